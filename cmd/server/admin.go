@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/files"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// defaultSignedURLTTL is used when a sign request does not specify a TTL
+const defaultSignedURLTTL = time.Hour
+
+// signURLRequest is the body of a POST to the sign-url admin endpoint
+type signURLRequest struct {
+	Path string `json:"path"`
+	// TTL is the lifetime of the URL in seconds
+	TTL int `json:"ttl,omitempty"`
+}
+
+// signURLResponse is returned by the sign-url admin endpoint
+type signURLResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// signURLHandler mints signed URLs for authorized admin clients
+func signURLHandler(getConfig func() *config.Config, getSigner func() *files.Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getConfig().Server.SignedURLs.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !validAdminToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http-mirror-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req signURLRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Path == "" {
+			http.Error(w, "Missing path", http.StatusBadRequest)
+			return
+		}
+
+		ttl := defaultSignedURLTTL
+		if req.TTL > 0 {
+			ttl = time.Duration(req.TTL) * time.Second
+		}
+
+		signedURL, expires, err := getSigner().Sign(req.Path, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The signature covers the path below the base path, which requests have removed
+		if base := httpPkg.BasePath(r); base != "" {
+			signedURL = (&url.URL{Path: base}).EscapedPath() + signedURL
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(signURLResponse{URL: signedURL, Expires: expires.UTC()})
+	}
+}
+
+// refreshStatsHandler has the sizes of the data path and all targets walked again
+// in the background for authorized admin clients. Sizes are served from the
+// previous walk until then.
+func refreshStatsHandler(getConfig func() *config.Config, refresh func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getConfig().Server.SignedURLs.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !validAdminToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http-mirror-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		refresh()
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// purgeResponse is returned by the target data admin endpoints
+type purgeResponse struct {
+	Name string `json:"name"`
+	// Action is "purge" or "reset"
+	Action string `json:"action"`
+	Files  int64  `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// purgeHandler deletes the directory of a target, or with reset only its metadata,
+// for authorized admin clients. The confirm parameter must repeat the target name.
+// afterChange is called once something was removed.
+func purgeHandler(getConfig func() *config.Config, reset bool, afterChange func(), logger *slog.Logger) http.HandlerFunc {
+	action := "purge"
+	if reset {
+		action = "reset"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		token := cfg.Server.SignedURLs.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !validAdminToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http-mirror-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		name := r.PathValue("name")
+		i := slices.IndexFunc(cfg.Targets, func(t config.Target) bool { return t.Name == name })
+		if i < 0 {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("confirm") != name {
+			http.Error(w, "confirm must repeat the target name", http.StatusBadRequest)
+			return
+		}
+
+		// A client going away must not leave a half-removed directory behind
+		ctx := context.WithoutCancel(r.Context())
+		target := cfg.Targets[i]
+		targetDir := filepath.Join(cfg.Server.DataPath, name)
+		manager := mirror.NewManager(cfg, logger)
+		var stats *mirror.PurgeStats
+		var err error
+		if reset {
+			stats, err = manager.Reset(ctx, &target, cfg.Server.DataPath, targetDir)
+		} else {
+			stats, err = manager.Purge(ctx, &target, cfg.Server.DataPath, targetDir)
+		}
+		if stats.Files > 0 {
+			afterChange()
+		}
+		switch {
+		case errors.Is(err, mirror.ErrSyncInProgress), errors.Is(err, mirror.ErrTargetFrozen):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			logger.Error("Failed to "+action+" target", "target", name, "files", stats.Files, "bytes", stats.Bytes, "error", err)
+			http.Error(w, "failed to "+action+" target", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("Target "+action+" requested through the admin API", "target", name, "files", stats.Files, "bytes", stats.Bytes)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(purgeResponse{Name: name, Action: action, Files: stats.Files, Bytes: stats.Bytes})
+	}
+}
+
+// configHandler reports the configuration in use, with secrets redacted, to
+// authorized admin clients, so that they can check which version is live
+func configHandler(getConfig func() *config.Config, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		token := cfg.Server.SignedURLs.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !validAdminToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="http-mirror-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		effective, err := cfg.Effective()
+		if err != nil {
+			logger.Error("Failed to report configuration", "error", err)
+			http.Error(w, "failed to report configuration", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(effective)
+	}
+}
+
+// validAdminToken checks the bearer token of r in constant time
+func validAdminToken(r *http.Request, token string) bool {
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
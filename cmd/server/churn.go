@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// churnEntry is a directory returned by /api/v1/targets/{name}/churn
+type churnEntry struct {
+	// Path is slash-separated and relative to the target URL
+	Path string `json:"path"`
+	// Changes counts the listings that differed from the previous one
+	Changes     int64     `json:"changes"`
+	LastChanged time.Time `json:"last_changed"`
+	LastListed  time.Time `json:"last_listed"`
+	// RunsUnchanged is the number of runs since the last change was seen
+	RunsUnchanged int64 `json:"runs_unchanged"`
+}
+
+// hotterThan orders churn entries by changes, then by the most recent change,
+// then by path
+func (e churnEntry) hotterThan(other churnEntry) bool {
+	if e.Changes != other.Changes {
+		return e.Changes > other.Changes
+	}
+	if !e.LastChanged.Equal(other.LastChanged) {
+		return e.LastChanged.After(other.LastChanged)
+	}
+	return e.Path < other.Path
+}
+
+// position returns the cursor position of the entry
+func (e churnEntry) position() string {
+	return strconv.FormatInt(e.Changes, 10) + " " + e.LastChanged.Format(time.RFC3339Nano) + " " + e.Path
+}
+
+// parseChurnPosition parses a cursor position into the entry it continues after
+func parseChurnPosition(position string) (churnEntry, bool) {
+	parts := strings.SplitN(position, " ", 3)
+	if len(parts) != 3 {
+		return churnEntry{}, false
+	}
+	changes, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return churnEntry{}, false
+	}
+	lastChanged, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil {
+		return churnEntry{}, false
+	}
+	return churnEntry{Path: parts[2], Changes: changes, LastChanged: lastChanged}, true
+}
+
+// churnHandler lists how often the listings of the directories of a target
+// changed, the most changing first and a page at a time
+func churnHandler(getConfig func() *config.Config, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		name := r.PathValue("name")
+		target, ok := servedTarget(cfg, name)
+		if !ok {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+
+		limit, cursor, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var after churnEntry
+		if cursor != "" {
+			if after, ok = parseChurnPosition(cursor); !ok {
+				http.Error(w, "invalid cursor parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		churn, err := mirror.LoadChurn(filepath.Join(cfg.Server.DataPath, target.Name))
+		if err != nil {
+			logger.Warn("Failed to read listing churn", "target", target.Name, "error", err)
+			http.Error(w, "failed to read listing churn", http.StatusInternalServerError)
+			return
+		}
+
+		hidden := cfg.HiddenPatterns(target.Name)
+		entries := make([]churnEntry, 0, len(churn.Directories))
+		for rel, dir := range churn.Directories {
+			if !listable(rel, hidden) {
+				continue
+			}
+			entry := churnEntry{Path: rel, Changes: dir.Changes, LastChanged: dir.LastChanged, LastListed: dir.LastListed,
+				RunsUnchanged: max(churn.Runs-dir.ChangedRun, 0)}
+			if cursor != "" && !after.hotterThan(entry) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		slices.SortFunc(entries, func(a, b churnEntry) int {
+			if a.hotterThan(b) {
+				return -1
+			}
+			return 1
+		})
+
+		var next string
+		if len(entries) > limit {
+			entries = entries[:limit]
+			next = entries[limit-1].position()
+		}
+
+		page := newPageWriter(w, target.Name)
+		for _, entry := range entries {
+			page.add(entry)
+		}
+		if err := page.finish(next, nil); err != nil {
+			logger.Debug("Failed to write churn response", "target", target.Name, "error", err)
+		}
+	}
+}
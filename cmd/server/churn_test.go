@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+func TestChurnHandler(t *testing.T) {
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "repo")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	churn := mirror.Churn{Runs: 10, LastFullScan: 8, Directories: map[string]*mirror.DirChurn{
+		"dists/stable": {Changes: 9, LastChanged: base.Add(time.Hour), ChangedRun: 10, ListedRun: 10},
+		"dists/old":    {Changes: 0, LastChanged: base, ChangedRun: 1, ListedRun: 8},
+		"pool/a":       {Changes: 2, LastChanged: base.Add(2 * time.Hour), ChangedRun: 7, ListedRun: 9},
+		"pool/b":       {Changes: 2, LastChanged: base.Add(2 * time.Hour), ChangedRun: 7, ListedRun: 9},
+		"pool/.git":    {Changes: 50, LastChanged: base, ChangedRun: 10, ListedRun: 10},
+	}}
+	data, _ := json.Marshal(churn)
+	if err := os.WriteFile(filepath.Join(targetDir, mirror.ChurnFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Server: config.Server{DataPath: dataPath}, Targets: []config.Target{{Name: "repo"}, {Name: "secret", Protected: true}}}
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/targets/{name}/churn", churnHandler(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+	var got []churnEntry
+	query := url.Values{"limit": {"2"}}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Too many pages")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets/repo/churn?"+query.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Page %d failed with %d", pages, w.Code)
+		}
+		var page struct {
+			Entries    []churnEntry `json:"entries"`
+			NextCursor *string      `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page.Entries...)
+		if page.NextCursor == nil {
+			break
+		}
+		query.Set("cursor", *page.NextCursor)
+	}
+
+	var paths []string
+	for _, entry := range got {
+		paths = append(paths, entry.Path)
+	}
+	if want := "[dists/stable pool/a pool/b dists/old]"; fmt.Sprint(paths) != want {
+		t.Fatalf("Expected the most changing directories first and hidden ones left out, got %v", paths)
+	}
+	if got[3].RunsUnchanged != 9 || got[0].RunsUnchanged != 0 || got[1].Changes != 2 {
+		t.Errorf("Unexpected entries %+v", got)
+	}
+
+	for _, tt := range []struct {
+		path string
+		code int
+	}{
+		{"/api/v1/targets/secret/churn", http.StatusNotFound},
+		{"/api/v1/targets/missing/churn", http.StatusNotFound},
+		{"/api/v1/targets/repo/churn?cursor=bm9wZQ", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/stats"
+)
+
+// dirStatsConcurrency is how many directories a size walk reads in parallel
+const dirStatsConcurrency = 4
+
+// globalStatsKey is the dirStatsStore key of the walk of the whole data path
+const globalStatsKey = "_global"
+
+// dirStatsSnapshot is a completed size walk
+type dirStatsSnapshot struct {
+	stats.DirStats
+	// At is when the walk completed and Duration how long it took
+	At       time.Time
+	Duration time.Duration
+}
+
+// age returns how old the snapshot is at now
+func (s dirStatsSnapshot) age(now time.Time) time.Duration {
+	return now.Sub(s.At)
+}
+
+// dirStatsStore keeps the latest completed size walk of each target, and of the
+// whole data path under globalStatsKey, so API requests do not walk the tree
+// themselves. Readers are answered from the last snapshot while a newer one is
+// being walked, and concurrent walks of the same key are merged into one.
+type dirStatsStore struct {
+	mu        sync.Mutex
+	snapshots map[string]dirStatsSnapshot
+	// expired are the keys to walk again on the next update regardless of age
+	expired  map[string]bool
+	inflight map[string]*dirStatsWalk
+	// onStale is called when a reader finds an outdated snapshot and no walk is
+	// running; nil leaves refreshing to the periodic update
+	onStale func()
+}
+
+// dirStatsWalk is a running walk other callers can wait for
+type dirStatsWalk struct {
+	done     chan struct{}
+	snapshot dirStatsSnapshot
+	err      error
+}
+
+// targetDirStats holds the size walks of the configured targets
+var targetDirStats = newDirStatsStore()
+
+// newDirStatsStore creates an empty store
+func newDirStatsStore() *dirStatsStore {
+	return &dirStatsStore{
+		snapshots: make(map[string]dirStatsSnapshot),
+		expired:   make(map[string]bool),
+		inflight:  make(map[string]*dirStatsWalk),
+	}
+}
+
+// get returns the latest snapshot of key, if any. An expired snapshot, or one older
+// than a positive ttl, triggers a refresh in the background.
+func (s *dirStatsStore) get(key string, ttl time.Duration) (dirStatsSnapshot, bool) {
+	s.mu.Lock()
+	snapshot, ok := s.snapshots[key]
+	stale := ok && (s.expired[key] || ttl > 0 && s.outdated(key, snapshot, ttl)) && len(s.inflight) == 0
+	onStale := s.onStale
+	s.mu.Unlock()
+
+	if stale && onStale != nil {
+		onStale()
+	}
+	return snapshot, ok
+}
+
+// outdated reports whether snapshot, the one of key, is due to be walked again;
+// s.mu must be held
+func (s *dirStatsStore) outdated(key string, snapshot dirStatsSnapshot, ttl time.Duration) bool {
+	return s.expired[key] || snapshot.age(time.Now()) >= ttl
+}
+
+// current returns the snapshot of key, walking it first with walk if there is none
+// or it is outdated
+func (s *dirStatsStore) current(key string, ttl time.Duration, walk func() (stats.DirStats, error)) (dirStatsSnapshot, error) {
+	s.mu.Lock()
+	snapshot, ok := s.snapshots[key]
+	due := !ok || s.outdated(key, snapshot, ttl)
+	s.mu.Unlock()
+	if !due {
+		return snapshot, nil
+	}
+	return s.refresh(key, walk)
+}
+
+// refresh walks key with walk and keeps the result, or forgets key if the walk
+// failed. If a walk of key is already running, it waits for that one instead.
+func (s *dirStatsStore) refresh(key string, walk func() (stats.DirStats, error)) (dirStatsSnapshot, error) {
+	s.mu.Lock()
+	if running, ok := s.inflight[key]; ok {
+		s.mu.Unlock()
+		<-running.done
+		return running.snapshot, running.err
+	}
+	running := &dirStatsWalk{done: make(chan struct{})}
+	s.inflight[key] = running
+	s.mu.Unlock()
+
+	start := time.Now()
+	result, err := walk()
+	running.snapshot = dirStatsSnapshot{DirStats: result, At: time.Now(), Duration: time.Since(start)}
+	running.err = err
+
+	s.mu.Lock()
+	delete(s.inflight, key)
+	delete(s.expired, key)
+	if err != nil {
+		delete(s.snapshots, key)
+	} else {
+		s.snapshots[key] = running.snapshot
+	}
+	s.mu.Unlock()
+	close(running.done)
+	return running.snapshot, running.err
+}
+
+// expire makes the next update walk every key again. The snapshots are still
+// served until then.
+func (s *dirStatsStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.snapshots {
+		s.expired[key] = true
+	}
+}
+
+// delete forgets the snapshot of key
+func (s *dirStatsStore) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots, key)
+	delete(s.expired, key)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/stats"
+)
+
+func TestDirStatsStoreSingleFlight(t *testing.T) {
+	store := newDirStatsStore()
+	release := make(chan struct{})
+	var walks atomic.Int32
+	walk := func() (stats.DirStats, error) {
+		walks.Add(1)
+		<-release
+		return stats.DirStats{Bytes: 42}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]dirStatsSnapshot, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = store.refresh("a", walk)
+		}()
+	}
+	// Let the callers pile up behind the first walk
+	for {
+		store.mu.Lock()
+		_, running := store.inflight["a"]
+		store.mu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := walks.Load(); n != 1 {
+		t.Errorf("Expected concurrent refreshes to walk once, walked %d times", n)
+	}
+	for _, result := range results {
+		if result.Bytes != 42 {
+			t.Errorf("Expected every caller to get the walk, got %+v", result)
+		}
+	}
+}
+
+func TestDirStatsStoreServesStale(t *testing.T) {
+	store := newDirStatsStore()
+	var stale atomic.Int32
+	store.onStale = func() { stale.Add(1) }
+
+	if _, ok := store.get("a", time.Minute); ok {
+		t.Fatal("Expected no snapshot before the first walk")
+	}
+	if _, err := store.current("a", time.Minute, func() (stats.DirStats, error) {
+		return stats.DirStats{Bytes: 1}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh snapshot is served as is and not walked again
+	if snapshot, ok := store.get("a", time.Minute); !ok || snapshot.Bytes != 1 {
+		t.Fatalf("Expected the snapshot, got %+v, %v", snapshot, ok)
+	}
+	snapshot, _ := store.current("a", time.Minute, func() (stats.DirStats, error) {
+		t.Error("Expected a fresh snapshot not to be walked")
+		return stats.DirStats{}, nil
+	})
+	if snapshot.Bytes != 1 || stale.Load() != 0 {
+		t.Fatalf("Expected the fresh snapshot without a refresh, got %+v and %d refreshes", snapshot, stale.Load())
+	}
+
+	// An outdated snapshot is still served, with a refresh in the background
+	store.mu.Lock()
+	old := store.snapshots["a"]
+	old.At = time.Now().Add(-2 * time.Minute)
+	store.snapshots["a"] = old
+	store.mu.Unlock()
+	if snapshot, ok := store.get("a", time.Minute); !ok || snapshot.Bytes != 1 || snapshot.age(time.Now()) < time.Minute {
+		t.Fatalf("Expected the outdated snapshot, got %+v, %v", snapshot, ok)
+	}
+	if stale.Load() != 1 {
+		t.Fatalf("Expected an outdated snapshot to trigger a refresh, got %d", stale.Load())
+	}
+
+	// While the refresh runs, readers get the old snapshot and trigger nothing more
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		store.refresh("a", func() (stats.DirStats, error) {
+			<-release
+			return stats.DirStats{Bytes: 2}, nil
+		})
+	}()
+	for {
+		store.mu.Lock()
+		n := len(store.inflight)
+		store.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if snapshot, _ := store.get("a", time.Minute); snapshot.Bytes != 1 {
+		t.Errorf("Expected the old snapshot during the walk, got %+v", snapshot)
+	}
+	if stale.Load() != 1 {
+		t.Errorf("Expected no further refresh while one is running, got %d", stale.Load())
+	}
+	close(release)
+	<-done
+	if snapshot, _ := store.get("a", time.Minute); snapshot.Bytes != 2 {
+		t.Errorf("Expected the new snapshot after the walk, got %+v", snapshot)
+	}
+
+	// Expired snapshots are refreshed regardless of their age, even without a TTL
+	store.expire()
+	if snapshot, ok := store.get("a", 0); !ok || snapshot.Bytes != 2 {
+		t.Errorf("Expected the expired snapshot to be served, got %+v, %v", snapshot, ok)
+	}
+	if stale.Load() != 2 {
+		t.Errorf("Expected an expired snapshot to trigger a refresh, got %d", stale.Load())
+	}
+
+	// A failed walk forgets the snapshot
+	if _, err := store.current("a", time.Minute, func() (stats.DirStats, error) {
+		return stats.DirStats{}, errors.New("boom")
+	}); err == nil {
+		t.Error("Expected the walk error")
+	}
+	if _, ok := store.get("a", time.Minute); ok {
+		t.Error("Expected a failed walk to drop the snapshot")
+	}
+}
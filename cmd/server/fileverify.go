@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+const (
+	// fileCheckCacheTTL is how long the result of a file check is served again
+	// instead of asking the upstream once more
+	fileCheckCacheTTL = time.Minute
+	// maxCachedFileChecks bounds the cache of file check results
+	maxCachedFileChecks = 1000
+	// maxFileCheckSample is the largest leading sample a file check fetches
+	maxFileCheckSample = 16 << 20
+)
+
+// fileCheckRate and fileCheckBurst limit the file checks that reach upstreams,
+// across all admin clients
+var (
+	fileCheckRate  = rate.Every(2 * time.Second)
+	fileCheckBurst = 5
+)
+
+// fileCheckRequest is the body of a POST to the verify admin endpoint
+type fileCheckRequest struct {
+	// Path is the URL path of a served file, e.g. /debian/dists/Release
+	Path string `json:"path"`
+	// Sample is the number of leading bytes compared with the upstream
+	Sample int64 `json:"sample,omitempty"`
+	// Checksums compares the sums the upstream publishes in its checksum lists
+	Checksums bool `json:"checksums,omitempty"`
+}
+
+// fileCheckResponse is returned by the verify admin endpoint
+type fileCheckResponse struct {
+	*mirror.FileCheck
+	// Cached is set if the result is that of an earlier request
+	Cached bool `json:"cached,omitempty"`
+}
+
+// cachedFileCheck is a file check result and when it expires
+type cachedFileCheck struct {
+	check   *mirror.FileCheck
+	expires time.Time
+}
+
+// fileChecker compares served files with their upstreams for authorized admin
+// clients. Results are cached briefly and fresh checks are rate limited, so the
+// endpoint cannot be used to hammer upstreams.
+type fileChecker struct {
+	getConfig func() *config.Config
+	logger    *slog.Logger
+	limiter   *rate.Limiter
+
+	mu    sync.Mutex
+	cache map[fileCheckRequest]cachedFileCheck
+}
+
+// newFileChecker creates the handler of the verify admin endpoint
+func newFileChecker(getConfig func() *config.Config, logger *slog.Logger) *fileChecker {
+	return &fileChecker{
+		getConfig: getConfig,
+		logger:    logger,
+		limiter:   rate.NewLimiter(fileCheckRate, fileCheckBurst),
+		cache:     make(map[fileCheckRequest]cachedFileCheck),
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (c *fileChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := c.getConfig()
+	token := cfg.Server.SignedURLs.AdminToken
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !validAdminToken(r, token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http-mirror-admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req fileCheckRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Sample < 0 || req.Sample > maxFileCheckSample {
+		http.Error(w, "sample must be between 0 and "+strconv.Itoa(maxFileCheckSample)+" bytes", http.StatusBadRequest)
+		return
+	}
+	name, rel, _ := strings.Cut(strings.TrimPrefix(req.Path, "/"), "/")
+	if name == "" || rel == "" {
+		http.Error(w, "Missing path", http.StatusBadRequest)
+		return
+	}
+	i := slices.IndexFunc(cfg.Targets, func(t config.Target) bool { return t.Name == name })
+	if i < 0 {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+
+	if check := c.cached(req); check != nil {
+		writeFileCheck(w, fileCheckResponse{FileCheck: check, Cached: true})
+		return
+	}
+	if reservation := c.limiter.Reserve(); reservation.Delay() > 0 {
+		reservation.Cancel()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reservation.Delay().Seconds()))))
+		http.Error(w, "Too many file checks", http.StatusTooManyRequests)
+		return
+	}
+
+	target := cfg.Targets[i]
+	manager := mirror.NewManager(cfg, c.logger)
+	check, err := manager.CheckFile(r.Context(), &target, filepath.Join(cfg.Server.DataPath, name), rel,
+		mirror.FileCheckOptions{Sample: req.Sample, Checksums: req.Checksums})
+	var pathErr *mirror.PathSecurityError
+	switch {
+	case errors.Is(err, mirror.ErrNotRecorded):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.As(err, &pathErr):
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	case err != nil:
+		c.logger.Error("Failed to check file", "target", name, "path", rel, "error", err)
+		http.Error(w, "failed to check file", http.StatusInternalServerError)
+		return
+	}
+
+	c.logger.Info("File checked through the admin API", "target", name, "path", check.Path, "verdict", check.Verdict)
+	c.store(req, check)
+	writeFileCheck(w, fileCheckResponse{FileCheck: check})
+}
+
+// cached returns the unexpired result of an earlier request like req, if any
+func (c *fileChecker) cached(req fileCheckRequest) *mirror.FileCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[req]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.check
+}
+
+// store caches the result of req, dropping expired results once the cache is
+// full; results that still do not fit are not cached
+func (c *fileChecker) store(req fileCheckRequest, check *mirror.FileCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.cache) >= maxCachedFileChecks {
+		for key, entry := range c.cache {
+			if now.After(entry.expires) {
+				delete(c.cache, key)
+			}
+		}
+	}
+	if len(c.cache) < maxCachedFileChecks {
+		c.cache[req] = cachedFileCheck{check: check, expires: now.Add(fileCheckCacheTTL)}
+	}
+}
+
+// writeFileCheck writes a file check result as JSON
+func writeFileCheck(w http.ResponseWriter, response fileCheckResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
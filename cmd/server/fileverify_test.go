@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+func TestFileChecker(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var heads atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+		http.ServeContent(w, r, "file.iso", modTime, strings.NewReader("content"))
+	}))
+	defer upstream.Close()
+
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "pub")
+	os.MkdirAll(targetDir, 0755)
+	os.WriteFile(filepath.Join(targetDir, "file.iso"), []byte("content"), 0644)
+	os.Chtimes(filepath.Join(targetDir, "file.iso"), modTime, modTime)
+	if err := mirror.RecordFile(targetDir, "file.iso", mirror.FileSource{URL: upstream.URL + "/file.iso", Size: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Server:  config.Server{DataPath: dataPath, SignedURLs: config.SignedURLs{AdminToken: "admin-token"}},
+		Targets: []config.Target{{Name: "pub", URL: upstream.URL + "/", Timeout: 5}},
+	}
+	checker := newFileChecker(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	checker.limiter = rate.NewLimiter(rate.Every(time.Hour), 2)
+	post := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/verify", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		checker.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tt := range []struct {
+		name, token, body string
+		status            int
+	}{
+		{"wrong token", "nope", `{"path":"/pub/file.iso"}`, http.StatusUnauthorized},
+		{"malformed body", "admin-token", `{`, http.StatusBadRequest},
+		{"missing path", "admin-token", `{"path":"/pub"}`, http.StatusBadRequest},
+		{"sample too large", "admin-token", `{"path":"/pub/file.iso","sample":1000000000}`, http.StatusBadRequest},
+		{"unknown target", "admin-token", `{"path":"/other/file.iso"}`, http.StatusNotFound},
+	} {
+		if w := post(tt.token, tt.body); w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.status, w.Code, w.Body.String())
+		}
+	}
+
+	// The first check asks the upstream, the second is answered from the cache
+	for i, cached := range []bool{false, true} {
+		w := post("admin-token", `{"path":"/pub/file.iso","sample":4}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Verdict string `json:"verdict"`
+			Cached  bool   `json:"cached"`
+			Local   struct {
+				SHA256 string `json:"sha256"`
+			} `json:"local"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if resp.Verdict != mirror.CheckMatch || resp.Cached != cached || resp.Local.SHA256 == "" {
+			t.Errorf("Check %d: expected a match, cached %t, got %+v", i, cached, resp)
+		}
+	}
+	if heads.Load() != 1 {
+		t.Errorf("Expected one upstream request, got %d", heads.Load())
+	}
+
+	// Fresh checks are rate limited
+	if w := post("admin-token", `{"path":"/pub/file.iso"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the burst to allow a second check, got %d", w.Code)
+	}
+	w := post("admin-token", `{"path":"/pub/file.iso","checksums":true}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d", w.Code)
+	}
+	if w := post("admin-token", `{"path":"/pub/missing.iso"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the limit to apply to every fresh check, got %d", w.Code)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inflightRequest tracks the progress of a single request being served
+type inflightRequest struct {
+	method  string
+	path    string
+	remote  string
+	start   time.Time
+	total   atomic.Int64 // declared Content-Length, -1 if unknown
+	written atomic.Int64
+}
+
+// remaining returns the bytes still to be sent, or -1 if the length is unknown
+func (r *inflightRequest) remaining() int64 {
+	total := r.total.Load()
+	if total < 0 {
+		return -1
+	}
+	return total - r.written.Load()
+}
+
+// inflightSnapshot summarizes the requests in flight at a point in time
+type inflightSnapshot struct {
+	Count             int
+	LargestPath       string
+	LargestRemote     string
+	LargestRemaining  int64
+	LargestDuration   time.Duration
+	UnknownLengthReqs int
+}
+
+// inflightTracker keeps track of requests currently being served
+type inflightTracker struct {
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]*inflightRequest
+	gauge    prometheus.Gauge
+}
+
+// newInflightTracker creates a tracker reporting into the given gauge (may be nil)
+func newInflightTracker(gauge prometheus.Gauge) *inflightTracker {
+	return &inflightTracker{
+		requests: make(map[uint64]*inflightRequest),
+		gauge:    gauge,
+	}
+}
+
+// Middleware wraps a handler so that every request is tracked while it is served
+func (t *inflightTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &inflightRequest{
+			method: r.Method,
+			path:   r.URL.Path,
+			remote: httpPkg.ClientIP(r),
+			start:  time.Now(),
+		}
+		req.total.Store(-1)
+
+		id := t.add(req)
+		defer t.remove(id)
+
+		next.ServeHTTP(&trackingResponseWriter{ResponseWriter: w, req: req}, r)
+	})
+}
+
+func (t *inflightTracker) add(req *inflightRequest) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextID++
+	t.requests[t.nextID] = req
+	if t.gauge != nil {
+		t.gauge.Inc()
+	}
+	return t.nextID
+}
+
+func (t *inflightTracker) remove(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.requests, id)
+	if t.gauge != nil {
+		t.gauge.Dec()
+	}
+}
+
+// Snapshot returns the current number of in-flight requests and the largest remaining transfer
+func (t *inflightTracker) Snapshot() inflightSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	snapshot := inflightSnapshot{
+		Count:            len(t.requests),
+		LargestRemaining: -1,
+	}
+
+	for _, req := range t.requests {
+		remaining := req.remaining()
+		if remaining < 0 {
+			snapshot.UnknownLengthReqs++
+			continue
+		}
+		if remaining > snapshot.LargestRemaining {
+			snapshot.LargestRemaining = remaining
+			snapshot.LargestPath = req.path
+			snapshot.LargestRemote = req.remote
+			snapshot.LargestDuration = time.Since(req.start)
+		}
+	}
+
+	return snapshot
+}
+
+// trackingResponseWriter records the declared and written length of a response
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	req         *inflightRequest
+	wroteHeader bool
+}
+
+func (w *trackingResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if cl := w.Header().Get("Content-Length"); cl != "" {
+			if size, err := strconv.ParseInt(cl, 10, 64); err == nil {
+				w.req.total.Store(size)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *trackingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.req.written.Add(int64(n))
+	return n, err
+}
+
+// Flush implements http.Flusher when the underlying writer supports it
+func (w *trackingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (w *trackingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInflightTrackerSnapshot(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_inflight"})
+	tracker := newInflightTracker(gauge)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := tracker.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+		w.Write(make([]byte, 400))
+		close(started)
+		<-release
+		w.Write(make([]byte, 600))
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/big.iso", nil))
+	}()
+
+	<-started
+	snapshot := tracker.Snapshot()
+	if snapshot.Count != 1 {
+		t.Errorf("Expected 1 in-flight request, got %d", snapshot.Count)
+	}
+	if snapshot.LargestRemaining != 600 {
+		t.Errorf("Expected 600 bytes remaining, got %d", snapshot.LargestRemaining)
+	}
+	if snapshot.LargestPath != "/big.iso" {
+		t.Errorf("Expected largest path /big.iso, got %s", snapshot.LargestPath)
+	}
+	if value := testutil.ToFloat64(gauge); value != 1 {
+		t.Errorf("Expected gauge value 1, got %v", value)
+	}
+
+	close(release)
+	<-done
+
+	if snapshot := tracker.Snapshot(); snapshot.Count != 0 {
+		t.Errorf("Expected no in-flight requests after completion, got %d", snapshot.Count)
+	}
+	if value := testutil.ToFloat64(gauge); value != 0 {
+		t.Errorf("Expected gauge value 0, got %v", value)
+	}
+}
+
+func TestInflightTrackerUnknownLength(t *testing.T) {
+	tracker := newInflightTracker(nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := tracker.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("streaming"))
+		close(started)
+		<-release
+	}))
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream", nil))
+
+	<-started
+	snapshot := tracker.Snapshot()
+	if snapshot.UnknownLengthReqs != 1 {
+		t.Errorf("Expected 1 request with unknown length, got %d", snapshot.UnknownLengthReqs)
+	}
+	if snapshot.LargestRemaining != -1 {
+		t.Errorf("Expected no known remaining transfer, got %d", snapshot.LargestRemaining)
+	}
+	close(release)
+}
+
+func TestDrainAndShutdown(t *testing.T) {
+	tracker := newInflightTracker(nil)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	started := make(chan struct{})
+	handler := tracker.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		close(started)
+		<-r.Context().Done()
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	start := time.Now()
+	err = drainAndShutdown(server, nil, tracker, 100*time.Millisecond, logger)
+	if err == nil {
+		t.Error("Expected drain timeout error while a request is still in flight")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown took too long: %v", elapsed)
+	}
+}
+
+func TestDrainAndShutdownIdle(t *testing.T) {
+	tracker := newInflightTracker(nil)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	server := &http.Server{Handler: tracker.Middleware(http.NotFoundHandler())}
+	go server.Serve(listener)
+
+	if err := drainAndShutdown(server, nil, tracker, time.Second, logger); err != nil {
+		t.Errorf("Expected clean shutdown with no in-flight requests, got %v", err)
+	}
+}
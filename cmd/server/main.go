@@ -2,57 +2,50 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/jhofer-cloud/http-mirror/pkg/config"
 	"github.com/jhofer-cloud/http-mirror/pkg/files"
-	"github.com/prometheus/client_golang/prometheus"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/jhofer-cloud/http-mirror/pkg/systemd"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	// Metrics for the mirror server
-	mirrorFilesTotal = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "http_mirror_files_total",
-			Help: "Total number of mirrored files",
-		},
-		[]string{"target", "data_path"},
-	)
-	mirrorDirectoriesTotal = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "http_mirror_directories_total",
-			Help: "Total number of mirrored directories",
-		},
-		[]string{"target", "data_path"},
-	)
-	mirrorSizeBytes = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "http_mirror_size_bytes",
-			Help: "Total size of mirrored data in bytes",
-		},
-		[]string{"target", "data_path"},
-	)
-)
+// writeTimeout bounds writing a response, or a single write of a throttled one
+const writeTimeout = 10 * time.Second
 
 func main() {
-	// Register Prometheus metrics
-	prometheus.MustRegister(mirrorFilesTotal)
-	prometheus.MustRegister(mirrorDirectoriesTotal)
-	prometheus.MustRegister(mirrorSizeBytes)
-
 	// Parse command line flags
 	configFile := flag.String("config", "", "Path to configuration file")
+	generateConfig := flag.String("generate-config", "", "Print an example configuration with every setting at its default, as \"yaml\" with comments or \"json\", then exit")
+	configSchema := flag.Bool("config-schema", false, "Print the JSON Schema of config files, then exit")
 	flag.Parse()
 
+	// The example and schema describe config files rather than the loaded one
+	if *generateConfig != "" || *configSchema {
+		var err error
+		if *generateConfig != "" {
+			err = config.WriteExample(os.Stdout, *generateConfig)
+		} else {
+			err = config.WriteSchema(os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write configuration documentation:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Setup logging
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
@@ -71,6 +64,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Register Prometheus metrics
+	serverMetrics, err := newMetrics(nil)
+	if err != nil {
+		logger.Error("Failed to register metrics", "error", err)
+		os.Exit(1)
+	}
+
+	// Pull-through downloads share the process-wide transfer limit
+	httpPkg.Transfers.SetLimit(cfg.Mirror.MaxOpenTransfers)
+
 	logger.Info("Starting HTTP Mirror Server",
 		"port", cfg.Server.Port,
 		"data_path", cfg.Server.DataPath)
@@ -81,60 +84,209 @@ func main() {
 		logger.Error("Failed to create file handler", "error", err)
 		os.Exit(1)
 	}
+	if err := fileHandler.StorageError(); err != nil {
+		logger.Warn("Data path unavailable, serving 503 until it is back", "data_path", cfg.Server.DataPath, "error", err)
+	}
+
+	// Client addresses honor forwarding headers only from trusted proxies
+	clientIPs, err := httpPkg.NewClientIPResolver(cfg.Server.TrustedProxies)
+	if err != nil {
+		logger.Error("Invalid trusted proxies", "error", err)
+		os.Exit(1)
+	}
+	var currentClientIPs atomic.Pointer[httpPkg.ClientIPResolver]
+	currentClientIPs.Store(clientIPs)
 
 	// Create HTTP server
 	mux := http.NewServeMux()
 
-	// File serving handler
-	mux.Handle("/", fileHandler)
+	// File serving handler, with the generated sitemaps in front
+	mux.Handle("/", targetSitemaps.Middleware(fileHandler))
 
 	// Health check endpoint
-	mux.HandleFunc("/health", healthCheckHandler)
+	mux.Handle("/health", healthCheckHandler(fileHandler.StorageError))
+
+	// Readiness fails while the data path is unavailable
+	mux.Handle("/ready", readyHandler(fileHandler.StorageError))
 
 	// Prometheus metrics endpoint
 	mux.Handle("/metrics", promhttp.Handler())
 
-	// Wrap with security headers middleware
-	handler := securityHeadersMiddleware(mux)
+	// The active configuration can be swapped on SIGHUP
+	var currentConfig atomic.Pointer[config.Config]
+	currentConfig.Store(cfg)
+
+	// Sync status of all targets
+	mux.Handle("/api/v1/targets", targetsHandler(currentConfig.Load, logger))
+
+	// Syncs in progress, with the estimated progress of first runs
+	mux.Handle("GET /api/v1/runs", runsHandler(currentConfig.Load, mirror.Runs, logger))
+
+	// Extension and size breakdown of a target
+	mux.Handle("GET /api/v1/targets/{name}/breakdown", breakdownHandler(currentConfig.Load))
+
+	// Paginated file tree and recent downloads of a target
+	mux.Handle("GET /api/v1/targets/{name}/tree", treeHandler(currentConfig.Load, logger))
+	mux.Handle("GET /api/v1/targets/{name}/recent", recentHandler(currentConfig.Load, logger))
+
+	// How often the listings of the directories of a target change
+	mux.Handle("GET /api/v1/targets/{name}/churn", churnHandler(currentConfig.Load, logger))
+
+	// Transfer accounting and monthly budget
+	mux.Handle("/api/v1/usage", usageHandler(currentConfig.Load, logger))
+
+	// Upstream origin of individual files
+	mux.Handle("/api/v1/file-info", fileHandler.FileInfoAPI())
+
+	// Newest version behind each latest link
+	mux.Handle("/api/v1/latest", fileHandler.LatestAPI())
+
+	// Admin API for minting signed download links
+	mux.Handle("/api/v1/admin/sign-url", signURLHandler(currentConfig.Load, fileHandler.Signer))
+
+	// Admin API reporting the configuration in use, with secrets redacted
+	mux.Handle("GET /api/v1/config", configHandler(currentConfig.Load, logger))
+
+	// Admin API for decommissioning a target or forcing a full re-check; metrics
+	// and sizes are refreshed right away instead of once they are outdated
+	refreshMetrics := func() {
+		targetDirStats.expire()
+		go serverMetrics.update(currentConfig.Load(), logger)
+	}
+	mux.Handle("DELETE /api/v1/targets/{name}/data", purgeHandler(currentConfig.Load, false, refreshMetrics, logger))
+	mux.Handle("DELETE /api/v1/targets/{name}/metadata", purgeHandler(currentConfig.Load, true, refreshMetrics, logger))
+
+	// Admin API for walking all sizes again, e.g. after manual changes to the volume
+	mux.Handle("POST /api/v1/admin/refresh-stats", refreshStatsHandler(currentConfig.Load, refreshMetrics))
+
+	// Admin API comparing a served file with its upstream, e.g. after reports of
+	// corrupt downloads
+	mux.Handle("POST /api/v1/verify", newFileChecker(currentConfig.Load, logger))
+
+	// Readers of outdated sizes are answered right away and trigger a walk
+	targetDirStats.onStale = func() { go serverMetrics.update(currentConfig.Load(), logger) }
+
+	// Responses are throttled by the rate tier of their request
+	tiers, err := newRateTiers(cfg.Server)
+	if err != nil {
+		logger.Error("Invalid rate tiers", "error", err)
+		os.Exit(1)
+	}
+	gate := &rateTierGate{clientIPs: currentClientIPs.Load, signer: fileHandler.Signer, metrics: serverMetrics, logger: logger, writeTimeout: writeTimeout}
+	gate.tiers.Store(tiers)
+
+	// Wrap with client address resolution, base path removal, security headers
+	// middleware, in-flight tracking and rate tiers
+	tracker := newInflightTracker(serverMetrics.inflightRequests)
+	basePath := func() string { return currentConfig.Load().Server.BasePath }
+	handler := httpPkg.ClientIPMiddleware(currentClientIPs.Load,
+		httpPkg.BasePathMiddleware(basePath, currentClientIPs.Load, tracker.Middleware(gate.Middleware(securityHeadersMiddleware(mux)))))
 
 	// Initialize metrics immediately
-	updateMetrics(cfg, logger)
+	serverMetrics.storage = fileHandler.StorageError
+	serverMetrics.update(cfg, logger)
 
 	// Start metrics updater
-	go updateMetricsLoop(cfg, logger)
+	go serverMetrics.updateLoop(currentConfig.Load, logger)
+
+	// HTTP/3 shares the handler and is advertised to TCP clients via Alt-Svc
+	h3, err := startHTTP3(cfg.Server, handler, logger)
+	if err != nil {
+		logger.Error("Failed to start HTTP/3 server", "error", err)
+		os.Exit(1)
+	}
+	tcpHandler := handler
+	if h3 != nil {
+		tcpHandler = altSvcMiddleware(cfg.Server.GetHTTP3Port(), handler)
+	}
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
-		Handler: handler,
+		Handler: tcpHandler,
+
+		// Requests sent over one connection share its rate tier limiters
+		ConnContext: gate.ConnContext,
 
 		// Security settings
 		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      10 * time.Second,
+		WriteTimeout:      writeTimeout,
 		IdleTimeout:       60 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
+	// Listen before notifying systemd so readiness means "accepting connections".
+	// After a graceful restart the socket is inherited from the previous process.
+	inherited, err := inheritListeners()
+	if err != nil {
+		logger.Error("Failed to inherit listeners", "error", err)
+		os.Exit(1)
+	}
+	listener, err := inherited.listen("public", server.Addr)
+	if err != nil {
+		logger.Error("Server failed to start", "error", err)
+		os.Exit(1)
+	}
+
 	// Start server in goroutine
 	go func() {
-		logger.Info("Server starting", "address", server.Addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("Server starting", "address", server.Addr, "tls", cfg.Server.TLS.Enabled())
+		serve := func() error { return server.Serve(listener) }
+		if tls := cfg.Server.TLS; tls.Enabled() {
+			serve = func() error { return server.ServeTLS(listener, tls.CertFile, tls.KeyFile) }
+		}
+		if err := serve(); err != nil && err != http.ErrServerClosed {
 			logger.Error("Server failed to start", "error", err)
 			os.Exit(1)
 		}
 	}()
 
-	// Wait for interrupt signal
+	// Signal readiness and start the watchdog when running under systemd
+	notifier := systemd.NewNotifier()
+	if err := notifier.Ready(); err != nil {
+		logger.Warn("Failed to notify systemd of readiness", "error", err)
+	}
+	if err := inherited.signalReady(); err != nil {
+		logger.Error("Failed to signal readiness to previous process", "error", err)
+		os.Exit(1)
+	}
+
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	if interval := notifier.WatchdogInterval(); interval > 0 {
+		logger.Info("Systemd watchdog enabled", "interval", interval)
+		go notifier.RunWatchdog(watchdogCtx, func() bool {
+			return isHealthy(currentConfig.Load().Server.DataPath)
+		})
+	}
+
+	// Wait for interrupt signal, reloading configuration on SIGHUP and handing the
+	// listeners to a new binary on SIGUSR2
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	handedOver := false
+wait:
+	for sig := range quit {
+		switch sig {
+		case syscall.SIGHUP:
+			reloadConfig(notifier, fileHandler, serverMetrics, &currentConfig, &currentClientIPs, gate, logger)
+		case syscall.SIGUSR2:
+			if restart(notifier, h3, []namedListener{{"public", listener}}, logger) {
+				handedOver = true
+				break wait
+			}
+		default:
+			break wait
+		}
+	}
 
 	logger.Info("Server shutting down...")
+	if !handedOver {
+		// After a restart the service keeps running in the successor
+		notifier.Stopping()
+	}
+	stopWatchdog()
 
-	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
+	if err := drainAndShutdown(server, h3, tracker, currentConfig.Load().Server.GetDrainTimeout(), logger); err != nil {
 		logger.Error("Server forced to shutdown", "error", err)
 		os.Exit(1)
 	}
@@ -142,113 +294,167 @@ func main() {
 	logger.Info("Server stopped")
 }
 
-// healthCheckHandler handles health check requests
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, `{"status":"healthy","service":"http-mirror-server"}`)
-}
+// restart starts the current binary as a successor serving the given listeners and
+// reports whether it is ready, in which case this process should drain and exit
+func restart(notifier *systemd.Notifier, h3 quicServer, listeners []namedListener, logger *slog.Logger) bool {
+	if h3 != nil {
+		logger.Error("Graceful restart is not supported with HTTP/3 enabled")
+		return false
+	}
+	path, err := os.Executable()
+	if err != nil {
+		logger.Error("Graceful restart failed", "error", err)
+		return false
+	}
 
-// updateMetricsLoop periodically updates Prometheus metrics
-func updateMetricsLoop(cfg *config.Config, logger *slog.Logger) {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+	logger.Info("Graceful restart requested", "binary", path)
+	successor, err := startSuccessor(path, os.Args[1:], listeners, logger)
+	if err != nil {
+		logger.Error("Graceful restart failed, continuing to serve", "error", err)
+		return false
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			updateMetrics(cfg, logger)
-		}
+	// systemd follows the successor as main process (requires NotifyAccess=all)
+	if err := notifier.Notify(fmt.Sprintf("MAINPID=%d", successor.Pid)); err != nil {
+		logger.Warn("Failed to notify systemd of new main process", "error", err)
 	}
+	logger.Info("Successor ready, handing over", "pid", successor.Pid)
+	return true
 }
 
-// updateMetrics calculates and updates Prometheus metrics
-func updateMetrics(cfg *config.Config, logger *slog.Logger) {
-	// Update global metrics for the entire data path
-	globalStats, err := getDirStats(cfg.Server.DataPath)
-	if err != nil {
-		logger.Warn("Failed to update global metrics", "error", err)
-	} else {
-		dataPath := cfg.Server.DataPath
+// drainAndShutdown stops accepting new connections and waits up to drainTimeout for
+// in-flight requests to complete before closing the remaining connections forcibly.
+// The optional QUIC server is drained alongside the TCP server.
+func drainAndShutdown(server *http.Server, h3 quicServer, tracker *inflightTracker, drainTimeout time.Duration, logger *slog.Logger) error {
+	logInflight(tracker, "Draining in-flight requests", logger, "drain_timeout", drainTimeout)
 
-		if files, ok := globalStats["files"].(int); ok {
-			mirrorFilesTotal.WithLabelValues("_global", dataPath).Set(float64(files))
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
 
-		if dirs, ok := globalStats["directories"].(int); ok {
-			mirrorDirectoriesTotal.WithLabelValues("_global", dataPath).Set(float64(dirs))
+	// Report progress periodically while long transfers drain
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logInflight(tracker, "Still draining in-flight requests", logger)
+			}
 		}
+	}()
 
-		if size, ok := globalStats["total_size_bytes"].(int64); ok {
-			mirrorSizeBytes.WithLabelValues("_global", dataPath).Set(float64(size))
-		}
+	h3Done := make(chan error, 1)
+	if h3 != nil {
+		go func() { h3Done <- h3.Shutdown(ctx) }()
+	} else {
+		h3Done <- nil
 	}
 
-	// Update per-target metrics
-	for _, target := range cfg.Targets {
-		targetPath := filepath.Join(cfg.Server.DataPath, target.Name)
-		targetStats, err := getDirStats(targetPath)
-		if err != nil {
-			logger.Warn("Failed to update target metrics", "target", target.Name, "error", err)
-			// Set zero values for missing targets
-			mirrorFilesTotal.WithLabelValues(target.Name, targetPath).Set(0)
-			mirrorDirectoriesTotal.WithLabelValues(target.Name, targetPath).Set(0)
-			mirrorSizeBytes.WithLabelValues(target.Name, targetPath).Set(0)
-			continue
-		}
-
-		if files, ok := targetStats["files"].(int); ok {
-			mirrorFilesTotal.WithLabelValues(target.Name, targetPath).Set(float64(files))
-		}
+	err := server.Shutdown(ctx)
+	if h3Err := <-h3Done; err == nil {
+		err = h3Err
+	}
+	if err == nil {
+		return nil
+	}
 
-		if dirs, ok := targetStats["directories"].(int); ok {
-			mirrorDirectoriesTotal.WithLabelValues(target.Name, targetPath).Set(float64(dirs))
-		}
+	logInflight(tracker, "Drain timeout reached, dropping in-flight requests", logger)
+	if h3 != nil {
+		h3.Close()
+	}
+	if closeErr := server.Close(); closeErr != nil {
+		return closeErr
+	}
+	return err
+}
 
-		if size, ok := targetStats["total_size_bytes"].(int64); ok {
-			mirrorSizeBytes.WithLabelValues(target.Name, targetPath).Set(float64(size))
-		}
+// logInflight logs a summary of the requests currently in flight
+func logInflight(tracker *inflightTracker, msg string, logger *slog.Logger, args ...any) {
+	snapshot := tracker.Snapshot()
+	args = append(args,
+		"inflight_requests", snapshot.Count,
+		"unknown_length_requests", snapshot.UnknownLengthReqs)
+	if snapshot.LargestRemaining >= 0 {
+		args = append(args,
+			"largest_remaining_bytes", snapshot.LargestRemaining,
+			"largest_remaining_path", snapshot.LargestPath,
+			"largest_remaining_client", snapshot.LargestRemote,
+			"largest_remaining_elapsed", snapshot.LargestDuration)
 	}
+	logger.Info(msg, args...)
 }
 
-// getDirStats returns basic statistics about a directory
-func getDirStats(dirPath string) (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+// reloadConfig reloads the configuration and applies it to the running server
+func reloadConfig(notifier *systemd.Notifier, fileHandler *files.Handler, serverMetrics *metrics, current *atomic.Pointer[config.Config], clientIPs *atomic.Pointer[httpPkg.ClientIPResolver], gate *rateTierGate, logger *slog.Logger) {
+	logger.Info("Reloading configuration")
+	notifier.Reloading()
+	defer notifier.Ready()
 
-	// Check if directory exists
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		return stats, fmt.Errorf("directory does not exist: %s", dirPath)
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		logger.Error("Failed to reload configuration, keeping previous", "error", err)
+		return
+	}
+	resolver, err := httpPkg.NewClientIPResolver(cfg.Server.TrustedProxies)
+	if err != nil {
+		logger.Error("Invalid trusted proxies, keeping previous configuration", "error", err)
+		return
+	}
+	tiers, err := newRateTiers(cfg.Server)
+	if err != nil {
+		logger.Error("Invalid rate tiers, keeping previous configuration", "error", err)
+		return
 	}
 
-	// Count files and directories
-	fileCount := 0
-	dirCount := 0
-	var totalSize int64
+	clientIPs.Store(resolver)
+	gate.tiers.Store(tiers)
 
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	current.Store(cfg)
+	httpPkg.Transfers.SetLimit(cfg.Mirror.MaxOpenTransfers)
+	fileHandler.SetConfig(cfg)
+	targetDirStats.expire()
+	serverMetrics.update(cfg, logger)
 
-		if info.IsDir() {
-			dirCount++
-		} else {
-			fileCount++
-			totalSize += info.Size()
-		}
+	logger.Info("Configuration reloaded", "targets", len(cfg.Targets))
+}
 
-		return nil
-	})
+// isHealthy reports whether the server can still access its data path
+func isHealthy(dataPath string) bool {
+	_, err := os.Stat(dataPath)
+	return err == nil
+}
 
-	if err != nil {
-		return stats, err
+// healthCheckHandler handles health check requests. The server stays healthy
+// while its storage is unavailable, which is reported as well.
+func healthCheckHandler(storageErr func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		storage := "available"
+		if storageErr() != nil {
+			storage = "unavailable"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"status":"healthy","service":"http-mirror-server","storage":%q}`, storage)
 	}
+}
 
-	stats["files"] = fileCount
-	stats["directories"] = dirCount
-	stats["total_size_bytes"] = totalSize
-
-	return stats, nil
+// readyHandler handles readiness checks, which fail while the storage is
+// unavailable so that load balancers route around the server
+func readyHandler(storageErr func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := storageErr(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "unavailable", "storage": "unavailable", "error": err.Error()})
+			return
+		}
+		fmt.Fprint(w, `{"status":"ready","storage":"available"}`)
+	}
 }
 
 // securityHeadersMiddleware adds security headers to all responses
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +13,7 @@ import (
 	"testing"
 
 	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -18,7 +21,7 @@ func TestHealthCheckHandler(t *testing.T) {
 	req := httptest.NewRequest("GET", "/health", nil)
 	w := httptest.NewRecorder()
 
-	healthCheckHandler(w, req)
+	healthCheckHandler(func() error { return nil })(w, req)
 
 	resp := w.Result()
 	if resp.StatusCode != http.StatusOK {
@@ -43,6 +46,32 @@ func TestHealthCheckHandler(t *testing.T) {
 	if response["service"] != "http-mirror-server" {
 		t.Errorf("Expected service 'http-mirror-server', got %s", response["service"])
 	}
+
+	if response["storage"] != "available" {
+		t.Errorf("Expected storage 'available', got %s", response["storage"])
+	}
+}
+
+func TestHealthAndReadinessWithUnavailableStorage(t *testing.T) {
+	storageErr := func() error { return errors.New("stale file handle") }
+
+	w := httptest.NewRecorder()
+	healthCheckHandler(storageErr)(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"storage":"unavailable"`) {
+		t.Errorf("Expected a healthy server reporting unavailable storage, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	readyHandler(storageErr)(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "stale file handle") {
+		t.Errorf("Expected readiness to fail, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	readyHandler(func() error { return nil })(w, httptest.NewRequest("GET", "/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected readiness with available storage, got %d", w.Code)
+	}
 }
 
 func TestMetricsEndpoint(t *testing.T) {
@@ -81,13 +110,18 @@ func TestMetricsEndpoint(t *testing.T) {
 	}
 
 	// Update metrics first
-	updateMetrics(cfg, slog.Default())
+	reg := prometheus.NewRegistry()
+	m, err := newMetrics(reg)
+	if err != nil {
+		t.Fatalf("Failed to create metrics: %v", err)
+	}
+	m.update(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
 
 	// Test the metrics endpoint
 	req := httptest.NewRequest("GET", "/metrics", nil)
 	w := httptest.NewRecorder()
 
-	promhttp.Handler().ServeHTTP(w, req)
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, req)
 
 	resp := w.Result()
 	if resp.StatusCode != http.StatusOK {
@@ -95,64 +129,16 @@ func TestMetricsEndpoint(t *testing.T) {
 	}
 
 	body := w.Body.String()
-	// Check for Prometheus format response rather than specific metric since it might not be registered in test
-	if !strings.Contains(body, "HELP") && !strings.Contains(body, "TYPE") {
-		t.Error("Expected metrics endpoint to return Prometheus format data")
-	}
-}
-
-func TestGetDirStats(t *testing.T) {
-	tempDir := t.TempDir()
-
-	// Create test files and directories
-	testFile1 := filepath.Join(tempDir, "file1.txt")
-	testFile2 := filepath.Join(tempDir, "file2.txt")
-	testDir := filepath.Join(tempDir, "subdir")
-
-	err := os.WriteFile(testFile1, []byte("content1"), 0644)
-	if err != nil {
-		t.Fatalf("Failed to create test file1: %v", err)
-	}
-
-	err = os.WriteFile(testFile2, []byte("content2"), 0644)
-	if err != nil {
-		t.Fatalf("Failed to create test file2: %v", err)
-	}
-
-	err = os.Mkdir(testDir, 0755)
-	if err != nil {
-		t.Fatalf("Failed to create test directory: %v", err)
-	}
-
-	stats, err := getDirStats(tempDir)
-	if err != nil {
-		t.Fatalf("getDirStats failed: %v", err)
-	}
-
-	// Check file count (should be 2)
-	if fileCount, ok := stats["files"].(int); !ok || fileCount != 2 {
-		t.Errorf("Expected 2 files, got %v", stats["files"])
-	}
-
-	// Check directory count (should be 2: root dir + subdir we created)
-	if dirCount, ok := stats["directories"].(int); !ok || dirCount != 2 {
-		t.Errorf("Expected 2 directories (root + subdir), got %v", stats["directories"])
-	}
-
-	// Check total size
-	if totalSize, ok := stats["total_size_bytes"].(int64); !ok || totalSize != 16 {
-		t.Errorf("Expected total size 16 bytes, got %v", stats["total_size_bytes"])
-	}
-}
-
-func TestGetDirStatsNonExistentDir(t *testing.T) {
-	stats, err := getDirStats("/nonexistent/directory")
-	if err == nil {
-		t.Error("Expected error for non-existent directory")
-	}
-
-	if stats == nil {
-		t.Error("Stats map should not be nil even on error")
+	for _, series := range []string{
+		`http_mirror_files_total{target="_global"} 2`,
+		`http_mirror_files_total{target="example-target"} 1`,
+		`http_mirror_size_bytes{target="example-target"} 14`,
+		`http_mirror_staleness_seconds{target="example-target"} +Inf`,
+		`http_mirror_monthly_byte_cap_bytes 0`,
+	} {
+		if !strings.Contains(body, series+"\n") {
+			t.Errorf("Expected series %s in metrics output:\n%s", series, body)
+		}
 	}
 }
 
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherTarget is the target label the series of the targets beyond
+// Server.MetricsTargetLimit are summed up under
+const otherTarget = "_other"
+
+// labelSep joins the label values of a series into a map key
+const labelSep = "\xff"
+
+// targetLabels returns the target label of every configured target, its name or
+// otherTarget, and the number of targets collapsed into otherTarget
+func targetLabels(cfg *config.Config) (map[string]string, int) {
+	labels := make(map[string]string, len(cfg.Targets))
+	collapsed := 0
+	for _, target := range cfg.Targets {
+		if cfg.Server.OwnMetricsSeries(target.Name, len(cfg.Targets)) {
+			labels[target.Name] = target.Name
+		} else {
+			labels[target.Name] = otherTarget
+			collapsed++
+		}
+	}
+	return labels, collapsed
+}
+
+// gaugeBatch collects the per-target values of a metrics update to set them at
+// once. Values of targets sharing a label, i.e. those collapsed into otherTarget,
+// are summed up, or the highest is kept for the vecs in max.
+type gaugeBatch struct {
+	values map[*prometheus.GaugeVec]map[string]float64
+	max    map[*prometheus.GaugeVec]bool
+}
+
+// newGaugeBatch creates an empty batch keeping the highest value for max
+func newGaugeBatch(max ...*prometheus.GaugeVec) *gaugeBatch {
+	b := &gaugeBatch{
+		values: make(map[*prometheus.GaugeVec]map[string]float64),
+		max:    make(map[*prometheus.GaugeVec]bool, len(max)),
+	}
+	for _, vec := range max {
+		b.max[vec] = true
+	}
+	return b
+}
+
+// add adds value to the series of vec with labels
+func (b *gaugeBatch) add(vec *prometheus.GaugeVec, value float64, labels ...string) {
+	series := b.values[vec]
+	if series == nil {
+		series = make(map[string]float64)
+		b.values[vec] = series
+	}
+	key := strings.Join(labels, labelSep)
+	previous, ok := series[key]
+	switch {
+	case !ok:
+		series[key] = value
+	case b.max[vec]:
+		series[key] = max(previous, value)
+	default:
+		series[key] = previous + value
+	}
+}
+
+// setTargetSeries sets the series of batch and deletes those of vecs the previous
+// batch set but batch does not, e.g. of removed or collapsed targets; m.seriesMu
+// must be held
+func (m *metrics) setTargetSeries(batch *gaugeBatch, vecs ...*prometheus.GaugeVec) {
+	for _, vec := range vecs {
+		for key := range m.targetSeries[vec] {
+			if _, ok := batch.values[vec][key]; !ok {
+				vec.DeleteLabelValues(strings.Split(key, labelSep)...)
+			}
+		}
+		for key, value := range batch.values[vec] {
+			vec.WithLabelValues(strings.Split(key, labelSep)...).Set(value)
+		}
+	}
+	m.targetSeries = batch.values
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/files"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/jhofer-cloud/http-mirror/pkg/stats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus metrics of the mirror server
+type metrics struct {
+	filesTotal       *prometheus.GaugeVec
+	directoriesTotal *prometheus.GaugeVec
+	sizeBytes        *prometheus.GaugeVec
+	stalenessSeconds *prometheus.GaugeVec
+	lastRunListings  *prometheus.GaugeVec
+	transferredBytes *prometheus.GaugeVec
+	extensionFiles   *prometheus.GaugeVec
+	extensionBytes   *prometheus.GaugeVec
+	sizeBucketFiles  *prometheus.GaugeVec
+	sizeBucketBytes  *prometheus.GaugeVec
+	monthlyByteCap   prometheus.Gauge
+	inflightRequests prometheus.Gauge
+	storageAvailable prometheus.Gauge
+	tierRequests     *prometheus.CounterVec
+	tierBytes        *prometheus.CounterVec
+	statsAge         *prometheus.GaugeVec
+	statsDuration    *prometheus.GaugeVec
+	// storage reports whether the data path can be read; nil if unknown
+	storage func() error
+
+	// seriesMu serializes setting the per-target series, which targetSeries holds
+	// the values of as set by the last update
+	seriesMu     sync.Mutex
+	targetSeries map[*prometheus.GaugeVec]map[string]float64
+	// collapseWarned is set once collapsing targets into otherTarget was logged
+	collapseWarned atomic.Bool
+}
+
+// newMetrics creates the server metrics and registers them with reg, or with the
+// global registry if reg is nil. Metrics that are already registered, e.g. by a
+// second server in the same process, are shared instead of causing an error.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &metrics{
+		filesTotal: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_files_total",
+				Help: "Total number of mirrored files",
+			},
+			[]string{"target"},
+		),
+		directoriesTotal: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_directories_total",
+				Help: "Total number of mirrored directories",
+			},
+			[]string{"target"},
+		),
+		sizeBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_size_bytes",
+				Help: "Total size of mirrored data in bytes",
+			},
+			[]string{"target"},
+		),
+		stalenessSeconds: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_staleness_seconds",
+				Help: "Seconds since the start of the last successful sync; +Inf if the target never synced",
+			},
+			[]string{"target"},
+		),
+		lastRunListings: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_last_run_listings",
+				Help: "Directory listings parsed by the last run, by outcome (parsed, empty, unrecognized)",
+			},
+			[]string{"target", "outcome"},
+		),
+		transferredBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_transferred_bytes",
+				Help: "Bytes downloaded from upstream, by target (_global for all) and period (month or lifetime)",
+			},
+			[]string{"target", "period"},
+		),
+		extensionFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_extension_files",
+				Help: "Mirrored files by extension; extensions outside the configured list are counted as other",
+			},
+			[]string{"target", "extension"},
+		),
+		extensionBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_extension_bytes",
+				Help: "Size of mirrored files in bytes by extension; extensions outside the configured list are counted as other",
+			},
+			[]string{"target", "extension"},
+		),
+		sizeBucketFiles: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_size_bucket_files",
+				Help: "Mirrored files by size bucket, labeled with the bucket's upper bound",
+			},
+			[]string{"target", "bucket"},
+		),
+		sizeBucketBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_size_bucket_bytes",
+				Help: "Size of mirrored files in bytes by size bucket, labeled with the bucket's upper bound",
+			},
+			[]string{"target", "bucket"},
+		),
+		monthlyByteCap: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_monthly_byte_cap_bytes",
+				Help: "Configured monthly download budget in bytes; 0 if unlimited",
+			},
+		),
+		inflightRequests: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_inflight_requests",
+				Help: "Number of requests currently being served",
+			},
+		),
+		storageAvailable: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_storage_available",
+				Help: "Whether the data path can be read (1) or requests are answered with 503 (0)",
+			},
+		),
+		tierRequests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_mirror_rate_tier_requests_total",
+				Help: "Requests by rate tier (none if no tier matched) and outcome (served, or rejected over the concurrency cap)",
+			},
+			[]string{"tier", "outcome"},
+		),
+		tierBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_mirror_rate_tier_bytes_total",
+				Help: "Response bytes written under each rate tier",
+			},
+			[]string{"tier"},
+		),
+		statsAge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_stats_age_seconds",
+				Help: "Age of the size walk served for a target (_global for the data path) as of the last metrics update",
+			},
+			[]string{"target"},
+		),
+		statsDuration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_mirror_stats_refresh_duration_seconds",
+				Help: "How long the last size walk of a target (_global for the data path) took",
+			},
+			[]string{"target"},
+		),
+	}
+
+	var err error
+	register := func(c prometheus.Collector) prometheus.Collector {
+		if regErr := reg.Register(c); regErr != nil {
+			var already prometheus.AlreadyRegisteredError
+			if errors.As(regErr, &already) {
+				return already.ExistingCollector
+			}
+			err = errors.Join(err, regErr)
+		}
+		return c
+	}
+	m.filesTotal = register(m.filesTotal).(*prometheus.GaugeVec)
+	m.directoriesTotal = register(m.directoriesTotal).(*prometheus.GaugeVec)
+	m.sizeBytes = register(m.sizeBytes).(*prometheus.GaugeVec)
+	m.stalenessSeconds = register(m.stalenessSeconds).(*prometheus.GaugeVec)
+	m.lastRunListings = register(m.lastRunListings).(*prometheus.GaugeVec)
+	m.transferredBytes = register(m.transferredBytes).(*prometheus.GaugeVec)
+	m.extensionFiles = register(m.extensionFiles).(*prometheus.GaugeVec)
+	m.extensionBytes = register(m.extensionBytes).(*prometheus.GaugeVec)
+	m.sizeBucketFiles = register(m.sizeBucketFiles).(*prometheus.GaugeVec)
+	m.sizeBucketBytes = register(m.sizeBucketBytes).(*prometheus.GaugeVec)
+	m.monthlyByteCap = register(m.monthlyByteCap).(prometheus.Gauge)
+	m.inflightRequests = register(m.inflightRequests).(prometheus.Gauge)
+	m.storageAvailable = register(m.storageAvailable).(prometheus.Gauge)
+	m.tierRequests = register(m.tierRequests).(*prometheus.CounterVec)
+	m.tierBytes = register(m.tierBytes).(*prometheus.CounterVec)
+	m.statsAge = register(m.statsAge).(*prometheus.GaugeVec)
+	m.statsDuration = register(m.statsDuration).(*prometheus.GaugeVec)
+	register(files.SignatureRejections)
+	register(files.PullThroughFetches)
+	register(files.PathRejections)
+	register(httpPkg.TransferGauge)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// countTierRequest counts a request of a rate tier; m may be nil
+func (m *metrics) countTierRequest(tier, outcome string) {
+	if m != nil {
+		m.tierRequests.WithLabelValues(tier, outcome).Inc()
+	}
+}
+
+// countTierBytes counts the bytes of a response of a rate tier; m may be nil
+func (m *metrics) countTierBytes(tier string, n int64) {
+	if m != nil {
+		m.tierBytes.WithLabelValues(tier).Add(float64(n))
+	}
+}
+
+// updateLoop periodically updates the metrics
+func (m *metrics) updateLoop(getConfig func() *config.Config, logger *slog.Logger) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.update(getConfig(), logger)
+	}
+}
+
+// update calculates and updates the metrics
+func (m *metrics) update(cfg *config.Config, logger *slog.Logger) {
+	// Walking an unavailable volume would only produce errors or hang
+	if m.storage != nil {
+		if err := m.storage(); err != nil {
+			m.storageAvailable.Set(0)
+			logger.Warn("Storage unavailable, skipping metrics update", "data_path", cfg.Server.DataPath, "error", err)
+			return
+		}
+		m.storageAvailable.Set(1)
+	}
+
+	// Update global metrics for the entire data path. Walks are only repeated once
+	// their snapshot is older than the stats TTL.
+	ttl := time.Duration(cfg.Server.StatsTTL) * time.Second
+	globalStats, err := m.dirStats(globalStatsKey, ttl, cfg.Server.DataPath, stats.WithConcurrency(dirStatsConcurrency))
+	if err != nil {
+		m.statsAge.DeleteLabelValues(globalStatsKey)
+		m.statsDuration.DeleteLabelValues(globalStatsKey)
+		logger.Warn("Failed to update global metrics", "error", err)
+	} else {
+		m.statsAge.WithLabelValues(globalStatsKey).Set(globalStats.age(time.Now()).Seconds())
+		m.statsDuration.WithLabelValues(globalStatsKey).Set(globalStats.Duration.Seconds())
+		m.filesTotal.WithLabelValues("_global").Set(float64(globalStats.Files))
+		m.directoriesTotal.WithLabelValues("_global").Set(float64(globalStats.Dirs))
+		m.sizeBytes.WithLabelValues("_global").Set(float64(globalStats.Bytes))
+	}
+
+	// Per-target series are collected first, so that targets collapsed into
+	// otherTarget add up before they are set
+	labels, collapsed := targetLabels(cfg)
+	if collapsed > 0 && m.collapseWarned.CompareAndSwap(false, true) {
+		logger.Warn("Too many targets for per-target metrics, summing up the rest as "+otherTarget,
+			"targets", len(cfg.Targets), "limit", cfg.Server.MetricsTargetLimit, "collapsed", collapsed)
+	}
+	batch := newGaugeBatch(m.stalenessSeconds, m.statsAge, m.statsDuration)
+	now := time.Now()
+
+	m.monthlyByteCap.Set(float64(httpPkg.ParseSize(cfg.Mirror.MonthlyByteCap)))
+	if usage, err := loadUsage(cfg, now); err != nil {
+		logger.Warn("Failed to read transfer accounting", "error", err)
+	} else {
+		m.transferredBytes.WithLabelValues("_global", "month").Set(float64(usage.PeriodBytes))
+		m.transferredBytes.WithLabelValues("_global", "lifetime").Set(float64(usage.TotalBytes))
+		for _, target := range cfg.Targets {
+			label := labels[target.Name]
+			batch.add(m.transferredBytes, float64(usage.PeriodTargets[target.Name]), label, "month")
+			batch.add(m.transferredBytes, float64(usage.TotalTargets[target.Name]), label, "lifetime")
+		}
+	}
+	walkOptions := []stats.Option{stats.WithConcurrency(dirStatsConcurrency)}
+	if cfg.Server.Breakdown.Enabled {
+		walkOptions = append(walkOptions, stats.WithBreakdown())
+	}
+	for _, target := range cfg.Targets {
+		label := labels[target.Name]
+		targetPath := filepath.Join(cfg.Server.DataPath, target.Name)
+
+		// Staleness keeps growing across failed or skipped runs
+		if state, err := mirror.LoadTargetState(targetPath); err != nil {
+			logger.Warn("Failed to read target state", "target", target.Name, "error", err)
+		} else {
+			batch.add(m.stalenessSeconds, stalenessSeconds(state, now), label)
+			batch.add(m.lastRunListings, float64(state.Listings), label, "parsed")
+			batch.add(m.lastRunListings, float64(state.EmptyListings), label, "empty")
+			batch.add(m.lastRunListings, float64(state.UnrecognizedListings), label, "unrecognized")
+		}
+
+		targetStats, err := m.dirStats(target.Name, ttl, targetPath, walkOptions...)
+		if err != nil {
+			logger.Warn("Failed to update target metrics", "target", target.Name, "error", err)
+			// Set zero values for missing targets
+			batch.add(m.filesTotal, 0, label)
+			batch.add(m.directoriesTotal, 0, label)
+			batch.add(m.sizeBytes, 0, label)
+			continue
+		}
+
+		batch.add(m.statsAge, targetStats.age(now).Seconds(), label)
+		batch.add(m.statsDuration, targetStats.Duration.Seconds(), label)
+		batch.add(m.filesTotal, float64(targetStats.Files), label)
+		batch.add(m.directoriesTotal, float64(targetStats.Dirs), label)
+		batch.add(m.sizeBytes, float64(targetStats.Bytes), label)
+		m.addBreakdown(batch, label, targetStats.Breakdown, cfg.Server.Breakdown.Extensions)
+	}
+
+	m.seriesMu.Lock()
+	m.setTargetSeries(batch, m.filesTotal, m.directoriesTotal, m.sizeBytes, m.stalenessSeconds, m.lastRunListings,
+		m.transferredBytes, m.extensionFiles, m.extensionBytes, m.sizeBucketFiles, m.sizeBucketBytes,
+		m.statsAge, m.statsDuration)
+	m.seriesMu.Unlock()
+
+	if err := targetSitemaps.Generate(cfg); err != nil {
+		logger.Warn("Failed to generate sitemaps", "error", err)
+	}
+}
+
+// dirStats returns the size walk of dir stored under key in targetDirStats,
+// walking it first if its snapshot is older than ttl
+func (m *metrics) dirStats(key string, ttl time.Duration, dir string, opts ...stats.Option) (dirStatsSnapshot, error) {
+	return targetDirStats.current(key, ttl, func() (stats.DirStats, error) {
+		return stats.GetDirStats(context.Background(), dir, opts...)
+	})
+}
+
+// addBreakdown adds the breakdown metrics of a target to batch. Only the given
+// extensions get their own label; targets without a breakdown add no series.
+func (m *metrics) addBreakdown(batch *gaugeBatch, target string, breakdown *stats.Breakdown, extensions []string) {
+	if breakdown == nil {
+		return
+	}
+
+	grouped := make(map[string]stats.Usage, len(extensions)+1)
+	grouped["other"] = stats.Usage{}
+	for _, ext := range extensions {
+		grouped[strings.ToLower(ext)] = stats.Usage{}
+	}
+	for ext, usage := range breakdown.Extensions {
+		if _, ok := grouped[ext]; !ok || ext == "other" {
+			ext = "other"
+		}
+		total := grouped[ext]
+		total.Files += usage.Files
+		total.Bytes += usage.Bytes
+		grouped[ext] = total
+	}
+	for ext, usage := range grouped {
+		batch.add(m.extensionFiles, float64(usage.Files), target, ext)
+		batch.add(m.extensionBytes, float64(usage.Bytes), target, ext)
+	}
+
+	for i, usage := range breakdown.Sizes {
+		batch.add(m.sizeBucketFiles, float64(usage.Files), target, stats.SizeBucketLabels[i])
+		batch.add(m.sizeBucketBytes, float64(usage.Bytes), target, stats.SizeBucketLabels[i])
+	}
+}
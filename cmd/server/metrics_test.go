@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewMetricsSharesRegisteredCollectors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	first, err := newMetrics(reg)
+	if err != nil {
+		t.Fatalf("Failed to create metrics: %v", err)
+	}
+	second, err := newMetrics(reg)
+	if err != nil {
+		t.Fatalf("Expected second registration to succeed, got %v", err)
+	}
+
+	second.inflightRequests.Set(3)
+	if value := testutil.ToFloat64(first.inflightRequests); value != 3 {
+		t.Errorf("Expected both instances to share the gauge, got %v", value)
+	}
+
+	// Independent registries keep independent values
+	other, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create metrics: %v", err)
+	}
+	if value := testutil.ToFloat64(other.inflightRequests); value != 0 {
+		t.Errorf("Expected fresh registry to start at 0, got %v", value)
+	}
+}
+
+func TestMetricsUpdate(t *testing.T) {
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "synced")
+	if err := os.MkdirAll(filepath.Join(targetDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(targetDir, "sub", "file.bin"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lastSuccess := time.Now().Add(-time.Hour)
+	state, _ := json.Marshal(mirror.TargetState{Target: "synced", LastAttempt: lastSuccess, LastSuccess: lastSuccess, Listings: 5, EmptyListings: 1})
+	if err := os.WriteFile(filepath.Join(targetDir, mirror.StateFileName), state, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Server:  config.Server{DataPath: dataPath},
+		Mirror:  config.Mirror{MonthlyByteCap: "1k"},
+		Targets: []config.Target{{Name: "synced", URL: "http://a/"}, {Name: "missing", URL: "http://b/"}},
+	}
+	m, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create metrics: %v", err)
+	}
+	m.update(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{"files", m.filesTotal.WithLabelValues("synced"), 2},
+		{"directories", m.directoriesTotal.WithLabelValues("synced"), 2},
+		{"size", m.sizeBytes.WithLabelValues("synced"), float64(100 + len(state))},
+		{"missing target files", m.filesTotal.WithLabelValues("missing"), 0},
+		{"parsed listings", m.lastRunListings.WithLabelValues("synced", "parsed"), 5},
+		{"empty listings", m.lastRunListings.WithLabelValues("synced", "empty"), 1},
+		{"monthly cap", m.monthlyByteCap, 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(tt.collector); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if staleness := testutil.ToFloat64(m.stalenessSeconds.WithLabelValues("synced")); staleness < 3600 || staleness > 3700 {
+		t.Errorf("Expected about an hour of staleness, got %v", staleness)
+	}
+}
+
+func TestMetricsStorageUnavailable(t *testing.T) {
+	m, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Server: config.Server{DataPath: t.TempDir()}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var storageErr error
+	m.storage = func() error { return storageErr }
+	m.update(cfg, logger)
+	if value := testutil.ToFloat64(m.storageAvailable); value != 1 {
+		t.Errorf("Expected storage to be available, got %v", value)
+	}
+
+	storageErr = errors.New("stale file handle")
+	m.update(cfg, logger)
+	if value := testutil.ToFloat64(m.storageAvailable); value != 0 {
+		t.Errorf("Expected storage to be unavailable, got %v", value)
+	}
+}
+
+func TestMetricsBreakdown(t *testing.T) {
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "distro")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"a.iso": 2000, "b.ISO": 1000, "c.txt": 10, "d.md": 20} {
+		if err := os.WriteFile(filepath.Join(targetDir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{
+		Server: config.Server{
+			DataPath:  dataPath,
+			Breakdown: config.Breakdown{Enabled: true, Extensions: []string{".ISO", ".deb"}},
+		},
+		Targets: []config.Target{{Name: "distro", URL: "http://a/"}},
+	}
+	m, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create metrics: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m.update(cfg, logger)
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{"iso files", m.extensionFiles.WithLabelValues("distro", ".iso"), 2},
+		{"iso bytes", m.extensionBytes.WithLabelValues("distro", ".iso"), 3000},
+		{"unused extension", m.extensionFiles.WithLabelValues("distro", ".deb"), 0},
+		{"other files", m.extensionFiles.WithLabelValues("distro", "other"), 2},
+		{"other bytes", m.extensionBytes.WithLabelValues("distro", "other"), 30},
+		{"small bucket", m.sizeBucketFiles.WithLabelValues("distro", "4KiB"), 4},
+		{"largest bucket", m.sizeBucketFiles.WithLabelValues("distro", "+Inf"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(tt.collector); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+	// Allowlisted extensions and other, per metric
+	if series := testutil.CollectAndCount(m.extensionFiles); series != 3 {
+		t.Errorf("Expected 3 extension series, got %d", series)
+	}
+
+	// Disabling the breakdown removes the series again
+	cfg.Server.Breakdown.Enabled = false
+	m.update(cfg, logger)
+	if series := testutil.CollectAndCount(m.extensionFiles) + testutil.CollectAndCount(m.sizeBucketFiles); series != 0 {
+		t.Errorf("Expected no breakdown series when disabled, got %d", series)
+	}
+}
+
+func TestMetricsCollapseTargets(t *testing.T) {
+	dataPath := t.TempDir()
+	names := []string{"collapse-a", "collapse-b", "keep-c", "collapse-d"}
+	for i, name := range names {
+		if err := os.MkdirAll(filepath.Join(dataPath, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dataPath, name, "file.bin"), make([]byte, 10*(i+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{Server: config.Server{DataPath: dataPath, MetricsTargetLimit: 3, MetricsTargets: []string{"keep-*"}}}
+	for _, name := range names {
+		cfg.Targets = append(cfg.Targets, config.Target{Name: name, URL: "http://a/" + name + "/"})
+	}
+	m, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	m.update(cfg, logger)
+	m.update(cfg, logger)
+
+	// Allowlisted targets keep their series, the rest are summed up
+	if got := testutil.ToFloat64(m.sizeBytes.WithLabelValues("keep-c")); got != 30 {
+		t.Errorf("Expected the allowlisted target's own size, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.sizeBytes.WithLabelValues(otherTarget)); got != 10+20+40 {
+		t.Errorf("Expected the collapsed targets' sizes summed up, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.stalenessSeconds.WithLabelValues(otherTarget)); !math.IsInf(got, 1) {
+		t.Errorf("Expected the worst staleness of the collapsed targets, got %v", got)
+	}
+	// keep-c, _other and _global
+	if series := testutil.CollectAndCount(m.filesTotal); series != 3 {
+		t.Errorf("Expected 3 file series, got %d", series)
+	}
+	if n := strings.Count(logs.String(), "Too many targets"); n != 1 {
+		t.Errorf("Expected the collapsing to be logged once, got %d times:\n%s", n, logs.String())
+	}
+
+	// Within the limit every target gets its own series again
+	cfg.Server.MetricsTargetLimit = 0
+	m.update(cfg, logger)
+	if series := testutil.CollectAndCount(m.filesTotal); series != len(names)+1 {
+		t.Errorf("Expected a file series per target, got %d", series)
+	}
+	if got := testutil.ToFloat64(m.sizeBytes.WithLabelValues("collapse-d")); got != 40 {
+		t.Errorf("Expected the own size of collapse-d, got %v", got)
+	}
+	if series := testutil.CollectAndCount(m.stalenessSeconds); series != len(names) {
+		t.Errorf("Expected the %s series to be removed, got %d staleness series", otherTarget, series)
+	}
+}
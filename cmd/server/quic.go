@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// errHTTP3NotCompiled is returned when HTTP/3 is enabled in a server built without
+// the http3 build tag
+var errHTTP3NotCompiled = errors.New("HTTP/3 support not compiled in; rebuild with -tags http3")
+
+// quicServer is an HTTP/3 listener running next to the TCP server
+type quicServer interface {
+	// Shutdown stops accepting connections and waits for active requests until ctx ends
+	Shutdown(ctx context.Context) error
+	// Close closes all connections immediately
+	Close() error
+}
+
+// startHTTP3 starts the QUIC listener if it is enabled, returning nil otherwise
+func startHTTP3(cfg config.Server, handler http.Handler, logger *slog.Logger) (quicServer, error) {
+	if !cfg.HTTP3.Enabled {
+		return nil, nil
+	}
+	if !cfg.TLS.Enabled() {
+		return nil, errors.New("HTTP/3 requires a TLS certificate")
+	}
+
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.GetHTTP3Port())
+	return listenHTTP3(addr, cfg.TLS, handler, logger)
+}
+
+// altSvcMiddleware advertises the HTTP/3 endpoint on responses sent over TCP
+func altSvcMiddleware(port int, next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,15 @@
+//go:build !http3
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// listenHTTP3 fails because quic-go is only linked into builds with the http3 tag
+func listenHTTP3(addr string, tls config.TLS, handler http.Handler, logger *slog.Logger) (quicServer, error) {
+	return nil, errHTTP3NotCompiled
+}
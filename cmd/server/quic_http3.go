@@ -0,0 +1,62 @@
+//go:build http3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Server wraps the quic-go server so that it satisfies quicServer
+type http3Server struct {
+	*http3.Server
+	conn net.PacketConn
+}
+
+// listenHTTP3 binds the UDP address and serves HTTP/3 on it. Certificate and bind
+// errors are returned, like those of the TCP listener, instead of ending the process.
+func listenHTTP3(addr string, tlsCfg config.TLS, handler http.Handler, logger *slog.Logger) (quicServer, error) {
+	cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+
+	go func() {
+		logger.Info("HTTP/3 server starting", "address", addr)
+		if err := server.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP/3 server stopped", "error", err)
+		}
+	}()
+
+	return http3Server{server, conn}, nil
+}
+
+// Shutdown implements quicServer
+func (s http3Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	s.conn.Close()
+	return err
+}
+
+// Close implements quicServer
+func (s http3Server) Close() error {
+	err := s.Server.Close()
+	s.conn.Close()
+	return err
+}
@@ -0,0 +1,84 @@
+//go:build http3
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// writeTestCert writes a self-signed certificate for localhost and returns the TLS settings
+func writeTestCert(t *testing.T) config.TLS {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tls := config.TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	if err := os.WriteFile(tls.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tls.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls
+}
+
+func TestListenHTTP3ReturnsErrors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tls := writeTestCert(t)
+
+	if _, err := listenHTTP3("127.0.0.1:0", config.TLS{CertFile: "missing.pem", KeyFile: "missing.pem"}, http.NotFoundHandler(), logger); err == nil {
+		t.Error("Expected an error for a missing certificate")
+	}
+
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if _, err := listenHTTP3(busy.LocalAddr().String(), tls, http.NotFoundHandler(), logger); err == nil {
+		t.Error("Expected an error for a UDP port in use")
+	}
+
+	h3, err := listenHTTP3("127.0.0.1:0", tls, http.NotFoundHandler(), logger)
+	if err != nil {
+		t.Fatalf("Expected HTTP/3 to start, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h3.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// fakeQUICServer records how it was stopped
+type fakeQUICServer struct {
+	shutdown bool
+	closed   bool
+	block    bool
+}
+
+func (f *fakeQUICServer) Shutdown(ctx context.Context) error {
+	f.shutdown = true
+	if f.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (f *fakeQUICServer) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestAltSvcMiddleware(t *testing.T) {
+	handler := altSvcMiddleware(8443, http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got := w.Header().Get("Alt-Svc"); got != `h3=":8443"; ma=86400` {
+		t.Errorf("Unexpected Alt-Svc header %q", got)
+	}
+
+	// Requests already on HTTP/3 need no advertisement
+	req := httptest.NewRequest("GET", "/", nil)
+	req.ProtoMajor = 3
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got := w.Header().Get("Alt-Svc"); got != "" {
+		t.Errorf("Expected no Alt-Svc over HTTP/3, got %q", got)
+	}
+}
+
+func TestStartHTTP3(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	h3, err := startHTTP3(config.Server{}, http.NotFoundHandler(), logger)
+	if h3 != nil || err != nil {
+		t.Errorf("Expected HTTP/3 to be disabled by default, got %v, %v", h3, err)
+	}
+
+	_, err = startHTTP3(config.Server{HTTP3: config.HTTP3{Enabled: true}}, http.NotFoundHandler(), logger)
+	if err == nil {
+		t.Error("Expected HTTP/3 without TLS to be rejected")
+	}
+}
+
+func TestDrainAndShutdownStopsQUIC(t *testing.T) {
+	tracker := newInflightTracker(nil)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name    string
+		block   bool
+		wantErr bool
+	}{
+		{"graceful", false, false},
+		{"drain timeout", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			server := &http.Server{Handler: http.NotFoundHandler()}
+			go server.Serve(listener)
+
+			h3 := &fakeQUICServer{block: tt.block}
+			err = drainAndShutdown(server, h3, tracker, 50*time.Millisecond, logger)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if !h3.shutdown {
+				t.Error("Expected the QUIC server to be shut down")
+			}
+			if h3.closed != tt.block {
+				t.Errorf("Expected forced close %v, got %v", tt.block, h3.closed)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/files"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"golang.org/x/time/rate"
+)
+
+// rateTierHeader names the tier applied to a response, so that the access logs of
+// reverse proxies in front of the server can record it
+const rateTierHeader = "X-Rate-Tier"
+
+// rateTierNone labels requests matching no tier in the metrics
+const rateTierNone = "none"
+
+// maxRateBurst bounds the bytes a throttled response writes at once
+const maxRateBurst = 256 << 10
+
+// rateTierExempt are the paths of probes and scrapes, which are never throttled
+var rateTierExempt = map[string]bool{"/health": true, "/ready": true, "/metrics": true}
+
+// requester describes who sent a request, as far as rate tiers are concerned
+type requester struct {
+	authenticated bool
+	user          string
+	groups        []string
+}
+
+// matches reports whether the requester is selected by a RateTier.Match entry
+func (r requester) matches(match string) bool {
+	switch match {
+	case config.RateTierAnonymous:
+		return !r.authenticated
+	case config.RateTierAuthenticated:
+		return r.authenticated
+	}
+	if user, ok := strings.CutPrefix(match, "user:"); ok {
+		return r.user == user
+	}
+	if group, ok := strings.CutPrefix(match, "group:"); ok {
+		return slices.Contains(r.groups, group)
+	}
+	return false
+}
+
+// rateTier is a configured tier with the state of its limits
+type rateTier struct {
+	name  string
+	match []string
+	// connectionRate and ipRate are in bytes per second; 0 is unlimited
+	connectionRate int64
+	ipRate         int64
+	// slots holds a token per request being served; nil if unlimited
+	slots chan struct{}
+
+	mu  sync.Mutex
+	ips map[string]*sharedLimiter
+}
+
+// connLimitersKey is the context key of the limiters of a client connection
+type connLimitersKey struct{}
+
+// connLimiters are the connectionRate limiters of one client connection by tier,
+// shared by the requests sent over it, e.g. with keep-alive or HTTP/2
+type connLimiters struct {
+	mu       sync.Mutex
+	limiters map[*rateTier]*rate.Limiter
+}
+
+// sharedLimiter is the limiter of the responses to one client address
+type sharedLimiter struct {
+	limiter *rate.Limiter
+	refs    int
+}
+
+// newByteLimiter returns a limiter of bytesPerSecond
+func newByteLimiter(bytesPerSecond int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxRateBurst)))
+}
+
+// enter takes a slot of the tier, reporting false if all are taken
+func (t *rateTier) enter() bool {
+	if t.slots == nil {
+		return true
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// leave returns a slot taken by enter
+func (t *rateTier) leave() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// connectionLimiter returns the limiter of the tier for the connection r was sent
+// over. Requests whose connection was not set up by rateTierGate.ConnContext, e.g.
+// those over HTTP/3, get a limiter of their own.
+func (t *rateTier) connectionLimiter(r *http.Request) *rate.Limiter {
+	conn, ok := r.Context().Value(connLimitersKey{}).(*connLimiters)
+	if !ok {
+		return newByteLimiter(t.connectionRate)
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	limiter, ok := conn.limiters[t]
+	if !ok {
+		limiter = newByteLimiter(t.connectionRate)
+		conn.limiters[t] = limiter
+	}
+	return limiter
+}
+
+// acquireIP returns the limiter shared by the responses of the tier to ip and a
+// function to call once the response is done
+func (t *rateTier) acquireIP(ip string) (*rate.Limiter, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	shared, ok := t.ips[ip]
+	if !ok {
+		shared = &sharedLimiter{limiter: newByteLimiter(t.ipRate)}
+		t.ips[ip] = shared
+	}
+	shared.refs++
+	return shared.limiter, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if shared.refs--; shared.refs == 0 {
+			delete(t.ips, ip)
+		}
+	}
+}
+
+// rateTiers are the rate tiers of a configuration
+type rateTiers struct {
+	tiers        []*rateTier
+	userHeader   string
+	groupsHeader string
+}
+
+// newRateTiers parses the rate tiers of the server configuration
+func newRateTiers(server config.Server) (*rateTiers, error) {
+	parse := func(tier, field, value string) (int64, error) {
+		if value == "" {
+			return 0, nil
+		}
+		if bytesPerSecond := httpPkg.ParseSize(value); bytesPerSecond > 0 {
+			return bytesPerSecond, nil
+		}
+		return 0, fmt.Errorf("rate tier %s: invalid %s %q", tier, field, value)
+	}
+
+	tiers := &rateTiers{userHeader: server.UserHeader, groupsHeader: server.GroupsHeader}
+	for _, cfg := range server.RateTiers {
+		tier := &rateTier{name: cfg.Name, match: cfg.Match, ips: make(map[string]*sharedLimiter)}
+		var err error
+		if tier.connectionRate, err = parse(cfg.Name, "connectionRate", cfg.ConnectionRate); err != nil {
+			return nil, err
+		}
+		if tier.ipRate, err = parse(cfg.Name, "ipRate", cfg.IPRate); err != nil {
+			return nil, err
+		}
+		if cfg.MaxConcurrent > 0 {
+			tier.slots = make(chan struct{}, cfg.MaxConcurrent)
+		}
+		tiers.tiers = append(tiers.tiers, tier)
+	}
+	return tiers, nil
+}
+
+// match returns the first tier selecting who, or nil
+func (t *rateTiers) match(who requester) *rateTier {
+	for _, tier := range t.tiers {
+		if slices.ContainsFunc(tier.match, who.matches) {
+			return tier
+		}
+	}
+	return nil
+}
+
+// rateTierGate decides the tier of every request once and throttles its response
+// accordingly
+type rateTierGate struct {
+	tiers     atomic.Pointer[rateTiers]
+	clientIPs func() *httpPkg.ClientIPResolver
+	signer    func() *files.Signer
+	// metrics counts requests and bytes per tier; may be nil
+	metrics *metrics
+	// logger records the requests of every tier at debug level; may be nil
+	logger *slog.Logger
+	// writeTimeout is how long a single write of a throttled response may take;
+	// the deadline is renewed after every wait so that slow lanes are not cut off
+	writeTimeout time.Duration
+}
+
+// ConnContext gives every client connection its own connectionRate limiters. It is
+// meant for http.Server.ConnContext.
+func (g *rateTierGate) ConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connLimitersKey{}, &connLimiters{limiters: make(map[*rateTier]*rate.Limiter)})
+}
+
+// logRequest records a request and its tier at debug level
+func (g *rateTierGate) logRequest(r *http.Request, tier, outcome string, args ...any) {
+	if g.logger != nil {
+		g.logger.Debug("Request", append([]any{"method", r.Method, "path", r.URL.Path,
+			"client", httpPkg.ClientIP(r), "tier", tier, "outcome", outcome}, args...)...)
+	}
+}
+
+// identify tells who sent r. The user and group headers are only believed from
+// trusted proxies; a valid signed URL also counts as authenticated.
+func (g *rateTierGate) identify(r *http.Request, tiers *rateTiers) requester {
+	var who requester
+	if g.clientIPs().TrustedPeer(r) {
+		who.user = strings.TrimSpace(r.Header.Get(tiers.userHeader))
+		for _, group := range strings.Split(r.Header.Get(tiers.groupsHeader), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				who.groups = append(who.groups, group)
+			}
+		}
+	}
+	who.authenticated = who.user != ""
+	if !who.authenticated && g.signer != nil && r.URL.Query().Has("sig") {
+		who.authenticated = g.signer().Verify(r.URL.Path, r.URL.Query()) == nil
+	}
+	return who
+}
+
+// Middleware throttles every response by the tier of its request. Requests beyond
+// the concurrency cap of their tier are answered with 429.
+func (g *rateTierGate) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tiers := g.tiers.Load()
+		if tiers == nil || len(tiers.tiers) == 0 || rateTierExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tier := tiers.match(g.identify(r, tiers))
+		if tier == nil {
+			g.metrics.countTierRequest(rateTierNone, "served")
+			g.logRequest(r, rateTierNone, "served")
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(rateTierHeader, tier.name)
+		if !tier.enter() {
+			g.metrics.countTierRequest(tier.name, "rejected")
+			g.logRequest(r, tier.name, "rejected")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		defer tier.leave()
+		g.metrics.countTierRequest(tier.name, "served")
+
+		limited := &limitedResponseWriter{ResponseWriter: w, ctx: r.Context(), timeout: g.writeTimeout}
+		if tier.connectionRate > 0 {
+			limited.limiters = append(limited.limiters, tier.connectionLimiter(r))
+		}
+		if tier.ipRate > 0 {
+			limiter, release := tier.acquireIP(httpPkg.ClientIP(r))
+			defer release()
+			limited.limiters = append(limited.limiters, limiter)
+		}
+		next.ServeHTTP(limited, r)
+		g.metrics.countTierBytes(tier.name, limited.written)
+		g.logRequest(r, tier.name, "served", "bytes", limited.written)
+	})
+}
+
+// limitedResponseWriter writes a response no faster than all of its limiters allow.
+// It deliberately does not implement io.ReaderFrom, so that sendfile cannot bypass
+// the limits; range responses are throttled like any other body.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+	timeout  time.Duration
+	written  int64
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, limiter := range w.limiters {
+			n = min(n, limiter.Burst())
+		}
+		for _, limiter := range w.limiters {
+			if err := limiter.WaitN(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		if w.timeout > 0 && len(w.limiters) > 0 {
+			// Not every writer supports deadlines, e.g. HTTP/3 streams
+			_ = http.NewResponseController(w.ResponseWriter).SetWriteDeadline(time.Now().Add(w.timeout))
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		w.written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush implements http.Flusher when the underlying writer supports it
+func (w *limitedResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (w *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
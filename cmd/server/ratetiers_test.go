@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/files"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestGate creates a gate for server trusting proxies in 10.0.0.0/8
+func newTestGate(t *testing.T, server config.Server, signer *files.Signer) *rateTierGate {
+	t.Helper()
+	resolver, err := httpPkg.NewClientIPResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.UserHeader == "" {
+		server.UserHeader, server.GroupsHeader = "X-Remote-User", "X-Remote-Groups"
+	}
+	tiers, err := newRateTiers(server)
+	if err != nil {
+		t.Fatalf("newRateTiers failed: %v", err)
+	}
+	m, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := &rateTierGate{
+		clientIPs:    func() *httpPkg.ClientIPResolver { return resolver },
+		signer:       func() *files.Signer { return signer },
+		metrics:      m,
+		writeTimeout: time.Second,
+	}
+	gate.tiers.Store(tiers)
+	return gate
+}
+
+func TestRateTierSelection(t *testing.T) {
+	signer := files.NewSigner(config.SignedURLs{Secrets: []string{"secret"}, MaxTTL: 3600})
+	signed, _, err := signer.Sign("/pub/file.iso", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := newTestGate(t, config.Server{RateTiers: []config.RateTier{
+		{Name: "staff", Match: []string{"user:alice", "group:staff"}},
+		{Name: "customers", Match: []string{config.RateTierAuthenticated}},
+		{Name: "public", Match: []string{config.RateTierAnonymous}},
+	}}, signer)
+
+	tests := []struct {
+		name    string
+		target  string
+		remote  string
+		headers map[string]string
+		tier    string
+	}{
+		{"anonymous", "/pub/file.iso", "203.0.113.7:1234", nil, "public"},
+		{"user through proxy", "/pub/file.iso", "10.0.0.2:1234", map[string]string{"X-Remote-User": "bob"}, "customers"},
+		{"named user", "/pub/file.iso", "10.0.0.2:1234", map[string]string{"X-Remote-User": "alice"}, "staff"},
+		{"group", "/pub/file.iso", "10.0.0.2:1234", map[string]string{"X-Remote-User": "carol", "X-Remote-Groups": "ops, staff"}, "staff"},
+		{"spoofed header", "/pub/file.iso", "203.0.113.7:1234", map[string]string{"X-Remote-User": "alice"}, "public"},
+		{"signed URL", signed, "203.0.113.7:1234", nil, "customers"},
+		{"forged signature", "/pub/file.iso?exp=9999999999&sig=forged", "203.0.113.7:1234", nil, "public"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.RemoteAddr = tt.remote
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			tier := gate.tiers.Load().match(gate.identify(req, gate.tiers.Load()))
+			if tier == nil || tier.name != tt.tier {
+				t.Errorf("Expected tier %s, got %+v", tt.tier, tier)
+			}
+		})
+	}
+}
+
+func TestNewRateTiersRejectsInvalidRates(t *testing.T) {
+	if _, err := newRateTiers(config.Server{RateTiers: []config.RateTier{{Name: "a", Match: []string{"anonymous"}, IPRate: "fast"}}}); err == nil || !strings.Contains(err.Error(), `"fast"`) {
+		t.Errorf("Expected an error naming the invalid rate, got %v", err)
+	}
+}
+
+func TestRateTierGateThrottles(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 6*1024) // 96 KiB
+	gate := newTestGate(t, config.Server{RateTiers: []config.RateTier{
+		{Name: "public", Match: []string{"anonymous"}, ConnectionRate: "64k", IPRate: "1m"},
+	}}, nil)
+	server := httptest.NewServer(gate.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	})))
+	defer server.Close()
+
+	// The first second worth of data goes out at once, the rest at the rate
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(body, content) {
+		t.Fatalf("Expected the whole file, got %d bytes, %v", len(body), err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the response to be throttled, took %s", elapsed)
+	}
+	if tier := resp.Header.Get(rateTierHeader); tier != "public" {
+		t.Errorf("Expected the tier in the response, got %q", tier)
+	}
+
+	// Ranges are served exactly under throttling
+	req, _ := http.NewRequest("GET", server.URL+"/file.bin", nil)
+	req.Header.Set("Range", "bytes=70000-70099")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[70000:70100]) {
+		t.Errorf("Expected the requested range, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+
+	if got := testutil.ToFloat64(gate.metrics.tierRequests.WithLabelValues("public", "served")); got != 2 {
+		t.Errorf("Expected 2 served requests, got %v", got)
+	}
+	if got := testutil.ToFloat64(gate.metrics.tierBytes.WithLabelValues("public")); got != float64(len(content)+100) {
+		t.Errorf("Expected %d bytes, got %v", len(content)+100, got)
+	}
+	if tier := gate.tiers.Load().tiers[0]; len(tier.ips) != 0 {
+		t.Errorf("Expected per-address limiters to be released, got %d", len(tier.ips))
+	}
+}
+
+func TestRateTierGateLimitsPerConnection(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*1024) // 64 KiB, one burst
+	gate := newTestGate(t, config.Server{RateTiers: []config.RateTier{
+		{Name: "public", Match: []string{"anonymous"}, ConnectionRate: "64k"},
+	}}, nil)
+	var logs bytes.Buffer
+	gate.logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	server := httptest.NewUnstartedServer(gate.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	})))
+	server.Config.ConnContext = gate.ConnContext
+	server.Start()
+	defer server.Close()
+
+	// The second response over the same connection waits for the first one's
+	// budget to refill; one over a new connection does not
+	fetch := func(client *http.Client) time.Duration {
+		start := time.Now()
+		resp, err := client.Get(server.URL + "/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return time.Since(start)
+	}
+	client := server.Client()
+	fetch(client)
+	if elapsed := fetch(client); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected the second response over the connection to be throttled, took %s", elapsed)
+	}
+	if elapsed := fetch(&http.Client{Transport: &http.Transport{}}); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected a new connection to get its own limit, took %s", elapsed)
+	}
+
+	if !strings.Contains(logs.String(), `"tier":"public"`) {
+		t.Errorf("Expected the tier in the request log, got %s", logs.String())
+	}
+}
+
+func TestRateTierGateConcurrency(t *testing.T) {
+	gate := newTestGate(t, config.Server{RateTiers: []config.RateTier{
+		{Name: "public", Match: []string{"anonymous"}, MaxConcurrent: 1},
+	}}, nil)
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := gate.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-release
+		}
+		io.WriteString(w, "ok")
+	}))
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		done <- w.Code
+	}()
+	<-entered
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 over the concurrency cap, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK || w.Header().Get(rateTierHeader) != "" {
+		t.Errorf("Expected health checks to bypass the tiers, got %d", w.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the first request to succeed, got %d", code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/other", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the slot to be free again, got %d", w.Code)
+	}
+	if got := testutil.ToFloat64(gate.metrics.tierRequests.WithLabelValues("public", "rejected")); got != 1 {
+		t.Errorf("Expected one rejection, got %v", got)
+	}
+}
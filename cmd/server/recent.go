@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/heap"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// recentEntry is a file returned by /api/v1/targets/{name}/recent
+type recentEntry struct {
+	Path      string    `json:"path"`
+	URL       string    `json:"url,omitempty"`
+	Size      int64     `json:"size"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// newerThan orders recent entries newest first, then by path
+func (e recentEntry) newerThan(other recentEntry) bool {
+	if !e.FetchedAt.Equal(other.FetchedAt) {
+		return e.FetchedAt.After(other.FetchedAt)
+	}
+	return e.Path < other.Path
+}
+
+// position returns the cursor position of the entry
+func (e recentEntry) position() string {
+	return e.FetchedAt.Format(time.RFC3339Nano) + " " + e.Path
+}
+
+// parsePosition parses a cursor position into the entry it continues after
+func parsePosition(position string) (recentEntry, bool) {
+	fetchedAt, rel, ok := strings.Cut(position, " ")
+	if !ok {
+		return recentEntry{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, fetchedAt)
+	if err != nil {
+		return recentEntry{}, false
+	}
+	return recentEntry{Path: rel, FetchedAt: t}, true
+}
+
+// recentHeap keeps the newest entries seen so far, with the oldest of them on top
+type recentHeap []recentEntry
+
+func (h recentHeap) Len() int           { return len(h) }
+func (h recentHeap) Less(i, j int) bool { return h[j].newerThan(h[i]) }
+func (h recentHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *recentHeap) Push(x any)        { *h = append(*h, x.(recentEntry)) }
+func (h *recentHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// recentHandler lists the most recently downloaded files of a target, newest
+// first and a page at a time. The manifest is read one entry at a time and only
+// the entries of the page are kept, so a page costs the same memory no matter how
+// many files the target has.
+func recentHandler(getConfig func() *config.Config, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		name := r.PathValue("name")
+		target, ok := servedTarget(cfg, name)
+		if !ok {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+
+		limit, cursor, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var after recentEntry
+		if cursor != "" {
+			if after, ok = parsePosition(cursor); !ok {
+				http.Error(w, "invalid cursor parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// One entry more than the page tells whether another page follows
+		hidden := cfg.HiddenPatterns(target.Name)
+		newest := make(recentHeap, 0, limit+1)
+		err = mirror.WalkManifest(filepath.Join(cfg.Server.DataPath, target.Name), func(rel string, source mirror.FileSource) error {
+			if source.FetchedAt.IsZero() || !listable(rel, hidden) {
+				return nil
+			}
+			entry := recentEntry{Path: rel, URL: source.URL, Size: source.Size, FetchedAt: source.FetchedAt}
+			if cursor != "" && !after.newerThan(entry) {
+				return nil
+			}
+			if len(newest) <= limit {
+				heap.Push(&newest, entry)
+			} else if entry.newerThan(newest[0]) {
+				newest[0] = entry
+				heap.Fix(&newest, 0)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Warn("Failed to read manifest", "target", target.Name, "error", err)
+			http.Error(w, "failed to read manifest", http.StatusInternalServerError)
+			return
+		}
+
+		more := len(newest) > limit
+		if more {
+			heap.Pop(&newest)
+		}
+		entries := make([]recentEntry, len(newest))
+		for i := len(entries) - 1; i >= 0; i-- {
+			entries[i] = heap.Pop(&newest).(recentEntry)
+		}
+		var next string
+		if more {
+			next = entries[len(entries)-1].position()
+		}
+
+		page := newPageWriter(w, target.Name)
+		for _, entry := range entries {
+			page.add(entry)
+		}
+		if err := page.finish(next, nil); err != nil {
+			logger.Debug("Failed to write recent response", "target", target.Name, "error", err)
+		}
+	}
+}
+
+// listable reports whether no component of the manifest path rel is hidden or an
+// incomplete download
+func listable(rel string, hidden []string) bool {
+	for _, name := range strings.Split(rel, "/") {
+		if config.IsHidden(hidden, name) || config.IsTempFile(name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+func TestRecentHandler(t *testing.T) {
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "big")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every fetch time appears twice so that ties are paginated too
+	const files = 5000
+	base := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	manifest := mirror.Manifest{Files: make(map[string]mirror.FileSource, files+2)}
+	for i := range files {
+		manifest.Files[fmt.Sprintf("dir/f%05d", i)] = mirror.FileSource{URL: "http://up/f", Size: 1, FetchedAt: base.Add(time.Duration(i/2) * time.Minute)}
+	}
+	manifest.Files[".hidden"] = mirror.FileSource{FetchedAt: base.Add(time.Hour * 1000)}
+	manifest.Files["adopted"] = mirror.FileSource{Adopted: true}
+	data, _ := json.Marshal(manifest)
+	if err := os.WriteFile(filepath.Join(targetDir, mirror.ManifestFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Server: config.Server{DataPath: dataPath}, Targets: []config.Target{{Name: "big"}}}
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/targets/{name}/recent", recentHandler(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+	var got []recentEntry
+	query := url.Values{"limit": {"999"}}
+	for pages := 0; ; pages++ {
+		if pages > files/999+2 {
+			t.Fatal("Too many pages")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets/big/recent?"+query.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Page %d failed with %d", pages, w.Code)
+		}
+		var page struct {
+			Entries    []recentEntry `json:"entries"`
+			NextCursor *string       `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page.Entries...)
+		if page.NextCursor == nil {
+			break
+		}
+		query.Set("cursor", *page.NextCursor)
+	}
+
+	if len(got) != files {
+		t.Fatalf("Expected %d downloaded files, got %d", files, len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if !got[i-1].newerThan(got[i]) {
+			t.Fatalf("Expected newest first without repeats, got %+v before %+v", got[i-1], got[i])
+		}
+	}
+	if got[0].Path != "dir/f04998" || got[0].URL != "http://up/f" {
+		t.Errorf("Expected the newest download first, got %+v", got[0])
+	}
+}
+
+func TestRecentHandlerUnknownTarget(t *testing.T) {
+	cfg := &config.Config{Server: config.Server{DataPath: t.TempDir()}, Targets: []config.Target{{Name: "secret", Protected: true}}}
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/targets/{name}/recent", recentHandler(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+	for _, name := range []string{"secret", "missing"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets/"+name+"/recent", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", name, w.Code)
+		}
+	}
+}
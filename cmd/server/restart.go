@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment passed to a successor started by a graceful restart
+const (
+	// listenFDsEnv names the inherited listeners, in file descriptor order from 3
+	listenFDsEnv = "HTTP_MIRROR_LISTEN_FDS"
+	// readyFDEnv is the descriptor the successor closes once it is serving
+	readyFDEnv = "HTTP_MIRROR_READY_FD"
+)
+
+// restartReadyTimeout is how long the old process waits for its successor
+var restartReadyTimeout = 30 * time.Second
+
+// namedListener is a listening socket handed over on restart under its name
+type namedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// inheritedListeners holds the sockets and readiness pipe passed in by a predecessor
+type inheritedListeners struct {
+	listeners map[string]net.Listener
+	ready     *os.File
+}
+
+// inheritListeners picks up listeners passed by a predecessor process. Without a
+// predecessor the result is empty and every listener is opened fresh.
+func inheritListeners() (*inheritedListeners, error) {
+	inherited := &inheritedListeners{listeners: make(map[string]net.Listener)}
+	names := os.Getenv(listenFDsEnv)
+	readyFD := os.Getenv(readyFDEnv)
+	// Not passed on to processes started by this one
+	os.Unsetenv(listenFDsEnv)
+	os.Unsetenv(readyFDEnv)
+
+	if names != "" {
+		for i, name := range strings.Split(names, ",") {
+			file := os.NewFile(uintptr(3+i), name)
+			listener, err := net.FileListener(file)
+			file.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to inherit listener %s: %w", name, err)
+			}
+			inherited.listeners[name] = listener
+		}
+	}
+	if readyFD != "" {
+		fd, err := strconv.Atoi(readyFD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", readyFDEnv, err)
+		}
+		inherited.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	return inherited, nil
+}
+
+// listen returns the inherited listener called name, or opens a new one on addr
+func (i *inheritedListeners) listen(name, addr string) (net.Listener, error) {
+	if listener, ok := i.listeners[name]; ok {
+		delete(i.listeners, name)
+		return listener, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// signalReady tells the predecessor that this process serves all listeners, after
+// which it stops accepting and drains. Inherited listeners that were not claimed
+// are closed.
+func (i *inheritedListeners) signalReady() error {
+	for name, listener := range i.listeners {
+		listener.Close()
+		delete(i.listeners, name)
+	}
+	if i.ready == nil {
+		return nil
+	}
+	defer func() { i.ready = nil }()
+	if _, err := i.ready.Write([]byte{1}); err != nil {
+		i.ready.Close()
+		return fmt.Errorf("failed to signal readiness: %w", err)
+	}
+	return i.ready.Close()
+}
+
+// fileListener is implemented by listeners whose socket can be duplicated
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// startSuccessor execs path with args, passing the listeners as inherited file
+// descriptors, and waits until it is serving them. On failure the successor is
+// killed and the caller keeps serving.
+func startSuccessor(path string, args []string, listeners []namedListener, logger *slog.Logger) (*os.Process, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	names := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		fl, ok := l.listener.(fileListener)
+		if !ok {
+			return nil, fmt.Errorf("listener %s cannot be passed on", l.name)
+		}
+		file, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("failed to duplicate listener %s: %w", l.name, err)
+		}
+		files = append(files, file)
+		names = append(names, l.name)
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer readyRead.Close()
+	files = append(files, readyWrite)
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(withoutEnv(os.Environ(), listenFDsEnv, readyFDEnv),
+		listenFDsEnv+"="+strings.Join(names, ","),
+		fmt.Sprintf("%s=%d", readyFDEnv, 3+len(files)-1))
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start successor: %w", err)
+	}
+	logger.Info("Started successor, waiting for readiness", "pid", cmd.Process.Pid)
+
+	// Our copy of the write end must be closed so a dying successor yields EOF
+	readyWrite.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyRead.Read(buf); err != nil {
+			if err == io.EOF {
+				err = errors.New("successor exited before becoming ready")
+			}
+			ready <- err
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(restartReadyTimeout):
+		err = fmt.Errorf("successor not ready after %s", restartReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	// The successor is reparented once we exit; reap it if we are still around
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// withoutEnv returns env without the given variables
+func withoutEnv(env []string, keys ...string) []string {
+	result := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		drop := false
+		for _, k := range keys {
+			drop = drop || key == k
+		}
+		if !drop {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// restartHelperEnv makes the test binary act as the successor server
+const restartHelperEnv = "HTTP_MIRROR_RESTART_HELPER"
+
+// TestRestartHelperProcess is the successor started by TestGracefulRestart. It
+// serves the inherited listener until it is terminated.
+func TestRestartHelperProcess(t *testing.T) {
+	if os.Getenv(restartHelperEnv) != "1" {
+		t.Skip("only run as restart successor")
+	}
+
+	inherited, err := inheritListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	listener, err := inherited.listen("public", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "successor")
+	})}
+	go server.Serve(listener)
+	if err := inherited.signalReady(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM)
+	select {
+	case <-quit:
+	case <-time.After(30 * time.Second):
+	}
+	os.Exit(0)
+}
+
+func TestGracefulRestart(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tracker := newInflightTracker(nil)
+
+	// The slow download writes 10 chunks over about a second
+	const chunks = 10
+	chunk := bytes.Repeat([]byte("x"), 1024)
+	started := make(chan struct{})
+	handler := tracker.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			fmt.Fprint(w, "predecessor")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(chunks*len(chunk)))
+		close(started)
+		for range chunks {
+			w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(listener)
+	baseURL := "http://" + listener.Addr().String()
+
+	type result struct {
+		n   int
+		err error
+	}
+	download := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(baseURL + "/slow")
+		if err != nil {
+			download <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		download <- result{len(data), err}
+	}()
+	<-started
+
+	t.Setenv(restartHelperEnv, "1")
+	successor, err := startSuccessor(os.Args[0], []string{"-test.run=^TestRestartHelperProcess$"},
+		[]namedListener{{"public", listener}}, logger)
+	if err != nil {
+		t.Fatalf("startSuccessor failed: %v", err)
+	}
+	defer successor.Signal(syscall.SIGTERM)
+
+	if err := drainAndShutdown(server, nil, tracker, 10*time.Second, logger); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	// The download in progress completes on the old process
+	r := <-download
+	if r.err != nil || r.n != chunks*len(chunk) {
+		t.Errorf("Expected slow download to complete with %d bytes, got %d (%v)", chunks*len(chunk), r.n, r.err)
+	}
+
+	// New connections are accepted by the successor on the same address
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(baseURL + "/")
+	if err != nil {
+		t.Fatalf("Request after restart failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "successor" {
+		t.Errorf("Expected successor to serve after restart, got %q", body)
+	}
+}
+
+func TestStartSuccessorFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// A successor that exits without becoming ready leaves the old process serving
+	_, err = startSuccessor("/bin/false", nil, []namedListener{{"public", listener}}, logger)
+	if err == nil || !strings.Contains(err.Error(), "before becoming ready") {
+		t.Errorf("Expected readiness error, got %v", err)
+	}
+}
+
+func TestInheritListenersWithoutPredecessor(t *testing.T) {
+	inherited, err := inheritListeners()
+	if err != nil {
+		t.Fatalf("inheritListeners failed: %v", err)
+	}
+	listener, err := inherited.listen("public", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	listener.Close()
+	if err := inherited.signalReady(); err != nil {
+		t.Errorf("Expected signalReady to be a no-op, got %v", err)
+	}
+}
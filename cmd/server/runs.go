@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// runStatus is a sync in progress returned by /api/v1/runs
+type runStatus struct {
+	Target  string    `json:"target"`
+	Started time.Time `json:"started"`
+	Host    string    `json:"host,omitempty"`
+	PID     int       `json:"pid"`
+	// Progress is the latest estimate of a first run, reported every 30 seconds;
+	// later runs report none
+	Progress *mirror.Progress `json:"progress,omitempty"`
+}
+
+// runsHandler lists the syncs in progress as recorded in the sync markers of the
+// targets, and as "active" the runs of the process that hold or wait for a target
+// directory in coordinator
+func runsHandler(getConfig func() *config.Config, coordinator *mirror.RunCoordinator, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		runs := make([]runStatus, 0)
+		for _, target := range cfg.Targets {
+			marker, err := mirror.LoadSyncMarker(filepath.Join(cfg.Server.DataPath, target.Name))
+			if err != nil {
+				logger.Warn("Failed to load sync marker", "target", target.Name, "error", err)
+				continue
+			}
+			if marker == nil {
+				continue
+			}
+			runs = append(runs, runStatus{Target: target.Name, Started: marker.Started, Host: marker.Host,
+				PID: marker.PID, Progress: marker.Progress})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		active := coordinator.Runs()
+		if active == nil {
+			active = []mirror.RunStatus{}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"runs": runs, "active": active})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+func TestRunsHandler(t *testing.T) {
+	dataPath := t.TempDir()
+	started := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	marker := mirror.SyncMarker{Target: "syncing", Started: started, PID: 42,
+		Progress: &mirror.Progress{Basis: mirror.ProgressByFiles, FilesDone: 5, FilesDiscovered: 20, Percent: 25, Estimate: true}}
+	data, _ := json.Marshal(marker)
+	if err := os.MkdirAll(filepath.Join(dataPath, "syncing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataPath, "syncing", mirror.SyncMarkerFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Server:  config.Server{DataPath: dataPath},
+		Targets: []config.Target{{Name: "idle", URL: "http://a/"}, {Name: "syncing", URL: "http://b/"}},
+	}
+	coordinator := mirror.NewRunCoordinator()
+	release, err := coordinator.TryAcquire("idle", filepath.Join(dataPath, "idle"), mirror.OperationPurge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	handler := runsHandler(func() *config.Config { return cfg }, coordinator, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/runs", nil))
+
+	var resp struct {
+		Runs   []runStatus        `json:"runs"`
+		Active []mirror.RunStatus `json:"active"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Runs) != 1 {
+		t.Fatalf("Expected only the syncing target, got %+v", resp.Runs)
+	}
+	run := resp.Runs[0]
+	if run.Target != "syncing" || !run.Started.Equal(started) || run.PID != 42 {
+		t.Errorf("Unexpected run %+v", run)
+	}
+	if run.Progress == nil || run.Progress.Percent != 25 || !run.Progress.Estimate || run.Progress.Basis != mirror.ProgressByFiles {
+		t.Errorf("Expected the progress of the marker, got %+v", run.Progress)
+	}
+	if len(resp.Active) != 1 || resp.Active[0].Target != "idle" || resp.Active[0].Operation != mirror.OperationPurge ||
+		resp.Active[0].State != mirror.RunRunning {
+		t.Errorf("Expected the purge of the process, got %+v", resp.Active)
+	}
+}
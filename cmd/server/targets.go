@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/files"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/jhofer-cloud/http-mirror/pkg/stats"
+)
+
+// targetStatus is the per-target entry returned by /api/v1/targets
+type targetStatus struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	NeverSynced bool   `json:"never_synced"`
+	// Frozen targets are served but not mirrored; FrozenAt is null until the
+	// updater first skipped the target
+	Frozen            bool       `json:"frozen"`
+	FrozenAt          *time.Time `json:"frozen_at,omitempty"`
+	LastSuccess       *time.Time `json:"last_success"`
+	LastAttempt       *time.Time `json:"last_attempt"`
+	LastAttemptErrors int64      `json:"last_attempt_errors"`
+	// LastAttemptSkips counts the files the last run skipped per skip reason
+	LastAttemptSkips    map[string]int64 `json:"last_attempt_skips,omitempty"`
+	NewestRemoteModTime *time.Time       `json:"newest_remote_mtime"`
+	// StalenessSeconds is null for targets that have never synced
+	StalenessSeconds *float64 `json:"staleness_seconds"`
+	// Disk is the size of the local copy as of the last completed size walk, which
+	// is DiskAgeSeconds old
+	Disk           *stats.DirStats `json:"disk,omitempty"`
+	DiskAgeSeconds *float64        `json:"disk_age_seconds,omitempty"`
+}
+
+// targetSitemaps holds the sitemaps, regenerated together with the metrics
+var targetSitemaps = files.NewSitemaps()
+
+// stalenessSeconds returns the staleness metric value for a target state. Targets
+// that have never synced report +Inf so that "staleness > X" alerts fire for them.
+func stalenessSeconds(state *mirror.TargetState, now time.Time) float64 {
+	if !state.Synced() {
+		return math.Inf(1)
+	}
+	return state.Staleness(now).Seconds()
+}
+
+// loadTargetStatus builds the status of a target from its persisted sync state
+func loadTargetStatus(dataPath string, target config.Target, now time.Time) (targetStatus, error) {
+	status := targetStatus{Name: target.Name, URL: target.URL, NeverSynced: true, Frozen: target.Frozen}
+
+	state, err := mirror.LoadTargetState(filepath.Join(dataPath, target.Name))
+	if err != nil {
+		return status, err
+	}
+
+	if target.Frozen && !state.FrozenAt.IsZero() {
+		status.FrozenAt = &state.FrozenAt
+	}
+
+	if !state.LastAttempt.IsZero() {
+		status.LastAttempt = &state.LastAttempt
+		status.LastAttemptErrors = state.LastAttemptErrors
+		status.LastAttemptSkips = state.LastAttemptSkips
+	}
+	if state.Synced() {
+		staleness := state.Staleness(now).Seconds()
+		status.NeverSynced = false
+		status.LastSuccess = &state.LastSuccess
+		status.StalenessSeconds = &staleness
+		if !state.NewestRemoteModTime.IsZero() {
+			status.NewestRemoteModTime = &state.NewestRemoteModTime
+		}
+	}
+	return status, nil
+}
+
+// targetsHandler serves the sync status of all configured targets
+func targetsHandler(getConfig func() *config.Config, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		now := time.Now()
+		ttl := time.Duration(cfg.Server.StatsTTL) * time.Second
+
+		statuses := make([]targetStatus, 0, len(cfg.Targets))
+		for _, target := range cfg.Targets {
+			status, err := loadTargetStatus(cfg.Server.DataPath, target, now)
+			if err != nil {
+				logger.Warn("Failed to load target state", "target", target.Name, "error", err)
+			}
+			if disk, ok := targetDirStats.get(target.Name, ttl); ok {
+				age := disk.age(now).Seconds()
+				status.Disk = &disk.DirStats
+				status.DiskAgeSeconds = &age
+			}
+			statuses = append(statuses, status)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(map[string]any{"targets": statuses})
+	}
+}
+
+// defaultBreakdownTop is how many extensions /api/v1/targets/{name}/breakdown lists
+// unless the top parameter says otherwise
+const defaultBreakdownTop = 10
+
+// sizeBucketUsage is one size bucket of a breakdown response
+type sizeBucketUsage struct {
+	// Bucket is the upper bound of the bucket, e.g. "16MiB" or "+Inf"
+	Bucket string `json:"bucket"`
+	stats.Usage
+}
+
+// targetBreakdown is returned by /api/v1/targets/{name}/breakdown
+type targetBreakdown struct {
+	Name  string `json:"name"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+	// Extensions are the extensions using the most bytes, largest first
+	Extensions []stats.ExtensionUsage `json:"extensions"`
+	// Other sums up the extensions not listed
+	Other stats.Usage       `json:"other"`
+	Sizes []sizeBucketUsage `json:"sizes"`
+	// AgeSeconds is how old the size walk the breakdown comes from is
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+// newTargetBreakdown summarizes the breakdown of a target to the top extensions
+func newTargetBreakdown(name string, dirStats stats.DirStats, top int) targetBreakdown {
+	result := targetBreakdown{
+		Name:       name,
+		Files:      dirStats.Files,
+		Bytes:      dirStats.Bytes,
+		Extensions: dirStats.Breakdown.TopExtensions(top),
+	}
+	for _, ext := range result.Extensions {
+		result.Other.Files -= ext.Files
+		result.Other.Bytes -= ext.Bytes
+	}
+	result.Other.Files += dirStats.Files
+	result.Other.Bytes += dirStats.Bytes
+	for i, usage := range dirStats.Breakdown.Sizes {
+		result.Sizes = append(result.Sizes, sizeBucketUsage{Bucket: stats.SizeBucketLabels[i], Usage: usage})
+	}
+	return result
+}
+
+// breakdownHandler serves the extension and size breakdown of a target from the
+// latest metrics walk
+func breakdownHandler(getConfig func() *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		if !cfg.Server.Breakdown.Enabled {
+			http.Error(w, "breakdowns are disabled", http.StatusNotFound)
+			return
+		}
+
+		name := r.PathValue("name")
+		if !slices.ContainsFunc(cfg.Targets, func(t config.Target) bool { return t.Name == name }) {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+
+		top := defaultBreakdownTop
+		if value := r.URL.Query().Get("top"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid top parameter", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		dirStats, ok := targetDirStats.get(name, time.Duration(cfg.Server.StatsTTL)*time.Second)
+		if !ok || dirStats.Breakdown == nil {
+			http.Error(w, "no breakdown available yet", http.StatusServiceUnavailable)
+			return
+		}
+		breakdown := newTargetBreakdown(name, dirStats.DirStats, top)
+		breakdown.AgeSeconds = dirStats.age(time.Now()).Seconds()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(breakdown)
+	}
+}
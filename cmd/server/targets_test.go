@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/jhofer-cloud/http-mirror/pkg/stats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTargetsHandler(t *testing.T) {
+	dataPath := t.TempDir()
+	lastSuccess := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	syncedDir := filepath.Join(dataPath, "synced")
+	if err := os.MkdirAll(syncedDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	state := mirror.TargetState{Target: "synced", LastAttempt: lastSuccess, LastSuccess: lastSuccess,
+		LastAttemptSkips: map[string]int64{config.SkipUnchanged: 3}}
+	data, _ := json.Marshal(state)
+	if err := os.WriteFile(filepath.Join(syncedDir, mirror.StateFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Server:  config.Server{DataPath: dataPath},
+		Targets: []config.Target{{Name: "synced", URL: "http://a/"}, {Name: "fresh", URL: "http://b/"}},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.update(cfg, logger)
+	handler := targetsHandler(func() *config.Config { return cfg }, logger)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets", nil))
+
+	var resp struct {
+		Targets []targetStatus `json:"targets"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %d", len(resp.Targets))
+	}
+
+	synced := resp.Targets[0]
+	if synced.NeverSynced || synced.StalenessSeconds == nil || *synced.StalenessSeconds < 3600 {
+		t.Errorf("Expected synced target with about an hour of staleness, got %+v", synced)
+	}
+	if synced.Disk == nil || synced.Disk.Files != 1 || synced.Disk.Bytes != int64(len(data)) {
+		t.Errorf("Expected disk usage of the state file, got %+v", synced.Disk)
+	}
+	if synced.DiskAgeSeconds == nil || *synced.DiskAgeSeconds < 0 || *synced.DiskAgeSeconds > 60 {
+		t.Errorf("Expected the age of the size walk, got %v", synced.DiskAgeSeconds)
+	}
+
+	if synced.LastAttemptSkips[config.SkipUnchanged] != 3 {
+		t.Errorf("Expected the skip reasons of the last run, got %v", synced.LastAttemptSkips)
+	}
+
+	if synced.Frozen || synced.FrozenAt != nil {
+		t.Errorf("Expected target not to be frozen, got %+v", synced)
+	}
+
+	fresh := resp.Targets[1]
+	if !fresh.NeverSynced || fresh.StalenessSeconds != nil || fresh.LastSuccess != nil {
+		t.Errorf("Expected never-synced target without staleness, got %+v", fresh)
+	}
+	if fresh.Disk != nil {
+		t.Errorf("Expected no disk usage for a missing directory, got %+v", fresh.Disk)
+	}
+}
+
+func TestTargetsHandlerFrozen(t *testing.T) {
+	dataPath := t.TempDir()
+	frozenAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	for _, name := range []string{"frozen", "thawed"} {
+		dir := filepath.Join(dataPath, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(mirror.TargetState{Target: name, FrozenAt: frozenAt})
+		if err := os.WriteFile(filepath.Join(dir, mirror.StateFileName), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{
+		Server: config.Server{DataPath: dataPath},
+		// A target unfrozen in the configuration is reported as such before the next run
+		Targets: []config.Target{{Name: "frozen", URL: "http://a/", Frozen: true}, {Name: "thawed", URL: "http://b/"}},
+	}
+	handler := targetsHandler(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets", nil))
+
+	var resp struct {
+		Targets []targetStatus `json:"targets"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if frozen := resp.Targets[0]; !frozen.Frozen || frozen.FrozenAt == nil || !frozen.FrozenAt.Equal(frozenAt) {
+		t.Errorf("Expected frozen target frozen at %v, got %+v", frozenAt, frozen)
+	}
+	if thawed := resp.Targets[1]; thawed.Frozen || thawed.FrozenAt != nil {
+		t.Errorf("Expected thawed target not to be frozen, got %+v", thawed)
+	}
+}
+
+func TestStalenessSecondsSentinel(t *testing.T) {
+	now := time.Now()
+	if got := stalenessSeconds(&mirror.TargetState{}, now); !math.IsInf(got, 1) {
+		t.Errorf("Expected +Inf for a never-synced target, got %v", got)
+	}
+
+	state := &mirror.TargetState{LastSuccess: now.Add(-time.Minute)}
+	if got := stalenessSeconds(state, now); got != 60 {
+		t.Errorf("Expected 60 seconds, got %v", got)
+	}
+}
+
+func TestBreakdownHandler(t *testing.T) {
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "distro")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"a.iso": 3000, "b.rpm": 200, "c.deb": 100, "README": 5} {
+		if err := os.WriteFile(filepath.Join(targetDir, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{
+		Server: config.Server{
+			DataPath:  dataPath,
+			Breakdown: config.Breakdown{Enabled: true},
+		},
+		Targets: []config.Target{{Name: "distro", URL: "http://a/"}, {Name: "pending", URL: "http://b/"}},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m, err := newMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.update(cfg, logger)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/targets/{name}/breakdown", breakdownHandler(func() *config.Config { return cfg }))
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"unknown target", "/api/v1/targets/nope/breakdown", http.StatusNotFound},
+		{"not walked yet", "/api/v1/targets/pending/breakdown", http.StatusServiceUnavailable},
+		{"invalid top", "/api/v1/targets/distro/breakdown?top=x", http.StatusBadRequest},
+		{"ok", "/api/v1/targets/distro/breakdown?top=2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets/distro/breakdown?top=2", nil))
+	var resp targetBreakdown
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Extensions) != 2 || resp.Extensions[0].Extension != ".iso" || resp.Extensions[1].Extension != ".rpm" {
+		t.Errorf("Expected .iso and .rpm as top extensions, got %+v", resp.Extensions)
+	}
+	if resp.Other.Files != 2 || resp.Other.Bytes != 105 {
+		t.Errorf("Expected the remaining 2 files in other, got %+v", resp.Other)
+	}
+	if len(resp.Sizes) != len(stats.SizeBucketLabels) || resp.Sizes[0].Files != 4 {
+		t.Errorf("Expected all files in the first size bucket, got %+v", resp.Sizes)
+	}
+
+	cfg.Server.Breakdown.Enabled = false
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets/distro/breakdown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 while disabled, got %d", w.Code)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// Page sizes of the paginated endpoints. Larger limits are lowered to
+// maxPageLimit; the response then carries a cursor to the rest.
+const (
+	defaultPageLimit = 1000
+	maxPageLimit     = 10000
+)
+
+// treeEntry is a file, directory or symlink returned by /api/v1/targets/{name}/tree
+type treeEntry struct {
+	// Path is slash-separated and relative to the target directory
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// pageParams reads the limit and cursor query parameters of a paginated request
+func pageParams(r *http.Request) (limit int, cursor string, err error) {
+	limit = defaultPageLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return 0, "", errors.New("invalid limit parameter")
+		}
+		limit = min(limit, maxPageLimit)
+	}
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(decoded) == 0 {
+			return 0, "", errors.New("invalid cursor parameter")
+		}
+		cursor = string(decoded)
+	}
+	return limit, cursor, nil
+}
+
+// encodeCursor returns the opaque cursor continuing after position
+func encodeCursor(position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// pageWriter streams a paginated JSON response of the form
+// {"target": ..., "entries": [...], "next_cursor": ...} one entry at a time
+type pageWriter struct {
+	w       io.Writer
+	entries int
+	err     error
+}
+
+// newPageWriter writes the response headers and the start of the response
+func newPageWriter(w http.ResponseWriter, target string) *pageWriter {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	p := &pageWriter{w: w}
+	name, _ := json.Marshal(target)
+	p.write([]byte(`{"target":`), name, []byte(`,"entries":[`))
+	return p
+}
+
+// add encodes a single entry
+func (p *pageWriter) add(entry any) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		p.err = err
+		return
+	}
+	if p.entries > 0 {
+		p.write([]byte(","))
+	}
+	p.write(data)
+	p.entries++
+}
+
+// finish ends the response with the cursor of the next page, if any, and the
+// error that cut the page short, if any
+func (p *pageWriter) finish(next string, pageErr error) error {
+	p.write([]byte(`],"next_cursor":`))
+	if next == "" {
+		p.write([]byte("null"))
+	} else {
+		p.write([]byte(strconv.Quote(encodeCursor(next))))
+	}
+	if pageErr != nil {
+		msg, _ := json.Marshal(pageErr.Error())
+		p.write([]byte(`,"error":`), msg)
+	}
+	p.write([]byte("}\n"))
+	return p.err
+}
+
+func (p *pageWriter) write(chunks ...[]byte) {
+	for _, chunk := range chunks {
+		if p.err != nil {
+			return
+		}
+		_, p.err = p.w.Write(chunk)
+	}
+}
+
+// pathBefore reports whether the slash-separated path a comes before b in the
+// order of a depth-first walk visiting names in lexical order
+func pathBefore(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// servedTarget returns the named target if it may be listed through the API:
+// protected targets are only reachable through signed URLs
+func servedTarget(cfg *config.Config, name string) (config.Target, bool) {
+	for _, target := range cfg.Targets {
+		if target.Name == name {
+			return target, !target.Protected
+		}
+	}
+	return config.Target{}, false
+}
+
+// treeHandler lists the files and directories below a path of a target, in walk
+// order and a page at a time. Entries are streamed while the tree is walked, and
+// directories before the cursor are skipped without being read, so a page costs
+// the same memory no matter how large the tree is.
+func treeHandler(getConfig func() *config.Config, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+		name := r.PathValue("name")
+		target, ok := servedTarget(cfg, name)
+		if !ok {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+
+		limit, cursor, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		hidden := cfg.HiddenPatterns(target.Name)
+		start := strings.Trim(path.Clean("/"+r.URL.Query().Get("path")), "/")
+		for _, part := range strings.Split(start, "/") {
+			if part != "" && (config.IsHidden(hidden, part) || config.IsTempFile(part)) {
+				http.Error(w, "path not found", http.StatusNotFound)
+				return
+			}
+		}
+		root := filepath.Join(cfg.Server.DataPath, target.Name)
+		if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(start))); err != nil || !info.IsDir() {
+			http.Error(w, "path not found", http.StatusNotFound)
+			return
+		}
+
+		page := newPageWriter(w, target.Name)
+		var last, next string
+		walkErr := filepath.WalkDir(filepath.Join(root, filepath.FromSlash(start)), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, p)
+			rel = filepath.ToSlash(rel)
+			if rel == start || rel == "." {
+				return nil
+			}
+			if config.IsHidden(hidden, d.Name()) || config.IsTempFile(d.Name()) {
+				return skipEntry(d)
+			}
+
+			// Entries up to the cursor were returned by earlier pages; only the
+			// directories leading to it need to be entered
+			if cursor != "" && !pathBefore(cursor, rel) {
+				if d.IsDir() && strings.HasPrefix(cursor, rel+"/") {
+					return nil
+				}
+				return skipEntry(d)
+			}
+
+			if page.entries == limit {
+				next = last
+				return fs.SkipAll
+			}
+			page.add(newTreeEntry(rel, d))
+			last = rel
+			return page.err
+		})
+		if walkErr != nil {
+			logger.Warn("Failed to walk target tree", "target", target.Name, "path", start, "error", walkErr)
+		}
+		if err := page.finish(next, walkErr); err != nil {
+			logger.Debug("Failed to write tree response", "target", target.Name, "error", err)
+		}
+	}
+}
+
+// skipEntry skips a directory's contents during a walk, or nothing for files
+func skipEntry(d fs.DirEntry) error {
+	if d.IsDir() {
+		return fs.SkipDir
+	}
+	return nil
+}
+
+// newTreeEntry describes a walked directory entry; symlinks are not followed
+func newTreeEntry(rel string, d fs.DirEntry) treeEntry {
+	entry := treeEntry{Path: rel, Type: "file"}
+	switch {
+	case d.IsDir():
+		entry.Type = "dir"
+	case d.Type()&fs.ModeSymlink != 0:
+		entry.Type = "symlink"
+	}
+	if info, err := d.Info(); err == nil {
+		entry.ModTime = info.ModTime().UTC()
+		if entry.Type == "file" {
+			entry.Size = info.Size()
+		}
+	}
+	return entry
+}
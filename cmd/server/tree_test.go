@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// treePage is the decoded response of the tree endpoint
+type treePage struct {
+	Target     string      `json:"target"`
+	Entries    []treeEntry `json:"entries"`
+	NextCursor *string     `json:"next_cursor"`
+	Error      string      `json:"error"`
+}
+
+// getTree requests a page of the tree endpoint
+func getTree(t *testing.T, handler http.Handler, query url.Values) (int, treePage) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/targets/{name}/tree", handler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets/big/tree?"+query.Encode(), nil))
+
+	var page treePage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Failed to decode response %q: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, page
+}
+
+// writeTree creates dirs directories of files files each below root
+func writeTree(t *testing.T, root string, dirs, files int) {
+	t.Helper()
+	for d := range dirs {
+		dir := filepath.Join(root, fmt.Sprintf("d%03d", d))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for f := range files {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%03d.bin", f)), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestTreeHandlerPaginatesLargeTree(t *testing.T) {
+	dataPath := t.TempDir()
+	const dirs, files = 100, 200
+	writeTree(t, filepath.Join(dataPath, "big"), dirs, files)
+	cfg := &config.Config{Server: config.Server{DataPath: dataPath}, Targets: []config.Target{{Name: "big"}}}
+	handler := treeHandler(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// A page of a large tree is served within a small memory budget
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	code, page := getTree(t, handler, url.Values{"limit": {"100"}})
+	runtime.ReadMemStats(&after)
+	if code != http.StatusOK || len(page.Entries) != 100 || page.NextCursor == nil {
+		t.Fatalf("Expected a full page with a cursor, got %d with %d entries", code, len(page.Entries))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2<<20 {
+		t.Errorf("Expected a page to allocate less than 2 MiB, allocated %d bytes", allocated)
+	}
+
+	// Following the cursors returns every entry exactly once, in walk order
+	var paths []string
+	query := url.Values{"limit": {"3000"}}
+	for pages := 0; ; pages++ {
+		if pages > dirs*files/3000+2 {
+			t.Fatal("Too many pages")
+		}
+		code, page := getTree(t, handler, query)
+		if code != http.StatusOK || page.Error != "" {
+			t.Fatalf("Page %d failed: %d %q", pages, code, page.Error)
+		}
+		for _, entry := range page.Entries {
+			paths = append(paths, entry.Path)
+		}
+		if page.NextCursor == nil {
+			break
+		}
+		query.Set("cursor", *page.NextCursor)
+	}
+	if len(paths) != dirs+dirs*files {
+		t.Fatalf("Expected %d entries, got %d", dirs+dirs*files, len(paths))
+	}
+	if !sort.SliceIsSorted(paths, func(i, j int) bool { return pathBefore(paths[i], paths[j]) }) {
+		t.Error("Expected entries in walk order")
+	}
+	if paths[0] != "d000" || paths[1] != "d000/f000.bin" {
+		t.Errorf("Expected directories before their files, got %v", paths[:2])
+	}
+}
+
+func TestTreeHandler(t *testing.T) {
+	dataPath := t.TempDir()
+	root := filepath.Join(dataPath, "big")
+	writeTree(t, root, 2, 2)
+	for _, name := range []string{".hidden", config.TempFilePrefix + "x", ".http-mirror-state.json"} {
+		if err := os.WriteFile(filepath.Join(root, "d000", name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{
+		Server:  config.Server{DataPath: dataPath},
+		Targets: []config.Target{{Name: "big"}, {Name: "secret", Protected: true}},
+	}
+	handler := treeHandler(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	code, page := getTree(t, handler, url.Values{"path": {"d001"}})
+	if code != http.StatusOK || page.NextCursor != nil || len(page.Entries) != 2 ||
+		page.Entries[0].Path != "d001/f000.bin" || page.Entries[0].Type != "file" {
+		t.Errorf("Expected the two files of d001 without cursor, got %d %+v", code, page)
+	}
+
+	_, page = getTree(t, handler, url.Values{})
+	if len(page.Entries) != 6 {
+		t.Errorf("Expected hidden, temporary and metadata files to be left out, got %+v", page.Entries)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		code  int
+	}{
+		{"missing path", url.Values{"path": {"nope"}}, http.StatusNotFound},
+		{"file path", url.Values{"path": {"d000/f000.bin"}}, http.StatusNotFound},
+		{"hidden path", url.Values{"path": {"d000/.hidden"}}, http.StatusNotFound},
+		{"invalid limit", url.Values{"limit": {"0"}}, http.StatusBadRequest},
+		{"invalid cursor", url.Values{"cursor": {"!"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, _ := getTree(t, handler, tt.query); code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, code)
+		}
+	}
+
+	// Protected targets are not listed
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/targets/{name}/tree", handler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/targets/secret/tree", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a protected target, got %d", w.Code)
+	}
+}
+
+func TestPageParamsClampsLimit(t *testing.T) {
+	limit, _, err := pageParams(httptest.NewRequest("GET", "/?limit=1000000", nil))
+	if err != nil || limit != maxPageLimit {
+		t.Errorf("Expected limit lowered to %d, got %d (%v)", maxPageLimit, limit, err)
+	}
+}
+
+func TestPathBefore(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"a", "a/x", true},
+		{"a/x", "a.txt", true},
+		{"a.txt", "a/x", false},
+		{"a/x", "a/x", false},
+		{"b", "a/z", false},
+	}
+	for _, tt := range tests {
+		if got := pathBefore(tt.a, tt.b); got != tt.expected {
+			t.Errorf("pathBefore(%q, %q) = %v, expected %v", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// usageStatus is the transfer accounting returned by /api/v1/usage
+type usageStatus struct {
+	PeriodStart   *time.Time `json:"period_start"`
+	TrackingSince *time.Time `json:"tracking_since"`
+	// PartialPeriod is set in the month of installation, when transfer from before
+	// tracking started is unknown
+	PartialPeriod bool  `json:"partial_period"`
+	PeriodBytes   int64 `json:"period_bytes"`
+	// MonthlyByteCap and RemainingBytes are null without a cap
+	MonthlyByteCap *int64           `json:"monthly_byte_cap"`
+	RemainingBytes *int64           `json:"remaining_bytes"`
+	TotalBytes     int64            `json:"total_bytes"`
+	PeriodTargets  map[string]int64 `json:"period_bytes_by_target"`
+	TotalTargets   map[string]int64 `json:"total_bytes_by_target"`
+}
+
+// loadUsage reads the accounting written by the updater, as of now
+func loadUsage(cfg *config.Config, now time.Time) (*mirror.Usage, error) {
+	usage, err := mirror.LoadUsage(cfg.Server.DataPath)
+	if err != nil {
+		return nil, err
+	}
+	return usage.At(now, cfg.Mirror.CapResetDay), nil
+}
+
+// newUsageStatus converts the accounting into its API representation
+func newUsageStatus(usage *mirror.Usage, monthlyCap int64) usageStatus {
+	status := usageStatus{
+		PeriodBytes:   usage.PeriodBytes,
+		TotalBytes:    usage.TotalBytes,
+		PeriodTargets: usage.PeriodTargets,
+		TotalTargets:  usage.TotalTargets,
+	}
+	if !usage.PeriodStart.IsZero() {
+		status.PeriodStart = &usage.PeriodStart
+		status.TrackingSince = &usage.TrackingSince
+		status.PartialPeriod = usage.Partial()
+	}
+	if monthlyCap > 0 {
+		remaining := max(monthlyCap-usage.PeriodBytes, 0)
+		status.MonthlyByteCap = &monthlyCap
+		status.RemainingBytes = &remaining
+	}
+	return status
+}
+
+// usageHandler serves the transfer accounting of all targets
+func usageHandler(getConfig func() *config.Config, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig()
+
+		usage, err := loadUsage(cfg, time.Now())
+		if err != nil {
+			logger.Warn("Failed to load transfer accounting", "error", err)
+			http.Error(w, "Failed to load transfer accounting", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(newUsageStatus(usage, httpPkg.ParseSize(cfg.Mirror.MonthlyByteCap)))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+func TestUsageHandler(t *testing.T) {
+	dataPath := t.TempDir()
+	now := time.Now()
+	periodStart := mirror.BillingPeriodStart(now, 1)
+
+	usage := mirror.Usage{
+		PeriodStart:   periodStart,
+		TrackingSince: periodStart,
+		PeriodBytes:   300,
+		PeriodTargets: map[string]int64{"a": 300},
+		TotalBytes:    900,
+		TotalTargets:  map[string]int64{"a": 900},
+	}
+	data, _ := json.Marshal(usage)
+	if err := os.WriteFile(filepath.Join(dataPath, mirror.UsageFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Server: config.Server{DataPath: dataPath},
+		Mirror: config.Mirror{MonthlyByteCap: "1k", CapResetDay: 1},
+	}
+	handler := usageHandler(func() *config.Config { return cfg }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/usage", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var status usageStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if status.PeriodBytes != 300 || status.TotalBytes != 900 || status.PartialPeriod {
+		t.Errorf("Unexpected usage %+v", status)
+	}
+	if status.MonthlyByteCap == nil || *status.MonthlyByteCap != 1024 || status.RemainingBytes == nil || *status.RemainingBytes != 724 {
+		t.Errorf("Expected 724 of 1024 bytes remaining, got %+v", status)
+	}
+
+	// A period that has ended reports no usage for the current one
+	cfg.Mirror.MonthlyByteCap = ""
+	usage.PeriodStart = periodStart.AddDate(0, -2, 0)
+	data, _ = json.Marshal(usage)
+	os.WriteFile(filepath.Join(dataPath, mirror.UsageFileName), data, 0644)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/usage", nil))
+	status = usageStatus{}
+	json.NewDecoder(w.Body).Decode(&status)
+	if status.PeriodBytes != 0 || status.TotalBytes != 900 || status.MonthlyByteCap != nil {
+		t.Errorf("Expected reset period without cap, got %+v", status)
+	}
+}
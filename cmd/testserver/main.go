@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,8 +10,71 @@ import (
 )
 
 func main() {
-	// Create a simple file server that mimics Apache/Nginx directory listings
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	requireUserAgent := flag.String("require-user-agent", "", "Reject requests whose User-Agent differs with 403 Forbidden")
+	flag.Parse()
+
+	port := "8080"
+	fmt.Printf("🚀 Test server starting on http://localhost:%s\n", port)
+	fmt.Printf("📁 Directory listing available at: http://localhost:%s/\n", port)
+	fmt.Printf("📄 Direct files:\n")
+	fmt.Printf("   - http://localhost:%s/file1.txt\n", port)
+	fmt.Printf("   - http://localhost:%s/file2.txt\n", port)
+	fmt.Printf("   - http://localhost:%s/subdir/\n", port)
+	fmt.Printf("   - http://localhost:%s/subdir/nested.txt\n", port)
+	fmt.Printf("   - http://localhost:%s/subdir/another.log\n", port)
+	fmt.Printf("🔍 Request headers echoed at: http://localhost:%s/echo\n", port)
+	if *requireUserAgent != "" {
+		fmt.Printf("🔒 Only accepting User-Agent: %s\n", *requireUserAgent)
+	}
+	fmt.Printf("\n🔄 Use Ctrl+C to stop the server\n")
+
+	log.Fatal(http.ListenAndServe(":"+port, newHandler(*requireUserAgent)))
+}
+
+// echoResponse describes a received request as returned by /echo
+type echoResponse struct {
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Headers http.Header `json:"headers"`
+}
+
+// echoHandler returns the method, path and headers of the request as JSON, so the
+// exact request the mirror sends can be inspected
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	headers := r.Header.Clone()
+	// Go moves these out of the header map, but they are sent on the wire
+	headers.Set("Host", r.Host)
+	if r.ContentLength > 0 {
+		headers.Set("Content-Length", fmt.Sprint(r.ContentLength))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(echoResponse{Method: r.Method, Path: r.URL.Path, Headers: headers})
+}
+
+// requireUserAgentMiddleware rejects requests with a different User-Agent; an empty
+// userAgent accepts all requests
+func requireUserAgentMiddleware(userAgent string, next http.Handler) http.Handler {
+	if userAgent == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.UserAgent(); got != userAgent {
+			log.Printf("Rejecting %s %s with User-Agent %q", r.Method, r.URL.Path, got)
+			http.Error(w, "403 Forbidden: unexpected User-Agent", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newHandler creates the test server handler
+func newHandler(requireUserAgent string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", echoHandler)
+
+	// A simple file server that mimics Apache/Nginx directory listings
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s %s", r.Method, r.URL.Path)
 
 		switch r.URL.Path {
@@ -89,16 +154,5 @@ func main() {
 		}
 	})
 
-	port := "8080"
-	fmt.Printf("🚀 Test server starting on http://localhost:%s\n", port)
-	fmt.Printf("📁 Directory listing available at: http://localhost:%s/\n", port)
-	fmt.Printf("📄 Direct files:\n")
-	fmt.Printf("   - http://localhost:%s/file1.txt\n", port)
-	fmt.Printf("   - http://localhost:%s/file2.txt\n", port)
-	fmt.Printf("   - http://localhost:%s/subdir/\n", port)
-	fmt.Printf("   - http://localhost:%s/subdir/nested.txt\n", port)
-	fmt.Printf("   - http://localhost:%s/subdir/another.log\n", port)
-	fmt.Printf("\n🔄 Use Ctrl+C to stop the server\n")
-
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	return requireUserAgentMiddleware(requireUserAgent, mux)
 }
@@ -2,19 +2,51 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/jhofer-cloud/http-mirror/pkg/config"
-	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
 )
 
+// exitMonthlyCap is the exit code when runs stopped at Mirror.MonthlyByteCap, so
+// schedulers can tell an exhausted budget from failures
+const exitMonthlyCap = 3
+
+// exitUpstreamUnavailable is the exit code when every failed target failed with a
+// temporary upstream error (timeouts, network errors, 5xx, 429), so schedulers can
+// retry sooner than after other failures
+const exitUpstreamUnavailable = 4
+
 func main() {
 	// Parse command line flags
 	configFile := flag.String("config", "", "Path to configuration file")
+	probe := flag.Bool("probe", false, "Check that every target is reachable and parseable without downloading; exits with the number of unreachable targets")
+	probeJSON := flag.Bool("json", false, "Print --probe and --verify results as JSON instead of a table")
+	adopt := flag.Bool("adopt", false, "Record files already present in the target directories without downloading, then exit")
+	adoptHash := flag.Bool("adopt-hash", false, "Compute SHA-256 hashes of adopted files (slow for large trees)")
+	cleanup := flag.Bool("cleanup", false, "Remove stale temporary and partial download files from the target directories, then exit")
+	auditTimes := flag.Bool("audit-times", false, "Report files whose modification time lies in the future, clamping them with clampFutureTimes, then exit")
+	purgeTarget := flag.String("purge-target", "", "Delete all mirrored data and metadata of the named target, then exit; requires --yes")
+	resetTarget := flag.String("reset-target", "", "Delete the metadata of the named target so that the next run checks every file again, then exit; requires --yes")
+	verify := flag.String("verify", "", "Check the files of the named target against its manifest and report missing, corrupted and unknown files, then exit")
+	verifySample := flag.Int("verify-sample", 0, "Number of random files whose upstream --verify checks with a HEAD request")
+	repair := flag.Bool("repair", false, "Download the files --verify finds missing or corrupted again")
+	yes := flag.Bool("yes", false, "Confirm --purge-target or --reset-target")
+	full := flag.Bool("full", false, "List every directory in full, including those whose listings churnSkipAfter would skip or conditionalListings request conditionally")
+	printCfg := flag.Bool("print-config", false, "Print the resolved configuration as JSON with secrets redacted, then exit")
+	generateConfig := flag.String("generate-config", "", "Print an example configuration with every setting at its default, as \"yaml\" with comments or \"json\", then exit")
+	configSchema := flag.Bool("config-schema", false, "Print the JSON Schema of config files, then exit")
+	reportFile := flag.String("report-file", "", "Also write the JSON summary of the run, with the stats of every target, to this file")
 	flag.Parse()
 
 	// Setup logging
@@ -30,11 +62,25 @@ func main() {
 		}
 	}
 
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	// Probe results and the configuration go to stdout, so logs move to stderr
+	logOutput := os.Stdout
+	if *probe || *printCfg || *generateConfig != "" || *configSchema {
+		logOutput = os.Stderr
+	}
+	logger := slog.New(slog.NewJSONHandler(logOutput, &slog.HandlerOptions{
 		Level: logLevel,
 	}))
 	slog.SetDefault(logger)
 
+	// The example and schema describe config files rather than the loaded one
+	if *generateConfig != "" || *configSchema {
+		if err := writeConfigDocs(os.Stdout, *generateConfig, *configSchema); err != nil {
+			logger.Error("Failed to write configuration documentation", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	logger.Info("Starting HTTP Mirror Updater")
 
 	// Set config file if provided
@@ -49,6 +95,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *printCfg {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			logger.Error("Failed to print configuration", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Validate configuration
 	if len(cfg.Targets) == 0 {
 		logger.Error("No mirror targets configured")
@@ -59,16 +113,80 @@ func main() {
 		"targets", len(cfg.Targets),
 		"data_path", cfg.Mirror.DataPath)
 
-	// Create mirror manager
-	manager := mirror.NewManager(cfg, logger)
+	// Create one mirrorer per target; they share per-host politeness
+	opts := mirrorOptions(cfg, logger)
+	for i := range opts {
+		opts[i].Settings.FullScan = *full
+	}
+	mirrorers, err := mirrorlib.NewGroup(opts...)
+	if err != nil {
+		logger.Error("Invalid mirror configuration", "error", err)
+		os.Exit(1)
+	}
 
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
 	defer cancel()
 
+	if *probe {
+		unreachable, err := runProbe(ctx, mirrorers, os.Stdout, *probeJSON)
+		if err != nil {
+			logger.Error("Failed to write probe results", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(min(unreachable, 125))
+	}
+
+	if *adopt {
+		os.Exit(runAdopt(ctx, cfg, mirrorers, *adoptHash, logger))
+	}
+
+	if *cleanup {
+		os.Exit(runCleanup(ctx, cfg, mirrorers, logger))
+	}
+
+	if *auditTimes {
+		os.Exit(runAuditTimes(ctx, cfg, mirrorers, logger))
+	}
+
+	if *verify != "" {
+		// Hashing a large mirror takes longer than a run may; an interrupted
+		// verification resumes on the next call
+		verifyCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := runVerify(verifyCtx, cfg, mirrorers, *verify, mirrorlib.VerifyOptions{Sample: *verifySample, Repair: *repair}, os.Stdout, *probeJSON, logger)
+		stop()
+		os.Exit(code)
+	}
+
+	if *purgeTarget != "" && *resetTarget != "" {
+		logger.Error("Use either --purge-target or --reset-target")
+		os.Exit(1)
+	}
+	if *purgeTarget != "" {
+		os.Exit(runPurge(ctx, cfg, mirrorers, *purgeTarget, false, *yes, logger))
+	}
+	if *resetTarget != "" {
+		os.Exit(runPurge(ctx, cfg, mirrorers, *resetTarget, true, *yes, logger))
+	}
+
 	// Mirror all targets
-	var errors []error
+	var failures []error
+	capReached := false
+	frozen := 0
+	var filtersReported, budgetExceeded []string
+	summary := newRunSummary(time.Now())
 	for i, target := range cfg.Targets {
+		if capReached {
+			summary.add(target.Name, statusSkipped, nil, 0, nil)
+			continue
+		}
+		if target.Frozen {
+			// Run only records since when the target is frozen
+			mirrorers[i].Run(ctx)
+			summary.add(target.Name, statusFrozen, nil, 0, nil)
+			frozen++
+			continue
+		}
 		logger.Info("Starting mirror for target",
 			"index", i+1,
 			"total", len(cfg.Targets),
@@ -76,39 +194,296 @@ func main() {
 			"url", target.URL)
 
 		startTime := time.Now()
-		err := manager.MirrorTarget(ctx, &target)
+		stats, err := mirrorers[i].Run(ctx)
 		duration := time.Since(startTime)
+		if stats.DirectoriesReported > 0 {
+			logFilterReport(stats, logger)
+			filtersReported = append(filtersReported, target.Name)
+		}
 
+		if errors.Is(err, mirrorlib.ErrMonthlyCapReached) {
+			logger.Warn("Monthly byte cap reached, skipping remaining targets",
+				"name", target.Name,
+				"skipped", len(cfg.Targets)-i-1,
+				"error", err)
+			summary.add(target.Name, statusCapped, &stats, duration, err)
+			capReached = true
+			continue
+		}
+		if errors.Is(err, mirrorlib.ErrBudgetExceeded) {
+			logger.Warn("Run budget of target exceeded, stopped early",
+				"name", target.Name,
+				"budget", stats.BudgetExceeded,
+				"files_downloaded", stats.FilesDownloaded,
+				"bytes_downloaded", stats.BytesDownloaded,
+				"duration", duration,
+				"error", err)
+			summary.add(target.Name, statusBudget, &stats, duration, err)
+			budgetExceeded = append(budgetExceeded, target.Name)
+			continue
+		}
 		if err != nil {
 			logger.Error("Failed to mirror target",
 				"name", target.Name,
 				"url", target.URL,
 				"duration", duration,
 				"error", err)
-			errors = append(errors, fmt.Errorf("target %s: %w", target.Name, err))
+			failures = append(failures, fmt.Errorf("target %s: %w", target.Name, err))
+			summary.add(target.Name, statusFailed, &stats, duration, err)
 		} else {
 			logger.Info("Successfully mirrored target",
 				"name", target.Name,
 				"url", target.URL,
-				"duration", duration)
+				"duration", duration,
+				"skip_reasons", stats.SkipReasons)
+			summary.add(target.Name, statusOK, &stats, duration, nil)
 		}
 	}
 
 	// Final summary
-	if len(errors) > 0 {
+	logUsage(mirrorers[0], logger)
+
+	exitCode := 0
+	if len(failures) > 0 {
+		exitCode = failureExitCode(failures)
+	} else if capReached {
+		exitCode = exitMonthlyCap
+	}
+	summary.finish(exitCode)
+	for i, failure := range summary.Totals.TopFailures {
+		logger.Warn("Frequent download failure",
+			"rank", i+1,
+			"signature", failure.Signature,
+			"files", failure.Count)
+	}
+	if err := summary.write(os.Stdout, *reportFile); err != nil {
+		logger.Error("Failed to write run summary", "report_file", *reportFile, "error", err)
+	}
+
+	if len(failures) > 0 {
 		logger.Error("Mirror process completed with errors",
-			"successful", len(cfg.Targets)-len(errors),
-			"failed", len(errors),
+			"successful", len(cfg.Targets)-len(failures)-frozen,
+			"failed", len(failures),
+			"frozen", frozen,
+			"filters_reported", filtersReported,
+			"budget_exceeded", budgetExceeded,
 			"total", len(cfg.Targets))
 
-		for _, err := range errors {
+		for _, err := range failures {
 			logger.Error("Error details", "error", err)
 		}
 
 		// Exit with error code if any mirrors failed
-		os.Exit(1)
+		os.Exit(exitCode)
+	} else if capReached {
+		os.Exit(exitCode)
 	} else {
 		logger.Info("Mirror process completed successfully",
-			"targets", len(cfg.Targets))
+			"targets", len(cfg.Targets),
+			"frozen", frozen,
+			"filters_reported", filtersReported,
+			"budget_exceeded", budgetExceeded)
+	}
+}
+
+// failureExitCode returns the exit code for failed targets
+func failureExitCode(failures []error) int {
+	for _, err := range failures {
+		if !mirrorlib.IsTemporary(err) {
+			return 1
+		}
+	}
+	return exitUpstreamUnavailable
+}
+
+// logFilterReport logs what the filters of a target in report mode would have
+// skipped or deleted, so that they can be reviewed before they are enforced
+func logFilterReport(stats mirrorlib.Stats, logger *slog.Logger) {
+	var skip, remove []string
+	for _, d := range stats.ExcludedDirs {
+		if !d.Reported {
+			continue
+		}
+		skip = append(skip, d.Path)
+		if d.WouldDelete {
+			remove = append(remove, d.Path)
+		}
+	}
+	logger.Warn("REPORT MODE: filters matched directories that were mirrored anyway; set filterMode to enforce once reviewed",
+		"name", stats.Target,
+		"directories_reported", stats.DirectoriesReported,
+		"files_reported", stats.FilesReported,
+		"would_skip", skip,
+		"would_delete", remove)
+}
+
+// logUsage logs the transfer accounting shared by all targets
+func logUsage(m *mirrorlib.Mirrorer, logger *slog.Logger) {
+	usage, err := m.Usage()
+	if err != nil {
+		logger.Warn("Failed to read transfer accounting", "error", err)
+		return
+	}
+	if usage.PeriodStart.IsZero() {
+		return
+	}
+
+	args := []any{
+		"period_start", usage.PeriodStart,
+		"period_bytes", usage.PeriodBytes,
+		"total_bytes", usage.TotalBytes,
+		"period_bytes_by_target", usage.PeriodBytesByTarget,
+		"partial_period", usage.TrackingSince.After(usage.PeriodStart),
+	}
+	if usage.MonthlyByteCap > 0 {
+		args = append(args,
+			"monthly_byte_cap", usage.MonthlyByteCap,
+			"remaining_bytes", max(usage.MonthlyByteCap-usage.PeriodBytes, 0))
+	}
+	logger.Info("Transfer usage", args...)
+}
+
+// writeConfigDocs writes the example configuration in format, if set, or else the
+// JSON Schema of config files
+func writeConfigDocs(w io.Writer, format string, schema bool) error {
+	if format != "" {
+		return config.WriteExample(w, format)
+	}
+	return config.WriteSchema(w)
+}
+
+// printConfig writes the resolved configuration with secrets redacted as JSON
+func printConfig(w io.Writer, cfg *config.Config) error {
+	effective, err := cfg.Effective()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(effective)
+}
+
+// runAdopt adopts the existing files of every target and returns the exit code
+func runAdopt(ctx context.Context, cfg *config.Config, mirrorers []*mirrorlib.Mirrorer, hash bool, logger *slog.Logger) int {
+	failed := 0
+	for i, target := range cfg.Targets {
+		if target.Frozen {
+			logger.Info("Skipping frozen target", "name", target.Name)
+			continue
+		}
+		stats, err := mirrorers[i].Adopt(ctx, hash)
+		if err != nil {
+			logger.Error("Failed to adopt target", "name", target.Name, "files", stats.Files, "error", err)
+			failed++
+			continue
+		}
+		logger.Info("Adopted target", "name", target.Name, "files", stats.Files, "bytes", stats.Bytes, "known", stats.Known)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runCleanup removes the stale temporary files of every target and returns the exit code
+func runCleanup(ctx context.Context, cfg *config.Config, mirrorers []*mirrorlib.Mirrorer, logger *slog.Logger) int {
+	failed := 0
+	for i, target := range cfg.Targets {
+		stats, err := mirrorers[i].Cleanup(ctx)
+		if errors.Is(err, mirrorlib.ErrTargetFrozen) {
+			logger.Info("Skipping frozen target", "name", target.Name)
+			continue
+		}
+		if err != nil {
+			logger.Error("Failed to clean up target", "name", target.Name, "files", stats.Files, "error", err)
+			failed++
+			continue
+		}
+		logger.Info("Cleaned up target", "name", target.Name, "files", stats.Files, "bytes", stats.Bytes, "resumable", stats.Resumable)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runAuditTimes reports the files of every target with modification times in the
+// future and returns the exit code
+func runAuditTimes(ctx context.Context, cfg *config.Config, mirrorers []*mirrorlib.Mirrorer, logger *slog.Logger) int {
+	failed := 0
+	for i, target := range cfg.Targets {
+		stats, err := mirrorers[i].AuditTimes(ctx)
+		if err != nil {
+			logger.Error("Failed to audit target", "name", target.Name, "files", stats.Files, "error", err)
+			failed++
+			continue
+		}
+		logger.Info("Audited target", "name", target.Name, "future_mod_times", stats.Files, "clamped", stats.Clamped)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// mirrorOptions converts the loaded configuration into embedding options, one per target
+func mirrorOptions(cfg *config.Config, logger *slog.Logger) []mirrorlib.Options {
+	var hosts []mirrorlib.HostPolicy
+	for _, h := range cfg.Mirror.Hosts {
+		hosts = append(hosts, mirrorlib.HostPolicy{
+			Host:                h.Host,
+			WaitBetweenRequests: time.Duration(h.WaitBetweenRequests) * time.Second,
+			MaxConcurrency:      h.MaxConcurrency,
+		})
+	}
+
+	// Disabled checks and limits are 0 in the configuration but negative in the
+	// embedding API, where 0 selects the default
+	disabledAsNegative := func(v int) int {
+		if v <= 0 {
+			return -1
+		}
+		return v
+	}
+
+	settings := mirrorlib.Settings{
+		WriteBufferSize:  cfg.Mirror.WriteBufferSize,
+		SyncWrites:       cfg.Mirror.SyncWrites,
+		MaxListingBytes:  cfg.Mirror.MaxResponseBytes,
+		FilesystemCompat: cfg.Mirror.FilesystemCompat,
+		LogThrottle: mirrorlib.LogThrottle{
+			Disabled:        !cfg.Mirror.LogThrottle.Enabled,
+			Burst:           cfg.Mirror.LogThrottle.Burst,
+			SampleRate:      cfg.Mirror.LogThrottle.SampleRate,
+			SummaryInterval: time.Duration(cfg.Mirror.LogThrottle.SummaryInterval) * time.Second,
+		},
+		Hosts:                    hosts,
+		EmptyListingAlertPercent: disabledAsNegative(cfg.Mirror.EmptyListingAlertPercent),
+		MaxDirectories:           disabledAsNegative(cfg.Mirror.MaxDirectories),
+		MaxEntriesPerDirectory:   disabledAsNegative(cfg.Mirror.MaxEntriesPerDirectory),
+		MaxPathDepth:             disabledAsNegative(cfg.Mirror.MaxPathDepth),
+		VerifyRelinks:            cfg.Mirror.VerifyRelinks,
+		UsageDir:                 cfg.Mirror.DataPath,
+		MonthlyByteCap:           cfg.Mirror.MonthlyByteCap,
+		CapResetDay:              cfg.Mirror.CapResetDay,
+		TempMaxAge:               time.Duration(disabledAsNegative(cfg.Mirror.TempMaxAge)) * time.Second,
+		ReportDetail:             cfg.Mirror.ReportDetail,
+		FutureTimeTolerance:      time.Duration(disabledAsNegative(cfg.Mirror.FutureTimeTolerance)) * time.Second,
+		ClampFutureTimes:         cfg.Mirror.ClampFutureTimes,
+		MaxOpenTransfers:         cfg.Mirror.MaxOpenTransfers,
+	}
+
+	opts := make([]mirrorlib.Options, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		opts[i] = mirrorlib.Options{
+			Target:   mirrorlib.TargetFromConfig(t),
+			Dir:      filepath.Join(cfg.Mirror.DataPath, t.Name),
+			Logger:   logger,
+			Settings: settings,
+		}
 	}
+	return opts
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+// probeReport is the JSON form of a probe result
+type probeReport struct {
+	Target         string `json:"target"`
+	URL            string `json:"url"`
+	Reachable      bool   `json:"reachable"`
+	StatusCode     int    `json:"statusCode,omitempty"`
+	ResponseTimeMs int64  `json:"responseTimeMs"`
+	Server         string `json:"server,omitempty"`
+	Format         string `json:"format,omitempty"`
+	Generator      string `json:"generator,omitempty"`
+	Links          int    `json:"links"`
+	// ExcludedDirs are root directories skipped by ExcludeDirs, with the matching pattern
+	ExcludedDirs []excludedReport `json:"excludedDirs,omitempty"`
+	Error        string           `json:"error,omitempty"`
+}
+
+// excludedReport is the JSON form of a skipped subtree
+type excludedReport struct {
+	Path    string `json:"path"`
+	Pattern string `json:"pattern"`
+}
+
+// runProbe checks all targets concurrently, writes the results to out as a table or
+// JSON and returns the number of unreachable targets
+func runProbe(ctx context.Context, mirrorers []*mirrorlib.Mirrorer, out io.Writer, asJSON bool) (int, error) {
+	results := make([]mirrorlib.ProbeResult, len(mirrorers))
+
+	// Targets on a shared host are still paced by the group's host coordinator
+	var wg sync.WaitGroup
+	for i, m := range mirrorers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = m.Probe(ctx)
+		}()
+	}
+	wg.Wait()
+
+	unreachable := 0
+	for _, r := range results {
+		if !r.Reachable {
+			unreachable++
+		}
+	}
+
+	if asJSON {
+		return unreachable, writeProbeJSON(out, results)
+	}
+	return unreachable, writeProbeTable(out, results)
+}
+
+// writeProbeJSON writes probe results as a JSON array
+func writeProbeJSON(out io.Writer, results []mirrorlib.ProbeResult) error {
+	reports := make([]probeReport, len(results))
+	for i, r := range results {
+		reports[i] = probeReport{
+			Target:         r.Target,
+			URL:            r.URL,
+			Reachable:      r.Reachable,
+			StatusCode:     r.StatusCode,
+			ResponseTimeMs: r.ResponseTime.Milliseconds(),
+			Server:         r.Server,
+			Format:         r.Format,
+			Generator:      r.Generator,
+			Links:          r.Links,
+			Error:          r.Err,
+		}
+		for _, d := range r.ExcludedDirs {
+			reports[i].ExcludedDirs = append(reports[i].ExcludedDirs, excludedReport{Path: d.Path, Pattern: d.Pattern})
+		}
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reports)
+}
+
+// writeProbeTable writes probe results as an aligned text table
+func writeProbeTable(out io.Writer, results []mirrorlib.ProbeResult) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTATUS\tTIME\tSERVER\tFORMAT\tLINKS\tERROR")
+	for _, r := range results {
+		status := "unreachable"
+		if r.StatusCode != 0 {
+			status = fmt.Sprint(r.StatusCode)
+		}
+		format := r.Format
+		if r.Generator != "" {
+			format += " (" + r.Generator + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			r.Target, status, r.ResponseTime.Round(time.Millisecond),
+			orDash(r.Server), orDash(format), r.Links, orDash(r.Err))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	header := false
+	for _, r := range results {
+		for _, d := range r.ExcludedDirs {
+			if !header {
+				fmt.Fprintln(tw, "\nSKIPPED SUBTREE\tPATTERN")
+				header = true
+			}
+			fmt.Fprintf(tw, "%s/%s/\t%s\n", r.Target, d.Path, d.Pattern)
+		}
+	}
+	return tw.Flush()
+}
+
+// orDash returns s, or "-" for empty table cells
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+func TestRunProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/up/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="file.txt">file.txt</a>`))
+	}))
+	defer server.Close()
+
+	mirrorers, err := mirrorlib.NewGroup(
+		mirrorlib.Options{Target: mirrorlib.Target{Name: "up", URL: server.URL + "/up/"}, Dir: t.TempDir()},
+		mirrorlib.Options{Target: mirrorlib.Target{Name: "down", URL: server.URL + "/down/"}, Dir: t.TempDir()},
+	)
+	if err != nil {
+		t.Fatalf("NewGroup failed: %v", err)
+	}
+
+	var table bytes.Buffer
+	unreachable, err := runProbe(context.Background(), mirrorers, &table, false)
+	if err != nil {
+		t.Fatalf("runProbe failed: %v", err)
+	}
+	if unreachable != 1 {
+		t.Errorf("Expected 1 unreachable target, got %d", unreachable)
+	}
+
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "TARGET") {
+		t.Fatalf("Unexpected table:\n%s", table.String())
+	}
+	if !strings.Contains(lines[1], "html-listing") || !strings.Contains(lines[2], "404") {
+		t.Errorf("Unexpected table rows:\n%s", table.String())
+	}
+
+	var out bytes.Buffer
+	if _, err := runProbe(context.Background(), mirrorers, &out, true); err != nil {
+		t.Fatalf("runProbe failed: %v", err)
+	}
+	var reports []probeReport
+	if err := json.Unmarshal(out.Bytes(), &reports); err != nil {
+		t.Fatalf("Invalid JSON output: %v", err)
+	}
+	if len(reports) != 2 || !reports[0].Reachable || reports[0].Links != 1 || reports[1].Reachable {
+		t.Errorf("Unexpected JSON reports: %+v", reports)
+	}
+}
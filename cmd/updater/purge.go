@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"slices"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+// runPurge deletes the data of the named target, or only its metadata with reset,
+// and returns the exit code. Nothing is removed unless confirmed.
+func runPurge(ctx context.Context, cfg *config.Config, mirrorers []*mirrorlib.Mirrorer, name string, reset, confirmed bool, logger *slog.Logger) int {
+	action := "purge"
+	if reset {
+		action = "reset"
+	}
+
+	i := slices.IndexFunc(cfg.Targets, func(t config.Target) bool { return t.Name == name })
+	if i < 0 {
+		logger.Error("Unknown target, nothing to "+action, "name", name)
+		return 1
+	}
+	path := filepath.Join(cfg.Mirror.DataPath, name)
+	if !confirmed {
+		logger.Error("Refusing to "+action+" target without --yes", "name", name, "path", path)
+		return 1
+	}
+
+	var stats mirrorlib.PurgeStats
+	var err error
+	if reset {
+		stats, err = mirrorers[i].Reset(ctx, cfg.Mirror.DataPath)
+	} else {
+		stats, err = mirrorers[i].Purge(ctx, cfg.Mirror.DataPath)
+	}
+	if err != nil {
+		logger.Error("Failed to "+action+" target", "name", name, "path", path, "files", stats.Files, "bytes", stats.Bytes, "error", err)
+		return 1
+	}
+	if reset {
+		logger.Info("Reset target metadata", "name", name, "path", path, "files", stats.Files, "bytes", stats.Bytes)
+	} else {
+		logger.Info("Purged target", "name", name, "path", path, "files", stats.Files, "bytes", stats.Bytes)
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+func TestRunPurge(t *testing.T) {
+	dataPath := t.TempDir()
+	for _, name := range []string{"a/file.txt", "a/.http-mirror-state.json", "b/file.txt"} {
+		path := filepath.Join(dataPath, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("data"), 0644)
+	}
+	cfg := &config.Config{
+		Targets: []config.Target{{Name: "a", URL: "http://example.com/a/"}, {Name: "b", URL: "http://example.com/b/"}},
+		Mirror:  config.Mirror{DataPath: dataPath},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mirrorers, err := mirrorlib.NewGroup(mirrorOptions(cfg, logger)...)
+	if err != nil {
+		t.Fatalf("NewGroup failed: %v", err)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dataPath, filepath.FromSlash(name)))
+		return err == nil
+	}
+
+	if code := runPurge(context.Background(), cfg, mirrorers, "a", false, false, logger); code != 1 || !exists("a/file.txt") {
+		t.Errorf("Expected an unconfirmed purge to be refused, got exit code %d", code)
+	}
+	if code := runPurge(context.Background(), cfg, mirrorers, "c", false, true, logger); code != 1 {
+		t.Errorf("Expected an unknown target to fail, got exit code %d", code)
+	}
+
+	if code := runPurge(context.Background(), cfg, mirrorers, "a", true, true, logger); code != 0 {
+		t.Fatalf("Expected reset to succeed, got exit code %d", code)
+	}
+	if exists("a/.http-mirror-state.json") || !exists("a/file.txt") {
+		t.Error("Expected reset to remove only the metadata")
+	}
+
+	if code := runPurge(context.Background(), cfg, mirrorers, "a", false, true, logger); code != 0 {
+		t.Fatalf("Expected purge to succeed, got exit code %d", code)
+	}
+	if exists("a") || !exists("b/file.txt") {
+		t.Error("Expected purge to remove the target directory and nothing else")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+// Statuses of targets in a run summary
+const (
+	statusOK      = "ok"
+	statusFailed  = "failed"
+	statusFrozen  = "frozen"
+	statusSkipped = "skipped"
+	// statusCapped is the target whose run stopped at the monthly byte cap
+	statusCapped = "capped"
+	// statusBudget is a target whose run stopped at its maxTotalBytes or
+	// maxTotalFiles; the updater goes on with the other targets
+	statusBudget = "budget-exceeded"
+)
+
+// runSummary is the JSON summary of an updater run over all targets
+type runSummary struct {
+	StartTime  time.Time       `json:"startTime"`
+	EndTime    time.Time       `json:"endTime"`
+	DurationMs int64           `json:"durationMs"`
+	ExitCode   int             `json:"exitCode"`
+	Totals     summaryTotals   `json:"totals"`
+	Targets    []targetSummary `json:"targets"`
+}
+
+// summaryTotals adds up the stats of all targets of a run
+type summaryTotals struct {
+	Targets         int              `json:"targets"`
+	Failed          int              `json:"failed"`
+	FilesDownloaded int64            `json:"filesDownloaded"`
+	FilesSkipped    int64            `json:"filesSkipped"`
+	BytesDownloaded int64            `json:"bytesDownloaded"`
+	FilesDeleted    int64            `json:"filesDeleted"`
+	Errors          int64            `json:"errors"`
+	ErrorsByClass   map[string]int64 `json:"errorsByClass"`
+	// TopFailures are the most frequent failure signatures over all targets
+	TopFailures []failureCount `json:"topFailures,omitempty"`
+	// signatures counts the failure signatures of all targets
+	signatures map[string]int64
+}
+
+// failureCount is a failure signature and the number of files that failed with it
+type failureCount struct {
+	Signature string `json:"signature"`
+	Count     int64  `json:"count"`
+}
+
+// maxTopFailures is the number of failure signatures the summary lists
+const maxTopFailures = 3
+
+// targetSummary is the outcome of one target: its status, the error it failed
+// with and the stats of its run, if it ran
+type targetSummary struct {
+	Target     string           `json:"target"`
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"`
+	Temporary  bool             `json:"temporary,omitempty"`
+	DurationMs int64            `json:"durationMs"`
+	Stats      *mirrorlib.Stats `json:"stats,omitempty"`
+}
+
+// newRunSummary starts the summary of a run begun at start
+func newRunSummary(start time.Time) *runSummary {
+	return &runSummary{
+		StartTime: start,
+		Totals:    summaryTotals{ErrorsByClass: map[string]int64{}, signatures: map[string]int64{}},
+		Targets:   []targetSummary{},
+	}
+}
+
+// add records the outcome of a target; stats are left out of targets that did
+// not run
+func (s *runSummary) add(name, status string, stats *mirrorlib.Stats, duration time.Duration, err error) {
+	t := targetSummary{Target: name, Status: status, DurationMs: duration.Milliseconds(), Stats: stats}
+	if err != nil {
+		t.Error, t.Temporary = err.Error(), mirrorlib.IsTemporary(err)
+	}
+	s.Targets = append(s.Targets, t)
+
+	s.Totals.Targets++
+	if status == statusFailed {
+		s.Totals.Failed++
+	}
+	if stats == nil {
+		return
+	}
+	s.Totals.FilesDownloaded += stats.FilesDownloaded
+	s.Totals.FilesSkipped += stats.FilesSkipped
+	s.Totals.BytesDownloaded += stats.BytesDownloaded
+	s.Totals.FilesDeleted += stats.FilesDeleted
+	s.Totals.Errors += stats.Errors
+	for class, n := range stats.ErrorsByClass {
+		s.Totals.ErrorsByClass[class] += n
+	}
+	for signature, n := range stats.FailureSignatures {
+		s.Totals.signatures[signature] += n
+	}
+}
+
+// finish completes the summary with the exit code of the run
+func (s *runSummary) finish(exitCode int) {
+	s.EndTime = time.Now()
+	s.DurationMs = s.EndTime.Sub(s.StartTime).Milliseconds()
+	s.ExitCode = exitCode
+
+	// The most frequent signatures come first, ties in name order
+	for signature, n := range s.Totals.signatures {
+		s.Totals.TopFailures = append(s.Totals.TopFailures, failureCount{Signature: signature, Count: n})
+	}
+	slices.SortFunc(s.Totals.TopFailures, func(a, b failureCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Signature, b.Signature))
+	})
+	s.Totals.TopFailures = s.Totals.TopFailures[:min(len(s.Totals.TopFailures), maxTopFailures)]
+}
+
+// write prints the summary to out as a single line, beside the JSON log records,
+// and, if reportFile is set, writes it indented to that file
+func (s *runSummary) write(out io.Writer, reportFile string) error {
+	if err := json.NewEncoder(out).Encode(s); err != nil {
+		return err
+	}
+	if reportFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reportFile, append(data, '\n'), 0644)
+}
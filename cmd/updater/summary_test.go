@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+func TestRunSummary(t *testing.T) {
+	summary := newRunSummary(time.Now().Add(-time.Second))
+	summary.add("debian", statusOK, &mirrorlib.Stats{Target: "debian", FilesDownloaded: 3, BytesDownloaded: 300,
+		Errors: 1, ErrorsByClass: map[string]int64{"http 404": 1},
+		FailureSignatures: map[string]int64{"http 404 from a": 1, "http 503 from b": 2, "timeout from c": 1}}, time.Second, nil)
+	summary.add("centos", statusFailed, &mirrorlib.Stats{Target: "centos", FilesDownloaded: 1, BytesDownloaded: 50,
+		Errors: 2, ErrorsByClass: map[string]int64{"http 404": 1, "timeout": 1},
+		FailureSignatures: map[string]int64{"http 404 from a": 1, "dns error from d": 1}}, time.Second, fmt.Errorf("listing failed"))
+	summary.add("archive", statusFrozen, nil, 0, nil)
+	summary.finish(1)
+
+	var out bytes.Buffer
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	if err := summary.write(&out, reportFile); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Errorf("Expected the summary on a single line, got %d lines", lines)
+	}
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatalf("Expected a report file: %v", err)
+	}
+
+	for _, raw := range [][]byte{out.Bytes(), data} {
+		var decoded struct {
+			ExitCode int `json:"exitCode"`
+			Totals   struct {
+				Targets         int              `json:"targets"`
+				Failed          int              `json:"failed"`
+				FilesDownloaded int64            `json:"filesDownloaded"`
+				BytesDownloaded int64            `json:"bytesDownloaded"`
+				ErrorsByClass   map[string]int64 `json:"errorsByClass"`
+				TopFailures     []failureCount   `json:"topFailures"`
+			} `json:"totals"`
+			Targets []struct {
+				Target string `json:"target"`
+				Status string `json:"status"`
+				Error  string `json:"error"`
+				Stats  *struct {
+					FilesDownloaded int64 `json:"filesDownloaded"`
+				} `json:"stats"`
+			} `json:"targets"`
+		}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			t.Fatalf("Invalid summary %s: %v", raw, err)
+		}
+		totals := decoded.Totals
+		if decoded.ExitCode != 1 || totals.Targets != 3 || totals.Failed != 1 || totals.FilesDownloaded != 4 || totals.BytesDownloaded != 350 {
+			t.Errorf("Unexpected totals %+v (exit code %d)", totals, decoded.ExitCode)
+		}
+		if totals.ErrorsByClass["http 404"] != 2 || totals.ErrorsByClass["timeout"] != 1 {
+			t.Errorf("Expected errors by class added up, got %v", totals.ErrorsByClass)
+		}
+		want := []failureCount{{"http 404 from a", 2}, {"http 503 from b", 2}, {"dns error from d", 1}}
+		if !slices.Equal(totals.TopFailures, want) {
+			t.Errorf("Expected the three most frequent failure signatures, got %v", totals.TopFailures)
+		}
+		if len(decoded.Targets) != 3 || decoded.Targets[1].Status != statusFailed || decoded.Targets[1].Error != "listing failed" {
+			t.Fatalf("Unexpected targets %+v", decoded.Targets)
+		}
+		if stats := decoded.Targets[0].Stats; stats == nil || stats.FilesDownloaded != 3 || decoded.Targets[2].Stats != nil {
+			t.Errorf("Expected stats of the targets that ran only, got %+v", decoded.Targets)
+		}
+	}
+}
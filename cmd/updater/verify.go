@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+// exitVerifyWarnings is the exit code of --verify when it found only files the
+// manifest does not know or sampled upstreams that changed
+const exitVerifyWarnings = 5
+
+// exitVerifyDamaged is the exit code of --verify when recorded files are missing or
+// corrupted and were not repaired
+const exitVerifyDamaged = 6
+
+// verifyReport is the JSON form of a verification report
+type verifyReport struct {
+	Target          string          `json:"target"`
+	Files           int64           `json:"files"`
+	Bytes           int64           `json:"bytes"`
+	Hashed          int64           `json:"hashed"`
+	UpstreamChecked int64           `json:"upstreamChecked"`
+	Resumed         bool            `json:"resumed,omitempty"`
+	DurationMs      int64           `json:"durationMs"`
+	Problems        []verifyProblem `json:"problems"`
+}
+
+type verifyProblem struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// runVerify verifies the named target, writes its report to out and returns the
+// exit code, which reflects the most severe unrepaired problem
+func runVerify(ctx context.Context, cfg *config.Config, mirrorers []*mirrorlib.Mirrorer, name string, opts mirrorlib.VerifyOptions, out io.Writer, asJSON bool, logger *slog.Logger) int {
+	i := slices.IndexFunc(cfg.Targets, func(t config.Target) bool { return t.Name == name })
+	if i < 0 {
+		logger.Error("Unknown target, nothing to verify", "name", name)
+		return 1
+	}
+
+	report, err := mirrorers[i].Verify(ctx, opts)
+	if err != nil {
+		logger.Error("Failed to verify target", "name", name, "files", report.Files, "error", err)
+		return 1
+	}
+	if asJSON {
+		err = writeVerifyJSON(out, report)
+	} else {
+		err = writeVerifyTable(out, report)
+	}
+	if err != nil {
+		logger.Error("Failed to write verification report", "error", err)
+		return 1
+	}
+	return verifyExitCode(report)
+}
+
+// verifyExitCode returns the exit code for the problems of report
+func verifyExitCode(report mirrorlib.VerifyReport) int {
+	switch {
+	case report.Count(mirrorlib.ProblemMissing) > 0 || report.Count(mirrorlib.ProblemCorrupted) > 0:
+		return exitVerifyDamaged
+	case report.Count(mirrorlib.ProblemExtra) > 0 || report.Count(mirrorlib.ProblemUpstream) > 0:
+		return exitVerifyWarnings
+	}
+	return 0
+}
+
+// writeVerifyJSON writes a verification report as JSON
+func writeVerifyJSON(out io.Writer, report mirrorlib.VerifyReport) error {
+	r := verifyReport{
+		Target:          report.Target,
+		Files:           report.Files,
+		Bytes:           report.Bytes,
+		Hashed:          report.Hashed,
+		UpstreamChecked: report.UpstreamChecked,
+		Resumed:         report.Resumed,
+		DurationMs:      report.Duration.Milliseconds(),
+		Problems:        []verifyProblem{},
+	}
+	for _, p := range report.Problems {
+		r.Problems = append(r.Problems, verifyProblem{Path: p.Path, Kind: p.Kind, Detail: p.Detail, Repaired: p.Repaired})
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// writeVerifyTable writes the problems of a verification report as an aligned text
+// table, followed by a summary line
+func writeVerifyTable(out io.Writer, report mirrorlib.VerifyReport) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if len(report.Problems) > 0 {
+		fmt.Fprintln(tw, "PROBLEM\tPATH\tDETAIL")
+	}
+	for _, p := range report.Problems {
+		kind := p.Kind
+		if p.Repaired {
+			kind += " (repaired)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", kind, p.Path, orDash(p.Detail))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%s: %d files, %d hashed, %d upstreams checked; %d missing, %d corrupted, %d extra, %d upstream changes\n",
+		report.Target, report.Files, report.Hashed, report.UpstreamChecked,
+		report.Count(mirrorlib.ProblemMissing), report.Count(mirrorlib.ProblemCorrupted),
+		report.Count(mirrorlib.ProblemExtra), report.Count(mirrorlib.ProblemUpstream))
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+func TestRunVerify(t *testing.T) {
+	dataPath := t.TempDir()
+	dir := filepath.Join(dataPath, "a")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "file.txt"), []byte("data"), 0644)
+	cfg := &config.Config{
+		Targets: []config.Target{{Name: "a", URL: "http://example.com/a/"}},
+		Mirror:  config.Mirror{DataPath: dataPath},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mirrorers, err := mirrorlib.NewGroup(mirrorOptions(cfg, logger)...)
+	if err != nil {
+		t.Fatalf("NewGroup failed: %v", err)
+	}
+	verify := func(asJSON bool) (int, string) {
+		var out bytes.Buffer
+		code := runVerify(context.Background(), cfg, mirrorers, "a", mirrorlib.VerifyOptions{}, &out, asJSON, logger)
+		return code, out.String()
+	}
+
+	if code := runVerify(context.Background(), cfg, mirrorers, "b", mirrorlib.VerifyOptions{}, io.Discard, false, logger); code != 1 {
+		t.Errorf("Expected an unknown target to fail, got exit code %d", code)
+	}
+
+	// A file the manifest does not know is only a warning
+	if code, out := verify(false); code != exitVerifyWarnings || !strings.Contains(out, "extra") || !strings.Contains(out, "file.txt") {
+		t.Errorf("Expected the extra file reported, got exit code %d and %q", code, out)
+	}
+
+	if err := mirror.RecordFile(dir, "file.txt", mirror.FileSource{Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := verify(false); code != 0 {
+		t.Errorf("Expected a clean tree to pass, got exit code %d", code)
+	}
+
+	os.Remove(filepath.Join(dir, "file.txt"))
+	code, out := verify(true)
+	var report verifyReport
+	if err := json.Unmarshal([]byte(out), &report); err != nil {
+		t.Fatalf("Invalid JSON report %q: %v", out, err)
+	}
+	if code != exitVerifyDamaged || len(report.Problems) != 1 || report.Problems[0].Kind != mirrorlib.ProblemMissing {
+		t.Errorf("Expected the missing file reported, got exit code %d and %+v", code, report)
+	}
+}
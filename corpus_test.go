@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/files"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// corpusDirs are the directories files of a generated corpus are spread over
+var corpusDirs = []string{
+	"",
+	"pub/",
+	"pub/linux/",
+	"pub/linux/x86_64/",
+	"pub/linux/x86_64/debug/",
+	"docs ü/",
+	"日本語/",
+	"日本語/資料/",
+	"Ωmega space/",
+	"archive/2023/",
+	"archive/2024/",
+}
+
+// corpusStems are the name stems of generated files
+var corpusStems = []string{"file", "café", "наука", "報告", "mixed name", "emoji🚀", "c++ notes+v2", "100% done"}
+
+// corpusExts are the extensions of generated files; none of them gets a thumbnail
+var corpusExts = []string{".txt", ".bin", ".tar.gz", ".log", ""}
+
+// corpusBase is the modification time of the oldest generated file
+var corpusBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// corpusFile is a file of a generated upstream tree
+type corpusFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// corpus is a generated upstream tree served with Apache-style listings. It counts
+// the requests it receives so tests can tell what a run fetched.
+type corpus struct {
+	mu       sync.Mutex
+	files    map[string]corpusFile
+	rng      *rand.Rand
+	requests map[string]int
+}
+
+// newCorpus generates a deterministic tree of n files over corpusDirs, a releases
+// directory with a SHA256SUMS list, a directory the tests exclude and, unless large
+// is 0, two files of large bytes
+func newCorpus(n int, large int) *corpus {
+	c := &corpus{
+		files:    make(map[string]corpusFile),
+		rng:      rand.New(rand.NewPCG(1, 2)),
+		requests: make(map[string]int),
+	}
+	for i := 0; i < n; i++ {
+		dir := corpusDirs[i%len(corpusDirs)]
+		name := fmt.Sprintf("%s%s-%04d%s", dir, corpusStems[i%len(corpusStems)], i, corpusExts[i%len(corpusExts)])
+		c.put(name, c.content(name, 4096), corpusBase.Add(time.Duration(i)*time.Minute))
+	}
+	for i := 0; i < 20; i++ {
+		c.put(fmt.Sprintf("releases/release-%02d.tar", i), c.content("release", 8192), corpusBase)
+	}
+	c.writeChecksums("releases/", corpusBase)
+	for i := 0; i < 10; i++ {
+		c.put(fmt.Sprintf("skipped/excluded-%02d.txt", i), c.content("excluded", 256), corpusBase)
+	}
+	if large > 0 {
+		for i := 0; i < 2; i++ {
+			data := make([]byte, large)
+			for j := range data {
+				data[j] = byte(c.rng.IntN(256))
+			}
+			c.put(fmt.Sprintf("pub/large/image-%d.iso", i), data, corpusBase)
+		}
+	}
+	return c
+}
+
+// content returns up to max bytes of random text starting with name
+func (c *corpus) content(name string, max int) []byte {
+	data := []byte(name + "\n")
+	for n := c.rng.IntN(max); n > 0; n-- {
+		data = append(data, byte('a'+c.rng.IntN(26)))
+	}
+	return data
+}
+
+// put stores a file at the slash-separated path name
+func (c *corpus) put(name string, data []byte, modTime time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[name] = corpusFile{data: data, modTime: modTime}
+}
+
+// writeChecksums replaces the SHA256SUMS list of dir
+func (c *corpus) writeChecksums(dir string, modTime time.Time) {
+	var sums bytes.Buffer
+	for _, name := range c.names() {
+		if strings.HasPrefix(name, dir) && path.Base(name) != "SHA256SUMS" {
+			sum := sha256.Sum256(c.files[name].data)
+			fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(sum[:]), strings.TrimPrefix(name, dir))
+		}
+	}
+	c.put(dir+"SHA256SUMS", sums.Bytes(), modTime)
+}
+
+// names returns the paths of all files in order
+func (c *corpus) names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// snapshot returns a copy of the files, leaving out those below the excluded dirs
+func (c *corpus) snapshot(excluded ...string) map[string]corpusFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make(map[string]corpusFile, len(c.files))
+outer:
+	for name, file := range c.files {
+		for _, dir := range excluded {
+			if strings.HasPrefix(name, dir) {
+				continue outer
+			}
+		}
+		snapshot[name] = file
+	}
+	return snapshot
+}
+
+// fileRequests returns how many requests with method were made for files, and
+// resets all counts
+func (c *corpus) fileRequests(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for key, count := range c.requests {
+		if strings.HasPrefix(key, method+" ") && !strings.HasSuffix(key, "/") {
+			n += count
+		}
+	}
+	c.requests = make(map[string]int)
+	return n
+}
+
+// requested reports whether any request was made below the directory dir
+func (c *corpus) requested(dir string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.requests {
+		if _, p, _ := strings.Cut(key, " "); strings.HasPrefix(p, "/"+dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *corpus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	c.mu.Lock()
+	c.requests[r.Method+" "+r.URL.Path]++
+	file, ok := c.files[name]
+	c.mu.Unlock()
+
+	if name == "" || strings.HasSuffix(name, "/") {
+		c.serveListing(w, name)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, path.Base(name), file.modTime, bytes.NewReader(file.data))
+}
+
+// serveListing writes an Apache-style listing of dir
+func (c *corpus) serveListing(w http.ResponseWriter, dir string) {
+	children := make(map[string]corpusFile)
+	for _, name := range c.names() {
+		rest, ok := strings.CutPrefix(name, dir)
+		if !ok {
+			continue
+		}
+		if sub, _, isDir := strings.Cut(rest, "/"); isDir {
+			children[sub+"/"] = corpusFile{}
+		} else {
+			c.mu.Lock()
+			children[rest] = c.files[name]
+			c.mu.Unlock()
+		}
+	}
+	if len(children) == 0 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	entries := make([]string, 0, len(children))
+	for entry := range children {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, "<html><head><title>Index of /%s</title></head><body>\n<h1>Index of /%s</h1>\n<pre>", html.EscapeString(dir), html.EscapeString(dir))
+	fmt.Fprintf(w, "<a href=\"?C=N;O=D\">Name</a>\n<a href=\"../\">Parent Directory</a>\n")
+	for _, entry := range entries {
+		href := url.PathEscape(strings.TrimSuffix(entry, "/"))
+		size := "-"
+		if strings.HasSuffix(entry, "/") {
+			href += "/"
+		} else {
+			size = fmt.Sprint(len(children[entry].data))
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a> %s %s\n", href, html.EscapeString(entry),
+			children[entry].modTime.Format("02-Jan-2006 15:04"), size)
+	}
+	fmt.Fprint(w, "</pre></body></html>\n")
+}
+
+// corpusMutation records how mutate changed a corpus
+type corpusMutation struct {
+	added, changed, deleted []string
+	// renamed maps old paths to new ones; relinked are the renames the upstream
+	// checksum lists describe
+	renamed  map[string]string
+	relinked int
+}
+
+// mutate changes the corpus like an upstream between two runs: every tenth file is
+// changed, deleted or renamed, new files appear in existing and new directories,
+// some releases are renamed and one large file is rewritten
+func (c *corpus) mutate() corpusMutation {
+	mutation := corpusMutation{renamed: make(map[string]string)}
+	later := corpusBase.AddDate(1, 0, 0)
+
+	var plain []string
+	for _, name := range c.names() {
+		if !strings.HasPrefix(name, "releases/") && !strings.HasPrefix(name, "skipped/") && !strings.HasPrefix(name, "pub/large/") {
+			plain = append(plain, name)
+		}
+	}
+	for i, name := range plain {
+		c.mu.Lock()
+		file := c.files[name]
+		c.mu.Unlock()
+		switch i % 10 {
+		case 0:
+			c.put(name, append(file.data, "changed\n"...), later)
+			mutation.changed = append(mutation.changed, name)
+		case 1:
+			c.mu.Lock()
+			delete(c.files, name)
+			c.mu.Unlock()
+			mutation.deleted = append(mutation.deleted, name)
+		case 2:
+			renamed := path.Join(path.Dir(name), "renamed "+path.Base(name))
+			c.mu.Lock()
+			delete(c.files, name)
+			c.files[renamed] = file
+			c.mu.Unlock()
+			mutation.renamed[name] = renamed
+		}
+	}
+	for i := 0; i < len(plain)/10; i++ {
+		dir := corpusDirs[i%len(corpusDirs)]
+		if i%2 == 1 {
+			dir = "new/ñew/"
+		}
+		name := fmt.Sprintf("%sadded-%04d.txt", dir, i)
+		c.put(name, c.content(name, 2048), later)
+		mutation.added = append(mutation.added, name)
+	}
+
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("releases/release-%02d.tar", i)
+		renamed := fmt.Sprintf("releases/moved-%02d.tar", i)
+		c.mu.Lock()
+		c.files[renamed] = c.files[name]
+		delete(c.files, name)
+		c.mu.Unlock()
+		mutation.renamed[name] = renamed
+		mutation.relinked++
+	}
+	c.writeChecksums("releases/", later)
+	mutation.changed = append(mutation.changed, "releases/SHA256SUMS")
+
+	c.mu.Lock()
+	large, ok := c.files["pub/large/image-0.iso"]
+	c.mu.Unlock()
+	if ok {
+		data := bytes.Clone(large.data)
+		data[len(data)/2]++
+		c.put("pub/large/image-0.iso", data, later)
+		mutation.changed = append(mutation.changed, "pub/large/image-0.iso")
+	}
+	return mutation
+}
+
+// corpusSize returns the number of files and total size a test generates, small
+// in short mode
+func corpusSize() (files, large int) {
+	if testing.Short() {
+		return 300, 0
+	}
+	return 3000, 16 << 20
+}
+
+// newCorpusMirror starts serving c and returns a config and target mirroring it
+// into a temporary data path, excluding the skipped directory
+func newCorpusMirror(t *testing.T, c *corpus) (*config.Config, *config.Target) {
+	t.Helper()
+	upstream := httptest.NewServer(c)
+	t.Cleanup(upstream.Close)
+
+	dataPath := t.TempDir()
+	target := config.Target{
+		Name:         "corpus",
+		URL:          upstream.URL + "/",
+		MaxDepth:     10,
+		Timeout:      30,
+		CheckChanges: true,
+		ExcludeDirs:  []string{"skipped"},
+	}
+	cfg := &config.Config{
+		Mirror:  config.Mirror{DataPath: dataPath},
+		Server:  config.Server{DataPath: dataPath},
+		Targets: []config.Target{target},
+	}
+	return cfg, &cfg.Targets[0]
+}
+
+// totalSize returns the summed size of files
+func totalSize(files map[string]corpusFile) int64 {
+	var size int64
+	for _, file := range files {
+		size += int64(len(file.data))
+	}
+	return size
+}
+
+// assertTree checks that targetDir holds exactly the wanted files, byte for byte
+// and with their upstream modification times, ignoring mirror metadata
+func assertTree(t *testing.T, targetDir string, want map[string]corpusFile) {
+	t.Helper()
+	found := make(map[string]bool)
+	err := filepath.WalkDir(targetDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), config.MetadataPrefix) {
+			return nil
+		}
+		rel, _ := filepath.Rel(targetDir, p)
+		rel = filepath.ToSlash(rel)
+		found[rel] = true
+
+		file, ok := want[rel]
+		if !ok {
+			t.Errorf("Unexpected file %s", rel)
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, file.data) {
+			t.Errorf("%s: content differs from upstream (%d vs %d bytes)", rel, len(data), len(file.data))
+		}
+		if info, err := d.Info(); err == nil && !info.ModTime().Equal(file.modTime) {
+			t.Errorf("%s: modification time %v, expected %v", rel, info.ModTime().UTC(), file.modTime)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %s: %v", targetDir, err)
+	}
+	for rel := range want {
+		if !found[rel] {
+			t.Errorf("Missing file %s", rel)
+		}
+	}
+}
+
+// assertManifest checks that the manifest records the upstream URL, size and
+// SHA-256 of every wanted file
+func assertManifest(t *testing.T, targetDir string, want map[string]corpusFile) {
+	t.Helper()
+	sources := make(map[string]mirror.FileSource)
+	err := mirror.WalkManifest(targetDir, func(rel string, source mirror.FileSource) error {
+		sources[rel] = source
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	if len(sources) != len(want) {
+		t.Errorf("Expected %d manifest entries, got %d", len(want), len(sources))
+	}
+	for rel, file := range want {
+		source, ok := sources[rel]
+		if !ok {
+			t.Errorf("%s: missing from manifest", rel)
+			continue
+		}
+		sum := sha256.Sum256(file.data)
+		if source.SHA256 != hex.EncodeToString(sum[:]) || source.Size != int64(len(file.data)) {
+			t.Errorf("%s: manifest records %d bytes with SHA-256 %s", rel, source.Size, source.SHA256)
+		}
+		if u, err := url.Parse(source.URL); err != nil || u.Path != "/"+rel {
+			t.Errorf("%s: manifest records URL %q", rel, source.URL)
+		}
+	}
+}
+
+// listingRow matches a row of a listing served by the file handler
+var listingRow = regexp.MustCompile(`(?s)<td class="file-name">(.*?)</td>\s*<td class="size">.*?</td>\s*<td class="date">(.*?)</td>`)
+
+// listingHref matches the link of a listing row; html/template writes some
+// characters of it as entities, e.g. "+" as "&#43;"
+var listingHref = regexp.MustCompile(`href="(/[^"?]*)"`)
+
+// assertServed checks that the file handler lists every directory of the wanted
+// files with exactly their entries and modification times, and serves every file
+// byte for byte
+func assertServed(t *testing.T, cfg *config.Config, target string, want map[string]corpusFile) {
+	t.Helper()
+	handler, err := files.NewHandler(cfg.Server.DataPath, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create file handler: %v", err)
+	}
+	get := func(p string) (int, []byte) {
+		req := httptest.NewRequest("GET", (&url.URL{Path: "/" + target + "/" + p}).EscapedPath(), nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code, w.Body.Bytes()
+	}
+
+	// The entries every directory is expected to list, with "" for directories
+	listings := map[string]map[string]string{"": {}}
+	for rel, file := range want {
+		dir := ""
+		for _, part := range strings.Split(path.Dir(rel), "/") {
+			if part == "." {
+				break
+			}
+			if listings[dir] == nil {
+				listings[dir] = make(map[string]string)
+			}
+			listings[dir][dir+part+"/"] = ""
+			dir += part + "/"
+		}
+		if listings[dir] == nil {
+			listings[dir] = make(map[string]string)
+		}
+		listings[dir][rel] = file.modTime.Local().Format("2006-01-02 15:04:05")
+	}
+
+	for dir, entries := range listings {
+		code, body := get(dir)
+		if code != http.StatusOK {
+			t.Errorf("Listing of /%s: status %d", dir, code)
+			continue
+		}
+		served := make(map[string]string)
+		for _, row := range listingRow.FindAllSubmatch(body, -1) {
+			href := listingHref.FindSubmatch(row[1])
+			if href == nil {
+				t.Errorf("Listing of /%s: row without link: %s", dir, row[1])
+				continue
+			}
+			p, err := url.PathUnescape(html.UnescapeString(string(href[1])))
+			if err != nil {
+				t.Errorf("Listing of /%s: invalid link %s", dir, href[1])
+				continue
+			}
+			rel := strings.TrimPrefix(p, "/"+target+"/")
+			if strings.HasSuffix(rel, "/") {
+				served[rel] = ""
+			} else {
+				served[rel] = strings.TrimSpace(string(row[2]))
+			}
+		}
+		if len(served) != len(entries) {
+			t.Errorf("Listing of /%s: %d entries, expected %d", dir, len(served), len(entries))
+		}
+		for rel, date := range entries {
+			if got, ok := served[rel]; !ok || got != date {
+				t.Errorf("Listing of /%s: entry %s with date %q, expected %q", dir, rel, got, date)
+			}
+		}
+	}
+
+	for rel, file := range want {
+		if code, body := get(rel); code != http.StatusOK || !bytes.Equal(body, file.data) {
+			t.Errorf("Serving %s: status %d with %d bytes, expected %d bytes", rel, code, len(body), len(file.data))
+		}
+	}
+}
+
+// TestCorpusMirrorAcrossRuns mirrors a generated tree, mutates the upstream and
+// mirrors it again, checking files, manifest, statistics and served listings
+// after both runs
+func TestCorpusMirrorAcrossRuns(t *testing.T) {
+	n, large := corpusSize()
+	c := newCorpus(n, large)
+	cfg, target := newCorpusMirror(t, c)
+	targetDir := filepath.Join(cfg.Mirror.DataPath, target.Name)
+	manager := mirror.NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// First run: everything but the excluded directory is downloaded
+	want := c.snapshot("skipped/")
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("First run failed: %v", err)
+	}
+	if stats.FilesDownloaded != int64(len(want)) || stats.FilesSkipped != 0 || stats.Errors != 0 {
+		t.Errorf("First run: downloaded %d, skipped %d, %d errors; expected %d downloads",
+			stats.FilesDownloaded, stats.FilesSkipped, stats.Errors, len(want))
+	}
+	if stats.BytesDownloaded != totalSize(want) {
+		t.Errorf("First run: downloaded %d bytes, expected %d", stats.BytesDownloaded, totalSize(want))
+	}
+	if stats.DirectoriesSkipped != 1 || c.requested("skipped/") {
+		t.Errorf("Expected the excluded directory to be skipped without requests, skipped %d", stats.DirectoriesSkipped)
+	}
+	if gets := c.fileRequests("GET"); gets != len(want) {
+		t.Errorf("First run: %d file downloads, expected %d", gets, len(want))
+	}
+	assertTree(t, targetDir, want)
+	assertManifest(t, targetDir, want)
+	assertServed(t, cfg, target.Name, want)
+
+	// Second run: changed and new files are downloaded, moved releases relinked
+	// from the checksum list and all others skipped. Files gone upstream are kept.
+	mutation := c.mutate()
+	current := c.snapshot("skipped/")
+	for rel, file := range current {
+		want[rel] = file
+	}
+	downloads := len(mutation.added) + len(mutation.changed) + len(mutation.renamed) - mutation.relinked
+	unchanged := len(current) - downloads - mutation.relinked
+
+	stats, err = manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if stats.FilesDownloaded != int64(downloads) || stats.FilesRelinked != int64(mutation.relinked) ||
+		stats.FilesSkipped != int64(unchanged) || stats.Errors != 0 {
+		t.Errorf("Second run: downloaded %d, relinked %d, skipped %d, %d errors; expected %d, %d, %d",
+			stats.FilesDownloaded, stats.FilesRelinked, stats.FilesSkipped, stats.Errors,
+			downloads, mutation.relinked, unchanged)
+	}
+	if gets := c.fileRequests("GET"); gets != downloads {
+		t.Errorf("Second run: %d file downloads, expected %d", gets, downloads)
+	}
+	assertTree(t, targetDir, want)
+	assertManifest(t, targetDir, want)
+	assertServed(t, cfg, target.Name, want)
+}
+
+// TestCorpusResumesInterruptedRun cancels a run part way through and checks that
+// the next run completes the mirror without downloading finished files again
+func TestCorpusResumesInterruptedRun(t *testing.T) {
+	n, large := corpusSize()
+	c := newCorpus(n, large)
+	cfg, target := newCorpusMirror(t, c)
+	targetDir := filepath.Join(cfg.Mirror.DataPath, target.Name)
+	want := c.snapshot("skipped/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var downloaded int
+	sink := func(event mirror.Event) {
+		if event.Type == mirror.EventFileDownloaded {
+			if downloaded++; downloaded == len(want)/3 {
+				cancel()
+			}
+		}
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if _, err := mirror.NewManager(cfg, logger, mirror.WithEventSink(sink)).Run(ctx, target, targetDir); err == nil {
+		t.Fatal("Expected the cancelled run to fail")
+	}
+	interrupted := c.fileRequests("GET")
+
+	stats, err := mirror.NewManager(cfg, logger).Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Resumed run failed: %v", err)
+	}
+	if stats.FilesSkipped < int64(downloaded) || stats.Errors != 0 {
+		t.Errorf("Resumed run skipped %d files with %d errors, expected at least the %d finished ones",
+			stats.FilesSkipped, stats.Errors, downloaded)
+	}
+	// Only a download in flight when the run was cancelled may be repeated
+	if gets := interrupted + c.fileRequests("GET"); gets > len(want)+1 {
+		t.Errorf("%d file downloads over both runs, expected at most %d", gets, len(want)+1)
+	}
+	assertTree(t, targetDir, want)
+	assertManifest(t, targetDir, want)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -9,11 +10,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jhofer-cloud/http-mirror/pkg/config"
 	"github.com/jhofer-cloud/http-mirror/pkg/files"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
 	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
 )
 
@@ -270,16 +274,27 @@ func TestConfigurationLoading(t *testing.T) {
 	t.Logf("✅ Configuration loading test passed!")
 }
 
-// TestRateLimiting tests that rate limiting works correctly
+// TestRateLimiting tests that WaitBetweenRequests spaces every request of a run,
+// including file downloads
 func TestRateLimiting(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping rate limiting test in short mode")
 	}
 
 	// Create a server that records request timing
+	var mu sync.Mutex
 	var requestTimes []time.Time
+	var paths []string
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
 		requestTimes = append(requestTimes, time.Now())
+		paths = append(paths, r.Method+r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a</a><a href="b.txt">b</a><a href="c.txt">c</a>`))
+			return
+		}
 		if r.Method == "HEAD" {
 			w.Header().Set("Content-Length", "10")
 			w.WriteHeader(http.StatusOK)
@@ -297,7 +312,8 @@ func TestRateLimiting(t *testing.T) {
 		RateLimit:           "1k", // Very slow rate
 		WaitBetweenRequests: 1,    // 1 second between requests
 		MaxDepth:            1,
-		CheckChanges:        false,
+		Timeout:             5,
+		CheckChanges:        true,
 	}
 
 	cfg := &config.Config{
@@ -311,21 +327,186 @@ func TestRateLimiting(t *testing.T) {
 	}))
 
 	manager := mirror.NewManager(cfg, logger)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	start := time.Now()
-	err := manager.MirrorTarget(ctx, target)
-	duration := time.Since(start)
+	if err := manager.MirrorTarget(ctx, target); err != nil {
+		t.Fatalf("MirrorTarget failed: %v", err)
+	}
 
+	// One listing plus a HEAD and a GET per file
+	if len(requestTimes) != 7 {
+		t.Fatalf("Expected 7 requests, got %d: %v", len(requestTimes), paths)
+	}
+	for i := 1; i < len(requestTimes); i++ {
+		// Allow for timer granularity
+		if gap := requestTimes[i].Sub(requestTimes[i-1]); gap < 950*time.Millisecond {
+			t.Errorf("Request %d started %v after the previous one, expected at least 1s", i, gap)
+		}
+	}
+}
+
+// TestServeDuringSync reads a target through the file server while the updater
+// rewrites it and checks that no request fails and no partial file is served
+func TestServeDuringSync(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping concurrent sync test in short mode")
+	}
+
+	// Every run gets a new version of each file, streamed in slow chunks
+	versions := []string{strings.Repeat("A", 64*1024), strings.Repeat("B", 64*1024)}
+	var run atomic.Int32
+	names := []string{"one.bin", "two.bin", "three.bin"}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			for _, name := range names {
+				fmt.Fprintf(w, `<a href="%s">%s</a>`, name, name)
+			}
+			return
+		}
+		content := versions[int(run.Load())%len(versions)]
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		for i := 0; i < len(content); i += 8 * 1024 {
+			w.Write([]byte(content[i : i+8*1024]))
+			w.(http.Flusher).Flush()
+			time.Sleep(2 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	dataPath := t.TempDir()
+	cfg := &config.Config{
+		Mirror:  config.Mirror{DataPath: dataPath},
+		Server:  config.Server{DataPath: dataPath, SyncRetry: true},
+		Targets: []config.Target{{Name: "busy", URL: upstream.URL + "/"}},
+	}
+	handler, err := files.NewHandler(dataPath, cfg)
 	if err != nil {
-		t.Fatalf("MirrorTarget failed: %v", err)
+		t.Fatalf("Failed to create file handler: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	var reads, failures atomic.Int64
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, path := range []string{"/busy/", "/busy/one.bin", "/busy/two.bin", "/busy/three.bin"} {
+					resp, err := http.Get(server.URL + path)
+					if err != nil {
+						t.Errorf("GET %s failed: %v", path, err)
+						failures.Add(1)
+						continue
+					}
+					body, err := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					reads.Add(1)
+					switch {
+					case err != nil:
+						t.Errorf("GET %s: failed to read body: %v", path, err)
+						failures.Add(1)
+					case resp.StatusCode >= 500:
+						t.Errorf("GET %s: status %d", path, resp.StatusCode)
+						failures.Add(1)
+					case resp.StatusCode == http.StatusOK && strings.HasSuffix(path, ".bin") &&
+						string(body) != versions[0] && string(body) != versions[1]:
+						t.Errorf("GET %s: served %d bytes of a partial file", path, len(body))
+						failures.Add(1)
+					}
+				}
+			}
+		}()
 	}
 
-	// With wait between requests, it should take at least the wait time
-	if duration < 500*time.Millisecond {
-		t.Logf("Mirror completed in %v (rate limiting may not have been effective)", duration)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := mirror.NewManager(cfg, logger)
+	target := &config.Target{Name: "busy", URL: upstream.URL + "/", MaxDepth: 2, Timeout: 10}
+	for i := 0; i < 3; i++ {
+		run.Store(int32(i))
+		if err := manager.MirrorTarget(context.Background(), target); err != nil {
+			t.Fatalf("Run %d failed: %v", i, err)
+		}
+	}
+	close(done)
+	readers.Wait()
+
+	if failures.Load() > 0 {
+		t.Fatalf("%d of %d concurrent reads failed", failures.Load(), reads.Load())
 	}
+	if reads.Load() == 0 {
+		t.Fatal("Expected reads while syncing")
+	}
+}
 
-	t.Logf("✅ Rate limiting test completed in %v", duration)
+// TestTransferLimitQueues mirrors a target with more concurrent downloads than the
+// process-wide transfer limit allows and checks that the surplus downloads wait
+// for a slot instead of failing
+func TestTransferLimitQueues(t *testing.T) {
+	const fileCount, limit = 12, 2
+
+	var active, peak atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			for i := range fileCount {
+				fmt.Fprintf(w, `<a href="file%02d.bin">file%02d.bin</a>`, i, i)
+			}
+			return
+		}
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("payload " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	httpPkg.Transfers.SetLimit(limit)
+	t.Cleanup(func() { httpPkg.Transfers.SetLimit(0) })
+
+	tempDir := t.TempDir()
+	target := &config.Target{
+		Name:        "transfers",
+		URL:         server.URL + "/",
+		MaxDepth:    1,
+		Timeout:     10,
+		Concurrency: 6,
+	}
+	manager := mirror.NewManager(&config.Config{Mirror: config.Mirror{DataPath: tempDir}},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	stats, err := manager.Run(context.Background(), target, filepath.Join(tempDir, target.Name))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if stats.FilesDownloaded != fileCount || stats.Errors != 0 {
+		t.Errorf("Expected %d files and no errors, got %d and %d", fileCount, stats.FilesDownloaded, stats.Errors)
+	}
+	if got := peak.Load(); got > limit {
+		t.Errorf("Upstream saw %d downloads at once, limit is %d", got, limit)
+	}
+	if stats.TransfersQueued == 0 {
+		t.Error("Expected downloads to queue for a transfer slot")
+	}
+	if stats.PeakOpenTransfers > limit {
+		t.Errorf("Run reported %d open transfers, limit is %d", stats.PeakOpenTransfers, limit)
+	}
+	if open := httpPkg.Transfers.Open(); open != 0 {
+		t.Errorf("Expected all transfer slots released, %d still open", open)
+	}
 }
@@ -1,62 +1,752 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Target represents a single mirror target
 type Target struct {
-	Name                string `json:"name"`
-	URL                 string `json:"url"`
+	// Name identifies the target; its files are mirrored into the directory of that
+	// name below the data path
+	Name string `json:"name"`
+	// URL is the upstream directory to mirror, an absolute http or https URL
+	URL string `json:"url" redact:"url"`
+	// UserAgent, RateLimit, Retries, MaxDepth, Timeout and WaitBetweenRequests
+	// override the settings of the same name in Defaults; empty or 0 inherits them
 	UserAgent           string `json:"userAgent,omitempty"`
 	RateLimit           string `json:"rateLimit,omitempty"`
 	Retries             int    `json:"retries,omitempty"`
 	MaxDepth            int    `json:"maxDepth,omitempty"`
 	Timeout             int    `json:"timeout,omitempty"`
 	WaitBetweenRequests int    `json:"waitBetweenRequests,omitempty"`
-	Timestamping        bool   `json:"timestamping,omitempty"`
-	NoClobber           bool   `json:"noClobber,omitempty"`
-	ContinueDownload    bool   `json:"continueDownload,omitempty"`
-	CheckChanges        bool   `json:"checkChanges,omitempty"`
+	// Timestamping, NoClobber, ContinueDownload and CheckChanges enable the
+	// settings of the same name in Defaults for this target; false inherits them
+	Timestamping     bool `json:"timestamping,omitempty"`
+	NoClobber        bool `json:"noClobber,omitempty"`
+	ContinueDownload bool `json:"continueDownload,omitempty"`
+	CheckChanges     bool `json:"checkChanges,omitempty"`
+	// Protected targets are only served through signed URLs
+	Protected bool `json:"protected,omitempty"`
+	// Frozen targets keep being served as they are but are not mirrored, e.g. to
+	// pin a mirror while its upstream is compromised
+	Frozen bool `json:"frozen,omitempty"`
+	// PullThrough lets the server fetch files of the target that were not mirrored
+	// yet from the upstream when they are requested, passing them on to the client
+	// while storing them like a sync would
+	PullThrough bool `json:"pullThrough,omitempty"`
+	// Prune deletes local files and directories that a run no longer finds
+	// upstream; PruneDryRun only logs what would be deleted
+	Prune       bool `json:"prune,omitempty"`
+	PruneDryRun bool `json:"pruneDryRun,omitempty"`
+	// ExcludeDirs skips matching directories without fetching their listings.
+	// Patterns are globs matched against the directory path relative to the target
+	// URL (e.g. "pub/old"); patterns without a slash match a directory name at any
+	// depth, and patterns prefixed with "re:" are regular expressions matched
+	// against the relative path.
+	ExcludeDirs []string `json:"excludeDirs,omitempty"`
+	// ExcludedDirPolicy decides what happens to local copies of excluded
+	// directories: "keep" (default) leaves them, "delete" removes them
+	ExcludedDirPolicy string `json:"excludedDirPolicy,omitempty"`
+	// FilterMode is "enforce" (default) to apply ExcludeDirs and ExcludedDirPolicy,
+	// or "report" to mirror and keep everything while reporting what they would
+	// have skipped or deleted, e.g. to review new patterns before enforcing them
+	FilterMode string `json:"filterMode,omitempty"`
+	// Priority are patterns in the syntax of ExcludeDirs, matched against files
+	// and directories, that are fetched first, in the order of the patterns; a
+	// matching directory ranks its whole subtree. Files are ordered within their
+	// directory, directories across the tree.
+	Priority []string `json:"priority,omitempty"`
+	// ContentTypeCheck compares downloads with their file extension: "html"
+	// (default) flags HTML saved under a binary extension and the reverse, "all"
+	// every conflict, "off" nothing
+	ContentTypeCheck string `json:"contentTypeCheck,omitempty"`
+	// QuarantineMismatches writes flagged downloads into the quarantine directory
+	// of the target instead of replacing the file
+	QuarantineMismatches bool `json:"quarantineMismatches,omitempty"`
+	// VerifyChecksums checks every download against the SHA256SUMS, sha256sum.txt
+	// or MD5SUMS list of its directory while it is written; files that do not
+	// match are discarded and downloaded again as often as Retries allows. Files
+	// the lists do not mention are downloaded as usual.
+	VerifyChecksums bool `json:"verifyChecksums,omitempty"`
+	// ChurnSkipAfter lets directories whose listing has not changed for more than
+	// that many runs be mirrored from their last listing instead of being listed
+	// again; 0 (default) lists every directory on every run
+	ChurnSkipAfter int `json:"churnSkipAfter,omitempty"`
+	// ChurnRelistEvery lists such directories every that many runs anyway
+	// (default 5), and FullScanEvery lists every directory every that many runs
+	// (default 20), so that changes the listing does not reveal are caught
+	ChurnRelistEvery int `json:"churnRelistEvery,omitempty"`
+	FullScanEvery    int `json:"fullScanEvery,omitempty"`
+	// ConditionalListings stores the ETag and Last-Modified of every listing with
+	// its links and requests it conditionally on the next run; listings answered
+	// with 304 Not Modified are mirrored from the stored links. ListingRefreshEvery
+	// requests every listing in full every that many runs anyway (default 10), in
+	// case the upstream validators are broken.
+	ConditionalListings bool `json:"conditionalListings,omitempty"`
+	ListingRefreshEvery int  `json:"listingRefreshEvery,omitempty"`
+	// AllowQueryStrings keeps the query string of listing links to files and
+	// directories when requesting them, for upstreams that need e.g. "?download=1"
+	// or a token; by default it is dropped. Files are always named by the link path.
+	AllowQueryStrings bool `json:"allowQueryStrings,omitempty"`
+	// ContentDispositionNames names files by the filename of the
+	// Content-Disposition header the upstream serves them with, for download
+	// endpoints like "/download?id=123". Names that are invalid, hidden or taken
+	// by another download keep the name of the link path.
+	ContentDispositionNames bool `json:"contentDispositionNames,omitempty"`
+	// ListingFormat selects how directory listings are read: "auto" (default)
+	// parses HTML and, for directory URLs, the JSON of nginx's
+	// "autoindex_format json"; "html" parses HTML only; "nginx-json" requests and
+	// parses every listing as nginx JSON; "s3" lists URL as an S3 bucket endpoint
+	// with ListObjectsV2, below the key prefix of its "prefix" query parameter.
+	// Auto mode detects S3 buckets at the target URL as well.
+	ListingFormat string `json:"listingFormat,omitempty"`
+	// FollowAbsoluteSameHost follows listing links that are absolute URLs, like
+	// "https://mirror.example.com/pub/file.txt", when they have the scheme and host
+	// of the target and lie below the listed directory; unset means true. Links to
+	// other hosts are never followed.
+	FollowAbsoluteSameHost *bool `json:"followAbsoluteSameHost,omitempty"`
+	// MTimeTolerance is how many seconds the Last-Modified time of a file may lie
+	// past its local modification time before the file counts as changed, for
+	// upstreams behind load balancers whose nodes disagree on the time; unset means
+	// 2, 0 re-downloads on any newer time. Files whose stored ETag matches the
+	// upstream one are up to date regardless.
+	MTimeTolerance *int `json:"mtimeTolerance,omitempty"`
+	// ParallelChunks downloads files of at least ParallelChunkMinSize (default
+	// "256m") in that many byte ranges at once when the upstream supports ranges;
+	// 0 or 1 (default) downloads every file in a single stream
+	ParallelChunks       int    `json:"parallelChunks,omitempty"`
+	ParallelChunkMinSize string `json:"parallelChunkMinSize,omitempty"`
+	// Concurrency is how many files of the target are downloaded at once while its
+	// directories are still visited one after another; defaults to
+	// Defaults.Concurrency
+	Concurrency int `json:"concurrency,omitempty"`
+	// TransferWeight is the share of Mirror.MaxOpenTransfers the target gets while
+	// targets running at once wait for transfer slots, relative to the weights of
+	// the others; unset means 1, an equal share
+	TransferWeight int `json:"transferWeight,omitempty"`
+	// MaxTotalBytes (e.g. "20g") and MaxTotalFiles cap what a single run of the
+	// target downloads; once either is reached the run lets the downloads in
+	// progress finish and stops. Empty or 0 inherits them from Defaults.
+	MaxTotalBytes string `json:"maxTotalBytes,omitempty"`
+	MaxTotalFiles int    `json:"maxTotalFiles,omitempty"`
+	// MinFileSize and MaxFileSize (e.g. "100m") skip files whose size, as a HEAD
+	// request or the listing tells, lies outside the range; downloads of unknown
+	// size are aborted once they grow past MaxFileSize. Empty is unlimited.
+	MinFileSize string `json:"minFileSize,omitempty"`
+	MaxFileSize string `json:"maxFileSize,omitempty"`
+	// Hidden overrides Defaults.Hidden for this target; an empty list mirrors and
+	// serves dotfiles
+	Hidden []string `json:"hidden,omitempty"`
+	// MetadataIndex is the URL of an "ls -lR" file (optionally gzipped, e.g.
+	// "ls-lR.gz"), resolved against URL. Directories it describes are mirrored from
+	// the index instead of fetching their listings.
+	MetadataIndex string `json:"metadataIndex,omitempty" redact:"url"`
+	// Layout selects how runs write into the target directory: "in-place" (default)
+	// updates a single tree, "immutable-dated" writes every run into a new
+	// directory named by DatedFormat and never touches it afterwards
+	Layout string `json:"layout,omitempty"`
+	// DatedFormat is the strftime-style name of the directory of a run, formatted
+	// in UTC (default "%Y-%m-%d"); supports %Y, %y, %m, %d, %j, %H, %M and %S
+	DatedFormat string `json:"datedFormat,omitempty"`
+	// LinkUnchanged hard-links files that did not change upstream from the previous
+	// dated directory instead of downloading them again
+	LinkUnchanged bool `json:"linkUnchanged,omitempty"`
+	// KeepDated is how many dated directories are kept after a successful run; 0
+	// keeps all of them
+	KeepDated int `json:"keepDated,omitempty"`
+	// CrossHostRedirects decides whether redirects to another host are followed:
+	// "allow" (default) or "deny"
+	CrossHostRedirects string `json:"crossHostRedirects,omitempty"`
+	// RedirectAllowHosts are hosts (e.g. a CDN) redirects may lead to even when
+	// CrossHostRedirects is "deny"
+	RedirectAllowHosts []string `json:"redirectAllowHosts,omitempty"`
+	// Storage selects where downloaded files are written: "local" (default) below
+	// the data path, or "s3" to upload them to the bucket configured in S3. State
+	// and manifest stay in the local target directory either way.
+	Storage string `json:"storage,omitempty"`
+	// S3 configures the bucket of a target with Storage "s3"
+	S3 *S3Storage `json:"s3,omitempty"`
+	// FileEvents streams an event for every file a run adds, updates or deletes
+	// to downstream automation while the run progresses
+	FileEvents *FileEvents `json:"fileEvents,omitempty"`
 }
 
+// Storage backends of Target.Storage
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// S3Storage configures the bucket a target is uploaded to. Credentials are read
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type S3Storage struct {
+	// Bucket is the name of the bucket
+	Bucket string `json:"bucket"`
+	// Prefix is prepended to all keys; defaults to the target name
+	Prefix string `json:"prefix,omitempty"`
+	// Region defaults to "us-east-1"
+	Region string `json:"region,omitempty"`
+	// Endpoint overrides the AWS endpoint, e.g. for S3-compatible stores
+	Endpoint string `json:"endpoint,omitempty" redact:"url"`
+	// PathStyle addresses the bucket in the URL path instead of the host name
+	PathStyle bool `json:"pathStyle,omitempty"`
+	// PartSize is the size of multipart upload parts (default "16m", at least "5m")
+	PartSize string `json:"partSize,omitempty"`
+}
+
+// FileEvents configures the outputs of the file events of a target, which are
+// selected independently
+type FileEvents struct {
+	// WebhookURL receives batches of events as JSON arrays in POST requests
+	WebhookURL string `json:"webhookUrl,omitempty" redact:"url"`
+	// File appends the events of every run as NDJSON lines to a file of its own
+	// in the hidden events directory of the target
+	File bool `json:"file,omitempty"`
+	// BatchSize is the most events per request (default 100), and FlushInterval
+	// the seconds an incomplete batch waits for more (default 5)
+	BatchSize     int `json:"batchSize,omitempty"`
+	FlushInterval int `json:"flushInterval,omitempty"`
+	// QueueSize is the most events kept while the webhook fails (default 10000);
+	// further events are dropped and counted
+	QueueSize int `json:"queueSize,omitempty"`
+}
+
+// Defaults of FileEvents
+const (
+	DefaultEventBatchSize     = 100
+	DefaultEventFlushInterval = 5 * time.Second
+	DefaultEventQueueSize     = 10000
+)
+
 // Config represents the complete mirror configuration
 type Config struct {
+	// Defaults are the settings of targets that do not set their own
 	Defaults Defaults `json:"defaults"`
-	Targets  []Target `json:"targets"`
-	Mirror   Mirror   `json:"mirror"`
-	Server   Server   `json:"server"`
+	// Targets are the upstream directories to mirror
+	Targets []Target `json:"targets"`
+	// Mirror configures the updater
+	Mirror Mirror `json:"mirror"`
+	// Server configures the web server
+	Server Server `json:"server"`
+	// Source records where the configuration was loaded from
+	Source Source `json:"-"`
 }
 
 // Defaults contains default values for all targets
 type Defaults struct {
-	UserAgent           string `json:"userAgent"`
-	RateLimit           string `json:"rateLimit"`
-	Retries             int    `json:"retries"`
-	MaxDepth            int    `json:"maxDepth"`
-	Timeout             int    `json:"timeout"`
-	WaitBetweenRequests int    `json:"waitBetweenRequests"`
-	Timestamping        bool   `json:"timestamping"`
-	NoClobber           bool   `json:"noClobber"`
-	ContinueDownload    bool   `json:"continueDownload"`
-	CheckChanges        bool   `json:"checkChanges"`
+	// UserAgent is the User-Agent header of upstream requests
+	UserAgent string `json:"userAgent"`
+	// RateLimit caps the download rate of a target in bytes per second (e.g. "500k")
+	RateLimit string `json:"rateLimit"`
+	// Retries is how often a failed request is attempted
+	Retries int `json:"retries"`
+	// MaxDepth is how many directory levels below the target URL are mirrored; -1
+	// is unlimited
+	MaxDepth int `json:"maxDepth"`
+	// Timeout bounds each request, in seconds
+	Timeout int `json:"timeout"`
+	// WaitBetweenRequests is the pause between listing requests, in seconds
+	WaitBetweenRequests int `json:"waitBetweenRequests"`
+	// Timestamping and NoClobber are accepted for wget-style configurations; the
+	// mirror always keeps upstream modification times and replaces files atomically
+	Timestamping bool `json:"timestamping"`
+	NoClobber    bool `json:"noClobber"`
+	// ContinueDownload resumes interrupted downloads from their partial file
+	ContinueDownload bool `json:"continueDownload"`
+	// CheckChanges compares existing files with the upstream and downloads only
+	// changed ones; false downloads every file on every run
+	CheckChanges bool `json:"checkChanges"`
+	// Concurrency is how many files of a target are downloaded at once
+	Concurrency int `json:"concurrency"`
+	// MaxTotalBytes (e.g. "20g") and MaxTotalFiles cap what a single run of a
+	// target downloads; empty or 0 is unlimited
+	MaxTotalBytes string `json:"maxTotalBytes,omitempty"`
+	MaxTotalFiles int    `json:"maxTotalFiles,omitempty"`
+	// Hidden are name patterns (e.g. ".*", "Thumbs.db") that are neither downloaded
+	// nor listed. Mirror metadata files are always hidden.
+	Hidden []string `json:"hidden"`
 }
 
 // Mirror contains mirroring-specific configuration
 type Mirror struct {
+	// DataPath is the directory the target directories are created in
 	DataPath string `json:"dataPath"`
+	// LogLevel is "debug", "info", "warn" or "error"
 	LogLevel string `json:"logLevel"`
+	// FilesystemCompat selects the on-disk naming policy: "auto" (detect Windows or
+	// case-insensitive volumes), "native" or "portable"
+	FilesystemCompat string `json:"filesystemCompat,omitempty"`
+	// LogThrottle aggregates repeated warnings (e.g. every file failing while an
+	// upstream is down) into sampled log lines and periodic summaries
+	LogThrottle LogThrottle `json:"logThrottle"`
+	// WriteBufferSize is the per-download buffer size used when writing files (e.g. "256k")
+	WriteBufferSize string `json:"writeBufferSize,omitempty"`
+	// SyncWrites selects when downloaded files are fsynced: "always", "large-files" or "never"
+	SyncWrites string `json:"syncWrites,omitempty"`
+	// MaxResponseBytes caps the size of a single directory listing (e.g. "1g"); larger
+	// listings fail to parse instead of exhausting memory. Empty means unlimited.
+	MaxResponseBytes string `json:"maxResponseBytes,omitempty"`
+	// Hosts overrides per-host politeness across all targets sharing an upstream host
+	Hosts []HostPolicy `json:"hosts,omitempty"`
+	// EmptyListingAlertPercent raises an alert when the share of directory listings
+	// without entries grows by more than this many percentage points compared to the
+	// previous run of a target; 0 disables the check
+	EmptyListingAlertPercent int `json:"emptyListingAlertPercent,omitempty"`
+	// MaxDirectories caps the directories visited per target run; 0 means unlimited
+	MaxDirectories int `json:"maxDirectories,omitempty"`
+	// MaxEntriesPerDirectory caps the entries processed from a single listing;
+	// 0 means unlimited
+	MaxEntriesPerDirectory int `json:"maxEntriesPerDirectory,omitempty"`
+	// MaxPathDepth caps the local directory nesting below a target directory, even
+	// for targets with unlimited MaxDepth; 0 means unlimited
+	MaxPathDepth int `json:"maxPathDepth,omitempty"`
+	// MonthlyByteCap stops runs once this many bytes (e.g. "2t") were downloaded
+	// across all targets in the current billing period; empty means unlimited
+	MonthlyByteCap string `json:"monthlyByteCap,omitempty"`
+	// VerifyRelinks re-hashes files created from an identical earlier copy after an
+	// upstream move before trusting them
+	VerifyRelinks bool `json:"verifyRelinks,omitempty"`
+	// CapResetDay is the day of the month, in local time, on which the billing period
+	// starts; months shorter than that reset on their last day
+	CapResetDay int `json:"capResetDay,omitempty"`
+	// TempMaxAge is how many seconds temporary and partial download files may be
+	// left over from crashed or cancelled runs before a run removes them; 0
+	// disables the cleanup
+	TempMaxAge int `json:"tempMaxAge,omitempty"`
+	// ReportDetail is "summary" (default) to count skipped files per skip reason, or
+	// "full" to also list every skipped file with its reason in the skip report of
+	// the target, which grows with the size of the target
+	ReportDetail string `json:"reportDetail,omitempty"`
+	// FutureTimeTolerance is how many seconds past the current time a modification
+	// time may lie before the file is reported as coming from a clock-skewed
+	// upstream; 0 disables the check
+	FutureTimeTolerance int `json:"futureTimeTolerance,omitempty"`
+	// ClampFutureTimes sets such modification times to the time the file was
+	// checked, keeping the upstream time in the manifest
+	ClampFutureTimes bool `json:"clampFutureTimes,omitempty"`
+	// MaxOpenTransfers caps the file downloads open at once across all targets of
+	// the process, counting every connection of a chunked download; further
+	// downloads wait for a slot. 0 derives the cap from the file descriptor limit,
+	// a negative value means unlimited.
+	MaxOpenTransfers int `json:"maxOpenTransfers,omitempty"`
+}
+
+// Report details of Mirror.ReportDetail
+const (
+	ReportSummary = "summary"
+	ReportFull    = "full"
+)
+
+// Skip reasons record why a run did not download a file. They are counted per run
+// and listed per file with ReportDetail "full"; the codes are stable.
+const (
+	// SkipUnchanged is a file whose local copy matches the upstream file
+	SkipUnchanged = "unchanged"
+	// SkipExcluded is a file whose name matches a hidden pattern
+	SkipExcluded = "excluded"
+	// SkipQuarantined is a download that conflicted with its file extension and was
+	// written into the quarantine directory instead
+	SkipQuarantined = "quarantined"
+	// SkipBudgetExhausted is a file the monthly byte cap left no budget for
+	SkipBudgetExhausted = "budget-exhausted"
+	// SkipOverBudget is a file larger than what the monthly byte cap has left; the
+	// run goes on with files that fit and the next run tries it first
+	SkipOverBudget = "over-budget"
+	// SkipRunBudget is a file left after the run reached Target.MaxTotalBytes or
+	// Target.MaxTotalFiles
+	SkipRunBudget = "run-budget"
+	// SkipSize is a file outside Target.MinFileSize and Target.MaxFileSize
+	SkipSize = "size"
+)
+
+// HostPolicy overrides politeness settings for a single upstream host. Requests from
+// all targets pointing at the host share its gap and concurrency limit.
+type HostPolicy struct {
+	// Host is the URL host (including a non-default port) the policy applies to
+	Host string `json:"host"`
+	// WaitBetweenRequests is the combined minimum gap in seconds between requests to
+	// the host; 0 derives it from the targets, -1 disables the gap entirely
+	WaitBetweenRequests int `json:"waitBetweenRequests,omitempty"`
+	// MaxConcurrency caps simultaneous requests to the host, 0 means unlimited
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+}
+
+// LogThrottle controls aggregation of repeated warnings during a mirror run.
+// Throttling never applies when logging at debug level.
+type LogThrottle struct {
+	// Enabled turns the aggregation on
+	Enabled bool `json:"enabled"`
+	// Burst is how many occurrences of each error class per host are logged in full
+	Burst int `json:"burst,omitempty"`
+	// SampleRate logs every Nth occurrence once the burst is exhausted
+	SampleRate int `json:"sampleRate,omitempty"`
+	// SummaryInterval is the number of seconds between summary lines
+	SummaryInterval int `json:"summaryInterval,omitempty"`
 }
 
 // Server contains web server configuration
 type Server struct {
-	Port     int    `json:"port"`
-	Host     string `json:"host"`
+	// Port and Host are the TCP port and address the server listens on
+	Port int    `json:"port"`
+	Host string `json:"host"`
+	// DataPath is the directory the target directories are served from
 	DataPath string `json:"dataPath"`
+	// DrainTimeout is how long (in seconds) shutdown waits for in-flight
+	// requests to finish before remaining connections are closed forcibly
+	DrainTimeout int `json:"drainTimeout,omitempty"`
+	// SignedURLs configures HMAC-signed temporary download links
+	SignedURLs SignedURLs `json:"signedURLs"`
+	// Thumbnails enables image previews in directory listings
+	Thumbnails Thumbnails `json:"thumbnails"`
+	// TLS enables HTTPS on the TCP listener
+	TLS TLS `json:"tls"`
+	// HTTP3 enables an additional QUIC listener; requires TLS and a server built
+	// with the http3 build tag
+	HTTP3 HTTP3 `json:"http3"`
+	// SourceHeader adds an X-Mirror-Source header with the upstream URL to served files
+	SourceHeader bool `json:"sourceHeader,omitempty"`
+	// ListingMaxAge is how many seconds clients may cache directory listings before
+	// revalidating them; 0 makes them revalidate every time
+	ListingMaxAge int `json:"listingMaxAge"`
+	// ListingTimezone is the IANA time zone (e.g. "Europe/Zurich") modification
+	// times are shown in on listing pages; empty means UTC
+	ListingTimezone string `json:"listingTimezone,omitempty"`
+	// TrustedProxies are the CIDR ranges of reverse proxies whose forwarding headers
+	// (Forwarded, X-Forwarded-For, X-Real-IP) are believed; empty trusts none
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// BasePath is the path prefix the server is published under by a reverse proxy,
+	// e.g. "/mirror". Generated links and redirects start with it, and requests are
+	// accepted with and without it. A trusted proxy's X-Forwarded-Prefix overrides it.
+	BasePath string `json:"basePath,omitempty"`
+	// BlockHidden answers direct requests for hidden files with 404 instead of only
+	// leaving them out of listings. Mirror metadata is never served.
+	BlockHidden bool `json:"blockHidden,omitempty"`
+	// PathLimits rejects absurd request paths before they reach the filesystem
+	PathLimits PathLimits `json:"pathLimits"`
+	// SyncRetry looks up a missing file once more after a short delay while its
+	// target is being synced, to ride out files being replaced
+	SyncRetry bool `json:"syncRetry"`
+	// Breakdown splits target sizes by file extension and size
+	Breakdown Breakdown `json:"breakdown"`
+	// StatsTTL is how many seconds the size walk of a target is served before it is
+	// walked again in the background; 0 walks on every metrics update
+	StatsTTL int `json:"statsTTL"`
+	// MetricsTargetLimit is the number of targets above which the per-target metric
+	// series of all targets but MetricsTargets are summed up under the target
+	// "_other", to bound the cardinality; 0 gives every target its own series
+	MetricsTargetLimit int `json:"metricsTargetLimit"`
+	// MetricsTargets are glob patterns of the target names that keep their own
+	// series beyond MetricsTargetLimit
+	MetricsTargets []string `json:"metricsTargets,omitempty"`
+	// Sitemap publishes sitemap.xml files listing the mirrored files
+	Sitemap Sitemap `json:"sitemap"`
+	// RateTiers throttle responses by who requests them. The first tier matching a
+	// request applies; requests matching none are not throttled.
+	RateTiers []RateTier `json:"rateTiers,omitempty"`
+	// UserHeader and GroupsHeader name the headers an authenticating reverse proxy
+	// among TrustedProxies passes the user and its comma-separated groups in
+	UserHeader   string `json:"userHeader,omitempty"`
+	GroupsHeader string `json:"groupsHeader,omitempty"`
+	// LatestLinks serve a stable "latest" path in directories of versioned entries
+	LatestLinks []LatestLink `json:"latestLinks,omitempty"`
+	// Decompress serves uncompressed variants of mirrored gzip files
+	Decompress Decompress `json:"decompress"`
+}
+
+// Decompress serves a missing file "foo" by decompressing "foo.gz" on the fly, for
+// clients asking for indexes such as Packages that were only mirrored compressed
+type Decompress struct {
+	// Paths are glob patterns of the uncompressed paths below the data root, e.g.
+	// "debian/dists/*/*/binary-*/Packages"; empty disables decompression
+	Paths []string `json:"paths,omitempty"`
+	// ShowInListings lists the uncompressed variants next to their gzip files
+	ShowInListings bool `json:"showInListings,omitempty"`
+	// CacheSize bounds the memory keeping small decompressed files, e.g. "16m"
+	CacheSize string `json:"cacheSize,omitempty"`
+}
+
+// Matches reports whether the slash-separated urlPath below the data root may be
+// served decompressed
+func (d *Decompress) Matches(urlPath string) bool {
+	for _, pattern := range d.Paths {
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Modes of LatestLink.Mode
+const (
+	LatestRedirect = "redirect"
+	LatestServe    = "serve"
+)
+
+// LatestLink serves <Path>/latest/ as the subdirectory of Path with the highest
+// version in its name, e.g. "v1.2.10" rather than "v1.2.9"
+type LatestLink struct {
+	// Path is the directory of the versions below the data root, starting with the
+	// target name, e.g. "tools/releases"
+	Path string `json:"path"`
+	// Mode is "redirect" (default) to answer with 302 to the newest version, or
+	// "serve" to serve it under the latest path itself
+	Mode string `json:"mode,omitempty"`
+	// Prereleases lets versions with a suffix such as "-rc1" be the latest
+	Prereleases bool `json:"prereleases,omitempty"`
+}
+
+// Requesters RateTier.Match selects, besides "user:<name>" and "group:<name>"
+const (
+	RateTierAnonymous     = "anonymous"
+	RateTierAuthenticated = "authenticated"
+)
+
+// RateTier caps the bandwidth and concurrency of the requests it matches
+type RateTier struct {
+	// Name identifies the tier in logs and metrics
+	Name string `json:"name"`
+	// Match selects the requests of the tier: "anonymous", "authenticated" (a user
+	// passed by a trusted proxy or a valid signed URL), "user:<name>" or
+	// "group:<name>"; any matching entry selects the tier
+	Match []string `json:"match"`
+	// ConnectionRate caps the responses of the tier sent over one client
+	// connection and IPRate all responses of the tier to one client address, in
+	// bytes per second (e.g. "1m"); empty is unlimited
+	ConnectionRate string `json:"connectionRate,omitempty"`
+	IPRate         string `json:"ipRate,omitempty"`
+	// MaxConcurrent caps the requests of the tier served at once; more are
+	// answered with 429. 0 is unlimited.
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+}
+
+// validateRateTiers checks the names and matches of the rate tiers; their rates
+// are parsed by the server
+func validateRateTiers(tiers []RateTier) error {
+	names := make(map[string]bool, len(tiers))
+	for _, tier := range tiers {
+		if tier.Name == "" || names[tier.Name] {
+			return fmt.Errorf("rate tier names must be unique and not empty, got %q", tier.Name)
+		}
+		names[tier.Name] = true
+		if len(tier.Match) == 0 {
+			return fmt.Errorf("rate tier %s: match is empty", tier.Name)
+		}
+		for _, match := range tier.Match {
+			kind, name, scoped := strings.Cut(match, ":")
+			valid := match == RateTierAnonymous || match == RateTierAuthenticated ||
+				(scoped && name != "" && (kind == "user" || kind == "group"))
+			if !valid {
+				return fmt.Errorf("rate tier %s: unknown match %q", tier.Name, match)
+			}
+		}
+		if tier.MaxConcurrent < 0 {
+			return fmt.Errorf("rate tier %s: maxConcurrent must not be negative", tier.Name)
+		}
+	}
+	return nil
+}
+
+// normalizeLatestLinks cleans the paths of the latest links and checks that they are
+// unique and their modes known
+func normalizeLatestLinks(links []LatestLink) error {
+	paths := make(map[string]bool, len(links))
+	for i := range links {
+		raw := links[i].Path
+		links[i].Path = strings.Trim(path.Clean("/"+raw), "/")
+		if links[i].Path == "" || paths[links[i].Path] {
+			return fmt.Errorf("latest link paths must be unique and below a target, got %q", raw)
+		}
+		paths[links[i].Path] = true
+		switch links[i].Mode {
+		case "", LatestRedirect, LatestServe:
+		default:
+			return fmt.Errorf("latest link %s: unknown mode %q", links[i].Path, links[i].Mode)
+		}
+	}
+	return nil
+}
+
+// Sitemap configures the generated sitemaps for search engines. They are rebuilt
+// from the target manifests together with the metrics, not per request.
+type Sitemap struct {
+	// Enabled publishes the sitemaps
+	Enabled bool `json:"enabled"`
+	// BaseURL is the public URL of the server the sitemap URLs start with, e.g.
+	// "https://mirror.example.com"; required when enabled
+	BaseURL string `json:"baseURL,omitempty" redact:"url"`
+	// Include are glob patterns of the target names to advertise; empty includes
+	// all targets
+	Include []string `json:"include,omitempty"`
+	// Exclude are glob patterns of target names never to advertise
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Advertises reports whether the target named name belongs in the sitemaps
+func (s *Sitemap) Advertises(name string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(s.Include) > 0 && !matches(s.Include) {
+		return false
+	}
+	return !matches(s.Exclude)
+}
+
+// OwnMetricsSeries reports whether the target named name gets its own metric
+// series when targets targets are configured
+func (s *Server) OwnMetricsSeries(name string, targets int) bool {
+	if s.MetricsTargetLimit <= 0 || targets <= s.MetricsTargetLimit {
+		return true
+	}
+	for _, pattern := range s.MetricsTargets {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Breakdown configures the per-extension and per-size statistics of targets. They
+// are collected during the size walk the metrics already do.
+type Breakdown struct {
+	// Enabled collects the statistics
+	Enabled bool `json:"enabled"`
+	// Extensions are the extensions (e.g. ".iso", ".tar.gz") exported as metric
+	// labels; all others are summed up as "other" to bound the cardinality
+	Extensions []string `json:"extensions,omitempty"`
+}
+
+// DefaultBreakdownExtensions are the extensions exported as metric labels when
+// none are configured
+var DefaultBreakdownExtensions = []string{".iso", ".img", ".qcow2", ".rpm", ".deb", ".zip", ".tar.gz", ".tar.xz"}
+
+// PathLimits caps the request paths the server accepts. Deep mirrors can exceed
+// typical web server limits, so the defaults are generous; 0 disables a cap.
+type PathLimits struct {
+	// MaxLength is the longest decoded URL path in bytes; longer paths get 414
+	MaxLength int `json:"maxLength"`
+	// MaxSegments is the largest number of path segments; more get 414
+	MaxSegments int `json:"maxSegments"`
+	// MaxSegmentLength is the longest single segment in bytes; longer ones get 400
+	MaxSegmentLength int `json:"maxSegmentLength"`
+}
+
+// TLS configures the server certificate. Both files must be set to enable HTTPS.
+type TLS struct {
+	// CertFile and KeyFile are the PEM files of the certificate chain and its key
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// Enabled reports whether a certificate is configured
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// HTTP3 configures the QUIC listener. Changes require a restart.
+type HTTP3 struct {
+	// Enabled starts the listener
+	Enabled bool `json:"enabled"`
+	// Port is the UDP port to listen on; 0 uses the TCP port
+	Port int `json:"port,omitempty"`
+}
+
+// Thumbnails configures on-demand image thumbnails. Changes require a restart.
+type Thumbnails struct {
+	// Enabled shows the thumbnails
+	Enabled bool `json:"enabled"`
+	// Size is the maximum width and height of a thumbnail in pixels
+	Size int `json:"size,omitempty"`
+	// CacheSize caps the disk space used by cached thumbnails (e.g. "256m")
+	CacheSize string `json:"cacheSize,omitempty"`
+	// MaxSourcePixels rejects source images with more pixels to avoid decompression bombs
+	MaxSourcePixels int `json:"maxSourcePixels,omitempty"`
+	// Workers limits concurrent thumbnail generation
+	Workers int `json:"workers,omitempty"`
+}
+
+// SignedURLs configures temporary download links of the form ?exp=...&sig=...
+type SignedURLs struct {
+	// Secrets are the accepted signing keys. The first one signs new URLs; the others
+	// are still accepted so keys can be rotated without invalidating issued links.
+	Secrets []string `json:"secrets,omitempty" redact:"secret"`
+	// AdminToken authorizes the admin API that mints signed URLs; empty disables it
+	AdminToken string `json:"adminToken,omitempty" redact:"secret"`
+	// MaxTTL is the longest lifetime in seconds a signed URL may have
+	MaxTTL int `json:"maxTTL,omitempty"`
+	// ClockSkew is the tolerance in seconds allowed when checking expiry
+	ClockSkew int `json:"clockSkew,omitempty"`
+}
+
+// MetadataPrefix starts the names of the files the mirror keeps its state in. They
+// are never downloaded from an upstream or served, whatever the hidden patterns.
+const MetadataPrefix = ".http-mirror-"
+
+// TempFilePrefix starts the names of files the updater is still downloading; they
+// are renamed to their final name once complete
+const TempFilePrefix = MetadataPrefix + "tmp-"
+
+// PartialSuffix ends the names of partially downloaded files
+const PartialSuffix = ".part"
+
+// PartialValidatorPrefix starts the name of the file next to a partial download
+// that keeps the validator of its content, followed by the name of the download
+const PartialValidatorPrefix = TempFilePrefix + "validator-"
+
+// IsTempFile reports whether name is an incomplete download
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, TempFilePrefix) || strings.HasSuffix(name, PartialSuffix)
+}
+
+// DefaultHidden hides dotfiles
+var DefaultHidden = []string{".*"}
+
+// IsHidden reports whether a file or directory name matches one of the hidden
+// patterns or is mirror metadata. Nil patterns mean DefaultHidden.
+func IsHidden(patterns []string, name string) bool {
+	if strings.HasPrefix(name, MetadataPrefix) {
+		return true
+	}
+	if patterns == nil {
+		patterns = DefaultHidden
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// HiddenPatterns returns the hidden patterns of the named target, or the defaults
+// for paths outside a configured target
+func (c *Config) HiddenPatterns(targetName string) []string {
+	if c == nil {
+		return DefaultHidden
+	}
+	for _, target := range c.Targets {
+		if target.Name == targetName {
+			if target.Hidden == nil {
+				return c.Defaults.Hidden
+			}
+			return target.Hidden
+		}
+	}
+	return c.Defaults.Hidden
 }
 
 // GetDefaults returns default configuration values
@@ -72,23 +762,128 @@ func GetDefaults() Defaults {
 		NoClobber:           true,
 		ContinueDownload:    true,
 		CheckChanges:        true,
+		Concurrency:         1,
+		Hidden:              DefaultHidden,
 	}
 }
 
-// LoadConfig loads configuration from environment variables and config file
-func LoadConfig() (*Config, error) {
-	config := &Config{
+// GetMirrorDefaults returns default mirroring settings, before environment overrides
+func GetMirrorDefaults() Mirror {
+	return Mirror{
+		DataPath:                 "/data",
+		LogLevel:                 "info",
+		FilesystemCompat:         "auto",
+		WriteBufferSize:          "64k",
+		SyncWrites:               "never",
+		MaxResponseBytes:         "1g",
+		EmptyListingAlertPercent: 20,
+		MaxPathDepth:             64,
+		CapResetDay:              1,
+		TempMaxAge:               86400,
+		ReportDetail:             ReportSummary,
+		FutureTimeTolerance:      86400,
+		LogThrottle: LogThrottle{
+			Enabled:         true,
+			Burst:           10,
+			SampleRate:      100,
+			SummaryInterval: 60,
+		},
+	}
+}
+
+// newConfig returns the configuration without a config file, with the settings
+// env overrides by environment variable
+func newConfig(env environment) *Config {
+	mirrorDefaults := GetMirrorDefaults()
+	return &Config{
 		Defaults: GetDefaults(),
 		Mirror: Mirror{
-			DataPath: getEnv("MIRROR_DATA_PATH", "/data"),
-			LogLevel: getEnv("LOG_LEVEL", "info"),
+			DataPath:                 env.get("MIRROR_DATA_PATH", mirrorDefaults.DataPath),
+			LogLevel:                 env.get("LOG_LEVEL", mirrorDefaults.LogLevel),
+			FilesystemCompat:         env.get("MIRROR_FILESYSTEM_COMPAT", mirrorDefaults.FilesystemCompat),
+			WriteBufferSize:          env.get("MIRROR_WRITE_BUFFER_SIZE", mirrorDefaults.WriteBufferSize),
+			SyncWrites:               env.get("MIRROR_SYNC_WRITES", mirrorDefaults.SyncWrites),
+			MaxResponseBytes:         env.get("MIRROR_MAX_RESPONSE_BYTES", mirrorDefaults.MaxResponseBytes),
+			LogThrottle:              mirrorDefaults.LogThrottle,
+			EmptyListingAlertPercent: env.getInt("MIRROR_EMPTY_LISTING_ALERT_PERCENT", mirrorDefaults.EmptyListingAlertPercent),
+			MaxDirectories:           env.getInt("MIRROR_MAX_DIRECTORIES", mirrorDefaults.MaxDirectories),
+			MaxEntriesPerDirectory:   env.getInt("MIRROR_MAX_ENTRIES_PER_DIRECTORY", mirrorDefaults.MaxEntriesPerDirectory),
+			MaxPathDepth:             env.getInt("MIRROR_MAX_PATH_DEPTH", mirrorDefaults.MaxPathDepth),
+			MonthlyByteCap:           env.get("MIRROR_MONTHLY_BYTE_CAP", mirrorDefaults.MonthlyByteCap),
+			CapResetDay:              env.getInt("MIRROR_CAP_RESET_DAY", mirrorDefaults.CapResetDay),
+			VerifyRelinks:            env.get("MIRROR_VERIFY_RELINKS", "false") == "true",
+			TempMaxAge:               env.getInt("MIRROR_TEMP_MAX_AGE", mirrorDefaults.TempMaxAge),
+			ReportDetail:             env.get("MIRROR_REPORT_DETAIL", mirrorDefaults.ReportDetail),
+			FutureTimeTolerance:      env.getInt("MIRROR_FUTURE_TIME_TOLERANCE", mirrorDefaults.FutureTimeTolerance),
+			ClampFutureTimes:         env.get("MIRROR_CLAMP_FUTURE_TIMES", "false") == "true",
+			MaxOpenTransfers:         env.getInt("MIRROR_MAX_OPEN_TRANSFERS", mirrorDefaults.MaxOpenTransfers),
 		},
 		Server: Server{
-			Port:     getEnvInt("SERVER_PORT", 8080),
-			Host:     getEnv("SERVER_HOST", "0.0.0.0"),
-			DataPath: getEnv("SERVER_DATA_PATH", "/data"),
+			Port:         env.getInt("SERVER_PORT", 8080),
+			Host:         env.get("SERVER_HOST", "0.0.0.0"),
+			DataPath:     env.get("SERVER_DATA_PATH", "/data"),
+			DrainTimeout: env.getInt("SERVER_DRAIN_TIMEOUT", 30),
+			SignedURLs: SignedURLs{
+				Secrets:    env.getList("SERVER_SIGNING_SECRETS"),
+				AdminToken: env("SERVER_ADMIN_TOKEN"),
+				MaxTTL:     env.getInt("SERVER_SIGNED_URL_MAX_TTL", 86400),
+				ClockSkew:  env.getInt("SERVER_SIGNED_URL_CLOCK_SKEW", 30),
+			},
+			Thumbnails: Thumbnails{
+				Enabled:         env.get("SERVER_THUMBNAILS", "false") == "true",
+				Size:            env.getInt("SERVER_THUMBNAIL_SIZE", 160),
+				CacheSize:       env.get("SERVER_THUMBNAIL_CACHE_SIZE", "256m"),
+				MaxSourcePixels: env.getInt("SERVER_THUMBNAIL_MAX_SOURCE_PIXELS", 50_000_000),
+				Workers:         env.getInt("SERVER_THUMBNAIL_WORKERS", 2),
+			},
+			TLS: TLS{
+				CertFile: env("SERVER_TLS_CERT_FILE"),
+				KeyFile:  env("SERVER_TLS_KEY_FILE"),
+			},
+			HTTP3: HTTP3{
+				Enabled: env.get("SERVER_HTTP3", "false") == "true",
+				Port:    env.getInt("SERVER_HTTP3_PORT", 0),
+			},
+			SourceHeader:       env.get("SERVER_SOURCE_HEADER", "false") == "true",
+			ListingMaxAge:      env.getInt("SERVER_LISTING_MAX_AGE", 60),
+			StatsTTL:           env.getInt("SERVER_STATS_TTL", 30),
+			MetricsTargetLimit: env.getInt("SERVER_METRICS_TARGET_LIMIT", 100),
+			MetricsTargets:     env.getList("SERVER_METRICS_TARGETS"),
+			ListingTimezone:    env.get("SERVER_LISTING_TIMEZONE", "UTC"),
+			TrustedProxies:     env.getList("SERVER_TRUSTED_PROXIES"),
+			BasePath:           env("SERVER_BASE_PATH"),
+			BlockHidden:        env.get("SERVER_BLOCK_HIDDEN", "false") == "true",
+			SyncRetry:          env.get("SERVER_SYNC_RETRY", "true") == "true",
+			Sitemap: Sitemap{
+				Enabled: env.get("SERVER_SITEMAP", "false") == "true",
+				BaseURL: env("SERVER_SITEMAP_BASE_URL"),
+				Include: env.getList("SERVER_SITEMAP_INCLUDE"),
+				Exclude: env.getList("SERVER_SITEMAP_EXCLUDE"),
+			},
+			Breakdown: Breakdown{
+				Enabled:    env.get("SERVER_BREAKDOWN", "false") == "true",
+				Extensions: env.getList("SERVER_BREAKDOWN_EXTENSIONS"),
+			},
+			UserHeader:   env.get("SERVER_USER_HEADER", "X-Remote-User"),
+			GroupsHeader: env.get("SERVER_GROUPS_HEADER", "X-Remote-Groups"),
+			PathLimits: PathLimits{
+				MaxLength:        env.getInt("SERVER_MAX_PATH_LENGTH", 16384),
+				MaxSegments:      env.getInt("SERVER_MAX_PATH_SEGMENTS", 512),
+				MaxSegmentLength: env.getInt("SERVER_MAX_PATH_SEGMENT_LENGTH", 1024),
+			},
+			Decompress: Decompress{
+				Paths:          env.getList("SERVER_DECOMPRESS_PATHS"),
+				ShowInListings: env.get("SERVER_DECOMPRESS_IN_LISTINGS", "false") == "true",
+				CacheSize:      env.get("SERVER_DECOMPRESS_CACHE_SIZE", "16m"),
+			},
 		},
 	}
+}
+
+// LoadConfig loads configuration from environment variables and config file
+func LoadConfig() (*Config, error) {
+	config := newConfig(os.Getenv)
+	config.Source.LoadedAt = time.Now().UTC()
 
 	// Load targets from config file or environment
 	if configFile := os.Getenv("CONFIG_FILE"); configFile != "" {
@@ -100,14 +895,180 @@ func LoadConfig() (*Config, error) {
 		loadFromEnv(config)
 	}
 
+	if _, err := config.Server.ListingLocation(); err != nil {
+		return nil, err
+	}
+	if base := config.Server.BasePath; base != "" && (!strings.HasPrefix(base, "/") || strings.ContainsAny(base, "?#\\")) {
+		return nil, fmt.Errorf("invalid base path %q: must be an absolute URL path", base)
+	}
+	config.Server.BasePath = CleanBasePath(config.Server.BasePath)
+	if config.Server.StatsTTL < 0 {
+		return nil, fmt.Errorf("stats TTL must not be negative, got %d", config.Server.StatsTTL)
+	}
+	if config.Server.MetricsTargetLimit < 0 {
+		return nil, fmt.Errorf("metrics target limit must not be negative, got %d", config.Server.MetricsTargetLimit)
+	}
+	for _, pattern := range config.Server.MetricsTargets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid metrics target pattern %q: %w", pattern, err)
+		}
+	}
+	if config.Server.Sitemap.Enabled {
+		if err := ValidateURL(config.Server.Sitemap.BaseURL); err != nil {
+			return nil, fmt.Errorf("sitemap base URL: %w", err)
+		}
+	}
+	if err := validateRateTiers(config.Server.RateTiers); err != nil {
+		return nil, err
+	}
+	if err := normalizeLatestLinks(config.Server.LatestLinks); err != nil {
+		return nil, err
+	}
+	for _, pattern := range config.Server.Decompress.Paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid decompress path %q: %w", pattern, err)
+		}
+	}
+	switch detail := config.Mirror.ReportDetail; detail {
+	case "", ReportSummary, ReportFull:
+	default:
+		return nil, fmt.Errorf("unknown report detail %q", detail)
+	}
+	if len(config.Server.Breakdown.Extensions) == 0 {
+		config.Server.Breakdown.Extensions = DefaultBreakdownExtensions
+	}
+
 	// Apply defaults to targets
 	for i := range config.Targets {
 		applyDefaults(&config.Targets[i], config.Defaults)
+		if err := ValidateURL(config.Targets[i].URL); err != nil {
+			return nil, fmt.Errorf("target %s: %w", config.Targets[i].Name, err)
+		}
+		switch layout := config.Targets[i].Layout; layout {
+		case "", "in-place", "immutable-dated":
+		default:
+			return nil, fmt.Errorf("target %s: unknown layout %q", config.Targets[i].Name, layout)
+		}
+		switch format := config.Targets[i].ListingFormat; format {
+		case "", "auto", "html", "nginx-json", "s3":
+		default:
+			return nil, fmt.Errorf("target %s: unknown listing format %q", config.Targets[i].Name, format)
+		}
+		switch policy := config.Targets[i].CrossHostRedirects; policy {
+		case "", "allow", "deny":
+		default:
+			return nil, fmt.Errorf("target %s: unknown cross-host redirect policy %q", config.Targets[i].Name, policy)
+		}
+		switch mode := config.Targets[i].FilterMode; mode {
+		case "", "enforce", "report":
+		default:
+			return nil, fmt.Errorf("target %s: unknown filter mode %q", config.Targets[i].Name, mode)
+		}
+		switch check := config.Targets[i].ContentTypeCheck; check {
+		case "", "html", "all", "off":
+		default:
+			return nil, fmt.Errorf("target %s: unknown content type check %q", config.Targets[i].Name, check)
+		}
+		if t := config.Targets[i]; t.ChurnSkipAfter < 0 || t.ChurnRelistEvery < 0 || t.FullScanEvery < 0 {
+			return nil, fmt.Errorf("target %s: churn settings must not be negative", t.Name)
+		}
+		if t := config.Targets[i]; t.ListingRefreshEvery < 0 {
+			return nil, fmt.Errorf("target %s: listingRefreshEvery must not be negative", t.Name)
+		}
+		if t := config.Targets[i]; t.ParallelChunks < 0 {
+			return nil, fmt.Errorf("target %s: parallelChunks must not be negative", t.Name)
+		}
+		if t := config.Targets[i]; t.Concurrency < 0 {
+			return nil, fmt.Errorf("target %s: concurrency must not be negative", t.Name)
+		}
+		if t := config.Targets[i]; t.TransferWeight < 0 {
+			return nil, fmt.Errorf("target %s: transferWeight must not be negative", t.Name)
+		}
+		if t := config.Targets[i]; t.MaxTotalFiles < 0 {
+			return nil, fmt.Errorf("target %s: maxTotalFiles must not be negative", t.Name)
+		}
+		if err := ValidateFileSizes(config.Targets[i]); err != nil {
+			return nil, fmt.Errorf("target %s: %w", config.Targets[i].Name, err)
+		}
+		if t := config.Targets[i]; t.MTimeTolerance != nil && *t.MTimeTolerance < 0 {
+			return nil, fmt.Errorf("target %s: mtimeTolerance must not be negative", t.Name)
+		}
+		if t := config.Targets[i]; t.PullThrough && t.Layout == "immutable-dated" {
+			return nil, fmt.Errorf("target %s: pullThrough does not support the immutable-dated layout", t.Name)
+		}
+		if t := config.Targets[i]; t.Prune && t.Layout == "immutable-dated" {
+			return nil, fmt.Errorf("target %s: prune does not support the immutable-dated layout", t.Name)
+		}
+		if err := validateStorage(&config.Targets[i]); err != nil {
+			return nil, fmt.Errorf("target %s: %w", config.Targets[i].Name, err)
+		}
+		if err := validateFileEvents(config.Targets[i].FileEvents); err != nil {
+			return nil, fmt.Errorf("target %s: %w", config.Targets[i].Name, err)
+		}
 	}
 
 	return config, nil
 }
 
+// validateStorage checks the storage backend of a target. Dated layouts link files
+// between runs on disk, which S3 cannot do.
+func validateStorage(target *Target) error {
+	switch target.Storage {
+	case "", StorageLocal:
+		return nil
+	case StorageS3:
+		if target.S3 == nil || target.S3.Bucket == "" {
+			return fmt.Errorf("s3 storage requires s3.bucket")
+		}
+		if target.Layout == "immutable-dated" {
+			return fmt.Errorf("s3 storage does not support the immutable-dated layout")
+		}
+		if target.PullThrough {
+			return fmt.Errorf("s3 storage does not support pullThrough")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown storage %q", target.Storage)
+	}
+}
+
+// ValidateFileSizes checks that the size range of a target parses and is not
+// empty
+func ValidateFileSizes(target Target) error {
+	sizes := make(map[string]int64, 2)
+	for name, value := range map[string]string{"minFileSize": target.MinFileSize, "maxFileSize": target.MaxFileSize} {
+		if value == "" {
+			continue
+		}
+		size, err := ParseSize(value)
+		if err != nil || size < 0 {
+			return fmt.Errorf("%s %q is not a size like \"100m\"", name, value)
+		}
+		sizes[name] = size
+	}
+	if minSize, maxSize := sizes["minFileSize"], sizes["maxFileSize"]; maxSize > 0 && minSize > maxSize {
+		return fmt.Errorf("minFileSize %s exceeds maxFileSize %s", target.MinFileSize, target.MaxFileSize)
+	}
+	return nil
+}
+
+// validateFileEvents checks the file event outputs of a target, if any
+func validateFileEvents(events *FileEvents) error {
+	if events == nil {
+		return nil
+	}
+	if events.WebhookURL != "" {
+		u, err := url.Parse(events.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("fileEvents.webhookUrl must be an http or https URL")
+		}
+	}
+	if events.BatchSize < 0 || events.FlushInterval < 0 || events.QueueSize < 0 {
+		return fmt.Errorf("fileEvents.batchSize, flushInterval and queueSize must not be negative")
+	}
+	return nil
+}
+
 // loadConfigFile loads configuration from a JSON file
 func loadConfigFile(config *Config, filename string) error {
 	data, err := os.ReadFile(filename)
@@ -115,6 +1076,9 @@ func loadConfigFile(config *Config, filename string) error {
 		return err
 	}
 
+	sum := sha256.Sum256(data)
+	config.Source.File = filename
+	config.Source.SHA256 = hex.EncodeToString(sum[:])
 	return json.Unmarshal(data, config)
 }
 
@@ -164,19 +1128,34 @@ func applyDefaults(target *Target, defaults Defaults) {
 	if !target.CheckChanges {
 		target.CheckChanges = defaults.CheckChanges
 	}
+	if target.Concurrency == 0 {
+		target.Concurrency = defaults.Concurrency
+	}
+	if target.MaxTotalBytes == "" {
+		target.MaxTotalBytes = defaults.MaxTotalBytes
+	}
+	if target.MaxTotalFiles == 0 {
+		target.MaxTotalFiles = defaults.MaxTotalFiles
+	}
+	if target.Hidden == nil {
+		target.Hidden = defaults.Hidden
+	}
 }
 
-// getEnv gets an environment variable with a default value
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+// environment looks up environment variables by name, like os.Getenv
+type environment func(key string) string
+
+// get gets an environment variable with a default value
+func (env environment) get(key, defaultValue string) string {
+	if value := env(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
 
-// getEnvInt gets an integer environment variable with a default value
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+// getInt gets an integer environment variable with a default value
+func (env environment) getInt(key string, defaultValue int) int {
+	if value := env(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
 			return intValue
 		}
@@ -184,11 +1163,144 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getList gets a comma-separated environment variable as a list, skipping empty items
+func (env environment) getList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(env(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnv gets an environment variable with a default value
+func getEnv(key, defaultValue string) string {
+	return environment(os.Getenv).get(key, defaultValue)
+}
+
+// getEnvInt gets an integer environment variable with a default value
+func getEnvInt(key string, defaultValue int) int {
+	return environment(os.Getenv).getInt(key, defaultValue)
+}
+
+// ValidateURL checks that a target URL is an absolute http or https URL
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q: scheme must be http or https", rawURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q: missing host", rawURL)
+	}
+	return nil
+}
+
+// ParseSize parses a size like "64k" or "1g" into bytes; the suffixes k, m, g and
+// t are powers of 1024 and are case-insensitive
+func ParseSize(value string) (int64, error) {
+	size := strings.ToLower(strings.TrimSpace(value))
+	var multiplier int64 = 1
+	for i, suffix := range []string{"k", "m", "g", "t"} {
+		if strings.HasSuffix(size, suffix) {
+			multiplier = 1 << (10 * (i + 1))
+			size = strings.TrimSuffix(size, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// CleanBasePath normalizes a URL path prefix to a leading and no trailing slash,
+// with "" for the site root
+func CleanBasePath(base string) string {
+	cleaned := path.Clean("/" + base)
+	if cleaned == "/" {
+		return ""
+	}
+	return cleaned
+}
+
 // GetTimeout returns the timeout duration for a target
 func (t *Target) GetTimeout() time.Duration {
 	return time.Duration(t.Timeout) * time.Second
 }
 
+// GetHTTP3Port returns the UDP port of the QUIC listener
+func (s *Server) GetHTTP3Port() int {
+	if s.HTTP3.Port > 0 {
+		return s.HTTP3.Port
+	}
+	return s.Port
+}
+
+// ListingLocation returns the time zone of listing pages
+func (s *Server) ListingLocation() (*time.Location, error) {
+	if s.ListingTimezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(s.ListingTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listing timezone %q: %w", s.ListingTimezone, err)
+	}
+	return loc, nil
+}
+
+// GetDrainTimeout returns the shutdown drain timeout for the server
+func (s *Server) GetDrainTimeout() time.Duration {
+	return time.Duration(s.DrainTimeout) * time.Second
+}
+
+// FollowsAbsoluteSameHost reports whether absolute listing links to the target's
+// own host are followed
+func (t *Target) FollowsAbsoluteSameHost() bool {
+	return t.FollowAbsoluteSameHost == nil || *t.FollowAbsoluteSameHost
+}
+
+// DefaultMTimeTolerance is the modification time skew tolerated when
+// Target.MTimeTolerance is unset
+const DefaultMTimeTolerance = 2 * time.Second
+
+// GetMTimeTolerance returns how far the upstream modification time of a file may
+// lie past the local one before the file is downloaded again
+func (t *Target) GetMTimeTolerance() time.Duration {
+	if t.MTimeTolerance == nil {
+		return DefaultMTimeTolerance
+	}
+	return time.Duration(*t.MTimeTolerance) * time.Second
+}
+
+// GetBatchSize returns the most file events sent in one request
+func (e *FileEvents) GetBatchSize() int {
+	if e.BatchSize > 0 {
+		return e.BatchSize
+	}
+	return DefaultEventBatchSize
+}
+
+// GetFlushInterval returns how long file events wait for their batch to fill
+func (e *FileEvents) GetFlushInterval() time.Duration {
+	if e.FlushInterval > 0 {
+		return time.Duration(e.FlushInterval) * time.Second
+	}
+	return DefaultEventFlushInterval
+}
+
+// GetQueueSize returns the most file events kept while they cannot be delivered
+func (e *FileEvents) GetQueueSize() int {
+	if e.QueueSize > 0 {
+		return e.QueueSize
+	}
+	return DefaultEventQueueSize
+}
+
 // GetWaitDuration returns the wait duration between requests for a target
 func (t *Target) GetWaitDuration() time.Duration {
 	return time.Duration(t.WaitBetweenRequests) * time.Second
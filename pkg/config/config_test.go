@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -34,6 +35,10 @@ func TestGetDefaults(t *testing.T) {
 	if !defaults.CheckChanges {
 		t.Error("CheckChanges should be true by default")
 	}
+
+	if defaults.Concurrency != 1 {
+		t.Errorf("Expected Concurrency to be 1, got %d", defaults.Concurrency)
+	}
 }
 
 func TestLoadConfigFromEnv(t *testing.T) {
@@ -287,3 +292,696 @@ func TestGetEnvIntWithDefault(t *testing.T) {
 		t.Errorf("Expected 20 (default), got %d", result)
 	}
 }
+
+func TestServerGetHTTP3Port(t *testing.T) {
+	s := Server{Port: 8443}
+	if got := s.GetHTTP3Port(); got != 8443 {
+		t.Errorf("Expected HTTP/3 to default to the TCP port, got %d", got)
+	}
+
+	s.HTTP3.Port = 443
+	if got := s.GetHTTP3Port(); got != 443 {
+		t.Errorf("Expected configured HTTP/3 port, got %d", got)
+	}
+}
+
+func TestServerListingLocation(t *testing.T) {
+	tests := []struct {
+		timezone string
+		want     string
+		wantErr  bool
+	}{
+		{"", "UTC", false},
+		{"UTC", "UTC", false},
+		{"Europe/Zurich", "Europe/Zurich", false},
+		{"Mars/Olympus_Mons", "", true},
+	}
+	for _, tt := range tests {
+		s := Server{ListingTimezone: tt.timezone}
+		loc, err := s.ListingLocation()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: expected error %v, got %v", tt.timezone, tt.wantErr, err)
+			continue
+		}
+		if err == nil && loc.String() != tt.want {
+			t.Errorf("%q: expected location %s, got %s", tt.timezone, tt.want, loc)
+		}
+	}
+
+	t.Setenv("SERVER_LISTING_TIMEZONE", "Mars/Olympus_Mons")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected LoadConfig to reject an unknown listing timezone")
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		expected bool
+	}{
+		{nil, ".htaccess", true},
+		{nil, "file.txt", false},
+		{[]string{}, ".htaccess", false},
+		{[]string{}, ".http-mirror-state.json", true},
+		{[]string{"Thumbs.db", ".DS_*"}, "Thumbs.db", true},
+		{[]string{"Thumbs.db", ".DS_*"}, ".DS_Store", true},
+		{[]string{"Thumbs.db", ".DS_*"}, ".git", false},
+	}
+	for _, tt := range tests {
+		if got := IsHidden(tt.patterns, tt.name); got != tt.expected {
+			t.Errorf("IsHidden(%q, %q) = %v, expected %v", tt.patterns, tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestHiddenPatterns(t *testing.T) {
+	cfg := &Config{
+		Defaults: Defaults{Hidden: DefaultHidden},
+		Targets:  []Target{{Name: "dotfiles", Hidden: []string{}}, {Name: "plain"}},
+	}
+	if patterns := cfg.HiddenPatterns("dotfiles"); len(patterns) != 0 {
+		t.Errorf("Expected target override, got %v", patterns)
+	}
+	if patterns := cfg.HiddenPatterns("plain"); len(patterns) != 1 || patterns[0] != ".*" {
+		t.Errorf("Expected defaults for target without override, got %v", patterns)
+	}
+	if patterns := (*Config)(nil).HiddenPatterns("any"); len(patterns) != 1 {
+		t.Errorf("Expected defaults without config, got %v", patterns)
+	}
+
+	// An explicitly empty list in the config file survives applying the defaults
+	var target Target
+	if err := json.Unmarshal([]byte(`{"name": "t", "hidden": []}`), &target); err != nil {
+		t.Fatal(err)
+	}
+	applyDefaults(&target, GetDefaults())
+	if target.Hidden == nil || len(target.Hidden) != 0 {
+		t.Errorf("Expected empty hidden override to be kept, got %#v", target.Hidden)
+	}
+}
+
+func TestLoadConfigRejectsUnknownLayout(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "layout": "immutable-dated"}, {"name": "b", "url": "http://b/", "layout": "dated"}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `"dated"`) {
+		t.Errorf("Expected an error naming the unknown layout, got %v", err)
+	}
+}
+
+func TestLoadConfigRejectsUnknownRedirectPolicy(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "crossHostRedirects": "deny"}, {"name": "b", "url": "http://b/", "crossHostRedirects": "block"}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `"block"`) {
+		t.Errorf("Expected an error naming the unknown policy, got %v", err)
+	}
+}
+
+func TestLoadConfigRejectsUnknownFilterMode(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "filterMode": "report"}, {"name": "b", "url": "http://b/", "filterMode": "warn"}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `"warn"`) {
+		t.Errorf("Expected an error naming the unknown mode, got %v", err)
+	}
+}
+
+func TestLoadConfigRejectsUnknownListingFormat(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "listingFormat": "nginx-json"}, {"name": "s", "url": "http://s/", "listingFormat": "s3"}, {"name": "b", "url": "http://b/", "listingFormat": "json"}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `"json"`) {
+		t.Errorf("Expected an error naming the unknown format, got %v", err)
+	}
+}
+
+func TestLoadConfigRejectsUnknownContentTypeCheck(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "contentTypeCheck": "all"}, {"name": "b", "url": "http://b/", "contentTypeCheck": "strict"}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `"strict"`) {
+		t.Errorf("Expected an error naming the unknown check, got %v", err)
+	}
+}
+
+func TestLoadConfigRejectsNegativeChurnSettings(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "churnSkipAfter": 3}, {"name": "b", "url": "http://b/", "churnSkipAfter": 3, "fullScanEvery": -1}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "target b") {
+		t.Errorf("Expected an error naming the target, got %v", err)
+	}
+}
+
+func TestLoadConfigValidatesRateTiers(t *testing.T) {
+	tests := []struct {
+		name  string
+		tiers string
+		err   string
+	}{
+		{"valid", `[{"name": "staff", "match": ["group:staff", "user:alice"]}, {"name": "public", "match": ["anonymous"], "ipRate": "1m"}]`, ""},
+		{"duplicate name", `[{"name": "a", "match": ["anonymous"]}, {"name": "a", "match": ["authenticated"]}]`, "unique"},
+		{"missing name", `[{"match": ["anonymous"]}]`, "not empty"},
+		{"empty match", `[{"name": "a"}]`, "rate tier a"},
+		{"unknown match", `[{"name": "a", "match": ["everyone"]}]`, `"everyone"`},
+		{"empty user", `[{"name": "a", "match": ["user:"]}]`, `"user:"`},
+		{"negative concurrency", `[{"name": "a", "match": ["anonymous"], "maxConcurrent": -1}]`, "maxConcurrent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			data := `{"server": {"rateTiers": ` + tt.tiers + `}, "targets": [{"name": "a", "url": "http://a/"}]}`
+			if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", configFile)
+
+			cfg, err := LoadConfig()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig failed: %v", err)
+				}
+				if cfg.Server.UserHeader != "X-Remote-User" || cfg.Server.GroupsHeader != "X-Remote-Groups" {
+					t.Errorf("Expected the default identity headers, got %q and %q", cfg.Server.UserHeader, cfg.Server.GroupsHeader)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesLatestLinks(t *testing.T) {
+	tests := []struct {
+		name  string
+		links string
+		err   string
+	}{
+		{"valid", `[{"path": "/tools/releases/"}, {"path": "tools/nightly", "mode": "serve", "prereleases": true}]`, ""},
+		{"duplicate path", `[{"path": "tools/releases"}, {"path": "/tools/releases/"}]`, "unique"},
+		{"root", `[{"path": "/"}]`, "below a target"},
+		{"unknown mode", `[{"path": "tools", "mode": "proxy"}]`, `"proxy"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			data := `{"server": {"latestLinks": ` + tt.links + `}, "targets": [{"name": "tools", "url": "http://a/"}]}`
+			if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", configFile)
+
+			cfg, err := LoadConfig()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig failed: %v", err)
+				}
+				if cfg.Server.LatestLinks[0].Path != "tools/releases" {
+					t.Errorf("Expected a normalized path, got %q", cfg.Server.LatestLinks[0].Path)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesBasePath(t *testing.T) {
+	tests := []struct {
+		basePath string
+		want     string
+		valid    bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"/mirror/", "/mirror", true},
+		{"/a//b/../mirror", "/a/mirror", true},
+		{"mirror", "", false},
+		{"/mirror?x=1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.basePath, func(t *testing.T) {
+			t.Setenv("SERVER_BASE_PATH", tt.basePath)
+			t.Setenv("MIRROR_NAME", "a")
+			t.Setenv("MIRROR_URL", "http://a/")
+
+			cfg, err := LoadConfig()
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("Expected base path %q to be rejected", tt.basePath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.Server.BasePath != tt.want {
+				t.Errorf("Expected base path %q, got %q", tt.want, cfg.Server.BasePath)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidatesDecompressPaths(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"server": {"decompress": {"paths": ["debian/dists/[*/Packages"]}}, "targets": [{"name": "debian", "url": "http://a/"}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "invalid decompress path") {
+		t.Errorf("Expected an invalid pattern to be rejected, got %v", err)
+	}
+}
+
+func TestDecompressMatches(t *testing.T) {
+	d := Decompress{Paths: []string{"debian/dists/*/main/binary-*/Packages", "centos/*/repodata/*.xml"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"debian/dists/stable/main/binary-amd64/Packages", true},
+		{"debian/dists/stable/contrib/binary-amd64/Packages", false},
+		{"centos/9/repodata/primary.xml", true},
+		{"centos/9/repodata/primary.xml.gz", false},
+		{"tools/Packages", false},
+	}
+	for _, tt := range tests {
+		if got := d.Matches(tt.path); got != tt.want {
+			t.Errorf("%s: expected %t, got %t", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestLoadConfigRejectsNegativeListingRefresh(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "conditionalListings": true, "listingRefreshEvery": -1}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "listingRefreshEvery") {
+		t.Errorf("Expected an error naming the setting, got %v", err)
+	}
+}
+
+func TestLoadConfigRejectsNegativeParallelChunks(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "parallelChunks": 4}, {"name": "b", "url": "http://b/", "parallelChunks": -2}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "target b") {
+		t.Errorf("Expected an error naming the target, got %v", err)
+	}
+}
+
+func TestLoadConfigValidatesReportDetail(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"targets": [{"name": "a", "url": "http://a/"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil || cfg.Mirror.ReportDetail != ReportSummary {
+		t.Fatalf("Expected the summary report detail by default, got %+v (%v)", cfg, err)
+	}
+	t.Setenv("MIRROR_REPORT_DETAIL", "verbose")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `"verbose"`) {
+		t.Errorf("Expected an error naming the detail, got %v", err)
+	}
+}
+
+func TestLoadConfigFutureTimes(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"targets": [{"name": "a", "url": "http://a/"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil || cfg.Mirror.FutureTimeTolerance != 86400 || cfg.Mirror.ClampFutureTimes {
+		t.Fatalf("Expected a day of tolerance without clamping by default, got %+v (%v)", cfg, err)
+	}
+	t.Setenv("MIRROR_FUTURE_TIME_TOLERANCE", "60")
+	t.Setenv("MIRROR_CLAMP_FUTURE_TIMES", "true")
+	cfg, err = LoadConfig()
+	if err != nil || cfg.Mirror.FutureTimeTolerance != 60 || !cfg.Mirror.ClampFutureTimes {
+		t.Errorf("Expected the environment to override the defaults, got %+v (%v)", cfg, err)
+	}
+}
+
+func TestLoadConfigConcurrency(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"defaults": {"concurrency": 4}, "targets": [{"name": "a", "url": "http://a/"}, {"name": "b", "url": "http://b/", "concurrency": 8}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Targets[0].Concurrency != 4 || cfg.Targets[1].Concurrency != 8 {
+		t.Errorf("Expected concurrency 4 from the defaults and 8, got %d and %d", cfg.Targets[0].Concurrency, cfg.Targets[1].Concurrency)
+	}
+
+	for _, setting := range []string{"concurrency", "transferWeight"} {
+		data = `{"targets": [{"name": "a", "url": "http://a/", "` + setting + `": -1}]}`
+		if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), setting) {
+			t.Errorf("Expected an error naming %s, got %v", setting, err)
+		}
+	}
+}
+
+func TestLoadConfigRunBudget(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"defaults": {"maxTotalBytes": "10g", "maxTotalFiles": 500}, "targets": [{"name": "a", "url": "http://a/"}, {"name": "b", "url": "http://b/", "maxTotalBytes": "1g", "maxTotalFiles": 20}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if a := cfg.Targets[0]; a.MaxTotalBytes != "10g" || a.MaxTotalFiles != 500 {
+		t.Errorf("Expected the budget from the defaults, got %q and %d", a.MaxTotalBytes, a.MaxTotalFiles)
+	}
+	if b := cfg.Targets[1]; b.MaxTotalBytes != "1g" || b.MaxTotalFiles != 20 {
+		t.Errorf("Expected the target's own budget, got %q and %d", b.MaxTotalBytes, b.MaxTotalFiles)
+	}
+
+	data = `{"targets": [{"name": "a", "url": "http://a/", "maxTotalFiles": -1}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "maxTotalFiles") {
+		t.Errorf("Expected an error naming maxTotalFiles, got %v", err)
+	}
+}
+
+func TestLoadConfigFileSizes(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("CONFIG_FILE", configFile)
+
+	tests := []struct {
+		sizes string
+		err   string
+	}{
+		{`"minFileSize": "1k", "maxFileSize": "4G"`, ""},
+		{`"minFileSize": "1k"`, ""},
+		{`"maxFileSize": "100mb"`, "maxFileSize"},
+		{`"minFileSize": "-1"`, "minFileSize"},
+		{`"minFileSize": "2g", "maxFileSize": "1g"`, "exceeds maxFileSize"},
+	}
+	for _, tt := range tests {
+		data := `{"targets": [{"name": "a", "url": "http://a/", ` + tt.sizes + `}]}`
+		if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: expected the sizes to be accepted, got %v", tt.sizes, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected an error naming %s, got %v", tt.sizes, tt.err, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int64
+		ok    bool
+	}{
+		{"512", 512, true},
+		{" 64K ", 64 << 10, true},
+		{"1g", 1 << 30, true},
+		{"2t", 2 << 40, true},
+		{"100mb", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		size, err := ParseSize(tt.value)
+		if size != tt.size || (err == nil) != tt.ok {
+			t.Errorf("ParseSize(%q) = %d, %v; expected %d, success %t", tt.value, size, err, tt.size, tt.ok)
+		}
+	}
+}
+
+func TestLoadConfigFollowAbsoluteSameHost(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/"}, {"name": "b", "url": "http://b/", "followAbsoluteSameHost": false}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !cfg.Targets[0].FollowsAbsoluteSameHost() || cfg.Targets[1].FollowsAbsoluteSameHost() {
+		t.Errorf("Expected same-host links followed by default and not when disabled, got %v and %v",
+			cfg.Targets[0].FollowsAbsoluteSameHost(), cfg.Targets[1].FollowsAbsoluteSameHost())
+	}
+}
+
+func TestLoadConfigMTimeTolerance(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/"}, {"name": "b", "url": "http://b/", "mtimeTolerance": 0},
+		{"name": "c", "url": "http://c/", "mtimeTolerance": 30}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	for i, want := range []time.Duration{DefaultMTimeTolerance, 0, 30 * time.Second} {
+		if got := cfg.Targets[i].GetMTimeTolerance(); got != want {
+			t.Errorf("Expected target %s to tolerate %v, got %v", cfg.Targets[i].Name, want, got)
+		}
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{"targets": [{"name": "a", "url": "http://a/", "mtimeTolerance": -1}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "mtimeTolerance") {
+		t.Errorf("Expected a negative tolerance to be rejected, got %v", err)
+	}
+}
+
+func TestLoadConfigValidatesStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		wantErr string
+	}{
+		{name: "local", target: `{"name": "a", "url": "http://a/", "storage": "local"}`},
+		{name: "s3", target: `{"name": "a", "url": "http://a/", "storage": "s3", "s3": {"bucket": "mirror", "region": "eu-west-1"}}`},
+		{name: "unknown", target: `{"name": "a", "url": "http://a/", "storage": "ftp"}`, wantErr: `unknown storage "ftp"`},
+		{name: "missing bucket", target: `{"name": "a", "url": "http://a/", "storage": "s3"}`, wantErr: "requires s3.bucket"},
+		{name: "dated layout", target: `{"name": "a", "url": "http://a/", "storage": "s3", "layout": "immutable-dated", "s3": {"bucket": "mirror"}}`, wantErr: "immutable-dated"},
+		{name: "local pull-through", target: `{"name": "a", "url": "http://a/", "pullThrough": true}`},
+		{name: "s3 pull-through", target: `{"name": "a", "url": "http://a/", "storage": "s3", "pullThrough": true, "s3": {"bucket": "mirror"}}`, wantErr: "pullThrough"},
+		{name: "dated pull-through", target: `{"name": "a", "url": "http://a/", "layout": "immutable-dated", "pullThrough": true}`, wantErr: "pullThrough"},
+		{name: "dated prune", target: `{"name": "a", "url": "http://a/", "layout": "immutable-dated", "prune": true}`, wantErr: "prune"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(configFile, []byte(`{"targets": [`+tt.target+`]}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", configFile)
+
+			cfg, err := LoadConfig()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig failed: %v", err)
+				}
+				if tt.name == "s3" && (cfg.Targets[0].S3 == nil || cfg.Targets[0].S3.Region != "eu-west-1") {
+					t.Errorf("Expected S3 settings to be loaded, got %+v", cfg.Targets[0].S3)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileEvents(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	data := `{"targets": [{"name": "a", "url": "http://a/", "fileEvents": {"file": true}},
+		{"name": "b", "url": "http://b/", "fileEvents": {"webhookUrl": "https://indexer/events", "batchSize": 10, "flushInterval": 1}}]}`
+	if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	a, b := cfg.Targets[0].FileEvents, cfg.Targets[1].FileEvents
+	if !a.File || a.GetBatchSize() != DefaultEventBatchSize || a.GetFlushInterval() != DefaultEventFlushInterval ||
+		a.GetQueueSize() != DefaultEventQueueSize {
+		t.Errorf("Expected the defaults for target a, got %+v", a)
+	}
+	if b.WebhookURL != "https://indexer/events" || b.GetBatchSize() != 10 || b.GetFlushInterval() != time.Second {
+		t.Errorf("Expected the settings of target b, got %+v", b)
+	}
+
+	for _, events := range []string{`{"webhookUrl": "indexer/events"}`, `{"batchSize": -1}`} {
+		data := `{"targets": [{"name": "a", "url": "http://a/", "fileEvents": ` + events + `}]}`
+		if err := os.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "fileEvents") {
+			t.Errorf("Expected %s to be rejected, got %v", events, err)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"http://example.com/pub/", false},
+		{"https://example.com/pub", false},
+		{"https://example.com", false},
+		{"ftp://example.com/pub/", true},
+		{"example.com/pub/", true},
+		{"https:///pub/", true},
+		{"http://exa mple.com/", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateURL(%q): expected error %v, got %v", tt.url, tt.wantErr, err)
+		}
+	}
+
+	t.Setenv("MIRROR_URL", "ftp://example.com/pub/")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected LoadConfig to reject a non-http target URL")
+	}
+}
+
+func TestSitemapAdvertises(t *testing.T) {
+	tests := []struct {
+		sitemap Sitemap
+		name    string
+		want    bool
+	}{
+		{Sitemap{}, "debian", true},
+		{Sitemap{Include: []string{"deb*", "ubuntu"}}, "debian", true},
+		{Sitemap{Include: []string{"ubuntu"}}, "debian", false},
+		{Sitemap{Exclude: []string{"*-internal"}}, "docs-internal", false},
+		{Sitemap{Include: []string{"*"}, Exclude: []string{"debian"}}, "debian", false},
+	}
+	for _, tt := range tests {
+		if got := tt.sitemap.Advertises(tt.name); got != tt.want {
+			t.Errorf("%+v.Advertises(%q) = %v, want %v", tt.sitemap, tt.name, got, tt.want)
+		}
+	}
+
+	t.Setenv("SERVER_SITEMAP", "true")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected LoadConfig to require a sitemap base URL")
+	}
+}
+
+func TestLoadConfigStatsTTL(t *testing.T) {
+	t.Setenv("MIRROR_NAME", "a")
+	t.Setenv("MIRROR_URL", "http://a/")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Server.StatsTTL != 30 {
+		t.Errorf("Expected a default stats TTL of 30, got %d", cfg.Server.StatsTTL)
+	}
+
+	t.Setenv("SERVER_STATS_TTL", "-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected a negative stats TTL to be rejected")
+	}
+}
+
+func TestLoadConfigMetricsTargetLimit(t *testing.T) {
+	t.Setenv("MIRROR_NAME", "a")
+	t.Setenv("MIRROR_URL", "http://a/")
+	t.Setenv("SERVER_METRICS_TARGETS", "debian-*,ubuntu")
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Server.MetricsTargetLimit != 100 {
+		t.Errorf("Expected a default metrics target limit of 100, got %d", cfg.Server.MetricsTargetLimit)
+	}
+
+	cfg.Server.MetricsTargetLimit = 2
+	for name, want := range map[string]bool{"debian-security": true, "ubuntu": true, "fedora": false} {
+		if got := cfg.Server.OwnMetricsSeries(name, 3); got != want {
+			t.Errorf("OwnMetricsSeries(%q) = %v beyond the limit, want %v", name, got, want)
+		}
+		if !cfg.Server.OwnMetricsSeries(name, 2) {
+			t.Errorf("Expected %q to get its own series within the limit", name)
+		}
+	}
+
+	t.Setenv("SERVER_METRICS_TARGET_LIMIT", "-1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("Expected a negative metrics target limit to be rejected")
+	}
+}
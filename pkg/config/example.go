@@ -0,0 +1,230 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of WriteExample
+const (
+	ExampleYAML = "yaml"
+	ExampleJSON = "json"
+)
+
+// ExampleConfig returns the configuration LoadConfig gives without environment
+// variables, with one target that spells out every setting it inherits from
+// Defaults or defaults to
+func ExampleConfig() *Config {
+	config := newConfig(func(string) string { return "" })
+	config.Server.Breakdown.Extensions = DefaultBreakdownExtensions
+
+	defaults := config.Defaults
+	follow, tolerance := true, int(DefaultMTimeTolerance/time.Second)
+	events := FileEvents{BatchSize: DefaultEventBatchSize, FlushInterval: int(DefaultEventFlushInterval / time.Second),
+		QueueSize: DefaultEventQueueSize}
+	config.Targets = []Target{{
+		Name:                   "example",
+		URL:                    "https://mirror.example.com/pub/",
+		UserAgent:              defaults.UserAgent,
+		RateLimit:              defaults.RateLimit,
+		Retries:                defaults.Retries,
+		MaxDepth:               defaults.MaxDepth,
+		Timeout:                defaults.Timeout,
+		WaitBetweenRequests:    defaults.WaitBetweenRequests,
+		Timestamping:           defaults.Timestamping,
+		NoClobber:              defaults.NoClobber,
+		ContinueDownload:       defaults.ContinueDownload,
+		CheckChanges:           defaults.CheckChanges,
+		ExcludedDirPolicy:      "keep",
+		FilterMode:             "enforce",
+		ContentTypeCheck:       "html",
+		ChurnRelistEvery:       5,
+		FullScanEvery:          20,
+		ListingRefreshEvery:    10,
+		ListingFormat:          "auto",
+		FollowAbsoluteSameHost: &follow,
+		MTimeTolerance:         &tolerance,
+		ParallelChunkMinSize:   "256m",
+		Concurrency:            defaults.Concurrency,
+		TransferWeight:         1,
+		Hidden:                 defaults.Hidden,
+		Layout:                 "in-place",
+		DatedFormat:            "%Y-%m-%d",
+		CrossHostRedirects:     "allow",
+		Storage:                StorageLocal,
+		S3:                     &S3Storage{Region: "us-east-1", PartSize: "16m"},
+		FileEvents:             &events,
+	}}
+	return config
+}
+
+// WriteExample writes ExampleConfig in format, ExampleYAML or ExampleJSON, with
+// every setting present. YAML describes each setting in a comment above it; JSON
+// has no comments and refers editors to the schema of WriteSchema instead.
+func WriteExample(w io.Writer, format string) error {
+	example := reflect.ValueOf(*ExampleConfig())
+	var out strings.Builder
+	switch format {
+	case ExampleYAML:
+		out.WriteString("# http-mirror configuration with every setting at its default.\n")
+		out.WriteString("# Config files are JSON; convert this file, e.g. for Helm values.\n")
+		writeYAMLFields(&out, example, 0, "")
+	case ExampleJSON:
+		out.WriteString("{\n  \"$schema\": \"config.schema.json\",\n")
+		writeJSONFields(&out, example, 1)
+		out.WriteString("}\n")
+	default:
+		return fmt.Errorf("unknown example format %q", format)
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// writeYAMLFields writes the fields of the struct value as a YAML mapping indented
+// by indent spaces, each line starting with prefix, e.g. "# " for commented-out
+// examples
+func writeYAMLFields(out *strings.Builder, value reflect.Value, indent int, prefix string) {
+	lead := prefix + strings.Repeat(" ", indent)
+	previous := ""
+	for _, field := range configFields(value.Type()) {
+		// Fields sharing a comment get it once
+		doc := fieldDoc(value.Type(), field.StructField.Name)
+		if doc != previous {
+			for _, line := range wrapComment(doc, 78-len(lead)) {
+				fmt.Fprintf(out, "%s# %s\n", lead, line)
+			}
+		}
+		previous = doc
+		fmt.Fprintf(out, "%s%s:", lead, field.Name)
+		writeYAMLValue(out, value.FieldByIndex(field.Index), indent, prefix)
+	}
+}
+
+// writeYAMLValue writes value after the key of a mapping at indent and ends the line
+func writeYAMLValue(out *strings.Builder, value reflect.Value, indent int, prefix string) {
+	lead := prefix + strings.Repeat(" ", indent)
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.IsNil() {
+			out.WriteString(" null\n")
+			return
+		}
+		writeYAMLValue(out, value.Elem(), indent, prefix)
+	case reflect.Struct:
+		out.WriteString("\n")
+		writeYAMLFields(out, value, indent+2, prefix)
+	case reflect.Slice:
+		if value.Len() == 0 {
+			out.WriteString(" []\n")
+			// The settings of list entries are shown as a commented-out entry
+			if value.Type().Elem().Kind() == reflect.Struct && prefix == "" {
+				fmt.Fprintf(out, "%s#   -\n", lead)
+				writeYAMLFields(out, reflect.New(value.Type().Elem()).Elem(), 4, lead+"# ")
+			}
+			return
+		}
+		out.WriteString("\n")
+		for i := range value.Len() {
+			item := value.Index(i)
+			if item.Kind() == reflect.Struct {
+				fmt.Fprintf(out, "%s  -\n", lead)
+				writeYAMLFields(out, item, indent+4, prefix)
+				continue
+			}
+			fmt.Fprintf(out, "%s  - %s\n", lead, scalarJSON(item))
+		}
+	default:
+		fmt.Fprintf(out, " %s\n", scalarJSON(value))
+	}
+}
+
+// writeJSONFields writes the fields of the struct value as the members of a JSON
+// object, indented by indent levels
+func writeJSONFields(out *strings.Builder, value reflect.Value, indent int) {
+	fields := configFields(value.Type())
+	for i, field := range fields {
+		fmt.Fprintf(out, "%s%q: ", strings.Repeat("  ", indent), field.Name)
+		writeJSONValue(out, value.FieldByIndex(field.Index), indent)
+		if i < len(fields)-1 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+	}
+}
+
+// writeJSONValue writes value as JSON, continuing lines at indent levels
+func writeJSONValue(out *strings.Builder, value reflect.Value, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.IsNil() {
+			out.WriteString("null")
+			return
+		}
+		writeJSONValue(out, value.Elem(), indent)
+	case reflect.Struct:
+		out.WriteString("{\n")
+		writeJSONFields(out, value, indent+1)
+		out.WriteString(pad + "}")
+	case reflect.Slice:
+		if value.Len() == 0 {
+			out.WriteString("[]")
+			return
+		}
+		out.WriteString("[\n")
+		for i := range value.Len() {
+			out.WriteString(pad + "  ")
+			writeJSONValue(out, value.Index(i), indent+1)
+			if i < value.Len()-1 {
+				out.WriteString(",")
+			}
+			out.WriteString("\n")
+		}
+		out.WriteString(pad + "]")
+	default:
+		out.WriteString(scalarJSON(value))
+	}
+}
+
+// scalarJSON formats a string, number or boolean as JSON, which YAML reads alike
+func scalarJSON(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.String:
+		quoted, _ := json.Marshal(value.String())
+		return string(quoted)
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10)
+	default:
+		return fmt.Sprint(value.Interface())
+	}
+}
+
+// wrapComment breaks text into lines of at most width characters, or longer for
+// single words
+func wrapComment(text string, width int) []string {
+	var lines []string
+	var line strings.Builder
+	for _, word := range strings.Fields(text) {
+		if line.Len() > 0 && line.Len()+1+len(word) > width {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteString(" ")
+		}
+		line.WriteString(word)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
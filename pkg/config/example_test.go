@@ -0,0 +1,69 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExampleConfigLoads(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteExample(&out, ExampleJSON); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed on the example: %v", err)
+	}
+	// Config files cannot tell nil lists from empty ones
+	render := func(c *Config) string {
+		var out strings.Builder
+		writeJSONFields(&out, reflect.ValueOf(*c), 0)
+		return out.String()
+	}
+	if got, want := render(cfg), render(ExampleConfig()); got != want {
+		t.Errorf("Expected the example configuration to load as it is, got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteExampleYAML(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteExample(&out, ExampleYAML); err != nil {
+		t.Fatal(err)
+	}
+	example := out.String()
+
+	for _, want := range []string{
+		"targets:\n  -\n    # Name identifies the target",
+		"\n    name: \"example\"\n",
+		"\n    mtimeTolerance: 2\n",
+		"  hosts: []\n  #   -\n",
+		"\n  #     maxConcurrency: 0\n",
+		"\n  listingMaxAge: 60\n",
+	} {
+		if !strings.Contains(example, want) {
+			t.Errorf("Expected the example to contain %q", want)
+		}
+	}
+	if strings.Count(example, "# ChurnRelistEvery lists") != 1 {
+		t.Error("Expected the comment FullScanEvery shares with ChurnRelistEvery to be written once")
+	}
+	for _, line := range strings.Split(example, "\n") {
+		if len(line) > 80 && strings.Contains(line, "# ") && !strings.Contains(line, ": ") {
+			t.Errorf("Expected comments wrapped at 80 characters, got %q", line)
+		}
+	}
+
+	if err := WriteExample(&out, "toml"); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
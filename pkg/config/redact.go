@@ -0,0 +1,131 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Redaction replaces the values of redacted fields
+const Redaction = "***"
+
+// Source describes where a configuration was loaded from
+type Source struct {
+	// File is the configuration file; empty when the configuration came from the
+	// environment only
+	File string `json:"file,omitempty"`
+	// SHA256 is the hex encoded hash of the file content
+	SHA256 string `json:"sha256,omitempty"`
+	// LoadedAt is when the configuration was loaded
+	LoadedAt time.Time `json:"loadedAt"`
+}
+
+// Effective is the resolved configuration of a running process as reported by the
+// server API and the updater, with secrets redacted
+type Effective struct {
+	Source Source  `json:"source"`
+	Config *Config `json:"config"`
+}
+
+// Effective returns the configuration with secrets redacted, together with its source
+func (c *Config) Effective() (*Effective, error) {
+	redacted, err := c.Redacted()
+	if err != nil {
+		return nil, err
+	}
+	return &Effective{Source: c.Source, Config: redacted}, nil
+}
+
+// Redacted returns a copy of the configuration with the values of fields tagged
+// `redact:"secret"` replaced by Redaction and the passwords of URLs in fields
+// tagged `redact:"url"` masked. The configuration itself is left unchanged.
+func (c *Config) Redacted() (*Config, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy configuration: %w", err)
+	}
+	redacted := &Config{}
+	if err := json.Unmarshal(data, redacted); err != nil {
+		return nil, fmt.Errorf("failed to copy configuration: %w", err)
+	}
+	redact(reflect.ValueOf(redacted).Elem())
+	return redacted, nil
+}
+
+// redact masks the tagged fields below v in place
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			redact(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			switch field.Tag.Get("redact") {
+			case "secret":
+				redactValue(v.Field(i), func(string) string { return Redaction })
+			case "url":
+				redactValue(v.Field(i), RedactURL)
+			default:
+				redact(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			redact(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			redact(value)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
+
+// redactValue applies mask to the non-empty strings of a tagged field. Fields of
+// other types are cleared, so that a secret is never shown by mistake.
+func redactValue(v reflect.Value, mask func(string) string) {
+	switch {
+	case v.Kind() == reflect.String:
+		if v.String() != "" {
+			v.SetString(mask(v.String()))
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		for i := 0; i < v.Len(); i++ {
+			redactValue(v.Index(i), mask)
+		}
+	case v.Kind() == reflect.Pointer && !v.IsNil():
+		redactValue(v.Elem(), mask)
+	default:
+		v.SetZero()
+	}
+}
+
+// RedactURL masks the password of a URL. Strings that do not parse as a URL are
+// replaced entirely, as they might contain credentials in any form.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Redaction
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	if u.Scheme == "" {
+		return Redaction
+	}
+	// Userinfo would percent-encode the mask, so it is added to the serialized URL
+	username := url.User(u.User.Username()).String()
+	u.User = nil
+	prefix := u.Scheme + "://"
+	return prefix + username + ":" + Redaction + "@" + strings.TrimPrefix(u.String(), prefix)
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// configSource is this package's struct definitions, whose doc comments describe
+// the settings in the schema and example configuration
+//
+//go:embed config.go
+var configSource []byte
+
+var (
+	fieldDocsOnce sync.Once
+	fieldDocs     map[string]string
+)
+
+// fieldDoc returns the doc comment of the field of a configuration struct, as a
+// single line. Fields declared right below a documented field without a comment of
+// their own share its comment, like ChurnRelistEvery and FullScanEvery.
+func fieldDoc(structType reflect.Type, field string) string {
+	fieldDocsOnce.Do(func() {
+		fieldDocs = make(map[string]string)
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "config.go", configSource, parser.ParseComments)
+		if err != nil {
+			return
+		}
+		ast.Inspect(file, func(node ast.Node) bool {
+			spec, ok := node.(*ast.TypeSpec)
+			if !ok {
+				return true
+			}
+			fields, ok := spec.Type.(*ast.StructType)
+			if !ok {
+				return false
+			}
+			shared, lastLine := "", 0
+			for _, f := range fields.Fields.List {
+				doc := strings.Join(strings.Fields(f.Doc.Text()), " ")
+				if doc == "" && fset.Position(f.Pos()).Line == lastLine+1 {
+					doc = shared
+				}
+				shared, lastLine = doc, fset.Position(f.End()).Line
+				for _, name := range f.Names {
+					fieldDocs[spec.Name.Name+"."+name.Name] = doc
+				}
+			}
+			return false
+		})
+	})
+	return fieldDocs[structType.Name()+"."+field]
+}
+
+// configField is a field of a configuration struct as it appears in config files
+type configField struct {
+	reflect.StructField
+	// Name is the JSON name of the field
+	Name      string
+	OmitEmpty bool
+}
+
+// configFields returns the fields of the struct type t that config files set, in
+// declaration order
+func configFields(t reflect.Type) []configField {
+	var fields []configField
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, configField{StructField: field, Name: name, OmitEmpty: options == "omitempty"})
+	}
+	return fields
+}
+
+// Schema returns a JSON Schema of config files. It is derived from the Go structs:
+// property names from their JSON tags, descriptions from their doc comments and
+// defaults from ExampleConfig. Fields without omitempty are required in the
+// objects of lists and optional objects, such as the name and URL of targets.
+func Schema() map[string]any {
+	schema := schemaOf(reflect.TypeOf(Config{}), reflect.ValueOf(*ExampleConfig()), false)
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "http-mirror configuration"
+	// Config files may point editors at the schema
+	schema["properties"].(map[string]any)["$schema"] = map[string]any{"type": "string"}
+	return schema
+}
+
+// WriteSchema writes the JSON Schema of config files as indented JSON
+func WriteSchema(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(Schema())
+}
+
+// schemaOf returns the schema of values of type t. value, if valid, is the example
+// value of the type. Fields of nested structs are required if nested is set.
+func schemaOf(t reflect.Type, value reflect.Value, nested bool) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		if value.IsValid() && !value.IsNil() {
+			value = value.Elem()
+		} else {
+			value = reflect.Value{}
+		}
+		schema := schemaOf(t.Elem(), value, true)
+		schema["type"] = []any{schema["type"], "null"}
+		return schema
+	case reflect.Struct:
+		properties := make(map[string]any)
+		var required []string
+		for _, field := range configFields(t) {
+			var fieldValue reflect.Value
+			if value.IsValid() {
+				fieldValue = value.FieldByIndex(field.Index)
+			}
+			property := schemaOf(field.Type, fieldValue, false)
+			if doc := fieldDoc(t, field.StructField.Name); doc != "" {
+				property["description"] = doc
+			}
+			if nested && !field.OmitEmpty {
+				required = append(required, field.Name)
+				if fieldValue.IsValid() && !fieldValue.IsZero() {
+					property["examples"] = []any{property["default"]}
+				}
+				delete(property, "default")
+			}
+			properties[field.Name] = property
+		}
+		schema := map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	case reflect.Slice:
+		// The first entry of a list of objects is the example of its settings
+		var item reflect.Value
+		if value.IsValid() && value.Len() > 0 && t.Elem().Kind() == reflect.Struct {
+			item = value.Index(0)
+		}
+		schema := map[string]any{"type": "array", "items": schemaOf(t.Elem(), item, true)}
+		if value.IsValid() && t.Elem().Kind() != reflect.Struct {
+			schema["default"] = jsonValue(value)
+		}
+		return schema
+	}
+
+	schema := map[string]any{"type": jsonType(t.Kind())}
+	if value.IsValid() {
+		schema["default"] = value.Interface()
+	}
+	return schema
+}
+
+// jsonType returns the JSON Schema type of values of kind
+func jsonType(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// jsonValue returns the value of a list of scalars as it is written to config
+// files, an empty list rather than null for a nil slice
+func jsonValue(value reflect.Value) []any {
+	values := make([]any, value.Len())
+	for i := range values {
+		values[i] = value.Index(i).Interface()
+	}
+	return values
+}
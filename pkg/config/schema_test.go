@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// checkSchema compares the object schema with the fields of the struct type t,
+// and requires a description for each
+func checkSchema(t *testing.T, schema map[string]any, typ reflect.Type, at string) {
+	t.Helper()
+	for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice {
+		if typ.Kind() == reflect.Slice {
+			schema = schema["items"].(map[string]any)
+		}
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return
+	}
+
+	properties := schema["properties"].(map[string]any)
+	var want, got []string
+	for _, field := range configFields(typ) {
+		want = append(want, field.Name)
+		property, ok := properties[field.Name].(map[string]any)
+		if !ok {
+			continue
+		}
+		if property["description"] == nil || property["description"] == "" {
+			t.Errorf("Expected a description of %s.%s; document %s.%s", at, field.Name, typ.Name(), field.StructField.Name)
+		}
+		checkSchema(t, property, field.Type, at+"."+field.Name)
+	}
+	for name := range properties {
+		if name != "$schema" {
+			got = append(got, name)
+		}
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if !slices.Equal(want, got) {
+		t.Errorf("Expected the properties of %s to be %v, got %v", at, want, got)
+	}
+}
+
+func TestSchemaDescribesEveryField(t *testing.T) {
+	schema := Schema()
+	checkSchema(t, schema, reflect.TypeOf(Config{}), "config")
+
+	target := schema["properties"].(map[string]any)["targets"].(map[string]any)["items"].(map[string]any)
+	if required := target["required"]; !reflect.DeepEqual(required, []string{"name", "url"}) {
+		t.Errorf("Expected the name and URL of targets required, got %v", required)
+	}
+	tolerance := target["properties"].(map[string]any)["mtimeTolerance"].(map[string]any)
+	if tolerance["default"] != 2 || !reflect.DeepEqual(tolerance["type"], []any{"integer", "null"}) {
+		t.Errorf("Expected an optional integer defaulting to 2, got %v", tolerance)
+	}
+	if doc := fieldDoc(reflect.TypeOf(Target{}), "FullScanEvery"); !strings.HasPrefix(doc, "ChurnRelistEvery lists") {
+		t.Errorf("Expected FullScanEvery to share the comment above it, got %q", doc)
+	}
+}
+
+// validate checks the decoded JSON value against the subset of JSON Schema that
+// Schema uses
+func validate(schema map[string]any, value any, at string) error {
+	types := []any{schema["type"]}
+	if list, ok := schema["type"].([]any); ok {
+		types = list
+	}
+	kind := map[bool]string{true: "null"}[value == nil]
+	switch v := value.(type) {
+	case bool:
+		kind = "boolean"
+	case float64:
+		kind = "number"
+		if v == float64(int64(v)) {
+			kind = "integer"
+		}
+	case string:
+		kind = "string"
+	case []any:
+		kind = "array"
+		for i, item := range v {
+			if err := validate(schema["items"].(map[string]any), item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		kind = "object"
+		properties := schema["properties"].(map[string]any)
+		for name, member := range v {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: unknown property %q", at, name)
+			}
+			if err := validate(property, member, at+"."+name); err != nil {
+				return err
+			}
+		}
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := v[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing required property %q", at, name)
+			}
+		}
+	}
+	if !slices.Contains(types, any(kind)) && !(kind == "integer" && slices.Contains(types, any("number"))) {
+		return fmt.Errorf("%s: expected %v, got %s", at, types, kind)
+	}
+	return nil
+}
+
+func TestExampleMatchesSchema(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteExample(&out, ExampleJSON); err != nil {
+		t.Fatal(err)
+	}
+	var example any
+	if err := json.Unmarshal(out.Bytes(), &example); err != nil {
+		t.Fatalf("Example is no valid JSON: %v", err)
+	}
+
+	// The schema is written as JSON, so it is checked in that form
+	out.Reset()
+	if err := WriteSchema(&out); err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(out.Bytes(), &schema); err != nil {
+		t.Fatalf("Schema is no valid JSON: %v", err)
+	}
+	if err := validate(schema, example, "config"); err != nil {
+		t.Errorf("Example does not match the schema: %v", err)
+	}
+
+	if err := validate(schema, map[string]any{"targets": []any{map[string]any{"name": "a", "urll": "http://a/"}}}, "config"); err == nil {
+		t.Error("Expected a misspelled setting to be rejected")
+	}
+}
@@ -0,0 +1,159 @@
+package files
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// precondition is the outcome of evaluating conditional request headers
+type precondition int
+
+const (
+	// preconditionProceed means the request should be served normally
+	preconditionProceed precondition = iota
+	// preconditionNotModified means a 304 Not Modified response should be sent
+	preconditionNotModified
+	// preconditionFailed means a 412 Precondition Failed response should be sent
+	preconditionFailed
+)
+
+// conditionalHeaders are the request headers evaluated by checkPreconditions
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+
+// validators describes the selected representation of a resource
+type validators struct {
+	// ETag is the quoted entity tag, optionally prefixed with W/
+	ETag         string
+	LastModified time.Time
+}
+
+// fileETag returns a strong entity tag for a file. Each content encoding of the same
+// file is a different representation and gets its own tag, so a cached gzip variant
+// is never validated against the identity file or vice versa.
+func fileETag(stat os.FileInfo, contentEncoding string) string {
+	tag := fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size())
+	if contentEncoding != "" && contentEncoding != "identity" {
+		tag += "-" + contentEncoding
+	}
+	return `"` + tag + `"`
+}
+
+// checkPreconditions evaluates the conditional headers of r against v in the order
+// defined by RFC 9110 section 13.2.2:
+//
+//  1. If-Match (strong comparison), otherwise If-Unmodified-Since: 412 on failure
+//  2. If-None-Match (weak comparison), otherwise If-Modified-Since for GET and HEAD:
+//     304 for GET and HEAD, 412 for other methods
+//  3. If-Range for GET requests with a Range header: the range is ignored and the
+//     full representation is sent unless the validator matches strongly
+//
+// It reports the outcome and whether the Range header must be ignored.
+func checkPreconditions(r *http.Request, v validators) (result precondition, ignoreRange bool) {
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, v.ETag, true) {
+			return preconditionFailed, false
+		}
+	} else if since, ok := parseHTTPDate(r.Header.Get("If-Unmodified-Since")); ok && !v.LastModified.IsZero() {
+		if modifiedAfter(v.LastModified, since) {
+			return preconditionFailed, false
+		}
+	}
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, v.ETag, false) {
+			if safe {
+				return preconditionNotModified, false
+			}
+			return preconditionFailed, false
+		}
+	} else if since, ok := parseHTTPDate(r.Header.Get("If-Modified-Since")); ok && safe && !v.LastModified.IsZero() {
+		if !modifiedAfter(v.LastModified, since) {
+			return preconditionNotModified, false
+		}
+	}
+
+	if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+		if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, v) {
+			return preconditionProceed, true
+		}
+	}
+
+	return preconditionProceed, false
+}
+
+// ifRangeMatches evaluates an If-Range value, which is either an entity tag or a date
+func ifRangeMatches(ifRange string, v validators) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagStrongMatch(ifRange, v.ETag)
+	}
+
+	// A date only validates if it exactly equals Last-Modified
+	date, ok := parseHTTPDate(ifRange)
+	return ok && !v.LastModified.IsZero() && v.LastModified.Truncate(time.Second).Equal(date)
+}
+
+// etagListMatches reports whether a comma-separated If-Match or If-None-Match value
+// matches current. "*" matches any existing representation.
+func etagListMatches(list, current string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return current != ""
+	}
+
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "" {
+			continue
+		}
+		if strong && etagStrongMatch(candidate, current) {
+			return true
+		}
+		if !strong && etagWeakMatch(candidate, current) {
+			return true
+		}
+	}
+	return false
+}
+
+// etagStrongMatch compares two entity tags; both must be strong and identical
+func etagStrongMatch(a, b string) bool {
+	return a != "" && a == b && !strings.HasPrefix(a, "W/")
+}
+
+// etagWeakMatch compares two entity tags ignoring the weakness indicator
+func etagWeakMatch(a, b string) bool {
+	a, b = strings.TrimPrefix(a, "W/"), strings.TrimPrefix(b, "W/")
+	return a != "" && a == b
+}
+
+// modifiedAfter reports whether modTime is later than since at one-second precision,
+// the resolution of HTTP dates
+func modifiedAfter(modTime, since time.Time) bool {
+	return modTime.Truncate(time.Second).After(since)
+}
+
+// parseHTTPDate parses an HTTP date header value; invalid dates are ignored per RFC 9110
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// writeNotModified sends a 304 keeping only the headers a 304 may carry
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+}
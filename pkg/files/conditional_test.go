@@ -0,0 +1,210 @@
+package files
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	modTime := time.Date(2024, 6, 1, 12, 0, 0, 500_000_000, time.UTC)
+	v := validators{ETag: `"abc"`, LastModified: modTime}
+
+	lastModified := modTime.Format(http.TimeFormat)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	after := modTime.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name        string
+		method      string
+		headers     map[string]string
+		result      precondition
+		ignoreRange bool
+	}{
+		{"no conditions", "GET", nil, preconditionProceed, false},
+
+		// If-Match uses strong comparison
+		{"If-Match same", "GET", map[string]string{"If-Match": `"abc"`}, preconditionProceed, false},
+		{"If-Match list", "GET", map[string]string{"If-Match": `"x", "abc"`}, preconditionProceed, false},
+		{"If-Match star", "GET", map[string]string{"If-Match": `*`}, preconditionProceed, false},
+		{"If-Match other", "GET", map[string]string{"If-Match": `"other"`}, preconditionFailed, false},
+		{"If-Match weak never matches", "GET", map[string]string{"If-Match": `W/"abc"`}, preconditionFailed, false},
+		{"If-Match fails for PUT", "PUT", map[string]string{"If-Match": `"other"`}, preconditionFailed, false},
+
+		// If-Unmodified-Since only applies without If-Match
+		{"IUS at Last-Modified", "GET", map[string]string{"If-Unmodified-Since": lastModified}, preconditionProceed, false},
+		{"IUS after", "GET", map[string]string{"If-Unmodified-Since": after}, preconditionProceed, false},
+		{"IUS before", "GET", map[string]string{"If-Unmodified-Since": before}, preconditionFailed, false},
+		{"IUS invalid date ignored", "GET", map[string]string{"If-Unmodified-Since": "yesterday"}, preconditionProceed, false},
+		{"If-Match wins over failing IUS", "GET", map[string]string{"If-Match": `"abc"`, "If-Unmodified-Since": before}, preconditionProceed, false},
+
+		// If-None-Match uses weak comparison
+		{"INM same", "GET", map[string]string{"If-None-Match": `"abc"`}, preconditionNotModified, false},
+		{"INM weak same", "GET", map[string]string{"If-None-Match": `W/"abc"`}, preconditionNotModified, false},
+		{"INM list", "GET", map[string]string{"If-None-Match": `"x", W/"abc"`}, preconditionNotModified, false},
+		{"INM star", "GET", map[string]string{"If-None-Match": `*`}, preconditionNotModified, false},
+		{"INM other", "GET", map[string]string{"If-None-Match": `"other"`}, preconditionProceed, false},
+		{"INM HEAD", "HEAD", map[string]string{"If-None-Match": `"abc"`}, preconditionNotModified, false},
+		{"INM unsafe method fails", "POST", map[string]string{"If-None-Match": `"abc"`}, preconditionFailed, false},
+
+		// If-Modified-Since only applies without If-None-Match and for GET/HEAD
+		{"IMS at Last-Modified", "GET", map[string]string{"If-Modified-Since": lastModified}, preconditionNotModified, false},
+		{"IMS after", "GET", map[string]string{"If-Modified-Since": after}, preconditionNotModified, false},
+		{"IMS before", "GET", map[string]string{"If-Modified-Since": before}, preconditionProceed, false},
+		{"IMS invalid date ignored", "GET", map[string]string{"If-Modified-Since": "garbage"}, preconditionProceed, false},
+		{"IMS ignored for POST", "POST", map[string]string{"If-Modified-Since": after}, preconditionProceed, false},
+		{"IMS RFC 850 date", "GET", map[string]string{"If-Modified-Since": modTime.Format(time.RFC850)}, preconditionNotModified, false},
+		{"INM mismatch wins over matching IMS", "GET", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": after}, preconditionProceed, false},
+		{"INM match wins over stale IMS", "GET", map[string]string{"If-None-Match": `"abc"`, "If-Modified-Since": before}, preconditionNotModified, false},
+
+		// Failing If-Match takes precedence over If-None-Match
+		{"If-Match fails before INM", "GET", map[string]string{"If-Match": `"other"`, "If-None-Match": `"abc"`}, preconditionFailed, false},
+		{"IUS fails before IMS", "GET", map[string]string{"If-Unmodified-Since": before, "If-Modified-Since": after}, preconditionFailed, false},
+
+		// If-Range only matters for GET with Range
+		{"If-Range ETag matches", "GET", map[string]string{"Range": "bytes=0-1", "If-Range": `"abc"`}, preconditionProceed, false},
+		{"If-Range ETag differs", "GET", map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`}, preconditionProceed, true},
+		{"If-Range weak ETag", "GET", map[string]string{"Range": "bytes=0-1", "If-Range": `W/"abc"`}, preconditionProceed, true},
+		{"If-Range exact date", "GET", map[string]string{"Range": "bytes=0-1", "If-Range": lastModified}, preconditionProceed, false},
+		{"If-Range later date", "GET", map[string]string{"Range": "bytes=0-1", "If-Range": after}, preconditionProceed, true},
+		{"If-Range invalid", "GET", map[string]string{"Range": "bytes=0-1", "If-Range": "nonsense"}, preconditionProceed, true},
+		{"If-Range without Range", "GET", map[string]string{"If-Range": `"other"`}, preconditionProceed, false},
+		{"If-Range on HEAD", "HEAD", map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`}, preconditionProceed, false},
+		{"Range without If-Range", "GET", map[string]string{"Range": "bytes=0-1"}, preconditionProceed, false},
+		{"INM match before If-Range", "GET", map[string]string{"If-None-Match": `"abc"`, "Range": "bytes=0-1", "If-Range": `"other"`}, preconditionNotModified, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/file", nil)
+			for k, val := range tt.headers {
+				req.Header.Set(k, val)
+			}
+
+			result, ignoreRange := checkPreconditions(req, v)
+			if result != tt.result {
+				t.Errorf("Expected result %d, got %d", tt.result, result)
+			}
+			if ignoreRange != tt.ignoreRange {
+				t.Errorf("Expected ignoreRange %v, got %v", tt.ignoreRange, ignoreRange)
+			}
+		})
+	}
+}
+
+func TestCheckPreconditionsWeakETag(t *testing.T) {
+	v := validators{ETag: `W/"abc"`}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		result  precondition
+	}{
+		{"If-Match never matches a weak tag", map[string]string{"If-Match": `W/"abc"`}, preconditionFailed},
+		{"If-Match star matches", map[string]string{"If-Match": `*`}, preconditionProceed},
+		{"INM strong against weak", map[string]string{"If-None-Match": `"abc"`}, preconditionNotModified},
+		{"INM weak against weak", map[string]string{"If-None-Match": `W/"abc"`}, preconditionNotModified},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/file", nil)
+			for k, val := range tt.headers {
+				req.Header.Set(k, val)
+			}
+			if result, _ := checkPreconditions(req, v); result != tt.result {
+				t.Errorf("Expected result %d, got %d", tt.result, result)
+			}
+		})
+	}
+}
+
+func TestFileETagPerEncoding(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity := fileETag(stat, "")
+	if identity != fileETag(stat, "identity") {
+		t.Error("Expected identity encoding to share the plain tag")
+	}
+
+	gzip := fileETag(stat, "gzip")
+	if gzip == identity {
+		t.Error("Expected each content encoding to have a distinct tag")
+	}
+
+	// A cached gzip variant must not validate the identity representation
+	req := httptest.NewRequest("GET", "/f.txt", nil)
+	req.Header.Set("If-None-Match", gzip)
+	if result, _ := checkPreconditions(req, validators{ETag: identity}); result != preconditionProceed {
+		t.Errorf("Expected gzip tag not to match identity representation, got %d", result)
+	}
+}
+
+func TestServeFileConditionalRequests(t *testing.T) {
+	tempDir := t.TempDir()
+	content := "0123456789"
+	if err := os.WriteFile(filepath.Join(tempDir, "file.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/file.txt", nil))
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("Expected an ETag header")
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"matching INM", map[string]string{"If-None-Match": etag}, http.StatusNotModified, ""},
+		{"failing If-Match", map[string]string{"If-Match": `"stale"`}, http.StatusPreconditionFailed, ""},
+		{"range with matching If-Range", map[string]string{"Range": "bytes=0-3", "If-Range": etag}, http.StatusPartialContent, "0123"},
+		{"range with stale If-Range", map[string]string{"Range": "bytes=0-3", "If-Range": `"stale"`}, http.StatusOK, content},
+		{"plain range", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/file.txt", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("Expected body %q, got %q", tt.body, w.Body.String())
+			}
+			if tt.status == http.StatusNotModified {
+				if w.Header().Get("ETag") != etag {
+					t.Error("Expected 304 to carry the ETag")
+				}
+				if w.Header().Get("Content-Type") != "" {
+					t.Error("Expected 304 without Content-Type")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// gzipSuffix is the extension of the compressed variants Server.Decompress serves
+// uncompressed
+const gzipSuffix = ".gz"
+
+// defaultDecompressCacheSize bounds the decompressed files kept in memory when
+// Server.Decompress.CacheSize is unset or invalid
+const defaultDecompressCacheSize = 16 * 1024 * 1024
+
+// decompressedEntry is a decompressed file kept in memory. It is valid while the
+// modification time and size of its gzip file are unchanged.
+type decompressedEntry struct {
+	gzPath  string
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// decompressCache keeps small decompressed files in memory, least recently used
+// ones evicted first, so that indexes polled by many clients are not decompressed
+// for every request
+type decompressCache struct {
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	used    int64
+}
+
+func newDecompressCache() *decompressCache {
+	return &decompressCache{lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the decompressed content of the gzip file at gzPath with stat, if cached
+func (c *decompressCache) get(gzPath string, stat os.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[gzPath]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*decompressedEntry)
+	if !entry.modTime.Equal(stat.ModTime()) || entry.size != stat.Size() {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.data, true
+}
+
+// put caches data as the content of the gzip file at gzPath with stat and evicts
+// entries until the cache fits limit
+func (c *decompressCache) put(gzPath string, stat os.FileInfo, data []byte, limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[gzPath]; ok {
+		c.used -= int64(len(elem.Value.(*decompressedEntry).data))
+		c.lru.Remove(elem)
+	}
+	c.entries[gzPath] = c.lru.PushFront(&decompressedEntry{gzPath: gzPath, modTime: stat.ModTime(), size: stat.Size(), data: data})
+	c.used += int64(len(data))
+	for c.used > limit && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		entry := elem.Value.(*decompressedEntry)
+		c.lru.Remove(elem)
+		delete(c.entries, entry.gzPath)
+		c.used -= int64(len(entry.data))
+	}
+}
+
+// decompressCacheLimit returns the size of the decompression cache configured in cfg
+func decompressCacheLimit(cfg *config.Config) int64 {
+	if cfg == nil {
+		return defaultDecompressCacheSize
+	}
+	if limit := httpPkg.ParseSize(cfg.Server.Decompress.CacheSize); limit > 0 {
+		return limit
+	}
+	return defaultDecompressCacheSize
+}
+
+// decompressible reports whether urlPath, which does not exist, may be served by
+// decompressing its gzip variant
+func (h *Handler) decompressible(urlPath string) bool {
+	cfg := h.getConfig()
+	return cfg != nil && cfg.Server.Decompress.Matches(strings.Trim(filepath.ToSlash(urlPath), "/"))
+}
+
+// decompressedETag derives the ETag of the decompressed variant of a gzip file,
+// which must never match the ETag of the gzip file itself
+func decompressedETag(gzStat os.FileInfo) string {
+	return strings.TrimSuffix(fileETag(gzStat, ""), `"`) + `-gunzip"`
+}
+
+// serveDecompressed answers a request for urlPath, which does not exist, with the
+// decompressed content of urlPath.gz if Server.Decompress covers it. Files up to an
+// eighth of the cache size are kept in memory and served with ranges; larger ones
+// are streamed without a Content-Length. It reports whether the request was handled.
+func (h *Handler) serveDecompressed(w http.ResponseWriter, r *http.Request, urlPath, filePath string) bool {
+	if !h.decompressible(urlPath) {
+		return false
+	}
+	gzPath := filePath + gzipSuffix
+	file, err := os.Open(gzPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		return false
+	}
+
+	name := filepath.Base(filePath)
+	w.Header().Set("Content-Type", getContentType(path.Ext(name)))
+	h.setSourceHeader(w, gzPath)
+	v := validators{ETag: decompressedETag(stat), LastModified: stat.ModTime()}
+	w.Header().Set("ETag", v.ETag)
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	if r.URL.Query().Has("sig") {
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+
+	result, ignoreRange := checkPreconditions(r, v)
+	switch result {
+	case preconditionNotModified:
+		writeNotModified(w)
+		return true
+	case preconditionFailed:
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return true
+	}
+	r = r.Clone(r.Context())
+	for _, header := range conditionalHeaders {
+		r.Header.Del(header)
+	}
+	if ignoreRange {
+		r.Header.Del("Range")
+	}
+
+	limit := decompressCacheLimit(h.getConfig())
+	if data, ok := h.decompressed.get(gzPath, stat); ok {
+		http.ServeContent(w, r, name, stat.ModTime(), bytes.NewReader(data))
+		return true
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		h.serverError(w, err, "Failed to decompress file")
+		return true
+	}
+	defer reader.Close()
+
+	// Small files are read completely, cached and served like any other file
+	head, err := io.ReadAll(io.LimitReader(reader, limit/8+1))
+	if err != nil {
+		h.serverError(w, err, "Failed to decompress file")
+		return true
+	}
+	if int64(len(head)) <= limit/8 {
+		h.decompressed.put(gzPath, stat, head, limit)
+		http.ServeContent(w, r, name, stat.ModTime(), bytes.NewReader(head))
+		return true
+	}
+
+	// Larger files are streamed; their size is unknown until the end
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return true
+	}
+	if _, err := w.Write(head); err != nil {
+		return true
+	}
+	if _, err := io.Copy(w, reader); err != nil && r.Context().Err() == nil {
+		// A truncated response must not look complete to the client
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
+
+// decompressedEntries returns listing entries for the uncompressed variants of the
+// gzip files among files in the directory at urlPath that Server.Decompress covers
+// and that do not exist themselves
+func (h *Handler) decompressedEntries(urlPath string, files []FileInfo) []FileInfo {
+	cfg := h.getConfig()
+	if cfg == nil || !cfg.Server.Decompress.ShowInListings {
+		return nil
+	}
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		names[file.Name] = true
+	}
+	var entries []FileInfo
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name, gzipSuffix)
+		if !ok || file.IsDir || name == "" || names[name] || !h.decompressible(filepath.Join(urlPath, name)) {
+			continue
+		}
+		entries = append(entries, FileInfo{
+			Name:         name,
+			Path:         path.Join(filepath.ToSlash(urlPath), name),
+			ModTime:      file.ModTime,
+			Decompressed: true,
+		})
+	}
+	return entries
+}
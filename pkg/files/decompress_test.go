@@ -0,0 +1,155 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// writeGzip writes content gzip-compressed to root/rel
+func writeGzip(t *testing.T, root, rel, content string) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(content))
+	zw.Close()
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDecompressHandler serves a tree with Packages.gz indexes, decompressing those
+// below debian/dists
+func newDecompressHandler(t *testing.T, decompress config.Decompress) (*Handler, string) {
+	t.Helper()
+	root := t.TempDir()
+	writeGzip(t, root, "debian/dists/stable/Packages.gz", "Package: foo\n")
+	writeGzip(t, root, "debian/dists/stable/Release.gz", "not covered\n")
+	writeGzip(t, root, "other/Packages.gz", "Package: bar\n")
+	decompress.Paths = []string{"debian/dists/*/Packages", "other/Packages"}
+	cfg := &config.Config{
+		Server:  config.Server{Decompress: decompress},
+		Targets: []config.Target{{Name: "debian"}, {Name: "other", Protected: true}},
+	}
+	handler, err := NewHandler(root, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler, root
+}
+
+func TestServeDecompressed(t *testing.T) {
+	handler, root := newDecompressHandler(t, config.Decompress{})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debian/dists/stable/Packages", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "Package: foo\n" {
+		t.Fatalf("Expected the decompressed index, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "13" || w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Unexpected headers %v", w.Header())
+	}
+	etag := w.Header().Get("ETag")
+
+	gz := httptest.NewRecorder()
+	handler.ServeHTTP(gz, httptest.NewRequest("GET", "/debian/dists/stable/Packages.gz", nil))
+	if gz.Code != http.StatusOK || etag == "" || gz.Header().Get("ETag") == etag {
+		t.Errorf("Expected the gzip file with another ETag than %s, got %d %s", etag, gz.Code, gz.Header().Get("ETag"))
+	}
+
+	// Cached results are revalidated and served with ranges
+	req := httptest.NewRequest("GET", "/debian/dists/stable/Packages", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", w.Code)
+	}
+	req = httptest.NewRequest("GET", "/debian/dists/stable/Packages", nil)
+	req.Header.Set("Range", "bytes=0-6")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "Package" {
+		t.Errorf("Expected a range of the index, got %d %q", w.Code, w.Body.String())
+	}
+
+	// A changed gzip file replaces the cached result
+	writeGzip(t, root, "debian/dists/stable/Packages.gz", "Package: foo\nPackage: baz\n")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(root, "debian/dists/stable/Packages.gz"), future, future)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debian/dists/stable/Packages", nil))
+	if w.Body.String() != "Package: foo\nPackage: baz\n" || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected the new index, got %q", w.Body.String())
+	}
+
+	for path, code := range map[string]int{
+		"/debian/dists/stable/Release": http.StatusNotFound,
+		"/debian/dists/stable/Missing": http.StatusNotFound,
+		"/other/Packages":              http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, w.Code)
+		}
+	}
+}
+
+func TestServeDecompressedStreamsLargeFiles(t *testing.T) {
+	// An eighth of the cache is a single byte, so every index is streamed
+	handler, _ := newDecompressHandler(t, config.Decompress{CacheSize: "8"})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debian/dists/stable/Packages", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "Package: foo\n" {
+		t.Fatalf("Expected the decompressed index, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Length") != "" || w.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("Expected a streamed response without ranges, got %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("HEAD", "/debian/dists/stable/Packages", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Expected headers only, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestListingShowsDecompressed(t *testing.T) {
+	for _, show := range []bool{false, true} {
+		handler, root := newDecompressHandler(t, config.Decompress{ShowInListings: show})
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/debian/dists/stable/", nil))
+		body := w.Body.String()
+		if got := strings.Contains(body, `href="/debian/dists/stable/Packages"`); got != show {
+			t.Errorf("ShowInListings %t: expected the virtual entry listed %t, got %s", show, show, body)
+		}
+		if strings.Contains(body, `href="/debian/dists/stable/Release"`) {
+			t.Error("Expected no entry for gzip files outside the paths")
+		}
+
+		// A mirrored uncompressed file is listed once, as itself
+		if err := os.WriteFile(filepath.Join(root, "debian/dists/stable/Packages"), []byte("real"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/debian/dists/stable/", nil))
+		if n := strings.Count(w.Body.String(), `href="/debian/dists/stable/Packages"`); n != 1 || strings.Contains(w.Body.String(), ">gunzip<") {
+			t.Errorf("Expected only the mirrored file, got %d entries", n)
+		}
+	}
+}
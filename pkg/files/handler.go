@@ -1,50 +1,92 @@
 package files
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
 )
 
 // FileInfo represents a file or directory
 type FileInfo struct {
-	Name    string
+	Name string
+	// Path is the slash-separated path below the data root, and URL the escaped
+	// link to it, with a trailing slash for directories
 	Path    string
+	URL     string
 	IsDir   bool
 	Size    int64
 	ModTime time.Time
+	// Thumbnail is the URL of an image preview, empty if there is none
+	Thumbnail string
+	// Preview is the URL of a text preview page, empty if there is none
+	Preview string
+	// Info is the URL of the file's detail page, empty if there is none
+	Info string
+	// Latest marks the newest version in a directory of Server.LatestLinks
+	Latest bool
+	// Decompressed marks the uncompressed variant of a gzip file served by
+	// Server.Decompress; its size is unknown
+	Decompressed bool
 }
 
 // DirectoryListing represents a directory with its files
 type DirectoryListing struct {
-	Path        string
-	Parent      string
+	Path   string
+	Parent string
+	// ParentURL is the escaped link to Parent
+	ParentURL   string
 	Files       []FileInfo
 	Timestamp   time.Time
 	OriginalURL string
 	TargetName  string
+	// SyncingSince is when the running sync of the target started, nil if the
+	// target is not being synced
+	SyncingSince *time.Time
 }
 
 // Handler handles file serving and directory listing
 type Handler struct {
 	rootPath string
 	template *template.Template
+	preview  *template.Template
+	info     *template.Template
+	thumbs   *Thumbnailer // nil when thumbnails are disabled
+	sources  *sourceIndex
+	storage  *storageState
+	latest   *latestCache
+	// decompressed keeps small files decompressed for Server.Decompress
+	decompressed *decompressCache
+	// pulls coalesces the fetches of missing files for Target.PullThrough
+	pulls *pullThrough
+
+	mu       sync.RWMutex
 	config   *config.Config
+	signer   *Signer
+	location *time.Location
 }
 
-// NewHandler creates a new file handler
+// NewHandler creates a new file handler. A root path that cannot be created or
+// read, e.g. because its volume is away, is not an error: requests are answered
+// with 503 until it becomes readable.
 func NewHandler(rootPath string, cfg *config.Config) (*Handler, error) {
 	// Ensure root path exists
-	if err := os.MkdirAll(rootPath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create root directory: %w", err)
-	}
+	os.MkdirAll(rootPath, 0755)
+	storage := newStorageState(rootPath)
 
 	// Parse the directory listing template with custom functions
 	tmpl, err := template.New("directory").Funcs(template.FuncMap{
@@ -54,17 +96,219 @@ func NewHandler(rootPath string, cfg *config.Config) (*Handler, error) {
 		return nil, fmt.Errorf("failed to parse template: %w", err)
 	}
 
+	preview, err := template.New("preview").Funcs(template.FuncMap{
+		"formatSize": formatSize,
+		"inc":        func(i int) int { return i + 1 },
+	}).Parse(previewTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse preview template: %w", err)
+	}
+
+	info, err := template.New("info").Funcs(infoFuncs).Parse(infoTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse info template: %w", err)
+	}
+
+	var thumbs *Thumbnailer
+	if cfg != nil && cfg.Server.Thumbnails.Enabled {
+		// Thumbnails need a writable cache; without one they are left out
+		if thumbs, err = NewThumbnailer(rootPath, cfg.Server.Thumbnails); err != nil && storage.err == nil && !isStorageError(err) {
+			return nil, err
+		}
+	}
+
 	return &Handler{
-		rootPath: rootPath,
-		template: tmpl,
-		config:   cfg,
+		rootPath:     rootPath,
+		template:     tmpl,
+		preview:      preview,
+		info:         info,
+		thumbs:       thumbs,
+		sources:      newSourceIndex(rootPath),
+		storage:      storage,
+		latest:       newLatestCache(),
+		config:       cfg,
+		decompressed: newDecompressCache(),
+		pulls:        newPullThrough(),
+		signer:       newConfigSigner(cfg),
+		location:     listingLocation(cfg),
 	}, nil
 }
 
+// SetConfig replaces the configuration used for target lookups, e.g. after a reload
+func (h *Handler) SetConfig(cfg *config.Config) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = cfg
+	h.signer = newConfigSigner(cfg)
+	h.location = listingLocation(cfg)
+}
+
+// listingLocation returns the time zone listings are rendered in for cfg, which may
+// be nil. Invalid zones are rejected when loading the configuration; UTC is the
+// fallback.
+func listingLocation(cfg *config.Config) *time.Location {
+	if cfg == nil {
+		return time.UTC
+	}
+	loc, err := cfg.Server.ListingLocation()
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Signer returns the signer for the current configuration
+func (h *Handler) Signer() *Signer {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.signer
+}
+
+// newConfigSigner creates the signer for cfg, which may be nil
+func newConfigSigner(cfg *config.Config) *Signer {
+	if cfg == nil {
+		return NewSigner(config.SignedURLs{})
+	}
+	return NewSigner(cfg.Server.SignedURLs)
+}
+
+// isProtected reports whether urlPath belongs to a target that requires signed URLs
+func (h *Handler) isProtected(urlPath string) bool {
+	cfg := h.getConfig()
+	if cfg == nil {
+		return false
+	}
+
+	targetName, _, _ := strings.Cut(strings.Trim(filepath.ToSlash(filepath.Clean(urlPath)), "/"), "/")
+	for _, target := range cfg.Targets {
+		if target.Protected && target.Name == targetName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignature validates the signature of requests to protected targets and of
+// any request carrying signature parameters. It writes a 403 and returns false if
+// the request must be rejected.
+func (h *Handler) checkSignature(w http.ResponseWriter, r *http.Request, urlPath string) bool {
+	query := r.URL.Query()
+	if !h.isProtected(urlPath) && !query.Has("sig") && !query.Has("exp") {
+		return true
+	}
+
+	if err := h.Signer().Verify(r.URL.Path, query); err != nil {
+		SignatureRejections.WithLabelValues(signatureReason(err)).Inc()
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// canonicalRequestPath returns the request path with a trailing slash for a
+// directory and without one for a file, and whether requestPath already is that.
+// The root is always canonical.
+func canonicalRequestPath(requestPath string, isDir bool) (string, bool) {
+	trimmed := strings.TrimRight(requestPath, "/")
+	if trimmed == "" {
+		return "/", true
+	}
+	canonical := trimmed
+	if isDir {
+		canonical += "/"
+	}
+	return canonical, canonical == requestPath
+}
+
+// escapeURLPath returns the slash-separated urlPath as an absolute URL path with
+// every segment escaped, so that names with spaces, '#' or '?' link correctly
+func escapeURLPath(urlPath string) string {
+	return (&url.URL{Path: "/" + strings.TrimPrefix(filepath.ToSlash(urlPath), "/")}).EscapedPath()
+}
+
+// targetOf returns the target a cleaned URL path belongs to, or "" for the root
+func targetOf(urlPath string) string {
+	if urlPath == "." {
+		return ""
+	}
+	name, _, _ := strings.Cut(filepath.ToSlash(urlPath), "/")
+	return name
+}
+
+// isHiddenPath reports whether a component of urlPath must not be served: mirror
+// metadata always, other hidden names only with Server.BlockHidden
+func (h *Handler) isHiddenPath(urlPath string) bool {
+	cfg := h.getConfig()
+	block := cfg != nil && cfg.Server.BlockHidden
+	parts := strings.Split(filepath.ToSlash(urlPath), "/")
+	for i, name := range parts {
+		if strings.HasPrefix(name, config.MetadataPrefix) {
+			return true
+		}
+		if !block {
+			continue
+		}
+		// Target directories follow the defaults, their contents the target's policy
+		patterns := cfg.HiddenPatterns("")
+		if i > 0 {
+			patterns = cfg.HiddenPatterns(parts[0])
+		}
+		if name != "." && config.IsHidden(patterns, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfig returns the current configuration
+func (h *Handler) getConfig() *config.Config {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config
+}
+
+// Views of a path served by the handler
+const (
+	viewFile      = "file"
+	viewThumbnail = "thumbnail"
+	viewPreview   = "preview"
+	viewInfo      = "info"
+)
+
+// routeView splits a request path into the requested view and the path of the file
+// it applies to. A mirrored top-level "preview" directory takes precedence over
+// the preview pages.
+func (h *Handler) routeView(requestPath string) (string, string) {
+	if strings.HasPrefix(requestPath, infoPrefix) {
+		return viewInfo, strings.TrimPrefix(requestPath, infoPrefix[:len(infoPrefix)-1])
+	}
+	if h.thumbs != nil && strings.HasPrefix(requestPath, thumbsPrefix) {
+		return viewThumbnail, strings.TrimPrefix(requestPath, thumbsPrefix[:len(thumbsPrefix)-1])
+	}
+	if strings.HasPrefix(requestPath, previewPrefix) {
+		if _, err := os.Stat(filepath.Join(h.rootPath, "preview")); os.IsNotExist(err) {
+			return viewPreview, strings.TrimPrefix(requestPath, previewPrefix[:len(previewPrefix)-1])
+		}
+	}
+	return viewFile, requestPath
+}
+
 // ServeHTTP implements http.Handler
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Absurd paths are rejected before any filesystem work
+	if h.rejectLongPath(w, r) {
+		return
+	}
+	if h.storage.check() != nil {
+		serveStorageUnavailable(w)
+		return
+	}
+
+	// Thumbnails and previews live in their own namespaces
+	view, requestPath := h.routeView(r.URL.Path)
+
 	// Clean the URL path
-	urlPath := strings.TrimPrefix(r.URL.Path, "/")
+	urlPath := strings.TrimPrefix(requestPath, "/")
 	if urlPath == "" {
 		urlPath = "."
 	}
@@ -90,14 +334,69 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.isHiddenPath(urlPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if view != viewFile {
+		// Derived views cannot carry a signature and would leak protected content
+		if h.isProtected(urlPath) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		switch view {
+		case viewThumbnail:
+			h.thumbs.serve(w, r, cleanPath)
+		case viewInfo:
+			h.serveInfo(w, r, urlPath)
+		default:
+			h.servePreview(w, r, cleanPath, urlPath)
+		}
+		return
+	}
+
+	if !h.checkSignature(w, r, urlPath) {
+		return
+	}
+
 	// Check if file/directory exists
 	stat, err := os.Stat(cleanPath)
+	if os.IsNotExist(err) && h.retryDuringSync(urlPath) {
+		stat, err = os.Stat(cleanPath)
+	}
 	if os.IsNotExist(err) {
+		// A vanished data root makes every file look missing
+		if h.storage.failed(err) {
+			serveStorageUnavailable(w)
+			return
+		}
+		// Indexes mirrored only compressed may be served decompressed
+		if h.serveDecompressed(w, r, urlPath, cleanPath) {
+			return
+		}
+		// Mirrored entries named latest take precedence over latest links
+		if h.serveLatest(w, r, urlPath) {
+			return
+		}
+		// Files not mirrored yet may be fetched on demand
+		if h.servePullThrough(w, r, urlPath, cleanPath) {
+			return
+		}
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		h.serverError(w, err, "Server error")
+		return
+	}
+
+	// Directories are addressed with a trailing slash and files without, so that
+	// relative links resolve the same way for every client. Signed requests are
+	// only valid for the exact path they were signed for.
+	if canonical, ok := canonicalRequestPath(r.URL.Path, stat.IsDir()); !ok && !r.URL.Query().Has("sig") {
+		location := (&url.URL{Path: httpPkg.BasePath(r) + canonical, RawQuery: r.URL.RawQuery}).String()
+		http.Redirect(w, r, location, http.StatusMovedPermanently)
 		return
 	}
 
@@ -124,8 +423,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // serveFile serves a static file
 func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, filePath string) {
 	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		// Removed by a sync since it was looked up
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		h.serverError(w, err, "Failed to open file")
 		return
 	}
 	defer file.Close()
@@ -133,26 +437,47 @@ func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, filePath str
 	// Get file info for headers
 	stat, err := file.Stat()
 	if err != nil {
-		http.Error(w, "Failed to stat file", http.StatusInternalServerError)
+		h.serverError(w, err, "Failed to stat file")
 		return
 	}
 
 	// Set content type based on file extension
 	contentType := getContentType(filepath.Ext(filePath))
 	w.Header().Set("Content-Type", contentType)
+	h.setSourceHeader(w, filePath)
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": stat.Name()}))
+	}
 
 	// Set cache headers
+	v := validators{ETag: fileETag(stat, ""), LastModified: stat.ModTime()}
+	w.Header().Set("ETag", v.ETag)
 	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-
-	// Check if-modified-since header
-	if modSince := r.Header.Get("If-Modified-Since"); modSince != "" {
-		if t, err := time.Parse(http.TimeFormat, modSince); err == nil {
-			if stat.ModTime().Before(t.Add(1 * time.Second)) {
-				w.WriteHeader(http.StatusNotModified)
-				return
-			}
-		}
+	if r.URL.Query().Has("sig") {
+		// Signed links must not outlive their expiry in shared caches
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+
+	// Evaluate conditional headers in one place so all features share the semantics
+	result, ignoreRange := checkPreconditions(r, v)
+	switch result {
+	case preconditionNotModified:
+		writeNotModified(w)
+		return
+	case preconditionFailed:
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	// The conditions are already decided; keep ServeContent from re-evaluating them
+	r = r.Clone(r.Context())
+	for _, header := range conditionalHeaders {
+		r.Header.Del(header)
+	}
+	if ignoreRange {
+		r.Header.Del("Range")
 	}
 
 	// Serve the file
@@ -161,32 +486,77 @@ func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, filePath str
 
 // serveDirectory serves a directory listing
 func (h *Handler) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath, urlPath string) {
+	dirStat, err := os.Stat(dirPath)
+	if err != nil {
+		h.serverError(w, err, "Failed to read directory")
+		return
+	}
 	files, err := os.ReadDir(dirPath)
 	if err != nil {
-		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+		h.serverError(w, err, "Failed to read directory")
 		return
 	}
 
-	// Build file list
+	// Build file list; links start with the path the server is published under
+	protected := h.isProtected(urlPath)
+	base := httpPkg.BasePath(r)
+	showThumbnails := h.thumbs != nil && !protected
+	showPreviews := !protected
+	hidden := h.getConfig().HiddenPatterns(targetOf(urlPath))
+	h.mu.RLock()
+	loc := h.location
+	h.mu.RUnlock()
 	var fileList []FileInfo
 	for _, file := range files {
 		info, err := file.Info()
 		if err != nil {
 			continue
 		}
+		// Symlinks such as the current link of dated targets are listed as what they point at
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(filepath.Join(dirPath, file.Name())); err != nil {
+				continue
+			}
+		}
 
-		// Skip hidden files
-		if strings.HasPrefix(file.Name(), ".") {
+		// Incomplete downloads are not part of the mirror yet
+		if config.IsHidden(hidden, file.Name()) || config.IsTempFile(file.Name()) {
 			continue
 		}
 
-		fileList = append(fileList, FileInfo{
+		entry := FileInfo{
 			Name:    file.Name(),
-			Path:    filepath.Join(urlPath, file.Name()),
-			IsDir:   file.IsDir(),
+			Path:    path.Join(filepath.ToSlash(urlPath), file.Name()),
+			IsDir:   info.IsDir(),
 			Size:    info.Size(),
-			ModTime: info.ModTime(),
-		})
+			ModTime: info.ModTime().In(loc),
+		}
+		if showThumbnails && !entry.IsDir && isThumbnailable(entry.Name) {
+			entry.Thumbnail = escapeURLPath(base + thumbnailURL(entry.Path))
+		}
+		if showPreviews && !entry.IsDir && isPreviewable(entry.Name, entry.Size) {
+			entry.Preview = escapeURLPath(base + previewURL(entry.Path))
+		}
+		if !protected && !entry.IsDir {
+			entry.Info = escapeURLPath(base + infoURL(entry.Path))
+		}
+		fileList = append(fileList, entry)
+	}
+	fileList = append(fileList, h.decompressedEntries(urlPath, fileList)...)
+	for i := range fileList {
+		fileList[i].URL = escapeURLPath(path.Join(base, "/", fileList[i].Path))
+		if fileList[i].IsDir {
+			fileList[i].URL += "/"
+		}
+	}
+
+	// The newest version is badged in directories with a latest link
+	if link, ok := h.latestLink(strings.Trim(filepath.ToSlash(urlPath), "/")); ok && !protected {
+		if latest, err := h.resolveLatest(link); err == nil {
+			for i := range fileList {
+				fileList[i].Latest = fileList[i].IsDir && fileList[i].Name == latest
+			}
+		}
 	}
 
 	// Sort files (directories first, then alphabetically)
@@ -201,8 +571,8 @@ func (h *Handler) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath
 	parent := ""
 	if urlPath != "." && urlPath != "" {
 		// Remove trailing slash for consistent behavior
-		cleanPath := strings.TrimSuffix(urlPath, "/")
-		parent = filepath.Dir(cleanPath)
+		cleanPath := strings.TrimSuffix(filepath.ToSlash(urlPath), "/")
+		parent = path.Dir(cleanPath)
 		if parent == "." {
 			parent = ""
 		}
@@ -210,13 +580,14 @@ func (h *Handler) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath
 
 	// Find the target info for this path
 	var originalURL, targetName string
-	if h.config != nil {
+	cfg := h.getConfig()
+	if cfg != nil {
 		// Determine which target this path belongs to by checking the first path segment
 		pathParts := strings.Split(strings.Trim(urlPath, "/"), "/")
 		if len(pathParts) > 0 && pathParts[0] != "" {
 			targetName = pathParts[0]
 			// Find the corresponding target configuration
-			for _, target := range h.config.Targets {
+			for _, target := range cfg.Targets {
 				if target.Name == targetName {
 					originalURL = target.URL
 					break
@@ -229,21 +600,72 @@ func (h *Handler) serveDirectory(w http.ResponseWriter, r *http.Request, dirPath
 	listing := DirectoryListing{
 		Path:        urlPath,
 		Parent:      parent,
+		ParentURL:   escapeURLPath(path.Join(base, "/", parent)) + "/",
 		Files:       fileList,
-		Timestamp:   time.Now(),
+		Timestamp:   time.Now().In(loc),
 		OriginalURL: originalURL,
 		TargetName:  targetName,
 	}
+	if marker := h.syncMarker(targetName); marker != nil {
+		since := marker.Started.In(loc)
+		listing.SyncingSince = &since
+	}
 
-	// Set headers
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	// Listings change only with their entries, so clients can revalidate cheaply
+	v := listingValidators(dirStat, listing)
+	w.Header().Set("ETag", v.ETag)
+	w.Header().Set("Last-Modified", v.LastModified.UTC().Format(http.TimeFormat))
+	switch {
+	case r.URL.Query().Has("sig"):
+		w.Header().Set("Cache-Control", "private, no-store")
+	case cfg != nil && cfg.Server.ListingMaxAge > 0:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cfg.Server.ListingMaxAge))
+	default:
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	switch result, _ := checkPreconditions(r, v); result {
+	case preconditionNotModified:
+		writeNotModified(w)
+		return
+	case preconditionFailed:
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
 
 	// Render template
-	if err := h.template.Execute(w, listing); err != nil {
-		http.Error(w, "Failed to render directory listing", http.StatusInternalServerError)
+	err = renderTemplate(w, h.template, listing)
+	if errors.Is(err, errRenderTooLarge) {
+		writePlainListing(w, listing)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Failed to render directory listing", http.StatusInternalServerError)
+	}
+}
+
+// listingValidators derives the validators of a listing. Last-Modified is the newest
+// of the directory's and its entries' modification times; the weak ETag covers
+// the entry set, the time zone, the sync banner and everything else that changes
+// the rendered page, except the generation timestamp.
+func listingValidators(dir os.FileInfo, listing DirectoryListing) validators {
+	lastModified := dir.ModTime()
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", listing.OriginalURL, listing.Timestamp.Location())
+	if listing.SyncingSince != nil {
+		fmt.Fprintf(h, "syncing %d\x00", listing.SyncingSince.UnixNano())
+	}
+	for _, entry := range listing.Files {
+		if entry.ModTime.After(lastModified) {
+			lastModified = entry.ModTime
+		}
+		fmt.Fprintf(h, "%s\x00%t\x00%d\x00%d\x00%s\x00%s\x00%s\x00%t\x00",
+			entry.Name, entry.IsDir, entry.Size, entry.ModTime.UnixNano(), entry.Thumbnail, entry.Preview, entry.Info, entry.Latest)
+	}
+	return validators{
+		ETag:         `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`,
+		LastModified: lastModified,
+	}
 }
 
 // getContentType returns the MIME type based on file extension
@@ -405,6 +827,15 @@ const directoryTemplate = `<!DOCTYPE html>
         .parent-link {
             margin-bottom: 20px;
         }
+        .syncing {
+            margin-bottom: 20px;
+            padding: 12px 16px;
+            background-color: #fff8e1;
+            border: 1px solid #ffe082;
+            border-radius: 4px;
+            font-size: 14px;
+            color: #6d5200;
+        }
         .parent-link a {
             display: inline-block;
             padding: 8px 16px;
@@ -417,6 +848,43 @@ const directoryTemplate = `<!DOCTYPE html>
         .parent-link a:hover {
             background-color: #005999;
         }
+        .latest-badge {
+            margin-left: 8px;
+            padding: 1px 6px;
+            background-color: #e6f4ea;
+            border: 1px solid #a8dab5;
+            border-radius: 4px;
+            font-size: 11px;
+            color: #1e6b34;
+        }
+        .preview-link {
+            margin-left: 12px;
+            font-size: 12px;
+            color: #999 !important;
+        }
+        .thumb {
+            width: 48px;
+            height: 48px;
+            object-fit: contain;
+            margin-right: 8px;
+            vertical-align: middle;
+        }
+        .lightbox {
+            display: none;
+            position: fixed;
+            inset: 0;
+            background: rgba(0,0,0,0.85);
+            align-items: center;
+            justify-content: center;
+            z-index: 10;
+        }
+        .lightbox:target {
+            display: flex;
+        }
+        .lightbox img {
+            max-width: 90vw;
+            max-height: 90vh;
+        }
     </style>
 </head>
 <body>
@@ -425,10 +893,14 @@ const directoryTemplate = `<!DOCTYPE html>
         
         {{if .Parent}}
         <div class="parent-link">
-            <a href="/{{.Parent}}">📁 Parent Directory</a>
+            <a href="{{.ParentURL}}">📁 Parent Directory</a>
         </div>
         {{end}}
 
+        {{if .SyncingSince}}
+        <div class="syncing">🔄 This mirror is being updated right now (since {{.SyncingSince.Format "2006-01-02 15:04:05 MST"}}); files may change while you browse.</div>
+        {{end}}
+
         <table>
             <thead>
                 <tr>
@@ -438,19 +910,28 @@ const directoryTemplate = `<!DOCTYPE html>
                 </tr>
             </thead>
             <tbody>
-                {{range .Files}}
+                {{range $i, $f := .Files}}
                 <tr>
                     <td class="file-name">
                         {{if .IsDir}}
                         <span class="icon">📁</span>
-                        <a href="/{{.Path}}/" class="directory">{{.Name}}/</a>
+                        <a href="{{.URL}}" class="directory">{{.Name}}/</a>
+                        {{if .Latest}}<span class="latest-badge" title="Also available as latest/">latest</span>{{end}}
+                        {{else if .Thumbnail}}
+                        <a href="#preview-{{$i}}"><img class="thumb" src="{{.Thumbnail}}" alt="" loading="lazy"></a>
+                        <a href="{{.URL}}">{{.Name}}</a>
+                        {{if .Info}}<a href="{{.Info}}" class="preview-link">info</a>{{end}}
+                        <div id="preview-{{$i}}" class="lightbox"><a href="#"><img src="{{.URL}}" alt="{{.Name}}"></a></div>
                         {{else}}
                         <span class="icon">📄</span>
-                        <a href="/{{.Path}}">{{.Name}}</a>
+                        <a href="{{.URL}}">{{.Name}}</a>
+                        {{if .Decompressed}}<span class="latest-badge" title="Decompressed from {{.Name}}.gz on request">gunzip</span>{{end}}
+                        {{if .Preview}}<a href="{{.Preview}}" class="preview-link">preview</a>{{end}}
+                        {{if .Info}}<a href="{{.Info}}" class="preview-link">info</a>{{end}}
                         {{end}}
                     </td>
                     <td class="size">
-                        {{if .IsDir}}-{{else}}{{.Size | formatSize}}{{end}}
+                        {{if or .IsDir .Decompressed}}-{{else}}{{.Size | formatSize}}{{end}}
                     </td>
                     <td class="date">{{.ModTime.Format "2006-01-02 15:04:05"}}</td>
                 </tr>
@@ -460,9 +941,9 @@ const directoryTemplate = `<!DOCTYPE html>
 
         <div class="footer">
             {{if .OriginalURL}}
-            Mirrored from <a href="{{.OriginalURL}}" target="_blank">{{.OriginalURL}}</a> • {{.Timestamp.Format "2006-01-02 15:04:05"}}
+            Mirrored from <a href="{{.OriginalURL}}" target="_blank">{{.OriginalURL}}</a> • {{.Timestamp.Format "2006-01-02 15:04:05 MST"}}
             {{else}}
-            Generated by HTTP Mirror • {{.Timestamp.Format "2006-01-02 15:04:05"}}
+            Generated by HTTP Mirror • {{.Timestamp.Format "2006-01-02 15:04:05 MST"}}
             {{end}}
         </div>
     </div>
@@ -1,13 +1,19 @@
 package files
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
 )
 
 func TestNewHandler(t *testing.T) {
@@ -203,6 +209,139 @@ func TestServeDirectoryListing(t *testing.T) {
 	}
 }
 
+func TestCanonicalSlashes(t *testing.T) {
+	tempDir := t.TempDir()
+	nested := filepath.Join(tempDir, "release notes", "v1 #2")
+	if err := os.MkdirAll(filepath.Join(nested, "sub dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(nested, "read me #1.txt"), []byte("notes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		status   int
+		location string
+	}{
+		{"directory with slash", "/release%20notes/v1%20%232/", http.StatusOK, ""},
+		{"directory without slash", "/release%20notes/v1%20%232?sort=name", http.StatusMovedPermanently, "/release%20notes/v1%20%232/?sort=name"},
+		{"file without slash", "/release%20notes/v1%20%232/read%20me%20%231.txt", http.StatusOK, ""},
+		{"file with slash", "/release%20notes/v1%20%232/read%20me%20%231.txt/", http.StatusMovedPermanently, "/release%20notes/v1%20%232/read%20me%20%231.txt"},
+		{"root", "/", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+				t.Errorf("Expected %d to %q, got %d to %q", tt.status, tt.location, w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/release%20notes/v1%20%232/", nil))
+	body := w.Body.String()
+	for _, link := range []string{
+		`href="/release%20notes/v1%20%232/sub%20dir/"`,
+		`href="/release%20notes/v1%20%232/read%20me%20%231.txt"`,
+		`href="/release%20notes/"`,
+	} {
+		if !strings.Contains(body, link) {
+			t.Errorf("Expected listing to link %s, got:\n%s", link, body)
+		}
+	}
+}
+
+func TestBasePathLinks(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"tools/notes.txt":                    "notes",
+		"tools/logo.png":                     "png",
+		"tools/releases/v1.2.10/tool.tar.gz": "new",
+		"tools/releases/v1.2.9/tool.tar.gz":  "old",
+	} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755)
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &config.Config{
+		Server:  config.Server{BasePath: "/mirror", LatestLinks: []config.LatestLink{{Path: "tools/releases"}}},
+		Targets: []config.Target{{Name: "tools", URL: "http://upstream.example/tools/"}},
+	}
+	handler, err := NewHandler(root, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle("/api/v1/latest", handler.LatestAPI())
+	mux.Handle("/api/v1/file-info", handler.FileInfoAPI())
+	server := httpPkg.BasePathMiddleware(func() string { return cfg.Server.BasePath }, func() *httpPkg.ClientIPResolver { return nil }, mux)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	// Every page links below the base path, whether requested with or without it
+	links := regexp.MustCompile(`(?:href|src)="([^"]*)"`)
+	for _, target := range []string{"/mirror/tools/", "/tools/", "/mirror/tools/releases/", "/mirror/preview/tools/notes.txt", "/mirror/.info/tools/notes.txt"} {
+		w := get(target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", target, w.Code)
+		}
+		matches := links.FindAllStringSubmatch(w.Body.String(), -1)
+		if len(matches) == 0 {
+			t.Errorf("%s: expected links", target)
+		}
+		for _, match := range matches {
+			if link := match[1]; !strings.HasPrefix(link, "/mirror/") && !strings.HasPrefix(link, "#") && !strings.HasPrefix(link, "http://upstream.example/") {
+				t.Errorf("%s: link %q is outside the base path", target, link)
+			}
+		}
+	}
+	body := get("/mirror/tools/releases/").Body.String()
+	for _, link := range []string{`href="/mirror/tools/releases/v1.2.10/"`, `href="/mirror/tools/"`} {
+		if !strings.Contains(body, link) {
+			t.Errorf("Expected listing to link %s, got:\n%s", link, body)
+		}
+	}
+
+	redirects := []struct {
+		target   string
+		location string
+	}{
+		{"/mirror/tools", "/mirror/tools/"},
+		{"/tools/notes.txt/", "/mirror/tools/notes.txt"},
+		{"/mirror/tools/releases/latest/", "/mirror/tools/releases/v1.2.10/"},
+		{"/mirror/preview/tools/releases/v1.2.10/tool.tar.gz", "/mirror/tools/releases/v1.2.10/tool.tar.gz"},
+	}
+	for _, tt := range redirects {
+		if location := get(tt.target).Header().Get("Location"); location != tt.location {
+			t.Errorf("%s: expected redirect to %q, got %q", tt.target, tt.location, location)
+		}
+	}
+
+	var latest latestInfo
+	json.NewDecoder(get("/mirror/api/v1/latest?path=tools/releases").Body).Decode(&latest)
+	if latest.Path != "/mirror/tools/releases/latest/" || latest.URL != "/mirror/tools/releases/v1.2.10/" {
+		t.Errorf("Unexpected latest links: %+v", latest)
+	}
+	var details fileDetails
+	json.NewDecoder(get("/mirror/api/v1/file-info?path=/tools/notes.txt").Body).Decode(&details)
+	if details.Path != "/tools/notes.txt" || details.URL != "/mirror/tools/notes.txt" {
+		t.Errorf("Unexpected file info: %+v", details)
+	}
+}
+
 func TestSecurityPathTraversal(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -387,3 +526,244 @@ func TestDirectoryListingSort(t *testing.T) {
 		t.Error("Files should be sorted alphabetically (apple before zebra)")
 	}
 }
+
+func TestDirectoryListingSymlinks(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, dir := range []string{"2024-06-01", "2024-06-02"} {
+		if err := os.MkdirAll(filepath.Join(tempDir, "archive", dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "archive", "2024-06-02", "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("2024-06-02", filepath.Join(tempDir, "archive", "current")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(tempDir, "archive", "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/archive/", nil))
+	body := w.Body.String()
+	for _, dir := range []string{"2024-06-01/", "2024-06-02/", "current/"} {
+		if !strings.Contains(body, dir) {
+			t.Errorf("Expected %s to be listed as a directory", dir)
+		}
+	}
+	if strings.Contains(body, "dangling") {
+		t.Error("Expected dangling symlinks to be left out")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/archive/current/file.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("Expected file through the current symlink, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDirectoryListingConditional(t *testing.T) {
+	tempDir := t.TempDir()
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	file := filepath.Join(tempDir, "a.txt")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, old, old)
+	os.Chtimes(tempDir, old, old)
+
+	cfg := &config.Config{Server: config.Server{ListingMaxAge: 60}}
+	handler, err := NewHandler(tempDir, cfg)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Errorf("Expected a weak ETag, got %q", etag)
+	}
+	if lastModified != old.UTC().Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified %s, got %s", old.UTC().Format(http.TimeFormat), lastModified)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("Expected configured Cache-Control, got %q", cc)
+	}
+
+	tests := []struct {
+		header, value string
+	}{
+		{"If-None-Match", etag},
+		{"If-Modified-Since", lastModified},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(tt.header, tt.value)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("Expected empty 304 for %s, got %d with %d bytes", tt.header, w.Code, w.Body.Len())
+		}
+	}
+
+	// A new entry invalidates both validators, even with an old modification time
+	newFile := filepath.Join(tempDir, "b.txt")
+	if err := os.WriteFile(newFile, []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(newFile, old, old)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "b.txt") {
+		t.Errorf("Expected a fresh listing after adding a file, got %d", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("Expected the ETag to change after adding a file")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the directory mtime to invalidate If-Modified-Since, got %d", w.Code)
+	}
+
+	// Without a max-age listings are revalidated on every use
+	handler.SetConfig(&config.Config{})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Expected no-cache without max-age, got %q", cc)
+	}
+}
+
+func TestHiddenFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{
+		"plain/visible.txt", "plain/.htaccess", "plain/.http-mirror-state.json",
+		"dotfiles/.htaccess", "dotfiles/Thumbs.db", "dotfiles/.http-mirror-manifest.json",
+	} {
+		path := filepath.Join(tempDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &config.Config{
+		Defaults: config.Defaults{Hidden: config.DefaultHidden},
+		Targets: []config.Target{
+			{Name: "plain"},
+			{Name: "dotfiles", Hidden: []string{"Thumbs.db"}},
+		},
+	}
+	handler, err := NewHandler(tempDir, cfg)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	listings := []struct {
+		path    string
+		visible []string
+		hidden  []string
+	}{
+		{"/plain/", []string{"visible.txt"}, []string{".htaccess", ".http-mirror-state.json"}},
+		{"/dotfiles/", []string{".htaccess"}, []string{"Thumbs.db", ".http-mirror-manifest.json"}},
+	}
+	for _, tt := range listings {
+		body := get(tt.path).Body.String()
+		for _, name := range tt.visible {
+			if !strings.Contains(body, name) {
+				t.Errorf("Expected %s to list %s", tt.path, name)
+			}
+		}
+		for _, name := range tt.hidden {
+			if strings.Contains(body, name) {
+				t.Errorf("Expected %s to hide %s", tt.path, name)
+			}
+		}
+	}
+
+	// Mirror metadata is never served; other hidden files only with BlockHidden
+	access := []struct {
+		path        string
+		status      int
+		blockStatus int
+	}{
+		{"/plain/.http-mirror-state.json", http.StatusNotFound, http.StatusNotFound},
+		{"/plain/.htaccess", http.StatusOK, http.StatusNotFound},
+		{"/dotfiles/.htaccess", http.StatusOK, http.StatusOK},
+		{"/dotfiles/Thumbs.db", http.StatusOK, http.StatusNotFound},
+		{"/plain/visible.txt", http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range access {
+		if w := get(tt.path); w.Code != tt.status {
+			t.Errorf("GET %s: expected %d, got %d", tt.path, tt.status, w.Code)
+		}
+	}
+	cfg.Server.BlockHidden = true
+	for _, tt := range access {
+		if w := get(tt.path); w.Code != tt.blockStatus {
+			t.Errorf("GET %s with BlockHidden: expected %d, got %d", tt.path, tt.blockStatus, w.Code)
+		}
+	}
+}
+
+func TestDirectoryListingTimezone(t *testing.T) {
+	tempDir := t.TempDir()
+	modTime := time.Date(2024, time.March, 31, 0, 30, 0, 0, time.UTC)
+	filePath := filepath.Join(tempDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		timezone string
+		want     string
+	}{
+		// Listings are in UTC regardless of the server's local zone
+		{"", "2024-03-31 00:30:00"},
+		{"UTC", "2024-03-31 00:30:00"},
+		// Just before the DST switch in Central Europe
+		{"Europe/Zurich", "2024-03-31 01:30:00"},
+		{"America/New_York", "2024-03-30 20:30:00"},
+	}
+	var etags []string
+	for _, tt := range tests {
+		handler, err := NewHandler(tempDir, &config.Config{Server: config.Server{ListingTimezone: tt.timezone}})
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%q: expected modification time %s in listing", tt.timezone, tt.want)
+		}
+		etags = append(etags, w.Header().Get("ETag"))
+	}
+	if etags[2] == etags[3] {
+		t.Error("Expected the time zone to change the listing ETag")
+	}
+}
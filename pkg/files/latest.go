@@ -0,0 +1,351 @@
+package files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// latestName is the path segment resolved to the newest version by Server.LatestLinks
+const latestName = "latest"
+
+// errNoVersions is returned when a directory of a latest link holds no versions
+var errNoVersions = errors.New("no versioned entries")
+
+// version is the version in the name of a directory entry
+type version struct {
+	// numbers are the numeric components without leading zeros
+	numbers []string
+	// prerelease is the suffix following the numbers, e.g. "rc1"; empty for releases
+	prerelease string
+}
+
+// parseVersion reads the version of an entry name: the first run of numbers joined
+// by ".", "-" or "_", e.g. "1.2.10" in "v1.2.10" or "2024-01-15" in "snapshot-2024-01-15".
+// Whatever follows the numbers marks a pre-release, except build metadata starting
+// with "+". Names without digits are not versions.
+func parseVersion(name string) (version, bool) {
+	start := strings.IndexFunc(name, isDigit)
+	if start < 0 {
+		return version{}, false
+	}
+	s := name[start:]
+	var v version
+	for {
+		end := strings.IndexFunc(s, func(r rune) bool { return !isDigit(r) })
+		if end < 0 {
+			end = len(s)
+		}
+		v.numbers = append(v.numbers, strings.TrimLeft(s[:end], "0"))
+		s = s[end:]
+		if len(s) < 2 || !strings.ContainsRune(".-_", rune(s[0])) || !isDigit(rune(s[1])) {
+			break
+		}
+		s = s[1:]
+	}
+	if s != "" && s[0] != '+' {
+		v.prerelease = strings.TrimLeft(s, ".-_~")
+	}
+	return v, true
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// compareNumbers compares two decimal numbers without leading zeros, of any length
+func compareNumbers(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// compareNatural compares strings with runs of digits compared numerically, so that
+// "rc10" follows "rc9"
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(rune(a[0])) && isDigit(rune(b[0])) {
+			i := strings.IndexFunc(a, func(r rune) bool { return !isDigit(r) })
+			if i < 0 {
+				i = len(a)
+			}
+			j := strings.IndexFunc(b, func(r rune) bool { return !isDigit(r) })
+			if j < 0 {
+				j = len(b)
+			}
+			if c := compareNumbers(strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")); c != 0 {
+				return c
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		if a[0] != b[0] {
+			return int(a[0]) - int(b[0])
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+// compare orders versions: numbers component by component, missing components
+// counting as 0, then releases after their pre-releases
+func (v version) compare(other version) int {
+	for i := range max(len(v.numbers), len(other.numbers)) {
+		var a, b string
+		if i < len(v.numbers) {
+			a = v.numbers[i]
+		}
+		if i < len(other.numbers) {
+			b = other.numbers[i]
+		}
+		if c := compareNumbers(a, b); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case v.prerelease == other.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	}
+	return compareNatural(v.prerelease, other.prerelease)
+}
+
+// latestEntry returns the name among names with the highest version. Names that are
+// no versions are ignored, as are pre-releases unless prereleases is set. Of equal
+// versions, such as "1.2" and "v1.2.0", the name sorting last wins.
+func latestEntry(names []string, prereleases bool) (string, bool) {
+	var best string
+	var bestVersion version
+	for _, name := range names {
+		v, ok := parseVersion(name)
+		if !ok || (v.prerelease != "" && !prereleases) {
+			continue
+		}
+		if best == "" {
+			best, bestVersion = name, v
+			continue
+		}
+		if c := v.compare(bestVersion); c > 0 || (c == 0 && name > best) {
+			best, bestVersion = name, v
+		}
+	}
+	return best, best != ""
+}
+
+// latestResolution is a cached resolution of a latest link, valid while the
+// modification time of its directory is unchanged
+type latestResolution struct {
+	modTime     time.Time
+	prereleases bool
+	entry       string
+	err         error
+}
+
+// latestCache caches the resolutions of latest links by directory. Adding or
+// removing a version changes the modification time of the directory, which, like
+// for listing validators, invalidates the cached resolution.
+type latestCache struct {
+	mu      sync.Mutex
+	entries map[string]latestResolution
+}
+
+func newLatestCache() *latestCache {
+	return &latestCache{entries: make(map[string]latestResolution)}
+}
+
+// latestLink returns the rule of Server.LatestLinks for the directory at dirPath
+func (h *Handler) latestLink(dirPath string) (config.LatestLink, bool) {
+	cfg := h.getConfig()
+	if cfg == nil {
+		return config.LatestLink{}, false
+	}
+	for _, link := range cfg.Server.LatestLinks {
+		if link.Path == dirPath {
+			return link, true
+		}
+	}
+	return config.LatestLink{}, false
+}
+
+// latestLinkBelow returns the rule whose latest path urlPath lies at or below, and
+// the rest of urlPath after the latest path
+func (h *Handler) latestLinkBelow(urlPath string) (config.LatestLink, string, bool) {
+	cfg := h.getConfig()
+	if cfg == nil {
+		return config.LatestLink{}, "", false
+	}
+	for _, link := range cfg.Server.LatestLinks {
+		rest, ok := strings.CutPrefix(urlPath, link.Path+"/"+latestName)
+		if ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+			return link, rest, true
+		}
+	}
+	return config.LatestLink{}, "", false
+}
+
+// resolveLatest returns the name of the newest version in the directory of link.
+// Only visible subdirectories are versions.
+func (h *Handler) resolveLatest(link config.LatestLink) (string, error) {
+	dirPath := filepath.Join(h.rootPath, filepath.FromSlash(link.Path))
+	stat, err := os.Stat(dirPath)
+	if err != nil {
+		return "", err
+	}
+	if !stat.IsDir() {
+		return "", errNoVersions
+	}
+
+	h.latest.mu.Lock()
+	cached, ok := h.latest.entries[link.Path]
+	h.latest.mu.Unlock()
+	if ok && cached.modTime.Equal(stat.ModTime()) && cached.prereleases == link.Prereleases {
+		return cached.entry, cached.err
+	}
+
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return "", err
+	}
+	hidden := h.getConfig().HiddenPatterns(targetOf(link.Path))
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if config.IsHidden(hidden, name) || config.IsTempFile(name) || strings.HasPrefix(name, config.MetadataPrefix) {
+			continue
+		}
+		// Symlinks such as the current link of dated targets count as what they point at
+		if info, err := os.Stat(filepath.Join(dirPath, name)); err == nil && info.IsDir() {
+			names = append(names, name)
+		}
+	}
+
+	resolution := latestResolution{modTime: stat.ModTime(), prereleases: link.Prereleases}
+	if latest, ok := latestEntry(names, link.Prereleases); ok {
+		resolution.entry = latest
+	} else {
+		resolution.err = errNoVersions
+	}
+	h.latest.mu.Lock()
+	h.latest.entries[link.Path] = resolution
+	h.latest.mu.Unlock()
+	return resolution.entry, resolution.err
+}
+
+// serveLatest answers a request for urlPath, which does not exist, if it lies below
+// the latest path of a latest link: with a redirect to the newest version, or that
+// version itself. It reports whether the request was handled.
+func (h *Handler) serveLatest(w http.ResponseWriter, r *http.Request, urlPath string) bool {
+	urlPath = filepath.ToSlash(urlPath)
+	link, rest, ok := h.latestLinkBelow(urlPath)
+	if !ok || h.isProtected(urlPath) {
+		return false
+	}
+
+	entry, err := h.resolveLatest(link)
+	if errors.Is(err, errNoVersions) || os.IsNotExist(err) {
+		http.Error(w, "No version found", http.StatusNotFound)
+		return true
+	}
+	if err != nil {
+		h.serverError(w, err, "Failed to resolve latest version")
+		return true
+	}
+
+	// Directories are addressed with a trailing slash, like in listings
+	resolved := "/" + link.Path + "/" + entry + rest
+	if rest == "" || strings.HasSuffix(r.URL.Path, "/") {
+		resolved = strings.TrimSuffix(resolved, "/") + "/"
+	}
+	h.setLatestCaching(w)
+	if link.Mode == config.LatestServe {
+		w.Header().Set("Content-Location", httpPkg.BasePath(r)+resolved)
+		resolvedRequest := r.Clone(r.Context())
+		resolvedRequest.URL.Path = resolved
+		resolvedRequest.URL.RawPath = ""
+		h.ServeHTTP(w, resolvedRequest)
+		return true
+	}
+
+	location := (&url.URL{Path: httpPkg.BasePath(r) + resolved, RawQuery: r.URL.RawQuery}).String()
+	http.Redirect(w, r, location, http.StatusFound)
+	return true
+}
+
+// setLatestCaching lets clients cache latest redirects as long as listings, since a
+// new version shows up in the listing of their directory first
+func (h *Handler) setLatestCaching(w http.ResponseWriter) {
+	if cfg := h.getConfig(); cfg != nil && cfg.Server.ListingMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cfg.Server.ListingMaxAge))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+}
+
+// latestInfo is the resolution of a latest link as served by LatestAPI
+type latestInfo struct {
+	Path   string `json:"path"`
+	Latest string `json:"latest"`
+	URL    string `json:"url"`
+	Mode   string `json:"mode"`
+}
+
+// LatestAPI serves the resolution of a latest link as JSON at /api/v1/latest?path=...,
+// where path is the directory of the versions
+func (h *Handler) LatestAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dirPath := r.URL.Query().Get("path")
+		if dirPath == "" {
+			http.Error(w, "Missing path parameter", http.StatusBadRequest)
+			return
+		}
+		dirPath = strings.Trim(path.Clean("/"+dirPath), "/")
+
+		link, ok := h.latestLink(dirPath)
+		if !ok || h.isHiddenPath(filepath.FromSlash(dirPath)) {
+			http.Error(w, "No latest link for this path", http.StatusNotFound)
+			return
+		}
+		if h.isProtected(dirPath) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		entry, err := h.resolveLatest(link)
+		if errors.Is(err, errNoVersions) || os.IsNotExist(err) {
+			http.Error(w, "No version found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			h.serverError(w, err, "Failed to resolve latest version")
+			return
+		}
+
+		mode := link.Mode
+		if mode == "" {
+			mode = config.LatestRedirect
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		base := httpPkg.BasePath(r)
+		json.NewEncoder(w).Encode(latestInfo{
+			Path:   base + "/" + dirPath + "/" + latestName + "/",
+			Latest: entry,
+			URL:    base + "/" + dirPath + "/" + entry + "/",
+			Mode:   mode,
+		})
+	})
+}
@@ -0,0 +1,180 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestLatestEntry(t *testing.T) {
+	tests := []struct {
+		name        string
+		names       []string
+		prereleases bool
+		want        string
+	}{
+		{"numeric components", []string{"v1.2.9", "v1.2.10", "v1.10.0-rc1"}, false, "v1.2.10"},
+		{"prereleases", []string{"v1.2.9", "v1.2.10", "v1.10.0-rc1"}, true, "v1.10.0-rc1"},
+		{"release beats its prereleases", []string{"2.0-rc2", "2.0", "2.0-rc10"}, true, "2.0"},
+		{"natural prerelease order", []string{"2.0-rc2", "2.0-rc10"}, true, "2.0-rc10"},
+		{"dates", []string{"snapshot-2023-12-31", "snapshot-2024-01-02"}, false, "snapshot-2024-01-02"},
+		{"missing components are zero", []string{"1.2", "1.2.0"}, false, "1.2.0"},
+		{"tie goes to the last name", []string{"v1.2", "1.2"}, false, "v1.2"},
+		{"build metadata is a release", []string{"1.0+build5", "0.9"}, false, "1.0+build5"},
+		{"leading zeros", []string{"release-010", "release-9"}, false, "release-010"},
+		{"huge numbers", []string{"99999999999999999999", "100000000000000000000"}, false, "100000000000000000000"},
+		{"non-versions are ignored", []string{"docs", "1.0", "old"}, false, "1.0"},
+		{"no versions", []string{"docs", "old"}, false, ""},
+		{"only prereleases", []string{"1.0-beta"}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := latestEntry(tt.names, tt.prereleases)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// newLatestHandler serves a tree with versions below tools/releases
+func newLatestHandler(t *testing.T, links ...config.LatestLink) (*Handler, string) {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range []string{"tools/releases/v1.2.9", "tools/releases/v1.2.10", "tools/releases/docs", "tools/empty", "secret/releases/1.0"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "tools/releases/v1.2.10/tool.tar.gz"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Server:  config.Server{LatestLinks: links},
+		Targets: []config.Target{{Name: "tools"}, {Name: "secret", Protected: true}},
+	}
+	handler, err := NewHandler(root, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler, root
+}
+
+func TestServeLatestRedirect(t *testing.T) {
+	handler, root := newLatestHandler(t,
+		config.LatestLink{Path: "tools/releases"},
+		config.LatestLink{Path: "tools/empty"},
+		config.LatestLink{Path: "secret/releases"})
+
+	tests := []struct {
+		path     string
+		code     int
+		location string
+	}{
+		{"/tools/releases/latest/", http.StatusFound, "/tools/releases/v1.2.10/"},
+		{"/tools/releases/latest", http.StatusFound, "/tools/releases/v1.2.10/"},
+		{"/tools/releases/latest/tool.tar.gz?x=1", http.StatusFound, "/tools/releases/v1.2.10/tool.tar.gz?x=1"},
+		{"/tools/releases/latestfoo", http.StatusNotFound, ""},
+		{"/tools/empty/latest/", http.StatusNotFound, ""},
+		{"/secret/releases/latest/", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s: expected %d to %q, got %d to %q", tt.path, tt.code, tt.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// A new version is picked up once the directory changes
+	if err := os.Mkdir(filepath.Join(root, "tools/releases/v1.3.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(root, "tools/releases"), future, future)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/tools/releases/latest/", nil))
+	if location := w.Header().Get("Location"); location != "/tools/releases/v1.3.0/" {
+		t.Errorf("Expected the new version, got %q", location)
+	}
+
+	// A mirrored entry named latest is served as is
+	if err := os.Mkdir(filepath.Join(root, "tools/releases/latest"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/tools/releases/latest/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the mirrored directory, got %d", w.Code)
+	}
+}
+
+func TestServeLatestInPlace(t *testing.T) {
+	handler, _ := newLatestHandler(t, config.LatestLink{Path: "tools/releases", Mode: config.LatestServe})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/tools/releases/latest/tool.tar.gz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "new" {
+		t.Errorf("Expected the file of the newest version, got %d %q", w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Content-Location"); location != "/tools/releases/v1.2.10/tool.tar.gz" {
+		t.Errorf("Expected the resolved path in Content-Location, got %q", location)
+	}
+}
+
+func TestListingBadgesLatest(t *testing.T) {
+	handler, _ := newLatestHandler(t, config.LatestLink{Path: "tools/releases"})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/tools/releases/", nil))
+	body := w.Body.String()
+	if strings.Count(body, `class="latest-badge"`) != 1 {
+		t.Fatalf("Expected exactly one badge, got %s", body)
+	}
+	badge := strings.Index(body, `class="latest-badge"`)
+	if link := strings.LastIndex(body[:badge], "<a href="); !strings.HasPrefix(body[link:], `<a href="/tools/releases/v1.2.10/"`) {
+		t.Errorf("Expected the badge on v1.2.10, got %s", body[link:badge])
+	}
+}
+
+func TestLatestAPI(t *testing.T) {
+	handler, _ := newLatestHandler(t,
+		config.LatestLink{Path: "tools/releases"},
+		config.LatestLink{Path: "tools/empty"},
+		config.LatestLink{Path: "secret/releases"})
+	api := handler.LatestAPI()
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/latest?path=/tools/releases/", nil))
+	var info latestInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Expected JSON, got %d %s", w.Code, w.Body.String())
+	}
+	want := latestInfo{Path: "/tools/releases/latest/", Latest: "v1.2.10", URL: "/tools/releases/v1.2.10/", Mode: config.LatestRedirect}
+	if info != want {
+		t.Errorf("Expected %+v, got %+v", want, info)
+	}
+
+	for _, tt := range []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusBadRequest},
+		{"?path=tools", http.StatusNotFound},
+		{"?path=tools/empty", http.StatusNotFound},
+		{"?path=secret/releases", http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/latest"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%q: expected %d, got %d", tt.query, tt.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package files
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PathRejections counts requests rejected because their path exceeds the
+// configured limits. It is registered by the server binary.
+var PathRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_mirror_path_rejections_total",
+		Help: "Total number of requests rejected for an overlong path, by reason (length, segments, segment_length)",
+	},
+	[]string{"reason"},
+)
+
+// checkPathLimits returns the status and the reason a request path must be
+// rejected with, or 0 if it is within limits. It does not touch the filesystem.
+func checkPathLimits(limits config.PathLimits, urlPath string) (int, string) {
+	if limits.MaxLength > 0 && len(urlPath) > limits.MaxLength {
+		return http.StatusRequestURITooLong, "length"
+	}
+
+	segments := 0
+	for segment := range strings.SplitSeq(urlPath, "/") {
+		if segment == "" {
+			continue
+		}
+		segments++
+		if limits.MaxSegments > 0 && segments > limits.MaxSegments {
+			return http.StatusRequestURITooLong, "segments"
+		}
+		if limits.MaxSegmentLength > 0 && len(segment) > limits.MaxSegmentLength {
+			return http.StatusBadRequest, "segment_length"
+		}
+	}
+	return 0, ""
+}
+
+// rejectLongPath writes an error and returns true if the request path exceeds the
+// configured limits
+func (h *Handler) rejectLongPath(w http.ResponseWriter, r *http.Request) bool {
+	cfg := h.getConfig()
+	if cfg == nil {
+		return false
+	}
+	status, reason := checkPathLimits(cfg.Server.PathLimits, r.URL.Path)
+	if status == 0 {
+		return false
+	}
+	PathRejections.WithLabelValues(reason).Inc()
+	http.Error(w, http.StatusText(status), status)
+	return true
+}
@@ -0,0 +1,75 @@
+package files
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckPathLimits(t *testing.T) {
+	limits := config.PathLimits{MaxLength: 100, MaxSegments: 5, MaxSegmentLength: 20}
+
+	tests := []struct {
+		name       string
+		limits     config.PathLimits
+		path       string
+		wantStatus int
+		wantReason string
+	}{
+		{"root", limits, "/", 0, ""},
+		{"within limits", limits, "/target/a/b/c/file.iso", 0, ""},
+		{"empty segments ignored", limits, "/target//a///b/", 0, ""},
+		{"too long", limits, "/" + strings.Repeat("a/", 60), http.StatusRequestURITooLong, "length"},
+		{"too many segments", limits, "/a/b/c/d/e/f", http.StatusRequestURITooLong, "segments"},
+		{"segment too long", limits, "/target/" + strings.Repeat("x", 21), http.StatusBadRequest, "segment_length"},
+		{"disabled", config.PathLimits{}, "/" + strings.Repeat(strings.Repeat("x", 300)+"/", 100), 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reason := checkPathLimits(tt.limits, tt.path)
+			if status != tt.wantStatus || reason != tt.wantReason {
+				t.Errorf("Expected %d %q, got %d %q", tt.wantStatus, tt.wantReason, status, reason)
+			}
+		})
+	}
+}
+
+func TestHandlerRejectsLongPaths(t *testing.T) {
+	cfg := &config.Config{Server: config.Server{PathLimits: config.PathLimits{MaxLength: 64, MaxSegments: 4, MaxSegmentLength: 16}}}
+	handler, err := NewHandler(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+		reason string
+	}{
+		{"/" + strings.Repeat("a", 70), http.StatusRequestURITooLong, "length"},
+		{"/a/b/c/d/e", http.StatusRequestURITooLong, "segments"},
+		{"/" + strings.Repeat("a", 17), http.StatusBadRequest, "segment_length"},
+		{"/a/b/missing.txt", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		var before float64
+		if tt.reason != "" {
+			before = testutil.ToFloat64(PathRejections.WithLabelValues(tt.reason))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, w.Code)
+		}
+		if tt.reason != "" {
+			if got := testutil.ToFloat64(PathRejections.WithLabelValues(tt.reason)) - before; got != 1 {
+				t.Errorf("%s: expected one %s rejection, got %v", tt.path, tt.reason, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package files
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+const (
+	// previewPrefix is the URL prefix of preview pages
+	previewPrefix = "/preview/"
+	// maxPreviewBytes is the largest file rendered as a preview page
+	maxPreviewBytes = 1024 * 1024
+	// binarySniffBytes is how much of a file is checked for NUL bytes
+	binarySniffBytes = 8 * 1024
+)
+
+// previewLanguages maps previewable extensions to the highlighting rules applied
+var previewLanguages = map[string]string{
+	".txt": "", ".log": "", ".md": "", ".csv": "", ".diff": "", ".patch": "", ".json": "", ".xml": "",
+	".yaml": "hash", ".yml": "hash", ".toml": "hash", ".ini": "hash", ".conf": "hash", ".cfg": "hash",
+	".sh": "shell", ".py": "python",
+	".go": "go", ".c": "c", ".h": "c", ".js": "js", ".ts": "js", ".css": "c", ".java": "c", ".rs": "c", ".sql": "sql",
+}
+
+// keywords per highlighting language
+var previewKeywords = map[string]map[string]bool{
+	"go":     wordSet("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false"),
+	"c":      wordSet("auto break case char const continue default do double else enum extern float for goto if int long return short signed sizeof static struct switch typedef union unsigned void volatile while class public private protected new fn let mut impl use pub true false null"),
+	"js":     wordSet("async await break case catch class const continue default delete do else export extends false finally for function if import in instanceof let new null return switch this throw true try typeof undefined var void while yield"),
+	"python": wordSet("and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield"),
+	"shell":  wordSet("if then else elif fi for while until do done case esac in function return local export set"),
+	"sql":    wordSet("SELECT FROM WHERE INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER INDEX JOIN LEFT RIGHT INNER OUTER ON AND OR NOT NULL AS ORDER BY GROUP LIMIT select from where insert into values update set delete create table drop alter index join left right inner outer on and or not null as order by group limit"),
+}
+
+// previewPage is the data rendered by the preview template
+type previewPage struct {
+	Name string
+	Path string
+	Dir  string
+	// Base is the path prefix the server is published under
+	Base     string
+	Size     int64
+	Language string
+	Lines    []template.HTML
+}
+
+// wordSet builds a keyword set from a space-separated list
+func wordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// isPreviewable reports whether a file gets a preview link in the listing
+func isPreviewable(name string, size int64) bool {
+	_, ok := previewLanguages[strings.ToLower(filepath.Ext(name))]
+	return ok && size <= maxPreviewBytes
+}
+
+// previewURL returns the preview page URL of the file at urlPath
+func previewURL(urlPath string) string {
+	return previewPrefix + strings.TrimPrefix(filepath.ToSlash(urlPath), "/")
+}
+
+// servePreview renders a text file with line numbers. Oversized, binary or unknown
+// files are redirected to the raw file instead.
+func (h *Handler) servePreview(w http.ResponseWriter, r *http.Request, filePath, urlPath string) {
+	base := httpPkg.BasePath(r)
+	raw := (&url.URL{Path: base + "/" + filepath.ToSlash(urlPath)}).String()
+
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if stat.IsDir() || !isPreviewable(stat.Name(), stat.Size()) {
+		http.Redirect(w, r, raw, http.StatusFound)
+		return
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		http.Error(w, "Failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// The file may have grown since the stat; never read more than the limit
+	data, err := io.ReadAll(io.LimitReader(file, maxPreviewBytes+1))
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	if len(data) > maxPreviewBytes || isBinary(data) {
+		http.Redirect(w, r, raw, http.StatusFound)
+		return
+	}
+
+	language := previewLanguages[strings.ToLower(filepath.Ext(stat.Name()))]
+	text := strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	page := previewPage{
+		Name:     stat.Name(),
+		Path:     filepath.ToSlash(urlPath),
+		Dir:      filepath.ToSlash(filepath.Dir(urlPath)),
+		Base:     base,
+		Size:     stat.Size(),
+		Language: language,
+	}
+	if page.Dir == "." {
+		page.Dir = ""
+	}
+	for _, line := range strings.Split(text, "\n") {
+		page.Lines = append(page.Lines, highlightLine(line, language))
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := renderTemplate(w, h.preview, page); err != nil {
+		http.Error(w, "Failed to render preview", http.StatusInternalServerError)
+	}
+}
+
+// isBinary reports whether data looks like binary content
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), binarySniffBytes)], 0) >= 0 || !utf8.Valid(data)
+}
+
+// highlightLine escapes a single line and wraps comments, strings, numbers and
+// keywords of the given language in spans. Constructs spanning several lines are
+// not tracked; each line is highlighted on its own.
+func highlightLine(line, language string) template.HTML {
+	if language == "" {
+		return template.HTML(html.EscapeString(line))
+	}
+
+	keywords := previewKeywords[language]
+	var out strings.Builder
+	span := func(class, text string) {
+		out.WriteString(`<span class="` + class + `">`)
+		out.WriteString(html.EscapeString(text))
+		out.WriteString(`</span>`)
+	}
+
+	for i := 0; i < len(line); {
+		c := line[i]
+		rest := line[i:]
+
+		switch {
+		case isCommentStart(rest, language, i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			span("c", rest)
+			return template.HTML(out.String())
+
+		case c == '"' || c == '\'' || (c == '`' && language != "hash"):
+			end := i + 1
+			for end < len(line) && line[end] != c {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(line))
+			span("s", line[i:end])
+			i = end
+
+		case c >= '0' && c <= '9' && (i == 0 || !isWordByte(line[i-1])):
+			end := i
+			for end < len(line) && (isWordByte(line[end]) || line[end] == '.') {
+				end++
+			}
+			span("n", line[i:end])
+			i = end
+
+		case isWordByte(c):
+			end := i
+			for end < len(line) && isWordByte(line[end]) {
+				end++
+			}
+			if word := line[i:end]; keywords[word] {
+				span("k", word)
+			} else {
+				out.WriteString(html.EscapeString(word))
+			}
+			i = end
+
+		default:
+			_, size := utf8.DecodeRuneInString(rest)
+			out.WriteString(html.EscapeString(rest[:size]))
+			i += size
+		}
+	}
+
+	return template.HTML(out.String())
+}
+
+// isCommentStart reports whether a line comment of the language starts at rest
+func isCommentStart(rest, language string, atWordStart bool) bool {
+	switch language {
+	case "hash", "shell", "python":
+		return rest[0] == '#' && atWordStart
+	case "sql":
+		return strings.HasPrefix(rest, "--")
+	default:
+		return strings.HasPrefix(rest, "//") || strings.HasPrefix(rest, "/*")
+	}
+}
+
+// isWordByte reports whether b can be part of an identifier
+func isWordByte(b byte) bool {
+	return b == '_' || b < utf8.RuneSelf && (unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)))
+}
+
+// Preview page HTML template, styled like the directory listing
+const previewTemplate = `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Name}} - /{{.Path}}</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            margin: 40px;
+            background-color: #f5f5f5;
+            line-height: 1.6;
+        }
+        .container {
+            max-width: 1200px;
+            margin: 0 auto;
+            background: white;
+            padding: 30px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            color: #333;
+            border-bottom: 2px solid #007acc;
+            padding-bottom: 10px;
+            margin-bottom: 20px;
+            word-break: break-all;
+        }
+        .actions {
+            margin-bottom: 20px;
+            font-size: 14px;
+        }
+        .actions a {
+            display: inline-block;
+            padding: 8px 16px;
+            margin-right: 8px;
+            background-color: #007acc;
+            color: white;
+            text-decoration: none;
+            border-radius: 4px;
+        }
+        .actions a:hover {
+            background-color: #005999;
+        }
+        .actions .meta {
+            color: #666;
+        }
+        .code-view {
+            overflow-x: auto;
+            border: 1px solid #eee;
+            border-radius: 4px;
+        }
+        table {
+            border-collapse: collapse;
+            width: 100%;
+            font-family: 'Monaco', 'Menlo', monospace;
+            font-size: 13px;
+            line-height: 1.5;
+        }
+        td.ln {
+            width: 1%;
+            padding: 0 12px;
+            text-align: right;
+            background-color: #f8f9fa;
+            border-right: 1px solid #eee;
+            user-select: none;
+        }
+        td.ln a {
+            color: #999;
+            text-decoration: none;
+        }
+        td.code {
+            padding: 0 12px;
+            white-space: pre;
+        }
+        tr:target {
+            background-color: #fff8c5;
+        }
+        .c { color: #6a737d; }
+        .s { color: #032f62; }
+        .n { color: #005cc5; }
+        .k { color: #d73a49; font-weight: 600; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Name}}</h1>
+        <div class="actions">
+            <a href="{{.Base}}/{{.Dir}}{{if .Dir}}/{{end}}">📁 Back to directory</a>
+            <a href="{{.Base}}/{{.Path}}">View raw</a>
+            <a href="{{.Base}}/{{.Path}}?download=1">Download</a>
+            <span class="meta">{{.Size | formatSize}} • {{len .Lines}} lines</span>
+        </div>
+        <div class="code-view">
+            <table>
+                <tbody>
+                    {{range $i, $line := .Lines}}
+                    <tr id="L{{inc $i}}"><td class="ln"><a href="#L{{inc $i}}">{{inc $i}}</a></td><td class="code">{{$line}}</td></tr>
+                    {{end}}
+                </tbody>
+            </table>
+        </div>
+    </div>
+</body>
+</html>`
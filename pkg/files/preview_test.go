@@ -0,0 +1,160 @@
+package files
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestHighlightLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		language string
+		expected string
+	}{
+		{"plain text is escaped", `<script>alert("x")</script>`, "", `&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`},
+		{"go keyword and string", `return "a<b"`, "go", `<span class="k">return</span> <span class="s">&#34;a&lt;b&#34;</span>`},
+		{"go comment", `x := 1 // done`, "go", `x := <span class="n">1</span> <span class="c">// done</span>`},
+		{"yaml comment", `key: value # note`, "hash", `key: value <span class="c"># note</span>`},
+		{"hash inside word is not a comment", `url: a#b`, "hash", `url: a#b`},
+		{"escaped quote in string", `"a\"b" c`, "python", `<span class="s">&#34;a\&#34;b&#34;</span> c`},
+		{"unterminated string", `'abc`, "shell", `<span class="s">&#39;abc</span>`},
+		{"identifier with digits", `var x1 = 42`, "js", `<span class="k">var</span> x1 = <span class="n">42</span>`},
+		{"sql comment", `SELECT 1 -- one`, "sql", `<span class="k">SELECT</span> <span class="n">1</span> <span class="c">-- one</span>`},
+		{"non-ascii text", `// größe`, "go", `<span class="c">// größe</span>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(highlightLine(tt.line, tt.language)); got != tt.expected {
+				t.Errorf("highlightLine(%q, %q)\n got: %s\nwant: %s", tt.line, tt.language, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestServePreview(t *testing.T) {
+	tempDir := t.TempDir()
+	os.MkdirAll(filepath.Join(tempDir, "logs"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "logs", "app.log"), []byte("first <line>\nsecond line\n"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "logs", "binary.log"), []byte("text\x00more"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "logs", "big.log"), []byte(strings.Repeat("x", maxPreviewBytes+1)), 0644)
+	os.WriteFile(filepath.Join(tempDir, "logs", "archive.zip"), []byte("PK"), 0644)
+
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/preview/logs/app.log", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`first &lt;line&gt;`,
+		`id="L2"`,
+		`href="/logs/app.log"`,
+		`href="/logs/app.log?download=1"`,
+		`href="/logs/"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected preview to contain %q", want)
+		}
+	}
+	if strings.Contains(body, `id="L3"`) {
+		t.Error("Expected no extra line for the trailing newline")
+	}
+	if strings.Contains(body, "<script") || strings.Contains(body, " onclick=") {
+		t.Error("Preview must not contain scripts or inline event handlers")
+	}
+
+	// Files that cannot be previewed fall back to raw serving
+	for _, name := range []string{"binary.log", "big.log", "archive.zip"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/preview/logs/"+name, nil))
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/logs/"+name {
+			t.Errorf("Expected %s to redirect to the raw file, got %d %s", name, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/preview/logs/missing.log", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing file, got %d", w.Code)
+	}
+}
+
+func TestListingLinksPreviews(t *testing.T) {
+	tempDir := t.TempDir()
+	os.WriteFile(filepath.Join(tempDir, "config.yaml"), []byte("a: 1\n"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "image.iso"), []byte("iso"), 0644)
+
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+
+	if !strings.Contains(body, `href="/preview/config.yaml"`) {
+		t.Error("Expected a preview link for text files")
+	}
+	if strings.Contains(body, "/preview/image.iso") {
+		t.Error("Expected no preview link for binary types")
+	}
+}
+
+func TestPreviewProtectedAndShadowed(t *testing.T) {
+	tempDir := t.TempDir()
+	os.MkdirAll(filepath.Join(tempDir, "private"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "private", "notes.txt"), []byte("secret"), 0644)
+
+	cfg := &config.Config{Targets: []config.Target{{Name: "private", Protected: true}}}
+	handler, err := NewHandler(tempDir, cfg)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/preview/private/notes.txt", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for previews of protected targets, got %d", w.Code)
+	}
+
+	// A mirrored target named "preview" wins over preview pages
+	os.MkdirAll(filepath.Join(tempDir, "preview"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "preview", "file.txt"), []byte("mirrored"), 0644)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/preview/file.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "mirrored" {
+		t.Errorf("Expected the mirrored file, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestServeFileDownload(t *testing.T) {
+	tempDir := t.TempDir()
+	os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte("text"), 0644)
+
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/notes.txt?download=1", nil))
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=notes.txt` {
+		t.Errorf("Expected attachment disposition, got %q", cd)
+	}
+}
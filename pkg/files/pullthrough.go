@@ -0,0 +1,181 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pullThroughWait bounds how long a request for a missing file waits for the
+// upstream to start sending it before it is answered with 404
+var pullThroughWait = 10 * time.Second
+
+// errPullThroughTimeout ends a pull-through fetch whose upstream did not answer
+// within pullThroughWait
+var errPullThroughTimeout = errors.New("upstream did not answer in time")
+
+// PullThroughFetches counts requests for missing files of targets with
+// Target.PullThrough by result: "fetched" from the upstream, "coalesced" into a
+// fetch already running, or "failed". It is registered by the server binary.
+var PullThroughFetches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_mirror_pull_through_requests_total",
+		Help: "Total number of requests for missing files answered through the upstream",
+	},
+	[]string{"result"},
+)
+
+// pullFetch is a running fetch of a missing file; requests for the same file wait
+// for it and are served from disk once it is done
+type pullFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// pullThrough coalesces the fetches of missing files by local path
+type pullThrough struct {
+	mu      sync.Mutex
+	fetches map[string]*pullFetch
+	// manifestMu serializes the manifest updates of completed fetches
+	manifestMu sync.Mutex
+}
+
+func newPullThrough() *pullThrough {
+	return &pullThrough{fetches: make(map[string]*pullFetch)}
+}
+
+// pullThroughTarget returns the target urlPath belongs to if missing files of it may
+// be fetched from the upstream, or nil. Frozen targets are never written to.
+func (h *Handler) pullThroughTarget(urlPath string) *config.Target {
+	cfg := h.getConfig()
+	if cfg == nil {
+		return nil
+	}
+	name := targetOf(urlPath)
+	for i := range cfg.Targets {
+		if t := &cfg.Targets[i]; t.Name == name && t.PullThrough && !t.Frozen {
+			return t
+		}
+	}
+	return nil
+}
+
+// servePullThrough answers a GET request for urlPath, which does not exist, with the
+// file fetched from the upstream of its target if the target has
+// Target.PullThrough. The first request streams the file as it is stored at
+// filePath and recorded in the manifest; concurrent requests for it wait and are
+// served the stored file. It reports whether the request was handled; failures are
+// left for the caller to answer with 404.
+func (h *Handler) servePullThrough(w http.ResponseWriter, r *http.Request, urlPath, filePath string) bool {
+	if r.Method != http.MethodGet || strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	urlPath = filepath.ToSlash(filepath.Clean(urlPath))
+	target := h.pullThroughTarget(urlPath)
+	if target == nil {
+		return false
+	}
+	rel, ok := strings.CutPrefix(urlPath, target.Name+"/")
+	if !ok || rel == "" {
+		return false
+	}
+	upstream, err := url.JoinPath(target.URL, rel)
+	if err != nil {
+		return false
+	}
+
+	h.pulls.mu.Lock()
+	fetch, running := h.pulls.fetches[filePath]
+	if !running {
+		fetch = &pullFetch{done: make(chan struct{})}
+		h.pulls.fetches[filePath] = fetch
+	}
+	h.pulls.mu.Unlock()
+
+	if running {
+		select {
+		case <-fetch.done:
+		case <-r.Context().Done():
+			return true
+		}
+		if fetch.err != nil {
+			return false
+		}
+		PullThroughFetches.WithLabelValues("coalesced").Inc()
+		h.serveFile(w, r, filePath)
+		return true
+	}
+
+	started := false
+	fetch.err = h.fetchPullThrough(w, r, target, upstream, rel, filePath, &started)
+	h.pulls.mu.Lock()
+	delete(h.pulls.fetches, filePath)
+	h.pulls.mu.Unlock()
+	close(fetch.done)
+
+	if fetch.err != nil {
+		PullThroughFetches.WithLabelValues("failed").Inc()
+		// A truncated response must not look complete to the client
+		if started && r.Context().Err() == nil {
+			panic(http.ErrAbortHandler)
+		}
+		return started
+	}
+	PullThroughFetches.WithLabelValues("fetched").Inc()
+	return true
+}
+
+// fetchPullThrough streams upstream to w while storing it at filePath, and records
+// it in the manifest of target. The fetch continues when the client goes away, so
+// that requests waiting for it are served. started is set once the response was
+// begun. A file missing from the manifest is recorded by the next sync.
+func (h *Handler) fetchPullThrough(w http.ResponseWriter, r *http.Request, target *config.Target, upstream, rel, filePath string, started *bool) error {
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(r.Context()))
+	defer cancel(nil)
+	timer := time.AfterFunc(pullThroughWait, func() { cancel(errPullThroughTimeout) })
+
+	client := httpPkg.NewClient(target)
+	digest, err := client.StreamFile(ctx, upstream, filePath, w, func(header http.Header) error {
+		if !timer.Stop() {
+			return context.Cause(ctx)
+		}
+		w.Header().Set("Content-Type", getContentType(filepath.Ext(filePath)))
+		for _, name := range []string{"Content-Length", "Last-Modified"} {
+			if value := header.Get(name); value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+		if r.URL.Query().Has("sig") {
+			w.Header().Set("Cache-Control", "private, no-store")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		}
+		w.WriteHeader(http.StatusOK)
+		*started = true
+		return nil
+	})
+	timer.Stop()
+	if err != nil {
+		return err
+	}
+
+	source := mirror.FileSource{URL: upstream, FinalURL: digest.FinalURL, FetchedAt: time.Now().UTC(), SHA256: digest.SHA256, MD5: digest.MD5}
+	if stat, err := os.Stat(filePath); err == nil {
+		source.Size, source.ModTime = stat.Size(), stat.ModTime().UTC()
+	}
+	h.pulls.manifestMu.Lock()
+	defer h.pulls.manifestMu.Unlock()
+	mirror.RecordFile(filepath.Join(h.rootPath, target.Name), rel, source)
+	return nil
+}
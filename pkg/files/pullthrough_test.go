@@ -0,0 +1,120 @@
+package files
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// newPullThroughHandler serves the targets "debian", with Target.PullThrough, and
+// "plain", without, from the same upstream
+func newPullThroughHandler(t *testing.T, upstream string) (*Handler, string) {
+	t.Helper()
+	root := t.TempDir()
+	cfg := &config.Config{Targets: []config.Target{
+		{Name: "debian", URL: upstream + "/", PullThrough: true, Timeout: 5},
+		{Name: "plain", URL: upstream + "/", Timeout: 5},
+	}}
+	handler, err := NewHandler(root, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler, root
+}
+
+func TestServePullThrough(t *testing.T) {
+	var requests atomic.Int64
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/pool/a.deb" {
+			http.NotFound(w, r)
+			return
+		}
+		<-release
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		io.WriteString(w, "package")
+	}))
+	defer upstream.Close()
+	handler, root := newPullThroughHandler(t, upstream.URL)
+
+	// Concurrent requests share a single upstream fetch
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 3)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(responses[i], httptest.NewRequest("GET", "/debian/pool/a.deb", nil))
+		}()
+	}
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != "package" {
+			t.Errorf("Request %d: expected the fetched file, got %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected a single upstream request, got %d", requests.Load())
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "debian/pool/a.deb")); err != nil || string(data) != "package" {
+		t.Errorf("Expected the file to be stored, got %q (%v)", data, err)
+	}
+	manifest, _ := mirror.LoadManifest(filepath.Join(root, "debian"))
+	if source, ok := manifest.Lookup("pool/a.deb"); !ok || source.URL != upstream.URL+"/pool/a.deb" || source.Size != 7 || source.SHA256 == "" {
+		t.Errorf("Expected the file recorded in the manifest, got %+v", source)
+	}
+
+	for _, path := range []string{"/debian/pool/missing.deb", "/plain/pool/a.deb"} {
+		requests.Store(0)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+		if expected := map[bool]int64{true: 1, false: 0}[path == "/debian/pool/missing.deb"]; requests.Load() != expected {
+			t.Errorf("%s: expected %d upstream requests, got %d", path, expected, requests.Load())
+		}
+	}
+}
+
+func TestServePullThroughTimesOut(t *testing.T) {
+	wait := pullThroughWait
+	pullThroughWait = 20 * time.Millisecond
+	t.Cleanup(func() { pullThroughWait = wait })
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	handler, root := newPullThroughHandler(t, upstream.URL)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debian/slow.deb", nil))
+	if w.Code != http.StatusNotFound || time.Since(start) > 2*time.Second {
+		t.Errorf("Expected a quick 404, got %d after %v", w.Code, time.Since(start))
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "debian")); len(entries) != 0 {
+		t.Errorf("Expected nothing stored, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,93 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRenderBytes caps the size of a rendered HTML page; larger directory listings
+// fall back to plain text
+var maxRenderBytes = 32 * 1024 * 1024
+
+// maxPooledBufferBytes is the largest buffer returned to the pool; bigger ones are
+// left to the garbage collector so one huge page does not pin memory
+const maxPooledBufferBytes = 1024 * 1024
+
+// errRenderTooLarge is returned when a page exceeds maxRenderBytes
+var errRenderTooLarge = errors.New("rendered page too large")
+
+// renderBuffers holds reusable buffers for page rendering
+var renderBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// cappedBuffer is a writer that fails once more than limit bytes are written
+type cappedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+// Write implements io.Writer
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.buf.Len()+len(p) > c.limit {
+		return 0, errRenderTooLarge
+	}
+	return c.buf.Write(p)
+}
+
+// renderTemplate executes tmpl into a pooled buffer and only writes the response
+// once rendering succeeded, so a failing template never leaves a half-written 200
+// behind. Nothing is written on error; the caller sends the error response.
+func renderTemplate(w http.ResponseWriter, tmpl *template.Template, data any) error {
+	buf := renderBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBufferBytes {
+			renderBuffers.Put(buf)
+		}
+	}()
+
+	if err := tmpl.Execute(&cappedBuffer{buf: buf, limit: maxRenderBytes}, data); err != nil {
+		if errors.Is(err, errRenderTooLarge) {
+			return errRenderTooLarge
+		}
+		return fmt.Errorf("failed to execute %s template: %w", tmpl.Name(), err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writePlainListing writes a directory listing as plain text, one entry per line,
+// for directories too large to render as HTML
+func writePlainListing(w http.ResponseWriter, listing DirectoryListing) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	var line []byte
+	for _, file := range listing.Files {
+		line = append(line[:0], file.Name...)
+		if file.IsDir {
+			line = append(line, '/')
+		}
+		line = append(line, '\t')
+		if file.Decompressed {
+			line = append(line, '-')
+		} else {
+			line = strconv.AppendInt(line, file.Size, 10)
+		}
+		line = append(line, '\t')
+		line = file.ModTime.UTC().AppendFormat(line, time.RFC3339)
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package files
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeDirectoryBrokenTemplate(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tempDir, "file.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	// Fails halfway through, after some output has been produced
+	handler.template = template.Must(template.New("broken").Parse(
+		`<html>{{range .Files}}<p>{{.Name}}</p>{{end}}{{.NoSuchField}}</html>`))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "<p>file.txt</p>") {
+		t.Error("Expected no partial listing in the error response")
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected a plain error page, got Content-Type %q", ct)
+	}
+}
+
+func TestServeDirectoryTooLargeFallsBackToPlainText(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(tempDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewHandler(tempDir, nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	limit := maxRenderBytes
+	maxRenderBytes = 100
+	defer func() { maxRenderBytes = limit }()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Expected plain-text fallback, got Content-Type %q", ct)
+	}
+
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "sub/\t") || !strings.HasPrefix(lines[1], "a.txt\t5\t") {
+		t.Errorf("Unexpected plain listing:\n%s", w.Body.String())
+	}
+}
+
+func TestRenderTemplateSetsLength(t *testing.T) {
+	tmpl := template.Must(template.New("ok").Parse(`<p>{{.}}</p>`))
+
+	w := httptest.NewRecorder()
+	if err := renderTemplate(w, tmpl, "hi"); err != nil {
+		t.Fatalf("renderTemplate failed: %v", err)
+	}
+	if w.Body.String() != "<p>hi</p>" || w.Header().Get("Content-Length") != "9" {
+		t.Errorf("Unexpected response %q with length %q", w.Body.String(), w.Header().Get("Content-Length"))
+	}
+}
@@ -0,0 +1,157 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Errors returned when verifying signed URLs
+var (
+	ErrSignatureMissing = errors.New("signed URL required")
+	ErrSignatureInvalid = errors.New("invalid URL signature")
+	ErrSignatureExpired = errors.New("signed URL expired")
+	ErrSigningDisabled  = errors.New("no signing secrets configured")
+)
+
+// SignatureRejections counts requests rejected because of a missing, invalid or
+// expired signature. It is registered by the server binary.
+var SignatureRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_mirror_signed_url_rejections_total",
+		Help: "Total number of requests rejected by signed URL validation",
+	},
+	[]string{"reason"},
+)
+
+// Signer mints and verifies HMAC-signed URLs
+type Signer struct {
+	secrets [][]byte
+	maxTTL  time.Duration
+	skew    time.Duration
+	now     func() time.Time
+}
+
+// NewSigner creates a signer from the signed URL configuration
+func NewSigner(cfg config.SignedURLs) *Signer {
+	s := &Signer{
+		maxTTL: time.Duration(cfg.MaxTTL) * time.Second,
+		skew:   time.Duration(cfg.ClockSkew) * time.Second,
+		now:    time.Now,
+	}
+	for _, secret := range cfg.Secrets {
+		if secret != "" {
+			s.secrets = append(s.secrets, []byte(secret))
+		}
+	}
+	return s
+}
+
+// Enabled reports whether at least one signing secret is configured
+func (s *Signer) Enabled() bool {
+	return len(s.secrets) > 0
+}
+
+// Sign returns urlPath with exp and sig query parameters valid for ttl, along with
+// the expiry time. The signature covers the cleaned path and the expiry only.
+func (s *Signer) Sign(urlPath string, ttl time.Duration) (string, time.Time, error) {
+	if !s.Enabled() {
+		return "", time.Time{}, ErrSigningDisabled
+	}
+	if ttl <= 0 {
+		return "", time.Time{}, fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	if s.maxTTL > 0 && ttl > s.maxTTL {
+		return "", time.Time{}, fmt.Errorf("ttl %s exceeds maximum of %s", ttl, s.maxTTL)
+	}
+
+	urlPath = canonicalPath(urlPath)
+	expires := s.now().Add(ttl).Truncate(time.Second)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("exp", exp)
+	query.Set("sig", signature(s.secrets[0], urlPath, exp))
+
+	return (&url.URL{Path: urlPath, RawQuery: query.Encode()}).String(), expires, nil
+}
+
+// Verify checks the exp and sig query parameters of a request for urlPath. Any of
+// the configured secrets is accepted. Expiry is checked with the configured clock
+// skew tolerance, and links expiring further out than the maximum TTL are rejected.
+func (s *Signer) Verify(urlPath string, query url.Values) error {
+	exp, sig := query.Get("exp"), query.Get("sig")
+	if exp == "" && sig == "" {
+		return ErrSignatureMissing
+	}
+	if !s.Enabled() || exp == "" || sig == "" {
+		return ErrSignatureInvalid
+	}
+
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+
+	urlPath = canonicalPath(urlPath)
+	valid := false
+	for _, secret := range s.secrets {
+		if hmac.Equal([]byte(sig), []byte(signature(secret, urlPath, exp))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrSignatureInvalid
+	}
+
+	now := s.now()
+	expires := time.Unix(expUnix, 0)
+	if now.After(expires.Add(s.skew)) {
+		return ErrSignatureExpired
+	}
+	if s.maxTTL > 0 && expires.After(now.Add(s.maxTTL+s.skew)) {
+		return ErrSignatureInvalid
+	}
+
+	return nil
+}
+
+// signatureReason maps a verification error to the rejection metric label
+func signatureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrSignatureMissing):
+		return "missing"
+	case errors.Is(err, ErrSignatureExpired):
+		return "expired"
+	default:
+		return "invalid"
+	}
+}
+
+// signature computes the URL-safe HMAC-SHA256 of path and expiry
+func signature(secret []byte, urlPath, exp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(urlPath))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalPath cleans urlPath so equivalent spellings share a signature
+func canonicalPath(urlPath string) string {
+	cleaned := path.Clean("/" + urlPath)
+	if len(urlPath) > 1 && urlPath[len(urlPath)-1] == '/' && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
@@ -0,0 +1,221 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestSigner returns a signer with a controllable clock
+func newTestSigner(secrets []string, now *time.Time) *Signer {
+	s := NewSigner(config.SignedURLs{Secrets: secrets, MaxTTL: 3600, ClockSkew: 30})
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+// signedQuery signs urlPath and returns the resulting query parameters
+func signedQuery(t *testing.T, s *Signer, urlPath string, ttl time.Duration) url.Values {
+	t.Helper()
+	signed, _, err := s.Sign(urlPath, ttl)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("Failed to parse signed URL: %v", err)
+	}
+	return parsed.Query()
+}
+
+func TestSignAndVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestSigner([]string{"secret"}, &now)
+
+	query := signedQuery(t, s, "/target/file.iso", time.Minute)
+	if err := s.Verify("/target/file.iso", query); err != nil {
+		t.Errorf("Expected valid signature, got %v", err)
+	}
+
+	// Equivalent spellings of the path share the signature
+	if err := s.Verify("/target//./file.iso", query); err != nil {
+		t.Errorf("Expected cleaned path to verify, got %v", err)
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newTestSigner([]string{"secret"}, &now)
+	query := signedQuery(t, s, "/target/file.iso", time.Minute)
+
+	tests := []struct {
+		name  string
+		path  string
+		query func() url.Values
+		want  error
+	}{
+		{"other path", "/target/other.iso", func() url.Values { return query }, ErrSignatureInvalid},
+		{"extended expiry", "/target/file.iso", func() url.Values {
+			q := url.Values{"exp": {"1700003000"}, "sig": query["sig"]}
+			return q
+		}, ErrSignatureInvalid},
+		{"garbage signature", "/target/file.iso", func() url.Values {
+			return url.Values{"exp": query["exp"], "sig": {"AAAA"}}
+		}, ErrSignatureInvalid},
+		{"missing signature", "/target/file.iso", func() url.Values {
+			return url.Values{"exp": query["exp"]}
+		}, ErrSignatureInvalid},
+		{"non-numeric expiry", "/target/file.iso", func() url.Values {
+			return url.Values{"exp": {"soon"}, "sig": query["sig"]}
+		}, ErrSignatureInvalid},
+		{"no parameters", "/target/file.iso", func() url.Values { return url.Values{} }, ErrSignatureMissing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Verify(tt.path, tt.query()); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestVerifyClockSkew(t *testing.T) {
+	issued := time.Unix(1700000000, 0)
+	now := issued
+	s := newTestSigner([]string{"secret"}, &now)
+	query := signedQuery(t, s, "/target/file.iso", time.Minute)
+	expires := issued.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want error
+	}{
+		{"well before expiry", issued, nil},
+		{"exactly at expiry", expires, nil},
+		{"just after expiry within skew", expires.Add(time.Second), nil},
+		{"at the skew boundary", expires.Add(30 * time.Second), nil},
+		{"past the skew", expires.Add(31 * time.Second), ErrSignatureExpired},
+		{"verifier clock behind the signer", issued.Add(-10 * time.Minute), nil},
+		{"verifier clock far behind the signer", issued.Add(-2 * time.Hour), ErrSignatureInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = tt.now
+			err := s.Verify("/target/file.iso", query)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestSignerKeyRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	oldSigner := newTestSigner([]string{"old"}, &now)
+	query := signedQuery(t, oldSigner, "/target/file.iso", time.Minute)
+
+	rotated := newTestSigner([]string{"new", "old"}, &now)
+	if err := rotated.Verify("/target/file.iso", query); err != nil {
+		t.Errorf("Expected URL signed with a retired key to verify, got %v", err)
+	}
+
+	// New URLs are signed with the first secret only
+	newQuery := signedQuery(t, rotated, "/target/file.iso", time.Minute)
+	if err := oldSigner.Verify("/target/file.iso", newQuery); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("Expected URL from the new key to fail with only the old key, got %v", err)
+	}
+
+	dropped := newTestSigner([]string{"new"}, &now)
+	if err := dropped.Verify("/target/file.iso", query); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("Expected URL signed with a removed key to be rejected, got %v", err)
+	}
+}
+
+func TestSignLimits(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	if _, _, err := newTestSigner(nil, &now).Sign("/a", time.Minute); !errors.Is(err, ErrSigningDisabled) {
+		t.Errorf("Expected ErrSigningDisabled, got %v", err)
+	}
+
+	s := newTestSigner([]string{"secret"}, &now)
+	if _, _, err := s.Sign("/a", 2*time.Hour); err == nil {
+		t.Error("Expected TTL above the maximum to be rejected")
+	}
+	if _, _, err := s.Sign("/a", 0); err == nil {
+		t.Error("Expected zero TTL to be rejected")
+	}
+}
+
+func TestHandlerProtectedTarget(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "private"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "private", "file.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "public.txt"), []byte("public"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Targets: []config.Target{{Name: "private", Protected: true}},
+		Server: config.Server{SignedURLs: config.SignedURLs{
+			Secrets: []string{"secret"}, MaxTTL: 3600, ClockSkew: 30,
+		}},
+	}
+	handler, err := NewHandler(tempDir, cfg)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	signed, _, err := handler.Signer().Sign("/private/file.txt", time.Minute)
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+
+	rejectedBefore := testutil.ToFloat64(SignatureRejections.WithLabelValues("invalid"))
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"unsigned protected file", "/private/file.txt", http.StatusForbidden},
+		{"unsigned protected listing", "/private/", http.StatusForbidden},
+		{"signed protected file", signed, http.StatusOK},
+		{"signature reused for another path", "/public.txt?" + signed[len("/private/file.txt?"):], http.StatusForbidden},
+		{"public file", "/public.txt", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(SignatureRejections.WithLabelValues("invalid")) - rejectedBefore; got != 1 {
+		t.Errorf("Expected 1 invalid signature rejection, got %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", signed, nil))
+	if cc := w.Header().Get("Cache-Control"); cc != "private, no-store" {
+		t.Errorf("Expected signed responses to be uncacheable, got %q", cc)
+	}
+}
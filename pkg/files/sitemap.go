@@ -0,0 +1,246 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// sitemapName is the file name of the sitemap of the server and of each target
+const sitemapName = "sitemap.xml"
+
+// maxSitemapURLs is the most URLs a single sitemap may list; larger sitemaps are
+// split into a sitemap index and numbered child sitemaps
+var maxSitemapURLs = 50000
+
+// sitemapURL is a <url> entry of a sitemap
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapURLSet is the root element of a sitemap
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// sitemapIndex is the root element of a sitemap index
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// sitemapEntry is a file listed in a sitemap
+type sitemapEntry struct {
+	// path is the URL path below the data root, e.g. "/debian/README"
+	path    string
+	modTime time.Time
+}
+
+// Sitemaps holds the generated sitemaps of the server, gzipped and keyed by URL path
+type Sitemaps struct {
+	mu   sync.RWMutex
+	docs map[string][]byte
+}
+
+// NewSitemaps creates an empty sitemap store; nothing is served until Generate ran
+func NewSitemaps() *Sitemaps {
+	return &Sitemaps{docs: make(map[string][]byte)}
+}
+
+// Generate rebuilds the sitemaps from the manifests of the advertised targets:
+// /sitemap.xml for all of them and /<target>/sitemap.xml for each. Protected
+// targets, hidden files and mirror metadata are never listed.
+func (s *Sitemaps) Generate(cfg *config.Config) error {
+	docs := make(map[string][]byte)
+	if !cfg.Server.Sitemap.Enabled {
+		s.replace(docs)
+		return nil
+	}
+
+	base, err := url.Parse(strings.TrimSuffix(cfg.Server.Sitemap.BaseURL, "/"))
+	if err != nil {
+		return fmt.Errorf("invalid sitemap base URL: %w", err)
+	}
+	// The base URL may already include the path the server is published under
+	if !strings.HasSuffix(base.Path, cfg.Server.BasePath) {
+		base.Path += cfg.Server.BasePath
+		base.RawPath = ""
+	}
+
+	var all []sitemapEntry
+	for _, target := range cfg.Targets {
+		if target.Protected || !cfg.Server.Sitemap.Advertises(target.Name) {
+			continue
+		}
+		manifest, err := mirror.LoadManifest(filepath.Join(cfg.Server.DataPath, target.Name))
+		if err != nil {
+			return fmt.Errorf("target %s: %w", target.Name, err)
+		}
+
+		entries := sitemapEntries(target.Name, manifest, cfg.HiddenPatterns(target.Name))
+		if len(entries) == 0 {
+			continue
+		}
+		if err := addSitemaps(docs, base, "/"+target.Name+"/", entries); err != nil {
+			return err
+		}
+		all = append(all, entries...)
+	}
+	if err := addSitemaps(docs, base, "/", all); err != nil {
+		return err
+	}
+
+	s.replace(docs)
+	return nil
+}
+
+// replace swaps in a new set of sitemaps
+func (s *Sitemaps) replace(docs map[string][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs = docs
+}
+
+// sitemapEntries returns the files of a target manifest that may be advertised,
+// sorted by path
+func sitemapEntries(target string, manifest *mirror.Manifest, hidden []string) []sitemapEntry {
+	var entries []sitemapEntry
+	for rel, source := range manifest.Files {
+		if !advertisable(rel, hidden) {
+			continue
+		}
+		entries = append(entries, sitemapEntry{path: "/" + target + "/" + rel, modTime: source.ModTime})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries
+}
+
+// advertisable reports whether no component of the manifest path rel is hidden,
+// mirror metadata or an incomplete download
+func advertisable(rel string, hidden []string) bool {
+	for _, name := range strings.Split(rel, "/") {
+		if name == "" || name == "." || name == ".." || strings.HasPrefix(name, config.MetadataPrefix) ||
+			config.IsTempFile(name) || config.IsHidden(hidden, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// addSitemaps adds the sitemap at prefix+sitemap.xml listing entries, split into an
+// index and child sitemaps prefix+sitemap-N.xml when there are too many
+func addSitemaps(docs map[string][]byte, base *url.URL, prefix string, entries []sitemapEntry) error {
+	if len(entries) <= maxSitemapURLs {
+		return addSitemap(docs, prefix+sitemapName, sitemapURLSet{URLs: sitemapURLs(base, entries)})
+	}
+
+	var index sitemapIndex
+	for n := 0; n*maxSitemapURLs < len(entries); n++ {
+		chunk := entries[n*maxSitemapURLs : min((n+1)*maxSitemapURLs, len(entries))]
+		name := fmt.Sprintf("%ssitemap-%d.xml", prefix, n+1)
+		if err := addSitemap(docs, name, sitemapURLSet{URLs: sitemapURLs(base, chunk)}); err != nil {
+			return err
+		}
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{Loc: absoluteURL(base, name), LastMod: lastMod(newestModTime(chunk))})
+	}
+	return addSitemap(docs, prefix+sitemapName, index)
+}
+
+// addSitemap encodes and gzips a sitemap document
+func addSitemap(docs map[string][]byte, urlPath string, doc any) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	io.WriteString(gz, xml.Header)
+	if err := xml.NewEncoder(gz).Encode(doc); err != nil {
+		return fmt.Errorf("failed to encode %s: %w", urlPath, err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress %s: %w", urlPath, err)
+	}
+	docs[urlPath] = buf.Bytes()
+	return nil
+}
+
+// sitemapURLs converts entries into sitemap <url> elements
+func sitemapURLs(base *url.URL, entries []sitemapEntry) []sitemapURL {
+	urls := make([]sitemapURL, len(entries))
+	for i, entry := range entries {
+		urls[i] = sitemapURL{Loc: absoluteURL(base, entry.path), LastMod: lastMod(entry.modTime)}
+	}
+	return urls
+}
+
+// absoluteURL returns the public URL of urlPath below base
+func absoluteURL(base *url.URL, urlPath string) string {
+	u := *base
+	u.Path = base.Path + urlPath
+	u.RawPath = ""
+	return u.String()
+}
+
+// lastMod formats a modification time for <lastmod>; unknown times are left out
+func lastMod(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// newestModTime returns the latest modification time among entries
+func newestModTime(entries []sitemapEntry) time.Time {
+	var newest time.Time
+	for _, entry := range entries {
+		if entry.modTime.After(newest) {
+			newest = entry.modTime
+		}
+	}
+	return newest
+}
+
+// Middleware serves the generated sitemaps and passes all other requests to next.
+// Sitemaps are sent gzip-encoded to clients accepting it.
+func (s *Sitemaps) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		doc, ok := s.docs[r.URL.Path]
+		s.mu.RUnlock()
+		if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", fmt.Sprint(len(doc)))
+			if r.Method == http.MethodGet {
+				w.Write(doc)
+			}
+			return
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(doc))
+		if err != nil {
+			http.Error(w, "Failed to read sitemap", http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodGet {
+			io.Copy(w, gz)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package files
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// writeManifest records files with the given modification time in a target manifest
+func writeManifest(t *testing.T, dataPath, target string, modTime time.Time, rels ...string) {
+	t.Helper()
+	manifest := mirror.Manifest{Files: make(map[string]mirror.FileSource)}
+	for _, rel := range rels {
+		manifest.Files[rel] = mirror.FileSource{ModTime: modTime}
+	}
+	data, _ := json.Marshal(manifest)
+	if err := os.MkdirAll(filepath.Join(dataPath, target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataPath, target, mirror.ManifestFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fetchSitemap requests urlPath through the sitemap middleware and decodes the
+// response into doc
+func fetchSitemap(t *testing.T, handler http.Handler, urlPath string, doc any) {
+	t.Helper()
+	req := httptest.NewRequest("GET", urlPath, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("%s: expected gzipped sitemap, got %d %v", urlPath, w.Code, w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.NewDecoder(gz).Decode(doc); err != nil {
+		t.Fatalf("%s: failed to decode sitemap: %v", urlPath, err)
+	}
+}
+
+func TestSitemaps(t *testing.T) {
+	dataPath := t.TempDir()
+	modTime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	writeManifest(t, dataPath, "debian", modTime, "README", "pool/a b.deb", ".hidden", "pool/.git/config", "pool/x.deb.part")
+	writeManifest(t, dataPath, "secret", modTime, "key.pem")
+	writeManifest(t, dataPath, "internal", modTime, "notes.txt")
+
+	cfg := &config.Config{
+		Defaults: config.Defaults{Hidden: config.DefaultHidden},
+		Server: config.Server{
+			DataPath: dataPath,
+			Sitemap:  config.Sitemap{Enabled: true, BaseURL: "https://mirror.example.com/", Exclude: []string{"intern*"}},
+		},
+		Targets: []config.Target{
+			{Name: "debian"},
+			{Name: "secret", Protected: true},
+			{Name: "internal"},
+			{Name: "empty"},
+		},
+	}
+
+	sitemaps := NewSitemaps()
+	if err := sitemaps.Generate(cfg); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "from file handler", http.StatusTeapot)
+	})
+	handler := sitemaps.Middleware(next)
+
+	want := []sitemapURL{
+		{Loc: "https://mirror.example.com/debian/README", LastMod: "2024-06-01T12:00:00Z"},
+		{Loc: "https://mirror.example.com/debian/pool/a%20b.deb", LastMod: "2024-06-01T12:00:00Z"},
+	}
+	for _, urlPath := range []string{"/sitemap.xml", "/debian/sitemap.xml"} {
+		var set sitemapURLSet
+		fetchSitemap(t, handler, urlPath, &set)
+		if len(set.URLs) != len(want) {
+			t.Fatalf("%s: expected %v, got %v", urlPath, want, set.URLs)
+		}
+		for i := range want {
+			if set.URLs[i] != want[i] {
+				t.Errorf("%s: expected %v, got %v", urlPath, want[i], set.URLs[i])
+			}
+		}
+	}
+
+	// Excluded, protected and empty targets get no sitemap of their own
+	for _, urlPath := range []string{"/internal/sitemap.xml", "/secret/sitemap.xml", "/empty/sitemap.xml", "/debian/README"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", urlPath, nil))
+		if w.Code != http.StatusTeapot {
+			t.Errorf("%s: expected request to reach the file handler, got %d", urlPath, w.Code)
+		}
+	}
+
+	// Clients without gzip support get plain XML
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/sitemap.xml", nil))
+	if w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(w.Body.String(), "<?xml") {
+		t.Errorf("Expected uncompressed XML, got %v %q", w.Header(), w.Body.String())
+	}
+
+	// URLs lie below the base path, unless the base URL already ends with it
+	cfg.Server.BasePath = "/mirror"
+	for _, baseURL := range []string{"https://mirror.example.com", "https://mirror.example.com/mirror/"} {
+		cfg.Server.Sitemap.BaseURL = baseURL
+		if err := sitemaps.Generate(cfg); err != nil {
+			t.Fatalf("Generate failed: %v", err)
+		}
+		var set sitemapURLSet
+		fetchSitemap(t, handler, "/debian/sitemap.xml", &set)
+		if len(set.URLs) == 0 || set.URLs[0].Loc != "https://mirror.example.com/mirror/debian/README" {
+			t.Errorf("%s: expected URLs below the base path, got %v", baseURL, set.URLs)
+		}
+	}
+
+	// Disabling the sitemap withdraws it
+	cfg.Server.Sitemap.Enabled = false
+	if err := sitemaps.Generate(cfg); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/sitemap.xml", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("Expected no sitemap while disabled, got %d", w.Code)
+	}
+}
+
+func TestSitemapIndex(t *testing.T) {
+	defer func(limit int) { maxSitemapURLs = limit }(maxSitemapURLs)
+	maxSitemapURLs = 2
+
+	dataPath := t.TempDir()
+	older := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	writeManifest(t, dataPath, "a", older, "1", "2", "3")
+	writeManifest(t, dataPath, "b", newer, "4")
+
+	cfg := &config.Config{
+		Server: config.Server{
+			DataPath: dataPath,
+			Sitemap:  config.Sitemap{Enabled: true, BaseURL: "https://mirror.example.com/pub"},
+		},
+		Targets: []config.Target{{Name: "a"}, {Name: "b"}},
+	}
+	sitemaps := NewSitemaps()
+	if err := sitemaps.Generate(cfg); err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	handler := sitemaps.Middleware(http.NotFoundHandler())
+
+	var index sitemapIndex
+	fetchSitemap(t, handler, "/sitemap.xml", &index)
+	wantIndex := []sitemapURL{
+		{Loc: "https://mirror.example.com/pub/sitemap-1.xml", LastMod: "2024-01-01T00:00:00Z"},
+		{Loc: "https://mirror.example.com/pub/sitemap-2.xml", LastMod: "2024-06-01T00:00:00Z"},
+	}
+	if len(index.Sitemaps) != len(wantIndex) || index.Sitemaps[0] != wantIndex[0] || index.Sitemaps[1] != wantIndex[1] {
+		t.Errorf("Expected index %v, got %v", wantIndex, index.Sitemaps)
+	}
+
+	var child sitemapURLSet
+	fetchSitemap(t, handler, "/sitemap-2.xml", &child)
+	if len(child.URLs) != 2 || child.URLs[1].Loc != "https://mirror.example.com/pub/b/4" {
+		t.Errorf("Expected the second chunk to hold the last two files, got %v", child.URLs)
+	}
+
+	// Targets are split on their own
+	var targetIndex sitemapIndex
+	fetchSitemap(t, handler, "/a/sitemap.xml", &targetIndex)
+	if len(targetIndex.Sitemaps) != 2 || targetIndex.Sitemaps[0].Loc != "https://mirror.example.com/pub/a/sitemap-1.xml" {
+		t.Errorf("Expected a per-target index, got %v", targetIndex.Sitemaps)
+	}
+	var single sitemapURLSet
+	fetchSitemap(t, handler, "/b/sitemap.xml", &single)
+	if len(single.URLs) != 1 {
+		t.Errorf("Expected a plain sitemap for a small target, got %v", single.URLs)
+	}
+}
@@ -0,0 +1,284 @@
+package files
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+const (
+	// infoPrefix is the URL prefix of per-file detail pages
+	infoPrefix = "/.info/"
+	// unknownSource is reported for files without a recorded origin, e.g. data
+	// mirrored before origins were recorded
+	unknownSource = "unknown"
+	// sourceHeader carries the upstream URL of a served file when enabled
+	sourceHeader = "X-Mirror-Source"
+)
+
+// fileDetails describes a mirrored file and where it came from
+type fileDetails struct {
+	Path string `json:"path"`
+	// URL is the escaped link to the file, below the path the server is published under
+	URL     string    `json:"url"`
+	Name    string    `json:"name"`
+	Target  string    `json:"target"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// SourceURL is the upstream URL of the file, or "unknown"
+	SourceURL string `json:"source_url"`
+	// FetchedAt is when the local copy was downloaded, null if unknown
+	FetchedAt *time.Time `json:"fetched_at"`
+	// RunID is the run_id of the log records of the run that downloaded the file
+	RunID string `json:"run_id,omitempty"`
+}
+
+// cachedManifest is a loaded manifest together with the file state it was read at
+type cachedManifest struct {
+	modTime  time.Time
+	size     int64
+	manifest *mirror.Manifest
+}
+
+// sourceIndex serves file origins from the target manifests, reloading a manifest
+// only when the updater replaced it
+type sourceIndex struct {
+	rootPath string
+
+	mu        sync.Mutex
+	manifests map[string]*cachedManifest
+}
+
+// newSourceIndex creates an index over the targets below rootPath
+func newSourceIndex(rootPath string) *sourceIndex {
+	return &sourceIndex{rootPath: rootPath, manifests: make(map[string]*cachedManifest)}
+}
+
+// lookup returns the recorded source of the file at urlPath, relative to the data root
+func (s *sourceIndex) lookup(urlPath string) (mirror.FileSource, bool) {
+	target, rel, ok := strings.Cut(strings.Trim(filepath.ToSlash(urlPath), "/"), "/")
+	if !ok || target == "" {
+		return mirror.FileSource{}, false
+	}
+
+	manifest := s.manifest(target)
+	if manifest == nil {
+		return mirror.FileSource{}, false
+	}
+	return manifest.Lookup(rel)
+}
+
+// manifest returns the current manifest of target, or nil if it has none
+func (s *sourceIndex) manifest(target string) *mirror.Manifest {
+	targetDir := filepath.Join(s.rootPath, target)
+	stat, err := os.Stat(filepath.Join(targetDir, mirror.ManifestFileName))
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cached, ok := s.manifests[target]; ok && cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+		return cached.manifest
+	}
+
+	manifest, err := mirror.LoadManifest(targetDir)
+	if err != nil {
+		return nil
+	}
+	s.manifests[target] = &cachedManifest{modTime: stat.ModTime(), size: stat.Size(), manifest: manifest}
+	return manifest
+}
+
+// infoURL returns the detail page URL of the file at urlPath
+func infoURL(urlPath string) string {
+	return infoPrefix + strings.TrimPrefix(filepath.ToSlash(urlPath), "/")
+}
+
+// fileDetails describes the regular file at urlPath below the data root
+func (h *Handler) fileDetails(urlPath string) (*fileDetails, int) {
+	urlPath = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(urlPath)), "/")
+	filePath := filepath.Join(h.rootPath, filepath.FromSlash(urlPath))
+	if urlPath == "" || !isWithinRoot(h.rootPath, filePath) {
+		return nil, http.StatusBadRequest
+	}
+	if h.isProtected(urlPath) {
+		return nil, http.StatusForbidden
+	}
+
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) || (err == nil && stat.IsDir()) {
+		return nil, http.StatusNotFound
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+
+	target, _, _ := strings.Cut(urlPath, "/")
+	details := &fileDetails{
+		Path:      "/" + urlPath,
+		Name:      stat.Name(),
+		Target:    target,
+		Size:      stat.Size(),
+		ModTime:   stat.ModTime().UTC(),
+		SourceURL: unknownSource,
+	}
+	// Adopted files are recorded without an origin
+	if source, ok := h.sources.lookup(urlPath); ok && source.URL != "" {
+		details.SourceURL = source.URL
+		details.FetchedAt = &source.FetchedAt
+		details.RunID = source.RunID
+	}
+	return details, http.StatusOK
+}
+
+// isWithinRoot reports whether filePath lies inside rootPath
+func isWithinRoot(rootPath, filePath string) bool {
+	rel, err := filepath.Rel(rootPath, filePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// FileInfoAPI serves the origin of a single file as JSON at /api/v1/file-info?path=...
+func (h *Handler) FileInfoAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := r.URL.Query().Get("path")
+		if filePath == "" {
+			http.Error(w, "Missing path parameter", http.StatusBadRequest)
+			return
+		}
+
+		details, status := h.fileDetails(filePath)
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		details.URL = escapeURLPath(httpPkg.BasePath(r) + details.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(details)
+	})
+}
+
+// serveInfo renders the detail page of a file
+func (h *Handler) serveInfo(w http.ResponseWriter, r *http.Request, urlPath string) {
+	details, status := h.fileDetails(urlPath)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	details.URL = escapeURLPath(httpPkg.BasePath(r) + details.Path)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := renderTemplate(w, h.info, details); err != nil {
+		http.Error(w, "Failed to render file details", http.StatusInternalServerError)
+	}
+}
+
+// setSourceHeader adds the upstream URL of the served file when enabled
+func (h *Handler) setSourceHeader(w http.ResponseWriter, filePath string) {
+	cfg := h.getConfig()
+	if cfg == nil || !cfg.Server.SourceHeader {
+		return
+	}
+
+	rel, err := filepath.Rel(h.rootPath, filePath)
+	if err != nil {
+		return
+	}
+	source, ok := h.sources.lookup(rel)
+	if !ok || source.URL == "" {
+		w.Header().Set(sourceHeader, unknownSource)
+		return
+	}
+	// Header values must not carry raw non-ASCII characters
+	if parsed, err := url.Parse(source.URL); err == nil {
+		w.Header().Set(sourceHeader, parsed.String())
+	}
+}
+
+// infoFuncs are the template functions of the detail page
+var infoFuncs = template.FuncMap{
+	"formatSize": formatSize,
+	"dir": func(p string) string {
+		return strings.TrimSuffix(path.Dir(p), "/") + "/"
+	},
+}
+
+// File detail page HTML template, styled like the directory listing
+const infoTemplate = `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Name}} - details</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            margin: 40px;
+            background-color: #f5f5f5;
+            line-height: 1.6;
+        }
+        .container {
+            max-width: 1200px;
+            margin: 0 auto;
+            background: white;
+            padding: 30px;
+            border-radius: 8px;
+            box-shadow: 0 2px 10px rgba(0,0,0,0.1);
+        }
+        h1 {
+            color: #333;
+            border-bottom: 2px solid #007acc;
+            padding-bottom: 10px;
+            margin-bottom: 20px;
+            word-break: break-all;
+        }
+        table {
+            border-collapse: collapse;
+        }
+        th, td {
+            padding: 8px 12px;
+            text-align: left;
+            border-bottom: 1px solid #eee;
+            word-break: break-all;
+        }
+        th {
+            color: #666;
+            font-weight: 600;
+            width: 160px;
+        }
+        a {
+            color: #007acc;
+            text-decoration: none;
+        }
+        .unknown {
+            color: #999;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Name}}</h1>
+        <table>
+            <tr><th>Path</th><td><a href="{{.URL}}">{{.Path}}</a></td></tr>
+            <tr><th>Size</th><td>{{.Size | formatSize}}</td></tr>
+            <tr><th>Last Modified</th><td>{{.ModTime.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+            <tr><th>Source URL</th><td>{{if .FetchedAt}}<a href="{{.SourceURL}}">{{.SourceURL}}</a>{{else}}<span class="unknown">unknown</span>{{end}}</td></tr>
+            <tr><th>Fetched</th><td>{{if .FetchedAt}}{{.FetchedAt.Format "2006-01-02 15:04:05 MST"}}{{else}}<span class="unknown">unknown</span>{{end}}</td></tr>
+        </table>
+        <p><a href="{{dir .URL}}">📁 Back to directory</a></p>
+    </div>
+</body>
+</html>`
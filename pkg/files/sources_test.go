@@ -0,0 +1,148 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// newSourcesTestHandler creates a data root with a target holding one file with a
+// recorded source and one without
+func newSourcesTestHandler(t *testing.T, cfg *config.Config) *Handler {
+	t.Helper()
+	root := t.TempDir()
+	targetDir := filepath.Join(root, "target")
+	if err := os.MkdirAll(filepath.Join(targetDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sub/known.txt", "legacy.txt"} {
+		if err := os.WriteFile(filepath.Join(targetDir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest := mirror.Manifest{Files: map[string]mirror.FileSource{
+		"sub/known.txt": {URL: "http://upstream.example/pub/sub/known.txt", FetchedAt: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), RunID: "5f1c0a2b9e7d4c38"},
+	}}
+	data, _ := json.Marshal(manifest)
+	if err := os.WriteFile(filepath.Join(targetDir, mirror.ManifestFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewHandler(root, cfg)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	return handler
+}
+
+func TestFileInfoAPI(t *testing.T) {
+	handler := newSourcesTestHandler(t, &config.Config{
+		Targets: []config.Target{{Name: "target"}},
+	})
+	api := handler.FileInfoAPI()
+
+	tests := []struct {
+		name      string
+		query     string
+		status    int
+		sourceURL string
+	}{
+		{"recorded source", "?path=/target/sub/known.txt", http.StatusOK, "http://upstream.example/pub/sub/known.txt"},
+		{"pre-existing file", "?path=/target/legacy.txt", http.StatusOK, "unknown"},
+		{"missing file", "?path=/target/nope.txt", http.StatusNotFound, ""},
+		{"directory", "?path=/target/sub", http.StatusNotFound, ""},
+		{"traversal", "?path=/../../etc/passwd", http.StatusNotFound, ""},
+		{"missing parameter", "", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/file-info"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var details fileDetails
+			if err := json.NewDecoder(w.Body).Decode(&details); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if details.SourceURL != tt.sourceURL || details.Target != "target" {
+				t.Errorf("Unexpected details: %+v", details)
+			}
+			if (details.FetchedAt == nil) != (tt.sourceURL == "unknown") {
+				t.Errorf("Expected fetched_at only for recorded sources, got %v", details.FetchedAt)
+			}
+			if (details.RunID == "5f1c0a2b9e7d4c38") != (tt.sourceURL != "unknown") {
+				t.Errorf("Expected the run ID only for recorded sources, got %q", details.RunID)
+			}
+		})
+	}
+}
+
+func TestSourceHeaderOptIn(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		path    string
+		want    string
+	}{
+		{"disabled", false, "/target/sub/known.txt", ""},
+		{"recorded", true, "/target/sub/known.txt", "http://upstream.example/pub/sub/known.txt"},
+		{"unknown", true, "/target/legacy.txt", "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newSourcesTestHandler(t, &config.Config{Server: config.Server{SourceHeader: tt.enabled}})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if got := w.Header().Get("X-Mirror-Source"); got != tt.want {
+				t.Errorf("Expected X-Mirror-Source %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestInfoPage(t *testing.T) {
+	handler := newSourcesTestHandler(t, &config.Config{
+		Targets: []config.Target{{Name: "target"}, {Name: "private", Protected: true}},
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/.info/target/sub/known.txt", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "http://upstream.example/pub/sub/known.txt") {
+		t.Errorf("Expected detail page with source URL, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The listing links to the detail page
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/target/sub/", nil))
+	if !strings.Contains(w.Body.String(), `href="/.info/target/sub/known.txt"`) {
+		t.Error("Expected listing to link to the detail page")
+	}
+
+	if err := os.MkdirAll(filepath.Join(handler.rootPath, "private"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(handler.rootPath, "private", "f.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/.info/private/f.txt", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected protected file details to be forbidden, got %d", w.Code)
+	}
+}
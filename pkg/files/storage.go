@@ -0,0 +1,125 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// storageCheckInterval is how often requests check an unavailable data root again
+var storageCheckInterval = time.Second
+
+// storageRetryAfter is the Retry-After sent with "storage unavailable" responses
+const storageRetryAfter = "30"
+
+// storageState tracks whether the data root can be read, e.g. while an NFS volume
+// is away. Unavailable roots are checked again at most every storageCheckInterval.
+type storageState struct {
+	root string
+
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+}
+
+// newStorageState creates the state of root, checking it right away
+func newStorageState(root string) *storageState {
+	s := &storageState{root: root}
+	s.err = s.probe()
+	s.checked = time.Now()
+	return s
+}
+
+// probe checks that the root is a readable directory
+func (s *storageState) probe() error {
+	dir, err := os.Open(s.root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// check returns nil if the storage is available, checking an unavailable root
+// again once storageCheckInterval passed
+func (s *storageState) check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil && time.Since(s.checked) >= storageCheckInterval {
+		s.err = s.probe()
+		s.checked = time.Now()
+	}
+	return s.err
+}
+
+// failed re-checks the root after a filesystem error serving a request and
+// reports whether the error was caused by the storage being unavailable
+func (s *storageState) failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	probeErr := s.probe()
+	if probeErr == nil && isStorageError(err) {
+		probeErr = err
+	}
+	s.err = probeErr
+	s.checked = time.Now()
+	return s.err != nil
+}
+
+// isStorageError reports whether err means the filesystem itself is failing,
+// rather than a single file being missing or unreadable
+func isStorageError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.ESTALE, syscall.ENOTCONN, syscall.ENODEV, syscall.EROFS, syscall.ENOSPC} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// StorageError returns why the data root is unavailable, or nil if it can be read
+func (h *Handler) StorageError() error {
+	return h.storage.check()
+}
+
+// serverError answers a failed filesystem operation: with the "storage
+// unavailable" page if the data root failed, otherwise with a 500 and msg
+func (h *Handler) serverError(w http.ResponseWriter, err error, msg string) {
+	if h.storage.failed(err) {
+		serveStorageUnavailable(w)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// serveStorageUnavailable answers with a 503 page explaining that the data volume
+// is unavailable
+func serveStorageUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", storageRetryAfter)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprint(w, storageUnavailablePage)
+}
+
+// storageUnavailablePage is served while the data root cannot be read
+const storageUnavailablePage = `<!DOCTYPE html>
+<html>
+<head><title>Storage unavailable</title></head>
+<body>
+<h1>Storage unavailable</h1>
+<p>The mirror's storage is temporarily unavailable. Files will be served again as soon as it is back; please retry in a moment.</p>
+</body>
+</html>
+`
@@ -0,0 +1,85 @@
+package files
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestHandlerWaitsForUnavailableStorage(t *testing.T) {
+	previous := storageCheckInterval
+	storageCheckInterval = 0
+	defer func() { storageCheckInterval = previous }()
+
+	// A mount point whose volume is away: the root cannot even be created
+	parent := filepath.Join(t.TempDir(), "mnt")
+	if err := os.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootPath := filepath.Join(parent, "data")
+	handler, err := NewHandler(rootPath, &config.Config{Server: config.Server{Thumbnails: config.Thumbnails{Enabled: true}}})
+	if err != nil {
+		t.Fatalf("Expected the handler to tolerate a missing root, got %v", err)
+	}
+	if handler.StorageError() == nil {
+		t.Fatal("Expected storage to be unavailable")
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/target/file.txt", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Storage unavailable") || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a storage unavailable page, got %d %q", w.Code, w.Body.String())
+	}
+
+	// The volume comes back
+	if err := os.Remove(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootPath, "target"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootPath, "target", "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/target/file.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Expected the file once storage is back, got %d %q", w.Code, w.Body.String())
+	}
+	if err := handler.StorageError(); err != nil {
+		t.Errorf("Expected storage to be available again, got %v", err)
+	}
+}
+
+func TestHandlerDetectsVanishedStorage(t *testing.T) {
+	rootPath := filepath.Join(t.TempDir(), "data")
+	handler, err := NewHandler(rootPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/missing.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing file, got %d", w.Code)
+	}
+
+	// The whole root disappears, e.g. an unmounted volume
+	if err := os.Remove(rootPath); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/missing.txt", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the root is gone, got %d", w.Code)
+	}
+	if handler.StorageError() == nil {
+		t.Error("Expected storage to be reported unavailable")
+	}
+}
@@ -0,0 +1,37 @@
+package files
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// syncRetryDelay is how long a lookup waits before retrying a file that went
+// missing during a sync
+const syncRetryDelay = 100 * time.Millisecond
+
+// syncMarker returns the marker of the running sync of the named target, nil if it
+// is not being synced
+func (h *Handler) syncMarker(targetName string) *mirror.SyncMarker {
+	if targetName == "" {
+		return nil
+	}
+	marker, err := mirror.LoadSyncMarker(filepath.Join(h.rootPath, targetName))
+	if err != nil {
+		return nil
+	}
+	return marker
+}
+
+// retryDuringSync waits before a missing file is looked up once more and reports
+// whether to do so: only with Server.SyncRetry and while its target is being
+// synced, when it may reappear under its final name any moment
+func (h *Handler) retryDuringSync(urlPath string) bool {
+	cfg := h.getConfig()
+	if cfg == nil || !cfg.Server.SyncRetry || h.syncMarker(targetOf(urlPath)) == nil {
+		return false
+	}
+	time.Sleep(syncRetryDelay)
+	return true
+}
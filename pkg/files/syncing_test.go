@@ -0,0 +1,112 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// writeSyncMarker marks the target in dir as being synced since started
+func writeSyncMarker(t *testing.T, dir string, started time.Time) {
+	t.Helper()
+	data, _ := json.Marshal(mirror.SyncMarker{Target: filepath.Base(dir), Started: started})
+	if err := os.WriteFile(filepath.Join(dir, mirror.SyncMarkerFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListingDuringSync(t *testing.T) {
+	rootDir := t.TempDir()
+	targetDir := filepath.Join(rootDir, "target")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"done.iso", "big.iso.part", config.TempFilePrefix + "123"} {
+		if err := os.WriteFile(filepath.Join(targetDir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler, err := NewHandler(rootDir, &config.Config{Targets: []config.Target{{Name: "target", Hidden: []string{}}}})
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/target/", nil))
+		return w
+	}
+
+	idle := get()
+	body := idle.Body.String()
+	if !strings.Contains(body, "done.iso") {
+		t.Error("Expected complete file in listing")
+	}
+	if strings.Contains(body, "big.iso.part") || strings.Contains(body, config.TempFilePrefix) {
+		t.Error("Expected incomplete downloads to be left out of the listing")
+	}
+	if strings.Contains(body, "being updated") {
+		t.Error("Expected no sync banner without a running sync")
+	}
+
+	writeSyncMarker(t, targetDir, time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC))
+	syncing := get()
+	if !strings.Contains(syncing.Body.String(), "being updated right now (since 2024-05-01 12:00:00 UTC)") {
+		t.Error("Expected sync banner with the start of the sync")
+	}
+	if syncing.Header().Get("ETag") == idle.Header().Get("ETag") {
+		t.Error("Expected the sync banner to change the listing ETag")
+	}
+}
+
+func TestSyncRetry(t *testing.T) {
+	rootDir := t.TempDir()
+	targetDir := filepath.Join(rootDir, "target")
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		syncRetry bool
+		syncing   bool
+		want      int
+	}{
+		{"retry during sync", true, true, http.StatusOK},
+		{"no retry without sync", true, false, http.StatusNotFound},
+		{"retry disabled", false, true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filePath := filepath.Join(targetDir, "late.txt")
+			os.Remove(filePath)
+			os.Remove(filepath.Join(targetDir, mirror.SyncMarkerFileName))
+			if tt.syncing {
+				writeSyncMarker(t, targetDir, time.Now())
+			}
+
+			handler, err := NewHandler(rootDir, &config.Config{Server: config.Server{SyncRetry: tt.syncRetry}})
+			if err != nil {
+				t.Fatalf("Failed to create handler: %v", err)
+			}
+
+			// The file appears while the first lookup waits
+			timer := time.AfterFunc(syncRetryDelay/4, func() { os.WriteFile(filePath, []byte("late"), 0644) })
+			defer timer.Stop()
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/target/late.txt", nil))
+			if w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package files
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register decoders for image.Decode
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+const (
+	// thumbsPrefix is the URL prefix thumbnails are served from
+	thumbsPrefix = "/.thumbs/"
+	// thumbCacheDir is the cache directory below the data root
+	thumbCacheDir = ".thumbcache"
+)
+
+// Defaults for zero-valued thumbnail settings
+const (
+	defaultThumbnailSize       = 160
+	defaultThumbnailCacheSize  = 256 * 1024 * 1024
+	defaultThumbnailMaxPixels  = 50_000_000
+	defaultThumbnailWorkerPool = 2
+)
+
+// errSourceTooLarge is returned for images exceeding the configured pixel limit
+var errSourceTooLarge = errors.New("source image too large for thumbnailing")
+
+// thumbnailExtensions are the file types thumbnails are generated for
+var thumbnailExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+}
+
+// thumbEntry is a cached thumbnail tracked by the LRU
+type thumbEntry struct {
+	name string
+	size int64
+}
+
+// Thumbnailer generates, caches and serves image thumbnails
+type Thumbnailer struct {
+	rootPath  string
+	cachePath string
+	size      int
+	maxPixels int
+	limit     int64
+	workers   chan struct{}
+
+	mu       sync.Mutex
+	lru      *list.List // front is most recently used
+	entries  map[string]*list.Element
+	used     int64
+	inflight map[string]chan struct{}
+}
+
+// NewThumbnailer creates a thumbnailer for images below rootPath and loads the
+// existing cache, oldest entries first
+func NewThumbnailer(rootPath string, cfg config.Thumbnails) (*Thumbnailer, error) {
+	t := &Thumbnailer{
+		rootPath:  rootPath,
+		cachePath: filepath.Join(rootPath, thumbCacheDir),
+		size:      cfg.Size,
+		maxPixels: cfg.MaxSourcePixels,
+		limit:     httpPkg.ParseSize(cfg.CacheSize),
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+		inflight:  make(map[string]chan struct{}),
+	}
+	if t.size <= 0 {
+		t.size = defaultThumbnailSize
+	}
+	if t.maxPixels <= 0 {
+		t.maxPixels = defaultThumbnailMaxPixels
+	}
+	if t.limit <= 0 {
+		t.limit = defaultThumbnailCacheSize
+	}
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = defaultThumbnailWorkerPool
+	}
+	t.workers = make(chan struct{}, workers)
+
+	if err := os.MkdirAll(t.cachePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create thumbnail cache: %w", err)
+	}
+
+	entries, err := os.ReadDir(t.cachePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read thumbnail cache: %w", err)
+	}
+
+	var cached []os.FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			// Leftover from an interrupted generation
+			os.Remove(filepath.Join(t.cachePath, info.Name()))
+			continue
+		}
+		cached = append(cached, info)
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().Before(cached[j].ModTime())
+	})
+
+	for _, info := range cached {
+		t.add(info.Name(), info.Size())
+	}
+	t.mu.Lock()
+	t.evict()
+	t.mu.Unlock()
+
+	return t, nil
+}
+
+// isThumbnailable reports whether a file name has an image type thumbnails exist for
+func isThumbnailable(name string) bool {
+	return thumbnailExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// thumbnailURL returns the URL of the thumbnail for the file at urlPath
+func thumbnailURL(urlPath string) string {
+	return path.Clean(thumbsPrefix + filepath.ToSlash(urlPath))
+}
+
+// serve writes the thumbnail of sourcePath, generating it if it is not cached
+func (t *Thumbnailer) serve(w http.ResponseWriter, r *http.Request, sourcePath string) {
+	stat, err := os.Stat(sourcePath)
+	if err != nil || stat.IsDir() || !isThumbnailable(sourcePath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	name := thumbnailKey(sourcePath, stat)
+	if !t.touch(name) {
+		if err := t.generate(r, sourcePath, name); err != nil {
+			if errors.Is(err, errSourceTooLarge) {
+				http.Error(w, "Image too large for a thumbnail", http.StatusUnprocessableEntity)
+				return
+			}
+			if r.Context().Err() != nil {
+				return
+			}
+			http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	file, err := os.Open(filepath.Join(t.cachePath, name))
+	if err != nil {
+		http.Error(w, "Failed to open thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// The cache key changes with the source mtime, so thumbnails can be cached long
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
+
+// thumbnailKey derives the cache file name from the source path and modification time
+func thumbnailKey(sourcePath string, stat os.FileInfo) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%d\x00%d", sourcePath, stat.ModTime().UnixNano(), stat.Size()))
+	return hex.EncodeToString(sum[:16]) + ".png"
+}
+
+// generate creates the thumbnail name for sourcePath. Concurrent requests for the
+// same thumbnail wait for a single generation; at most Workers generations run at once.
+func (t *Thumbnailer) generate(r *http.Request, sourcePath, name string) error {
+	t.mu.Lock()
+	if done, ok := t.inflight[name]; ok {
+		t.mu.Unlock()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+		if t.touch(name) {
+			return nil
+		}
+		return errors.New("thumbnail generation failed")
+	}
+	done := make(chan struct{})
+	t.inflight[name] = done
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.inflight, name)
+		t.mu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case t.workers <- struct{}{}:
+		defer func() { <-t.workers }()
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+
+	size, err := t.render(sourcePath, name)
+	if err != nil {
+		return err
+	}
+
+	t.add(name, size)
+	t.mu.Lock()
+	t.evict()
+	t.mu.Unlock()
+	return nil
+}
+
+// render decodes sourcePath, scales it down and writes the PNG to the cache
+func (t *Thumbnailer) render(sourcePath, name string) (int64, error) {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	// Check dimensions before decoding so huge images are never allocated
+	imgConfig, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return 0, err
+	}
+	if imgConfig.Width <= 0 || imgConfig.Height <= 0 || imgConfig.Width*imgConfig.Height > t.maxPixels {
+		return 0, errSourceTooLarge
+	}
+
+	if _, err := src.Seek(0, 0); err != nil {
+		return 0, err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(t.cachePath, ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := png.Encode(tmp, scaleDown(img, t.size)); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	stat, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(t.cachePath, name)); err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// scaleDown converts img to RGBA and shrinks it with a box filter so that neither
+// side exceeds maxSide. Smaller images are only converted.
+func scaleDown(img image.Image, maxSide int) *image.RGBA {
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxSide && h <= maxSide {
+		return src
+	}
+
+	dw, dh := maxSide, maxSide
+	if w > h {
+		dh = max(1, h*maxSide/w)
+	} else {
+		dw = max(1, w*maxSide/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+
+			// Average the source box covered by this destination pixel
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := src.RGBAAt(sx, sy)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// touch marks a cached thumbnail as recently used and reports whether it exists
+func (t *Thumbnailer) touch(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elem, ok := t.entries[name]
+	if ok {
+		t.lru.MoveToFront(elem)
+	}
+	return ok
+}
+
+// add records a cached thumbnail as most recently used
+func (t *Thumbnailer) add(name string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if elem, ok := t.entries[name]; ok {
+		t.used -= elem.Value.(*thumbEntry).size
+		t.lru.Remove(elem)
+	}
+	t.entries[name] = t.lru.PushFront(&thumbEntry{name: name, size: size})
+	t.used += size
+}
+
+// evict removes least recently used thumbnails until the cache fits its limit.
+// The caller must hold t.mu.
+func (t *Thumbnailer) evict() {
+	for t.used > t.limit && t.lru.Len() > 1 {
+		elem := t.lru.Back()
+		entry := elem.Value.(*thumbEntry)
+		t.lru.Remove(elem)
+		delete(t.entries, entry.name)
+		t.used -= entry.size
+		os.Remove(filepath.Join(t.cachePath, entry.name))
+	}
+}
@@ -0,0 +1,221 @@
+package files
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// writeTestImage writes a solid PNG of the given dimensions
+func writeTestImage(t *testing.T, path string, width, height int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+}
+
+// thumbnailConfig returns a config with thumbnails enabled
+func thumbnailConfig(thumbs config.Thumbnails) *config.Config {
+	thumbs.Enabled = true
+	return &config.Config{Server: config.Server{Thumbnails: thumbs}}
+}
+
+func TestThumbnailsDisabled(t *testing.T) {
+	tempDir := t.TempDir()
+	writeTestImage(t, filepath.Join(tempDir, "a.png"), 10, 10)
+
+	handler, err := NewHandler(tempDir, &config.Config{})
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/.thumbs/a.png", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for thumbnails when disabled, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if strings.Contains(w.Body.String(), "/.thumbs/") {
+		t.Error("Listing should not reference thumbnails when disabled")
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, thumbCacheDir)); !os.IsNotExist(err) {
+		t.Error("Thumbnail cache should not be created when disabled")
+	}
+}
+
+func TestThumbnailGeneration(t *testing.T) {
+	tempDir := t.TempDir()
+	writeTestImage(t, filepath.Join(tempDir, "wide.png"), 400, 200)
+	os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte("text"), 0644)
+
+	handler, err := NewHandler(tempDir, thumbnailConfig(config.Thumbnails{Size: 100}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	// The listing links the thumbnail and a lightbox for images only
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `src="/.thumbs/wide.png"`) {
+		t.Error("Expected listing to include the image thumbnail")
+	}
+	if strings.Contains(body, "/.thumbs/notes.txt") {
+		t.Error("Expected no thumbnail for non-image files")
+	}
+	if strings.Contains(body, thumbCacheDir) {
+		t.Error("Expected the thumbnail cache to be hidden from the listing")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/.thumbs/wide.png", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected image/png, got %s", ct)
+	}
+
+	thumb, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Failed to decode thumbnail: %v", err)
+	}
+	if b := thumb.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Errorf("Expected 100x50 thumbnail, got %dx%d", b.Dx(), b.Dy())
+	}
+	if c := color.RGBAModel.Convert(thumb.At(10, 10)).(color.RGBA); c.R != 200 || c.G != 100 || c.B != 50 {
+		t.Errorf("Expected averaged color to be preserved, got %v", c)
+	}
+
+	cached, _ := os.ReadDir(filepath.Join(tempDir, thumbCacheDir))
+	if len(cached) != 1 {
+		t.Errorf("Expected one cached thumbnail, got %d", len(cached))
+	}
+}
+
+func TestThumbnailRejectsOversizedSource(t *testing.T) {
+	tempDir := t.TempDir()
+	writeTestImage(t, filepath.Join(tempDir, "huge.png"), 300, 300)
+
+	handler, err := NewHandler(tempDir, thumbnailConfig(config.Thumbnails{MaxSourcePixels: 1000}))
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/.thumbs/huge.png", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an oversized source, got %d", w.Code)
+	}
+}
+
+func TestThumbnailErrors(t *testing.T) {
+	tempDir := t.TempDir()
+	os.MkdirAll(filepath.Join(tempDir, "private"), 0755)
+	writeTestImage(t, filepath.Join(tempDir, "private", "a.png"), 10, 10)
+	os.WriteFile(filepath.Join(tempDir, "broken.png"), []byte("not a png"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte("text"), 0644)
+
+	cfg := thumbnailConfig(config.Thumbnails{})
+	cfg.Targets = []config.Target{{Name: "private", Protected: true}}
+	handler, err := NewHandler(tempDir, cfg)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/.thumbs/private/a.png", http.StatusForbidden},
+		{"/.thumbs/broken.png", http.StatusInternalServerError},
+		{"/.thumbs/notes.txt", http.StatusNotFound},
+		{"/.thumbs/missing.png", http.StatusNotFound},
+		{"/.thumbs/../../etc/passwd.png", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestThumbnailCacheEviction(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		writeTestImage(t, filepath.Join(tempDir, name), 64, 64)
+	}
+
+	thumbs, err := NewThumbnailer(tempDir, config.Thumbnails{Size: 32})
+	if err != nil {
+		t.Fatalf("NewThumbnailer failed: %v", err)
+	}
+
+	fetch := func(name string) {
+		w := httptest.NewRecorder()
+		thumbs.serve(w, httptest.NewRequest("GET", "/.thumbs/"+name, nil), filepath.Join(tempDir, name))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d", name, w.Code)
+		}
+	}
+
+	fetch("a.png")
+	fetch("b.png")
+
+	// Allow room for two thumbnails, then use a again so b is least recently used
+	thumbs.limit = thumbs.used
+	fetch("a.png")
+	fetch("c.png")
+
+	cacheKey := func(name string) string {
+		stat, _ := os.Stat(filepath.Join(tempDir, name))
+		return thumbnailKey(filepath.Join(tempDir, name), stat)
+	}
+
+	for name, want := range map[string]bool{"a.png": true, "b.png": false, "c.png": true} {
+		_, err := os.Stat(filepath.Join(tempDir, thumbCacheDir, cacheKey(name)))
+		if exists := err == nil; exists != want {
+			t.Errorf("Expected cached thumbnail for %s to exist=%v, got %v", name, want, exists)
+		}
+	}
+	if thumbs.used > thumbs.limit {
+		t.Errorf("Expected cache usage %d within limit %d", thumbs.used, thumbs.limit)
+	}
+
+	// A new thumbnailer picks up the existing cache
+	reloaded, err := NewThumbnailer(tempDir, config.Thumbnails{Size: 32})
+	if err != nil {
+		t.Fatalf("NewThumbnailer failed: %v", err)
+	}
+	if reloaded.lru.Len() != 2 {
+		t.Errorf("Expected 2 cached entries after reload, got %d", reloaded.lru.Len())
+	}
+}
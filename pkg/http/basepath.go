@@ -0,0 +1,66 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// forwardedPrefixHeader names the path prefix a reverse proxy publishes the server under
+const forwardedPrefixHeader = "X-Forwarded-Prefix"
+
+// basePathKey is the context key of the base path resolved by BasePathMiddleware
+type basePathKey struct{}
+
+// BasePathMiddleware resolves the path prefix the server is published under: the
+// X-Forwarded-Prefix of a trusted proxy, otherwise the one returned by configured.
+// Requests starting with the prefix have it removed, so handlers see the same paths
+// with and without a proxy in front. Both functions are called per request, so the
+// prefix and the trusted proxies can be replaced on reload.
+func BasePathMiddleware(configured func() string, current func() *ClientIPResolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		base := configured()
+		if prefix := req.Header.Get(forwardedPrefixHeader); prefix != "" && current().TrustedPeer(req) {
+			first, _, _ := strings.Cut(prefix, ",")
+			base = config.CleanBasePath(strings.TrimSpace(first))
+		}
+
+		if rest, ok := cutBasePath(req.URL.Path, base); ok {
+			stripped := *req.URL
+			stripped.Path = rest
+			stripped.RawPath = ""
+			if rawRest, ok := cutBasePath(req.URL.RawPath, (&url.URL{Path: base}).EscapedPath()); ok {
+				stripped.RawPath = rawRest
+			}
+			req = req.Clone(req.Context())
+			req.URL = &stripped
+		}
+		ctx := context.WithValue(req.Context(), basePathKey{}, base)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// cutBasePath removes base from the start of urlPath if urlPath lies at or below it
+func cutBasePath(urlPath, base string) (string, bool) {
+	if base == "" || urlPath == "" {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(urlPath, base)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+// BasePath returns the path prefix resolved by BasePathMiddleware, which generated
+// links and redirects start with; "" when the server is published at the site root
+func BasePath(req *http.Request) string {
+	base, _ := req.Context().Value(basePathKey{}).(string)
+	return base
+}
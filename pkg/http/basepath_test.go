@@ -0,0 +1,53 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasePathMiddleware(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		configured string
+		remoteAddr string
+		target     string
+		prefix     string
+		base       string
+		path       string
+		rawPath    string
+	}{
+		{"no base path", "", "203.0.113.7:1", "/debian/", "", "", "/debian/", ""},
+		{"prefixed request", "/mirror", "203.0.113.7:1", "/mirror/debian/", "", "/mirror", "/debian/", ""},
+		{"prefix alone", "/mirror", "203.0.113.7:1", "/mirror", "", "/mirror", "/", ""},
+		{"direct request", "/mirror", "203.0.113.7:1", "/debian/", "", "/mirror", "/debian/", ""},
+		{"prefix is a whole segment", "/mirror", "203.0.113.7:1", "/mirrors/", "", "/mirror", "/mirrors/", ""},
+		{"escaped path", "/mirror", "203.0.113.7:1", "/mirror/a%2Fb.txt", "", "/mirror", "/a/b.txt", "/a%2Fb.txt"},
+		{"trusted forwarded prefix", "/mirror", "10.0.0.1:1", "/debian/", "/proxy/mirror/", "/proxy/mirror", "/debian/", ""},
+		{"forwarded prefix list", "", "10.0.0.1:1", "/debian/", "/outer, /inner", "/outer", "/debian/", ""},
+		{"untrusted forwarded prefix", "/mirror", "203.0.113.7:1", "/debian/", "/evil", "/mirror", "/debian/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var base, path, rawPath string
+			handler := BasePathMiddleware(func() string { return tt.configured }, func() *ClientIPResolver { return resolver },
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					base, path, rawPath = BasePath(r), r.URL.Path, r.URL.RawPath
+				}))
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.prefix != "" {
+				req.Header.Set("X-Forwarded-Prefix", tt.prefix)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if base != tt.base || path != tt.path || rawPath != tt.rawPath {
+				t.Errorf("Expected base %q, path %q and raw path %q, got %q, %q and %q", tt.base, tt.path, tt.rawPath, base, path, rawPath)
+			}
+		})
+	}
+}
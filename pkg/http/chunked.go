@@ -0,0 +1,209 @@
+package http
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// DefaultParallelChunkMinSize is the size from which files are downloaded in
+// parallel chunks when Target.ParallelChunkMinSize is not set
+const DefaultParallelChunkMinSize = 256 << 20
+
+// errRangesIgnored is returned by chunked downloads when the upstream does not serve
+// the requested byte ranges, e.g. because the file changed meanwhile; the file is
+// then downloaded again in a single stream
+var errRangesIgnored = errors.New("upstream did not serve the requested byte range")
+
+// chunkRange is a byte range of a file downloaded in chunks
+type chunkRange struct {
+	start, length int64
+}
+
+// chunkRanges splits size bytes into n ranges of nearly equal length
+func chunkRanges(size int64, n int) []chunkRange {
+	ranges := make([]chunkRange, n)
+	var start int64
+	for i := range ranges {
+		length := size / int64(n)
+		if int64(i) < size%int64(n) {
+			length++
+		}
+		ranges[i] = chunkRange{start: start, length: length}
+		start += length
+	}
+	return ranges
+}
+
+// chunkable reports whether the file served by resp is downloaded in parallel chunks:
+// it must be large enough and served uncompressed by an upstream accepting ranges
+func (c *Client) chunkable(resp *http.Response) bool {
+	minSize := ParseSize(c.config.ParallelChunkMinSize)
+	if minSize <= 0 {
+		minSize = DefaultParallelChunkMinSize
+	}
+	return c.config.ParallelChunks > 1 &&
+		resp.ContentLength >= max(minSize, int64(c.config.ParallelChunks)) &&
+		strings.Contains(strings.ToLower(resp.Header.Get("Accept-Ranges")), "bytes") &&
+		resp.Header.Get("Content-Encoding") == ""
+}
+
+// fetchChunks downloads the file served by resp into file in up to
+// Target.ParallelChunks byte ranges at once, as many as free transfer slots allow.
+// The first range is read from body, the rest of resp, the others are requested
+// concurrently. All chunks read through the limiter of the client, so together they
+// stay within the rate limit of the target. The first failing chunk cancels all
+// others. The assembled file is verified against expected before it is committed.
+func (c *Client) fetchChunks(ctx context.Context, url string, resp *http.Response, body io.Reader,
+	file storage.RandomAccessFile, digest, expected Digest, localPath string) (Digest, error) {
+	size := resp.ContentLength
+	if err := file.Truncate(size); err != nil {
+		return Digest{}, fmt.Errorf("failed to preallocate file: %w", err)
+	}
+
+	// Ranges are requested from where the redirects led, and only of the version
+	// of the file the first response served
+	chunkURL := resp.Request.URL.String()
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	chunkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Reads of the first response do not watch chunkCtx by themselves
+	stop := context.AfterFunc(chunkCtx, func() { resp.Body.Close() })
+	defer stop()
+
+	// Every further connection needs a transfer slot of its own. Waiting for them
+	// while holding one could deadlock downloads against each other, so only free
+	// slots are taken and the file is split into fewer chunks if there are none.
+	chunks := 1
+	for chunks < c.config.ParallelChunks {
+		release, ok := c.tryAcquireTransfer()
+		if !ok {
+			break
+		}
+		defer release()
+		chunks++
+	}
+	c.log(ctx).Debug("Downloading in chunks", "url", url, "size", size, "chunks", chunks)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i, r := range chunkRanges(size, chunks) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if i == 0 {
+				err = c.copyChunk(chunkCtx, body, file, r)
+			} else {
+				err = c.fetchChunk(chunkCtx, chunkURL, validator, size, file, r)
+			}
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return Digest{}, fmt.Errorf("download of %s interrupted: %w", url, ctx.Err())
+	}
+	if errors.Is(firstErr, errRangesIgnored) {
+		return Digest{}, firstErr
+	}
+	if isTimeout(firstErr) {
+		return Digest{}, &TimeoutError{Op: "GET response body", URL: url, Err: firstErr}
+	}
+	if firstErr != nil {
+		return Digest{}, fmt.Errorf("failed to download chunk: %w", firstErr)
+	}
+
+	if f, ok := file.(syncer); ok && shouldSync(c.syncMode, size) {
+		if err := f.Sync(); err != nil {
+			return Digest{}, fmt.Errorf("failed to sync file: %w", err)
+		}
+	}
+
+	// The chunks arrive out of order, so the content is hashed once complete
+	sha, sum := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha, sum), io.NewSectionReader(file, 0, size)); err != nil {
+		return Digest{}, fmt.Errorf("failed to hash file: %w", err)
+	}
+	digest.SHA256, digest.MD5 = hex.EncodeToString(sha.Sum(nil)), hex.EncodeToString(sum.Sum(nil))
+	if err := digest.Verify(expected, localPath); err != nil {
+		return Digest{}, err
+	}
+
+	if err := file.Commit(); err != nil {
+		return Digest{}, err
+	}
+	if chunkURL != url {
+		digest.FinalURL = chunkURL
+	}
+	return digest, nil
+}
+
+// fetchChunk requests the byte range r of the file at url, which is size bytes long,
+// and writes it into file. validator is sent as If-Range, so that a changed file is
+// answered in full and detected.
+func (c *Client) fetchChunk(ctx context.Context, url, validator string, size int64, file io.WriterAt, r chunkRange) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create GET request: %w", err)
+	}
+	req.Header.Set("User-Agent", c.config.UserAgent)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.start, r.start+r.length-1))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return requestError("GET request", url, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return errRangesIgnored
+	default:
+		return newStatusError("GET", url, resp)
+	}
+	want := fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+	if got := resp.Header.Get("Content-Range"); got != want {
+		return fmt.Errorf("%w: expected %q, got %q", errRangesIgnored, want, got)
+	}
+	return c.copyChunk(ctx, resp.Body, file, r)
+}
+
+// copyChunk writes the byte range r of the file from src into file
+func (c *Client) copyChunk(ctx context.Context, src io.Reader, file io.WriterAt, r chunkRange) error {
+	reader := io.LimitReader(c.bodyReader(ctx, src), r.length)
+	written, err := c.buffers.copyToFile(io.NewOffsetWriter(file, r.start), reader, SyncNever)
+	if err != nil {
+		return err
+	}
+	if written != r.length {
+		return fmt.Errorf("chunk at %d ended after %d of %d bytes: %w", r.start, written, r.length, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestChunkRanges(t *testing.T) {
+	ranges := chunkRanges(10, 3)
+	want := []chunkRange{{0, 4}, {4, 3}, {7, 3}}
+	if len(ranges) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, ranges)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, ranges)
+		}
+	}
+}
+
+// rangeServer serves content, counting the requests for byte ranges
+type rangeServer struct {
+	content []byte
+	// ignoreRanges serves the whole file to range requests
+	ignoreRanges bool
+	// stall blocks range requests until the request ends
+	stall bool
+
+	mu     sync.Mutex
+	ranges int
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Range") != "" {
+		s.mu.Lock()
+		s.ranges++
+		s.mu.Unlock()
+		if s.stall {
+			<-r.Context().Done()
+			return
+		}
+		if s.ignoreRanges {
+			r.Header.Del("Range")
+		}
+	}
+	w.Header().Set("ETag", `"v1"`)
+	http.ServeContent(w, r, "file.bin", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(s.content))
+}
+
+func (s *rangeServer) rangeRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ranges
+}
+
+func TestFetchFileInChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 30000)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name         string
+		minSize      string
+		ignoreRanges bool
+		expected     Digest
+		ranges       int
+		err          bool
+	}{
+		{name: "chunked", minSize: "1k", expected: Digest{SHA256: checksum}, ranges: 3},
+		{name: "below threshold", minSize: "2m", ranges: 0},
+		{name: "ranges ignored", minSize: "1k", ignoreRanges: true, ranges: 3},
+		{name: "checksum mismatch", minSize: "1k", expected: Digest{SHA256: strings.Repeat("0", 64)}, ranges: 3, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &rangeServer{content: content, ignoreRanges: tt.ignoreRanges}
+			server := httptest.NewServer(upstream)
+			defer server.Close()
+
+			dir := t.TempDir()
+			localPath := filepath.Join(dir, "file.bin")
+			client := NewClient(&config.Target{UserAgent: "test", Timeout: 10, ParallelChunks: 4, ParallelChunkMinSize: tt.minSize})
+			digest, err := client.FetchFileVerified(context.Background(), server.URL+"/file.bin", localPath, tt.expected)
+			if got := upstream.rangeRequests(); got != tt.ranges {
+				t.Errorf("Expected %d range requests, got %d", tt.ranges, got)
+			}
+
+			if tt.err {
+				var mismatch *ChecksumMismatchError
+				if !errors.As(err, &mismatch) {
+					t.Fatalf("Expected a checksum mismatch, got %v", err)
+				}
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("Expected nothing to be written, found %d entries", len(entries))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FetchFileVerified failed: %v", err)
+			}
+			if data, _ := os.ReadFile(localPath); !bytes.Equal(data, content) {
+				t.Errorf("Expected the whole content, got %d bytes", len(data))
+			}
+			if digest.SHA256 != checksum || digest.MD5 == "" || digest.Content.Sniffed == "" {
+				t.Errorf("Unexpected digest %+v", digest)
+			}
+			if stat, _ := os.Stat(localPath); !stat.ModTime().Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("Expected the upstream modification time, got %s", stat.ModTime())
+			}
+		})
+	}
+}
+
+func TestFetchFileInChunksSharesRateLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 64*1024)
+	server := httptest.NewServer(&rangeServer{content: content})
+	defer server.Close()
+
+	// Four 16k chunks would each fit the 32k burst of their own limiter
+	client := NewClient(&config.Target{UserAgent: "test", Timeout: 10, RateLimit: "32k", ParallelChunks: 4, ParallelChunkMinSize: "1k"})
+	start := time.Now()
+	if _, err := client.FetchFileDigest(context.Background(), server.URL+"/file.bin", filepath.Join(t.TempDir(), "file.bin")); err != nil {
+		t.Fatalf("FetchFileDigest failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Errorf("Expected the chunks to share the rate limit, took %s", elapsed)
+	}
+}
+
+func TestFetchFileInChunksCancellation(t *testing.T) {
+	server := httptest.NewServer(&rangeServer{content: bytes.Repeat([]byte("x"), 1<<20), stall: true})
+	defer server.Close()
+
+	dir := t.TempDir()
+	client := NewClient(&config.Target{UserAgent: "test", Timeout: 30, ParallelChunks: 4, ParallelChunkMinSize: "1k"})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.FetchFileDigest(ctx, server.URL+"/file.bin", filepath.Join(dir, "file.bin"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the download to be interrupted, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected cancellation to stop all chunks")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the partial download to be removed, found %d entries", len(entries))
+	}
+}
@@ -1,29 +1,141 @@
 package http
 
 import (
+	"bufio"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
 	"golang.org/x/time/rate"
 )
 
 // Client wraps http.Client with additional functionality
 type Client struct {
-	client  *http.Client
-	limiter *rate.Limiter
-	config  *config.Target
+	client   *http.Client
+	limiter  *rate.Limiter
+	config   *config.Target
+	buffers  *bufferPool
+	syncMode string
+	// storage receives downloaded files
+	storage storage.Storage
+	// redirects records the redirects followed and blocked by all requests
+	redirects redirectLog
+	// quarantine picks another path for downloads that must not replace their file
+	quarantine func(localPath string, content Content) string
+	// rename picks the path of downloads whose Content-Disposition names a file
+	rename func(url, localPath, filename string) string
+	// transfers caps the downloads open at once, shared with other clients
+	transfers *TransferLimiter
+	// transferLog records how downloads fared with transfers
+	transferLog transferLog
+	// logger receives the records of requests whose context carries no logger
+	logger *slog.Logger
+	// minSize and maxSize bound the size of downloads, 0 meaning no bound
+	minSize int64
+	maxSize int64
+}
+
+// Option configures optional Client behavior
+type Option func(*Client)
+
+// WithWriteOptions sets the buffer size and fsync policy used when writing downloads
+func WithWriteOptions(opts WriteOptions) Option {
+	return func(c *Client) {
+		c.buffers = newBufferPool(opts.BufferSize)
+		c.syncMode = opts.SyncMode
+	}
+}
+
+// WithStorage sets where downloaded files are written instead of the local filesystem
+func WithStorage(s storage.Storage) Option {
+	return func(c *Client) {
+		if s != nil {
+			c.storage = s
+		}
+	}
+}
+
+// WithTransport sets the RoundTripper used for all requests instead of http.DefaultTransport
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		if rt != nil {
+			c.client.Transport = rt
+		}
+	}
+}
+
+// WithQuarantine calls divert with the content of every download before it is
+// written. If divert returns a path, the download is written there instead of to
+// its local path, which keeps its current content.
+func WithQuarantine(divert func(localPath string, content Content) string) Option {
+	return func(c *Client) {
+		c.quarantine = divert
+	}
+}
+
+// WithDispositionNames calls rename with the URL and local path of every download
+// whose response names a file in its Content-Disposition header, and that name. If rename
+// returns a path, the download is written there instead and Digest.Path reports it.
+// Downloads continuing a partial file keep their path.
+func WithDispositionNames(rename func(url, localPath, filename string) string) Option {
+	return func(c *Client) {
+		c.rename = rename
+	}
+}
+
+// WithTransferLimiter makes downloads take their slots from l instead of the
+// process-wide Transfers
+func WithTransferLimiter(l *TransferLimiter) Option {
+	return func(c *Client) {
+		if l != nil {
+			c.transfers = l
+		}
+	}
+}
+
+// WithLogger makes the client log to logger, e.g. one carrying the target the
+// client mirrors; by default it does not log
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// loggerKey is the context key of ContextWithLogger
+type loggerKey struct{}
+
+// ContextWithLogger returns a copy of ctx that makes a Client log what happens
+// during requests made with it to logger instead of the client's own logger, e.g.
+// to add the attributes of a single call
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// log returns the logger for a request made with ctx
+func (c *Client) log(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok && logger != nil {
+		return logger
+	}
+	return c.logger
 }
 
 // NewClient creates a new HTTP client with rate limiting
-func NewClient(target *config.Target) *Client {
+func NewClient(target *config.Target, opts ...Option) *Client {
 	client := &http.Client{
 		Timeout: target.GetTimeout(),
 	}
@@ -36,11 +148,25 @@ func NewClient(target *config.Target) *Client {
 		}
 	}
 
-	return &Client{
-		client:  client,
-		limiter: limiter,
-		config:  target,
+	c := &Client{
+		client:    client,
+		limiter:   limiter,
+		config:    target,
+		buffers:   newBufferPool(DefaultWriteBufferSize),
+		syncMode:  SyncNever,
+		storage:   storage.NewLocal(),
+		transfers: Transfers,
+		logger:    slog.New(slog.DiscardHandler),
+		minSize:   max(ParseSize(target.MinFileSize), 0),
+		maxSize:   max(ParseSize(target.MaxFileSize), 0),
 	}
+	client.CheckRedirect = c.checkRedirect
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 // GetUserAgent returns the user agent for this client
@@ -53,9 +179,23 @@ func (c *Client) GetConfig() *config.Target {
 	return c.config
 }
 
-// DoRequest executes an HTTP request
+// CheckSize returns a FileSizeError if a file of size bytes at url lies outside
+// Target.MinFileSize and Target.MaxFileSize; a negative size is unknown and passes
+func (c *Client) CheckSize(url string, size int64) error {
+	if size < 0 || (c.minSize == 0 || size >= c.minSize) && (c.maxSize == 0 || size <= c.maxSize) {
+		return nil
+	}
+	return &FileSizeError{URL: url, Size: size, Min: c.minSize, Max: c.maxSize}
+}
+
+// DoRequest executes an HTTP request. Timeouts are returned as TimeoutError; the
+// status code is left for the caller to check.
 func (c *Client) DoRequest(req *http.Request) (*http.Response, error) {
-	return c.client.Do(req)
+	resp, err := c.client.Do(req)
+	if err != nil && isTimeout(err) {
+		return nil, &TimeoutError{Op: req.Method + " request", URL: req.URL.String(), Err: err}
+	}
+	return resp, err
 }
 
 // FileInfo represents remote file information
@@ -65,6 +205,8 @@ type FileInfo struct {
 	Size         int64
 	ETag         string
 	ContentType  string
+	// Filename is the file name of the Content-Disposition header, if any
+	Filename string
 }
 
 // CheckFileInfo performs a HEAD request to get file information
@@ -78,18 +220,19 @@ func (c *Client) CheckFileInfo(ctx context.Context, url string) (*FileInfo, erro
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("HEAD request failed: %w", err)
+		return nil, requestError("HEAD request", url, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HEAD request returned status %d", resp.StatusCode)
+		return nil, newStatusError("HEAD", url, resp)
 	}
 
 	info := &FileInfo{
 		URL:         url,
 		ContentType: resp.Header.Get("Content-Type"),
 		ETag:        resp.Header.Get("ETag"),
+		Filename:    DispositionFilename(resp.Header),
 	}
 
 	// Parse Content-Length
@@ -100,115 +243,444 @@ func (c *Client) CheckFileInfo(ctx context.Context, url string) (*FileInfo, erro
 	}
 
 	// Parse Last-Modified
-	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
-		if t, err := time.Parse(time.RFC1123, lastModified); err == nil {
-			info.LastModified = t
-		}
+	if lastModified, ok := parseLastModified(resp.Header); ok {
+		info.LastModified = lastModified
 	}
 
 	return info, nil
 }
 
+// DispositionFilename returns the file name a Content-Disposition header suggests,
+// such as "report.pdf" of `attachment; filename="report.pdf"`, decoding the
+// RFC 2231 filename* form. Missing and malformed headers give "". The name is
+// untrusted and must be validated before it is used as a path.
+func DispositionFilename(header http.Header) string {
+	disposition := header.Get("Content-Disposition")
+	if disposition == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// parseLastModified parses the Last-Modified header in any of the HTTP date formats
+// (RFC 1123, RFC 850, asctime), or with a numeric zone as some servers send it, and
+// returns it in UTC. Missing or malformed dates report false, leaving change
+// detection to the size.
+func parseLastModified(header http.Header) (time.Time, bool) {
+	lastModified := header.Get("Last-Modified")
+	if lastModified == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(lastModified)
+	if err != nil {
+		if t, err = time.Parse(time.RFC1123Z, lastModified); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return t.UTC(), true
+}
+
 // NeedsUpdate checks if a local file needs to be updated based on remote file info
 func (c *Client) NeedsUpdate(localPath string, remoteInfo *FileInfo) (bool, error) {
+	check, err := c.CheckUpdate(localPath, remoteInfo, "")
+	return check.NeedsUpdate, err
+}
+
+// UpdateCheck is the outcome of comparing a local file with its remote info
+type UpdateCheck struct {
+	// NeedsUpdate reports whether the file has to be downloaded
+	NeedsUpdate bool
+	// Tolerated reports whether the file is up to date only because the remote
+	// modification time lies within Target.MTimeTolerance past the local one
+	Tolerated bool
+}
+
+// CheckUpdate compares a local file with remote file info like NeedsUpdate. etag is
+// the entity tag the file was downloaded with if the caller recorded it, otherwise
+// the one kept by the storage is used. A file of the remote size whose entity tag
+// equals the remote one is up to date whatever its modification time; else remote
+// modification times up to Target.MTimeTolerance newer are taken for clock skew.
+func (c *Client) CheckUpdate(localPath string, remoteInfo *FileInfo, etag string) (UpdateCheck, error) {
 	// If file doesn't exist locally, we need to download it
-	stat, err := os.Stat(localPath)
-	if os.IsNotExist(err) {
-		return true, nil
+	stat, err := c.storage.Stat(localPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return UpdateCheck{NeedsUpdate: true}, nil
 	}
 	if err != nil {
-		return false, fmt.Errorf("failed to stat local file: %w", err)
+		return UpdateCheck{}, fmt.Errorf("failed to stat local file: %w", err)
 	}
 
-	// Check if remote file is newer
-	if !remoteInfo.LastModified.IsZero() && stat.ModTime().Before(remoteInfo.LastModified) {
-		return true, nil
+	// Check if size differs (simple change detection)
+	if remoteInfo.Size > 0 && stat.Size != remoteInfo.Size {
+		return UpdateCheck{NeedsUpdate: true}, nil
 	}
 
-	// Check if size differs (simple change detection)
-	if remoteInfo.Size > 0 && stat.Size() != remoteInfo.Size {
-		return true, nil
+	// The same entity tag is the same content, however the clocks disagree
+	if etag == "" {
+		etag = stat.ETag
+	}
+	if etag != "" && remoteInfo.ETag == etag {
+		return UpdateCheck{}, nil
+	}
+
+	// Check if remote file is newer by more than the clocks of the upstream may differ
+	if !remoteInfo.LastModified.IsZero() && stat.ModTime.Before(remoteInfo.LastModified) {
+		if remoteInfo.LastModified.Sub(stat.ModTime) > c.config.GetMTimeTolerance() {
+			return UpdateCheck{NeedsUpdate: true}, nil
+		}
+		return UpdateCheck{Tolerated: true}, nil
 	}
 
 	// File appears to be up to date
-	return false, nil
+	return UpdateCheck{}, nil
+}
+
+// Digest holds the hex content hashes of a downloaded file
+type Digest struct {
+	SHA256 string
+	MD5    string
+	// FinalURL is the URL the content was served from after following redirects;
+	// empty if the request was not redirected
+	FinalURL string
+	// Content describes what the upstream served
+	Content Content
+	// Quarantined is the path the download was written to instead of the local
+	// path, if the quarantine diverted it
+	Quarantined string
+	// Resumed is the number of bytes kept from an interrupted download instead of
+	// being downloaded again
+	Resumed int64
+	// ETag is the entity tag the upstream served the content with, if any
+	ETag string
+	// Path is the path the download was written to instead of the local path,
+	// if the Content-Disposition header named it, see WithDispositionNames
+	Path string
+}
+
+// sniffLen is the number of leading bytes content types are detected from
+const sniffLen = 512
+
+// Content describes the content of a download
+type Content struct {
+	// Type is the Content-Type header of the response
+	Type string
+	// Sniffed is the type detected from the first bytes by http.DetectContentType
+	Sniffed string
 }
 
 // DownloadFile downloads a file with rate limiting and progress tracking
 func (c *Client) DownloadFile(ctx context.Context, url, localPath string) error {
+	_, err := c.DownloadFileDigest(ctx, url, localPath)
+	return err
+}
+
+// DownloadFileNamed downloads a file like DownloadFile and returns the path it was
+// written to: localPath, or the one WithDispositionNames picked from the
+// Content-Disposition header
+func (c *Client) DownloadFileNamed(ctx context.Context, url, localPath string) (string, error) {
+	digest, err := c.DownloadFileDigest(ctx, url, localPath)
+	if err != nil || digest.Path == "" {
+		return localPath, err
+	}
+	return digest.Path, nil
+}
+
+// DownloadFileDigest downloads a file like DownloadFile and returns the hashes of
+// the written content, computed while streaming. The digest is empty if the file
+// was up to date and not downloaded, but for its Path.
+func (c *Client) DownloadFileDigest(ctx context.Context, url, localPath string) (Digest, error) {
 	// Check if we need to update the file
 	if c.config.CheckChanges {
 		remoteInfo, err := c.CheckFileInfo(ctx, url)
 		if err != nil {
-			return fmt.Errorf("failed to check remote file info: %w", err)
+			return Digest{}, fmt.Errorf("failed to check remote file info: %w", err)
+		}
+
+		// The file named by the upstream is the one to compare
+		var named string
+		if c.rename != nil && remoteInfo.Filename != "" {
+			if renamed := c.rename(url, localPath, remoteInfo.Filename); renamed != "" && renamed != localPath {
+				localPath, named = renamed, renamed
+			}
 		}
 
 		needsUpdate, err := c.NeedsUpdate(localPath, remoteInfo)
 		if err != nil {
-			return fmt.Errorf("failed to check if file needs update: %w", err)
+			return Digest{}, fmt.Errorf("failed to check if file needs update: %w", err)
 		}
 
 		if !needsUpdate {
-			return nil // File is up to date
+			return Digest{Path: named}, nil // File is up to date
+		}
+		digest, err := c.FetchFileDigest(ctx, url, localPath)
+		if digest.Path == "" {
+			digest.Path = named
 		}
+		return digest, err
 	}
 
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	return c.FetchFileDigest(ctx, url, localPath)
+}
+
+// FetchFileDigest downloads a file like DownloadFileDigest, but unconditionally, for
+// callers that already checked whether the local copy is up to date. The request,
+// the rate limiter and the copy all stop as soon as ctx ends; the partial download
+// is then removed and localPath is left as it was.
+func (c *Client) FetchFileDigest(ctx context.Context, url, localPath string) (Digest, error) {
+	return c.FetchFileVerified(ctx, url, localPath, Digest{})
+}
+
+// FetchFileVerified downloads a file like FetchFileDigest. Large files are downloaded
+// in parallel chunks as configured by Target.ParallelChunks; as those are assembled
+// out of order, they are verified against the hashes of expected it has before they
+// replace localPath; so are single streams with Target.VerifyChecksums, hashed while
+// they are written. Upstreams that do not serve the ranges are read in a single
+// stream instead. With Target.ContinueDownload, single streams are written to a
+// partial file that an interrupted download is continued from, see resumeFile.
+func (c *Client) FetchFileVerified(ctx context.Context, url, localPath string, expected Digest) (Digest, error) {
+	chunked := c.config.ParallelChunks > 1
+	digest, err := c.fetchFile(ctx, url, localPath, expected, chunked, true)
+	if errors.Is(err, errResumeFailed) {
+		c.log(ctx).Debug("Partial download cannot be continued, downloading the whole file", "url", url)
+		digest, err = c.fetchFile(ctx, url, localPath, expected, chunked, false)
 	}
+	if errors.Is(err, errRangesIgnored) {
+		c.log(ctx).Debug("Upstream ignored the chunk ranges, downloading in a single stream", "url", url)
+		return c.fetchFile(ctx, url, localPath, expected, false, false)
+	}
+	return digest, err
+}
 
-	// Create/open the local file
-	file, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to create local file: %w", err)
+// fetchFile implements FetchFileVerified, downloading in chunks only if chunked is
+// set and continuing a partial download only if resume is set
+func (c *Client) fetchFile(ctx context.Context, url, localPath string, expected Digest, chunked, resume bool) (Digest, error) {
+	partials := c.partialStorage()
+	var offset int64
+	var validator string
+	if partials != nil && resume {
+		offset, validator = partials.Partial(localPath)
 	}
-	defer file.Close()
 
 	// Make the request
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create GET request: %w", err)
+		return Digest{}, fmt.Errorf("failed to create GET request: %w", err)
 	}
 
 	req.Header.Set("User-Agent", c.config.UserAgent)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
+		c.log(ctx).Debug("Resuming partial download", "url", url, "offset", offset)
+	}
+
+	// The connection and the file stay open until the download is written
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		return Digest{}, fmt.Errorf("download of %s interrupted: %w", url, err)
+	}
+	defer release()
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("GET request failed: %w", err)
+		return Digest{}, requestError("GET request", url, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("GET request returned status %d", resp.StatusCode)
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			return Digest{}, errResumeFailed
+		}
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return Digest{}, errResumeFailed
+	case resp.StatusCode != http.StatusOK:
+		return Digest{}, newStatusError("GET", url, resp)
+	default:
+		// The upstream sent the whole file, because it changed or ignores ranges
+		if offset > 0 {
+			c.log(ctx).Debug("Upstream sent the whole file instead of the rest", "url", url, "offset", offset)
+		}
+		offset = 0
+	}
+	// A size outside the range is refused before anything is written
+	if offset == 0 {
+		if err := c.CheckSize(url, resp.ContentLength); err != nil {
+			return Digest{}, err
+		}
 	}
 
-	// Copy with rate limiting
-	reader := resp.Body
-	if c.limiter != nil {
-		reader = &rateLimitedReader{
-			reader:  resp.Body,
-			limiter: c.limiter,
-			ctx:     ctx,
+	// The first bytes tell what the upstream actually served
+	body := bufio.NewReaderSize(resp.Body, sniffLen)
+	head, err := body.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		if ctx.Err() != nil {
+			return Digest{}, fmt.Errorf("download of %s interrupted: %w", url, ctx.Err())
+		}
+		if isTimeout(err) {
+			return Digest{}, &TimeoutError{Op: "GET response body", URL: url, Err: err}
+		}
+		return Digest{}, fmt.Errorf("failed to read response: %w", err)
+	}
+	if offset > 0 {
+		return c.resumeFile(ctx, url, localPath, resp, body, partials, validator, offset, expected)
+	}
+	digest := Digest{Content: Content{Type: resp.Header.Get("Content-Type"), Sniffed: http.DetectContentType(head)}, ETag: resp.Header.Get("ETag")}
+	if c.rename != nil {
+		if filename := DispositionFilename(resp.Header); filename != "" {
+			if renamed := c.rename(url, localPath, filename); renamed != "" && renamed != localPath {
+				localPath, digest.Path = renamed, renamed
+			}
 		}
 	}
+	dest := localPath
+	if c.quarantine != nil {
+		if diverted := c.quarantine(localPath, digest.Content); diverted != "" {
+			dest, digest.Quarantined = diverted, diverted
+		}
+	}
+
+	// Create directory if it doesn't exist
+	if err := c.storage.MkdirAll(filepath.Dir(dest)); err != nil {
+		return Digest{}, fmt.Errorf("failed to create directory: %w", err)
+	}
 
-	_, err = io.Copy(file, reader)
+	// The content replaces the file only once complete, so readers never see a
+	// partial file. Content with a validator can be continued after an interruption.
+	lastModified, _ := parseLastModified(resp.Header)
+	var file storage.File
+	if validator := rangeValidator(resp.Header); partials != nil && validator != "" && !(chunked && c.chunkable(resp)) {
+		file, err = partials.CreatePartial(dest, lastModified, validator, 0)
+	} else {
+		file, err = c.storage.Create(dest, lastModified, resp.Header.Get("ETag"))
+	}
 	if err != nil {
-		return fmt.Errorf("failed to copy file: %w", err)
+		return Digest{}, err
+	}
+	defer file.Abort()
+
+	if random, ok := file.(storage.RandomAccessFile); ok && chunked && c.chunkable(resp) {
+		return c.fetchChunks(ctx, url, resp, body, random, digest, expected, localPath)
 	}
 
-	// Set modification time if available
-	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
-		if t, err := time.Parse(time.RFC1123, lastModified); err == nil {
-			os.Chtimes(localPath, t, t)
+	// Copy with rate limiting. Content of unknown length is cut off past the
+	// maximum size and dropped below the minimum, and is not kept for a later
+	// attempt either way.
+	sha, sum := sha256.New(), md5.New()
+	var src io.Reader = body
+	var limit *sizeLimitReader
+	if resp.ContentLength < 0 && (c.minSize > 0 || c.maxSize > 0) {
+		limit = &sizeLimitReader{r: body, err: &FileSizeError{URL: url, Min: c.minSize, Max: c.maxSize}}
+		src = limit
+	}
+	err = c.copyBody(ctx, url, file, src, resp.ContentLength, io.MultiWriter(sha, sum))
+	if err == nil && limit != nil && limit.err.Size < c.minSize {
+		err = limit.err
+	}
+	if err != nil {
+		var sizeErr *FileSizeError
+		if partial, ok := file.(storage.PartialFile); ok && errors.As(err, &sizeErr) {
+			partial.Discard()
+		}
+		return Digest{}, err
+	}
+
+	// The hashes were computed while streaming, so content that does not match is
+	// discarded before it replaces localPath
+	digest.SHA256, digest.MD5 = hex.EncodeToString(sha.Sum(nil)), hex.EncodeToString(sum.Sum(nil))
+	if c.config.VerifyChecksums {
+		if err := digest.Verify(expected, localPath); err != nil {
+			if partial, ok := file.(storage.PartialFile); ok {
+				partial.Discard()
+			}
+			return Digest{}, err
 		}
 	}
 
+	if err := file.Commit(); err != nil {
+		return Digest{}, err
+	}
+	if final := resp.Request.URL.String(); final != url {
+		digest.FinalURL = final
+	}
+	return digest, nil
+}
+
+// copyBody copies body into file through the rate limiter, writing everything
+// copied to hashes as well. A body shorter or longer than length, the announced
+// Content-Length, fails unless length is negative.
+func (c *Client) copyBody(ctx context.Context, url string, file io.Writer, body io.Reader, length int64, hashes io.Writer) error {
+	written, err := c.buffers.copyToFile(file, io.TeeReader(c.bodyReader(ctx, body), hashes), c.syncMode)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("download of %s interrupted: %w", url, ctx.Err())
+	}
+	if isTimeout(err) {
+		return &TimeoutError{Op: "GET response body", URL: url, Err: err}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy file: %w", err)
+	}
+	if length >= 0 && written != length {
+		return fmt.Errorf("download of %s ended after %d of %d bytes: %w", url, written, length, io.ErrUnexpectedEOF)
+	}
 	return nil
 }
 
-// rateLimitedReader implements rate limiting for io.Reader
+// sizeLimitReader counts the bytes read from r in err.Size and fails with err
+// once they exceed err.Max, unless that is 0
+type sizeLimitReader struct {
+	r   io.Reader
+	err *FileSizeError
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.err.Size += int64(n)
+	if r.err.Max > 0 && r.err.Size > r.err.Max {
+		return n, r.err
+	}
+	return n, err
+}
+
+// bodyReader wraps a response body so that reading it stops once ctx is done and
+// stays within the rate limit of the client
+func (c *Client) bodyReader(ctx context.Context, body io.Reader) io.ReadCloser {
+	var reader io.ReadCloser = &contextReader{reader: io.NopCloser(body), ctx: ctx}
+	if c.limiter != nil {
+		reader = &rateLimitedReader{
+			reader:  reader,
+			limiter: c.limiter,
+			ctx:     ctx,
+		}
+	}
+	return reader
+}
+
+// contextReader ends a read loop once ctx is done, also for bodies of transports
+// that do not watch the request context themselves
+type contextReader struct {
+	reader io.ReadCloser
+	ctx    context.Context
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+func (r *contextReader) Close() error {
+	return r.reader.Close()
+}
+
+// rateLimitedReader implements rate limiting for io.Reader. ctx must be the
+// context of the request being read, so that a cancelled download does not keep
+// waiting for the limiter.
 type rateLimitedReader struct {
 	reader  io.ReadCloser
 	limiter *rate.Limiter
@@ -216,41 +688,38 @@ type rateLimitedReader struct {
 }
 
 func (r *rateLimitedReader) Read(p []byte) (n int, err error) {
-	// Wait for rate limiter
-	if err := r.limiter.WaitN(r.ctx, len(p)); err != nil {
-		return 0, err
+	// Never ask the limiter for more than its burst, or WaitN fails outright
+	if burst := r.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
 	}
 
-	return r.reader.Read(p)
+	// Wait for what was actually read, as reads often return less than asked for
+	// and readers sharing the limiter would otherwise be slowed down too much;
+	// WaitN also fails early if the wait would outlast the deadline of ctx
+	n, err = r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			if ctxErr := r.ctx.Err(); ctxErr != nil {
+				return n, ctxErr
+			}
+			return n, waitErr
+		}
+	}
+	return n, err
 }
 
 func (r *rateLimitedReader) Close() error {
 	return r.reader.Close()
 }
 
-// parseRateLimit parses a rate limit string like "500k" into bytes per second
-func parseRateLimit(rateStr string) int64 {
-	rateStr = strings.ToLower(strings.TrimSpace(rateStr))
-
-	var multiplier int64 = 1
-	var numStr string
-
-	if strings.HasSuffix(rateStr, "k") {
-		multiplier = 1024
-		numStr = strings.TrimSuffix(rateStr, "k")
-	} else if strings.HasSuffix(rateStr, "m") {
-		multiplier = 1024 * 1024
-		numStr = strings.TrimSuffix(rateStr, "m")
-	} else if strings.HasSuffix(rateStr, "g") {
-		multiplier = 1024 * 1024 * 1024
-		numStr = strings.TrimSuffix(rateStr, "g")
-	} else {
-		numStr = rateStr
-	}
-
-	if num, err := strconv.ParseInt(numStr, 10, 64); err == nil {
-		return num * multiplier
-	}
+// ParseSize parses a size string like "64k" or "1g" into bytes, returning 0 if invalid
+func ParseSize(sizeStr string) int64 {
+	return parseRateLimit(sizeStr)
+}
 
-	return 0
+// parseRateLimit parses a rate limit string like "500k" into bytes per second,
+// returning 0 if invalid
+func parseRateLimit(rateStr string) int64 {
+	rate, _ := config.ParseSize(rateStr)
+	return rate
 }
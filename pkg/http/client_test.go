@@ -1,9 +1,12 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -50,6 +53,7 @@ func TestParseRateLimit(t *testing.T) {
 		{"100k", 100 * 1024},
 		{"1m", 1 * 1024 * 1024},
 		{"2g", 2 * 1024 * 1024 * 1024},
+		{"2t", 2 * 1024 * 1024 * 1024 * 1024},
 		{"invalid", 0},
 		{"", 0},
 		{"100x", 0}, // Invalid suffix
@@ -115,6 +119,58 @@ func TestCheckFileInfo(t *testing.T) {
 	}
 }
 
+func TestLastModifiedFormats(t *testing.T) {
+	want := time.Date(2023, time.October, 21, 7, 28, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Time
+	}{
+		{"RFC 1123", "Sat, 21 Oct 2023 07:28:00 GMT", want},
+		{"RFC 1123 numeric zone", "Sat, 21 Oct 2023 09:28:00 +0200", want},
+		{"RFC 850", "Saturday, 21-Oct-23 07:28:00 GMT", want},
+		{"asctime", "Sat Oct 21 07:28:00 2023", want},
+		{"malformed", "yesterday-ish", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Last-Modified", tt.header)
+				w.Write([]byte("content"))
+			}))
+			defer server.Close()
+			client := NewClient(&config.Target{UserAgent: "Test Agent", Timeout: 5})
+
+			info, err := client.CheckFileInfo(context.Background(), server.URL)
+			if err != nil {
+				t.Fatalf("CheckFileInfo failed: %v", err)
+			}
+			if !info.LastModified.Equal(tt.want) || info.LastModified.Location() != time.UTC {
+				t.Errorf("Expected LastModified %v in UTC, got %v", tt.want, info.LastModified)
+			}
+			// A malformed date falls back to size-only change detection
+			if info.Size != 7 {
+				t.Errorf("Expected size 7, got %d", info.Size)
+			}
+
+			localPath := filepath.Join(t.TempDir(), "file")
+			if err := client.DownloadFile(context.Background(), server.URL, localPath); err != nil {
+				t.Fatalf("DownloadFile failed: %v", err)
+			}
+			stat, err := os.Stat(localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want.IsZero() && !stat.ModTime().Equal(tt.want) {
+				t.Errorf("Expected mtime %v, got %v", tt.want, stat.ModTime())
+			}
+			if tt.want.IsZero() && time.Since(stat.ModTime()) > time.Minute {
+				t.Errorf("Expected malformed date to leave the download time, got %v", stat.ModTime())
+			}
+		})
+	}
+}
+
 func TestCheckFileInfoError(t *testing.T) {
 	target := &config.Target{
 		UserAgent: "Test Agent",
@@ -216,6 +272,53 @@ func TestNeedsUpdate(t *testing.T) {
 	}
 }
 
+func TestCheckUpdateToleratesSkew(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(localPath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(localPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	none := 0
+
+	tests := []struct {
+		name      string
+		tolerance *int
+		info      FileInfo
+		etag      string
+		want      UpdateCheck
+	}{
+		{name: "within default", info: FileInfo{LastModified: modTime.Add(2 * time.Second), Size: 7},
+			want: UpdateCheck{Tolerated: true}},
+		{name: "beyond default", info: FileInfo{LastModified: modTime.Add(3 * time.Second), Size: 7},
+			want: UpdateCheck{NeedsUpdate: true}},
+		{name: "no tolerance", tolerance: &none, info: FileInfo{LastModified: modTime.Add(time.Second), Size: 7},
+			want: UpdateCheck{NeedsUpdate: true}},
+		{name: "older", info: FileInfo{LastModified: modTime.Add(-time.Hour), Size: 7}},
+		{name: "same etag", info: FileInfo{LastModified: modTime.Add(time.Hour), Size: 7, ETag: `"abc"`}, etag: `"abc"`},
+		{name: "same etag other size", info: FileInfo{LastModified: modTime, Size: 8, ETag: `"abc"`}, etag: `"abc"`,
+			want: UpdateCheck{NeedsUpdate: true}},
+		{name: "other etag", info: FileInfo{LastModified: modTime.Add(time.Hour), Size: 7, ETag: `"def"`}, etag: `"abc"`,
+			want: UpdateCheck{NeedsUpdate: true}},
+		{name: "other etag within tolerance", info: FileInfo{LastModified: modTime.Add(time.Second), Size: 7, ETag: `"def"`},
+			etag: `"abc"`, want: UpdateCheck{Tolerated: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(&config.Target{MTimeTolerance: tt.tolerance})
+			got, err := client.CheckUpdate(localPath, &tt.info, tt.etag)
+			if err != nil {
+				t.Fatalf("CheckUpdate failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
 func TestDownloadFile(t *testing.T) {
 	testContent := "This is test content for download"
 
@@ -276,6 +379,76 @@ func TestDownloadFile(t *testing.T) {
 	}
 }
 
+func TestDownloadFileFailureKeepsExistingFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(localPath, []byte("previous version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(&config.Target{UserAgent: "Test Agent", Timeout: 5})
+	if _, err := client.FetchFileDigest(context.Background(), server.URL, localPath); err == nil {
+		t.Fatal("Expected download to fail")
+	}
+
+	if data, _ := os.ReadFile(localPath); string(data) != "previous version" {
+		t.Errorf("Expected previous version to be untouched, got %q", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected temporary file to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestDownloadFileInterruptedKeepsExistingFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The connection breaks after half of the announced content
+		w.Header().Set("Content-Length", "10000")
+		w.Write(bytes.Repeat([]byte("x"), 5000))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(localPath, []byte("previous version"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(&config.Target{UserAgent: "Test Agent", Timeout: 5})
+	if err := client.DownloadFile(context.Background(), server.URL, localPath); err == nil {
+		t.Fatal("Expected the interrupted download to fail")
+	}
+
+	if data, _ := os.ReadFile(localPath); string(data) != "previous version" {
+		t.Errorf("Expected previous version to be untouched, got %d bytes", len(data))
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected temporary file to be removed, found %d entries", len(entries))
+	}
+}
+
+func TestCopyBodyChecksLength(t *testing.T) {
+	client := NewClient(&config.Target{Timeout: 5})
+	for _, tt := range []struct {
+		length int64
+		ok     bool
+	}{{7, true}, {-1, true}, {8, false}, {6, false}} {
+		var file, hashes bytes.Buffer
+		err := client.copyBody(context.Background(), "http://example.com/a", &file, strings.NewReader("content"), tt.length, &hashes)
+		if (err == nil) != tt.ok {
+			t.Errorf("Length %d: expected success %t, got %v", tt.length, tt.ok, err)
+		}
+	}
+}
+
 func TestDownloadFileSkipUnchanged(t *testing.T) {
 	testContent := "This is test content"
 
@@ -361,3 +534,429 @@ func TestRateLimitedReader(t *testing.T) {
 		t.Errorf("rateLimitedReader.Close failed: %v", err)
 	}
 }
+
+// slowServer sends the first part of a body and then stalls until the request
+// is cancelled or the test ends
+func slowServer(t *testing.T, first []byte) *httptest.Server {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1048576")
+		w.Write(first)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+	return server
+}
+
+func TestFetchFileDigestCancellation(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit string
+		first     int
+	}{
+		{name: "stalled body", first: 1024},
+		// The limiter allows 1 KiB/s, so the first chunk alone takes minutes
+		{name: "waiting for rate limiter", rateLimit: "1k", first: 256 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := slowServer(t, []byte(strings.Repeat("x", tt.first)))
+			dir := t.TempDir()
+			localPath := filepath.Join(dir, "file.bin")
+			client := NewClient(&config.Target{UserAgent: "Test Agent", Timeout: 60, RateLimit: tt.rateLimit})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, cancel)
+			start := time.Now()
+			_, err := client.FetchFileDigest(ctx, server.URL, localPath)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("Expected cancellation error, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Expected download to stop promptly after cancellation, took %v", elapsed)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("Expected partial download to be removed, found %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestContextReaderStopsAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &contextReader{reader: io.NopCloser(strings.NewReader("data")), ctx: ctx}
+	cancel()
+	if _, err := reader.Read(make([]byte, 4)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRateLimitedReaderCapsReadsAtBurst(t *testing.T) {
+	target := &config.Target{
+		RateLimit: "1k",
+	}
+	client := NewClient(target)
+
+	rateLimited := &rateLimitedReader{
+		reader:  io.NopCloser(strings.NewReader(strings.Repeat("x", 4096))),
+		limiter: client.limiter,
+		ctx:     context.Background(),
+	}
+
+	// A buffer larger than the limiter burst must not make WaitN fail
+	buffer := make([]byte, 64*1024)
+	n, err := rateLimited.Read(buffer)
+	if err != nil {
+		t.Fatalf("rateLimitedReader.Read failed: %v", err)
+	}
+
+	if n != 1024 {
+		t.Errorf("Expected read to be capped at the 1024 byte burst, got %d", n)
+	}
+}
+
+func TestDownloadFileWithWriteOptions(t *testing.T) {
+	testContent := strings.Repeat("buffered content ", 1000)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(testContent))
+	}))
+	defer server.Close()
+
+	target := &config.Target{
+		UserAgent: "Test Agent",
+	}
+
+	client := NewClient(target, WithWriteOptions(WriteOptions{
+		BufferSize: 1024,
+		SyncMode:   SyncAlways,
+	}))
+
+	localPath := filepath.Join(t.TempDir(), "buffered.txt")
+	if err := client.DownloadFile(context.Background(), server.URL, localPath); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+
+	content, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+
+	if string(content) != testContent {
+		t.Errorf("Downloaded content mismatch: got %d bytes, expected %d", len(content), len(testContent))
+	}
+}
+
+// countingTransport counts requests before delegating to http.DefaultTransport
+type countingTransport struct {
+	requests int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	transport := &countingTransport{}
+	client := NewClient(&config.Target{UserAgent: "Test Agent"}, WithTransport(transport))
+
+	if _, err := client.CheckFileInfo(context.Background(), server.URL); err != nil {
+		t.Fatalf("CheckFileInfo failed: %v", err)
+	}
+	if err := client.DownloadFile(context.Background(), server.URL, filepath.Join(t.TempDir(), "f")); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+
+	if transport.requests < 2 {
+		t.Errorf("Expected requests to go through the custom transport, got %d", transport.requests)
+	}
+}
+
+func TestDownloadFileDigest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	client := NewClient(&config.Target{UserAgent: "Test Agent"})
+	digest, err := client.DownloadFileDigest(context.Background(), server.URL, filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatalf("DownloadFileDigest failed: %v", err)
+	}
+	if digest.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" ||
+		digest.MD5 != "5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("Unexpected digest %+v", digest)
+	}
+}
+
+func TestFetchFileDigestQuarantine(t *testing.T) {
+	const page = "<!DOCTYPE html><html><body>Please log in</body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "firmware.bin")
+	if err := os.WriteFile(localPath, []byte("good firmware"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	quarantined := filepath.Join(dir, "quarantine", "firmware.bin")
+
+	var seen Content
+	client := NewClient(&config.Target{UserAgent: "Test Agent"}, WithQuarantine(func(path string, content Content) string {
+		seen = content
+		if strings.HasPrefix(content.Sniffed, "text/html") {
+			return quarantined
+		}
+		return ""
+	}))
+	digest, err := client.FetchFileDigest(context.Background(), server.URL, localPath)
+	if err != nil {
+		t.Fatalf("FetchFileDigest failed: %v", err)
+	}
+
+	if seen.Type != "application/octet-stream" || !strings.HasPrefix(seen.Sniffed, "text/html") {
+		t.Errorf("Expected the header and sniffed types, got %+v", seen)
+	}
+	if digest.Content != seen || digest.Quarantined != quarantined {
+		t.Errorf("Expected the digest to describe the quarantined content, got %+v", digest)
+	}
+	if data, _ := os.ReadFile(localPath); string(data) != "good firmware" {
+		t.Errorf("Expected the existing file to be kept, got %q", data)
+	}
+	if data, _ := os.ReadFile(quarantined); string(data) != page {
+		t.Errorf("Expected the download in quarantine, got %q", data)
+	}
+}
+
+func TestFetchFileVerifiedChecksums(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "f")
+	if err := os.WriteFile(localPath, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wrong := Digest{SHA256: strings.Repeat("0", 64)}
+
+	// Single streams are only verified on request
+	client := NewClient(&config.Target{UserAgent: "Test Agent"})
+	if _, err := client.FetchFileVerified(context.Background(), server.URL, localPath, wrong); err != nil {
+		t.Fatalf("Expected no verification without VerifyChecksums, got %v", err)
+	}
+
+	os.WriteFile(localPath, []byte("old"), 0644)
+	client = NewClient(&config.Target{UserAgent: "Test Agent", VerifyChecksums: true})
+	_, err := client.FetchFileVerified(context.Background(), server.URL, localPath, wrong)
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Algorithm != "sha256" {
+		t.Fatalf("Expected a SHA-256 mismatch, got %v", err)
+	}
+	if data, _ := os.ReadFile(localPath); string(data) != "old" {
+		t.Errorf("Expected the mismatching download discarded, got %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no leftover files, got %v", entries)
+	}
+
+	digest, err := client.FetchFileVerified(context.Background(), server.URL, localPath, Digest{MD5: "5d41402abc4b2a76b9719d911017c592"})
+	if err != nil || digest.MD5 != "5d41402abc4b2a76b9719d911017c592" {
+		t.Fatalf("Expected the matching download, got %+v, %v", digest, err)
+	}
+	if data, _ := os.ReadFile(localPath); string(data) != "hello" {
+		t.Errorf("Expected the verified download written, got %q", data)
+	}
+}
+
+func TestDispositionFilename(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"attachment", ""},
+		{`attachment; filename="report.pdf"`, "report.pdf"},
+		{"attachment; filename=report.pdf", "report.pdf"},
+		{`inline; filename="a b.txt"`, "a b.txt"},
+		{"attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf", "résumé.pdf"},
+		{`attachment; filename="../../etc/passwd"`, "../../etc/passwd"},
+		{`attachment; filename="unterminated`, ""},
+		{"attachment; filename=a; filename=b", ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.header != "" {
+			header.Set("Content-Disposition", tt.header)
+		}
+		if got := DispositionFilename(header); got != tt.want {
+			t.Errorf("DispositionFilename(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadFileNamed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+r.URL.Query().Get("name")+`"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "download")
+	var names []string
+	client := NewClient(&config.Target{UserAgent: "Test Agent", CheckChanges: true}, WithDispositionNames(func(url, path, filename string) string {
+		names = append(names, filename)
+		if path != localPath || strings.Contains(filename, "/") {
+			return ""
+		}
+		return filepath.Join(dir, filename)
+	}))
+
+	named, err := client.DownloadFileNamed(context.Background(), server.URL+"/download?name=report.pdf", localPath)
+	if err != nil {
+		t.Fatalf("DownloadFileNamed failed: %v", err)
+	}
+	if want := filepath.Join(dir, "report.pdf"); named != want {
+		t.Errorf("Expected the download at %s, got %s", want, named)
+	}
+	if data, _ := os.ReadFile(named); string(data) != "data" {
+		t.Errorf("Expected the content at the named path, got %q", data)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing at the URL-derived path, got %v", err)
+	}
+
+	// The named file is the one checked for changes
+	names = nil
+	named, err = client.DownloadFileNamed(context.Background(), server.URL+"/download?name=report.pdf", localPath)
+	if err != nil || named != filepath.Join(dir, "report.pdf") || len(names) != 1 {
+		t.Errorf("Expected the unchanged named file without a download, got %s, %v after %v", named, err, names)
+	}
+
+	named, err = client.DownloadFileNamed(context.Background(), server.URL+"/download?name=../evil", localPath)
+	if err != nil {
+		t.Fatalf("DownloadFileNamed failed: %v", err)
+	}
+	if named != localPath {
+		t.Errorf("Expected a rejected name to keep the local path, got %s", named)
+	}
+}
+
+func TestClientLogger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client := NewClient(&config.Target{UserAgent: "Test Agent"}, WithLogger(base.With("target", "t")))
+	dir := t.TempDir()
+
+	if err := client.DownloadFile(context.Background(), server.URL+"/old", filepath.Join(dir, "a")); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	if got := logs.String(); !strings.Contains(got, "Following redirect") || !strings.Contains(got, "target=t") {
+		t.Errorf("Expected the redirect logged with the client's attributes, got %q", got)
+	}
+
+	// A logger of the context takes precedence
+	logs.Reset()
+	ctx := ContextWithLogger(context.Background(), base.With("target", "t", "depth", 2))
+	if err := client.DownloadFile(ctx, server.URL+"/old", filepath.Join(dir, "b")); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	if got := logs.String(); !strings.Contains(got, "Following redirect") || !strings.Contains(got, "depth=2") {
+		t.Errorf("Expected the redirect logged with the call's attributes, got %q", got)
+	}
+
+	// Without a logger, the client does not log
+	logs.Reset()
+	if err := NewClient(&config.Target{}).DownloadFile(context.Background(), server.URL+"/old", filepath.Join(dir, "c")); err != nil {
+		t.Fatalf("DownloadFile failed: %v", err)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("Expected no records, got %q", logs.String())
+	}
+}
+
+func TestFetchFileSizeLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2023 07:28:00 GMT")
+		switch r.URL.Path {
+		case "/large":
+			w.Write(bytes.Repeat([]byte("x"), 2048))
+		case "/small":
+			w.Write([]byte("tiny"))
+		case "/stream":
+			// Without a Content-Length the size is only known while reading
+			chunk := bytes.Repeat([]byte("x"), 1024)
+			for range 1024 {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+			}
+		case "/tiny-stream":
+			w.Write([]byte("tiny"))
+			w.(http.Flusher).Flush()
+		default:
+			w.Write(bytes.Repeat([]byte("x"), 512))
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(&config.Target{Timeout: 5, MinFileSize: "100", MaxFileSize: "1k", ContinueDownload: true})
+	for _, path := range []string{"/large", "/small", "/stream", "/tiny-stream"} {
+		t.Run(path, func(t *testing.T) {
+			dir := t.TempDir()
+			localPath := filepath.Join(dir, "file")
+			_, err := client.FetchFileDigest(context.Background(), server.URL+path, localPath)
+			var sizeErr *FileSizeError
+			if !errors.As(err, &sizeErr) {
+				t.Fatalf("Expected a FileSizeError, got %v", err)
+			}
+			// The stream is aborted within a read or two of growing past the maximum
+			if path == "/stream" && sizeErr.Size >= 512*1024 {
+				t.Errorf("Expected the stream aborted past the maximum, read %d bytes", sizeErr.Size)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("Expected nothing kept of the refused file, found %d entries", len(entries))
+			}
+		})
+	}
+
+	if _, err := client.FetchFileDigest(context.Background(), server.URL+"/fits", filepath.Join(t.TempDir(), "file")); err != nil {
+		t.Errorf("Expected a file within the range to download, got %v", err)
+	}
+	if err := client.CheckSize(server.URL, -1); err != nil {
+		t.Errorf("Expected an unknown size to pass, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPResolver determines the client address of a request. Forwarding headers
+// are only honored when the direct peer is a trusted proxy, so clients cannot
+// spoof their address by sending them.
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIPResolver creates a resolver trusting the given CIDR ranges. Bare
+// addresses are accepted as single-host ranges.
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	r := &ClientIPResolver{}
+	for _, cidr := range trustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		r.trusted = append(r.trusted, prefix.Masked())
+	}
+	return r, nil
+}
+
+// isTrusted reports whether addr is within a trusted proxy range
+func (r *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	if r == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedPeer reports whether req came directly from a trusted proxy, whose
+// headers may be believed
+func (r *ClientIPResolver) TrustedPeer(req *http.Request) bool {
+	peer, ok := parseHop(req.RemoteAddr)
+	return ok && r.isTrusted(peer)
+}
+
+// ClientIP returns the client address of req. Without a trusted peer it is the
+// address of the connection. Otherwise the forwarding chain from Forwarded,
+// X-Forwarded-For or X-Real-IP (in that order of preference) is walked from the
+// right, and the first address that is not a trusted proxy is the client.
+func (r *ClientIPResolver) ClientIP(req *http.Request) string {
+	peer, ok := parseHop(req.RemoteAddr)
+	if !ok {
+		return remoteHost(req.RemoteAddr)
+	}
+	if !r.isTrusted(peer) {
+		return peer.String()
+	}
+
+	chain := forwardedChain(req.Header)
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop, ok := parseHop(chain[i])
+		if !ok {
+			// Garbage in the chain was not added by a trusted proxy; the hop
+			// after it is the last address we can vouch for
+			break
+		}
+		client = hop
+		if !r.isTrusted(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedChain returns the addresses a request passed through, oldest first
+func forwardedChain(header http.Header) []string {
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		var chain []string
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						chain = append(chain, strings.Trim(val, `"`))
+					}
+				}
+			}
+		}
+		return chain
+	}
+	if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		var chain []string
+		for _, value := range values {
+			for _, hop := range strings.Split(value, ",") {
+				chain = append(chain, strings.TrimSpace(hop))
+			}
+		}
+		return chain
+	}
+	if value := header.Get("X-Real-IP"); value != "" {
+		return []string{strings.TrimSpace(value)}
+	}
+	return nil
+}
+
+// parseHop parses an address with an optional port, as found in RemoteAddr and
+// forwarding headers ("192.0.2.1", "192.0.2.1:80", "[2001:db8::1]:80")
+func parseHop(s string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// remoteHost strips the port from an address that is not an IP, e.g. a unix socket
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+type clientIPKey struct{}
+
+// ClientIPMiddleware resolves the client address once per request with the resolver
+// returned by current, so later handlers read it with ClientIP instead of parsing
+// headers themselves. current is called per request, so the trusted proxies can be
+// replaced on reload.
+func ClientIPMiddleware(current func() *ClientIPResolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), clientIPKey{}, current().ClientIP(req))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// ClientIP returns the client address resolved by ClientIPMiddleware,
+// falling back to the address of the connection
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return (*ClientIPResolver)(nil).ClientIP(req)
+}
@@ -0,0 +1,189 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("NewClientIPResolver failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:51234",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "spoofed X-Forwarded-For from untrusted peer",
+			remoteAddr: "203.0.113.7:51234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "spoofed X-Real-IP from untrusted peer",
+			remoteAddr: "203.0.113.7:51234",
+			headers:    map[string][]string{"X-Real-IP": {"1.2.3.4"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "single trusted proxy",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "chained trusted proxies",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7, 192.168.1.1, 10.1.2.3"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "client prepends spoofed address to chain",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.7, 10.1.2.3"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "chain split across header lines",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.7", "10.1.2.3"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "garbage in chain stops at last valid hop",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"not-an-ip, 10.1.2.3"}},
+			expected:   "10.1.2.3",
+		},
+		{
+			name:       "only trusted addresses",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"10.9.9.9, 10.1.2.3"}},
+			expected:   "10.9.9.9",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.0.0.1:443",
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "X-Real-IP from trusted proxy",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"X-Real-IP": {"203.0.113.7"}},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "Forwarded preferred over X-Forwarded-For",
+			remoteAddr: "10.0.0.1:443",
+			headers: map[string][]string{
+				"Forwarded":       {`for=198.51.100.2;proto=https, for="[2001:db8::1]:4711";by=10.1.2.3`},
+				"X-Forwarded-For": {"1.2.3.4"},
+			},
+			expected: "2001:db8::1",
+		},
+		{
+			name:       "Forwarded with obfuscated identifier",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string][]string{"Forwarded": {"for=_hidden, for=10.1.2.3"}},
+			expected:   "10.1.2.3",
+		},
+		{
+			name:       "IPv6 trusted peer",
+			remoteAddr: "[fd00::1]:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"2001:db8::7"}},
+			expected:   "2001:db8::7",
+		},
+		{
+			name:       "IPv4-mapped peer",
+			remoteAddr: "[::ffff:10.0.0.1]:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			expected:   "203.0.113.7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(key, value)
+				}
+			}
+			if got := resolver.ClientIP(req); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	resolver, err := NewClientIPResolver(nil)
+	if err != nil {
+		t.Fatalf("NewClientIPResolver failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:443"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if got := resolver.ClientIP(req); got != "10.0.0.1" {
+		t.Errorf("Expected forwarding headers to be ignored, got %s", got)
+	}
+}
+
+func TestTrustedPeer(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewClientIPResolver failed: %v", err)
+	}
+	for remote, want := range map[string]bool{"10.1.2.3:443": true, "[::ffff:10.1.2.3]:443": true, "203.0.113.7:443": false, "@": false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		if got := resolver.TrustedPeer(req); got != want {
+			t.Errorf("TrustedPeer(%s) = %v, want %v", remote, got, want)
+		}
+	}
+	if (*ClientIPResolver)(nil).TrustedPeer(httptest.NewRequest("GET", "/", nil)) {
+		t.Error("Expected a nil resolver to trust no peer")
+	}
+}
+
+func TestNewClientIPResolverInvalid(t *testing.T) {
+	if _, err := NewClientIPResolver([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected error for invalid CIDR")
+	}
+	if _, err := NewClientIPResolver([]string{"proxy.local"}); err == nil {
+		t.Error("Expected error for hostname")
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	resolver, _ := NewClientIPResolver([]string{"10.0.0.0/8"})
+	var got string
+	handler := ClientIPMiddleware(func() *ClientIPResolver { return resolver },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = ClientIP(r)
+		}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:443"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "203.0.113.7" {
+		t.Errorf("Expected resolved client address, got %s", got)
+	}
+
+	// Outside the middleware the connection address is used
+	if ip := ClientIP(req); ip != "10.0.0.1" {
+		t.Errorf("Expected connection address without middleware, got %s", ip)
+	}
+}
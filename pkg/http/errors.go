@@ -0,0 +1,147 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// StatusError is returned when a server answers with an unexpected status code
+type StatusError struct {
+	Method string
+	URL    string
+	Code   int
+	// Header is a copy of the response headers and Redirects the URLs redirected
+	// through before the response, starting with URL; both are nil if unknown
+	Header    http.Header
+	Redirects []string
+}
+
+// newStatusError returns the StatusError of resp to a method request for url
+func newStatusError(method, url string, resp *http.Response) *StatusError {
+	err := &StatusError{Method: method, URL: url, Code: resp.StatusCode, Header: resp.Header.Clone()}
+	// Each redirected request carries the response that caused it
+	for req := resp.Request; req != nil && (req.Response != nil || err.Redirects != nil); {
+		err.Redirects = append(err.Redirects, req.URL.String())
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	slices.Reverse(err.Redirects)
+	return err
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s request returned status %d", e.Method, e.Code)
+}
+
+// Temporary reports whether the status may go away on retry: server errors,
+// rate limiting and request timeouts
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests || e.Code == http.StatusRequestTimeout
+}
+
+// TimeoutError is returned when a request did not complete in time
+type TimeoutError struct {
+	Op  string
+	URL string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out: %v", e.Op, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// RedirectBlockedError is returned when the cross-host redirect policy refused to
+// follow a redirect from URL to Location
+type RedirectBlockedError struct {
+	URL      string
+	Location string
+}
+
+func (e *RedirectBlockedError) Error() string {
+	return fmt.Sprintf("cross-host redirect to %s blocked", e.Location)
+}
+
+// FileSizeError is returned for a file outside Target.MinFileSize and
+// Target.MaxFileSize, 0 meaning no bound. Size is the size the upstream announced
+// or, for a download of unknown size that grew past Max, the bytes received when
+// it was aborted.
+type FileSizeError struct {
+	URL  string
+	Size int64
+	Min  int64
+	Max  int64
+}
+
+func (e *FileSizeError) Error() string {
+	if e.Max > 0 && e.Size > e.Max {
+		return fmt.Sprintf("file of %d bytes exceeds the maximum size of %d bytes", e.Size, e.Max)
+	}
+	return fmt.Sprintf("file of %d bytes is below the minimum size of %d bytes", e.Size, e.Min)
+}
+
+// ChecksumMismatchError is returned when content does not hash to its expected digest
+type ChecksumMismatchError struct {
+	Path      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for %s: expected %s, got %s", e.Algorithm, e.Path, e.Expected, e.Actual)
+}
+
+// Verify compares d with expected, preferring SHA-256 and falling back to MD5 when
+// expected has no SHA-256. An empty expected digest always matches.
+func (d Digest) Verify(expected Digest, path string) error {
+	switch {
+	case expected.SHA256 != "" && d.SHA256 != expected.SHA256:
+		return &ChecksumMismatchError{Path: path, Algorithm: "sha256", Expected: expected.SHA256, Actual: d.SHA256}
+	case expected.SHA256 == "" && expected.MD5 != "" && d.MD5 != expected.MD5:
+		return &ChecksumMismatchError{Path: path, Algorithm: "md5", Expected: expected.MD5, Actual: d.MD5}
+	}
+	return nil
+}
+
+// requestError wraps a failed request, turning timeouts into a TimeoutError
+func requestError(op, url string, err error) error {
+	if isTimeout(err) {
+		return &TimeoutError{Op: op, URL: url, Err: err}
+	}
+	return fmt.Errorf("%s failed: %w", op, err)
+}
+
+// isTimeout reports whether err is a deadline or network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// IsTemporary reports whether err is a failure that may succeed on retry: a
+// timeout, a temporary status or a network error. Cancellation is not temporary.
+func IsTemporary(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+	var redirectErr *RedirectBlockedError
+	if errors.As(err, &redirectErr) {
+		return false
+	}
+	var timeoutErr *TimeoutError
+	var netErr net.Error
+	return errors.As(err, &timeoutErr) || errors.As(err, &netErr)
+}
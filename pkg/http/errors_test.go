@@ -0,0 +1,120 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestClientErrorTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/busy":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/moved":
+			http.Redirect(w, r, "/busy", http.StatusFound)
+		case "/slow":
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(&config.Target{Timeout: 5})
+	localPath := filepath.Join(t.TempDir(), "file")
+
+	_, err := client.CheckFileInfo(context.Background(), server.URL+"/missing")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusNotFound || statusErr.Method != "HEAD" {
+		t.Errorf("Expected HEAD StatusError 404, got %v", err)
+	}
+	if IsTemporary(err) {
+		t.Error("Expected 404 not to be temporary")
+	}
+
+	err = client.DownloadFile(context.Background(), server.URL+"/busy", localPath)
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusServiceUnavailable || statusErr.URL != server.URL+"/busy" {
+		t.Errorf("Expected GET StatusError 503, got %v", err)
+	}
+	if !IsTemporary(err) {
+		t.Error("Expected 503 to be temporary")
+	}
+	if statusErr.Header.Get("Retry-After") != "30" || statusErr.Redirects != nil {
+		t.Errorf("Expected the response headers without redirects, got %v %v", statusErr.Header, statusErr.Redirects)
+	}
+
+	// Redirects followed to the response are listed in order
+	err = client.DownloadFile(context.Background(), server.URL+"/moved", localPath)
+	want := []string{server.URL + "/moved", server.URL + "/busy"}
+	if !errors.As(err, &statusErr) || !slices.Equal(statusErr.Redirects, want) {
+		t.Errorf("Expected the redirect chain %v, got %v", want, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = client.DownloadFile(ctx, server.URL+"/slow", localPath)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected TimeoutError wrapping the deadline, got %v", err)
+	}
+	if !IsTemporary(err) {
+		t.Error("Expected timeout to be temporary")
+	}
+}
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&StatusError{Code: 500}, true},
+		{&StatusError{Code: 429}, true},
+		{&StatusError{Code: 403}, false},
+		{fmt.Errorf("target: %w", &TimeoutError{Op: "GET request", Err: context.DeadlineExceeded}), true},
+		{&ChecksumMismatchError{Algorithm: "sha256"}, false},
+		{context.Canceled, false},
+		{errors.New("disk full"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsTemporary(tt.err); got != tt.expected {
+			t.Errorf("IsTemporary(%v) = %v, expected %v", tt.err, got, tt.expected)
+		}
+	}
+}
+
+func TestDigestVerify(t *testing.T) {
+	digest := Digest{SHA256: "aaa", MD5: "bbb"}
+
+	tests := []struct {
+		expected  Digest
+		algorithm string
+	}{
+		{Digest{SHA256: "aaa", MD5: "zzz"}, ""},
+		{Digest{SHA256: "ccc"}, "sha256"},
+		{Digest{MD5: "bbb"}, ""},
+		{Digest{MD5: "ccc"}, "md5"},
+		{Digest{}, ""},
+	}
+	for _, tt := range tests {
+		err := digest.Verify(tt.expected, "file")
+		var mismatch *ChecksumMismatchError
+		if tt.algorithm == "" {
+			if err != nil {
+				t.Errorf("Verify(%+v) returned %v, expected match", tt.expected, err)
+			}
+		} else if !errors.As(err, &mismatch) || mismatch.Algorithm != tt.algorithm || mismatch.Path != "file" {
+			t.Errorf("Verify(%+v) returned %v, expected %s mismatch", tt.expected, err, tt.algorithm)
+		}
+	}
+}
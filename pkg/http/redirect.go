@@ -0,0 +1,88 @@
+package http
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Cross-host redirect policies of config.Target.CrossHostRedirects
+const (
+	RedirectAllow = "allow"
+	RedirectDeny  = "deny"
+)
+
+// maxRedirects is how many redirects a single request follows, like net/http's default
+const maxRedirects = 10
+
+// RedirectSummary counts the redirects followed and blocked by a client, keyed by
+// the host redirected to
+type RedirectSummary struct {
+	Followed map[string]int64
+	Blocked  map[string]int64
+}
+
+// redirectLog records the redirects of a client; it is safe for concurrent use
+type redirectLog struct {
+	mu      sync.Mutex
+	summary RedirectSummary
+}
+
+// record counts a redirect to host
+func (l *redirectLog) record(host string, blocked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counts := &l.summary.Followed
+	if blocked {
+		counts = &l.summary.Blocked
+	}
+	if *counts == nil {
+		*counts = make(map[string]int64)
+	}
+	(*counts)[host]++
+}
+
+// snapshot returns a copy of the recorded redirects
+func (l *redirectLog) snapshot() RedirectSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RedirectSummary{Followed: maps.Clone(l.summary.Followed), Blocked: maps.Clone(l.summary.Blocked)}
+}
+
+// Redirects returns the redirects the client followed and blocked so far
+func (c *Client) Redirects() RedirectSummary {
+	return c.redirects.snapshot()
+}
+
+// checkRedirect is the http.Client redirect policy. With the "deny" policy,
+// redirects leaving the host of the original request are refused unless the new
+// host is in RedirectAllowHosts.
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	origin := via[0].URL
+	if c.config.CrossHostRedirects == RedirectDeny && host != strings.ToLower(origin.Hostname()) && !c.redirectAllowed(host) {
+		c.redirects.record(host, true)
+		c.log(req.Context()).Debug("Blocking cross-host redirect", "url", origin.String(), "location", req.URL.String())
+		return &RedirectBlockedError{URL: origin.String(), Location: req.URL.String()}
+	}
+	c.redirects.record(host, false)
+	c.log(req.Context()).Debug("Following redirect", "url", via[len(via)-1].URL.String(), "location", req.URL.String())
+	return nil
+}
+
+// redirectAllowed reports whether host is allowlisted for cross-host redirects
+func (c *Client) redirectAllowed(host string) bool {
+	for _, allowed := range c.config.RedirectAllowHosts {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
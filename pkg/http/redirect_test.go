@@ -0,0 +1,94 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestCrossHostRedirects(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer cdn.Close()
+	// The same server under another host name stands in for a CDN
+	cdnURL := strings.Replace(cdn.URL, "127.0.0.1", "localhost", 1)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/file", http.StatusFound)
+		case "/file":
+			http.Redirect(w, r, cdnURL+"/file", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name       string
+		policy     string
+		allowHosts []string
+		blocked    bool
+	}{
+		{"allowed by default", "", nil, false},
+		{"denied", RedirectDeny, nil, true},
+		{"denied but allowlisted", RedirectDeny, []string{"LOCALHOST"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(&config.Target{UserAgent: "Test Agent", CrossHostRedirects: tt.policy, RedirectAllowHosts: tt.allowHosts})
+			digest, err := client.FetchFileDigest(context.Background(), origin.URL+"/moved", filepath.Join(t.TempDir(), "f"))
+			redirects := client.Redirects()
+
+			if tt.blocked {
+				var blockedErr *RedirectBlockedError
+				if !errors.As(err, &blockedErr) || blockedErr.Location != cdnURL+"/file" {
+					t.Fatalf("Expected RedirectBlockedError for %s, got %v", cdnURL, err)
+				}
+				if IsTemporary(err) {
+					t.Error("Expected blocked redirect not to be retried")
+				}
+				if redirects.Blocked["localhost"] != 1 || redirects.Followed["127.0.0.1"] != 1 {
+					t.Errorf("Unexpected redirect summary %+v", redirects)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("FetchFileDigest failed: %v", err)
+			}
+			if digest.FinalURL != cdnURL+"/file" {
+				t.Errorf("Expected final URL %s, got %q", cdnURL+"/file", digest.FinalURL)
+			}
+			if redirects.Followed["127.0.0.1"] != 1 || redirects.Followed["localhost"] != 1 || len(redirects.Blocked) != 0 {
+				t.Errorf("Unexpected redirect summary %+v", redirects)
+			}
+		})
+	}
+}
+
+func TestFetchFileDigestWithoutRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	client := NewClient(&config.Target{UserAgent: "Test Agent"})
+	digest, err := client.FetchFileDigest(context.Background(), server.URL+"/f", filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatalf("FetchFileDigest failed: %v", err)
+	}
+	if digest.FinalURL != "" {
+		t.Errorf("Expected no final URL without redirect, got %q", digest.FinalURL)
+	}
+	if redirects := client.Redirects(); len(redirects.Followed) != 0 || len(redirects.Blocked) != 0 {
+		t.Errorf("Expected no redirects, got %+v", redirects)
+	}
+}
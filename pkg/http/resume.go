@@ -0,0 +1,104 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// errResumeFailed is returned when a partial download cannot be continued, e.g.
+// because the upstream answered the range request with another range; the file is
+// then downloaded again from the start
+var errResumeFailed = errors.New("partial download cannot be continued")
+
+// partialStorage returns the storage of the client if it keeps partial downloads for
+// Target.ContinueDownload, or nil
+func (c *Client) partialStorage() storage.PartialStorage {
+	if !c.config.ContinueDownload {
+		return nil
+	}
+	partials, _ := c.storage.(storage.PartialStorage)
+	return partials
+}
+
+// rangeValidator returns the validator a download served with header can be
+// continued with in If-Range: a strong ETag, or else the Last-Modified date. Weak
+// ETags are not allowed in If-Range.
+func rangeValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// contentRangeStart returns the first byte of a Content-Range header such as
+// "bytes 100-199/200"
+func contentRangeStart(value string) (int64, bool) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	first, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	return start, err == nil && start >= 0
+}
+
+// resumeFile continues the partial download of localPath with the rest of its
+// content, served by resp after the first offset bytes. The kept content is what
+// the type is sniffed from and is hashed first, so the digest covers the whole file,
+// which is verified against expected before it replaces localPath. Content the
+// quarantine would divert is downloaded again in full.
+func (c *Client) resumeFile(ctx context.Context, url, localPath string, resp *http.Response, body *bufio.Reader,
+	partials storage.PartialStorage, validator string, offset int64, expected Digest) (Digest, error) {
+	lastModified, _ := parseLastModified(resp.Header)
+	file, err := partials.CreatePartial(localPath, lastModified, validator, offset)
+	if err != nil {
+		return Digest{}, err
+	}
+	defer file.Abort()
+
+	head := make([]byte, min(offset, sniffLen))
+	if _, err := file.ReadAt(head, 0); err != nil {
+		return Digest{}, fmt.Errorf("failed to read partial file: %w", err)
+	}
+	digest := Digest{Content: Content{Type: resp.Header.Get("Content-Type"), Sniffed: http.DetectContentType(head)},
+		Resumed: offset, ETag: resp.Header.Get("ETag")}
+	if c.quarantine != nil && c.quarantine(localPath, digest.Content) != "" {
+		file.Discard()
+		return Digest{}, errResumeFailed
+	}
+
+	sha, sum := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha, sum), io.NewSectionReader(file, 0, offset)); err != nil {
+		return Digest{}, fmt.Errorf("failed to read partial file: %w", err)
+	}
+	if err := c.copyBody(ctx, url, file, body, resp.ContentLength, io.MultiWriter(sha, sum)); err != nil {
+		return Digest{}, err
+	}
+
+	digest.SHA256, digest.MD5 = hex.EncodeToString(sha.Sum(nil)), hex.EncodeToString(sum.Sum(nil))
+	if err := digest.Verify(expected, localPath); err != nil {
+		file.Discard()
+		return Digest{}, err
+	}
+	if err := file.Commit(); err != nil {
+		return Digest{}, err
+	}
+	if final := resp.Request.URL.String(); final != url {
+		digest.FinalURL = final
+	}
+	return digest, nil
+}
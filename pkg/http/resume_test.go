@@ -0,0 +1,179 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestContentRangeStart(t *testing.T) {
+	tests := []struct {
+		value string
+		start int64
+		ok    bool
+	}{
+		{"bytes 100-199/200", 100, true},
+		{"bytes 0-0/*", 0, true},
+		{"bytes */200", 0, false},
+		{"items 1-2/3", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		start, ok := contentRangeStart(tt.value)
+		if start != tt.start || ok != tt.ok {
+			t.Errorf("%q: expected %d %t, got %d %t", tt.value, tt.start, tt.ok, start, ok)
+		}
+	}
+}
+
+func TestRangeValidator(t *testing.T) {
+	header := http.Header{"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"}}
+	if v := rangeValidator(header); v != "Mon, 01 Jan 2024 00:00:00 GMT" {
+		t.Errorf("Expected Last-Modified, got %q", v)
+	}
+	header.Set("ETag", `W/"weak"`)
+	if v := rangeValidator(header); v != "Mon, 01 Jan 2024 00:00:00 GMT" {
+		t.Errorf("Expected weak ETags to be skipped, got %q", v)
+	}
+	header.Set("ETag", `"strong"`)
+	if v := rangeValidator(header); v != `"strong"` {
+		t.Errorf("Expected the strong ETag, got %q", v)
+	}
+}
+
+// writePartial leaves a partial download of localPath with content for validator
+func writePartial(t *testing.T, localPath, content, validator string) {
+	t.Helper()
+	if err := os.WriteFile(localPath+config.PartialSuffix, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	validatorPath := filepath.Join(filepath.Dir(localPath), config.PartialValidatorPrefix+filepath.Base(localPath))
+	if err := os.WriteFile(validatorPath, []byte(validator), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchFileResumesPartialDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(content)
+
+	tests := []struct {
+		name         string
+		partial      string
+		validator    string
+		ignoreRanges bool
+		resumed      int64
+		ranges       int
+	}{
+		{"continues", string(content[:4000]), `"v1"`, false, 4000, 1},
+		{"changed upstream", string(content[:4000]), `"v0"`, false, 0, 1},
+		{"ranges ignored", string(content[:4000]), `"v1"`, true, 0, 1},
+		{"not satisfiable", string(content) + "extra", `"v1"`, false, 0, 1},
+		{"no validator", string(content[:4000]), "", false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &rangeServer{content: content, ignoreRanges: tt.ignoreRanges}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+
+			dir := t.TempDir()
+			localPath := filepath.Join(dir, "file.bin")
+			writePartial(t, localPath, tt.partial, tt.validator)
+
+			client := NewClient(&config.Target{Timeout: 5, ContinueDownload: true})
+			digest, err := client.FetchFileDigest(context.Background(), ts.URL+"/file.bin", localPath)
+			if err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+			if data, _ := os.ReadFile(localPath); !bytes.Equal(data, content) {
+				t.Errorf("Expected the whole content, got %d bytes", len(data))
+			}
+			if digest.Resumed != tt.resumed || digest.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("Expected %d bytes resumed and the hash of the whole file, got %+v", tt.resumed, digest)
+			}
+			if server.rangeRequests() != tt.ranges {
+				t.Errorf("Expected %d range requests, got %d", tt.ranges, server.rangeRequests())
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("Expected only the downloaded file, found %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestFetchFileContinuesInterruptedDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	ranges := &rangeServer{content: content}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.ServeHTTP(w, r)
+			return
+		}
+		// The connection breaks after the first half of the file
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:5000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer ts.Close()
+
+	for _, continueDownload := range []bool{false, true} {
+		dir := t.TempDir()
+		localPath := filepath.Join(dir, "file.bin")
+		client := NewClient(&config.Target{Timeout: 5, ContinueDownload: continueDownload})
+		if _, err := client.FetchFileDigest(context.Background(), ts.URL+"/file.bin", localPath); err == nil {
+			t.Fatal("Expected the interrupted download to fail")
+		}
+		entries, _ := os.ReadDir(dir)
+		if !continueDownload {
+			if len(entries) != 0 {
+				t.Errorf("Expected no partial download without ContinueDownload, found %d entries", len(entries))
+			}
+			continue
+		}
+
+		if stat, err := os.Stat(localPath + config.PartialSuffix); err != nil || stat.Size() != 5000 {
+			t.Fatalf("Expected the first half to be kept, got %v", err)
+		}
+		digest, err := client.FetchFileDigest(context.Background(), ts.URL+"/file.bin", localPath)
+		if err != nil {
+			t.Fatalf("Continuing failed: %v", err)
+		}
+		if data, _ := os.ReadFile(localPath); !bytes.Equal(data, content) || digest.Resumed != 5000 {
+			t.Errorf("Expected the whole content with 5000 bytes resumed, got %d bytes and %+v", len(data), digest)
+		}
+	}
+}
+
+func TestFetchFileDiscardsCorruptPartialDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(content)
+	ts := httptest.NewServer(&rangeServer{content: content})
+	defer ts.Close()
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "file.bin")
+	writePartial(t, localPath, string(bytes.Repeat([]byte("x"), 4000)), `"v1"`)
+
+	client := NewClient(&config.Target{Timeout: 5, ContinueDownload: true})
+	_, err := client.FetchFileVerified(context.Background(), ts.URL+"/file.bin", localPath, Digest{SHA256: hex.EncodeToString(sum[:])})
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected a checksum mismatch, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the corrupt partial download to be removed, found %d entries", len(entries))
+	}
+}
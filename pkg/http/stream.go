@@ -0,0 +1,82 @@
+package http
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+)
+
+// StreamFile downloads url to localPath in a single stream, writing the content to
+// w as well while it arrives, e.g. to pass it on to a waiting client. start is
+// called with the response headers once the upstream sent the content and before
+// anything is written to w; an error returned by start ends the download. Once w
+// fails, the download continues without it. The file replaces localPath only when
+// complete.
+func (c *Client) StreamFile(ctx context.Context, url, localPath string, w io.Writer, start func(header http.Header) error) (Digest, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to create GET request: %w", err)
+	}
+	req.Header.Set("User-Agent", c.config.UserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Digest{}, requestError("GET request", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Digest{}, newStatusError("GET", url, resp)
+	}
+
+	if err := c.storage.MkdirAll(filepath.Dir(localPath)); err != nil {
+		return Digest{}, fmt.Errorf("failed to create directory: %w", err)
+	}
+	lastModified, _ := parseLastModified(resp.Header)
+	file, err := c.storage.Create(localPath, lastModified, resp.Header.Get("ETag"))
+	if err != nil {
+		return Digest{}, err
+	}
+	defer file.Abort()
+
+	if err := start(resp.Header); err != nil {
+		return Digest{}, err
+	}
+	sha, sum := sha256.New(), md5.New()
+	if err := c.copyBody(ctx, url, file, resp.Body, resp.ContentLength, io.MultiWriter(sha, sum, &detachedWriter{w: w})); err != nil {
+		return Digest{}, err
+	}
+	if err := file.Commit(); err != nil {
+		return Digest{}, err
+	}
+
+	digest := Digest{
+		SHA256:  hex.EncodeToString(sha.Sum(nil)),
+		MD5:     hex.EncodeToString(sum.Sum(nil)),
+		Content: Content{Type: resp.Header.Get("Content-Type")},
+		ETag:    resp.Header.Get("ETag"),
+	}
+	if final := resp.Request.URL.String(); final != url {
+		digest.FinalURL = final
+	}
+	return digest, nil
+}
+
+// detachedWriter passes writes on to w until one fails and drops them from then on,
+// so that a reader going away does not stop the download it started
+type detachedWriter struct {
+	w   io.Writer
+	err error
+}
+
+// Write implements io.Writer
+func (d *detachedWriter) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// failingWriter fails every write, like a client that went away
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("client gone") }
+
+func TestStreamFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, "streamed content")
+	}))
+	defer server.Close()
+	client := NewClient(&config.Target{Timeout: 5})
+
+	tests := []struct {
+		name   string
+		writer io.Writer
+	}{
+		{"passes the content on", &strings.Builder{}},
+		{"continues without the writer", failingWriter{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localPath := filepath.Join(t.TempDir(), "file.txt")
+			var header http.Header
+			digest, err := client.StreamFile(context.Background(), server.URL+"/file.txt", localPath, tt.writer, func(h http.Header) error {
+				header = h
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("StreamFile failed: %v", err)
+			}
+			if header.Get("ETag") != `"v1"` || digest.ETag != `"v1"` || digest.SHA256 == "" {
+				t.Errorf("Expected the response headers and a digest, got %v and %+v", header, digest)
+			}
+			if data, _ := os.ReadFile(localPath); string(data) != "streamed content" {
+				t.Errorf("Expected the file to be stored, got %q", data)
+			}
+			if b, ok := tt.writer.(*strings.Builder); ok && b.String() != "streamed content" {
+				t.Errorf("Expected the content passed on, got %q", b.String())
+			}
+		})
+	}
+
+	// Missing files and a refused start store nothing
+	dir := t.TempDir()
+	started := false
+	if _, err := client.StreamFile(context.Background(), server.URL+"/missing.txt", filepath.Join(dir, "missing.txt"), io.Discard, func(http.Header) error {
+		started = true
+		return nil
+	}); err == nil || started {
+		t.Errorf("Expected a missing file to fail before starting, got %v", err)
+	}
+	refused := errors.New("refused")
+	if _, err := client.StreamFile(context.Background(), server.URL+"/file.txt", filepath.Join(dir, "file.txt"), io.Discard, func(http.Header) error {
+		return refused
+	}); !errors.Is(err, refused) {
+		t.Errorf("Expected the start error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing stored, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,304 @@
+package http
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reservedFDs are the file descriptors the default transfer limit leaves for
+// listings, logs, metadata files and the server
+const reservedFDs = 64
+
+// minTransferLimit is the smallest limit derived from the file descriptor limit
+const minTransferLimit = 4
+
+// Transfers caps the file downloads open at once across all clients of the
+// process. A download holds a slot from its request until its file is written,
+// as it keeps a connection and a destination file open meanwhile; downloads
+// beyond the limit wait for a slot instead of failing with "too many open files".
+var Transfers = newExportedTransferLimiter(TransferGauge)
+
+// TransferGauge exports the state of Transfers: the downloads "open" and
+// "waiting" for a slot, and the "limit"
+var TransferGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "http_mirror_transfers",
+		Help: "Upstream file transfers of the process by state (open, waiting, limit)",
+	},
+	[]string{"state"},
+)
+
+// DefaultTransferLimit derives the number of transfers that may be open at once
+// from the file descriptor limit of the process: every transfer takes a
+// connection and a file, and some descriptors are kept for everything else
+func DefaultTransferLimit() int {
+	fds := maxOpenFiles()
+	if fds <= 0 {
+		return defaultTransferLimit
+	}
+	return max((fds-reservedFDs)/2, minTransferLimit)
+}
+
+// TransferLimiter is a semaphore on open transfers whose limit can change while
+// transfers are open. Slots are shared fairly between the owners of transfers,
+// e.g. targets: while transfers wait, a freed slot goes to the waiting owner
+// holding the fewest slots for its weight, so an owner of long transfers cannot
+// keep every slot while others wait. Waiters of one owner get slots in order. It
+// is safe for concurrent use.
+type TransferLimiter struct {
+	mu      sync.Mutex
+	limit   int // negative means unlimited
+	open    int
+	waiting int
+	// held counts the open transfers per owner and queue holds the waiting
+	// transfers in arrival order
+	held  map[string]int
+	queue []*transferWaiter
+	// gauge, if set, follows the open, waiting and limit counts
+	gauge *prometheus.GaugeVec
+}
+
+// transferWaiter is a transfer waiting for a slot; ready is closed once it was
+// granted one
+type transferWaiter struct {
+	owner   string
+	weight  int
+	ready   chan struct{}
+	granted bool
+}
+
+// newExportedTransferLimiter creates a limiter with the default limit whose
+// counts gauge follows
+func newExportedTransferLimiter(gauge *prometheus.GaugeVec) *TransferLimiter {
+	l := &TransferLimiter{held: make(map[string]int), gauge: gauge}
+	l.SetLimit(0)
+	return l
+}
+
+// NewTransferLimiter creates a limiter for limit transfers; 0 uses
+// DefaultTransferLimit and a negative limit means unlimited
+func NewTransferLimiter(limit int) *TransferLimiter {
+	l := &TransferLimiter{held: make(map[string]int)}
+	l.SetLimit(limit)
+	return l
+}
+
+// SetLimit changes the limit like NewTransferLimiter. Transfers beyond a lowered
+// limit finish; new ones wait until the open transfers fall below it.
+func (l *TransferLimiter) SetLimit(limit int) {
+	if limit == 0 {
+		limit = DefaultTransferLimit()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.grant()
+	l.report()
+}
+
+// Limit returns the current limit; negative means unlimited
+func (l *TransferLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Open returns the number of transfers holding a slot
+func (l *TransferLimiter) Open() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open
+}
+
+// Waiting returns the number of transfers waiting for a slot
+func (l *TransferLimiter) Waiting() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
+
+// Acquire waits for a slot until ctx ends, for transfers without an owner. It
+// returns a function releasing the slot, which may be called more than once, and
+// whether the caller had to wait.
+func (l *TransferLimiter) Acquire(ctx context.Context) (release func(), waited bool, err error) {
+	return l.AcquireFor(ctx, "", 1)
+}
+
+// AcquireFor waits for a slot for a transfer of owner like Acquire. While
+// transfers wait, owners get slots in proportion to their weight; weights below 1
+// count as 1.
+func (l *TransferLimiter) AcquireFor(ctx context.Context, owner string, weight int) (release func(), waited bool, err error) {
+	l.mu.Lock()
+	if len(l.queue) == 0 && l.available() {
+		l.take(owner)
+		l.report()
+		l.mu.Unlock()
+		return l.releaser(owner), false, nil
+	}
+	w := &transferWaiter{owner: owner, weight: max(weight, 1), ready: make(chan struct{})}
+	l.queue = append(l.queue, w)
+	l.waiting++
+	l.report()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return l.releaser(owner), true, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if w.granted {
+			// The slot came too late; pass it on
+			l.free(owner)
+		} else {
+			l.queue = slices.DeleteFunc(l.queue, func(q *transferWaiter) bool { return q == w })
+			l.waiting--
+		}
+		l.report()
+		return func() {}, true, ctx.Err()
+	}
+}
+
+// TryAcquire takes a slot if one is free without waiting, for transfers without
+// an owner
+func (l *TransferLimiter) TryAcquire() (release func(), ok bool) {
+	return l.TryAcquireFor("")
+}
+
+// TryAcquireFor takes a slot for a transfer of owner if one is free and no other
+// transfer waits for it
+func (l *TransferLimiter) TryAcquireFor(owner string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) > 0 || !l.available() {
+		return nil, false
+	}
+	l.take(owner)
+	l.report()
+	return l.releaser(owner), true
+}
+
+// available reports whether a slot is free; l.mu must be held
+func (l *TransferLimiter) available() bool {
+	return l.limit < 0 || l.open < l.limit
+}
+
+// take counts a slot taken by owner; l.mu must be held
+func (l *TransferLimiter) take(owner string) {
+	l.open++
+	l.held[owner]++
+}
+
+// free gives back a slot of owner and hands it to the next waiter; l.mu must be
+// held
+func (l *TransferLimiter) free(owner string) {
+	l.open--
+	if l.held[owner]--; l.held[owner] <= 0 {
+		delete(l.held, owner)
+	}
+	l.grant()
+}
+
+// grant hands free slots to waiting transfers: each goes to the earliest waiter
+// of the owner holding the fewest slots for its weight; l.mu must be held
+func (l *TransferLimiter) grant() {
+	for len(l.queue) > 0 && l.available() {
+		next := 0
+		for i, w := range l.queue[1:] {
+			// held/weight < best held/best weight, without division
+			best := l.queue[next]
+			if l.held[w.owner]*best.weight < l.held[best.owner]*w.weight {
+				next = i + 1
+			}
+		}
+		w := l.queue[next]
+		l.queue = slices.Delete(l.queue, next, next+1)
+		l.waiting--
+		l.take(w.owner)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// releaser returns the function giving back one slot of owner
+func (l *TransferLimiter) releaser(owner string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.free(owner)
+			l.report()
+		})
+	}
+}
+
+// report updates the gauge; l.mu must be held
+func (l *TransferLimiter) report() {
+	if l.gauge == nil {
+		return
+	}
+	l.gauge.WithLabelValues("open").Set(float64(l.open))
+	l.gauge.WithLabelValues("waiting").Set(float64(l.waiting))
+	l.gauge.WithLabelValues("limit").Set(float64(l.limit))
+}
+
+// TransferSummary describes how the downloads of a client fared with the
+// transfer limit
+type TransferSummary struct {
+	// Queued counts downloads that had to wait for a slot
+	Queued int64
+	// PeakOpen is the most transfers of the process open at once that a download
+	// of the client saw when it got its slot
+	PeakOpen int64
+}
+
+// transferLog records the transfer slots a client took; it is safe for concurrent use
+type transferLog struct {
+	queued atomic.Int64
+	peak   atomic.Int64
+}
+
+// record counts a slot taken while open transfers were open in the process
+func (t *transferLog) record(waited bool, open int) {
+	if waited {
+		t.queued.Add(1)
+	}
+	for {
+		peak := t.peak.Load()
+		if int64(open) <= peak || t.peak.CompareAndSwap(peak, int64(open)) {
+			return
+		}
+	}
+}
+
+// Transfers returns how the downloads of the client fared with the transfer
+// limit so far
+func (c *Client) Transfers() TransferSummary {
+	return TransferSummary{Queued: c.transferLog.queued.Load(), PeakOpen: c.transferLog.peak.Load()}
+}
+
+// acquireTransfer waits for a transfer slot for a download of the client, sharing
+// the slots with other targets by Target.TransferWeight
+func (c *Client) acquireTransfer(ctx context.Context) (func(), error) {
+	release, waited, err := c.transfers.AcquireFor(ctx, c.config.Name, c.config.TransferWeight)
+	if err != nil {
+		return release, err
+	}
+	c.transferLog.record(waited, c.transfers.Open())
+	return release, nil
+}
+
+// tryAcquireTransfer takes a transfer slot for an additional connection of a
+// download if one is free
+func (c *Client) tryAcquireTransfer() (func(), bool) {
+	release, ok := c.transfers.TryAcquireFor(c.config.Name)
+	if ok {
+		c.transferLog.record(false, c.transfers.Open())
+	}
+	return release, ok
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package http
+
+// defaultTransferLimit is the transfer limit on systems without RLIMIT_NOFILE
+const defaultTransferLimit = 256
+
+// maxOpenFiles returns 0, as the number of open files is not limited per process
+func maxOpenFiles() int {
+	return 0
+}
@@ -0,0 +1,178 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestTransferLimiter(t *testing.T) {
+	l := NewTransferLimiter(2)
+	first, waited, err := l.Acquire(context.Background())
+	if err != nil || waited {
+		t.Fatalf("Expected a free slot, got waited=%v err=%v", waited, err)
+	}
+	second, ok := l.TryAcquire()
+	if !ok {
+		t.Fatal("Expected a second free slot")
+	}
+	if _, ok := l.TryAcquire(); ok {
+		t.Fatal("Expected no slot beyond the limit")
+	}
+
+	// A full limiter makes Acquire wait until a slot is released
+	acquired := make(chan bool)
+	go func() {
+		release, waited, err := l.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- waited
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Waiting() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	first()
+	first() // releasing twice frees one slot only
+	if waited := <-acquired; !waited {
+		t.Error("Expected Acquire to report that it waited")
+	}
+	if open := l.Open(); open != 1 {
+		t.Errorf("Expected 1 open transfer, got %d", open)
+	}
+
+	// Waiting ends with the context
+	l.SetLimit(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := l.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to end the wait, got %v", err)
+	}
+	if waiting := l.Waiting(); waiting != 0 {
+		t.Errorf("Expected no waiting transfers, got %d", waiting)
+	}
+
+	// Raising the limit frees slots at once; negative limits are unlimited
+	l.SetLimit(-1)
+	for range 10 {
+		if _, ok := l.TryAcquire(); !ok {
+			t.Fatal("Expected an unlimited limiter to always have a slot")
+		}
+	}
+	second()
+}
+
+func TestTransferLimiterSharesSlots(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		waiters []string
+		weights map[string]int
+		want    []string
+	}{
+		// The owner of the open transfers gets every other slot, not all of them
+		{"equal weights", 2, []string{"big", "big", "small", "small"}, nil, []string{"small", "big", "small", "big"}},
+		{"weighted", 3, []string{"a", "a", "a", "b", "b", "b"}, map[string]int{"a": 2}, []string{"a", "b", "a"}},
+		{"single owner in order", 2, []string{"big", "big"}, nil, []string{"big", "big"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewTransferLimiter(tt.limit)
+			var held []func()
+			for range tt.limit {
+				release, _, _ := l.AcquireFor(context.Background(), "big", 1)
+				held = append(held, release)
+			}
+
+			type grant struct {
+				owner   string
+				release func()
+			}
+			granted := make(chan grant, len(tt.waiters))
+			for i, owner := range tt.waiters {
+				go func() {
+					release, waited, err := l.AcquireFor(context.Background(), owner, tt.weights[owner])
+					if err == nil && waited {
+						granted <- grant{owner, release}
+					}
+				}()
+				// Waiters queue in the order of the test
+				deadline := time.Now().Add(5 * time.Second)
+				for l.Waiting() != i+1 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			if _, ok := l.TryAcquireFor("other"); ok {
+				t.Error("Expected no slot to be taken past waiting transfers")
+			}
+
+			// Free slots one at a time; a granted transfer keeps its slot until the
+			// open transfers of the setup are released
+			var got []string
+			for len(got) < len(tt.want) {
+				if len(held) > 0 {
+					held[0]()
+					held = held[1:]
+				} else {
+					t.Fatal("Ran out of slots to release")
+				}
+				select {
+				case g := <-granted:
+					got = append(got, g.owner)
+					held = append(held, g.release)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Expected a transfer to get the slot, got %v", got)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Expected slots granted to %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDefaultTransferLimit(t *testing.T) {
+	if limit := DefaultTransferLimit(); limit < minTransferLimit {
+		t.Errorf("Expected a default limit of at least %d, got %d", minTransferLimit, limit)
+	}
+	if limit := NewTransferLimiter(0).Limit(); limit != DefaultTransferLimit() {
+		t.Errorf("Expected 0 to select the default limit, got %d", limit)
+	}
+}
+
+func TestFetchFileInChunksWithoutFreeSlots(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	upstream := &rangeServer{content: content}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	// The download's own slot is the only one, so no chunk can be requested
+	limiter := NewTransferLimiter(1)
+	localPath := filepath.Join(t.TempDir(), "file.bin")
+	client := NewClient(&config.Target{UserAgent: "test", Timeout: 10, ParallelChunks: 4, ParallelChunkMinSize: "1k"},
+		WithTransferLimiter(limiter))
+	if _, err := client.FetchFileDigest(context.Background(), server.URL+"/file.bin", localPath); err != nil {
+		t.Fatalf("FetchFileDigest failed: %v", err)
+	}
+	if got := upstream.rangeRequests(); got != 0 {
+		t.Errorf("Expected a single stream without range requests, got %d", got)
+	}
+	if data, _ := os.ReadFile(localPath); !bytes.Equal(data, content) {
+		t.Errorf("Expected the whole content, got %d bytes", len(data))
+	}
+	if open := limiter.Open(); open != 0 {
+		t.Errorf("Expected the slot to be released, %d still open", open)
+	}
+	if summary := client.Transfers(); summary.PeakOpen != 1 || summary.Queued != 0 {
+		t.Errorf("Unexpected transfer summary %+v", summary)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package http
+
+import "syscall"
+
+// defaultTransferLimit is used when the file descriptor limit is unknown
+const defaultTransferLimit = 256
+
+// maxOpenFiles returns the soft RLIMIT_NOFILE of the process, or 0 if unknown.
+// Unlimited and very high limits are capped at 2^30.
+func maxOpenFiles() int {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	return int(min(limit.Cur, 1<<30))
+}
@@ -0,0 +1,115 @@
+package http
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Sync modes for Mirror.SyncWrites
+const (
+	SyncAlways     = "always"
+	SyncLargeFiles = "large-files"
+	SyncNever      = "never"
+)
+
+// DefaultWriteBufferSize is used when no write buffer size is configured
+const DefaultWriteBufferSize = 64 * 1024
+
+// largeFileSyncThreshold is the size above which "large-files" sync mode fsyncs a file
+const largeFileSyncThreshold = 64 * 1024 * 1024
+
+// WriteOptions controls how downloaded data is written to disk
+type WriteOptions struct {
+	// BufferSize is the size of the read and write buffers used per download
+	BufferSize int
+	// SyncMode selects when files are fsynced: always, large-files or never
+	SyncMode string
+}
+
+// copyBuffers holds the reusable buffers for a single in-progress download
+type copyBuffers struct {
+	read  []byte
+	write *bufio.Writer
+}
+
+// bufferPool hands out copy buffers of a fixed size to concurrent downloads
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool creates a pool of buffers with the given size
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = DefaultWriteBufferSize
+	}
+
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		return &copyBuffers{
+			read:  make([]byte, size),
+			write: bufio.NewWriterSize(nil, size),
+		}
+	}
+	return p
+}
+
+// syncer is implemented by files that can be flushed to disk
+type syncer interface {
+	Sync() error
+}
+
+// copyToFile streams src into file through pooled buffers, flushes, and fsyncs
+// according to syncMode if file supports it. It returns the number of bytes written.
+func (p *bufferPool) copyToFile(file io.Writer, src io.Reader, syncMode string) (int64, error) {
+	buffers := p.pool.Get().(*copyBuffers)
+	defer func() {
+		buffers.write.Reset(nil)
+		p.pool.Put(buffers)
+	}()
+
+	buffers.write.Reset(file)
+
+	// Hide ReadFrom/WriteTo so io.CopyBuffer really goes through our buffers
+	written, err := io.CopyBuffer(writerOnly{buffers.write}, readerOnly{src}, buffers.read)
+
+	// Content read before a failure is still written, so that a partial download
+	// can be continued from it
+	if flushErr := buffers.write.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return written, err
+	}
+
+	if f, ok := file.(syncer); ok && shouldSync(syncMode, written) {
+		if err := f.Sync(); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// shouldSync reports whether a file of the given size must be fsynced
+func shouldSync(syncMode string, size int64) bool {
+	switch syncMode {
+	case SyncAlways:
+		return true
+	case SyncLargeFiles:
+		return size >= largeFileSyncThreshold
+	default:
+		return false
+	}
+}
+
+// writerOnly hides optional interfaces of an io.Writer
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly hides optional interfaces of an io.Reader
+type readerOnly struct {
+	io.Reader
+}
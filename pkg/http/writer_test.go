@@ -0,0 +1,154 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyToFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 10000) // 160k, larger than the buffer
+
+	for _, size := range []int{0, 1024, 4096, 1024 * 1024} {
+		pool := newBufferPool(size)
+		path := filepath.Join(t.TempDir(), "out.bin")
+
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+
+		written, err := pool.copyToFile(file, bytes.NewReader(content), SyncAlways)
+		file.Close()
+		if err != nil {
+			t.Fatalf("copyToFile failed with buffer size %d: %v", size, err)
+		}
+
+		if written != int64(len(content)) {
+			t.Errorf("Expected %d bytes written, got %d", len(content), written)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		if !bytes.Equal(data, content) {
+			t.Errorf("File content mismatch with buffer size %d", size)
+		}
+	}
+}
+
+func TestShouldSync(t *testing.T) {
+	tests := []struct {
+		mode     string
+		size     int64
+		expected bool
+	}{
+		{SyncAlways, 1, true},
+		{SyncNever, largeFileSyncThreshold * 2, false},
+		{"", largeFileSyncThreshold * 2, false},
+		{SyncLargeFiles, 1024, false},
+		{SyncLargeFiles, largeFileSyncThreshold, true},
+	}
+
+	for _, tt := range tests {
+		if got := shouldSync(tt.mode, tt.size); got != tt.expected {
+			t.Errorf("shouldSync(%q, %d) = %v, expected %v", tt.mode, tt.size, got, tt.expected)
+		}
+	}
+}
+
+// copyFunc writes src into a freshly created file
+type copyFunc func(file *os.File, src io.Reader) error
+
+// benchmarkCopies are the strategies compared by the benchmarks below
+func benchmarkCopies() map[string]copyFunc {
+	pooled := newBufferPool(256 * 1024)
+	return map[string]copyFunc{
+		"io.Copy": func(file *os.File, src io.Reader) error {
+			_, err := io.Copy(writerOnly{file}, readerOnly{src})
+			return err
+		},
+		"pooled-256k": func(file *os.File, src io.Reader) error {
+			_, err := pooled.copyToFile(file, src, SyncNever)
+			return err
+		},
+	}
+}
+
+// BenchmarkCopySmallFiles writes 10k small files per iteration
+func BenchmarkCopySmallFiles(b *testing.B) {
+	const files = 10000
+	content := bytes.Repeat([]byte("x"), 2048)
+
+	for name, copyFile := range benchmarkCopies() {
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			b.ReportAllocs()
+			b.SetBytes(int64(files * len(content)))
+
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < files; j++ {
+					file, err := os.Create(filepath.Join(dir, fmt.Sprintf("f%d", j)))
+					if err != nil {
+						b.Fatal(err)
+					}
+					// Small chunked reads like a network body delivers
+					if err := copyFile(file, io.LimitReader(&chunkedReader{data: content}, int64(len(content)))); err != nil {
+						b.Fatal(err)
+					}
+					file.Close()
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCopyLargeFile writes a single 1 GB file per iteration
+func BenchmarkCopyLargeFile(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping 1 GB benchmark in short mode")
+	}
+
+	const size = 1 << 30
+
+	for name, copyFile := range benchmarkCopies() {
+		b.Run(name, func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "large.bin")
+			b.ReportAllocs()
+			b.SetBytes(size)
+
+			for i := 0; i < b.N; i++ {
+				file, err := os.Create(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := copyFile(file, io.LimitReader(&chunkedReader{}, size)); err != nil {
+					b.Fatal(err)
+				}
+				file.Close()
+			}
+		})
+	}
+}
+
+// chunkedReader returns at most 4k per Read, like a TCP-backed response body
+type chunkedReader struct {
+	data []byte
+	off  int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	if r.data == nil {
+		return len(p), nil
+	}
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
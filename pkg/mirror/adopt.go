@@ -0,0 +1,210 @@
+package mirror
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// adoptCheckpointInterval is how often adoption progress is logged and saved, so an
+// interrupted adoption resumes where it stopped
+var adoptCheckpointInterval = 30 * time.Second
+
+// AdoptStats summarizes the adoption of an existing tree
+type AdoptStats struct {
+	// Files and Bytes count the files recorded by this adoption
+	Files int64
+	Bytes int64
+	// Hashed counts files whose content hashes were computed
+	Hashed int64
+	// Known counts files already in the manifest, e.g. from an interrupted adoption
+	Known    int64
+	Duration time.Duration
+}
+
+// Adopt records the files already present in targetDir in its manifest, with their
+// sizes, modification times and optionally SHA-256 and MD5 hashes. The next mirror run then
+// checks adopted files against upstream before downloading them, so unchanged data
+// is not fetched again. Progress is saved periodically; running Adopt again after an
+// interruption skips files recorded before.
+func (m *Manager) Adopt(ctx context.Context, targetName, targetDir string, hash bool) (*AdoptStats, error) {
+	m = m.forTarget(targetName)
+	release, err := m.runs.TryAcquire(targetName, targetDir, OperationAdopt)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return m.adopt(ctx, targetName, targetDir, hash)
+}
+
+// adopt implements Adopt for a caller holding targetDir
+func (m *Manager) adopt(ctx context.Context, targetName, targetDir string, hash bool) (*AdoptStats, error) {
+	start := time.Now()
+	stats := &AdoptStats{}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Info("Adopting existing files", "path", targetDir, "hash", hash)
+
+	lastCheckpoint := time.Now()
+	checkpoint := func() error {
+		lastCheckpoint = time.Now()
+		m.logger.Info("Adoption progress",
+			"files", stats.Files, "bytes", stats.Bytes, "known", stats.Known, "elapsed", time.Since(start).Round(time.Second))
+		return saveManifest(targetDir, manifest)
+	}
+
+	walkErr := filepath.WalkDir(targetDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		// Skip mirror metadata, temporary files and other hidden entries
+		if path != targetDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(targetDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if known, ok := manifest.Files[rel]; ok && known.Size == info.Size() &&
+			known.ModTime.Equal(info.ModTime().UTC()) && (!hash || known.SHA256 != "") {
+			stats.Known++
+			return nil
+		}
+
+		entry := FileSource{Size: info.Size(), ModTime: info.ModTime().UTC(), Adopted: true}
+		if hash {
+			digest, err := fileDigest(ctx, path)
+			if err != nil {
+				return err
+			}
+			entry.SHA256, entry.MD5 = digest.SHA256, digest.MD5
+			stats.Hashed++
+		}
+		manifest.Files[rel] = entry
+		stats.Files++
+		stats.Bytes += info.Size()
+
+		if time.Since(lastCheckpoint) >= adoptCheckpointInterval {
+			return checkpoint()
+		}
+		return nil
+	})
+
+	// Keep what was adopted so far, also when interrupted
+	if err := saveManifest(targetDir, manifest); err != nil && walkErr == nil {
+		walkErr = err
+	}
+	stats.Duration = time.Since(start)
+
+	if walkErr != nil {
+		return stats, fmt.Errorf("failed to adopt %s: %w", targetDir, walkErr)
+	}
+
+	m.logger.Info("Adoption completed",
+		"files", stats.Files, "bytes", stats.Bytes, "hashed", stats.Hashed, "known", stats.Known, "duration", stats.Duration)
+	return stats, nil
+}
+
+// fileDigest returns the content hashes of a file, aborting when ctx ends
+func fileDigest(ctx context.Context, path string) (httpPkg.Digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return httpPkg.Digest{}, err
+	}
+	defer file.Close()
+
+	sha, sum := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha, sum), &contextReader{ctx: ctx, r: file}); err != nil {
+		return httpPkg.Digest{}, err
+	}
+	return httpPkg.Digest{SHA256: hex.EncodeToString(sha.Sum(nil)), MD5: hex.EncodeToString(sum.Sum(nil))}, nil
+}
+
+// contextReader stops reading once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// needsAdoption reports whether targetDir holds files from before the mirror took
+// over: it has never been mirrored, but is not empty
+func needsAdoption(targetDir string) bool {
+	for _, name := range []string{StateFileName, ManifestFileName} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); !errors.Is(err, fs.ErrNotExist) {
+			return false
+		}
+	}
+
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadManifest reads the manifest of targetDir at the start of a run; an unreadable
+// manifest is treated as empty
+func (m *Manager) loadManifest(targetDir string) *Manifest {
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		m.logger.Warn("Failed to read manifest", "path", targetDir, "error", err)
+		return &Manifest{Files: make(map[string]FileSource)}
+	}
+	return manifest
+}
+
+// adoptedFiles returns the manifest keys of adopted files
+func adoptedFiles(manifest *Manifest) map[string]bool {
+	adopted := make(map[string]bool)
+	for rel, source := range manifest.Files {
+		if source.Adopted {
+			adopted[rel] = true
+		}
+	}
+	return adopted
+}
@@ -0,0 +1,147 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestAdoptRecordsExistingFiles(t *testing.T) {
+	targetDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(targetDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"a.txt":                            "hello",
+		filepath.Join("sub", "b.txt"):      "world!",
+		".hidden":                          "skip",
+		filepath.Join("sub", ".tmp-12345"): "partial",
+	} {
+		if err := os.WriteFile(filepath.Join(targetDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	stats, err := manager.Adopt(context.Background(), "adopt", targetDir, true)
+	if err != nil {
+		t.Fatalf("Adopt failed: %v", err)
+	}
+	if stats.Files != 2 || stats.Bytes != 11 || stats.Hashed != 2 {
+		t.Errorf("Expected 2 files, 11 bytes and 2 hashes, got %+v", stats)
+	}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	source, ok := manifest.Lookup("a.txt")
+	if !ok || !source.Adopted || source.Size != 5 {
+		t.Errorf("Expected a.txt to be adopted with size 5, got %+v", source)
+	}
+	// sha256("hello")
+	if source.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected hash %q", source.SHA256)
+	}
+	if len(manifest.Files) != 2 {
+		t.Errorf("Expected hidden files to be skipped, got %v", manifest.Files)
+	}
+
+	// Running again resumes instead of redoing the work
+	stats, err = manager.Adopt(context.Background(), "adopt", targetDir, true)
+	if err != nil {
+		t.Fatalf("Second Adopt failed: %v", err)
+	}
+	if stats.Files != 0 || stats.Known != 2 {
+		t.Errorf("Expected both files to be known on the second adoption, got %+v", stats)
+	}
+}
+
+func TestNeedsAdoption(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  bool
+	}{
+		{"empty", nil, false},
+		{"only hidden", []string{".thumbcache"}, false},
+		{"existing data", []string{"data.iso"}, true},
+		{"already mirrored", []string{"data.iso", StateFileName}, false},
+		{"adopted", []string{"data.iso", ManifestFileName}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := needsAdoption(dir); got != tt.want {
+				t.Errorf("needsAdoption() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunSkipsUnchangedAdoptedFiles(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var downloads int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="same.txt">same</a><a href="changed.txt">changed</a>`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+			w.Header().Set("Content-Length", "7")
+			if r.Method == http.MethodGet {
+				downloads++
+				w.Write([]byte("content"))
+			}
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	for name, content := range map[string]string{"same.txt": "content", "changed.txt": "old"} {
+		path := filepath.Join(targetDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Change checks are off, but the first run still checks adopted files
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "adopted", URL: server.URL + "/", MaxDepth: 1, Timeout: 5}
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if stats.FilesSkipped != 1 || stats.FilesDownloaded != 1 || downloads != 1 {
+		t.Errorf("Expected only the changed file to be downloaded, got skipped=%d downloaded=%d requests=%d",
+			stats.FilesSkipped, stats.FilesDownloaded, downloads)
+	}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if source, _ := manifest.Lookup("changed.txt"); source.Adopted || source.URL != server.URL+"/changed.txt" {
+		t.Errorf("Expected redownloaded file to record its origin, got %+v", source)
+	}
+}
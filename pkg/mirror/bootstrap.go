@@ -0,0 +1,213 @@
+package mirror
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// bootstrapProgressInterval is how often the first run of a target logs and
+// reports its progress
+var bootstrapProgressInterval = 30 * time.Second
+
+// rateSmoothing is the weight of the latest interval in the transfer rate the ETA
+// is based on. The rate follows changes of the rate limit within a few intervals
+// instead of averaging over the whole run.
+const rateSmoothing = 0.5
+
+// Progress bases
+const (
+	// ProgressByBytes estimates progress from the sizes of the files discovered
+	ProgressByBytes = "bytes"
+	// ProgressByFiles estimates progress from the number of files discovered, as
+	// not all of their sizes are known
+	ProgressByFiles = "files"
+)
+
+// Progress estimates how far the first run of a target got. The tree is
+// discovered while it is mirrored, so the totals grow during the run and the
+// percentage relates to the files discovered so far.
+type Progress struct {
+	// Basis is ProgressByBytes or ProgressByFiles
+	Basis           string `json:"basis"`
+	FilesDone       int64  `json:"files_done"`
+	FilesDiscovered int64  `json:"files_discovered"`
+	// BytesDone and BytesDiscovered sum the sizes listings and metadata indexes
+	// printed; files of unknown size are counted in UnsizedFiles instead
+	BytesDone       int64 `json:"bytes_done"`
+	BytesDiscovered int64 `json:"bytes_discovered"`
+	UnsizedFiles    int64 `json:"unsized_files"`
+	// Percent is the share of the discovered work done, by Basis
+	Percent float64 `json:"percent"`
+	// Rate is the recent rate in Basis units per second
+	Rate float64 `json:"rate"`
+	// ETASeconds is the estimated time until the discovered work is done; zero
+	// while the rate is unknown
+	ETASeconds float64 `json:"eta_seconds,omitempty"`
+	// Estimate is always true: the totals are a lower bound until the tree is
+	// discovered completely
+	Estimate bool `json:"estimate"`
+}
+
+// bootstrapProgress tracks the files of the first run of a target; it is safe
+// for concurrent use. A nil tracker ignores all calls.
+type bootstrapProgress struct {
+	mu              sync.Mutex
+	filesDone       int64
+	filesDiscovered int64
+	bytesDone       int64
+	bytesDiscovered int64
+	unsizedFiles    int64
+	// transferred is the work done by requests to the upstream, which sets the
+	// rate; files skipped locally are done at once and would inflate it
+	transferredFiles int64
+	transferredBytes int64
+
+	// last is the transferred work at the previous report
+	lastFiles, lastBytes int64
+	lastReport           time.Time
+	fileRate, byteRate   float64
+	// stop ends the reports of startProgress, which closes done once it returned
+	stop, done chan struct{}
+}
+
+// newBootstrapProgress returns a tracker for the first run of a target, nil for
+// targets that were synced before
+func newBootstrapProgress(state *TargetState) *bootstrapProgress {
+	if state.Synced() {
+		return nil
+	}
+	return &bootstrapProgress{}
+}
+
+// discover counts a file about to be mirrored; size is -1 if unknown
+func (p *bootstrapProgress) discover(size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesDiscovered++
+	if size >= 0 {
+		p.bytesDiscovered += size
+	} else {
+		p.unsizedFiles++
+	}
+}
+
+// finish counts a discovered file as done; transferred tells whether it took
+// requests to the upstream rather than being skipped locally
+func (p *bootstrapProgress) finish(size int64, transferred bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.filesDone++
+	if size > 0 {
+		p.bytesDone += size
+	}
+	if transferred {
+		p.transferredFiles++
+		p.transferredBytes += max(size, 0)
+	}
+}
+
+// snapshot updates the rates with the work transferred since the previous
+// snapshot and returns the progress at now
+func (p *bootstrapProgress) snapshot(now time.Time) Progress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elapsed := now.Sub(p.lastReport).Seconds(); !p.lastReport.IsZero() && elapsed > 0 {
+		p.fileRate = smoothRate(p.fileRate, float64(p.transferredFiles-p.lastFiles)/elapsed)
+		p.byteRate = smoothRate(p.byteRate, float64(p.transferredBytes-p.lastBytes)/elapsed)
+	}
+	p.lastReport, p.lastFiles, p.lastBytes = now, p.transferredFiles, p.transferredBytes
+
+	progress := Progress{
+		Basis:           ProgressByBytes,
+		FilesDone:       p.filesDone,
+		FilesDiscovered: p.filesDiscovered,
+		BytesDone:       p.bytesDone,
+		BytesDiscovered: p.bytesDiscovered,
+		UnsizedFiles:    p.unsizedFiles,
+		Estimate:        true,
+	}
+	done, total, rate := float64(p.bytesDone), float64(p.bytesDiscovered), p.byteRate
+	if p.unsizedFiles > 0 || p.bytesDiscovered == 0 {
+		progress.Basis = ProgressByFiles
+		done, total, rate = float64(p.filesDone), float64(p.filesDiscovered), p.fileRate
+	}
+	if total > 0 {
+		progress.Percent = 100 * done / total
+	}
+	progress.Rate = rate
+	if rate > 0 {
+		progress.ETASeconds = (total - done) / rate
+	}
+	return progress
+}
+
+// smoothRate weighs the rate of the latest interval into the previous rate
+func smoothRate(previous, latest float64) float64 {
+	if previous == 0 {
+		return latest
+	}
+	return rateSmoothing*latest + (1-rateSmoothing)*previous
+}
+
+// startProgress reports the progress of the first run of a target every
+// bootstrapProgressInterval until stopProgress
+func (m *Manager) startProgress(stats *MirrorStats, marker *SyncMarker) {
+	p := stats.progress
+	if p == nil {
+		return
+	}
+	p.snapshot(time.Now())
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(bootstrapProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case now := <-ticker.C:
+				m.reportProgress(stats, marker, p.snapshot(now))
+			}
+		}
+	}()
+}
+
+// stopProgress ends the progress reports of startProgress and waits for a report
+// underway, so that it does not write the sync marker after its removal
+func (m *Manager) stopProgress(stats *MirrorStats) {
+	if p := stats.progress; p != nil && p.stop != nil {
+		close(p.stop)
+		<-p.done
+		p.stop = nil
+	}
+}
+
+// reportProgress logs progress, emits it as an EventProgress and records it in
+// the sync marker for the server's /api/v1/runs
+func (m *Manager) reportProgress(stats *MirrorStats, marker *SyncMarker, progress Progress) {
+	args := []any{"basis", progress.Basis,
+		"percent", math.Round(progress.Percent*10) / 10,
+		"files_done", progress.FilesDone, "files_discovered", progress.FilesDiscovered}
+	if progress.Basis == ProgressByBytes {
+		args = append(args, "bytes_done", progress.BytesDone, "bytes_discovered", progress.BytesDiscovered)
+	} else {
+		args = append(args, "unsized_files", progress.UnsizedFiles)
+	}
+	if progress.ETASeconds > 0 {
+		args = append(args, "eta", time.Duration(progress.ETASeconds*float64(time.Second)).Round(time.Second))
+	}
+	m.logger.Info("First run progress (estimate)", args...)
+	m.emit(stats, Event{Type: EventProgress, Progress: &progress})
+	if marker != nil {
+		marker.Progress = &progress
+		m.writeSyncMarker(stats.root, marker)
+	}
+}
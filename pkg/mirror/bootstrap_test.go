@@ -0,0 +1,109 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestBootstrapProgress(t *testing.T) {
+	if p := newBootstrapProgress(&TargetState{LastSuccess: time.Now()}); p != nil {
+		t.Fatal("Expected no progress tracking for a target synced before")
+	}
+	p := newBootstrapProgress(&TargetState{})
+	start := time.Now()
+	p.snapshot(start)
+
+	for range 4 {
+		p.discover(1000)
+	}
+	p.finish(1000, false) // skipped locally: done, but not part of the rate
+	p.finish(1000, true)
+	progress := p.snapshot(start.Add(10 * time.Second))
+	if progress.Basis != ProgressByBytes || progress.Percent != 50 || !progress.Estimate {
+		t.Errorf("Expected 50%% by bytes, got %+v", progress)
+	}
+	// 1000 bytes in 10 seconds leave 2000 bytes for 20 seconds
+	if progress.Rate != 100 || progress.ETASeconds != 20 {
+		t.Errorf("Expected 100 B/s and 20s left, got %v and %v", progress.Rate, progress.ETASeconds)
+	}
+
+	// A lower rate limit slows the rate down within a few reports
+	p.finish(1000, true)
+	progress = p.snapshot(start.Add(110 * time.Second))
+	if progress.Rate != 55 {
+		t.Errorf("Expected the rate to follow the slowdown, got %v", progress.Rate)
+	}
+
+	// A file of unknown size makes the estimate fall back to file counts
+	p.discover(-1)
+	progress = p.snapshot(start.Add(120 * time.Second))
+	if progress.Basis != ProgressByFiles || progress.FilesDone != 3 || progress.FilesDiscovered != 5 ||
+		progress.UnsizedFiles != 1 || progress.Percent != 60 {
+		t.Errorf("Expected 3 of 5 files by count, got %+v", progress)
+	}
+
+	var none *bootstrapProgress
+	none.discover(1)
+	none.finish(1, true)
+}
+
+func TestRunReportsBootstrapProgress(t *testing.T) {
+	interval := bootstrapProgressInterval
+	bootstrapProgressInterval = 20 * time.Millisecond
+	defer func() { bootstrapProgressInterval = interval }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<pre>" +
+				`<a href="a.bin">a.bin</a>  01-Jun-2024 10:00  3` + "\n" +
+				`<a href="b.bin">b.bin</a>  01-Jun-2024 10:00  3` + "\n</pre>"))
+		default:
+			time.Sleep(50 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("abc"))
+		}
+	}))
+	defer server.Close()
+
+	var reports []Progress
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WithEventSink(func(e Event) {
+			if e.Type == EventProgress {
+				reports = append(reports, *e.Progress)
+			}
+		}))
+	target := &config.Target{Name: "bootstrap", URL: server.URL + "/", MaxDepth: 2, Timeout: 5}
+	targetDir := t.TempDir()
+
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(reports) == 0 {
+		t.Fatal("Expected progress reports during the first run")
+	}
+	last := reports[len(reports)-1]
+	if last.Basis != ProgressByBytes || last.BytesDiscovered != 6 || last.FilesDiscovered != 2 {
+		t.Errorf("Expected an estimate from the listed sizes, got %+v", last)
+	}
+	if marker, err := LoadSyncMarker(targetDir); err != nil || marker != nil {
+		t.Errorf("Expected the sync marker to be removed, got %+v (%v)", marker, err)
+	}
+
+	// Later runs report no progress
+	reports = nil
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if len(reports) != 0 {
+		t.Errorf("Expected no progress reports after the first run, got %d", len(reports))
+	}
+}
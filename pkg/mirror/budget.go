@@ -0,0 +1,114 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// ErrBudgetExceeded is returned by a run that stopped because it downloaded
+// Target.MaxTotalBytes or Target.MaxTotalFiles
+var ErrBudgetExceeded = errors.New("run budget exceeded")
+
+// Budgets reported in MirrorStats.BudgetExceeded
+const (
+	budgetBytes = "bytes"
+	budgetFiles = "files"
+)
+
+// runBudget enforces Target.MaxTotalBytes and Target.MaxTotalFiles within a run.
+// Downloads claim their file before they start, so concurrent downloads never
+// exceed the file budget; the byte budget is checked against the bytes of
+// finished downloads and may be overshot by those in progress. A nil budget is
+// unlimited.
+type runBudget struct {
+	maxBytes int64
+	maxFiles int64
+
+	mu sync.Mutex
+	// claimed counts the downloads in progress or done, and bytes the bytes of
+	// finished ones
+	claimed  int64
+	bytes    int64
+	exceeded error
+	which    string
+}
+
+// newRunBudget returns the budget of a run of target, nil without one
+func newRunBudget(target *config.Target) *runBudget {
+	maxBytes := httpPkg.ParseSize(target.MaxTotalBytes)
+	if maxBytes <= 0 && target.MaxTotalFiles <= 0 {
+		return nil
+	}
+	return &runBudget{maxBytes: max(maxBytes, 0), maxFiles: int64(max(target.MaxTotalFiles, 0))}
+}
+
+// check returns an error wrapping ErrBudgetExceeded once a download found the
+// budget used up
+func (b *runBudget) check() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exceeded
+}
+
+// claim reserves the budget for a download about to start. It fails with
+// ErrBudgetExceeded if the files claimed or the bytes downloaded reached their
+// budget, and so does every later call.
+func (b *runBudget) claim() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exceeded != nil {
+		return b.exceeded
+	}
+	switch {
+	case b.maxFiles > 0 && b.claimed >= b.maxFiles:
+		b.which = budgetFiles
+		b.exceeded = fmt.Errorf("%w: %d of %d files downloaded", ErrBudgetExceeded, b.claimed, b.maxFiles)
+	case b.maxBytes > 0 && b.bytes >= b.maxBytes:
+		b.which = budgetBytes
+		b.exceeded = fmt.Errorf("%w: %d of %d bytes downloaded", ErrBudgetExceeded, b.bytes, b.maxBytes)
+	default:
+		b.claimed++
+		return nil
+	}
+	return b.exceeded
+}
+
+// release returns the claim of a download that failed
+func (b *runBudget) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.claimed--
+}
+
+// add accounts n bytes of a finished download
+func (b *runBudget) add(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bytes += n
+}
+
+// exceededBudget returns which budget stopped the run, "bytes" or "files", or ""
+func (b *runBudget) exceededBudget() string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.which
+}
@@ -0,0 +1,73 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunBudget(t *testing.T) {
+	server := createTestServer(t, map[string]string{
+		"/":          `<html><body><a href="file1.txt">file1.txt</a><a href="file2.txt">file2.txt</a><a href="file3.txt">file3.txt</a></body></html>`,
+		"/file1.txt": "Content 1",
+		"/file2.txt": "Content 2",
+		"/file3.txt": "Content 3",
+	})
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		target config.Target
+		budget string
+	}{
+		{"files", config.Target{MaxTotalFiles: 2}, budgetFiles},
+		{"files with concurrent downloads", config.Target{MaxTotalFiles: 2, Concurrency: 3}, budgetFiles},
+		{"bytes", config.Target{MaxTotalBytes: "10"}, budgetBytes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath := t.TempDir()
+			manager := NewManager(&config.Config{Mirror: config.Mirror{DataPath: dataPath}}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			target := tt.target
+			target.Name, target.URL, target.Timeout, target.MaxDepth, target.CheckChanges = "pub", server.URL+"/", 5, 1, true
+
+			stats, err := manager.MirrorTargetWithStats(context.Background(), &target)
+			if !errors.Is(err, ErrBudgetExceeded) {
+				t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+			}
+			if stats.BudgetExceeded != tt.budget || stats.FilesDownloaded != 2 || stats.BytesDownloaded != 18 {
+				t.Errorf("Expected the %s budget to stop the run after 2 files of 18 bytes, got %q after %d files of %d bytes",
+					tt.budget, stats.BudgetExceeded, stats.FilesDownloaded, stats.BytesDownloaded)
+			}
+			if stats.SkipReasons[config.SkipRunBudget] != 1 {
+				t.Errorf("Expected one file skipped for the run budget, got %v", stats.SkipReasons)
+			}
+			entries, err := os.ReadDir(filepath.Join(dataPath, "pub"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, entry := range entries {
+				if !entry.IsDir() && !isMetadataPath(entry.Name()) {
+					files = append(files, entry.Name())
+				}
+			}
+			if len(files) != 2 {
+				t.Errorf("Expected exactly two files on disk, got %v", files)
+			}
+
+			// The next run skips the files it has and downloads the rest
+			stats, err = manager.MirrorTargetWithStats(context.Background(), &target)
+			if err != nil || stats.FilesDownloaded != 1 || stats.BudgetExceeded != "" {
+				t.Errorf("Expected the next run to download the last file, got %d files, budget %q (%v)",
+					stats.FilesDownloaded, stats.BudgetExceeded, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// ErrNotRecorded is returned by CheckFile for files the manifest does not know
+var ErrNotRecorded = errors.New("file is not recorded in the manifest")
+
+// Verdicts of CheckFile
+const (
+	// CheckMatch is a local copy that agrees with the upstream in everything compared
+	CheckMatch = "match"
+	// CheckMissing is a recorded file that is not on disk
+	CheckMissing = "missing"
+	// CheckCorrupted is a local copy that differs from its manifest entry
+	CheckCorrupted = "corrupted"
+	// CheckUpstreamChanged is a local copy as it was downloaded whose upstream has
+	// changed since; the next sync fetches it again
+	CheckUpstreamChanged = "upstream-changed"
+	// CheckMismatch is a local copy as it was downloaded whose content differs from
+	// the upstream although the upstream claims the same size and time
+	CheckMismatch = "mismatch"
+	// CheckUpstreamMissing is a file the upstream no longer has
+	CheckUpstreamMissing = "upstream-missing"
+	// CheckUnknown is a file whose upstream is unknown or could not be checked
+	CheckUnknown = "unknown"
+)
+
+// maxChecksumListSize is the most of an upstream checksum list CheckFile reads
+const maxChecksumListSize = 16 << 20
+
+// FileCheckOptions configures CheckFile
+type FileCheckOptions struct {
+	// Sample is the number of leading bytes fetched from the upstream with a
+	// ranged GET and compared with the local copy; 0 compares none
+	Sample int64
+	// Checksums fetches the checksum lists of the upstream directory, such as
+	// SHA256SUMS, and compares the sums they publish with the local copy
+	Checksums bool
+}
+
+// FileFacts describes one side of a CheckFile comparison
+type FileFacts struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime,omitzero"`
+	ETag    string    `json:"etag,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	MD5     string    `json:"md5,omitempty"`
+}
+
+// FileCheck is the result of CheckFile
+type FileCheck struct {
+	Target string `json:"target"`
+	// Path is relative to the target directory, with forward slashes
+	Path string `json:"path"`
+	URL  string `json:"url,omitempty"`
+	// Verdict is one of the Check* constants and Detail explains it
+	Verdict string `json:"verdict"`
+	Detail  string `json:"detail,omitempty"`
+	// Local is the copy on disk, Recorded its manifest entry and Upstream what the
+	// upstream reported, nil if it was not reached. Upstream hashes come from
+	// its checksum lists.
+	Local    *FileFacts `json:"local,omitempty"`
+	Recorded FileFacts  `json:"recorded"`
+	Upstream *FileFacts `json:"upstream,omitempty"`
+	// SampleBytes is the number of leading bytes compared with FileCheckOptions.Sample
+	// and SampleMatch whether they were equal
+	SampleBytes int64     `json:"sampleBytes,omitempty"`
+	SampleMatch *bool     `json:"sampleMatch,omitempty"`
+	CheckedAt   time.Time `json:"checkedAt"`
+}
+
+// CheckFile compares the file at rel, relative to targetDir, with its manifest
+// entry and its upstream: the local SHA-256 is computed, the recorded URL is
+// checked with a HEAD request through the target's client and, as opts ask, a
+// leading sample of the content and the upstream's published checksums are
+// compared too. Files the manifest does not know give ErrNotRecorded.
+func (m *Manager) CheckFile(ctx context.Context, target *config.Target, targetDir, rel string, opts FileCheckOptions) (*FileCheck, error) {
+	m = m.forTarget(target.Name)
+	if target.Storage == config.StorageS3 {
+		return nil, fmt.Errorf("target %s: file checks do not support s3 storage", target.Name)
+	}
+	rel = path.Clean("/" + filepath.ToSlash(rel))[1:]
+	localPath := filepath.Join(targetDir, filepath.FromSlash(rel))
+	if rel == "" || !isWithinDir(targetDir, localPath) {
+		return nil, &PathSecurityError{Name: rel, Reason: "outside target directory"}
+	}
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		return nil, err
+	}
+	source, ok := manifest.Lookup(rel)
+	if !ok {
+		return nil, ErrNotRecorded
+	}
+
+	check := &FileCheck{
+		Target:    target.Name,
+		Path:      rel,
+		URL:       source.URL,
+		Recorded:  FileFacts{Size: source.Size, ModTime: source.ModTime, ETag: source.ETag, SHA256: source.SHA256, MD5: source.MD5},
+		CheckedAt: time.Now().UTC(),
+	}
+	info, err := os.Stat(localPath)
+	if os.IsNotExist(err) {
+		check.Verdict = CheckMissing
+		return check, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	digest, err := fileDigest(ctx, localPath)
+	if err != nil {
+		return nil, err
+	}
+	check.Local = &FileFacts{Size: info.Size(), ModTime: info.ModTime().UTC(), SHA256: digest.SHA256, MD5: digest.MD5}
+	if info.Size() != source.Size || (source.SHA256 != "" && digest.SHA256 != source.SHA256) {
+		check.Verdict, check.Detail = CheckCorrupted, "the local copy differs from the manifest"
+		return check, nil
+	}
+	if source.URL == "" {
+		check.Verdict, check.Detail = CheckUnknown, "the upstream URL was not recorded"
+		return check, nil
+	}
+
+	target = m.normalizeTarget(target)
+	client := m.newClient(target)
+	release, err := m.hosts.acquire(ctx, source.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	remote, err := client.CheckFileInfo(ctx, source.URL)
+	if err != nil {
+		var status *httpPkg.StatusError
+		if errors.As(err, &status) && (status.Code == http.StatusNotFound || status.Code == http.StatusGone) {
+			check.Verdict = CheckUpstreamMissing
+		} else {
+			check.Verdict = CheckUnknown
+		}
+		check.Detail = err.Error()
+		return check, nil
+	}
+	check.Upstream = &FileFacts{Size: remote.Size, ModTime: remote.LastModified, ETag: remote.ETag}
+	update, err := client.CheckUpdate(localPath, remote, source.ETag)
+	if err != nil {
+		return nil, err
+	}
+	changed := update.NeedsUpdate
+
+	// Content comparisons tell a changed upstream from a copy that went wrong
+	// while the upstream claims it is the same
+	verdict := func(detail string) (*FileCheck, error) {
+		check.Verdict, check.Detail = CheckMismatch, detail
+		if changed {
+			check.Verdict = CheckUpstreamChanged
+		}
+		return check, nil
+	}
+	if opts.Checksums {
+		published, err := m.publishedDigest(ctx, client, source.URL)
+		if err != nil {
+			m.logger.Debug("Failed to fetch upstream checksum lists", "url", source.URL, "error", err)
+		}
+		check.Upstream.SHA256, check.Upstream.MD5 = published.SHA256, published.MD5
+		switch {
+		case published.SHA256 != "" && published.SHA256 != digest.SHA256:
+			return verdict("the upstream publishes another SHA-256")
+		case published.SHA256 == "" && published.MD5 != "" && published.MD5 != digest.MD5:
+			return verdict("the upstream publishes another MD5")
+		}
+	}
+	if opts.Sample > 0 {
+		n, match, err := sampleMatches(ctx, client, source.URL, localPath, opts.Sample)
+		if err != nil {
+			check.Verdict, check.Detail = CheckUnknown, err.Error()
+			return check, nil
+		}
+		check.SampleBytes, check.SampleMatch = n, &match
+		if !match {
+			return verdict(fmt.Sprintf("the first %d bytes differ from the upstream", n))
+		}
+	}
+	if changed {
+		check.Verdict, check.Detail = CheckUpstreamChanged, "the upstream size or modification time changed"
+		return check, nil
+	}
+	check.Verdict = CheckMatch
+	return check, nil
+}
+
+// publishedDigest returns the sums the checksum lists in the upstream directory of
+// rawURL publish for it, trying the lists in turn until one has it
+func (m *Manager) publishedDigest(ctx context.Context, client *httpPkg.Client, rawURL string) (httpPkg.Digest, error) {
+	fileURL, err := url.Parse(rawURL)
+	if err != nil {
+		return httpPkg.Digest{}, err
+	}
+	dirURL := fileURL.ResolveReference(&url.URL{Path: "./"})
+	names := make([]string, 0, len(checksumFileNames))
+	for name := range checksumFileNames {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var errs []error
+	for _, name := range names {
+		// Lists are published in upper case as often as in lower case
+		for _, listName := range []string{name, upperBase(name)} {
+			digests, err := fetchChecksums(ctx, client, dirURL, listName)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if digest, ok := digests[fileURL.String()]; ok {
+				return digest, nil
+			}
+		}
+	}
+	return httpPkg.Digest{}, errors.Join(errs...)
+}
+
+// upperBase returns name with the part before its extension in upper case, as in
+// SHA256SUMS.txt
+func upperBase(name string) string {
+	ext := path.Ext(name)
+	return strings.ToUpper(strings.TrimSuffix(name, ext)) + ext
+}
+
+// fetchChecksums downloads the checksum list name of the directory at dirURL and
+// returns its sums; lists the upstream does not have give none
+func fetchChecksums(ctx context.Context, client *httpPkg.Client, dirURL *url.URL, name string) (map[string]httpPkg.Digest, error) {
+	listURL := dirURL.ResolveReference(&url.URL{Path: name}).String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", client.GetUserAgent())
+	resp, err := client.DoRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpPkg.StatusError{Method: http.MethodGet, URL: listURL, Code: resp.StatusCode}
+	}
+	digests := make(map[string]httpPkg.Digest)
+	parseChecksums(io.LimitReader(resp.Body, maxChecksumListSize), dirURL, digests)
+	return digests, nil
+}
+
+// sampleMatches fetches up to n leading bytes of rawURL with a ranged GET and
+// compares them with those of the file at localPath. Upstreams that ignore the
+// range have their response cut off after n bytes. It returns the number of bytes
+// compared.
+func sampleMatches(ctx context.Context, client *httpPkg.Client, rawURL, localPath string, n int64) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("User-Agent", client.GetUserAgent())
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	resp, err := client.DoRequest(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, false, &httpPkg.StatusError{Method: http.MethodGet, URL: rawURL, Code: resp.StatusCode}
+	}
+	remote := sha256.New()
+	read, err := io.Copy(remote, io.LimitReader(resp.Body, n))
+	if err != nil {
+		return 0, false, err
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	local := sha256.New()
+	compared, err := io.Copy(local, io.LimitReader(file, read))
+	if err != nil {
+		return 0, false, err
+	}
+	return read, compared == read && bytes.Equal(local.Sum(nil), remote.Sum(nil)), nil
+}
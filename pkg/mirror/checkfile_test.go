@@ -0,0 +1,135 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestCheckFile(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	content, upstreamTime, published := "release 1", modTime, ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/pub/file.iso":
+			http.ServeContent(w, r, "file.iso", upstreamTime, strings.NewReader(content))
+		case "/pub/SHA256SUMS":
+			if published == "" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, "%s  file.iso\n", published)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	sum := func(s string) string {
+		hash := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(hash[:])
+	}
+
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "file.iso")
+	record := func(local string) {
+		if err := os.WriteFile(localPath, []byte(local), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(localPath, modTime, modTime)
+		if err := RecordFile(dir, "file.iso", FileSource{URL: server.URL + "/pub/file.iso", Size: 9, SHA256: sum("release 1")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "pub", URL: server.URL + "/pub/", Timeout: 5}
+
+	tests := []struct {
+		name      string
+		local     string
+		upstream  string
+		newer     bool
+		published string
+		opts      FileCheckOptions
+		verdict   string
+	}{
+		{"match", "release 1", "release 1", false, sum("release 1"), FileCheckOptions{Sample: 4, Checksums: true}, CheckMatch},
+		{"corrupted copy", "release X", "release 1", false, "", FileCheckOptions{}, CheckCorrupted},
+		{"upstream changed", "release 1", "release 2", true, "", FileCheckOptions{}, CheckUpstreamChanged},
+		{"upstream content differs", "release 1", "release 2", false, "", FileCheckOptions{Sample: 16}, CheckMismatch},
+		{"published sum differs", "release 1", "release 1", false, sum("release 2"), FileCheckOptions{Checksums: true}, CheckMismatch},
+		{"changed with new sum", "release 1", "release 2", true, sum("release 2"), FileCheckOptions{Checksums: true}, CheckUpstreamChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record(tt.local)
+			mu.Lock()
+			content, upstreamTime, published = tt.upstream, modTime, tt.published
+			if tt.newer {
+				upstreamTime = modTime.Add(time.Hour)
+			}
+			mu.Unlock()
+
+			check, err := manager.CheckFile(context.Background(), target, dir, "/file.iso", tt.opts)
+			if err != nil {
+				t.Fatalf("CheckFile failed: %v", err)
+			}
+			if check.Verdict != tt.verdict {
+				t.Errorf("Expected verdict %s, got %s (%s)", tt.verdict, check.Verdict, check.Detail)
+			}
+			if check.Path != "file.iso" || check.Local == nil || check.Local.SHA256 != sum(tt.local) || check.Recorded.SHA256 != sum("release 1") {
+				t.Errorf("Expected the local and recorded hashes, got %+v", check)
+			}
+		})
+	}
+
+	// Matching checks report what was compared
+	record("release 1")
+	mu.Lock()
+	content, upstreamTime, published = "release 1", modTime, sum("release 1")
+	mu.Unlock()
+	check, err := manager.CheckFile(context.Background(), target, dir, "file.iso", FileCheckOptions{Sample: 4, Checksums: true})
+	if err != nil {
+		t.Fatalf("CheckFile failed: %v", err)
+	}
+	if check.Upstream == nil || check.Upstream.Size != 9 || !check.Upstream.ModTime.Equal(modTime) || check.Upstream.SHA256 != sum("release 1") {
+		t.Errorf("Expected the upstream described, got %+v", check.Upstream)
+	}
+	if check.SampleBytes != 4 || check.SampleMatch == nil || !*check.SampleMatch {
+		t.Errorf("Expected a matching sample of 4 bytes, got %d %v", check.SampleBytes, check.SampleMatch)
+	}
+
+	// Files gone upstream, gone locally or never recorded
+	if err := RecordFile(dir, "gone.iso", FileSource{URL: server.URL + "/pub/gone.iso", Size: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if check, err := manager.CheckFile(context.Background(), target, dir, "gone.iso", FileCheckOptions{}); err != nil || check.Verdict != CheckMissing {
+		t.Errorf("Expected the local copy missing, got %+v (%v)", check, err)
+	}
+	os.WriteFile(filepath.Join(dir, "gone.iso"), []byte("release 1"), 0644)
+	if check, err := manager.CheckFile(context.Background(), target, dir, "gone.iso", FileCheckOptions{}); err != nil || check.Verdict != CheckUpstreamMissing {
+		t.Errorf("Expected the upstream missing, got %+v (%v)", check, err)
+	}
+	if _, err := manager.CheckFile(context.Background(), target, dir, "other.iso", FileCheckOptions{}); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("Expected ErrNotRecorded, got %v", err)
+	}
+	if check, err := manager.CheckFile(context.Background(), target, dir, "../file.iso", FileCheckOptions{}); err != nil || check.Path != "file.iso" {
+		t.Errorf("Expected paths to stay within the target, got %+v (%v)", check, err)
+	}
+}
@@ -0,0 +1,217 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// ChurnFileName is the file in each target directory recording when the listings
+// of its directories last changed
+const ChurnFileName = config.MetadataPrefix + "churn.json"
+
+// Defaults of Target.ChurnRelistEvery and Target.FullScanEvery
+const (
+	DefaultChurnRelistEvery = 5
+	DefaultFullScanEvery    = 20
+)
+
+// DirChurn is the listing history of a directory
+type DirChurn struct {
+	// Hash identifies the entries of the most recent listing
+	Hash string `json:"hash"`
+	// Links are the links of the most recent listing, kept with
+	// Target.ChurnSkipAfter so that runs skipping the listing can mirror them
+	Links []string `json:"links,omitempty"`
+	// Changes counts listings whose entries differed from the previous listing
+	Changes int64 `json:"changes"`
+	// LastChanged is when the entries were last seen to change, or first seen
+	LastChanged time.Time `json:"lastChanged"`
+	// LastListed is when the directory was last listed
+	LastListed time.Time `json:"lastListed"`
+	// ChangedRun and ListedRun are the numbers of the runs that saw the last change
+	// and listed the directory last
+	ChangedRun int64 `json:"changedRun"`
+	ListedRun  int64 `json:"listedRun"`
+}
+
+// Churn is the listing history of the directories of a target, keyed by path
+// relative to the target URL
+type Churn struct {
+	// Runs counts the runs of the target so far
+	Runs int64 `json:"runs"`
+	// LastFullScan is the number of the last complete run that listed every directory
+	LastFullScan int64                `json:"lastFullScan"`
+	Directories  map[string]*DirChurn `json:"directories"`
+}
+
+// LoadChurn reads the listing history stored in targetDir. A missing file yields an
+// empty history.
+func LoadChurn(targetDir string) (*Churn, error) {
+	churn := &Churn{Directories: make(map[string]*DirChurn)}
+
+	data, err := os.ReadFile(filepath.Join(targetDir, ChurnFileName))
+	if os.IsNotExist(err) {
+		return churn, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read listing churn: %w", err)
+	}
+
+	if err := json.Unmarshal(data, churn); err != nil {
+		return nil, fmt.Errorf("failed to parse listing churn: %w", err)
+	}
+	if churn.Directories == nil {
+		churn.Directories = make(map[string]*DirChurn)
+	}
+	return churn, nil
+}
+
+// saveChurn atomically replaces the listing history in targetDir
+func saveChurn(targetDir string, churn *Churn) error {
+	data, err := json.Marshal(churn)
+	if err != nil {
+		return fmt.Errorf("failed to encode listing churn: %w", err)
+	}
+	return writeFileAtomic(targetDir, ChurnFileName, data)
+}
+
+// churnTracker records the listings of a run and decides which directories are
+// mirrored from their recorded links instead of being listed again
+type churnTracker struct {
+	churn *Churn
+	// run is the number of the current run; full is set if every directory is
+	// listed, as on every FullScanEvery-th run
+	run  int64
+	full bool
+	// skipAfter and relistEvery are Target.ChurnSkipAfter and ChurnRelistEvery
+	skipAfter   int64
+	relistEvery int64
+	// seen are the directories listed or replayed by the run
+	seen map[string]bool
+	now  func() time.Time
+}
+
+// newChurnTracker starts tracking the run following those in churn. force lists every
+// directory, as does a target without Target.ChurnSkipAfter and a target that never
+// completed a full scan.
+func newChurnTracker(churn *Churn, target *config.Target, force bool) *churnTracker {
+	relistEvery, fullScanEvery := target.ChurnRelistEvery, target.FullScanEvery
+	if relistEvery <= 0 {
+		relistEvery = DefaultChurnRelistEvery
+	}
+	if fullScanEvery <= 0 {
+		fullScanEvery = DefaultFullScanEvery
+	}
+	run := churn.Runs + 1
+	return &churnTracker{
+		churn:       churn,
+		run:         run,
+		full:        force || target.ChurnSkipAfter <= 0 || churn.LastFullScan == 0 || run-churn.LastFullScan >= int64(fullScanEvery),
+		skipAfter:   int64(target.ChurnSkipAfter),
+		relistEvery: int64(relistEvery),
+		seen:        make(map[string]bool),
+		now:         time.Now,
+	}
+}
+
+// skip returns the recorded links of the directory at rel if its listing has not
+// changed for more than skipAfter runs and was fetched less than relistEvery runs
+// ago. The root is always listed.
+func (c *churnTracker) skip(rel string) ([]string, bool) {
+	if c == nil || c.full || rel == "" {
+		return nil, false
+	}
+	dir, ok := c.churn.Directories[rel]
+	if !ok || dir.Links == nil || c.run-dir.ChangedRun <= c.skipAfter || c.run-dir.ListedRun >= c.relistEvery {
+		return nil, false
+	}
+	c.seen[rel] = true
+	return dir.Links, true
+}
+
+// observe records the links of a listing of the directory at rel
+func (c *churnTracker) observe(rel string, links []string) {
+	if c == nil {
+		return
+	}
+	c.seen[rel] = true
+	now := c.now().UTC()
+	hash := linkSetHash(links)
+	dir, ok := c.churn.Directories[rel]
+	if !ok {
+		dir = &DirChurn{}
+		c.churn.Directories[rel] = dir
+	}
+	if dir.Hash != hash {
+		if dir.Hash != "" {
+			dir.Changes++
+		}
+		dir.Hash = hash
+		dir.ChangedRun = c.run
+		dir.LastChanged = now
+	}
+	dir.ListedRun = c.run
+	dir.LastListed = now
+	dir.Links = nil
+	if c.skipAfter > 0 {
+		dir.Links = slices.Clone(links)
+	}
+}
+
+// finish ends the run. Only a complete full scan counts as one; it also forgets
+// directories that are gone upstream.
+func (c *churnTracker) finish(complete bool) {
+	c.churn.Runs = c.run
+	if !c.full || !complete {
+		return
+	}
+	c.churn.LastFullScan = c.run
+	for rel := range c.churn.Directories {
+		if !c.seen[rel] {
+			delete(c.churn.Directories, rel)
+		}
+	}
+}
+
+// linkSetHash identifies a set of links independently of their order
+func linkSetHash(links []string) string {
+	sorted := slices.Clone(links)
+	slices.Sort(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadChurn starts tracking the listing churn of a run into targetDir
+func (m *Manager) loadChurn(target *config.Target, targetDir string) *churnTracker {
+	churn, err := LoadChurn(targetDir)
+	if err != nil {
+		m.logger.Warn("Discarding unreadable listing churn", "error", err)
+		churn = &Churn{Directories: make(map[string]*DirChurn)}
+	}
+	tracker := newChurnTracker(churn, target, m.fullScan)
+	if tracker.full && target.ChurnSkipAfter > 0 {
+		m.logger.Info("Listing every directory in a full scan", "run", tracker.run)
+	}
+	return tracker
+}
+
+// saveChurn persists the listing churn of a run. A run that failed, hit a limit or
+// left directories unscheduled is not a complete scan.
+func (m *Manager) saveChurn(targetDir string, stats *MirrorStats, runErr error) {
+	if stats.churn == nil {
+		return
+	}
+	stats.churn.finish(runErr == nil && len(stats.LimitsReached) == 0 && len(stats.unscheduled) == 0)
+	if err := saveChurn(targetDir, stats.churn.churn); err != nil {
+		m.logger.Warn("Failed to save listing churn", "error", err)
+	}
+}
@@ -0,0 +1,218 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestChurnTracker(t *testing.T) {
+	target := &config.Target{ChurnSkipAfter: 1, ChurnRelistEvery: 3, FullScanEvery: 10}
+	churn := &Churn{Directories: make(map[string]*DirChurn)}
+
+	// The first run is a full scan, as there was none before
+	first := newChurnTracker(churn, target, false)
+	if !first.full {
+		t.Fatal("Expected the first run to list every directory")
+	}
+	first.observe("a", []string{"x", "y/"})
+	first.observe("gone", []string{"z"})
+	first.finish(true)
+
+	tests := []struct {
+		run   int64
+		links []string
+		skip  bool
+	}{
+		{run: 2, links: []string{"y/", "x"}, skip: false}, // same set, but changed too recently
+		{run: 3, skip: true},
+		{run: 4, skip: true},
+		{run: 5, links: []string{"x", "y/", "new"}, skip: false}, // relisted, and changed
+		{run: 6, links: []string{"x", "y/", "new"}, skip: false},
+		{run: 7, skip: true},
+	}
+	for _, tt := range tests {
+		c := newChurnTracker(churn, target, false)
+		if c.run != tt.run || c.full {
+			t.Fatalf("Expected run %d to be partial, got run %d, full %v", tt.run, c.run, c.full)
+		}
+		links, skip := c.skip("a")
+		if skip != tt.skip {
+			t.Fatalf("Run %d: expected skip %v, got %v", tt.run, tt.skip, skip)
+		}
+		if skip && !slices.Equal(links, churn.Directories["a"].Links) {
+			t.Errorf("Run %d: expected the recorded links, got %v", tt.run, links)
+		}
+		if !skip {
+			c.observe("a", tt.links)
+		}
+		c.finish(true)
+	}
+
+	a := churn.Directories["a"]
+	if a.Changes != 1 || a.ChangedRun != 5 || a.ListedRun != 6 {
+		t.Errorf("Expected one change in run 5 and the last listing in run 6, got %+v", a)
+	}
+	if _, ok := churn.Directories["gone"]; !ok {
+		t.Error("Expected partial runs to keep directories they did not see")
+	}
+
+	// The tenth run after the last full scan is a full one and forgets what is gone
+	for churn.Runs < 10 {
+		newChurnTracker(churn, target, false).finish(true)
+	}
+	full := newChurnTracker(churn, target, false)
+	if !full.full {
+		t.Fatal("Expected a periodic full scan")
+	}
+	if _, skip := full.skip("a"); skip {
+		t.Error("Expected a full scan to list every directory")
+	}
+	full.observe("a", []string{"x", "y/", "new"})
+	full.finish(true)
+	if _, ok := churn.Directories["gone"]; ok || churn.LastFullScan != 11 {
+		t.Errorf("Expected the full scan to be recorded and drop vanished directories, got %+v", churn)
+	}
+
+	// Forced scans list everything, incomplete ones do not count
+	if forced := newChurnTracker(churn, target, true); !forced.full {
+		t.Error("Expected a forced full scan")
+	}
+	if disabled := newChurnTracker(churn, &config.Target{}, false); !disabled.full {
+		t.Error("Expected every directory to be listed without churnSkipAfter")
+	}
+	churn.LastFullScan = 2
+	incomplete := newChurnTracker(churn, target, false)
+	incomplete.finish(false)
+	if churn.LastFullScan != 2 || len(churn.Directories) != 1 {
+		t.Errorf("Expected an incomplete scan not to count, got %+v", churn)
+	}
+	if incomplete.relistEvery != 3 {
+		t.Errorf("Expected the configured relist interval, got %d", incomplete.relistEvery)
+	}
+	if defaults := newChurnTracker(churn, &config.Target{ChurnSkipAfter: 1}, false); defaults.relistEvery != DefaultChurnRelistEvery {
+		t.Errorf("Expected the default relist interval, got %d", defaults.relistEvery)
+	}
+}
+
+// churnServer serves a small tree whose b/ listing can change, counting requests
+type churnServer struct {
+	mu       sync.Mutex
+	requests []string
+	b        string
+}
+
+func (s *churnServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.URL.Path)
+	listings := map[string]string{
+		"/":     `<a href="a/">a/</a><a href="b/">b/</a>`,
+		"/a/":   `<a href="one.txt">one.txt</a>`,
+		"/b/":   s.b,
+		"/b/c/": `<a href="deep.txt">deep.txt</a>`,
+	}
+	if listing, ok := listings[r.URL.Path]; ok {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, listing)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "content of "+r.URL.Path)
+}
+
+// listings returns the directory listings requested since the last call
+func (s *churnServer) listings() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var listings []string
+	for _, p := range s.requests {
+		if strings.HasSuffix(p, "/") {
+			listings = append(listings, p)
+		}
+	}
+	s.requests = nil
+	return listings
+}
+
+func TestRunSkipsUnchangedListings(t *testing.T) {
+	upstream := &churnServer{b: `<a href="two.txt">two.txt</a><a href="c/">c/</a>`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := NewManager(&config.Config{}, logger)
+	target := &config.Target{Name: "churn", URL: server.URL + "/", MaxDepth: 5, Timeout: 5,
+		ChurnSkipAfter: 1, ChurnRelistEvery: 3, FullScanEvery: 10}
+	run := func(m *Manager) *MirrorStats {
+		t.Helper()
+		stats, err := m.Run(context.Background(), target, targetDir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return stats
+	}
+	all := []string{"/", "/a/", "/b/", "/b/c/"}
+
+	for i := 1; i <= 2; i++ {
+		if stats := run(manager); stats.ListingsSkippedByChurn != 0 {
+			t.Fatalf("Run %d: expected every directory to be listed, skipped %d", i, stats.ListingsSkippedByChurn)
+		}
+		if got := upstream.listings(); !slices.Equal(got, all) {
+			t.Fatalf("Run %d: expected listings %v, got %v", i, all, got)
+		}
+	}
+
+	// Unchanged directories are mirrored from their recorded links, including
+	// their files and subdirectories
+	stats := run(manager)
+	if stats.ListingsSkippedByChurn != 3 {
+		t.Errorf("Expected 3 skipped listings, got %d", stats.ListingsSkippedByChurn)
+	}
+	if got := upstream.listings(); !slices.Equal(got, []string{"/"}) {
+		t.Errorf("Expected only the root to be listed, got %v", got)
+	}
+	if stats.FilesDownloaded+stats.FilesSkipped != 3 {
+		t.Errorf("Expected the files of skipped listings to be mirrored, got %+v", stats)
+	}
+
+	// A forced full scan lists everything and sees the change
+	upstream.mu.Lock()
+	upstream.b = `<a href="two.txt">two.txt</a><a href="three.txt">three.txt</a><a href="c/">c/</a>`
+	upstream.mu.Unlock()
+	if stats := run(NewManager(&config.Config{}, logger, WithFullScan())); stats.ListingsSkippedByChurn != 0 || stats.FilesDownloaded+stats.FilesSkipped != 4 {
+		t.Errorf("Expected a full scan mirroring the new file, got %+v", stats)
+	}
+	if got := upstream.listings(); !slices.Equal(got, all) {
+		t.Errorf("Expected a full scan, got %v", got)
+	}
+
+	churn, err := LoadChurn(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if churn.Runs != 4 || churn.LastFullScan != 4 {
+		t.Errorf("Expected 4 runs ending in a full scan, got %d and %d", churn.Runs, churn.LastFullScan)
+	}
+	if b := churn.Directories["b"]; b == nil || b.Changes != 1 || b.ChangedRun != 4 || len(b.Links) != 3 {
+		t.Errorf("Expected the change of b to be recorded, got %+v", b)
+	}
+	if a := churn.Directories["a"]; a == nil || a.Changes != 0 || a.ChangedRun != 1 {
+		t.Errorf("Expected a to be unchanged since the first run, got %+v", a)
+	}
+
+	// The changed directory is listed again while the others stay skipped
+	run(manager)
+	if got := upstream.listings(); !slices.Equal(got, []string{"/", "/b/"}) {
+		t.Errorf("Expected the recently changed directory to be listed, got %v", got)
+	}
+}
@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// CleanupStats summarizes a removal of stale temporary files
+type CleanupStats struct {
+	// Files and Bytes count the removed files
+	Files int64
+	Bytes int64
+	// Resumable counts stale partial downloads kept for a later run to resume
+	Resumable int64
+}
+
+// CleanupTempFiles removes temporary and partial download files below targetDir
+// that were last written more than maxAge ago, e.g. by a crashed or cancelled run.
+// Partial downloads are kept while the target may still resume them. Only names
+// recognized by config.IsTempFile are ever removed.
+func (m *Manager) CleanupTempFiles(ctx context.Context, target *config.Target, targetDir string, maxAge time.Duration) (*CleanupStats, error) {
+	return m.forTarget(target.Name).removeTempFiles(ctx, target, targetDir, maxAge)
+}
+
+// removeTempFiles implements CleanupTempFiles for a manager logging for target
+func (m *Manager) removeTempFiles(ctx context.Context, target *config.Target, targetDir string, maxAge time.Duration) (*CleanupStats, error) {
+	stats := &CleanupStats{}
+	if target.Frozen {
+		return stats, fmt.Errorf("target %s: %w", target.Name, ErrTargetFrozen)
+	}
+	manifest := m.loadManifest(targetDir)
+	cutoff := time.Now().Add(-maxAge)
+
+	err := filepath.WalkDir(targetDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if !d.Type().IsRegular() || !config.IsTempFile(d.Name()) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if resumable(target, manifest, targetDir, path, info) {
+			stats.Resumable++
+			return nil
+		}
+		// The validator of a partial download goes with it
+		if name, ok := strings.CutPrefix(info.Name(), config.PartialValidatorPrefix); ok {
+			if _, err := os.Lstat(filepath.Join(filepath.Dir(path), name+config.PartialSuffix)); err == nil {
+				return nil
+			}
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		if name, ok := strings.CutSuffix(info.Name(), config.PartialSuffix); ok {
+			os.Remove(filepath.Join(filepath.Dir(path), config.PartialValidatorPrefix+name))
+		}
+		m.logger.Debug("Removed stale temporary file", "path", path, "size", info.Size(), "modified", info.ModTime())
+		stats.Files++
+		stats.Bytes += info.Size()
+		return nil
+	})
+
+	if stats.Files > 0 {
+		m.logger.Info("Removed stale temporary files", "files", stats.Files, "bytes", stats.Bytes)
+	}
+	return stats, err
+}
+
+// resumable reports whether a partial download may still be resumed: the target
+// continues downloads and the file was not completely downloaded since
+func resumable(target *config.Target, manifest *Manifest, targetDir, path string, info fs.FileInfo) bool {
+	if !target.ContinueDownload || !strings.HasSuffix(info.Name(), config.PartialSuffix) || strings.HasPrefix(info.Name(), config.TempFilePrefix) {
+		return false
+	}
+	rel, err := filepath.Rel(targetDir, strings.TrimSuffix(path, config.PartialSuffix))
+	if err != nil {
+		return false
+	}
+	source, ok := manifest.Lookup(rel)
+	return !ok || !source.FetchedAt.After(info.ModTime())
+}
+
+// cleanupTempFiles removes stale temporary files at the start of a run, unless
+// Mirror.TempMaxAge disables it
+func (m *Manager) cleanupTempFiles(ctx context.Context, target *config.Target, targetDir string, stats *MirrorStats) {
+	if m.config.Mirror.TempMaxAge <= 0 {
+		return
+	}
+	cleanup, err := m.removeTempFiles(ctx, target, targetDir, time.Duration(m.config.Mirror.TempMaxAge)*time.Second)
+	if err != nil {
+		m.logger.Warn("Failed to clean up temporary files", "error", err)
+	}
+	stats.ReclaimedBytes = cleanup.Bytes
+}
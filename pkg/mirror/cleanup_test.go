@@ -0,0 +1,184 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestCleanupTempFiles(t *testing.T) {
+	targetDir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	fetched := time.Now().Add(-24 * time.Hour)
+
+	manifest := Manifest{Files: map[string]FileSource{"sub/done.iso": {FetchedAt: fetched}}}
+	data, _ := json.Marshal(manifest)
+	if err := os.WriteFile(filepath.Join(targetDir, ManifestFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []struct {
+		name    string
+		stale   bool
+		removed bool
+		// alongside files are removed with their partial download and not counted
+		alongside bool
+	}{
+		{name: "sub/" + config.TempFilePrefix + "123", stale: true, removed: true},
+		{name: config.TempFilePrefix + "state.json-9", stale: true, removed: true},
+		{name: "sub/" + config.TempFilePrefix + "456", stale: false, removed: false},
+		{name: "sub/big.iso.part", stale: true, removed: false},
+		{name: "sub/done.iso.part", stale: true, removed: true},
+		{name: "sub/fresh.iso.part", stale: false, removed: false},
+		{name: "sub/" + config.PartialValidatorPrefix + "big.iso", stale: true, removed: false},
+		{name: "sub/" + config.PartialValidatorPrefix + "done.iso", stale: true, removed: true, alongside: true},
+		{name: "sub/" + config.PartialValidatorPrefix + "gone.iso", stale: true, removed: true},
+		// Names outside the temp patterns are never touched
+		{name: "sub/big.iso.tmp", stale: true, removed: false},
+		{name: "sub/.hidden", stale: true, removed: false},
+		{name: "sub/partial", stale: true, removed: false},
+	}
+	var wantBytes int64
+	for i, f := range files {
+		path := filepath.Join(targetDir, f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		content := make([]byte, 10*(i+1))
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f.stale {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.removed && !f.alongside {
+			wantBytes += int64(len(content))
+		}
+	}
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "cleanup", ContinueDownload: true}
+	stats, err := manager.CleanupTempFiles(context.Background(), target, targetDir, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CleanupTempFiles failed: %v", err)
+	}
+	if stats.Files != 4 || stats.Bytes != wantBytes || stats.Resumable != 1 {
+		t.Errorf("Expected 4 files with %d bytes removed and 1 resumable, got %+v", wantBytes, stats)
+	}
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(targetDir, f.name))
+		if removed := os.IsNotExist(err); removed != f.removed {
+			t.Errorf("%s: expected removed=%v, got %v (%v)", f.name, f.removed, removed, err)
+		}
+	}
+
+	// Without ContinueDownload stale partial downloads are not worth keeping
+	target.ContinueDownload = false
+	stats, err = manager.CleanupTempFiles(context.Background(), target, targetDir, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("CleanupTempFiles failed: %v", err)
+	}
+	if stats.Files != 1 || stats.Resumable != 0 {
+		t.Errorf("Expected the stale partial download to be removed, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "sub/big.iso.part")); !os.IsNotExist(err) {
+		t.Errorf("Expected big.iso.part to be removed, got %v", err)
+	}
+}
+
+func TestRunReclaimsTempFiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body></body></html>`))
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	leftover := filepath.Join(targetDir, config.TempFilePrefix+"crashed")
+	if err := os.WriteFile(leftover, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(leftover, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		maxAge     int
+		wantBytes  int64
+		wantExists bool
+	}{
+		{"disabled", 0, 0, true},
+		{"younger than max age", 3 * 3600, 0, true},
+		{"older than max age", 3600, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Mirror: config.Mirror{TempMaxAge: tt.maxAge}}
+			manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			target := &config.Target{Name: "reclaim", URL: server.URL + "/", MaxDepth: 1, Timeout: 5}
+			stats, err := manager.Run(context.Background(), target, targetDir)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if stats.ReclaimedBytes != tt.wantBytes {
+				t.Errorf("Expected %d reclaimed bytes, got %d", tt.wantBytes, stats.ReclaimedBytes)
+			}
+			if _, err := os.Stat(leftover); (err == nil) != tt.wantExists {
+				t.Errorf("Expected leftover to exist=%v, got %v", tt.wantExists, err)
+			}
+		})
+	}
+}
+
+func TestRunResumesPartialDownloads(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="big.iso">big.iso</a>`))
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "big.iso", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	// A crashed run left the first 4000 bytes behind, long enough ago to be stale
+	targetDir := t.TempDir()
+	partial := filepath.Join(targetDir, "big.iso"+config.PartialSuffix)
+	if err := os.WriteFile(partial, []byte(content[:4000]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(targetDir, config.PartialValidatorPrefix+"big.iso"), []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(partial, old, old)
+
+	manager := NewManager(&config.Config{Mirror: config.Mirror{TempMaxAge: 3600}}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "resume", URL: server.URL + "/", MaxDepth: 1, Timeout: 5, ContinueDownload: true}
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesDownloaded != 1 || stats.BytesResumed != 4000 || stats.BytesDownloaded != 6000 || stats.ReclaimedBytes != 0 {
+		t.Errorf("Expected the partial download to be continued, got %+v", stats)
+	}
+	if data, _ := os.ReadFile(filepath.Join(targetDir, "big.iso")); string(data) != content {
+		t.Errorf("Expected the whole content, got %d bytes", len(data))
+	}
+}
@@ -0,0 +1,181 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// Content type checks of a target
+const (
+	// ContentCheckHTML only flags HTML served for files whose extension implies
+	// binary content and the reverse, such as a login page saved as firmware.bin
+	ContentCheckHTML = "html"
+	// ContentCheckAll flags every conflict between the extension and the content
+	ContentCheckAll = "all"
+	ContentCheckOff = "off"
+)
+
+// QuarantineDirName is the directory in each target directory that downloads
+// failing the content type check are written to with Target.QuarantineMismatches
+const QuarantineDirName = config.MetadataPrefix + "quarantine"
+
+// maxContentMismatchesReported bounds MirrorStats.ContentMismatches;
+// ContentTypeMismatches stays exact
+const maxContentMismatchesReported = 100
+
+// ErrContentTypeMismatch is the error of an EventContentMismatch
+var ErrContentTypeMismatch = errors.New("content does not match the file extension")
+
+// Classes of content, as implied by a file extension, a Content-Type or the first
+// bytes of a file
+const (
+	contentHTML   = "html"
+	contentText   = "text"
+	contentBinary = "binary"
+)
+
+// binaryExtensions are extensions of files that are never HTML or text
+var binaryExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".bin": true, ".bz2": true, ".cab": true, ".deb": true,
+	".dmg": true, ".exe": true, ".gz": true, ".img": true, ".iso": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".lz": true, ".lzma": true, ".msi": true, ".pdf": true,
+	".png": true, ".qcow2": true, ".rar": true, ".rom": true, ".rpm": true, ".squashfs": true,
+	".tar": true, ".tbz2": true, ".tgz": true, ".txz": true, ".udeb": true, ".vmdk": true,
+	".whl": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// textExtensions are extensions of plain text files
+var textExtensions = map[string]bool{
+	".asc": true, ".csv": true, ".json": true, ".md": true, ".txt": true, ".xml": true,
+	".yaml": true, ".yml": true,
+}
+
+// ContentMismatch is a download whose content conflicts with its file extension
+type ContentMismatch struct {
+	// Path is relative to the target directory
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// Expected is the class of content the extension implies: "binary", "html" or "text"
+	Expected string `json:"expected"`
+	// ContentType is the Content-Type header and Sniffed the type detected from
+	// the first 512 bytes
+	ContentType string `json:"contentType"`
+	Sniffed     string `json:"sniffed"`
+	// Quarantined is set if the download was written to QuarantineDirName instead
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// extensionClass returns the class of content the extension of name implies, or
+// "" if it implies none
+func extensionClass(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case ext == ".html" || ext == ".htm" || ext == ".xhtml":
+		return contentHTML
+	case binaryExtensions[ext]:
+		return contentBinary
+	case textExtensions[ext]:
+		return contentText
+	}
+	return ""
+}
+
+// typeClass returns the class of a media type, or "" for types that say nothing,
+// such as application/octet-stream, which many servers send for everything
+func typeClass(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return contentHTML
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/json", mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return contentText
+	case mediaType == "application/octet-stream":
+		return ""
+	case strings.HasPrefix(mediaType, "application/"), strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "font/"):
+		return contentBinary
+	}
+	return ""
+}
+
+// sniffedClass returns the class of the type http.DetectContentType found. Unlike
+// in a header, application/octet-stream there means the bytes are not text.
+func sniffedClass(sniffed string) string {
+	if mediaType, _, _ := mime.ParseMediaType(sniffed); mediaType == "application/octet-stream" {
+		return contentBinary
+	}
+	return typeClass(sniffed)
+}
+
+// contentConflicts reports whether content conflicts with the extension of name
+// under check, and the class the extension implies
+func contentConflicts(check, name string, content httpPkg.Content) (string, bool) {
+	expected := extensionClass(name)
+	if check == ContentCheckOff || expected == "" {
+		return expected, false
+	}
+	for _, got := range []string{typeClass(content.Type), sniffedClass(content.Sniffed)} {
+		if got == "" || got == expected {
+			continue
+		}
+		if check == ContentCheckAll {
+			return expected, true
+		}
+		// By default only HTML in place of binary data alerts, and the reverse
+		if (expected == contentBinary && got == contentHTML) || (expected == contentHTML && got == contentBinary) {
+			return expected, true
+		}
+	}
+	return expected, false
+}
+
+// quarantineDivert returns the function WithQuarantine diverts conflicting
+// downloads of target into the quarantine directory of targetDir with
+func quarantineDivert(target *config.Target, targetDir string) func(string, httpPkg.Content) string {
+	return func(localPath string, content httpPkg.Content) string {
+		if _, conflict := contentConflicts(target.ContentTypeCheck, filepath.Base(localPath), content); !conflict {
+			return ""
+		}
+		rel, err := filepath.Rel(targetDir, localPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return ""
+		}
+		return filepath.Join(targetDir, QuarantineDirName, rel)
+	}
+}
+
+// checkContent records a download whose content conflicts with its extension
+func (m *Manager) checkContent(stats *MirrorStats, check, url, localPath string, digest httpPkg.Digest) {
+	expected, conflict := contentConflicts(check, filepath.Base(localPath), digest.Content)
+	if !conflict {
+		return
+	}
+	atomic.AddInt64(&stats.ContentTypeMismatches, 1)
+	rel, _ := stats.relPath(localPath)
+	mismatch := ContentMismatch{Path: rel, URL: url, Expected: expected, ContentType: digest.Content.Type,
+		Sniffed: digest.Content.Sniffed, Quarantined: digest.Quarantined != ""}
+	stats.mu.Lock()
+	if len(stats.ContentMismatches) < maxContentMismatchesReported {
+		stats.ContentMismatches = append(stats.ContentMismatches, mismatch)
+	}
+	stats.mu.Unlock()
+
+	m.logger.Warn("Downloaded content does not match the file extension",
+		"path", rel, "url", url, "expected", expected,
+		"content_type", mismatch.ContentType, "sniffed", mismatch.Sniffed, "quarantined", digest.Quarantined)
+	m.emit(stats, Event{Type: EventContentMismatch, URL: url, Path: localPath,
+		Err: fmt.Errorf("%w: %s expected, served as %q, sniffed as %q", ErrContentTypeMismatch, expected, mismatch.ContentType, mismatch.Sniffed)})
+}
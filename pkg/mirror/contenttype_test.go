@@ -0,0 +1,127 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+func TestContentConflicts(t *testing.T) {
+	const (
+		html   = "text/html; charset=utf-8"
+		text   = "text/plain; charset=utf-8"
+		binary = "application/octet-stream"
+	)
+	tests := []struct {
+		name     string
+		check    string
+		file     string
+		header   string
+		sniffed  string
+		conflict bool
+	}{
+		{"login page as firmware", "", "firmware.bin", "text/html", html, true},
+		{"login page labelled octet-stream", "", "firmware.bin", binary, html, true},
+		{"html header on binary content", "", "image.iso", "text/html", binary, true},
+		{"binary served as html page", "", "index.html", "text/html", binary, true},
+		{"octet-stream for everything", "", "notes.txt", binary, text, false},
+		{"octet-stream for binary", "", "image.iso", binary, binary, false},
+		{"gzip", "", "a.tar.gz", "application/gzip", "application/x-gzip", false},
+		{"text served for binary only alerts with all", "", "firmware.bin", "text/plain", text, false},
+		{"text served for binary", ContentCheckAll, "firmware.bin", "text/plain", text, true},
+		{"html saved as text", ContentCheckAll, "notes.txt", "text/html", html, true},
+		{"unknown extension", ContentCheckAll, "README", "text/html", html, false},
+		{"check disabled", ContentCheckOff, "firmware.bin", "text/html", html, false},
+		{"upper-case extension", "", "FIRMWARE.BIN", "text/html", html, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, conflict := contentConflicts(tt.check, tt.file, httpPkg.Content{Type: tt.header, Sniffed: tt.sniffed})
+			if conflict != tt.conflict {
+				t.Errorf("Expected conflict %v, got %v", tt.conflict, conflict)
+			}
+		})
+	}
+}
+
+func TestRunQuarantinesMismatchedContent(t *testing.T) {
+	const page = "<!DOCTYPE html><html><body>Please log in</body></html>"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="firmware.bin">firmware.bin</a><a href="other.bin">other.bin</a><a href="notes.txt">notes.txt</a>`))
+		case "/firmware.bin":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(page))
+		case "/other.bin":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte{0x7f, 'E', 'L', 'F', 0, 1, 2, 3})
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("plain notes"))
+		}
+	}))
+	defer server.Close()
+
+	for _, strict := range []bool{false, true} {
+		t.Run(map[bool]string{false: "report", true: "quarantine"}[strict], func(t *testing.T) {
+			targetDir := t.TempDir()
+			firmware := filepath.Join(targetDir, "firmware.bin")
+			if err := os.WriteFile(firmware, []byte("good firmware"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var events []Event
+			manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)),
+				WithEventSink(func(e Event) {
+					if e.Type == EventContentMismatch {
+						events = append(events, e)
+					}
+				}))
+			target := &config.Target{Name: "firmware", URL: server.URL + "/", MaxDepth: 5, Timeout: 5, QuarantineMismatches: strict}
+			stats, err := manager.Run(context.Background(), target, targetDir)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			want := ContentMismatch{Path: "firmware.bin", URL: server.URL + "/firmware.bin", Expected: "binary",
+				ContentType: "text/html", Sniffed: "text/html; charset=utf-8", Quarantined: strict}
+			if stats.ContentTypeMismatches != 1 || len(stats.ContentMismatches) != 1 || stats.ContentMismatches[0] != want {
+				t.Errorf("Expected %+v, got %d: %+v", want, stats.ContentTypeMismatches, stats.ContentMismatches)
+			}
+			if len(events) != 1 || !errors.Is(events[0].Err, ErrContentTypeMismatch) {
+				t.Errorf("Expected one mismatch event, got %+v", events)
+			}
+
+			data, _ := os.ReadFile(firmware)
+			quarantined, quarantineErr := os.ReadFile(filepath.Join(targetDir, QuarantineDirName, "firmware.bin"))
+			manifest, err := LoadManifest(targetDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The pre-existing copy is adopted; the quarantined download is not recorded
+			source, _ := manifest.Lookup("firmware.bin")
+			recorded := source.URL != ""
+			if strict {
+				if string(data) != "good firmware" || string(quarantined) != page || recorded {
+					t.Errorf("Expected the good copy kept and the page quarantined, got %q, %q (%v), recorded %v", data, quarantined, quarantineErr, recorded)
+				}
+				if stats.FilesDownloaded != 2 {
+					t.Errorf("Expected the quarantined file not to count as downloaded, got %d", stats.FilesDownloaded)
+				}
+			} else if string(data) != page || quarantineErr == nil {
+				t.Errorf("Expected the page to be mirrored without quarantine, got %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// Target layouts
+const (
+	// LayoutInPlace updates a single tree in the target directory
+	LayoutInPlace = "in-place"
+	// LayoutImmutableDated writes every run into a new directory named by the run's
+	// date, which is never modified afterwards
+	LayoutImmutableDated = "immutable-dated"
+)
+
+// DefaultDatedFormat names the directories of the immutable-dated layout
+const DefaultDatedFormat = "%Y-%m-%d"
+
+// CurrentLinkName is the symlink in a target directory pointing at the dated
+// directory of the last successful run
+const CurrentLinkName = "current"
+
+// ErrDatedDirExists is returned by Run when the dated directory of the run already
+// exists, e.g. after a second run on the same day
+var ErrDatedDirExists = errors.New("dated directory already exists")
+
+// datedFields are the supported strftime directives with the pattern they match
+var datedFields = map[byte]string{
+	'Y': `(\d{4})`,
+	'y': `(\d{2})`,
+	'm': `(\d{2})`,
+	'd': `(\d{2})`,
+	'j': `(\d{3})`,
+	'H': `(\d{2})`,
+	'M': `(\d{2})`,
+	'S': `(\d{2})`,
+}
+
+// datedFormat is a parsed strftime-style directory name format
+type datedFormat struct {
+	format string
+	// fields are the directives in order of appearance
+	fields  []byte
+	pattern *regexp.Regexp
+}
+
+// parseDatedFormat parses a format such as "%Y-%m-%d" or "snapshot-%Y%m%dT%H%M"
+func parseDatedFormat(format string) (*datedFormat, error) {
+	if format == "" {
+		format = DefaultDatedFormat
+	}
+
+	f := &datedFormat{format: format}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			pattern.WriteString(regexp.QuoteMeta(format[i : i+1]))
+			continue
+		}
+		if i+1 == len(format) {
+			return nil, fmt.Errorf("invalid dated format %q: trailing %%", format)
+		}
+		i++
+		if format[i] == '%' {
+			pattern.WriteString("%")
+			continue
+		}
+		field, ok := datedFields[format[i]]
+		if !ok {
+			return nil, fmt.Errorf("invalid dated format %q: unsupported directive %%%c", format, format[i])
+		}
+		f.fields = append(f.fields, format[i])
+		pattern.WriteString(field)
+	}
+	pattern.WriteString("$")
+
+	if strings.ContainsAny(format, `/\`) {
+		return nil, fmt.Errorf("invalid dated format %q: must name a single directory", format)
+	}
+	if len(f.fields) == 0 {
+		return nil, fmt.Errorf("invalid dated format %q: no date directives", format)
+	}
+	f.pattern = regexp.MustCompile(pattern.String())
+	return f, nil
+}
+
+// name returns the directory name for t
+func (f *datedFormat) name(t time.Time) string {
+	var name strings.Builder
+	for i := 0; i < len(f.format); i++ {
+		if f.format[i] != '%' {
+			name.WriteByte(f.format[i])
+			continue
+		}
+		i++
+		switch f.format[i] {
+		case 'Y':
+			name.WriteString(fmt.Sprintf("%04d", t.Year()))
+		case 'y':
+			name.WriteString(fmt.Sprintf("%02d", t.Year()%100))
+		case 'm':
+			name.WriteString(fmt.Sprintf("%02d", int(t.Month())))
+		case 'd':
+			name.WriteString(fmt.Sprintf("%02d", t.Day()))
+		case 'j':
+			name.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case 'H':
+			name.WriteString(fmt.Sprintf("%02d", t.Hour()))
+		case 'M':
+			name.WriteString(fmt.Sprintf("%02d", t.Minute()))
+		case 'S':
+			name.WriteString(fmt.Sprintf("%02d", t.Second()))
+		case '%':
+			name.WriteByte('%')
+		}
+	}
+	return name.String()
+}
+
+// parse returns the time encoded in a directory name, or false if the name does not
+// match the format
+func (f *datedFormat) parse(name string) (time.Time, bool) {
+	match := f.pattern.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+
+	year, month, day, yearDay := 1970, 1, 1, 0
+	var hour, minute, second int
+	for i, field := range f.fields {
+		value, _ := strconv.Atoi(match[i+1])
+		switch field {
+		case 'Y':
+			year = value
+		case 'y':
+			year = 2000 + value
+		case 'm':
+			month = value
+		case 'd':
+			day = value
+		case 'j':
+			yearDay = value
+		case 'H':
+			hour = value
+		case 'M':
+			minute = value
+		case 'S':
+			second = value
+		}
+	}
+	if yearDay > 0 {
+		month, day = 1, yearDay
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC), true
+}
+
+// datedDirs returns the dated directories in targetDir, newest first
+func (f *datedFormat) datedDirs(targetDir string) ([]string, error) {
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type datedDir struct {
+		name string
+		date time.Time
+	}
+	var dirs []datedDir
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if date, ok := f.parse(entry.Name()); ok {
+			dirs = append(dirs, datedDir{entry.Name(), date})
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if !dirs[i].date.Equal(dirs[j].date) {
+			return dirs[i].date.After(dirs[j].date)
+		}
+		return dirs[i].name > dirs[j].name
+	})
+
+	names := make([]string, len(dirs))
+	for i, dir := range dirs {
+		names[i] = dir.name
+	}
+	return names, nil
+}
+
+// prepareDatedDir creates the dated directory of a run started at start and returns
+// it with the dated directory of the last successful run, if any
+func (m *Manager) prepareDatedDir(target *config.Target, targetDir string, start time.Time) (runDir, previous string, err error) {
+	format, err := parseDatedFormat(target.DatedFormat)
+	if err != nil {
+		return "", "", fmt.Errorf("target %s: %w", target.Name, err)
+	}
+
+	runDir = filepath.Join(targetDir, format.name(start.UTC()))
+	if err := os.Mkdir(runDir, 0755); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return "", "", fmt.Errorf("target %s: %s: %w", target.Name, runDir, ErrDatedDirExists)
+		}
+		return "", "", fmt.Errorf("failed to create dated directory: %w", err)
+	}
+
+	if link, err := os.Readlink(filepath.Join(targetDir, CurrentLinkName)); err == nil && filepath.Base(link) == link {
+		if info, err := os.Stat(filepath.Join(targetDir, link)); err == nil && info.IsDir() {
+			previous = filepath.Join(targetDir, link)
+		}
+	}
+
+	m.logger.Info("Mirroring into dated directory", "path", runDir, "previous", previous)
+	return runDir, previous, nil
+}
+
+// finishDatedRun points the current symlink at the dated directory of a successful
+// run and removes the dated directories beyond Target.KeepDated
+func (m *Manager) finishDatedRun(target *config.Target, targetDir, runDir string) {
+	if err := updateCurrentLink(targetDir, filepath.Base(runDir)); err != nil {
+		m.logger.Warn("Failed to update current symlink", "error", err)
+	}
+	if target.KeepDated <= 0 {
+		return
+	}
+
+	format, err := parseDatedFormat(target.DatedFormat)
+	if err != nil {
+		return
+	}
+	dirs, err := format.datedDirs(targetDir)
+	if err != nil {
+		m.logger.Warn("Failed to list dated directories", "error", err)
+		return
+	}
+
+	var removed []string
+	for _, name := range dirs[min(target.KeepDated, len(dirs)):] {
+		if name == filepath.Base(runDir) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(targetDir, name)); err != nil {
+			m.logger.Warn("Failed to remove expired dated directory", "dir", name, "error", err)
+			continue
+		}
+		m.logger.Info("Removed expired dated directory", "dir", name)
+		removed = append(removed, name)
+	}
+	m.forgetDatedDirs(target, targetDir, removed)
+}
+
+// forgetDatedDirs removes the manifest entries of deleted dated directories
+func (m *Manager) forgetDatedDirs(target *config.Target, targetDir string, dirs []string) {
+	if len(dirs) == 0 {
+		return
+	}
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		m.logger.Warn("Failed to read manifest", "error", err)
+		return
+	}
+	for rel := range manifest.Files {
+		for _, dir := range dirs {
+			if strings.HasPrefix(rel, dir+"/") {
+				delete(manifest.Files, rel)
+				break
+			}
+		}
+	}
+	if err := saveManifest(targetDir, manifest); err != nil {
+		m.logger.Warn("Failed to save manifest", "error", err)
+	}
+}
+
+// updateCurrentLink atomically points the current symlink of targetDir at name
+func updateCurrentLink(targetDir, name string) error {
+	tmp := filepath.Join(targetDir, config.TempFilePrefix+CurrentLinkName)
+	os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(targetDir, CurrentLinkName)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// previousCopy returns the counterpart of localPath in the dated directory of the
+// previous run, or "" if unchanged files are not linked
+func (stats *MirrorStats) previousCopy(localPath string) string {
+	if stats.previous == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(stats.runDir, localPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.Join(stats.previous, rel)
+}
+
+// linkUnchanged creates localPath from the previous dated directory if the upstream
+// file did not change since, and reports whether it did
+func (m *Manager) linkUnchanged(client *httpPkg.Client, stats *MirrorStats, rawURL, localPath string, remoteInfo *httpPkg.FileInfo) bool {
+	previous := stats.previousCopy(localPath)
+	if previous == "" || remoteInfo == nil {
+		return false
+	}
+	if _, err := os.Lstat(localPath); !os.IsNotExist(err) {
+		return false
+	}
+	if info, err := os.Stat(previous); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if needsUpdate, err := client.NeedsUpdate(previous, remoteInfo); err != nil || needsUpdate {
+		return false
+	}
+
+	if err := linkOrCopy(previous, localPath); err != nil {
+		m.logger.Debug("Could not link unchanged file, downloading", "path", localPath, "from", previous, "error", err)
+		return false
+	}
+
+	// The origin stays that of the earlier download
+	stats.recordSource(localPath, rawURL, httpPkg.Digest{})
+	if prevRel, ok := stats.relPath(previous); ok {
+		if source, ok := stats.digests.files[prevRel]; ok {
+			rel, _ := stats.relPath(localPath)
+			source.URL = rawURL
+			stats.mu.Lock()
+			stats.sources[rel] = source
+			stats.mu.Unlock()
+		}
+	}
+	m.logger.Debug("Linked unchanged file from previous dated directory", "path", localPath, "from", previous)
+	atomic.AddInt64(&stats.FilesSkipped, 1)
+	m.skipped(stats, rawURL, localPath, config.SkipUnchanged)
+	m.emit(stats, Event{Type: EventFileSkipped, URL: rawURL, Path: localPath})
+	return true
+}
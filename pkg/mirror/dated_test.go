@@ -0,0 +1,174 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestDatedFormat(t *testing.T) {
+	date := time.Date(2024, 6, 1, 13, 4, 5, 0, time.UTC)
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{"", "2024-06-01", false},
+		{"%Y%m%dT%H%M%S", "20240601T130405", false},
+		{"snap-%y.%j", "snap-24.153", false},
+		{"100%%-%Y", "100%-2024", false},
+		{"%Y/%m", "", true},
+		{"%Y-%b", "", true},
+		{"static", "", true},
+		{"%Y-%", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			f, err := parseDatedFormat(tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			name := f.name(date)
+			if name != tt.want {
+				t.Errorf("Expected name %q, got %q", tt.want, name)
+			}
+			if parsed, ok := f.parse(name); !ok || f.name(parsed) != name {
+				t.Errorf("Expected %q to parse back, got %v, %v", name, parsed, ok)
+			}
+		})
+	}
+
+	f, _ := parseDatedFormat("")
+	for _, name := range []string{"current", "2024-06-01.old", "24-06-01"} {
+		if _, ok := f.parse(name); ok {
+			t.Errorf("Expected %q not to be a dated directory", name)
+		}
+	}
+}
+
+func TestRunImmutableDated(t *testing.T) {
+	content := map[string]string{"stable.iso": "stable", "changing.txt": "v2"}
+	modTimes := map[string]time.Time{
+		"stable.iso":   time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"changing.txt": time.Now().Add(-time.Minute).UTC(),
+	}
+	downloads := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="stable.iso">stable</a><a href="changing.txt">changing</a>`))
+			return
+		}
+		name := r.URL.Path[1:]
+		w.Header().Set("Last-Modified", modTimes[name].Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			downloads[name]++
+		}
+		w.Write([]byte(content[name]))
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{
+		Name: "archive", URL: server.URL + "/", MaxDepth: 2, Timeout: 5,
+		Layout: LayoutImmutableDated, LinkUnchanged: true, KeepDated: 2,
+	}
+
+	// Pretend the previous runs happened on earlier days
+	for _, old := range []string{"2000-01-01", "2000-01-02"} {
+		if err := os.MkdirAll(filepath.Join(targetDir, old), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := filepath.Join(targetDir, "2000-01-02")
+	for name, data := range map[string]string{"stable.iso": "stable", "changing.txt": "v1"} {
+		path := filepath.Join(previous, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := modTimes[name]
+		if name == "changing.txt" {
+			modTime = modTime.Add(-time.Hour)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("2000-01-02", filepath.Join(targetDir, CurrentLinkName)); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := filepath.Join(targetDir, "notes")
+	if err := os.Mkdir(unrelated, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	runDir := filepath.Join(targetDir, stats.StartTime.UTC().Format("2006-01-02"))
+
+	if downloads["stable.iso"] != 0 || downloads["changing.txt"] != 1 {
+		t.Errorf("Expected only the changed file to be downloaded, got %v", downloads)
+	}
+	if stats.FilesSkipped != 1 || stats.FilesDownloaded != 1 {
+		t.Errorf("Expected 1 linked and 1 downloaded file, got %+v", stats)
+	}
+	linked, err := os.Stat(filepath.Join(runDir, "stable.iso"))
+	if err != nil {
+		t.Fatalf("Expected unchanged file in the new dated directory: %v", err)
+	}
+	original, _ := os.Stat(filepath.Join(previous, "stable.iso"))
+	if !os.SameFile(linked, original) {
+		t.Errorf("Expected the unchanged file to be hard-linked")
+	}
+	if data, _ := os.ReadFile(filepath.Join(previous, "changing.txt")); string(data) != "v1" {
+		t.Errorf("Expected the previous dated directory to stay untouched, got %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(runDir, "changing.txt")); string(data) != "v2" {
+		t.Errorf("Expected the new version in the new dated directory, got %q", data)
+	}
+
+	if link, err := os.Readlink(filepath.Join(targetDir, CurrentLinkName)); err != nil || link != filepath.Base(runDir) {
+		t.Errorf("Expected current to point at %s, got %q, %v", filepath.Base(runDir), link, err)
+	}
+
+	// Retention keeps the two newest dated directories and nothing else is touched
+	for path, want := range map[string]bool{
+		filepath.Join(targetDir, "2000-01-01"): false,
+		previous:                               true,
+		unrelated:                              true,
+	} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("%s: expected exists=%v, got %v", path, want, err)
+		}
+	}
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest.Lookup(filepath.Join(filepath.Base(runDir), "stable.iso")); !ok {
+		t.Error("Expected the linked file to be recorded in the manifest")
+	}
+
+	// A second run on the same day refuses to touch the existing directory
+	if _, err := manager.Run(context.Background(), target, targetDir); !errors.Is(err, ErrDatedDirExists) {
+		t.Errorf("Expected ErrDatedDirExists, got %v", err)
+	}
+	if link, _ := os.Readlink(filepath.Join(targetDir, CurrentLinkName)); link != filepath.Base(runDir) {
+		t.Errorf("Expected current to stay at %s, got %q", filepath.Base(runDir), link)
+	}
+}
@@ -0,0 +1,78 @@
+package mirror
+
+import (
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// dispositionPath returns the path of the download at localPath named filename by
+// its Content-Disposition header, with Target.ContentDispositionNames: filename in
+// the directory of localPath. Names that are invalid, hidden, or taken by the
+// download of another URL during the run give "", and the download keeps localPath.
+func (m *Manager) dispositionPath(stats *MirrorStats, target *config.Target, url, localPath, filename string) string {
+	if !isValidFilename(filename) {
+		m.logger.Warn("Ignoring invalid Content-Disposition filename", "path", localPath,
+			"error", &PathSecurityError{Name: filename, Reason: "invalid file name"})
+		return ""
+	}
+	if config.IsHidden(target.Hidden, filename) {
+		m.logger.Debug("Ignoring hidden Content-Disposition filename", "path", localPath, "filename", filename)
+		return ""
+	}
+
+	dir := filepath.Dir(localPath)
+	name, _ := stats.names.resolve(dir, filename)
+	named := filepath.Join(dir, name)
+	if named == localPath {
+		return ""
+	}
+	if !isWithinDir(dir, named) {
+		m.logger.Warn("Ignoring Content-Disposition filename outside the directory", "path", localPath,
+			"error", &PathSecurityError{Name: named, Reason: "outside target directory"})
+		return ""
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.dispositions == nil {
+		stats.dispositions = make(map[string]string)
+	}
+	if first, ok := stats.dispositions[named]; ok {
+		if first != url {
+			m.logger.Warn("Ignoring Content-Disposition filename of a file already mirrored from another URL",
+				"url", url, "filename", filename, "mirrored_from", first)
+			return ""
+		}
+		return named
+	}
+	atomic.AddInt64(&stats.FilesNamedByHeader, 1)
+	stats.dispositions[named] = url
+	return named
+}
+
+// recordedDisposition returns the path an earlier run wrote the download of url
+// to, if its Content-Disposition header named it, so that upstreams sending the
+// header only with the content are still checked for changes against it
+func (m *Manager) recordedDisposition(stats *MirrorStats, target *config.Target, url, localPath string) string {
+	rel, ok := stats.digests.byURL(url)
+	if !ok {
+		return ""
+	}
+	recorded := filepath.Join(stats.root, filepath.FromSlash(rel))
+	if filepath.Dir(recorded) != filepath.Dir(localPath) {
+		return ""
+	}
+	return m.dispositionPath(stats, target, url, localPath, filepath.Base(recorded))
+}
+
+// seeDispositions keeps the files named by Content-Disposition headers from being
+// pruned, as the listing only gave the names of their links
+func (stats *MirrorStats) seeDispositions() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	for named := range stats.dispositions {
+		stats.prune.seeFile(named)
+	}
+}
@@ -0,0 +1,112 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunContentDispositionNames(t *testing.T) {
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	names := map[string]string{"1": "report.pdf", "2": "notes.txt", "3": "../evil.txt"}
+	var headNames atomic.Bool
+	headNames.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pub/" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="download?id=1">1</a><a href="download?id=2">2</a>`+
+				`<a href="download?id=3">3</a><a href="old.txt">old.txt</a>`)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if names[id] != "" && (r.Method == http.MethodGet || headNames.Load()) {
+			w.Header().Set("Content-Disposition", `attachment; filename="`+names[id]+`"`)
+		}
+		http.ServeContent(w, r, "", modTime, strings.NewReader("file "+id))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "pub", URL: server.URL + "/pub/", MaxDepth: 2, Timeout: 5, CheckChanges: true,
+		AllowQueryStrings: true, ContentDispositionNames: true, Prune: true}
+	stats, err := manager.Run(context.Background(), target, dir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesDownloaded != 4 || stats.FilesNamedByHeader != 2 || stats.NameConflicts != 0 {
+		t.Errorf("Expected 4 files, 2 named by their header, got %+v", stats)
+	}
+	for name, content := range map[string]string{"report.pdf": "file 1", "notes.txt": "file 2", "download": "file 3"} {
+		if data, _ := os.ReadFile(filepath.Join(dir, name)); string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q", name, content, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the traversal name to be ignored, got %v", err)
+	}
+	manifest, _ := LoadManifest(dir)
+	if source, ok := manifest.Lookup("report.pdf"); !ok || source.URL != server.URL+"/pub/download?id=1" {
+		t.Errorf("Expected the named file recorded with its URL, got %+v", source)
+	}
+
+	// Unchanged files are found under their names, with or without the header in
+	// the file info response, and not pruned. The file of the link path could be
+	// any unnamed link's, so that link is downloaded again.
+	for _, head := range []bool{true, false} {
+		headNames.Store(head)
+		stats, err = manager.Run(context.Background(), target, dir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if stats.FilesDownloaded != 1 || stats.FilesSkipped != 3 {
+			t.Errorf("Header in file info %t: expected only the unnamed file downloaded, got %+v", head, stats)
+		}
+		for _, name := range []string{"report.pdf", "notes.txt"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+				t.Errorf("Header in file info %t: expected %s kept: %v", head, name, err)
+			}
+		}
+	}
+}
+
+func TestDispositionPath(t *testing.T) {
+	dir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	stats := &MirrorStats{root: dir}
+	target := &config.Target{Hidden: []string{"*.tmp"}}
+	localPath := filepath.Join(dir, "download")
+
+	for _, name := range []string{"", ".", "..", "../x", "a/b", `a\b`, "a\x00b", ".http-mirror-state", "x.tmp"} {
+		if named := manager.dispositionPath(stats, target, "http://a/download?id=1", localPath, name); named != "" {
+			t.Errorf("Expected %q rejected, got %s", name, named)
+		}
+	}
+	if named := manager.dispositionPath(stats, target, "http://a/download?id=1", localPath, "download"); named != "" {
+		t.Errorf("Expected the link name to need no renaming, got %s", named)
+	}
+
+	want := filepath.Join(dir, "a.zip")
+	if named := manager.dispositionPath(stats, target, "http://a/download?id=1", localPath, "a.zip"); named != want {
+		t.Errorf("Expected %s, got %s", want, named)
+	}
+	if named := manager.dispositionPath(stats, target, "http://a/download?id=1", localPath, "a.zip"); named != want {
+		t.Errorf("Expected the same URL to keep its name, got %s", named)
+	}
+	if named := manager.dispositionPath(stats, target, "http://a/download?id=2", localPath, "a.zip"); named != "" {
+		t.Errorf("Expected the name of another URL rejected, got %s", named)
+	}
+	if stats.FilesNamedByHeader != 1 {
+		t.Errorf("Expected 1 named file, got %d", stats.FilesNamedByHeader)
+	}
+}
@@ -0,0 +1,75 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// ListingParseError is returned when a directory listing could not be read or parsed
+type ListingParseError struct {
+	URL string
+	Err error
+}
+
+func (e *ListingParseError) Error() string {
+	return fmt.Sprintf("failed to parse directory listing %s: %v", e.URL, e.Err)
+}
+
+func (e *ListingParseError) Unwrap() error {
+	return e.Err
+}
+
+// PathSecurityError is returned for a remote name that would be written outside
+// the target directory or is not a plain file name
+type PathSecurityError struct {
+	Name   string
+	Reason string
+}
+
+func (e *PathSecurityError) Error() string {
+	return fmt.Sprintf("refusing unsafe path %q: %s", e.Name, e.Reason)
+}
+
+// StorageError is returned when the target directory cannot be written because
+// its volume is read-only, full or failing. It stops the run instead of failing
+// every remaining file the same way.
+type StorageError struct {
+	Path string
+	Err  error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("storage unavailable at %s: %v", e.Path, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// storageErrnos are the errors that mean the filesystem itself is failing
+var storageErrnos = []syscall.Errno{syscall.EROFS, syscall.ENOSPC, syscall.EDQUOT, syscall.EIO, syscall.ESTALE, syscall.ENOTCONN}
+
+// asStorageError returns err as a StorageError for path if it is a filesystem
+// failure, or nil otherwise
+func asStorageError(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var storageErr *StorageError
+	if errors.As(err, &storageErr) {
+		return err
+	}
+	var s3Err *storage.S3Error
+	if errors.As(err, &s3Err) && s3Err.BucketFailure() {
+		return &StorageError{Path: path, Err: err}
+	}
+	for _, errno := range storageErrnos {
+		if errors.Is(err, errno) {
+			return &StorageError{Path: path, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+func TestMirrorErrorTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/gone/":
+			http.Error(w, "gone", http.StatusGone)
+		case "/":
+			w.Write([]byte(`<a href="big/">big</a><a href="missing.txt">m</a>`))
+		case "/big/":
+			w.Write([]byte(`<a href="` + strings.Repeat("x", 4096) + `">x</a>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := NewManager(&config.Config{Mirror: config.Mirror{MaxResponseBytes: "1k"}}, logger)
+
+	// A failed root listing fails the run with the status
+	target := &config.Target{Name: "gone", URL: server.URL + "/gone/", Timeout: 5, MaxDepth: 2}
+	_, err := manager.Run(context.Background(), target, t.TempDir())
+	var statusErr *httpPkg.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusGone {
+		t.Errorf("Expected StatusError 410 for root listing, got %v", err)
+	}
+
+	// Failures below the root are bucketed by type
+	target = &config.Target{Name: "mixed", URL: server.URL + "/", Timeout: 5, MaxDepth: 2}
+	stats, err := manager.Run(context.Background(), target, t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.ErrorsByClass["listing parse error"] != 1 || stats.ErrorsByClass["http 404"] != 1 {
+		t.Errorf("Expected one parse error and one 404, got %v", stats.ErrorsByClass)
+	}
+}
+
+func TestAsStorageError(t *testing.T) {
+	tests := []struct {
+		err     error
+		storage bool
+	}{
+		{&os.PathError{Op: "open", Path: "/data/a", Err: syscall.EROFS}, true},
+		{fmt.Errorf("failed to copy file: %w", &os.PathError{Op: "write", Path: "/data/a", Err: syscall.ENOSPC}), true},
+		{&os.PathError{Op: "write", Path: "/data/a", Err: syscall.EIO}, true},
+		{&os.PathError{Op: "open", Path: "/data/a", Err: syscall.ENOENT}, false},
+		{&httpPkg.StatusError{Method: "GET", Code: 500}, false},
+		{fmt.Errorf("upload: %w", &storage.S3Error{Op: "put", Code: "AccessDenied", StatusCode: 403}), true},
+		{&storage.S3Error{Op: "put", Code: "InternalError", StatusCode: 500}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		err := asStorageError("/data/a", tt.err)
+		var storageErr *StorageError
+		if got := errors.As(err, &storageErr); got != tt.storage {
+			t.Errorf("asStorageError(%v) = %v, expected storage error %v", tt.err, err, tt.storage)
+		}
+		if tt.storage && classifyError(err) != "storage error" {
+			t.Errorf("Expected %v to be classified as storage error, got %q", err, classifyError(err))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package mirror
+
+import (
+	"errors"
+	"time"
+)
+
+// EventType identifies what happened during a mirror run
+type EventType string
+
+// Event types reported to an event sink
+const (
+	EventFileDownloaded EventType = "file_downloaded"
+	EventFileSkipped    EventType = "file_skipped"
+	// EventFileRelinked reports a file created from an identical earlier copy
+	// instead of being downloaded; Bytes is the download avoided
+	EventFileRelinked EventType = "file_relinked"
+	EventError        EventType = "error"
+	// EventListingAnomaly reports a jump in the share of empty directory listings
+	// compared to the previous run
+	EventListingAnomaly EventType = "listing_anomaly"
+	// EventMonthlyCapReached reports that a run stopped because the monthly byte cap
+	// is used up; its error wraps ErrMonthlyCapReached
+	EventMonthlyCapReached EventType = "monthly_cap_reached"
+	// EventFilterReport reports the directories a target in filter report mode
+	// mirrored although ExcludeDirs matched them; its error wraps ErrFilterReport
+	EventFilterReport EventType = "filter_report"
+	// EventContentMismatch reports a download whose content conflicts with its file
+	// extension; its error wraps ErrContentTypeMismatch
+	EventContentMismatch EventType = "content_mismatch"
+	// EventProgress reports the progress of the first run of a target every 30
+	// seconds in Progress
+	EventProgress EventType = "progress"
+)
+
+// ErrListingFormatChanged is the error of an EventListingAnomaly
+var ErrListingFormatChanged = errors.New("upstream listing format may have changed")
+
+// ErrFilterReport is the error of an EventFilterReport
+var ErrFilterReport = errors.New("filters in report mode matched directories")
+
+// Event describes a single file-level outcome or run-level alert of a mirror run
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Target string
+	URL    string
+	// Path is the local file path, empty for errors not tied to a file
+	Path string
+	// Bytes is the size of a downloaded file
+	Bytes int64
+	Err   error
+	// Progress is set for EventProgress
+	Progress *Progress
+}
+
+// EventSink receives events synchronously from the goroutine that mirrored the file;
+// the events of a run are delivered one at a time, even with Target.Concurrency.
+// It must not block.
+type EventSink func(Event)
+
+// emit sends an event to the configured sink, if any
+func (m *Manager) emit(stats *MirrorStats, event Event) {
+	if m.events == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.Target = stats.Target
+	stats.sinkMu.Lock()
+	defer stats.sinkMu.Unlock()
+	m.events(event)
+}
@@ -0,0 +1,61 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunReportsEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="good.txt">good.txt</a><a href="missing.txt">missing.txt</a>`))
+		case "/good.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("content"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	var events []Event
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WithEventSink(func(e Event) { events = append(events, e) }))
+
+	targetDir := filepath.Join(t.TempDir(), "custom")
+	target := &config.Target{Name: "events", URL: server.URL + "/", MaxDepth: 2, Timeout: 5}
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesDownloaded != 1 {
+		t.Errorf("Expected 1 file downloaded, got %d", stats.FilesDownloaded)
+	}
+
+	counts := make(map[EventType]int)
+	for _, e := range events {
+		counts[e.Type]++
+		if e.Target != "events" {
+			t.Errorf("Expected event target 'events', got %q", e.Target)
+		}
+		if e.Type == EventFileDownloaded {
+			if e.Path != filepath.Join(targetDir, "good.txt") || e.Bytes != int64(len("content")) {
+				t.Errorf("Unexpected download event: %+v", e)
+			}
+		}
+	}
+
+	if counts[EventFileDownloaded] != 1 || counts[EventError] != 1 {
+		t.Errorf("Expected one download and one error event, got %v", counts)
+	}
+}
@@ -0,0 +1,206 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// Policies for local copies of excluded directories
+const (
+	ExcludedDirKeep   = "keep"
+	ExcludedDirDelete = "delete"
+)
+
+// Filter modes of a target
+const (
+	FilterEnforce = "enforce"
+	// FilterReport mirrors excluded directories anyway and only reports them
+	FilterReport = "report"
+)
+
+// maxExcludedDirsReported bounds MirrorStats.ExcludedDirs; DirectoriesSkipped stays exact
+const maxExcludedDirsReported = 100
+
+// ExcludedDir is a subtree skipped by an ExcludeDirs pattern
+type ExcludedDir struct {
+	// Path is relative to the target URL
+	Path    string `json:"path"`
+	Pattern string `json:"pattern"`
+	// Deleted is set if a local copy was removed by the "delete" policy
+	Deleted bool `json:"deleted,omitempty"`
+	// Reported is set in report mode, where the directory was mirrored anyway;
+	// WouldDelete then tells that the "delete" policy would have removed a local copy
+	Reported    bool `json:"reported,omitempty"`
+	WouldDelete bool `json:"wouldDelete,omitempty"`
+}
+
+// dirPattern is a compiled ExcludeDirs or Priority pattern
+type dirPattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+// dirExcluder matches relative directory paths against ExcludeDirs patterns
+type dirExcluder struct {
+	patterns []dirPattern
+	delete   bool
+	report   bool
+}
+
+// newDirExcluder compiles the exclude patterns, policy and filter mode of a target
+func newDirExcluder(patterns []string, policy, mode string) (*dirExcluder, error) {
+	e := &dirExcluder{}
+	switch policy {
+	case "", ExcludedDirKeep:
+	case ExcludedDirDelete:
+		e.delete = true
+	default:
+		return nil, fmt.Errorf("invalid excluded directory policy %q", policy)
+	}
+	switch mode {
+	case "", FilterEnforce:
+	case FilterReport:
+		e.report = true
+	default:
+		return nil, fmt.Errorf("invalid filter mode %q", mode)
+	}
+
+	compiled, err := compilePatterns("exclude", patterns)
+	if err != nil {
+		return nil, err
+	}
+	e.patterns = compiled
+	return e, nil
+}
+
+// compilePatterns compiles path patterns in the syntax of ExcludeDirs; kind names
+// the option in errors
+func compilePatterns(kind string, patterns []string) ([]dirPattern, error) {
+	var compiled []dirPattern
+	for _, raw := range patterns {
+		p := dirPattern{raw: raw}
+		if expr, ok := strings.CutPrefix(raw, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s pattern %q: %w", kind, raw, err)
+			}
+			p.re = re
+		} else if _, err := path.Match(raw, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", kind, raw, err)
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// match reports whether the pattern matches rel, a slash-separated path relative
+// to the target URL
+func (p dirPattern) match(rel string) bool {
+	var matched bool
+	switch {
+	case p.re != nil:
+		matched = p.re.MatchString(rel)
+	case strings.Contains(p.raw, "/"):
+		matched, _ = path.Match(strings.Trim(p.raw, "/"), rel)
+	default:
+		matched, _ = path.Match(p.raw, path.Base(rel))
+	}
+	return matched
+}
+
+// match returns the first pattern excluding the directory at rel, a slash-separated
+// path relative to the target URL
+func (e *dirExcluder) match(rel string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	for _, p := range e.patterns {
+		if p.match(rel) {
+			return p.raw, true
+		}
+	}
+	return "", false
+}
+
+// errFound stops a walk once a file was found
+var errFound = errors.New("found")
+
+// present reports whether the directory at localDir exists in store, or holds
+// files in backends without directories
+func present(store storage.Storage, localDir string) bool {
+	if _, err := store.Stat(localDir); err == nil {
+		return true
+	}
+	return errors.Is(store.Walk(localDir, func(string, storage.FileInfo) error { return errFound }), errFound)
+}
+
+// excludeDir records a directory matched by pattern and applies the policy to its
+// local copy at localDir. It reports whether the directory is skipped, which it is
+// not in report mode.
+func (m *Manager) excludeDir(stats *MirrorStats, excluder *dirExcluder, rel, pattern, localDir string) bool {
+	if excluder.report {
+		stats.DirectoriesReported++
+		reported := ExcludedDir{Path: rel, Pattern: pattern, Reported: true}
+		reported.WouldDelete = excluder.delete && present(stats.fileStorage(), localDir)
+		m.logger.Info("Mirroring excluded directory in report mode", "path", rel,
+			"pattern", pattern, "would_delete", reported.WouldDelete)
+		if len(stats.ExcludedDirs) < maxExcludedDirsReported {
+			stats.ExcludedDirs = append(stats.ExcludedDirs, reported)
+		}
+		return false
+	}
+
+	stats.DirectoriesSkipped++
+	skipped := ExcludedDir{Path: rel, Pattern: pattern}
+
+	if excluder.delete {
+		store := stats.fileStorage()
+		if present(store, localDir) {
+			if err := store.RemoveAll(localDir); err != nil {
+				m.logger.Warn("Failed to delete excluded directory", "path", localDir, "error", err)
+			} else {
+				skipped.Deleted = true
+			}
+		}
+	}
+
+	m.logger.Info("Skipping excluded directory", "path", rel,
+		"pattern", pattern, "deleted", skipped.Deleted)
+	if len(stats.ExcludedDirs) < maxExcludedDirsReported {
+		stats.ExcludedDirs = append(stats.ExcludedDirs, skipped)
+	}
+	return true
+}
+
+// reportFilters warns about the directories matched in report mode, so that the
+// patterns can be reviewed before they are enforced
+func (m *Manager) reportFilters(stats *MirrorStats) {
+	if stats.DirectoriesReported == 0 {
+		return
+	}
+	var paths []string
+	wouldDelete := 0
+	for _, d := range stats.ExcludedDirs {
+		if !d.Reported {
+			continue
+		}
+		paths = append(paths, d.Path)
+		if d.WouldDelete {
+			wouldDelete++
+		}
+	}
+
+	err := fmt.Errorf("%w: %d directories with %d files would be skipped, %d local copies deleted",
+		ErrFilterReport, stats.DirectoriesReported, stats.FilesReported, wouldDelete)
+	m.logger.Warn("Filters in report mode matched directories; review them before setting filterMode to enforce",
+		"directories_reported", stats.DirectoriesReported,
+		"files_reported", stats.FilesReported,
+		"would_delete", wouldDelete,
+		"paths", paths)
+	m.emit(stats, Event{Type: EventFilterReport, Err: err})
+}
@@ -0,0 +1,214 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestDirExcluderMatch(t *testing.T) {
+	excluder, err := newDirExcluder([]string{"old", "pub/debug-*", `re:^archive/\d{4}$`}, "", "")
+	if err != nil {
+		t.Fatalf("newDirExcluder failed: %v", err)
+	}
+
+	tests := []struct {
+		rel     string
+		pattern string
+	}{
+		{"old", "old"},
+		{"pub/old", "old"},
+		{"pub/debug-symbols", "pub/debug-*"},
+		{"debug-symbols", ""},
+		{"pub/sub/debug-symbols", ""},
+		{"archive/2019", `re:^archive/\d{4}$`},
+		{"archive/2019/x", ""},
+		{"current", ""},
+	}
+	for _, tt := range tests {
+		pattern, ok := excluder.match(tt.rel)
+		if pattern != tt.pattern || ok != (tt.pattern != "") {
+			t.Errorf("match(%q) = %q, %v; want %q", tt.rel, pattern, ok, tt.pattern)
+		}
+	}
+}
+
+func TestNewDirExcluderInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		patterns []string
+		policy   string
+		mode     string
+	}{
+		{[]string{"re:("}, "", ""},
+		{[]string{"[a-"}, "", ""},
+		{nil, "purge", ""},
+		{nil, "", "warn"},
+	} {
+		if _, err := newDirExcluder(tt.patterns, tt.policy, tt.mode); err == nil {
+			t.Errorf("Expected error for patterns %v, policy %q and mode %q", tt.patterns, tt.policy, tt.mode)
+		}
+	}
+}
+
+func TestRunSkipsExcludedDirs(t *testing.T) {
+	var mu sync.Mutex
+	requested := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[r.URL.Path] = true
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="old/">old</a><a href="keep/">keep</a><a href="debug/">debug</a>`))
+		case "/keep/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a</a><a href="old/">old</a>`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		policy      string
+		wantDeleted bool
+	}{
+		{"", false},
+		{ExcludedDirDelete, true},
+	}
+
+	for _, tt := range tests {
+		t.Run("policy "+tt.policy, func(t *testing.T) {
+			targetDir := t.TempDir()
+			stale := filepath.Join(targetDir, "old", "stale.txt")
+			if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(stale, []byte("stale"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			target := &config.Target{
+				Name:              "exclude",
+				URL:               server.URL + "/",
+				MaxDepth:          5,
+				Timeout:           5,
+				ExcludeDirs:       []string{"old", "debug"},
+				ExcludedDirPolicy: tt.policy,
+			}
+			stats, err := manager.Run(context.Background(), target, targetDir)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			mu.Lock()
+			for _, p := range []string{"/old/", "/debug/", "/keep/old/"} {
+				if requested[p] {
+					t.Errorf("Excluded directory %s was fetched", p)
+				}
+			}
+			mu.Unlock()
+
+			if stats.DirectoriesSkipped != 3 || len(stats.ExcludedDirs) != 3 {
+				t.Errorf("Expected 3 skipped directories, got %d (%+v)", stats.DirectoriesSkipped, stats.ExcludedDirs)
+			}
+			if got := stats.ExcludedDirs[0]; got.Path != "old" || got.Pattern != "old" || got.Deleted != tt.wantDeleted {
+				t.Errorf("Unexpected first skipped directory %+v", got)
+			}
+			if got := stats.ExcludedDirs[2]; got.Path != "keep/old" {
+				t.Errorf("Expected nested skip to report its relative path, got %+v", got)
+			}
+
+			_, err = os.Stat(stale)
+			if deleted := os.IsNotExist(err); deleted != tt.wantDeleted {
+				t.Errorf("Expected local copy deleted=%v, got %v", tt.wantDeleted, deleted)
+			}
+		})
+	}
+}
+
+func TestRunReportsExcludedDirs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="old/">old</a><a href="keep/">keep</a>`))
+		case "/old/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a</a><a href="old/">old</a>`))
+		case "/old/old/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="b.txt">b</a>`))
+		case "/keep/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="c.txt">c</a>`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	stale := filepath.Join(targetDir, "old", "stale.txt")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WithEventSink(func(e Event) {
+			if e.Type == EventFilterReport {
+				events = append(events, e)
+			}
+		}))
+	target := &config.Target{
+		Name:              "report",
+		URL:               server.URL + "/",
+		MaxDepth:          5,
+		Timeout:           5,
+		ExcludeDirs:       []string{"old"},
+		ExcludedDirPolicy: ExcludedDirDelete,
+		FilterMode:        FilterReport,
+	}
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// Everything is mirrored and the local copy is kept
+	for _, name := range []string{"old/a.txt", "old/old/b.txt", "keep/c.txt", "old/stale.txt"} {
+		if _, err := os.Stat(filepath.Join(targetDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected %s to be mirrored or kept: %v", name, err)
+		}
+	}
+
+	// The nested match lies within the reported subtree and is not counted again
+	if stats.DirectoriesSkipped != 0 || stats.DirectoriesReported != 1 || stats.FilesReported != 2 {
+		t.Errorf("Expected 1 reported directory with 2 files, got skipped %d, reported %d, files %d",
+			stats.DirectoriesSkipped, stats.DirectoriesReported, stats.FilesReported)
+	}
+	want := ExcludedDir{Path: "old", Pattern: "old", Reported: true, WouldDelete: true}
+	if len(stats.ExcludedDirs) != 1 || stats.ExcludedDirs[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, stats.ExcludedDirs)
+	}
+	if len(events) != 1 || !errors.Is(events[0].Err, ErrFilterReport) {
+		t.Errorf("Expected one filter report event, got %+v", events)
+	}
+}
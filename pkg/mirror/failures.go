@@ -0,0 +1,187 @@
+package mirror
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// Bounds of the failures listed in the skip report, so that a run against a
+// broken upstream does not produce a report of unbounded size
+const (
+	maxFailuresRecorded  = 1000
+	maxFailureHeaderSize = 256
+	maxFailureErrorSize  = 512
+	maxFailureRedirects  = 10
+	maxFailureAttempts   = 10
+)
+
+// failureHeaders are the response headers a failure snapshot keeps
+var failureHeaders = []string{"Server", "Content-Type", "Content-Length", "Retry-After", "Location", "Via"}
+
+// redactedFailureHeaders are kept only as present, since their values may carry
+// credentials or session state
+var redactedFailureHeaders = []string{"Www-Authenticate", "Proxy-Authenticate", "Set-Cookie"}
+
+// sensitiveQueryParams are parts of query parameter names whose values are masked
+// in the URLs of a failure snapshot, as in signed URLs
+var sensitiveQueryParams = []string{"sig", "token", "key", "auth", "cred", "pass", "secret"}
+
+// FailedFile is a file a run failed to download, with a snapshot of the last
+// answer of the upstream
+type FailedFile struct {
+	URL string `json:"url"`
+	// Class is the classification of the error, as counted in errors_by_class
+	Class string `json:"class"`
+	Error string `json:"error"`
+	// Status is the status code of the last response, 0 if none was received
+	Status int `json:"status,omitempty"`
+	// Headers are the key headers of the last response, truncated, with those
+	// that may carry credentials replaced by config.Redaction
+	Headers map[string]string `json:"headers,omitempty"`
+	// Redirects are the URLs redirected through to the last response, starting
+	// with URL
+	Redirects []string `json:"redirects,omitempty"`
+	// Attempts are the times the requests for the file were started
+	Attempts []time.Time `json:"attempts,omitempty"`
+}
+
+// newFailedFile describes the failed download of rawURL with err
+func newFailedFile(rawURL string, err error) FailedFile {
+	failure := FailedFile{URL: redactFailureURL(rawURL), Class: classifyError(err)}
+	// Errors of the client may quote the URL
+	failure.Error = truncate(strings.ReplaceAll(err.Error(), rawURL, failure.URL), maxFailureErrorSize)
+	var status *httpPkg.StatusError
+	if !errors.As(err, &status) {
+		return failure
+	}
+	failure.Status = status.Code
+	for _, name := range failureHeaders {
+		if value := status.Header.Get(name); value != "" {
+			failure.setHeader(name, truncate(value, maxFailureHeaderSize))
+		}
+	}
+	for _, name := range redactedFailureHeaders {
+		if status.Header.Get(name) != "" {
+			failure.setHeader(name, config.Redaction)
+		}
+	}
+	if location := failure.Headers["Location"]; location != "" {
+		failure.Headers["Location"] = redactFailureURL(location)
+	}
+	for _, redirect := range status.Redirects[:min(len(status.Redirects), maxFailureRedirects)] {
+		failure.Redirects = append(failure.Redirects, redactFailureURL(redirect))
+	}
+	return failure
+}
+
+// setHeader records a header of the snapshot
+func (f *FailedFile) setHeader(name, value string) {
+	if f.Headers == nil {
+		f.Headers = make(map[string]string)
+	}
+	f.Headers[name] = value
+}
+
+// Signature identifies failures alike across files: the error class, the host
+// that answered last and its server software, e.g. "http 503 from
+// mirror.example.com (nginx)"
+func (f FailedFile) Signature() string {
+	signature, answered := f.Class, f.URL
+	if len(f.Redirects) > 0 {
+		answered = f.Redirects[len(f.Redirects)-1]
+	}
+	if u, err := url.Parse(answered); err == nil && u.Host != "" {
+		signature += " from " + u.Host
+	}
+	if server := f.Headers["Server"]; server != "" {
+		signature += " (" + truncate(server, 64) + ")"
+	}
+	return signature
+}
+
+// redactFailureURL masks the password and the values of sensitive query
+// parameters of a URL
+func redactFailureURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return config.Redaction
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			name, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil && sensitiveQueryParam(unescaped) {
+				params[i] = name + "=" + config.Redaction
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	return config.RedactURL(u.String())
+}
+
+// sensitiveQueryParam reports whether the value of the query parameter name may
+// be a credential
+func sensitiveQueryParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveQueryParams {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate cuts s to at most n bytes, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n-3], "") + "..."
+}
+
+// attempted records that the requests for rawURL were started at times and
+// failed, for the failure listed by failed
+func (stats *MirrorStats) attempted(rawURL string, times []time.Time) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.attempts == nil {
+		stats.attempts = make(map[string][]time.Time)
+	}
+	attempts := append(stats.attempts[rawURL], times...)
+	stats.attempts[rawURL] = attempts[max(len(attempts)-maxFailureAttempts, 0):]
+}
+
+// failed counts the signature of a file the run failed to download and, with
+// Mirror.ReportDetail "full", lists the file with a snapshot of the upstream's
+// answer in the skip report
+func (m *Manager) failed(stats *MirrorStats, rawURL, localPath string, err error) {
+	failure := newFailedFile(rawURL, err)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	failure.Attempts = stats.attempts[rawURL]
+	delete(stats.attempts, rawURL)
+	if stats.FailureSignatures == nil {
+		stats.FailureSignatures = make(map[string]int64)
+	}
+	stats.FailureSignatures[failure.Signature()]++
+
+	if m.config.Mirror.ReportDetail != config.ReportFull {
+		return
+	}
+	rel, ok := stats.relPath(localPath)
+	if !ok {
+		return
+	}
+	if stats.failures == nil {
+		stats.failures = make(map[string]FailedFile)
+	}
+	if len(stats.failures) < maxFailuresRecorded {
+		stats.failures[rel] = failure
+	}
+}
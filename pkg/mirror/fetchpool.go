@@ -0,0 +1,70 @@
+package mirror
+
+import (
+	"context"
+	"sync"
+)
+
+// fetchPool downloads the files of a run on up to Target.Concurrency goroutines
+// while the run keeps visiting directories in order. Submitting blocks while all
+// workers are busy, so the traversal never runs far ahead of the downloads.
+type fetchPool struct {
+	slots  chan struct{}
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+
+	once sync.Once
+	err  error
+}
+
+// newFetchPool creates a pool of n workers for a run, or nil to download every file
+// in place. The returned context ends when a worker hits an error that stops the
+// run, and must be used for the rest of the run.
+func newFetchPool(ctx context.Context, n int) (*fetchPool, context.Context) {
+	if n <= 1 {
+		return nil, ctx
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &fetchPool{slots: make(chan struct{}, n), cancel: cancel}, ctx
+}
+
+// submit runs fetch on a free worker, waiting for one if necessary. Without a pool,
+// fetch runs in place and its error is returned. With one, the first error of any
+// fetch cancels the run, and the error of submit only reports that ctx ended.
+func (p *fetchPool) submit(ctx context.Context, fetch func() error) error {
+	if p == nil {
+		return fetch()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+		if err := fetch(); err != nil {
+			p.once.Do(func() {
+				p.err = err
+				p.cancel()
+			})
+		}
+	}()
+	return nil
+}
+
+// wait waits for the running fetches and returns the first error that stopped the
+// run, if any
+func (p *fetchPool) wait() error {
+	if p == nil {
+		return nil
+	}
+	p.wg.Wait()
+	p.cancel()
+	return p.err
+}
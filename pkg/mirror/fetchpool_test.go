@@ -0,0 +1,101 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestFetchPool(t *testing.T) {
+	var inline *fetchPool
+	if err := inline.submit(context.Background(), func() error { return io.EOF }); err != io.EOF {
+		t.Errorf("Expected fetches without a pool to run in place, got %v", err)
+	}
+
+	pool, ctx := newFetchPool(context.Background(), 2)
+	var running, peak atomic.Int32
+	for range 6 {
+		err := pool.submit(ctx, func() error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+	}
+	if err := pool.wait(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if peak.Load() != 2 {
+		t.Errorf("Expected two fetches at once, got %d", peak.Load())
+	}
+
+	// The first failure cancels the run and is reported by wait
+	pool, ctx = newFetchPool(context.Background(), 2)
+	pool.submit(ctx, func() error { return ErrMonthlyCapReached })
+	<-ctx.Done()
+	if err := pool.submit(ctx, func() error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected submitting to a cancelled run to fail, got %v", err)
+	}
+	if err := pool.wait(); !errors.Is(err, ErrMonthlyCapReached) {
+		t.Errorf("Expected the error of the failed fetch, got %v", err)
+	}
+}
+
+func TestRunStopsConcurrentDownloadsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			for i := range 20 {
+				fmt.Fprintf(w, `<a href="file%02d.txt">file%02d.txt</a>`, i, i)
+			}
+			return
+		}
+		// The run is cancelled while four files are in flight, which are never finished
+		if requests.Add(1) == 4 {
+			cancel()
+		}
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "cancel", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, Concurrency: 4}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(ctx, target, targetDir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if n := requests.Load(); n != 4 {
+		t.Errorf("Expected no downloads to start after the cancellation, got %d", n)
+	}
+	if stats.Errors != 0 || stats.FilesDownloaded != 0 {
+		t.Errorf("Expected the downloads in flight to be abandoned, got %+v", stats)
+	}
+	matches, _ := filepath.Glob(filepath.Join(targetDir, config.TempFilePrefix+"*"))
+	if len(matches) != 0 {
+		t.Errorf("Expected no partial downloads, found %v", matches)
+	}
+}
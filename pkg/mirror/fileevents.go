@@ -0,0 +1,277 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// FileEventsDirName is the hidden directory of a target that holds the NDJSON file
+// events of its runs with Target.FileEvents
+const FileEventsDirName = config.MetadataPrefix + "events"
+
+// FileAction is what a run did to a file
+type FileAction string
+
+// Actions of file events
+const (
+	FileAdded   FileAction = "added"
+	FileUpdated FileAction = "updated"
+	FileDeleted FileAction = "deleted"
+)
+
+// FileEvent reports a file a run added, updated or deleted to the outputs of
+// Target.FileEvents
+type FileEvent struct {
+	Time   time.Time  `json:"time"`
+	Target string     `json:"target"`
+	RunID  string     `json:"runId"`
+	Action FileAction `json:"action"`
+	// Path is relative to the target directory, with forward slashes
+	Path string `json:"path"`
+	// Size and SHA256 describe the new content; both are empty for deletions
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// URL is where the file was downloaded from; empty for deletions
+	URL string `json:"url,omitempty"`
+}
+
+// finalDeliveryAttempts is how often the events left at the end of a run are
+// sent to a failing webhook before they are dropped
+const finalDeliveryAttempts = 3
+
+// fileEventStream delivers the file events of a run to the outputs of
+// Target.FileEvents. Events are appended to the run's file as they happen and
+// sent to the webhook in batches from a goroutine of their own, so a slow or
+// failing webhook never holds up the run: undelivered events wait in a bounded
+// queue and are dropped once it is full.
+type fileEventStream struct {
+	logger   *slog.Logger
+	target   string
+	runID    string
+	settings *config.FileEvents
+
+	// file receives the NDJSON lines, nil without FileEvents.File
+	fileMu sync.Mutex
+	file   *os.File
+
+	// client posts to the webhook at host, nil without FileEvents.WebhookURL
+	client *http.Client
+	host   string
+	// mu guards queue and the counters. wake asks the sender for a batch before
+	// the flush interval is over, stop ends it and stopped is closed once it has.
+	mu      sync.Mutex
+	queue   []FileEvent
+	sent    int64
+	dropped int64
+	failing bool
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newFileEventStream opens the outputs of settings for a run of target. An events
+// file that cannot be created is logged and left out rather than failing the run.
+func newFileEventStream(logger *slog.Logger, target *config.Target, targetDir, runID string, start time.Time) *fileEventStream {
+	settings := target.FileEvents
+	s := &fileEventStream{logger: logger, target: target.Name, runID: runID, settings: settings}
+	if settings.File {
+		dir := filepath.Join(targetDir, FileEventsDirName)
+		name := fmt.Sprintf("%s-%s.ndjson", start.UTC().Format("20060102T150405Z"), runID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			logger.Warn("Failed to create file events directory", "path", dir, "error", err)
+		} else if s.file, err = os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			logger.Warn("Failed to create file events file", "path", dir, "error", err)
+		}
+	}
+	if settings.WebhookURL != "" {
+		if u, err := url.Parse(settings.WebhookURL); err == nil {
+			s.host = u.Host
+		}
+		s.client = &http.Client{Timeout: target.GetTimeout()}
+		if s.client.Timeout <= 0 {
+			s.client.Timeout = 30 * time.Second
+		}
+		s.wake = make(chan struct{}, 1)
+		s.stop = make(chan struct{})
+		s.stopped = make(chan struct{})
+		go s.send()
+	}
+	return s
+}
+
+// add records event in the events file and queues it for the webhook
+func (s *fileEventStream) add(event FileEvent) {
+	event.Time, event.Target, event.RunID = time.Now().UTC(), s.target, s.runID
+	if s.file != nil {
+		line, _ := json.Marshal(event)
+		s.fileMu.Lock()
+		_, err := s.file.Write(append(line, '\n'))
+		s.fileMu.Unlock()
+		if err != nil {
+			s.logger.Warn("Failed to write file event", "path", s.file.Name(), "error", err)
+		}
+	}
+	if s.client == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) >= s.settings.GetQueueSize() {
+		s.dropped++
+		return
+	}
+	s.queue = append(s.queue, event)
+	if len(s.queue) >= s.settings.GetBatchSize() {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// send delivers the queued events in batches whenever a batch is full or the
+// flush interval is over, until stop is closed
+func (s *fileEventStream) send() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(s.settings.GetFlushInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+		// A failing webhook is tried again at the next tick
+		for s.flush(false) {
+		}
+	}
+}
+
+// flush posts the oldest batch of queued events and reports whether there are
+// more to send right away: a full batch, or any batch if all is set
+func (s *fileEventStream) flush(all bool) bool {
+	s.mu.Lock()
+	batch := s.queue[:min(len(s.queue), s.settings.GetBatchSize())]
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return false
+	}
+
+	if err := s.post(batch); err != nil {
+		s.mu.Lock()
+		if !s.failing {
+			s.logger.Warn("Failed to deliver file events, keeping them queued", "host", s.host,
+				"queued", len(s.queue), "error", err)
+		}
+		s.failing = true
+		s.mu.Unlock()
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		s.logger.Info("Delivering file events again", "host", s.host)
+	}
+	s.queue, s.sent, s.failing = s.queue[len(batch):], s.sent+int64(len(batch)), false
+	return len(s.queue) >= s.settings.GetBatchSize() || (all && len(s.queue) > 0)
+}
+
+// post sends batch to the webhook as a JSON array
+func (s *fileEventStream) post(batch []FileEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.settings.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// close delivers what is left of the queue, trying a failing webhook a few more
+// times before dropping the rest, closes the events file and returns the number
+// of events sent to and dropped for the webhook
+func (s *fileEventStream) close() (sent, dropped int64) {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			s.logger.Warn("Failed to write file events", "path", s.file.Name(), "error", err)
+		}
+	}
+	if s.client == nil {
+		return 0, 0
+	}
+
+	close(s.stop)
+	<-s.stopped
+	for attempt := 1; ; attempt++ {
+		for s.flush(true) {
+		}
+		s.mu.Lock()
+		left := len(s.queue)
+		s.mu.Unlock()
+		if left == 0 || attempt >= finalDeliveryAttempts {
+			break
+		}
+		time.Sleep(retryDelay(attempt, 0))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) > 0 {
+		s.logger.Warn("Dropping file events the webhook did not accept", "host", s.host,
+			"events", len(s.queue))
+		s.dropped += int64(len(s.queue))
+		s.queue = nil
+	}
+	return s.sent, s.dropped
+}
+
+// fileEvent reports what the run did to the file at localPath with
+// Target.FileEvents
+func (m *Manager) fileEvent(stats *MirrorStats, action FileAction, localPath, url string, size int64, sha256 string) {
+	if stats.fileEvents == nil {
+		return
+	}
+	rel, ok := stats.relPath(localPath)
+	if !ok {
+		return
+	}
+	stats.fileEvents.add(FileEvent{Action: action, Path: rel, Size: size, SHA256: sha256, URL: url})
+}
+
+// downloadAction tells a download that adds the file at localPath from one that
+// replaces a copy recorded by an earlier run
+func (stats *MirrorStats) downloadAction(localPath string) FileAction {
+	if rel, ok := stats.relPath(localPath); ok && stats.digests != nil {
+		if _, recorded := stats.digests.files[rel]; recorded {
+			return FileUpdated
+		}
+	}
+	return FileAdded
+}
@@ -0,0 +1,186 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// eventCollector is a webhook that records the events posted to it, failing the
+// first failures requests
+type eventCollector struct {
+	mu       sync.Mutex
+	events   []FileEvent
+	failures atomic.Int64
+}
+
+func (c *eventCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.failures.Add(-1) >= 0 {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var batch []FileEvent
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad batch", http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.events = append(c.events, batch...)
+	c.mu.Unlock()
+}
+
+// actions returns the action of the events per path
+func (c *eventCollector) actions() map[string]FileAction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	actions := make(map[string]FileAction)
+	for _, event := range c.events {
+		actions[event.Path] = event.Action
+	}
+	c.events = nil
+	return actions
+}
+
+func TestRunFileEvents(t *testing.T) {
+	var version atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			if version.Load() == 0 {
+				io.WriteString(w, `<a href="a.txt">a.txt</a><a href="sub/">sub/</a>`)
+			} else {
+				io.WriteString(w, `<a href="sub/">sub/</a>`)
+			}
+		case "/sub/":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="b.txt">b.txt</a>`)
+		case "/sub/b.txt":
+			content := "b"
+			if version.Load() > 0 {
+				content, modTime = "b, changed", modTime.Add(time.Hour)
+			}
+			http.ServeContent(w, r, "b.txt", modTime, strings.NewReader(content))
+		default:
+			http.ServeContent(w, r, "a.txt", modTime, strings.NewReader("a"))
+		}
+	}))
+	defer server.Close()
+	collector := &eventCollector{}
+	webhook := httptest.NewServer(collector)
+	defer webhook.Close()
+
+	dir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "events", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, CheckChanges: true, Prune: true,
+		FileEvents: &config.FileEvents{WebhookURL: webhook.URL, File: true, BatchSize: 1}}
+
+	stats, err := manager.Run(context.Background(), target, dir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FileEventsSent != 2 || stats.FileEventsDropped != 0 {
+		t.Errorf("Expected 2 events sent, got %+v", stats)
+	}
+	if actions := collector.actions(); actions["a.txt"] != FileAdded || actions["sub/b.txt"] != FileAdded || len(actions) != 2 {
+		t.Errorf("Expected both files added, got %v", actions)
+	}
+
+	// The second run updates one file and deletes the other
+	version.Store(1)
+	stats, err = manager.Run(context.Background(), target, dir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FileEventsSent != 2 {
+		t.Errorf("Expected 2 events sent, got %+v", stats)
+	}
+	if actions := collector.actions(); actions["a.txt"] != FileDeleted || actions["sub/b.txt"] != FileUpdated || len(actions) != 2 {
+		t.Errorf("Expected a.txt deleted and b.txt updated, got %v", actions)
+	}
+
+	// Every run has an events file of its own
+	files, err := filepath.Glob(filepath.Join(dir, FileEventsDirName, "*.ndjson"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected an events file per run, got %v (%v)", files, err)
+	}
+	var events []FileEvent
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event FileEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				t.Errorf("Invalid events line %q: %v", scanner.Text(), err)
+			}
+			events = append(events, event)
+		}
+		file.Close()
+	}
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events in the files, got %+v", events)
+	}
+	// Both runs may have started within the same second, which leaves the order of
+	// their files to the random run IDs
+	var added FileEvent
+	for _, event := range events {
+		if event.Path == "a.txt" && event.Action == FileAdded {
+			added = event
+		}
+	}
+	if added.Target != "events" || added.RunID == "" || added.Size != 1 || len(added.SHA256) != 64 || added.URL == "" {
+		t.Errorf("Expected the added file described, got %+v", added)
+	}
+}
+
+func TestFileEventStreamDelivery(t *testing.T) {
+	previous := listingRetryDelay
+	listingRetryDelay = time.Millisecond
+	t.Cleanup(func() { listingRetryDelay = previous })
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, tt := range []struct {
+		name        string
+		failures    int64
+		sent, drops int64
+	}{
+		{"recovering webhook", 2, 2, 1},
+		{"failing webhook", 100, 0, 3},
+	} {
+		collector := &eventCollector{}
+		collector.failures.Store(tt.failures)
+		webhook := httptest.NewServer(collector)
+
+		target := &config.Target{Name: "events", Timeout: 5,
+			FileEvents: &config.FileEvents{WebhookURL: webhook.URL, BatchSize: 10, FlushInterval: 3600, QueueSize: 2}}
+		stream := newFileEventStream(logger, target, t.TempDir(), "run", time.Now())
+		for _, path := range []string{"a", "b", "c"} {
+			stream.add(FileEvent{Action: FileAdded, Path: path})
+		}
+		sent, dropped := stream.close()
+		webhook.Close()
+		if sent != tt.sent || dropped != tt.drops {
+			t.Errorf("%s: expected %d sent and %d dropped, got %d and %d", tt.name, tt.sent, tt.drops, sent, dropped)
+		}
+		if actions := collector.actions(); int64(len(actions)) != tt.sent {
+			t.Errorf("%s: expected %d events delivered, got %v", tt.name, tt.sent, actions)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package mirror
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Filesystem compatibility modes for Mirror.FilesystemCompat
+const (
+	FilesystemCompatAuto     = "auto"
+	FilesystemCompatNative   = "native"
+	FilesystemCompatPortable = "portable"
+)
+
+// reservedWindowsNames are device names that cannot be used as file names on Windows,
+// regardless of extension
+var reservedWindowsNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// portableReservedChars are characters rejected by Windows, SMB and exFAT volumes
+const portableReservedChars = `<>:"|?*`
+
+// sanitizePortableName rewrites a single path segment so it can be created on
+// Windows and other restrictive filesystems
+func sanitizePortableName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(portableReservedChars, r) {
+			b.WriteRune('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	sanitized := b.String()
+
+	// Windows silently strips trailing dots and spaces, which would alias names
+	trimmed := strings.TrimRight(sanitized, ". ")
+	if trimmed != sanitized {
+		sanitized = trimmed + strings.Repeat("_", len(sanitized)-len(trimmed))
+	}
+
+	base := sanitized
+	if idx := strings.IndexByte(base, '.'); idx >= 0 {
+		base = base[:idx]
+	}
+	if reservedWindowsNames[strings.ToUpper(base)] {
+		sanitized = "_" + sanitized
+	}
+
+	return sanitized
+}
+
+// isCaseInsensitiveDir probes whether the filesystem holding dir folds case
+func isCaseInsensitiveDir(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".http-mirror-case-probe-")
+	if err != nil {
+		return false
+	}
+	probePath := probe.Name()
+	probe.Close()
+	defer os.Remove(probePath)
+
+	upper := filepath.Join(filepath.Dir(probePath), strings.ToUpper(filepath.Base(probePath)))
+	if upper == probePath {
+		return false
+	}
+
+	_, err = os.Stat(upper)
+	return err == nil
+}
+
+// resolveFilesystemCompat determines whether the portable naming policy applies to dir
+func resolveFilesystemCompat(mode, dir string) bool {
+	switch mode {
+	case FilesystemCompatPortable:
+		return true
+	case FilesystemCompatNative:
+		return false
+	default:
+		return runtime.GOOS == "windows" || isCaseInsensitiveDir(dir)
+	}
+}
+
+// localNames assigns on-disk names within each directory during a run. In portable mode
+// names are sanitized and names differing only by case are disambiguated so they
+// cannot overwrite each other on case-insensitive volumes.
+type localNames struct {
+	portable bool
+
+	mu   sync.Mutex
+	seen map[string]map[string]string // directory -> folded name -> remote name
+}
+
+// newLocalNames creates a name registry for a single run
+func newLocalNames(portable bool) *localNames {
+	return &localNames{
+		portable: portable,
+		seen:     make(map[string]map[string]string),
+	}
+}
+
+// resolve returns the local name to use for remoteName inside dir and whether it
+// had to be renamed because of a case collision
+func (n *localNames) resolve(dir, remoteName string) (string, bool) {
+	if n == nil || !n.portable {
+		return remoteName, false
+	}
+
+	name := sanitizePortableName(remoteName)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entries, ok := n.seen[dir]
+	if !ok {
+		entries = make(map[string]string)
+		n.seen[dir] = entries
+	}
+
+	candidate := name
+	for i := 1; ; i++ {
+		folded := foldName(candidate)
+		owner, taken := entries[folded]
+		if !taken || owner == remoteName {
+			entries[folded] = remoteName
+			return candidate, candidate != name
+		}
+		candidate = disambiguateName(name, i)
+	}
+}
+
+// foldName returns the case-folded form of a name used for collision detection
+func foldName(name string) string {
+	return strings.ToLower(strings.ToUpper(name))
+}
+
+// disambiguateName inserts a numeric suffix before the extension, e.g. "README~1.md"
+func disambiguateName(name string, n int) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return fmt.Sprintf("%s~%d%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// isWithinDir reports whether path is dir itself or located below it
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
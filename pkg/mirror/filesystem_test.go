@@ -0,0 +1,147 @@
+package mirror
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestSanitizePortableName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"normal.txt", "normal.txt"},
+		{"what?.txt", "what_.txt"},
+		{`a<b>c:d"e|f*g`, "a_b_c_d_e_f_g"},
+		{"tab\tname", "tab_name"},
+		{"trailing.", "trailing_"},
+		{"trailing  ", "trailing__"},
+		{"CON", "_CON"},
+		{"nul.txt", "_nul.txt"},
+		{"com1.tar.gz", "_com1.tar.gz"},
+		{"console.log", "console.log"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizePortableName(tt.name); got != tt.expected {
+			t.Errorf("sanitizePortableName(%q) = %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestLocalNamesCaseCollisions(t *testing.T) {
+	names := newLocalNames(true)
+	dir := filepath.Join("data", "target")
+
+	first, renamed := names.resolve(dir, "README.md")
+	if first != "README.md" || renamed {
+		t.Errorf("Expected README.md unchanged, got %q (renamed=%v)", first, renamed)
+	}
+
+	second, renamed := names.resolve(dir, "readme.md")
+	if second != "readme~1.md" || !renamed {
+		t.Errorf("Expected readme~1.md for colliding name, got %q (renamed=%v)", second, renamed)
+	}
+
+	third, _ := names.resolve(dir, "ReadMe.MD")
+	if third != "ReadMe~2.MD" {
+		t.Errorf("Expected ReadMe~2.MD for second collision, got %q", third)
+	}
+
+	// Seeing the same remote name again must yield the same local name
+	again, _ := names.resolve(dir, "readme.md")
+	if again != second {
+		t.Errorf("Expected stable name %q for repeated entry, got %q", second, again)
+	}
+
+	// Other directories have their own seen-set
+	other, renamed := names.resolve(filepath.Join(dir, "sub"), "readme.md")
+	if other != "readme.md" || renamed {
+		t.Errorf("Expected no collision in a different directory, got %q", other)
+	}
+}
+
+func TestLocalNamesNativeMode(t *testing.T) {
+	names := newLocalNames(false)
+
+	for _, remote := range []string{"README", "readme", "what?"} {
+		if got, renamed := names.resolve("dir", remote); got != remote || renamed {
+			t.Errorf("Native mode should keep %q unchanged, got %q", remote, got)
+		}
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	base := filepath.Join("data", "target")
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{base, true},
+		{filepath.Join(base, "file.txt"), true},
+		{filepath.Join(base, "sub", "file.txt"), true},
+		{filepath.Join("data", "target-other", "file.txt"), false},
+		{filepath.Join("data", "file.txt"), false},
+		{filepath.Join(base, "..", "escape.txt"), false},
+		{filepath.Join(base, "..foo"), true},
+	}
+
+	for _, tt := range tests {
+		if got := isWithinDir(base, tt.path); got != tt.expected {
+			t.Errorf("isWithinDir(%q, %q) = %v, expected %v", base, tt.path, got, tt.expected)
+		}
+	}
+}
+
+func TestMirrorTargetPortableCaseCollision(t *testing.T) {
+	responses := map[string]string{
+		"/":       `<html><body><a href="README">README</a><a href="readme">readme</a></body></html>`,
+		"/README": "upper",
+		"/readme": "lower",
+	}
+
+	server := createTestServer(t, responses)
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	target := &config.Target{
+		Name:         "test-target",
+		URL:          server.URL + "/",
+		UserAgent:    "Test Agent",
+		Timeout:      5,
+		MaxDepth:     1,
+		CheckChanges: false,
+	}
+
+	cfg := &config.Config{
+		Mirror: config.Mirror{
+			DataPath:         tempDir,
+			FilesystemCompat: FilesystemCompatPortable,
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	manager := NewManager(cfg, logger)
+
+	if err := manager.MirrorTarget(context.Background(), target); err != nil {
+		t.Fatalf("MirrorTarget failed: %v", err)
+	}
+
+	targetDir := filepath.Join(tempDir, "test-target")
+	for name, expected := range map[string]string{"README": "upper", "readme~1": "lower"} {
+		content, err := os.ReadFile(filepath.Join(targetDir, name))
+		if err != nil {
+			t.Errorf("Expected %s to exist: %v", name, err)
+			continue
+		}
+		if string(content) != expected {
+			t.Errorf("Expected %s to contain %q, got %q", name, expected, string(content))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// ErrTargetFrozen is returned for targets with config.Target.Frozen set. Frozen
+// targets keep being served but are neither mirrored nor cleaned up.
+var ErrTargetFrozen = errors.New("target is frozen")
+
+// skipFrozen records when target was first seen frozen in the state of targetDir
+// and returns the error that skips it
+func (m *Manager) skipFrozen(target *config.Target, targetDir string) error {
+	m.logger.Info("Skipping frozen target")
+
+	// Nothing to pin if the target was never mirrored
+	if _, err := os.Stat(targetDir); err != nil {
+		return fmt.Errorf("target %s: %w", target.Name, ErrTargetFrozen)
+	}
+
+	state, err := LoadTargetState(targetDir)
+	if err != nil {
+		m.logger.Warn("Discarding unreadable target state", "error", err)
+		state = &TargetState{Target: target.Name}
+	}
+	if state.FrozenAt.IsZero() {
+		state.FrozenAt = time.Now().UTC()
+		if err := saveTargetState(targetDir, state); err != nil {
+			m.logger.Warn("Failed to save target state", "error", err)
+		}
+	}
+	return fmt.Errorf("target %s: %w", target.Name, ErrTargetFrozen)
+}
@@ -0,0 +1,86 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunSkipsFrozenTarget(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="a.txt">a</a>`))
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	stale := filepath.Join(targetDir, config.TempFilePrefix+"old")
+	if err := os.WriteFile(stale, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "frozen", URL: server.URL + "/", MaxDepth: 1, Timeout: 5, Frozen: true}
+
+	if _, err := manager.Run(context.Background(), target, targetDir); !errors.Is(err, ErrTargetFrozen) {
+		t.Fatalf("Expected ErrTargetFrozen, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no upstream requests for a frozen target, got %d", requests)
+	}
+	if _, err := manager.CleanupTempFiles(context.Background(), target, targetDir, 0); !errors.Is(err, ErrTargetFrozen) {
+		t.Errorf("Expected cleanup to refuse a frozen target, got %v", err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("Expected files of a frozen target to be left alone: %v", err)
+	}
+
+	state, err := LoadTargetState(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frozenAt := state.FrozenAt
+	if frozenAt.IsZero() {
+		t.Fatal("Expected the freeze time to be recorded")
+	}
+
+	// Later skips keep the original freeze time
+	time.Sleep(10 * time.Millisecond)
+	manager.Run(context.Background(), target, targetDir)
+	if state, _ := LoadTargetState(targetDir); !state.FrozenAt.Equal(frozenAt) {
+		t.Errorf("Expected freeze time %v to be kept, got %v", frozenAt, state.FrozenAt)
+	}
+
+	// Unfreezing mirrors again and clears the freeze time
+	target.Frozen = false
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if state, _ := LoadTargetState(targetDir); !state.FrozenAt.IsZero() || !state.Synced() {
+		t.Errorf("Expected a synced state without freeze time, got %+v", state)
+	}
+}
+
+func TestRunFrozenTargetWithoutDirectory(t *testing.T) {
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	targetDir := filepath.Join(t.TempDir(), "missing")
+	target := &config.Target{Name: "frozen", URL: "http://example.com/", Frozen: true}
+
+	if _, err := manager.Run(context.Background(), target, targetDir); !errors.Is(err, ErrTargetFrozen) {
+		t.Fatalf("Expected ErrTargetFrozen, got %v", err)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Errorf("Expected no directory to be created for a frozen target, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// clampedTime records a future modification time a run clamped
+type clampedTime struct {
+	modTime  time.Time
+	upstream time.Time
+	etag     string
+}
+
+// TimeAuditStats summarizes a search for modification times in the future
+type TimeAuditStats struct {
+	// Files counts the files found with a modification time in the future, and
+	// Clamped those of them whose time was set to the time of the audit
+	Files   int64
+	Clamped int64
+}
+
+// clampedFiles returns the files of the manifest whose modification time was clamped
+func clampedFiles(manifest *Manifest) map[string]FileSource {
+	clamped := make(map[string]FileSource)
+	for rel, source := range manifest.Files {
+		if !source.UpstreamModTime.IsZero() {
+			clamped[rel] = source
+		}
+	}
+	return clamped
+}
+
+// inFuture reports whether modTime lies further than Mirror.FutureTimeTolerance
+// past now
+func (m *Manager) inFuture(modTime, now time.Time) bool {
+	tolerance := time.Duration(m.config.Mirror.FutureTimeTolerance) * time.Second
+	return tolerance > 0 && modTime.After(now.Add(tolerance))
+}
+
+// checkFutureTime reports the file at localPath if its modification time lies in
+// the future, which makes it look newer than any upstream change, and clamps the
+// time to now with Mirror.ClampFutureTimes. The upstream time and etag are kept in
+// the manifest. Only files on the local filesystem are clamped.
+func (m *Manager) checkFutureTime(stats *MirrorStats, localPath, etag string) {
+	stat, err := stats.fileStorage().Stat(localPath)
+	now := time.Now()
+	if err != nil || !m.inFuture(stat.ModTime, now) {
+		return
+	}
+	atomic.AddInt64(&stats.FutureModTimes, 1)
+
+	_, local := stats.fileStorage().(*storage.Local)
+	if !m.config.Mirror.ClampFutureTimes || !local {
+		m.logger.Warn("File modification time is in the future", "path", localPath, "modified", stat.ModTime)
+		return
+	}
+	if err := os.Chtimes(localPath, now, now); err != nil {
+		m.logger.Warn("Failed to clamp future modification time", "path", localPath, "error", err)
+		return
+	}
+	m.logger.Warn("Clamped future modification time", "path", localPath, "modified", stat.ModTime)
+
+	rel, ok := stats.relPath(localPath)
+	if !ok {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.clamps == nil {
+		stats.clamps = make(map[string]clampedTime)
+	}
+	stats.clamps[rel] = clampedTime{modTime: now.UTC(), upstream: stat.ModTime.UTC(), etag: etag}
+}
+
+// needsUpdate reports whether the file at localPath differs from remoteInfo,
+// preferring the ETag the manifest recorded for it over modification times. The
+// local modification time of a file whose future time was clamped says nothing about
+// the upstream, so such files are compared by ETag, or else by size and the
+// upstream modification time recorded for them.
+func (m *Manager) needsUpdate(client *httpPkg.Client, stats *MirrorStats, localPath string, remoteInfo *httpPkg.FileInfo) (bool, error) {
+	rel, ok := stats.relPath(localPath)
+	source, clamped := stats.clamped[rel]
+	if !ok || !clamped {
+		check, err := client.CheckUpdate(localPath, remoteInfo, stats.recordedETag(rel))
+		if check.Tolerated {
+			atomic.AddInt64(&stats.SkewTolerated, 1)
+			m.logger.Debug("Tolerating newer upstream modification time as clock skew", "path", localPath,
+				"upstream", remoteInfo.LastModified, "tolerance", client.GetConfig().GetMTimeTolerance())
+		}
+		return check.NeedsUpdate, err
+	}
+
+	stat, err := stats.fileStorage().Stat(localPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if remoteInfo.ETag != "" && source.ETag != "" {
+		return remoteInfo.ETag != source.ETag, nil
+	}
+	if remoteInfo.Size > 0 && stat.Size != remoteInfo.Size {
+		return true, nil
+	}
+	return !remoteInfo.LastModified.IsZero() && !remoteInfo.LastModified.Equal(source.UpstreamModTime), nil
+}
+
+// AuditTimes reports the files below targetDir whose modification time lies beyond
+// Mirror.FutureTimeTolerance in the future, e.g. in data taken over from a
+// clock-skewed upstream. With Mirror.ClampFutureTimes their times are set to the
+// time of the audit and the upstream times recorded in the manifest, as a run would.
+// Files of frozen targets are only reported.
+func (m *Manager) AuditTimes(ctx context.Context, target *config.Target, targetDir string) (*TimeAuditStats, error) {
+	m = m.forTarget(target.Name)
+	stats := &TimeAuditStats{}
+	clamp := m.config.Mirror.ClampFutureTimes && !target.Frozen
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		return stats, err
+	}
+	now := time.Now()
+
+	walkErr := filepath.WalkDir(targetDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// Skip mirror metadata, temporary files and other hidden entries
+		if path != targetDir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !m.inFuture(info.ModTime(), now) {
+			return nil
+		}
+		stats.Files++
+		m.logger.Warn("File modification time is in the future", "path", path, "modified", info.ModTime())
+		if !clamp {
+			return nil
+		}
+
+		rel, err := filepath.Rel(targetDir, path)
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, now, now); err != nil {
+			return fmt.Errorf("failed to clamp %s: %w", path, err)
+		}
+		source := manifest.Files[filepath.ToSlash(rel)]
+		source.Size, source.ModTime, source.UpstreamModTime = info.Size(), now.UTC(), info.ModTime().UTC()
+		manifest.Files[filepath.ToSlash(rel)] = source
+		stats.Clamped++
+		return nil
+	})
+
+	// Keep what was clamped so far, also when interrupted
+	if stats.Clamped > 0 {
+		if err := saveManifest(targetDir, manifest); err != nil && walkErr == nil {
+			walkErr = err
+		}
+	}
+	if walkErr != nil {
+		return stats, fmt.Errorf("failed to audit %s: %w", targetDir, walkErr)
+	}
+	m.logger.Info("Modification time audit completed", "files", stats.Files, "clamped", stats.Clamped)
+	return stats, nil
+}
@@ -0,0 +1,188 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunClampsFutureModTimes(t *testing.T) {
+	future := time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="a.txt">a.txt</a>`)
+			return
+		}
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(w, r, "a.txt", future, strings.NewReader("content"))
+	}))
+	defer server.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, clamp := range []bool{false, true} {
+		etag.Store(`"v1"`)
+		dir := t.TempDir()
+		manager := NewManager(&config.Config{Mirror: config.Mirror{FutureTimeTolerance: 3600, ClampFutureTimes: clamp}}, logger)
+		target := &config.Target{Name: "skewed", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, CheckChanges: true}
+
+		stats, err := manager.Run(context.Background(), target, dir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if stats.FutureModTimes != 1 {
+			t.Errorf("Clamp %t: expected the file to be counted, got %+v", clamp, stats)
+		}
+		info, err := os.Stat(filepath.Join(dir, "a.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clamped := info.ModTime().Before(future); clamped != clamp {
+			t.Errorf("Clamp %t: unexpected modification time %v", clamp, info.ModTime())
+		}
+		manifest, _ := LoadManifest(dir)
+		source, _ := manifest.Lookup("a.txt")
+		if clamp && (!source.UpstreamModTime.Equal(future) || source.ETag != `"v1"` || !source.ModTime.Equal(info.ModTime().UTC())) {
+			t.Errorf("Expected the upstream time and ETag kept in the manifest, got %+v", source)
+		}
+		if !clamp && !source.UpstreamModTime.IsZero() {
+			t.Errorf("Expected no upstream time without clamping, got %+v", source)
+		}
+
+		// A clamped file is found again only if its time was left as it is
+		stats, err = manager.Run(context.Background(), target, dir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if expected := map[bool]int64{false: 1, true: 0}[clamp]; stats.FutureModTimes != expected || stats.FilesDownloaded != 0 {
+			t.Errorf("Clamp %t: expected the unchanged file skipped and %d future times, got %+v", clamp, expected, stats)
+		}
+
+		// A file that changed without a newer time is only noticed by its ETag
+		etag.Store(`"v2"`)
+		stats, err = manager.Run(context.Background(), target, dir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if downloaded := stats.FilesDownloaded == 1; downloaded != clamp {
+			t.Errorf("Clamp %t: expected the changed file downloaded %t, got %+v", clamp, clamp, stats)
+		}
+	}
+}
+
+func TestRunToleratesClockSkew(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var upstream atomic.Value
+	serve := func(offset time.Duration, etag string) {
+		upstream.Store([2]string{modTime.Add(offset).Format(time.RFC3339), etag})
+	}
+	serve(0, `"v1"`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="a.txt">a.txt</a>`)
+			return
+		}
+		current := upstream.Load().([2]string)
+		if current[1] != "" {
+			w.Header().Set("ETag", current[1])
+		}
+		served, _ := time.Parse(time.RFC3339, current[0])
+		http.ServeContent(w, r, "a.txt", served, strings.NewReader("content"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "balanced", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, CheckChanges: true}
+	if _, err := manager.Run(context.Background(), target, dir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	manifest, _ := LoadManifest(dir)
+	if source, _ := manifest.Lookup("a.txt"); source.ETag != `"v1"` {
+		t.Fatalf("Expected the ETag recorded in the manifest, got %+v", source)
+	}
+
+	tests := []struct {
+		name       string
+		offset     time.Duration
+		etag       string
+		downloaded int64
+		tolerated  int64
+	}{
+		{name: "skewed node", offset: 2 * time.Second, tolerated: 1},
+		{name: "unchanged etag", offset: time.Hour, etag: `"v1"`},
+		{name: "changed", offset: time.Hour, etag: `"v2"`, downloaded: 1},
+	}
+	for _, tt := range tests {
+		serve(tt.offset, tt.etag)
+		stats, err := manager.Run(context.Background(), target, dir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if stats.FilesDownloaded != tt.downloaded || stats.SkewTolerated != tt.tolerated {
+			t.Errorf("%s: expected %d downloads and %d tolerated, got %d and %d",
+				tt.name, tt.downloaded, tt.tolerated, stats.FilesDownloaded, stats.SkewTolerated)
+		}
+	}
+}
+
+func TestAuditTimes(t *testing.T) {
+	future := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name    string
+		clamp   bool
+		frozen  bool
+		clamped int64
+	}{
+		{"reports only", false, false, 0},
+		{"clamps", true, false, 1},
+		{"frozen targets are only reported", true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range []string{"future.txt", "current.txt", config.MetadataPrefix + "state"} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range []string{"future.txt", config.MetadataPrefix + "state"} {
+				os.Chtimes(filepath.Join(dir, name), future, future)
+			}
+
+			manager := NewManager(&config.Config{Mirror: config.Mirror{FutureTimeTolerance: 86400, ClampFutureTimes: tt.clamp}}, logger)
+			stats, err := manager.AuditTimes(context.Background(), &config.Target{Name: "audit", Frozen: tt.frozen}, dir)
+			if err != nil {
+				t.Fatalf("Audit failed: %v", err)
+			}
+			if stats.Files != 1 || stats.Clamped != tt.clamped {
+				t.Errorf("Expected 1 file and %d clamped, got %+v", tt.clamped, stats)
+			}
+
+			info, _ := os.Stat(filepath.Join(dir, "future.txt"))
+			if clamped := info.ModTime().Before(future); clamped != (tt.clamped > 0) {
+				t.Errorf("Unexpected modification time %v", info.ModTime())
+			}
+			manifest, _ := LoadManifest(dir)
+			source, ok := manifest.Lookup("future.txt")
+			if ok != (tt.clamped > 0) || ok && !source.UpstreamModTime.Equal(future) {
+				t.Errorf("Expected the upstream time recorded only when clamped, got %+v", source)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package mirror
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// hostSlot enforces the politeness policy for a single upstream host
+type hostSlot struct {
+	gap time.Duration
+	sem chan struct{} // nil means unlimited concurrency
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// hostCoordinator serializes requests to upstream hosts that are shared by several
+// targets in one process, so that together they respect a combined minimum gap and
+// an optional concurrency cap. Hosts used by a single target without an explicit
+// override are not coordinated and keep the per-target WaitBetweenRequests behavior.
+type hostCoordinator struct {
+	slots map[string]*hostSlot
+}
+
+// newHostCoordinator builds the coordinator from the configured targets and host overrides
+func newHostCoordinator(cfg *config.Config) *hostCoordinator {
+	c := &hostCoordinator{
+		slots: make(map[string]*hostSlot),
+	}
+	if cfg == nil {
+		return c
+	}
+
+	// Group targets by host and derive the combined gap from the politest target
+	targetsPerHost := make(map[string]int)
+	gapPerHost := make(map[string]time.Duration)
+	for i := range cfg.Targets {
+		host := hostKey(cfg.Targets[i].URL)
+		if host == "" {
+			continue
+		}
+		targetsPerHost[host]++
+		if wait := cfg.Targets[i].GetWaitDuration(); wait > gapPerHost[host] {
+			gapPerHost[host] = wait
+		}
+	}
+
+	for host, count := range targetsPerHost {
+		if count > 1 {
+			c.slots[host] = &hostSlot{gap: gapPerHost[host]}
+		}
+	}
+
+	// Explicit overrides always apply, even for single-target hosts
+	for _, policy := range cfg.Mirror.Hosts {
+		host := strings.ToLower(policy.Host)
+		if host == "" {
+			continue
+		}
+
+		slot := &hostSlot{gap: gapPerHost[host]}
+		switch {
+		case policy.WaitBetweenRequests < 0:
+			slot.gap = 0
+		case policy.WaitBetweenRequests > 0:
+			slot.gap = time.Duration(policy.WaitBetweenRequests) * time.Second
+		}
+		if policy.MaxConcurrency > 0 {
+			slot.sem = make(chan struct{}, policy.MaxConcurrency)
+		}
+		c.slots[host] = slot
+	}
+
+	return c
+}
+
+// coordinates reports whether requests to rawURL are subject to host coordination
+func (c *hostCoordinator) coordinates(rawURL string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.slots[hostKey(rawURL)]
+	return ok
+}
+
+// acquire waits until a request to rawURL is allowed by the host policy. The returned
+// release function must be called once the request (including its body) is finished.
+func (c *hostCoordinator) acquire(ctx context.Context, rawURL string) (func(), error) {
+	noop := func() {}
+	if c == nil {
+		return noop, nil
+	}
+
+	slot, ok := c.slots[hostKey(rawURL)]
+	if !ok {
+		return noop, nil
+	}
+
+	if slot.sem != nil {
+		select {
+		case slot.sem <- struct{}{}:
+		case <-ctx.Done():
+			return noop, ctx.Err()
+		}
+	}
+
+	release := func() {}
+	if slot.sem != nil {
+		var once sync.Once
+		release = func() {
+			once.Do(func() { <-slot.sem })
+		}
+	}
+
+	if err := slot.delay(ctx); err != nil {
+		release()
+		return noop, err
+	}
+	return release, nil
+}
+
+// delay waits until the slot allows the next request to start, at least gap after
+// the previous one. The first request starts immediately; a nil slot never waits.
+func (s *hostSlot) delay(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	// Reserve the next start time so concurrent callers queue up behind each other
+	s.mu.Lock()
+	now := time.Now()
+	start := s.next
+	if start.Before(now) {
+		start = now
+	}
+	s.next = start.Add(s.gap)
+	s.mu.Unlock()
+
+	wait := time.Until(start)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hostKey returns the lower-cased host[:port] of a URL, or "" if it cannot be parsed
+func hostKey(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Host)
+}
@@ -0,0 +1,159 @@
+package mirror
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestHostCoordinatorSingleTargetIsNoop(t *testing.T) {
+	cfg := &config.Config{
+		Targets: []config.Target{
+			{Name: "a", URL: "http://upstream.example.com/a/", WaitBetweenRequests: 5},
+			{Name: "b", URL: "http://other.example.com/b/", WaitBetweenRequests: 5},
+		},
+	}
+
+	coordinator := newHostCoordinator(cfg)
+	if coordinator.coordinates("http://upstream.example.com/a/file") {
+		t.Error("Host used by a single target should not be coordinated")
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := coordinator.acquire(context.Background(), "http://upstream.example.com/a/file")
+		if err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+		release()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Uncoordinated acquires should not wait, took %v", elapsed)
+	}
+}
+
+func TestHostCoordinatorSharedHost(t *testing.T) {
+	cfg := &config.Config{
+		Targets: []config.Target{
+			{Name: "a", URL: "http://Upstream.example.com/a/", WaitBetweenRequests: 1},
+			{Name: "b", URL: "http://upstream.example.com/b/", WaitBetweenRequests: 3},
+		},
+	}
+
+	coordinator := newHostCoordinator(cfg)
+	if !coordinator.coordinates("http://upstream.example.com/c/file") {
+		t.Fatal("Host shared by two targets should be coordinated")
+	}
+
+	slot := coordinator.slots["upstream.example.com"]
+	if slot.gap != 3*time.Second {
+		t.Errorf("Expected combined gap of the politest target (3s), got %v", slot.gap)
+	}
+}
+
+func TestHostCoordinatorOverrides(t *testing.T) {
+	cfg := &config.Config{
+		Targets: []config.Target{
+			{Name: "a", URL: "http://internal.example.com/a/", WaitBetweenRequests: 2},
+			{Name: "b", URL: "http://internal.example.com/b/", WaitBetweenRequests: 2},
+		},
+		Mirror: config.Mirror{
+			Hosts: []config.HostPolicy{
+				{Host: "internal.example.com", WaitBetweenRequests: -1},
+				{Host: "slow.example.com", MaxConcurrency: 2},
+			},
+		},
+	}
+
+	coordinator := newHostCoordinator(cfg)
+
+	if gap := coordinator.slots["internal.example.com"].gap; gap != 0 {
+		t.Errorf("Expected override to disable the gap, got %v", gap)
+	}
+
+	slow := coordinator.slots["slow.example.com"]
+	if slow == nil || cap(slow.sem) != 2 {
+		t.Fatal("Expected override to create a concurrency-limited slot for a single-target host")
+	}
+}
+
+func TestHostCoordinatorEnforcesGap(t *testing.T) {
+	coordinator := &hostCoordinator{
+		slots: map[string]*hostSlot{"upstream.example.com": {gap: 50 * time.Millisecond}},
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := coordinator.acquire(context.Background(), "http://upstream.example.com/file")
+		if err != nil {
+			t.Fatalf("acquire failed: %v", err)
+		}
+		release()
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected at least two gaps between three requests, took %v", elapsed)
+	}
+}
+
+func TestHostCoordinatorConcurrencyLimit(t *testing.T) {
+	coordinator := &hostCoordinator{
+		slots: map[string]*hostSlot{"upstream.example.com": {sem: make(chan struct{}, 1)}},
+	}
+
+	release, err := coordinator.acquire(context.Background(), "http://upstream.example.com/a")
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	// A second request must wait for the first to be released
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := coordinator.acquire(ctx, "http://upstream.example.com/b"); err == nil {
+		t.Error("Expected second acquire to block until the context expired")
+	}
+
+	release()
+	release() // releasing twice must not free an extra slot
+
+	second, err := coordinator.acquire(context.Background(), "http://upstream.example.com/b")
+	if err != nil {
+		t.Fatalf("acquire after release failed: %v", err)
+	}
+	defer second()
+
+	if len(coordinator.slots["upstream.example.com"].sem) != 1 {
+		t.Error("Expected exactly one slot in use")
+	}
+}
+
+func TestHostSlotDelay(t *testing.T) {
+	slot := &hostSlot{gap: time.Hour}
+
+	// The first request of a run is not delayed
+	start := time.Now()
+	if err := slot.delay(context.Background()); err != nil {
+		t.Fatalf("First delay failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected first request to start immediately, waited %v", elapsed)
+	}
+
+	// A pending wait ends as soon as the context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := slot.delay(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected cancellation to end the wait, waited %v", elapsed)
+	}
+
+	var nilSlot *hostSlot
+	if err := nilSlot.delay(context.Background()); err != nil {
+		t.Errorf("Expected nil slot not to wait, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// ListingNginxJSON is the format of listings served by nginx with
+// "autoindex_format json"
+const ListingNginxJSON = "nginx-json"
+
+// Target.ListingFormat values
+const (
+	listingFormatAuto      = "auto"
+	listingFormatHTML      = "html"
+	listingFormatNginxJSON = "nginx-json"
+)
+
+// nginxJSONEntry is an element of the array nginx serves as a JSON listing
+type nginxJSONEntry struct {
+	Name string `json:"name"`
+	// Type is "directory", "file" or "other"
+	Type string `json:"type"`
+	// MTime is in HTTP date format
+	MTime string `json:"mtime"`
+	// Size is only set for files
+	Size *int64 `json:"size"`
+}
+
+// isJSONListing reports whether the response to a listing request for rawURL
+// is an nginx JSON listing: always with Target.ListingFormat "nginx-json", and in
+// auto mode for JSON served for directory URLs, so that JSON files are not taken
+// for listings
+func isJSONListing(target *config.Target, rawURL, contentType string) bool {
+	switch target.ListingFormat {
+	case listingFormatNginxJSON:
+		return true
+	case listingFormatHTML:
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" {
+		return false
+	}
+	parsed, err := url.Parse(rawURL)
+	return err == nil && strings.HasSuffix(parsed.Path, "/")
+}
+
+// parseJSONListing decodes an nginx JSON listing. Names become links as an HTML
+// listing would print them, so that they take the same path through filtering,
+// recursion and change detection; the sizes and times are exact to the second.
+// The array is decoded one entry at a time.
+func (m *Manager) parseJSONListing(resp *http.Response, baseURL string) (*listingResult, error) {
+	maxBytes := m.maxListingBytes()
+	counter := &countingReader{r: resp.Body}
+	if maxBytes > 0 {
+		counter.r = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	parseError := func(err error) error {
+		if maxBytes > 0 && counter.n > maxBytes {
+			err = fmt.Errorf("%w (%d bytes)", errListingTooLarge, maxBytes)
+		}
+		return &ListingParseError{URL: baseURL, Err: err}
+	}
+
+	result := &listingResult{Format: ListingNginxJSON}
+	decoder := json.NewDecoder(counter)
+	if token, err := decoder.Token(); err != nil {
+		return nil, parseError(err)
+	} else if token != json.Delim('[') {
+		return nil, &ListingParseError{URL: baseURL, Err: fmt.Errorf("expected a JSON array, got %v", token)}
+	}
+	for decoder.More() {
+		var entry nginxJSONEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, parseError(err)
+		}
+		result.Anchors++
+		link, ok := nginxJSONLink(entry)
+		if !ok {
+			continue
+		}
+		if filtered, ok := filterListingLink(link); ok {
+			result.Links = append(result.Links, filtered)
+			result.Entries = append(result.Entries, nginxJSONMetadata(entry))
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, parseError(err)
+	}
+	return result, nil
+}
+
+// nginxJSONLink returns the relative link to an entry; entries that are neither
+// files nor directories are skipped
+func nginxJSONLink(entry nginxJSONEntry) (string, bool) {
+	if entry.Name == "" || strings.Contains(entry.Name, "/") {
+		return "", false
+	}
+	link := escapeLinkName(entry.Name)
+	switch entry.Type {
+	case "directory":
+		return link + "/", true
+	case "file":
+		return link, true
+	}
+	return "", false
+}
+
+// nginxJSONMetadata returns the size and modification time of an entry
+func nginxJSONMetadata(entry nginxJSONEntry) listingEntry {
+	metadata := listingEntry{Size: -1}
+	if entry.Size != nil && entry.Type == "file" {
+		metadata.Size = *entry.Size
+	}
+	if modTime, err := http.ParseTime(entry.MTime); err == nil {
+		metadata.modTime, metadata.precision = modTime.Unix(), time.Second
+	}
+	return metadata
+}
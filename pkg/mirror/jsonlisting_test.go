@@ -0,0 +1,169 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestParseJSONListing(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "nginx-listing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	resp := &http.Response{Body: io.NopCloser(strings.NewReader(string(data)))}
+
+	listing, err := manager.parseJSONListing(resp, "http://example.com/pub/")
+	if err != nil {
+		t.Fatalf("parseJSONListing failed: %v", err)
+	}
+	if listing.Format != ListingNginxJSON || listing.Anchors != 6 {
+		t.Errorf("Expected 6 nginx JSON entries, got %d in format %q", listing.Anchors, listing.Format)
+	}
+	wantLinks := []string{"pool/", "%E6%97%A5%E6%9C%AC%E8%AA%9E/", "%C3%9Cbersicht%202024.pdf", "release%231%3Afinal.iso", "empty.txt"}
+	if strings.Join(listing.Links, " ") != strings.Join(wantLinks, " ") {
+		t.Errorf("Expected links %v, got %v", wantLinks, listing.Links)
+	}
+	for i, name := range []string{"pool", "日本語", "Übersicht 2024.pdf", "release#1:final.iso", "empty.txt"} {
+		if got := linkName(strings.TrimSuffix(linkPath(listing.Links[i]), "/")); got != name {
+			t.Errorf("Expected link %q to name %q, got %q", listing.Links[i], name, got)
+		}
+	}
+
+	entries := listingEntries(listing.Links, listing.Entries)
+	pdf := entries["%C3%9Cbersicht%202024.pdf"]
+	if pdf.Size != 48213 || pdf.sizeSlack != 0 || pdf.precision != time.Second ||
+		!pdf.ModTime().Equal(time.Date(2024, time.June, 4, 10, 10, 30, 0, time.UTC)) {
+		t.Errorf("Unexpected metadata for the PDF: %+v", pdf)
+	}
+	if iso := entries["release%231%3Afinal.iso"]; iso.Size != 3221225472 {
+		t.Errorf("Expected the size of the ISO, got %d", iso.Size)
+	}
+	if empty := entries["empty.txt"]; empty.Size != 0 || !empty.hasMetadata() {
+		t.Errorf("Expected an empty file with metadata, got %+v", empty)
+	}
+	if pool := entries["pool/"]; pool.Size != -1 {
+		t.Errorf("Expected no size for a directory, got %d", pool.Size)
+	}
+}
+
+func TestParseJSONListingErrors(t *testing.T) {
+	manager := NewManager(&config.Config{Mirror: config.Mirror{MaxResponseBytes: "64"}},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"object", `{"name":"a"}`},
+		{"truncated", `[{"name":"a","type":"file"`},
+		{"too large", `[` + strings.Repeat(`{"name":"a","type":"file"},`, 10) + `{}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(tt.body))}
+			_, err := manager.parseJSONListing(resp, "http://example.com/")
+			var parseErr *ListingParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("Expected a ListingParseError, got %v", err)
+			}
+			if tt.name == "too large" && !errors.Is(err, errListingTooLarge) {
+				t.Errorf("Expected errListingTooLarge, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIsJSONListing(t *testing.T) {
+	tests := []struct {
+		format, url, contentType string
+		want                     bool
+	}{
+		{"", "http://a/pub/", "application/json", true},
+		{"auto", "http://a/pub/", "application/json; charset=utf-8", true},
+		{"", "http://a/pub/data.json", "application/json", false},
+		{"", "http://a/pub/", "text/html", false},
+		{"html", "http://a/pub/", "application/json", false},
+		{"nginx-json", "http://a/pub/", "text/plain", true},
+	}
+	for _, tt := range tests {
+		target := &config.Target{ListingFormat: tt.format}
+		if got := isJSONListing(target, tt.url, tt.contentType); got != tt.want {
+			t.Errorf("isJSONListing(%q, %q, %q) = %v, expected %v", tt.format, tt.url, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestRunNginxJSONListing(t *testing.T) {
+	modTime := time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC)
+	mtime := modTime.Format(http.TimeFormat)
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	accepts := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		accepts[r.URL.Path] = r.Header.Get("Accept")
+		mu.Unlock()
+		w.Header().Set("Last-Modified", mtime)
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"name":"日本語","type":"directory","mtime":"` + mtime + `"},` +
+				`{"name":"a b.txt","type":"file","mtime":"` + mtime + `","size":3}]`))
+		case "/日本語/":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"name":"data.json","type":"file","mtime":"` + mtime + `","size":2}]`))
+		case "/日本語/data.json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("abc"))
+		}
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "json", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, CheckChanges: true,
+		ListingFormat: "nginx-json"}
+	targetDir := t.TempDir()
+
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for name, content := range map[string]string{"a b.txt": "abc", "日本語/data.json": "{}"} {
+		if data, err := os.ReadFile(filepath.Join(targetDir, name)); err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if accepts["/"] != "application/json" {
+		t.Errorf("Expected listings to be requested as JSON, got Accept %q", accepts["/"])
+	}
+
+	// Unchanged files are told apart by the listing without file info requests
+	mu.Lock()
+	clear(requests)
+	mu.Unlock()
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if requests["HEAD /a b.txt"] != 0 || requests["HEAD /日本語/data.json"] != 0 {
+		t.Errorf("Expected no file info requests, got %v", requests)
+	}
+	if stats.FilesCheckedByListing != 2 || stats.ListingsByFormat[ListingNginxJSON] != 2 {
+		t.Errorf("Expected 2 files checked by 2 JSON listings, got %d and %v", stats.FilesCheckedByListing, stats.ListingsByFormat)
+	}
+}
@@ -0,0 +1,415 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxLinkLength bounds the length of a listing link; longer hrefs are dropped
+const maxLinkLength = 16 * 1024
+
+// errListingTooLarge is returned when a listing exceeds Mirror.MaxResponseBytes
+var errListingTooLarge = errors.New("directory listing exceeds maximum response size")
+
+// Listing formats attributed by detectListingFormat
+const (
+	ListingApache   = "apache"
+	ListingNginx    = "nginx"
+	ListingLighttpd = "lighttpd"
+	ListingGeneric  = "generic"
+)
+
+// listingSniffBytes is how much of a listing is kept for format detection
+const listingSniffBytes = 4096
+
+// listingResult is the outcome of parsing one directory listing
+type listingResult struct {
+	// Links are the hrefs that passed filtering and will be followed
+	Links []string
+	// Entries describe Links in the same order, with the size and modification
+	// time the listing printed next to them where it could be parsed
+	Entries []listingEntry
+	// Anchors is the number of hrefs found before filtering; zero means the page has
+	// no recognizable listing at all, e.g. because it is rendered by JavaScript
+	Anchors int
+	// Format is the detected listing generator
+	Format string
+}
+
+// parseDirectoryListing parses HTML directory listing to extract links. The body is
+// tokenized as it streams in so memory use does not grow with the listing size.
+// With sameHost, absolute URLs below the listing's directory on its own host are
+// followed like relative links, see Target.FollowAbsoluteSameHost.
+func (m *Manager) parseDirectoryListing(resp *http.Response, baseURL string, sameHost bool) (*listingResult, error) {
+	result := &listingResult{}
+	head := &sniffBuffer{limit: listingSniffBytes}
+	var base *url.URL
+	if sameHost {
+		base, _ = url.Parse(baseURL)
+	}
+
+	err := scanListingLinks(io.TeeReader(resp.Body, head), m.maxListingBytes(), func(link, trailing string) {
+		result.Anchors++
+		link = sameHostLink(base, link)
+		if filtered, ok := filterListingLink(link); ok {
+			result.Links = append(result.Links, filtered)
+			result.Entries = append(result.Entries, parseListingEntry(trailing))
+		}
+	})
+	if err != nil {
+		return nil, &ListingParseError{URL: baseURL, Err: err}
+	}
+
+	result.Format = detectListingFormat(resp.Header.Get("Server"), head.buf)
+	return result, nil
+}
+
+// recordListing counts the outcome of a parsed listing in the run statistics
+func (m *Manager) recordListing(stats *MirrorStats, rawURL string, listing *listingResult) {
+	if stats.ListingsByFormat != nil {
+		stats.ListingsByFormat[listing.Format]++
+	}
+	if len(listing.Links) == 0 {
+		stats.EmptyListings++
+	}
+	if listing.Anchors == 0 {
+		stats.UnrecognizedListings++
+	}
+
+	m.logger.Debug("Parsed directory listing", "url", rawURL, "format", listing.Format,
+		"anchors", listing.Anchors, "linkCount", len(listing.Links))
+}
+
+// sniffBuffer keeps the first limit bytes written to it and discards the rest
+type sniffBuffer struct {
+	buf   []byte
+	limit int
+}
+
+// Write implements io.Writer
+func (b *sniffBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - len(b.buf); room > 0 {
+		b.buf = append(b.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// detectListingFormat attributes a listing to the server that generated it, using
+// the markup of the first bytes and falling back to the Server header
+func detectListingFormat(server string, head []byte) string {
+	switch {
+	case bytes.Contains(head, []byte("?C=N;O=D")) || bytes.Contains(head, []byte("?C=M;O=A")):
+		// Apache autoindex sort links
+		return ListingApache
+	case bytes.Contains(head, []byte(`summary="Directory Listing"`)):
+		return ListingLighttpd
+	case bytes.Contains(head, []byte("<hr><pre>")) && bytes.Contains(head, []byte("<h1>Index of")):
+		return ListingNginx
+	}
+
+	server = strings.ToLower(server)
+	switch {
+	case strings.HasPrefix(server, "apache"):
+		return ListingApache
+	case strings.HasPrefix(server, "nginx"):
+		return ListingNginx
+	case strings.HasPrefix(server, "lighttpd"):
+		return ListingLighttpd
+	}
+	return ListingGeneric
+}
+
+// maxListingBytes returns the configured listing size cap, or 0 for unlimited
+func (m *Manager) maxListingBytes() int64 {
+	if m.config == nil {
+		return 0
+	}
+	return httpPkg.ParseSize(m.config.Mirror.MaxResponseBytes)
+}
+
+// scanListingLinks streams body and calls fn for the HTML-unescaped href of every
+// <a> element outside the document head; hrefs in scripts, styles and comments are
+// not links. trailing is the text following the element up to the end of its line
+// or table row, where autoindex pages print the size and modification time. At
+// most maxBytes are read (0 means unlimited); larger listings yield
+// errListingTooLarge.
+func scanListingLinks(body io.Reader, maxBytes int64, fn func(link, trailing string)) error {
+	counter := &countingReader{r: body}
+	if maxBytes > 0 {
+		counter.r = io.LimitReader(body, maxBytes+1)
+	}
+
+	tokenizer := html.NewTokenizer(counter)
+	inHead, inAnchor, inRow := false, false, false
+	row := &trailingText{}
+	flush := func() {
+		if link, ok := row.take(); ok {
+			fn(link, row.String())
+		}
+	}
+	for {
+		tokenType := tokenizer.Next()
+		if maxBytes > 0 && counter.n > maxBytes {
+			return fmt.Errorf("%w (%d bytes)", errListingTooLarge, maxBytes)
+		}
+
+		switch tokenType {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return err
+			}
+			flush()
+			return nil
+		case html.TextToken:
+			if inAnchor {
+				continue
+			}
+			// Rows of <pre> listings end with the line, rows of tables with </tr>
+			text, _, newline := bytes.Cut(tokenizer.Text(), []byte("\n"))
+			row.write(text)
+			if newline && !inRow {
+				flush()
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch atom.Lookup(name) {
+			case atom.Head:
+				inHead = false
+			case atom.A:
+				inAnchor = false
+			case atom.Tr:
+				inRow = false
+				flush()
+			}
+			row.space()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch atom.Lookup(name) {
+			case atom.Head:
+				inHead = true
+			case atom.Body:
+				inHead = false
+			case atom.Tr:
+				flush()
+				inRow = true
+			case atom.A:
+				for hasAttr && !inHead {
+					var key, val []byte
+					key, val, hasAttr = tokenizer.TagAttr()
+					if string(key) == "href" && len(val) > 0 && len(val) <= maxLinkLength {
+						flush()
+						row.start(string(val))
+						inAnchor = tokenType == html.StartTagToken
+						break
+					}
+				}
+			}
+			row.space()
+		}
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// filterListingLink applies the link filtering rules to a raw href and reports
+// whether the link should be mirrored
+func filterListingLink(link string) (string, bool) {
+	// Skip certain links (security: prevent various types of malicious links)
+	if strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") ||
+		strings.HasPrefix(link, "mailto:") || strings.HasPrefix(link, "ftp://") ||
+		strings.HasPrefix(link, "javascript:") || strings.HasPrefix(link, "data:") || strings.HasPrefix(link, "vbscript:") ||
+		strings.HasPrefix(link, "#") || link == "/" || link == "./" {
+		return "", false
+	}
+
+	// Only the path of a link names a file; its query string may hold anything
+	pathPart := linkPath(link)
+
+	// Skip links that only change the query of the listing itself, such as the
+	// "?C=N;O=D" sort links of Apache. Parent directory links are caught by the ".."
+	// segment check of safeDecodedLink below, or by resolveListingLink when they are
+	// absolute, as are absolute links to the listing itself.
+	if pathPart == "" || pathPart == "." || pathPart == "./" {
+		return "", false
+	}
+
+	// Security: Skip empty or suspicious links
+	if strings.TrimSpace(pathPart) == "" {
+		return "", false
+	}
+
+	// Security: Skip links that only turn into a traversal or separator once
+	// decoded by the upstream server, e.g. "%2e%2e/", "a%2fb" or "%c0%ae%c0%ae/"
+	if !safeDecodedLink(pathPart) || hasControlChars(link) {
+		return "", false
+	}
+
+	return link, true
+}
+
+// sameHostLink turns an absolute http(s) link to a file or directory below the
+// listing directory of base, on the scheme and host of base, into a link relative
+// to that directory, e.g. "https://mirror.example.com/pub/file.txt" into
+// "file.txt" for "https://mirror.example.com/pub/". The listing directory is
+// below the base path of the target, so such links stay in the mirrored tree.
+// Other links, e.g. to another host, are returned unchanged for
+// filterListingLink to drop; so is every link if base is nil.
+func sameHostLink(base *url.URL, link string) string {
+	if base == nil || !(strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://")) {
+		return link
+	}
+	linkURL, err := url.Parse(link)
+	if err != nil || linkURL.User != nil {
+		return link
+	}
+	linkScheme, linkHost := canonicalOrigin(linkURL)
+	baseScheme, baseHost := canonicalOrigin(base)
+	if linkScheme != baseScheme || linkHost != baseHost {
+		return link
+	}
+
+	basePath := base.EscapedPath()
+	dir := basePath[:strings.LastIndex(basePath, "/")+1]
+	if dir == "" {
+		dir = "/"
+	}
+	rel, ok := strings.CutPrefix(linkURL.EscapedPath(), dir)
+	if !ok || rel == "" {
+		return link
+	}
+	// A colon would make the relative link parse as a URL scheme
+	rel = strings.ReplaceAll(rel, ":", "%3A")
+	if linkURL.RawQuery != "" {
+		rel += "?" + linkURL.RawQuery
+	}
+	return rel
+}
+
+// safeDecodedLink reports whether the percent-decoded link is free of control
+// characters, backslashes, encoded slashes, parent segments and overlong UTF-8
+func safeDecodedLink(link string) bool {
+	decoded, err := url.PathUnescape(link)
+	if err != nil {
+		return false
+	}
+	if strings.Count(decoded, "/") != strings.Count(link, "/") || strings.Contains(decoded, `\`) {
+		return false
+	}
+	segments := strings.Split(strings.TrimSuffix(decoded, "/"), "/")
+	for _, segment := range segments {
+		if segment == ".." {
+			return false
+		}
+	}
+	// "./name" is harmless, but a name that is itself "." lists the directory again
+	if segments[len(segments)-1] == "." {
+		return false
+	}
+	return !hasControlChars(decoded) && !hasOverlongUTF8(decoded)
+}
+
+// linkPath returns a listing link without its query string, e.g. "pkg.tar.gz" for
+// "pkg.tar.gz?token=abc"
+func linkPath(link string) string {
+	p, _, _ := strings.Cut(link, "?")
+	return p
+}
+
+// stripLinkQueries removes the query strings of links, so that a file linked with
+// a download token or parameter is fetched and deduplicated by its path alone
+func stripLinkQueries(links []string) []string {
+	stripped := make([]string, len(links))
+	for i, link := range links {
+		stripped[i] = linkPath(link)
+	}
+	return stripped
+}
+
+// linkName returns the name of the upstream file a listing link segment refers to,
+// i.e. the segment with its percent-encoding removed
+func linkName(segment string) string {
+	if name, err := url.PathUnescape(segment); err == nil {
+		return name
+	}
+	return segment
+}
+
+// escapeLinkName returns the relative link to a file or directory name, the
+// inverse of linkName for listings that give names rather than links
+func escapeLinkName(name string) string {
+	// A colon would make the escaped name parse as a URL scheme
+	return strings.ReplaceAll(url.PathEscape(name), ":", "%3A")
+}
+
+// hasControlChars reports whether s contains NUL or another ASCII control character
+func hasControlChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOverlongUTF8 reports whether s contains an overlong UTF-8 sequence, which
+// lenient decoders turn into ASCII such as "." or "/". Other invalid UTF-8 is
+// left alone: listings of old archives often carry Latin-1 names.
+func hasOverlongUTF8(s string) bool {
+	for i := 0; i+1 < len(s); i++ {
+		c, next := s[i], s[i+1]
+		switch {
+		case (c == 0xc0 || c == 0xc1) && next >= 0x80 && next <= 0xbf:
+			return true
+		case c == 0xe0 && next >= 0x80 && next <= 0x9f:
+			return true
+		case c == 0xf0 && next >= 0x80 && next <= 0x8f:
+			return true
+		}
+	}
+	return false
+}
+
+// resolveListingLink resolves a filtered link against the listing URL and reports
+// whether the result lies below the listing's directory on the same host; links
+// like "//other.host/" or "/elsewhere/" are not part of the mirrored tree
+func resolveListingLink(base *url.URL, link string) (*url.URL, bool) {
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return nil, false
+	}
+	resolved := base.ResolveReference(linkURL)
+	if resolved.Scheme != base.Scheme || resolved.Host != base.Host || resolved.User != nil {
+		return nil, false
+	}
+	dir := base.Path[:strings.LastIndex(base.Path, "/")+1]
+	if dir == "" {
+		dir = "/"
+	}
+	cleaned := path.Clean(resolved.Path)
+	if !strings.HasPrefix(cleaned, dir) || len(cleaned) <= len(dir) ||
+		hasControlChars(resolved.Path) || hasOverlongUTF8(resolved.Path) {
+		return nil, false
+	}
+	return resolved, true
+}
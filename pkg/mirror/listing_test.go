@@ -0,0 +1,553 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// syntheticListing generates an autoindex-style page of the given size on the fly.
+// Rows are rendered into a reused buffer so the generator itself barely allocates.
+type syntheticListing struct {
+	size    int64
+	emitted int64
+	entry   int
+	row     []byte
+	pending []byte
+}
+
+func (s *syntheticListing) Read(p []byte) (int, error) {
+	if s.emitted >= s.size {
+		return 0, io.EOF
+	}
+	if len(s.pending) == 0 {
+		name := fmt.Appendf(nil, "file-%07d.rpm", s.entry%10000000)
+		s.row = append(s.row[:0], `<tr><td valign="top"><img src="/icons/unknown.gif" alt="[   ]"></td><td><a href="`...)
+		s.row = append(s.row, name...)
+		s.row = append(s.row, `">`...)
+		s.row = append(s.row, name...)
+		s.row = append(s.row, `</a></td><td align="right">2024-06-01 12:00  </td><td align="right"> 12M</td><td>`...)
+		s.row = append(s.row, padding...)
+		s.row = append(s.row, "</td></tr>\n"...)
+		s.pending = s.row
+		s.entry++
+	}
+
+	n := copy(p, s.pending)
+	if remaining := s.size - s.emitted; int64(n) > remaining {
+		n = int(remaining)
+	}
+	s.pending = s.pending[n:]
+	s.emitted += int64(n)
+	return n, nil
+}
+
+// padding pads each synthetic row to roughly 1 KB
+var padding = strings.Repeat("&nbsp;", 120)
+
+// oneByteReader returns a single byte per Read to exercise chunk boundaries
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestScanListingLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want []string
+	}{
+		{"quoting", `<a href="double.txt">x</a><a href='single.txt'>y</a><a href=unquoted.txt>z</a><a class=x HREF="upper.txt">u</a>`,
+			[]string{"double.txt", "single.txt", "unquoted.txt", "upper.txt"}},
+		{"entities", `<a href="file&amp;name.txt">file&amp;name.txt</a><a href="caf&#233;.txt">x</a>`,
+			[]string{"file&name.txt", "café.txt"}},
+		{"not links", `<html><head><link href="style.css"><a href="head.txt">h</a></head><body>` +
+			`<!-- <a href="commented.txt">c</a> --><script>document.write('<a href="script.txt">s</a>')</script>` +
+			`<style>a[href="style.txt"] {}</style><img href="img.txt"><a name="top">top</a><a href="body.txt">b</a></body></html>`,
+			[]string{"body.txt"}},
+		{"large gaps", strings.Repeat(" ", 64*1024-10) + `<a href="split-across-reads.txt">x</a>` + strings.Repeat(" ", 64*1024-3) + `<a href='second.txt'>y</a>`,
+			[]string{"split-across-reads.txt", "second.txt"}},
+		{"overlong", `<a href="` + strings.Repeat("x", maxLinkLength+1) + `">x</a><a href="ok.txt">ok</a>`,
+			[]string{"ok.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, body := range []io.Reader{strings.NewReader(tt.html), oneByteReader{strings.NewReader(tt.html)}} {
+				var links []string
+				if err := scanListingLinks(body, 0, func(link, _ string) { links = append(links, link) }); err != nil {
+					t.Fatalf("scanListingLinks failed: %v", err)
+				}
+				if fmt.Sprint(links) != fmt.Sprint(tt.want) {
+					t.Errorf("Expected links %v, got %v", tt.want, links)
+				}
+			}
+		})
+	}
+}
+
+func TestScanListingLinksSizeCap(t *testing.T) {
+	err := scanListingLinks(&syntheticListing{size: 1 << 20}, 64*1024, func(string, string) {})
+	if !errors.Is(err, errListingTooLarge) {
+		t.Errorf("Expected errListingTooLarge, got %v", err)
+	}
+
+	// Exactly at the cap is fine
+	err = scanListingLinks(&syntheticListing{size: 64 * 1024}, 64*1024, func(string, string) {})
+	if err != nil {
+		t.Errorf("Expected listing at the cap to parse, got %v", err)
+	}
+}
+
+func TestParseDirectoryListingStreamsLargeListing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 100 MB listing in short mode")
+	}
+
+	const listingSize = 100 << 20
+
+	cfg := &config.Config{Mirror: config.Mirror{MaxResponseBytes: "1g"}}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	resp := &http.Response{Body: io.NopCloser(&syntheticListing{size: listingSize})}
+
+	// Peak live heap is sampled while parsing: cumulative allocations depend on
+	// the garbage collector and the race detector, what is held at once does not
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapInuse)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	listing, err := manager.parseDirectoryListing(resp, "http://example.com/pool/", false)
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatalf("parseDirectoryListing failed: %v", err)
+	}
+	links := listing.Links
+
+	if len(links) < 100000 {
+		t.Fatalf("Expected more than 100k links from a 100 MB listing, got %d", len(links))
+	}
+
+	// Reading the whole body would hold at least the listing size; streaming only
+	// holds the extracted links plus a chunk at a time
+	if inUse := peak - min(peak, before.HeapInuse); inUse > listingSize/2 {
+		t.Errorf("Parsing a %d MB listing held up to %d MB, expected streaming to stay well below",
+			listingSize>>20, inUse>>20)
+	}
+}
+
+func TestDetectListingFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		server string
+		head   string
+		want   string
+	}{
+		{"apache autoindex", "", `<th><a href="?C=N;O=D">Name</a></th>`, ListingApache},
+		{"nginx autoindex", "", "<h1>Index of /pub/</h1><hr><pre><a href=\"../\">../</a>", ListingNginx},
+		{"lighttpd", "", `<table summary="Directory Listing" cellpadding="0">`, ListingLighttpd},
+		{"server header fallback", "Apache/2.4.57 (Debian)", `<ul><li><a href="a">a</a></ul>`, ListingApache},
+		{"nginx header", "nginx/1.25", `<ul></ul>`, ListingNginx},
+		{"unknown", "custom", `<div id="app"></div>`, ListingGeneric},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectListingFormat(tt.server, []byte(tt.head)); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRunCountsListingOutcomes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="?C=N;O=D">Name</a><a href="app/">app</a><a href="empty/">empty</a>`))
+		case "/app/":
+			// A page rendered by JavaScript has no anchors at all
+			w.Write([]byte(`<div id="root"></div><script src="/bundle.js"></script>`))
+		case "/empty/":
+			w.Write([]byte(`<a href="../">Parent Directory</a>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "listings", URL: server.URL + "/", MaxDepth: 3, Timeout: 5}
+
+	stats, err := manager.Run(context.Background(), target, t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if stats.ListingsByFormat[ListingApache] != 1 || stats.ListingsByFormat[ListingGeneric] != 2 {
+		t.Errorf("Unexpected listings by format: %v", stats.ListingsByFormat)
+	}
+	if stats.EmptyListings != 2 {
+		t.Errorf("Expected 2 empty listings, got %d", stats.EmptyListings)
+	}
+	if stats.UnrecognizedListings != 1 {
+		t.Errorf("Expected 1 unrecognized listing, got %d", stats.UnrecognizedListings)
+	}
+}
+
+// addListingSeeds seeds a fuzz target with the hostile listings collected in
+// testdata/listings
+func addListingSeeds(f *testing.F) {
+	entries, err := os.ReadDir(filepath.Join("testdata", "listings"))
+	if err != nil {
+		f.Fatalf("Failed to read seed listings: %v", err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join("testdata", "listings", entry.Name()))
+		if err != nil {
+			f.Fatalf("Failed to read seed listing: %v", err)
+		}
+		f.Add(data)
+	}
+}
+
+func TestRunMirrorsParentAndBackNames(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pub/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="/">Parent Directory</a><a href="/pub/">Back</a><a href="../">Up</a>` +
+				`<a href="background.png">background.png</a><a href="backup/">backup/</a>` +
+				`<a href="foo..bar.tar">foo..bar.tar</a><a href="Parent%20Directory.txt">Parent Directory.txt</a>`))
+		case "/pub/backup/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="/pub/">Parent Directory</a><a href="parent.txt">parent.txt</a>`))
+		case "/pub/background.png", "/pub/backup/parent.txt", "/pub/foo..bar.tar", "/pub/Parent Directory.txt":
+			w.Write([]byte("data"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "pub", URL: server.URL + "/pub/", MaxDepth: 3, Timeout: 5}
+	stats, err := manager.Run(context.Background(), target, dir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesDownloaded != 4 || stats.Errors != 0 {
+		t.Errorf("Expected 4 files and no errors, got %d and %d", stats.FilesDownloaded, stats.Errors)
+	}
+	for _, name := range []string{"background.png", "backup/parent.txt", "foo..bar.tar", "Parent Directory.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected %s mirrored: %v", name, err)
+		}
+	}
+}
+
+func TestRunQueryStringLinks(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.RequestURI())
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/pub/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="?C=N;O=D">Name</a><a href="?C=M;O=A">Last modified</a>` +
+				`<a href="/pub/?C=S;O=A">Size</a><a href="pkg.tar.gz?token=abc">pkg.tar.gz</a>`))
+		case "/pub/pkg.tar.gz":
+			w.Write([]byte("data"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, allow := range []bool{false, true} {
+		requests = nil
+		dir := t.TempDir()
+		manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		target := &config.Target{Name: "pub", URL: server.URL + "/pub/", MaxDepth: 3, Timeout: 5, AllowQueryStrings: allow}
+		stats, err := manager.Run(context.Background(), target, dir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if stats.FilesDownloaded != 1 || stats.Errors != 0 {
+			t.Errorf("allowQueryStrings=%v: expected 1 file and no errors, got %d and %d", allow, stats.FilesDownloaded, stats.Errors)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "pkg.tar.gz")); err != nil {
+			t.Errorf("allowQueryStrings=%v: expected pkg.tar.gz mirrored: %v", allow, err)
+		}
+
+		want := "/pub/pkg.tar.gz"
+		if allow {
+			want += "?token=abc"
+		}
+		fetched := false
+		for _, uri := range requests {
+			if strings.HasPrefix(uri, "/pub/?") {
+				t.Errorf("allowQueryStrings=%v: sort link %s was followed", allow, uri)
+			}
+			if strings.HasPrefix(uri, "/pub/pkg.tar.gz") {
+				fetched = true
+				if uri != want {
+					t.Errorf("allowQueryStrings=%v: requested %s, want %s", allow, uri, want)
+				}
+			}
+		}
+		if !fetched {
+			t.Errorf("allowQueryStrings=%v: pkg.tar.gz was never requested", allow)
+		}
+	}
+}
+
+func TestFilterListingLinkHostileLinks(t *testing.T) {
+	tests := []struct {
+		link string
+		want bool
+	}{
+		{"file.txt", true},
+		{"file&name.txt", true},
+		{"background.png", true},
+		{"backup/", true},
+		{"Parentheses.pdf", true},
+		{"foo..bar.tar", true},
+		{"a/../../b", false},
+		{"?C=N&O=D", false},
+		{"?C=N;O=D", false},
+		{"./?C=M;O=A", false},
+		{"pkg.tar.gz?token=abc", true},
+		{"sub/?download=1", true},
+		{"pkg.tar.gz?next=../../etc", true},
+		{"..?C=N", false},
+		{"sub/", true},
+		{"./notes.txt", true},
+		{"caf%e9.txt", true},
+		{"%25252e%25252e/", true},
+		{"%2e%2e/", false},
+		{".%2e/secret", false},
+		{"%2e/", false},
+		{"a%2fb.txt", false},
+		{"readme%5c.txt", false},
+		{`..\..\win.ini`, false},
+		{"file%00.txt", false},
+		{"nul\x00byte.txt", false},
+		{"line%0abreak.txt", false},
+		{"%c0%ae%c0%ae/", false},
+		{"\xc0\xae\xc0\xae/", false},
+		{"%e0%80%ae%e0%80%ae%e0%80%af", false},
+		{"bad%zzescape", false},
+	}
+	for _, tt := range tests {
+		if _, got := filterListingLink(tt.link); got != tt.want {
+			t.Errorf("filterListingLink(%q) = %v, want %v", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestResolveListingLink(t *testing.T) {
+	base, _ := url.Parse("http://mirror.example.com/data/")
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"data.csv", "http://mirror.example.com/data/data.csv"},
+		{"/data/sub/", "http://mirror.example.com/data/sub/"},
+		{"./notes.txt", "http://mirror.example.com/data/notes.txt"},
+		{"/other/", ""},
+		{"/data/", ""},
+		{"/", ""},
+		{"/data/backup/", "http://mirror.example.com/data/backup/"},
+		{"//evil.example.net/data/", ""},
+		{"HTTP://evil.example.net/x", ""},
+		{"file:///etc/passwd", ""},
+		{" javascript:alert(1)", ""},
+	}
+	for _, tt := range tests {
+		resolved, ok := resolveListingLink(base, tt.link)
+		got := ""
+		if ok {
+			got = resolved.String()
+		}
+		if got != tt.want {
+			t.Errorf("resolveListingLink(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+	}
+}
+
+func TestSameHostLink(t *testing.T) {
+	base, _ := url.Parse("https://mirror.example.com/pub/dir/")
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"https://mirror.example.com/pub/dir/file.txt", "file.txt"},
+		{"https://MIRROR.example.com:443/pub/dir/sub/", "sub/"},
+		{"https://mirror.example.com/pub/dir/my%20file.txt?v=2#top", "my%20file.txt?v=2"},
+		{"https://mirror.example.com/pub/dir/a:b.txt", "a%3Ab.txt"},
+		{"https://mirror.example.com/pub/dir/../../etc/passwd", "../../etc/passwd"},
+		{"https://mirror.example.com/pub/dir/", "https://mirror.example.com/pub/dir/"},
+		{"https://mirror.example.com/pub/other/file.txt", "https://mirror.example.com/pub/other/file.txt"},
+		{"https://mirror.example.com/pub/directory/file.txt", "https://mirror.example.com/pub/directory/file.txt"},
+		{"http://mirror.example.com/pub/dir/file.txt", "http://mirror.example.com/pub/dir/file.txt"},
+		{"https://mirror.example.com:8443/pub/dir/file.txt", "https://mirror.example.com:8443/pub/dir/file.txt"},
+		{"https://evil.example.net/pub/dir/file.txt", "https://evil.example.net/pub/dir/file.txt"},
+		{"https://user@mirror.example.com/pub/dir/file.txt", "https://user@mirror.example.com/pub/dir/file.txt"},
+		{"file.txt", "file.txt"},
+	}
+	for _, tt := range tests {
+		if got := sameHostLink(base, tt.link); got != tt.want {
+			t.Errorf("sameHostLink(%q) = %q, want %q", tt.link, got, tt.want)
+		}
+		// Whatever is not rewritten into the listed directory is still dropped
+		filtered, ok := filterListingLink(sameHostLink(base, tt.link))
+		if ok {
+			if _, inside := resolveListingLink(base, filtered); !inside {
+				t.Errorf("sameHostLink(%q) kept a link outside the listed directory: %q", tt.link, filtered)
+			}
+		}
+	}
+	if got := sameHostLink(nil, "https://mirror.example.com/pub/dir/file.txt"); got != "https://mirror.example.com/pub/dir/file.txt" {
+		t.Errorf("Expected no rewriting without a base, got %q", got)
+	}
+}
+
+func TestRunFollowsAbsoluteSameHostLinks(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests["other "+r.URL.Path]++
+		mu.Unlock()
+		w.Write([]byte("foreign"))
+	}))
+	defer other.Close()
+
+	var origin string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/pub/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<a href="readme.txt">readme.txt</a><a href="%[1]s/pub/file.txt">file.txt</a><a href="%[1]s/pub/sub/">sub/</a>`+
+				`<a href="%[1]s/">home</a><a href="%[1]s/private/secret.txt">secret</a>`+
+				`<a href="%[1]s/pub/../private/secret.txt">escape</a><a href="%[2]s/pub/foreign.txt">mirror</a>`, origin, other.URL)
+		case "/pub/sub/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<a href="%s/pub/sub/nested.txt">nested.txt</a>`, origin)
+		default:
+			w.Write([]byte("content of " + r.URL.Path))
+		}
+	}))
+	defer server.Close()
+	origin = server.URL
+
+	for _, follow := range []bool{true, false} {
+		clear(requests)
+		dir := t.TempDir()
+		manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		target := &config.Target{Name: "pub", URL: server.URL + "/pub/", MaxDepth: 3, Timeout: 5, FollowAbsoluteSameHost: &follow}
+		stats, err := manager.Run(context.Background(), target, dir)
+		if err != nil {
+			t.Fatalf("followAbsoluteSameHost=%v: Run failed: %v", follow, err)
+		}
+
+		want := 1
+		if follow {
+			want = 3
+		}
+		if stats.FilesDownloaded != int64(want) {
+			t.Errorf("followAbsoluteSameHost=%v: expected %d downloads, got %d", follow, want, stats.FilesDownloaded)
+		}
+		for _, name := range []string{"file.txt", "sub/nested.txt"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != follow {
+				t.Errorf("followAbsoluteSameHost=%v: unexpected state of %s: %v", follow, name, err)
+			}
+		}
+		// Cross-host links and links outside the target are never followed
+		for path, count := range requests {
+			if strings.HasPrefix(path, "other ") || strings.HasPrefix(path, "/private/") || path == "/" {
+				t.Errorf("followAbsoluteSameHost=%v: %s was requested %d times", follow, path, count)
+			}
+		}
+	}
+}
+
+// FuzzParseDirectoryListing checks that no link extracted from arbitrary HTML
+// leaves the listed directory once resolved and filtered like mirrorLinks does
+func FuzzParseDirectoryListing(f *testing.F) {
+	addListingSeeds(f)
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	base, _ := url.Parse("http://mirror.example.com/pub/dir/")
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(body))}
+		listing, err := manager.parseDirectoryListing(resp, base.String(), true)
+		if err != nil {
+			t.Fatalf("parseDirectoryListing failed: %v", err)
+		}
+		for _, link := range listing.Links {
+			resolved, ok := resolveListingLink(base, link)
+			if !ok {
+				continue
+			}
+			if resolved.Scheme != base.Scheme || resolved.Host != base.Host {
+				t.Fatalf("Link %q resolved to another host: %s", link, resolved)
+			}
+			if !strings.HasPrefix(resolved.Path, base.Path) || len(resolved.Path) <= len(base.Path) {
+				t.Fatalf("Link %q resolved outside %s: %s", link, base.Path, resolved.Path)
+			}
+			for _, segment := range strings.Split(resolved.Path, "/") {
+				if segment == ".." || strings.ContainsAny(segment, "\\\x00") || hasOverlongUTF8(segment) {
+					t.Fatalf("Link %q resolved to unsafe path %q", link, resolved.Path)
+				}
+			}
+		}
+	})
+}
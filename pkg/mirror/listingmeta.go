@@ -0,0 +1,224 @@
+package mirror
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// maxTrailingText bounds the text kept after a listing link once runs of spaces
+// are collapsed; the time and size come first
+const maxTrailingText = 64
+
+// Dates of autoindex pages: Apache and nginx print dayFirstDate, Apache tables
+// isoDate and lighttpd yearFirstDate
+const (
+	dayFirstDate  = "02-Jan-2006"
+	isoDate       = "2006-01-02"
+	yearFirstDate = "2006-Jan-02"
+)
+
+// listingSizeUnits are the suffixes of sizes autoindex pages print in human
+// readable form; they are powers of 1024
+const listingSizeUnits = "KMGTP"
+
+// listingEntry is the metadata a directory listing printed next to a link. It
+// is kept small, as listings may hold hundreds of thousands of links.
+type listingEntry struct {
+	// Size is the size the listing printed, -1 if it printed none
+	Size int64
+	// sizeSlack is how far the actual size may be from Size: 0 for sizes in
+	// bytes, the rounding of sizes like "1.2M" otherwise
+	sizeSlack int64
+	// modTime is the modification time the listing printed in Unix seconds
+	modTime int64
+	// precision is how exact modTime is, a minute or a second; zero if the
+	// listing printed no time
+	precision time.Duration
+}
+
+// parseListingEntry reads the size and modification time of a link from the
+// text that follows it in the listing, as autoindex pages print them:
+//
+//	<a href="file.tar.gz">file.tar.gz</a>   15-Jan-2024 10:30   1234567
+//	<td><a href="file.tar.gz">file.tar.gz</a></td><td>2024-01-15 10:30</td><td>1.2M</td>
+//
+// Times are taken as UTC. Metadata that cannot be parsed is left unset.
+func parseListingEntry(trailing string) listingEntry {
+	entry := listingEntry{Size: -1}
+	fields := strings.Fields(trailing)
+	for i := 0; i+1 < len(fields); i++ {
+		modTime, precision, ok := parseListingTime(fields[i], fields[i+1])
+		if !ok {
+			continue
+		}
+		entry.modTime, entry.precision = modTime.Unix(), precision
+		if i+2 < len(fields) {
+			entry.Size, entry.sizeSlack = parseListingSize(fields[i+2])
+		}
+		break
+	}
+	return entry
+}
+
+// ModTime returns the modification time the listing printed, zero if none
+func (e listingEntry) ModTime() time.Time {
+	if e.precision == 0 {
+		return time.Time{}
+	}
+	return time.Unix(e.modTime, 0).UTC()
+}
+
+// parseListingTime parses a listing date and time of day. The layout is picked
+// by shape first, as listings are long and most fields are no dates.
+func parseListingTime(date, clock string) (time.Time, time.Duration, bool) {
+	var layout string
+	switch {
+	case len(date) == len(isoDate) && date[4] == '-':
+		layout = isoDate
+	case len(date) == len(dayFirstDate) && date[2] == '-':
+		layout = dayFirstDate
+	case len(date) == len(yearFirstDate) && date[4] == '-':
+		layout = yearFirstDate
+	default:
+		return time.Time{}, 0, false
+	}
+	precision := time.Minute
+	switch len(clock) {
+	case len("15:04"):
+		layout += " 15:04"
+	case len("15:04:05"):
+		layout += " 15:04:05"
+		precision = time.Second
+	default:
+		return time.Time{}, 0, false
+	}
+	t, err := time.Parse(layout, date+" "+clock)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return t, precision, true
+}
+
+// parseListingSize parses a size in bytes ("1234567") or in units of 1024 bytes
+// ("12K", "1.2M", "3.4GiB"). It returns -1 for anything else, such as the "-"
+// of directories.
+func parseListingSize(field string) (size, slack int64) {
+	if field == "" || field[0] < '0' || field[0] > '9' {
+		return -1, 0
+	}
+	if strings.TrimLeft(field, "0123456789") == "" {
+		if n, err := strconv.ParseInt(field, 10, 64); err == nil {
+			return n, 0
+		}
+		return -1, 0
+	}
+	number := strings.TrimSuffix(strings.TrimSuffix(field, "B"), "i")
+	if number == "" {
+		return -1, 0
+	}
+	exponent := strings.IndexByte(listingSizeUnits, number[len(number)-1])
+	if exponent < 0 {
+		return -1, 0
+	}
+	number = number[:len(number)-1]
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return -1, 0
+	}
+	unit := int64(1) << (10 * (exponent + 1))
+	slack = unit
+	if strings.Contains(number, ".") {
+		slack = unit / 10
+	}
+	return int64(value * float64(unit)), slack
+}
+
+// hasMetadata reports whether the listing printed both a size and a time
+func (e listingEntry) hasMetadata() bool {
+	return e.Size >= 0 && e.precision > 0
+}
+
+// upToDate reports whether the stored file matches the entry in size and
+// modification time, within the rounding of the listing
+func (e listingEntry) upToDate(store storage.Storage, localPath string) bool {
+	if !e.hasMetadata() {
+		return false
+	}
+	stat, err := store.Stat(localPath)
+	if err != nil || stat.IsDir || stat.Size < e.Size-e.sizeSlack || stat.Size > e.Size+e.sizeSlack {
+		return false
+	}
+	diff := stat.ModTime.Sub(e.ModTime())
+	return diff >= 0 && diff < e.precision
+}
+
+// listingEntries maps the entries of a listing, which describe links in the same
+// order, by link path. A link listed twice, like the icon and the name of Apache
+// listings, keeps the entry with metadata.
+func listingEntries(links []string, entries []listingEntry) map[string]listingEntry {
+	if len(entries) != len(links) {
+		return nil
+	}
+	byPath := make(map[string]listingEntry, len(entries))
+	for i, entry := range entries {
+		key := linkPath(links[i])
+		if known, ok := byPath[key]; ok && known.hasMetadata() {
+			continue
+		}
+		byPath[key] = entry
+	}
+	return byPath
+}
+
+// trailingText collects the text following the last link of a listing
+type trailingText struct {
+	link    string
+	pending bool
+	text    []byte
+}
+
+// start begins collecting the text after link
+func (t *trailingText) start(link string) {
+	t.link, t.pending, t.text = link, true, t.text[:0]
+}
+
+// write appends text while a link is pending, collapsing runs of spaces such
+// as the padding of <pre> listings and the &nbsp; of table cells
+func (t *trailingText) write(text []byte) {
+	for len(text) > 0 && t.pending && len(t.text) < maxTrailingText {
+		r, size := utf8.DecodeRune(text)
+		text = text[size:]
+		if unicode.IsSpace(r) {
+			t.space()
+		} else {
+			t.text = utf8.AppendRune(t.text, r)
+		}
+	}
+}
+
+// space separates the text of adjacent elements, such as table cells
+func (t *trailingText) space() {
+	if t.pending && len(t.text) < maxTrailingText && (len(t.text) == 0 || t.text[len(t.text)-1] != ' ') {
+		t.text = append(t.text, ' ')
+	}
+}
+
+// take returns the pending link, if any, and ends collecting; String returns
+// its text until the next start
+func (t *trailingText) take() (string, bool) {
+	if !t.pending {
+		return "", false
+	}
+	t.pending = false
+	return t.link, true
+}
+
+// String returns the text collected after the link
+func (t *trailingText) String() string {
+	return string(t.text)
+}
@@ -0,0 +1,170 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestParseListingEntries(t *testing.T) {
+	type meta struct {
+		size, slack int64
+		modTime     time.Time
+		precision   time.Duration
+	}
+	jan15 := time.Date(2024, time.January, 15, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		html string
+		want map[string]meta
+	}{
+		{"nginx", `<html><body><h1>Index of /pub/</h1><hr><pre><a href="../">../</a>
+<a href="sub/">sub/</a>                                               15-Jan-2024 10:30                   -
+<a href="file.tar.gz">file.tar.gz</a>                                        15-Jan-2024 10:30             1234567
+<a href="empty.txt">empty.txt</a>                                          15-Jan-2024 10:30                   0
+</pre><hr></body></html>`, map[string]meta{
+			"sub/":        {-1, 0, jan15, time.Minute},
+			"file.tar.gz": {1234567, 0, jan15, time.Minute},
+			"empty.txt":   {0, 0, jan15, time.Minute},
+		}},
+		{"apache pre", `<pre><img src="/icons/blank.gif" alt="Icon "> <a href="?C=N;O=D">Name</a>                    <a href="?C=M;O=A">Last modified</a>      <a href="?C=S;O=A">Size</a>
+<hr><img src="/icons/back.gif" alt="[PARENTDIR]"> <a href="/">Parent Directory</a>                             -
+<a href="file.tar.gz"><img src="/icons/compressed.gif" alt="[   ]"></a> <a href="file.tar.gz">file.tar.gz</a>             2024-01-15 10:30  1.2M
+<img src="/icons/text.gif" alt="[TXT]"> <a href="notes.txt">notes.txt</a>               15-Jan-2024 10:30   12K
+<hr></pre>`, map[string]meta{
+			"file.tar.gz": {1258291, 104857, jan15, time.Minute},
+			"notes.txt":   {12288, 1024, jan15, time.Minute},
+		}},
+		{"apache table", `<table>
+<tr><th valign="top"><img src="/icons/blank.gif" alt="[ICO]"></th><th><a href="?C=N;O=D">Name</a></th><th><a href="?C=M;O=A">Last modified</a></th><th><a href="?C=S;O=A">Size</a></th></tr>
+<tr><td valign="top"><img src="/icons/folder.gif" alt="[DIR]"></td><td><a href="sub/">sub/</a></td><td align="right">2024-01-15 10:30  </td><td align="right">  - </td><td>&nbsp;</td></tr>
+<tr><td valign="top"><img src="/icons/unknown.gif" alt="[   ]"></td><td><a href="file.iso">file.iso</a></td><td align="right">2024-01-15 10:30  </td><td align="right">3.4G</td><td>&nbsp;</td></tr>
+<tr><td valign="top"><img src="/icons/text.gif" alt="[TXT]"></td><td><a href="bare.txt">bare.txt</a></td><td></td><td></td></tr>
+</table>`, map[string]meta{
+			"sub/":     {-1, 0, jan15, time.Minute},
+			"file.iso": {3650722201, 107374182, jan15, time.Minute},
+			"bare.txt": {-1, 0, time.Time{}, 0},
+		}},
+		{"lighttpd", `<table><tbody>
+<tr class="d"><td class="n"><a href="sub/">sub</a>/</td><td class="m">2024-Jan-15 10:30:00</td><td class="s">- &nbsp;</td><td class="t">Directory</td></tr>
+<tr><td class="n"><a href="file.bin">file.bin</a></td><td class="m">2024-Jan-15 10:30:00</td><td class="s">1.5K</td><td class="t">application/octet-stream</td></tr>
+</tbody></table>`, map[string]meta{
+			"sub/":     {-1, 0, jan15, time.Second},
+			"file.bin": {1536, 102, jan15, time.Second},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var links []string
+			var entries []listingEntry
+			err := scanListingLinks(strings.NewReader(tt.html), 0, func(link, trailing string) {
+				if filtered, ok := filterListingLink(link); ok {
+					links = append(links, filtered)
+					entries = append(entries, parseListingEntry(trailing))
+				}
+			})
+			if err != nil {
+				t.Fatalf("scanListingLinks failed: %v", err)
+			}
+			got := listingEntries(links, entries)
+			for link, want := range tt.want {
+				entry, ok := got[link]
+				if !ok {
+					t.Errorf("Expected an entry for %s", link)
+					continue
+				}
+				if entry.Size != want.size || entry.sizeSlack != want.slack || !entry.ModTime().Equal(want.modTime) || entry.precision != want.precision {
+					t.Errorf("%s: expected %+v, got size %d±%d at %v (%v)", link, want, entry.Size, entry.sizeSlack, entry.ModTime(), entry.precision)
+				}
+			}
+		})
+	}
+}
+
+func TestParseListingSize(t *testing.T) {
+	tests := []struct {
+		field       string
+		size, slack int64
+	}{
+		{"512", 512, 0},
+		{"12K", 12 << 10, 1 << 10},
+		{"1.0M", 1 << 20, 1 << 20 / 10},
+		{"2GiB", 2 << 30, 1 << 30},
+		{"-", -1, 0},
+		{"K", -1, 0},
+		{"1.2X", -1, 0},
+		{"Directory", -1, 0},
+	}
+	for _, tt := range tests {
+		if size, slack := parseListingSize(tt.field); size != tt.size || slack != tt.slack {
+			t.Errorf("parseListingSize(%q) = %d, %d, expected %d, %d", tt.field, size, slack, tt.size, tt.slack)
+		}
+	}
+}
+
+func TestRunWithListingMetadata(t *testing.T) {
+	modTime := time.Date(2024, time.June, 1, 10, 0, 30, 0, time.UTC)
+	listed := modTime.Format("02-Jan-2006 15:04")
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<pre>" +
+				`<a href="a.txt">a.txt</a>       ` + listed + `      3` + "\n" +
+				`<a href="changed.txt">changed.txt</a> ` + listed + `      9` + "\n" +
+				`<a href="bare.txt">bare.txt</a>` + "\n</pre>"))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("abc"))
+		}
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "listed", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, CheckChanges: true}
+	targetDir := t.TempDir()
+
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, name := range []string{"a.txt", "changed.txt", "bare.txt"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); err != nil {
+			t.Errorf("Expected %s to be mirrored: %v", name, err)
+		}
+	}
+
+	// The unchanged file is told apart by its listing; the others still need a
+	// file info request
+	mu.Lock()
+	clear(requests)
+	mu.Unlock()
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if requests["HEAD /a.txt"] != 0 || requests["GET /a.txt"] != 0 {
+		t.Errorf("Expected a.txt to be checked against the listing, got %v", requests)
+	}
+	if requests["HEAD /changed.txt"] != 1 || requests["HEAD /bare.txt"] != 1 {
+		t.Errorf("Expected file info requests for files the listing does not confirm, got %v", requests)
+	}
+	if stats.FilesCheckedByListing != 1 {
+		t.Errorf("Expected 1 file checked by listing, got %d", stats.FilesCheckedByListing)
+	}
+}
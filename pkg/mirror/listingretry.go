@@ -0,0 +1,85 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// listingRetryDelay is the pause before the first retry of a request; it doubles
+// with every further attempt up to maxListingRetryDelay
+var listingRetryDelay = time.Second
+
+// maxListingRetryDelay caps the pause between attempts, including pauses
+// requested by Retry-After
+const maxListingRetryDelay = 30 * time.Second
+
+// listingBreakerThreshold is how many directory listings in a row may be
+// unavailable before the run stops instead of asking an upstream in maintenance
+// for every remaining directory
+const listingBreakerThreshold = 5
+
+// fetchListingWithRetry fetches a directory listing, retrying temporary failures
+// up to target.Retries attempts in total. Server errors are returned as a
+// StatusError without their body ever being read, since maintenance pages are no
+// listings; other responses, including 304 Not Modified to a request conditional on
+// stored, are returned for the caller to handle.
+func (m *Manager) fetchListingWithRetry(ctx context.Context, client *httpPkg.Client, target *config.Target,
+	url string, stored *ListingValidator, stats *MirrorStats,
+) (*http.Response, error) {
+	attempts := max(target.Retries, 1)
+	for attempt := 1; ; attempt++ {
+		resp, err := m.fetchDirectoryListing(ctx, client, url, stored)
+		var retryAfter time.Duration
+		if err == nil {
+			if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+				return resp, nil
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			err = &httpPkg.StatusError{Method: "GET", URL: url, Code: resp.StatusCode}
+		}
+		if attempt >= attempts || !httpPkg.IsTemporary(err) {
+			return nil, err
+		}
+
+		delay := retryDelay(attempt, retryAfter)
+		stats.ListingRetries++
+		atomic.AddInt64(&stats.Retries, 1)
+		m.logger.Debug("Retrying directory listing", "url", url, "attempt", attempt+1, "delay", delay, "error", err)
+		if err := sleepRetry(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseRetryAfter returns the delay of a Retry-After header in seconds; HTTP dates
+// and invalid values yield 0
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// isUnavailable reports whether err is a server error answering a listing request
+func isUnavailable(err error) bool {
+	var statusErr *httpPkg.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code >= http.StatusInternalServerError
+}
+
+// unavailableError fails a run that could not fetch some directory listings, so
+// that incomplete trees are never published or treated as complete
+func unavailableError(stats *MirrorStats, last error) error {
+	return fmt.Errorf("%d directory listings were unavailable: %w", stats.UnavailableListings, last)
+}
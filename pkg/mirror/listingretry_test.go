@@ -0,0 +1,186 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// maintenancePage is what upstreams in maintenance answer with; its links must
+// never be followed
+const maintenancePage = `<html><body>Down for maintenance <a href="status.html">status</a></body></html>`
+
+func fastListingRetries(t *testing.T) {
+	previous := listingRetryDelay
+	listingRetryDelay = time.Millisecond
+	t.Cleanup(func() { listingRetryDelay = previous })
+}
+
+func TestListingRetriesRecoverFromMaintenance(t *testing.T) {
+	fastListingRetries(t)
+
+	var listings atomic.Int64
+	var statusRequests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			if listings.Add(1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(maintenancePage))
+				return
+			}
+			w.Write([]byte(`<a href="a.txt">a</a>`))
+		case "/status.html":
+			statusRequests.Add(1)
+		default:
+			w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "maintenance", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, Retries: 3}
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.ListingRetries != 2 || stats.Retries != 2 || stats.UnavailableListings != 0 || stats.FilesDownloaded != 1 {
+		t.Errorf("Expected 2 retries and the file downloaded, got %+v", stats)
+	}
+	if statusRequests.Load() != 0 {
+		t.Error("Expected the maintenance page not to be parsed as a listing")
+	}
+}
+
+func TestUnavailableListingsFailRun(t *testing.T) {
+	fastListingRetries(t)
+
+	var subRequests atomic.Int64
+	var statusRequests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a</a><a href="sub/">sub</a>`))
+		case "/sub/":
+			subRequests.Add(1)
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(maintenancePage))
+		case "/sub/status.html":
+			statusRequests.Add(1)
+		default:
+			w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "maintenance", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, Retries: 2,
+		Layout: LayoutImmutableDated, DatedFormat: "%Y-%m-%d-%H%M%S"}
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	var statusErr *httpPkg.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusServiceUnavailable || !httpPkg.IsTemporary(err) {
+		t.Fatalf("Expected the run to fail with a temporary 503, got %v", err)
+	}
+	if subRequests.Load() != 2 || stats.UnavailableListings != 1 || stats.ListingRetries != 1 {
+		t.Errorf("Expected one retried and then unavailable listing, got %d requests and %+v", subRequests.Load(), stats)
+	}
+	if statusRequests.Load() != 0 {
+		t.Error("Expected the maintenance page not to be parsed as a listing")
+	}
+
+	// The incomplete snapshot is neither published nor recorded as a success
+	if _, err := os.Lstat(filepath.Join(targetDir, CurrentLinkName)); !os.IsNotExist(err) {
+		t.Errorf("Expected no current link after a failed run, got %v", err)
+	}
+	if state, _ := LoadTargetState(targetDir); state.Synced() {
+		t.Error("Expected the run not to count as a successful sync")
+	}
+}
+
+func TestListingCircuitBreaker(t *testing.T) {
+	fastListingRetries(t)
+
+	const dirs = 20
+	var subRequests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			for i := range dirs {
+				fmt.Fprintf(w, `<a href="d%02d/">d%02d</a>`, i, i)
+			}
+			return
+		}
+		subRequests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "breaker", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, Retries: 1}
+
+	stats, err := manager.Run(context.Background(), target, t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Fatalf("Expected the run to fail as unavailable, got %v", err)
+	}
+	if subRequests.Load() != listingBreakerThreshold || stats.UnavailableListings != listingBreakerThreshold {
+		t.Errorf("Expected the run to stop after %d unavailable listings, got %d requests and %+v",
+			listingBreakerThreshold, subRequests.Load(), stats)
+	}
+}
+
+func TestListingRetryNotForClientErrors(t *testing.T) {
+	fastListingRetries(t)
+
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "missing", URL: server.URL + "/", MaxDepth: 1, Timeout: 5, Retries: 3}
+	if _, err := manager.Run(context.Background(), target, t.TempDir()); err == nil {
+		t.Fatal("Expected the run to fail")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected a 404 not to be retried, got %d requests", requests.Load())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-3", 0},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value); got != tt.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", tt.value, got, tt.expected)
+		}
+	}
+}
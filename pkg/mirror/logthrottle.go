@@ -0,0 +1,227 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// throttleKey identifies a class of repeated warnings
+type throttleKey struct {
+	host  string
+	msg   string
+	class string
+}
+
+// throttleEntry tracks occurrences of a warning class
+type throttleEntry struct {
+	total      int64 // occurrences since the start of the run
+	suppressed int64 // occurrences not logged since the last summary
+	interval   int64 // occurrences since the last summary
+}
+
+// warnThrottle aggregates identical warnings per host during a run. The first Burst
+// occurrences of each class are logged in full, after that only every SampleRate-th
+// occurrence is, and suppressed occurrences are reported in periodic summary lines.
+type warnThrottle struct {
+	logger   *slog.Logger
+	settings config.LogThrottle
+	enabled  bool
+
+	mu         sync.Mutex
+	entries    map[throttleKey]*throttleEntry
+	lastFlush  time.Time
+	stopTicker chan struct{}
+}
+
+// newWarnThrottle creates a throttle for a single run. Throttling is disabled when
+// configured off or when the logger is at debug level.
+func newWarnThrottle(logger *slog.Logger, settings config.LogThrottle) *warnThrottle {
+	enabled := settings.Enabled && !logger.Enabled(context.Background(), slog.LevelDebug)
+	if settings.Burst <= 0 {
+		settings.Burst = 10
+	}
+	if settings.SampleRate <= 0 {
+		settings.SampleRate = 100
+	}
+	if settings.SummaryInterval <= 0 {
+		settings.SummaryInterval = 60
+	}
+
+	return &warnThrottle{
+		logger:    logger,
+		settings:  settings,
+		enabled:   enabled,
+		entries:   make(map[throttleKey]*throttleEntry),
+		lastFlush: time.Now(),
+	}
+}
+
+// Start launches the periodic summary loop; Stop must be called when the run ends
+func (t *warnThrottle) Start() {
+	if !t.enabled {
+		return
+	}
+
+	stop := make(chan struct{})
+	t.mu.Lock()
+	t.stopTicker = stop
+	t.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(time.Duration(t.settings.SummaryInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				t.Flush()
+			}
+		}
+	}()
+}
+
+// Stop ends the summary loop and emits a final summary
+func (t *warnThrottle) Stop() {
+	t.mu.Lock()
+	stop := t.stopTicker
+	t.stopTicker = nil
+	t.mu.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	t.Flush()
+}
+
+// Warn logs a warning about a failed operation on rawURL, subject to throttling
+func (t *warnThrottle) Warn(msg, rawURL string, err error, args ...any) {
+	args = append([]any{"url", rawURL, "error", err}, args...)
+	if !t.enabled {
+		t.logger.Warn(msg, args...)
+		return
+	}
+
+	key := throttleKey{
+		host:  urlHost(rawURL),
+		msg:   msg,
+		class: classifyError(err),
+	}
+
+	t.mu.Lock()
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &throttleEntry{}
+		t.entries[key] = entry
+	}
+	entry.total++
+	entry.interval++
+
+	logIt := entry.total <= int64(t.settings.Burst) ||
+		(entry.total-int64(t.settings.Burst))%int64(t.settings.SampleRate) == 0
+	if !logIt {
+		entry.suppressed++
+	}
+	total := entry.total
+	t.mu.Unlock()
+
+	if logIt {
+		if total > int64(t.settings.Burst) {
+			args = append(args, "sampled", true, "occurrences", total)
+		}
+		t.logger.Warn(msg, args...)
+	}
+}
+
+// Flush logs a summary line for every warning class that had suppressed occurrences
+func (t *warnThrottle) Flush() {
+	t.mu.Lock()
+	elapsed := time.Since(t.lastFlush).Round(time.Second)
+	t.lastFlush = time.Now()
+
+	type summary struct {
+		key     throttleKey
+		count   int64
+		total   int64
+		dropped int64
+	}
+	var summaries []summary
+	for key, entry := range t.entries {
+		if entry.suppressed > 0 {
+			summaries = append(summaries, summary{key, entry.interval, entry.total, entry.suppressed})
+		}
+		entry.suppressed = 0
+		entry.interval = 0
+	}
+	t.mu.Unlock()
+
+	for _, s := range summaries {
+		t.logger.Warn(fmt.Sprintf("%s (%s): %d occurrences in last %s", strings.ToLower(s.key.msg), s.key.class, s.count, elapsed),
+			"host", s.key.host,
+			"error_class", s.key.class,
+			"occurrences", s.count,
+			"suppressed", s.dropped,
+			"total", s.total)
+	}
+}
+
+// classifyError buckets an error into a short, stable class name for aggregation
+func classifyError(err error) string {
+	if err == nil {
+		return "unknown"
+	}
+
+	var statusErr *httpPkg.StatusError
+	var timeoutErr *httpPkg.TimeoutError
+	var checksumErr *httpPkg.ChecksumMismatchError
+	var parseErr *ListingParseError
+	var pathErr *PathSecurityError
+	var redirectErr *httpPkg.RedirectBlockedError
+	var storageErr *StorageError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("http %d", statusErr.Code)
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &timeoutErr), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &checksumErr):
+		return "checksum mismatch"
+	case errors.As(err, &parseErr):
+		return "listing parse error"
+	case errors.As(err, &pathErr):
+		return "unsafe path"
+	case errors.As(err, &redirectErr):
+		return "redirect blocked"
+	case errors.As(err, &storageErr):
+		return "storage error"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &dnsErr):
+		return "dns error"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// urlHost returns the host part of a URL, or the raw string if it cannot be parsed
+func urlHost(rawURL string) string {
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return rawURL
+}
@@ -0,0 +1,161 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+func TestWarnThrottleSamplesAndSummarizes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	throttle := newWarnThrottle(logger, config.LogThrottle{
+		Enabled:    true,
+		Burst:      3,
+		SampleRate: 10,
+	})
+
+	err := fmt.Errorf("GET request failed: %w", syscall.ECONNREFUSED)
+	for i := 0; i < 25; i++ {
+		throttle.Warn("Failed to download file", fmt.Sprintf("http://upstream.example.com/file%d", i), err)
+	}
+
+	// 3 burst lines plus the 13th and 23rd occurrence
+	if lines := strings.Count(buf.String(), `msg="Failed to download file"`); lines != 5 {
+		t.Errorf("Expected 5 logged warnings, got %d:\n%s", lines, buf.String())
+	}
+
+	buf.Reset()
+	throttle.Flush()
+
+	summary := buf.String()
+	if !strings.Contains(summary, "failed to download file (connection refused): 25 occurrences") {
+		t.Errorf("Expected summary line with 25 occurrences, got:\n%s", summary)
+	}
+	if !strings.Contains(summary, "suppressed=20") || !strings.Contains(summary, "host=upstream.example.com") {
+		t.Errorf("Expected summary to report suppressed count and host, got:\n%s", summary)
+	}
+
+	// Nothing new since the last summary
+	buf.Reset()
+	throttle.Flush()
+	if buf.Len() != 0 {
+		t.Errorf("Expected no summary without new suppressed warnings, got:\n%s", buf.String())
+	}
+}
+
+func TestWarnThrottleSeparatesHostsAndClasses(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	throttle := newWarnThrottle(logger, config.LogThrottle{Enabled: true, Burst: 1, SampleRate: 1000})
+
+	throttle.Warn("Failed to download file", "http://a.example.com/x", syscall.ECONNREFUSED)
+	throttle.Warn("Failed to download file", "http://b.example.com/x", syscall.ECONNREFUSED)
+	throttle.Warn("Failed to download file", "http://a.example.com/y", errors.New("GET request returned status 404"))
+
+	if lines := strings.Count(buf.String(), `msg="Failed to download file"`); lines != 3 {
+		t.Errorf("Expected each host/class pair to be logged, got %d lines:\n%s", lines, buf.String())
+	}
+}
+
+func TestWarnThrottleStartStop(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	throttle := newWarnThrottle(logger, config.LogThrottle{Enabled: true})
+
+	// Runs start and stop the summary loop while their warnings are throttled; the
+	// race detector catches the loop reading state that Stop resets
+	for range 10 {
+		throttle.Start()
+		throttle.Warn("Failed to download file", "http://example.com/file", syscall.ECONNRESET)
+		throttle.Stop()
+	}
+	throttle.Stop()
+	if throttle.stopTicker != nil {
+		t.Error("Expected Stop to end the summary loop")
+	}
+}
+
+func TestWarnThrottleDisabledAtDebugLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	throttle := newWarnThrottle(logger, config.LogThrottle{Enabled: true, Burst: 1, SampleRate: 100})
+	for i := 0; i < 10; i++ {
+		throttle.Warn("Failed to download file", "http://example.com/file", syscall.ECONNRESET)
+	}
+
+	if lines := strings.Count(buf.String(), `msg="Failed to download file"`); lines != 10 {
+		t.Errorf("Expected all warnings at debug level, got %d", lines)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{fmt.Errorf("wrapped: %w", syscall.ECONNREFUSED), "connection refused"},
+		{fmt.Errorf("wrapped: %w", syscall.ECONNRESET), "connection reset"},
+		{context.DeadlineExceeded, "timeout"},
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("wrapped: %w", &httpPkg.StatusError{Method: "GET", Code: 503}), "http 503"},
+		{&httpPkg.TimeoutError{Op: "GET request", Err: errors.New("i/o timeout")}, "timeout"},
+		{&httpPkg.ChecksumMismatchError{Algorithm: "sha256"}, "checksum mismatch"},
+		{&ListingParseError{URL: "http://example.com/", Err: errListingTooLarge}, "listing parse error"},
+		{&PathSecurityError{Name: "..", Reason: "outside target directory"}, "unsafe path"},
+		{&url.Error{Op: "Get", URL: "http://example.com/f", Err: &httpPkg.RedirectBlockedError{Location: "http://cdn.example.net/f"}}, "redirect blocked"},
+		// Messages alone are not classified
+		{errors.New("GET request returned status 503"), "other"},
+		{errors.New("something odd"), "other"},
+		{nil, "unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.expected {
+			t.Errorf("classifyError(%v) = %q, expected %q", tt.err, got, tt.expected)
+		}
+	}
+}
+
+func TestMirrorStatsErrorsByClass(t *testing.T) {
+	responses := map[string]string{
+		"/": `<html><body><a href="missing1.txt">1</a><a href="missing2.txt">2</a></body></html>`,
+	}
+
+	server := createTestServer(t, responses)
+	defer server.Close()
+
+	var buf bytes.Buffer
+	cfg := &config.Config{
+		Mirror: config.Mirror{
+			DataPath:    t.TempDir(),
+			LogThrottle: config.LogThrottle{Enabled: true, Burst: 1, SampleRate: 100},
+		},
+	}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(&buf, nil)))
+
+	stats := &MirrorStats{ErrorsByClass: make(map[string]int64), warnings: newWarnThrottle(manager.logger, cfg.Mirror.LogThrottle)}
+	target := &config.Target{Name: "test-target", URL: server.URL + "/", Timeout: 5, MaxDepth: 1}
+
+	if err := manager.mirrorTree(context.Background(), httpPkg.NewClient(target), target, target.URL, t.TempDir(), stats); err != nil {
+		t.Fatalf("mirrorTree failed: %v", err)
+	}
+
+	if stats.ErrorsByClass["http 404"] != 2 {
+		t.Errorf("Expected 2 errors classified as http 404, got %v", stats.ErrorsByClass)
+	}
+	if lines := strings.Count(buf.String(), `msg="Failed to download file"`); lines != 1 {
+		t.Errorf("Expected second identical warning to be suppressed, got %d lines", lines)
+	}
+}
@@ -0,0 +1,271 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// indexEntry is a file or directory described by a metadata index
+type indexEntry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+	// precision is how exact ModTime is: a minute for recent entries, a day for
+	// entries listed with a year instead of a time
+	precision time.Duration
+}
+
+// metadataIndex is a parsed ls-lR file. Directories are keyed by their path
+// relative to the target URL, "" being the root.
+type metadataIndex struct {
+	dirs map[string][]indexEntry
+	// files holds the file entries by relative path
+	files map[string]indexEntry
+}
+
+// loadMetadataIndex downloads and parses the target's MetadataIndex. A failure is
+// logged and yields nil, so the run falls back to crawling listings.
+func (m *Manager) loadMetadataIndex(ctx context.Context, client *httpPkg.Client, target *config.Target, stats *MirrorStats) *metadataIndex {
+	if target.MetadataIndex == "" {
+		return nil
+	}
+	base, err := url.Parse(target.URL)
+	if err != nil {
+		return nil
+	}
+	ref, err := url.Parse(target.MetadataIndex)
+	if err != nil {
+		m.logger.Warn("Invalid metadata index URL, crawling listings", "error", err)
+		return nil
+	}
+	indexURL := base.ResolveReference(ref).String()
+
+	release, err := m.acquire(ctx, stats, indexURL)
+	if err != nil {
+		return nil
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", indexURL, nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("User-Agent", client.GetUserAgent())
+	resp, err := client.DoRequest(req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = &httpPkg.StatusError{Method: "GET", URL: indexURL, Code: resp.StatusCode}
+	}
+	if err != nil {
+		m.logger.Warn("Failed to fetch metadata index, crawling listings", "url", indexURL, "error", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		now = lastModified
+	}
+	index, err := parseLsLR(resp.Body, now)
+	if err != nil {
+		m.logger.Warn("Failed to parse metadata index, crawling listings", "url", indexURL, "error", err)
+		return nil
+	}
+	m.logger.Info("Loaded metadata index", "url", indexURL, "directories", len(index.dirs))
+	return index
+}
+
+// parseLsLR parses the output of "ls -lR", optionally gzip-compressed. Times
+// without a year are placed in the year before now, as ls does.
+func parseLsLR(r io.Reader, now time.Time) (*metadataIndex, error) {
+	buffered := bufio.NewReader(r)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		buffered = bufio.NewReader(gz)
+	}
+
+	index := &metadataIndex{dirs: make(map[string][]indexEntry), files: make(map[string]indexEntry)}
+	// Entries before the first header belong to the root
+	dir := ""
+	index.dirs[dir] = nil
+
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 64*1024), maxLinkLength)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "total ") {
+			continue
+		}
+		if entry, ok := parseLsLine(line, now); ok {
+			index.dirs[dir] = append(index.dirs[dir], entry)
+			if !entry.IsDir {
+				index.files[path.Join(dir, entry.Name)] = entry
+			}
+			continue
+		}
+		if header, ok := strings.CutSuffix(line, ":"); ok {
+			dir = normalizeIndexDir(header)
+			if _, ok := index.dirs[dir]; !ok {
+				index.dirs[dir] = nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(index.dirs) == 1 && len(index.dirs[""]) == 0 {
+		return nil, fmt.Errorf("no entries found")
+	}
+	return index, nil
+}
+
+// normalizeIndexDir turns an ls-lR header ("./pub/gnu", "/pub") into a relative path
+func normalizeIndexDir(dir string) string {
+	dir = path.Clean("/" + strings.TrimPrefix(dir, "."))
+	return strings.TrimPrefix(dir, "/")
+}
+
+// lsMonths maps the month abbreviations printed by ls
+var lsMonths = map[string]time.Month{
+	"Jan": time.January, "Feb": time.February, "Mar": time.March, "Apr": time.April,
+	"May": time.May, "Jun": time.June, "Jul": time.July, "Aug": time.August,
+	"Sep": time.September, "Oct": time.October, "Nov": time.November, "Dec": time.December,
+}
+
+// parseLsLine parses a single "ls -l" line. Only regular files and directories are
+// returned; symlinks and special files are left to listing crawls.
+func parseLsLine(line string, now time.Time) (indexEntry, bool) {
+	if line[0] != '-' && line[0] != 'd' {
+		return indexEntry{}, false
+	}
+	fields := strings.Fields(line)
+
+	// The owner and group columns vary, so locate the date by its month name
+	for i := 3; i+3 < len(fields); i++ {
+		month, ok := lsMonths[fields[i]]
+		if !ok {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[i-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		day, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			continue
+		}
+		modTime, precision, ok := parseLsTime(month, day, fields[i+2], now)
+		if !ok {
+			continue
+		}
+
+		name := skipFields(line, i+3)
+		if name == "" || name == "." || name == ".." {
+			return indexEntry{}, false
+		}
+		return indexEntry{Name: name, IsDir: line[0] == 'd', Size: size, ModTime: modTime, precision: precision}, true
+	}
+	return indexEntry{}, false
+}
+
+// parseLsTime parses the "HH:MM" or year column of ls -l in UTC
+func parseLsTime(month time.Month, day int, value string, now time.Time) (time.Time, time.Duration, bool) {
+	if hour, minute, ok := strings.Cut(value, ":"); ok {
+		h, err1 := strconv.Atoi(hour)
+		m, err2 := strconv.Atoi(minute)
+		if err1 != nil || err2 != nil {
+			return time.Time{}, 0, false
+		}
+		t := time.Date(now.Year(), month, day, h, m, 0, 0, time.UTC)
+		// Recent entries are within the last six months; a date ahead of now
+		// belongs to the previous year
+		if t.After(now.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+		return t, time.Minute, true
+	}
+	year, err := strconv.Atoi(value)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC), 24 * time.Hour, true
+}
+
+// skipFields returns the rest of line after n whitespace-separated fields,
+// keeping spaces inside the remainder
+func skipFields(line string, n int) string {
+	rest := line
+	for range n {
+		rest = strings.TrimLeft(rest, " \t")
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			return ""
+		}
+		rest = rest[end:]
+	}
+	return strings.TrimLeft(rest, " \t")
+}
+
+// links returns the entries of dir as listing links, or false if the index does
+// not cover dir
+func (idx *metadataIndex) links(dir string) ([]string, bool) {
+	if idx == nil {
+		return nil, false
+	}
+	entries, ok := idx.dirs[dir]
+	if !ok {
+		return nil, false
+	}
+	links := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		link := url.PathEscape(entry.Name)
+		if entry.IsDir {
+			link += "/"
+		}
+		links = append(links, link)
+	}
+	return links, true
+}
+
+// file returns the index entry of a file by its link name in dir
+func (idx *metadataIndex) file(dir, link string) (indexEntry, bool) {
+	if idx == nil {
+		return indexEntry{}, false
+	}
+	name, err := url.PathUnescape(link)
+	if err != nil {
+		return indexEntry{}, false
+	}
+	entry, ok := idx.files[path.Join(dir, name)]
+	return entry, ok
+}
+
+// upToDate reports whether the stored file matches the entry in size and, within
+// the precision of the index, in modification time
+func (e indexEntry) upToDate(store storage.Storage, localPath string) bool {
+	stat, err := store.Stat(localPath)
+	if err != nil || stat.IsDir || stat.Size != e.Size {
+		return false
+	}
+	diff := stat.ModTime.Sub(e.ModTime)
+	return diff >= 0 && diff < e.precision
+}
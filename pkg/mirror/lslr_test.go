@@ -0,0 +1,163 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+const testLsLR = `.:
+total 12
+drwxr-xr-x    4 ftp      ftp          4096 Jan 10 12:00 pub
+-rw-r--r--    1 ftp      ftp            11 Mar  5  2020 README
+lrwxrwxrwx    1 ftp      ftp             6 Jan 10 12:00 latest -> README
+
+./pub:
+total 8
+-rw-r--r--    1 ftp      ftp             8 Jan 10 12:30 file with spaces.txt
+-rw-r--r--    1 ftp            5 Dec 31 23:59 nogroup.txt
+drwxr-xr-x    2 ftp      ftp          4096 Jan 10 12:00 empty
+`
+
+func TestParseLsLR(t *testing.T) {
+	now := time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(testLsLR))
+	w.Close()
+
+	for name, data := range map[string][]byte{"plain": []byte(testLsLR), "gzip": gz.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			index, err := parseLsLR(bytes.NewReader(data), now)
+			if err != nil {
+				t.Fatalf("parseLsLR failed: %v", err)
+			}
+
+			root := index.dirs[""]
+			if len(root) != 2 || root[0].Name != "pub" || !root[0].IsDir || root[1].Name != "README" {
+				t.Fatalf("Unexpected root entries %+v", root)
+			}
+			if want := time.Date(2020, time.March, 5, 0, 0, 0, 0, time.UTC); !root[1].ModTime.Equal(want) || root[1].precision != 24*time.Hour {
+				t.Errorf("Expected dated entry at %v, got %v", want, root[1].ModTime)
+			}
+
+			file, ok := index.file("pub", "file%20with%20spaces.txt")
+			if !ok || file.Size != 8 || !file.ModTime.Equal(time.Date(2025, time.January, 10, 12, 30, 0, 0, time.UTC)) {
+				t.Errorf("Unexpected entry for name with spaces: %+v (found %v)", file, ok)
+			}
+			// A time without year after now belongs to the previous year
+			if file, ok := index.file("pub", "nogroup.txt"); !ok || file.ModTime.Year() != 2024 || file.Size != 5 {
+				t.Errorf("Unexpected entry without group column: %+v (found %v)", file, ok)
+			}
+
+			if _, ok := index.links("pub/empty"); ok {
+				t.Error("Expected directory without header not to be covered")
+			}
+			links, ok := index.links("pub")
+			if !ok || strings.Join(links, " ") != "file%20with%20spaces.txt nogroup.txt empty/" {
+				t.Errorf("Unexpected links %v", links)
+			}
+		})
+	}
+
+	if _, err := parseLsLR(strings.NewReader("<html>not an index</html>"), now); err == nil {
+		t.Error("Expected error for input without entries")
+	}
+}
+
+func TestRunWithMetadataIndex(t *testing.T) {
+	modTime := time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC)
+	index := `.:
+-rw-r--r-- 1 ftp ftp 3 Jun  1  2024 a.txt
+drwxr-xr-x 2 ftp ftp 4096 Jun  1  2024 sub
+drwxr-xr-x 2 ftp ftp 4096 Jun  1  2024 crawled
+
+./sub:
+-rw-r--r-- 1 ftp ftp 3 Jun  1  2024 b.txt
+`
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		switch r.URL.Path {
+		case "/ls-lR":
+			w.Write([]byte(index))
+		case "/crawled/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="c.txt">c</a>`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("abc"))
+		}
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "indexed", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, MetadataIndex: "ls-lR"}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt", "crawled/c.txt"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); err != nil {
+			t.Errorf("Expected %s to be mirrored: %v", name, err)
+		}
+	}
+	if stats.ListingsAvoided != 2 {
+		t.Errorf("Expected 2 listings avoided, got %d", stats.ListingsAvoided)
+	}
+	if requests["GET /"] != 0 || requests["GET /sub/"] != 0 || requests["GET /crawled/"] != 1 {
+		t.Errorf("Expected only uncovered listings to be fetched, got %v", requests)
+	}
+
+	// Files matching the index are skipped without any request
+	mu.Lock()
+	clear(requests)
+	mu.Unlock()
+	stats, err = manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if requests["HEAD /a.txt"] != 0 || requests["GET /a.txt"] != 0 || requests["HEAD /sub/b.txt"] != 0 {
+		t.Errorf("Expected indexed files to be checked against the index, got %v", requests)
+	}
+	// Only the file outside the index is fetched again
+	if stats.FilesDownloaded != 1 || stats.FilesSkipped != 2 {
+		t.Errorf("Expected 1 download and 2 skips, got %d and %d", stats.FilesDownloaded, stats.FilesSkipped)
+	}
+}
+
+func TestRunWithUnavailableMetadataIndex(t *testing.T) {
+	server := createTestServer(t, map[string]string{"/": `<a href="a.txt">a</a>`, "/a.txt": "a"})
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "fallback", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, MetadataIndex: "ls-lR.gz"}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.ListingsAvoided != 0 || stats.FilesDownloaded != 1 {
+		t.Errorf("Expected crawl fallback, got %d avoided and %d downloaded", stats.ListingsAvoided, stats.FilesDownloaded)
+	}
+}
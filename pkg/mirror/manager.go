@@ -2,352 +2,1526 @@ package mirror
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jhofer-cloud/http-mirror/pkg/config"
 	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
 )
 
 // Manager handles the mirroring process
 type Manager struct {
-	config *config.Config
-	logger *slog.Logger
+	config        *config.Config
+	logger        *slog.Logger
+	hosts         *hostCoordinator
+	events        EventSink
+	clientOptions []httpPkg.Option
+	usage         *UsageMeter
+	runs          *RunCoordinator
+	// duplicateRuns is DuplicateRunsQueue or DuplicateRunsReject
+	duplicateRuns string
+	// fullScan lists every directory in full regardless of its listing churn and
+	// stored validators
+	fullScan bool
+}
+
+// Option configures optional Manager behavior
+type Option func(*Manager)
+
+// WithEventSink reports file-level events of every run to sink
+func WithEventSink(sink EventSink) Option {
+	return func(m *Manager) {
+		m.events = sink
+	}
+}
+
+// WithClientOptions appends options to the HTTP client created for each target
+func WithClientOptions(opts ...httpPkg.Option) Option {
+	return func(m *Manager) {
+		m.clientOptions = append(m.clientOptions, opts...)
+	}
+}
+
+// ShareHostsWith makes the manager use the host coordinator of other, so runs of both
+// managers pace upstream hosts shared by other's targets together
+func ShareHostsWith(other *Manager) Option {
+	return func(m *Manager) {
+		m.hosts = other.hosts
+	}
+}
+
+// WithUsageMeter accounts downloads in meter instead of a meter for Mirror.DataPath,
+// so that several managers share one budget
+func WithUsageMeter(meter *UsageMeter) Option {
+	return func(m *Manager) {
+		m.usage = meter
+	}
+}
+
+// WithRunCoordinator makes the manager serialize its runs with those of other
+// managers of runs instead of the process-wide Runs
+func WithRunCoordinator(runs *RunCoordinator) Option {
+	return func(m *Manager) {
+		m.runs = runs
+	}
+}
+
+// WithDuplicateRuns sets what a run does while another run of the same target
+// directory is in progress: DuplicateRunsQueue, the default, waits for it and
+// DuplicateRunsReject fails with ErrSyncInProgress
+func WithDuplicateRuns(policy string) Option {
+	return func(m *Manager) {
+		m.duplicateRuns = policy
+	}
+}
+
+// WithFullScan makes every run list every directory in full, even those whose
+// listings Target.ChurnSkipAfter would skip or Target.ConditionalListings would
+// request conditionally
+func WithFullScan() Option {
+	return func(m *Manager) {
+		m.fullScan = true
+	}
 }
 
 // NewManager creates a new mirror manager
-func NewManager(cfg *config.Config, logger *slog.Logger) *Manager {
-	return &Manager{
+func NewManager(cfg *config.Config, logger *slog.Logger, opts ...Option) *Manager {
+	m := &Manager{
 		config: cfg,
 		logger: logger,
+		hosts:  newHostCoordinator(cfg),
+		runs:   Runs,
 	}
+	if cfg.Mirror.DataPath != "" {
+		m.usage = NewUsageMeter(cfg.Mirror.DataPath, httpPkg.ParseSize(cfg.Mirror.MonthlyByteCap), cfg.Mirror.CapResetDay)
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// withLogger returns a copy of m that logs to logger and shares everything else
+// with m
+func (m *Manager) withLogger(logger *slog.Logger) *Manager {
+	scoped := *m
+	scoped.logger = logger
+	return &scoped
 }
 
-// MirrorTarget mirrors a single target
+// forTarget returns a copy of m whose log records carry the name of the target
+// an operation works on, followed by attrs
+func (m *Manager) forTarget(name string, attrs ...any) *Manager {
+	return m.withLogger(m.logger.With(append([]any{"target", name}, attrs...)...))
+}
+
+// newRunID returns a random identifier of a run, which its log records and the
+// manifest entries of the files it downloads carry
+func newRunID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// MirrorTarget mirrors a single target into its directory below Mirror.DataPath
 func (m *Manager) MirrorTarget(ctx context.Context, target *config.Target) error {
-	m.logger.Info("Starting mirror for target", "name", target.Name, "url", target.URL)
+	_, err := m.MirrorTargetWithStats(ctx, target)
+	return err
+}
 
-	// Create HTTP client for this target
-	client := httpPkg.NewClient(target)
+// MirrorTargetWithStats mirrors a single target into its directory below
+// Mirror.DataPath like MirrorTarget and returns the statistics of the run, which
+// are nil if the run did not start, e.g. for frozen targets
+func (m *Manager) MirrorTargetWithStats(ctx context.Context, target *config.Target) (*MirrorStats, error) {
+	return m.Run(ctx, target, filepath.Join(m.config.Mirror.DataPath, target.Name))
+}
+
+// Run mirrors a single target into targetDir and returns the statistics of the run.
+// Runs of the same target directory are serialized by the run coordinator of the
+// manager.
+func (m *Manager) Run(ctx context.Context, target *config.Target, targetDir string) (*MirrorStats, error) {
+	runID := newRunID()
+	m = m.forTarget(target.Name, "run_id", runID)
+	release, err := m.acquireRun(ctx, target.Name, targetDir)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if target.Frozen {
+		return nil, m.skipFrozen(target, targetDir)
+	}
+	m.logger.Info("Starting mirror for target", "url", target.URL)
+	target = m.normalizeTarget(target)
+
+	excluder, err := newDirExcluder(target.ExcludeDirs, target.ExcludedDirPolicy, target.FilterMode)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", target.Name, err)
+	}
+
+	// Downloaded files go to the target's storage backend
+	store, err := m.newStorage(target, targetDir)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", target.Name, err)
+	}
 
 	// Create target directory
-	targetDir := filepath.Join(m.config.Mirror.DataPath, target.Name)
 	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return fmt.Errorf("failed to create target directory: %w", err)
+		if storageErr := asStorageError(targetDir, err); storageErr != nil {
+			return nil, storageErr
+		}
+		return nil, fmt.Errorf("failed to create target directory: %w", err)
+	}
+
+	// Dated runs write into a directory of their own below the target directory,
+	// which keeps the metadata of all of them
+	start := time.Now()
+	runDir, previous := targetDir, ""
+	switch target.Layout {
+	case "", LayoutInPlace:
+	case LayoutImmutableDated:
+		runDir, previous, err = m.prepareDatedDir(target, targetDir, start)
+		if err != nil {
+			return nil, err
+		}
+		if !target.LinkUnchanged {
+			previous = ""
+		}
+	default:
+		return nil, fmt.Errorf("target %s: unknown layout %q", target.Name, target.Layout)
+	}
+	switch target.ListingFormat {
+	case "", listingFormatAuto, listingFormatHTML, listingFormatNginxJSON, listingFormatS3:
+	default:
+		return nil, fmt.Errorf("target %s: unknown listing format %q", target.Name, target.ListingFormat)
 	}
 
 	// Start mirroring from the root URL
+	portable := resolveFilesystemCompat(m.config.Mirror.FilesystemCompat, targetDir)
+	if portable {
+		m.logger.Debug("Using portable filesystem naming", "path", targetDir)
+	}
+
+	// Take over data that was on disk before the first run instead of refetching it
+	if needsAdoption(targetDir) {
+		if _, err := m.adopt(ctx, target.Name, targetDir, false); err != nil {
+			return nil, err
+		}
+	}
+
+	// Directories a cut-short previous run did not get to go first
+	state, err := LoadTargetState(targetDir)
+	if err != nil {
+		m.logger.Warn("Discarding unreadable target state", "error", err)
+		state = &TargetState{}
+	}
+	priority, err := newPriorityRules(target.Priority, state.Unscheduled, state.OverBudget)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", target.Name, err)
+	}
+	if len(state.Unscheduled) > 0 {
+		m.logger.Info("Visiting directories left over by the previous run first", "directories", len(state.Unscheduled))
+	}
+	if len(state.OverBudget) > 0 {
+		m.logger.Info("Trying files that did not fit the byte budget first", "files", len(state.OverBudget))
+	}
+
+	manifest := m.loadManifest(targetDir)
 	stats := &MirrorStats{
-		StartTime: time.Now(),
-		Target:    target.Name,
+		StartTime:        start,
+		Target:           target.Name,
+		RunID:            runID,
+		ErrorsByClass:    make(map[string]int64),
+		ListingsByFormat: make(map[string]int64),
+		names:            newLocalNames(portable),
+		root:             targetDir,
+		runDir:           runDir,
+		previous:         previous,
+		adopted:          adoptedFiles(manifest),
+		clamped:          clampedFiles(manifest),
+		prune:            newPruneTracker(target),
+		digests:          newDigestIndex(manifest),
+		excluder:         excluder,
+		priority:         priority,
+		churn:            m.loadChurn(target, targetDir),
+		validators:       m.loadValidators(target, targetDir),
+		warnings:         newWarnThrottle(m.logger, m.config.Mirror.LogThrottle),
+		pacer:            &hostSlot{gap: target.GetWaitDuration()},
+		storage:          store,
+		progress:         newBootstrapProgress(state),
+		visited:          newVisitedURLs(),
+		budget:           newRunBudget(target),
 	}
 
-	err := m.mirrorURL(ctx, client, target, target.URL, targetDir, 0, stats)
+	if target.FileEvents != nil {
+		stats.fileEvents = newFileEventStream(m.logger, target, targetDir, runID, start)
+	}
+
+	// Create HTTP client for this target
+	clientOptions := []httpPkg.Option{httpPkg.WithStorage(store)}
+	if target.QuarantineMismatches {
+		clientOptions = append(clientOptions, httpPkg.WithQuarantine(quarantineDivert(target, targetDir)))
+	}
+	if target.ContentDispositionNames {
+		clientOptions = append(clientOptions, httpPkg.WithDispositionNames(func(url, localPath, filename string) string {
+			return m.dispositionPath(stats, target, url, localPath, filename)
+		}))
+	}
+	client := m.newClient(target, clientOptions...)
+
+	// Readers can tell that files may change under them until the run ends
+	marker, unmark := m.markSyncing(targetDir, target.Name, stats.StartTime)
+	defer unmark()
+
+	m.cleanupTempFiles(ctx, target, targetDir, stats)
+
+	stats.index = m.loadMetadataIndex(ctx, client, target, stats)
+
+	stats.warnings.Start()
+	m.startProgress(stats, marker)
+	fetches, runCtx := newFetchPool(ctx, target.Concurrency)
+	stats.fetches = fetches
+	rootURL := target.URL
+	if target.ListingFormat == listingFormatS3 {
+		if stats.s3, err = parseS3Target(target.URL); err == nil {
+			rootURL = stats.s3.dirURL("").String()
+		}
+	}
+	if err == nil {
+		err = m.mirrorTree(runCtx, client, target, rootURL, runDir, stats)
+	}
+	// A download stopping the run cancelled it, so its error takes precedence
+	if fetchErr := fetches.wait(); fetchErr != nil && (err == nil || errors.Is(err, context.Canceled)) {
+		err = fetchErr
+	}
+	// The budget may run out with the last directory, which ends the tree walk
+	// without error
+	if err == nil {
+		err = stats.budget.check()
+	}
+	stats.BudgetExceeded = stats.budget.exceededBudget()
+	stats.warnings.Stop()
+	m.stopProgress(stats)
+	if err == nil {
+		stats.seeDispositions()
+		m.prune(target, stats)
+	}
+	if stats.fileEvents != nil {
+		stats.FileEventsSent, stats.FileEventsDropped = stats.fileEvents.close()
+	}
+	redirects := client.Redirects()
+	stats.RedirectHosts, stats.BlockedRedirects = redirects.Followed, redirects.Blocked
+	transfers := client.Transfers()
+	stats.TransfersQueued, stats.PeakOpenTransfers = transfers.Queued, transfers.PeakOpen
 
 	stats.EndTime = time.Now()
 	stats.Duration = stats.EndTime.Sub(stats.StartTime)
+	if seconds := stats.Duration.Seconds(); seconds > 0 {
+		stats.BytesPerSecond = int64(float64(stats.BytesDownloaded) / seconds)
+	}
+	m.recordRun(targetDir, stats, err)
+	m.saveSources(targetDir, stats)
+	m.saveSkipReport(targetDir, stats)
+	m.saveChurn(targetDir, stats, err)
+	m.saveValidators(targetDir, stats, err)
+	if runDir != targetDir {
+		if err == nil {
+			m.finishDatedRun(target, targetDir, runDir)
+		} else {
+			m.logger.Warn("Dated directory of failed run is incomplete", "path", runDir)
+		}
+	}
+	if flushErr := m.usage.Flush(); flushErr != nil {
+		m.logger.Warn("Failed to save transfer accounting", "error", flushErr)
+	}
+	if errors.Is(err, ErrMonthlyCapReached) {
+		m.logger.Warn("Monthly byte cap reached, stopping run", "error", err)
+		m.emit(stats, Event{Type: EventMonthlyCapReached, Err: err})
+	}
+	if errors.Is(err, ErrBudgetExceeded) {
+		m.logger.Warn("Run budget exceeded, stopping run", "error", err)
+	}
 
 	m.logger.Info("Mirror completed for target",
-		"name", target.Name,
 		"duration", stats.Duration,
 		"files_downloaded", stats.FilesDownloaded,
 		"files_skipped", stats.FilesSkipped,
+		"files_skipped_size", stats.FilesSkippedSize,
+		"skip_reasons", stats.SkipReasons,
 		"bytes_downloaded", stats.BytesDownloaded,
-		"errors", stats.Errors)
+		"bytes_resumed", stats.BytesResumed,
+		"bytes_per_second", stats.BytesPerSecond,
+		"budget_exceeded", stats.BudgetExceeded,
+		"case_collisions", stats.CaseCollisions,
+		"errors", stats.Errors,
+		"errors_by_class", stats.ErrorsByClass,
+		"failure_signatures", stats.FailureSignatures,
+		"listings_by_format", stats.ListingsByFormat,
+		"empty_listings", stats.EmptyListings,
+		"unrecognized_listings", stats.UnrecognizedListings,
+		"limits_reached", stats.LimitsReached,
+		"directories_skipped", stats.DirectoriesSkipped,
+		"directories_reported", stats.DirectoriesReported,
+		"unscheduled_directories", len(stats.unscheduled),
+		"content_type_mismatches", stats.ContentTypeMismatches,
+		"files_relinked", stats.FilesRelinked,
+		"bytes_saved_by_relink", stats.BytesSavedByRelink,
+		"listings_avoided", stats.ListingsAvoided,
+		"files_checked_by_listing", stats.FilesCheckedByListing,
+		"listings_skipped_by_churn", stats.ListingsSkippedByChurn,
+		"listings_not_modified", stats.ListingsNotModified,
+		"duplicate_links", stats.DuplicateLinks,
+		"name_conflicts", stats.NameConflicts,
+		"files_named_by_header", stats.FilesNamedByHeader,
+		"revisited_urls", stats.RevisitedURLs,
+		"skew_tolerated", stats.SkewTolerated,
+		"files_verified", stats.FilesVerified,
+		"checksum_mismatches", stats.ChecksumMismatches,
+		"file_events_sent", stats.FileEventsSent,
+		"file_events_dropped", stats.FileEventsDropped,
+		"reclaimed_bytes", stats.ReclaimedBytes,
+		"future_mod_times", stats.FutureModTimes,
+		"files_deleted", stats.FilesDeleted,
+		"directories_deleted", stats.DirectoriesDeleted,
+		"retries", stats.Retries,
+		"listing_retries", stats.ListingRetries,
+		"unavailable_listings", stats.UnavailableListings,
+		"redirect_hosts", stats.RedirectHosts,
+		"blocked_redirects", stats.BlockedRedirects,
+		"transfers_queued", stats.TransfersQueued,
+		"peak_open_transfers", stats.PeakOpenTransfers)
+	m.reportFilters(stats)
+	if len(stats.BlockedRedirects) > 0 {
+		m.logger.Warn("Cross-host redirects were blocked; allowlist trusted hosts in redirectAllowHosts", "hosts", stats.BlockedRedirects)
+	}
 
-	return err
+	return stats, err
+}
+
+// newClient creates the HTTP client used for a target, logging to the logger of m
+func (m *Manager) newClient(target *config.Target, opts ...httpPkg.Option) *httpPkg.Client {
+	clientOptions := append([]httpPkg.Option{httpPkg.WithWriteOptions(httpPkg.WriteOptions{
+		BufferSize: int(httpPkg.ParseSize(m.config.Mirror.WriteBufferSize)),
+		SyncMode:   m.config.Mirror.SyncWrites,
+	}), httpPkg.WithLogger(m.logger)}, m.clientOptions...)
+	return httpPkg.NewClient(target, append(clientOptions, opts...)...)
+}
+
+// fileStorage returns the storage the run writes downloaded files to
+func (stats *MirrorStats) fileStorage() storage.Storage {
+	if stats.storage == nil {
+		return storage.NewLocal()
+	}
+	return stats.storage
+}
+
+// newStorage creates the storage backend downloaded files of target are written
+// to; targetDir is where the files would be on the local filesystem
+func (m *Manager) newStorage(target *config.Target, targetDir string) (storage.Storage, error) {
+	switch target.Storage {
+	case "", config.StorageLocal:
+		return storage.NewLocal(), nil
+	case config.StorageS3:
+		if target.S3 == nil {
+			return nil, fmt.Errorf("s3 storage requires s3.bucket")
+		}
+		prefix := target.S3.Prefix
+		if prefix == "" {
+			prefix = target.Name
+		}
+		var partSize int64
+		if target.S3.PartSize != "" {
+			if partSize = httpPkg.ParseSize(target.S3.PartSize); partSize <= 0 {
+				return nil, fmt.Errorf("invalid s3 part size %q", target.S3.PartSize)
+			}
+		}
+		return storage.NewS3(targetDir, storage.S3Options{
+			Bucket:          target.S3.Bucket,
+			Prefix:          prefix,
+			Region:          target.S3.Region,
+			Endpoint:        target.S3.Endpoint,
+			PathStyle:       target.S3.PathStyle,
+			PartSize:        partSize,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage %q", target.Storage)
+	}
 }
 
 // MirrorStats tracks mirroring statistics
 type MirrorStats struct {
-	StartTime       time.Time
-	EndTime         time.Time
-	Duration        time.Duration
-	Target          string
+	StartTime time.Time
+	EndTime   time.Time
+	Duration  time.Duration
+	Target    string
+	// RunID identifies the run in its log records, as "run_id", and in the
+	// manifest entries of the files it downloaded
+	RunID           string
 	FilesDownloaded int64
 	FilesSkipped    int64
 	BytesDownloaded int64
-	Errors          int64
+	// BytesResumed counts the bytes of interrupted downloads that were continued
+	// instead of being downloaded again; they are not part of BytesDownloaded
+	BytesResumed int64
+	// FilesSkippedSize counts the files outside Target.MinFileSize and
+	// Target.MaxFileSize, including downloads aborted for their size
+	FilesSkippedSize int64
+	// SkipReasons counts the files the run did not download per config.Skip* reason
+	SkipReasons map[string]int64
+	// NewestRemoteModTime is the newest upstream Last-Modified seen during the run
+	NewestRemoteModTime time.Time
+	CaseCollisions      int64
+	Errors              int64
+	// ListingsByFormat counts parsed HTML listings per detected generator
+	ListingsByFormat map[string]int64
+	// EmptyListings counts HTML listings without a single followable link
+	EmptyListings int64
+	// FailureSignatures counts the files the run failed to download by the class
+	// of their error, the host that answered and its server software
+	FailureSignatures map[string]int64
+	// BudgetExceeded is "bytes" or "files" if the run stopped at Target.MaxTotalBytes
+	// or Target.MaxTotalFiles; the counters tell what it downloaded until then
+	BudgetExceeded string
+	// UnrecognizedListings counts HTML responses without any anchors at all, which
+	// usually means the upstream switched to a page rendered by JavaScript
+	UnrecognizedListings int64
+	// LimitsReached counts how often each tree limit (e.g. "directories") truncated
+	// the run
+	LimitsReached map[string]int64
+	// ErrorsByClass counts reported failures per error class (e.g. "timeout"),
+	// exact even when the corresponding log lines are throttled
+	ErrorsByClass map[string]int64
+	// FilesRelinked counts new upstream paths created from identical files mirrored
+	// earlier, and BytesSavedByRelink the downloads this avoided
+	FilesRelinked      int64
+	BytesSavedByRelink int64
+	// DirectoriesSkipped counts directories excluded by ExcludeDirs; their listings
+	// were never fetched. ExcludedDirs lists the first of them with the pattern.
+	DirectoriesSkipped int64
+	ExcludedDirs       []ExcludedDir
+	// DirectoriesReported counts directories ExcludeDirs matched in filter report
+	// mode, which were mirrored anyway, and FilesReported the files found in them.
+	// ExcludedDirs lists them too, marked as reported.
+	DirectoriesReported int64
+	FilesReported       int64
+	// ContentTypeMismatches counts downloads whose content conflicts with their
+	// file extension; ContentMismatches lists the first of them
+	ContentTypeMismatches int64
+	ContentMismatches     []ContentMismatch
+	// ListingsAvoided counts directories mirrored from Target.MetadataIndex without
+	// fetching their listing
+	ListingsAvoided int64
+	// FilesCheckedByListing counts files found unchanged by the size and
+	// modification time their listing printed, without a file info request
+	FilesCheckedByListing int64
+	// ListingsSkippedByChurn counts directories whose listing had not changed for
+	// Target.ChurnSkipAfter runs and was mirrored from its recorded links instead
+	ListingsSkippedByChurn int64
+	// ListingsNotModified counts listings the upstream answered with 304 Not
+	// Modified to a conditional request, mirrored from their stored links
+	ListingsNotModified int64
+	// DuplicateLinks counts links skipped because the same listing already linked
+	// their URL, and NameConflicts links skipped because an earlier link of the
+	// listing maps to the same local file
+	DuplicateLinks int64
+	NameConflicts  int64
+	// FilesNamedByHeader counts files named by the filename of their
+	// Content-Disposition header with Target.ContentDispositionNames
+	FilesNamedByHeader int64
+	// SkewTolerated counts files not downloaded again because their upstream
+	// modification time lay no more than Target.MTimeTolerance past the local one
+	SkewTolerated int64
+	// FilesVerified counts downloads that matched their checksum list or MD5 ETag
+	// with Target.VerifyChecksums, and ChecksumMismatches those discarded because
+	// they still did not after all retries
+	FilesVerified      int64
+	ChecksumMismatches int64
+	// FileEventsSent counts the file events Target.FileEvents delivered to its
+	// webhook, and FileEventsDropped those given up on while it failed
+	FileEventsSent    int64
+	FileEventsDropped int64
+	// RevisitedURLs counts directories and files skipped because the run processed
+	// their URL before, e.g. as listings linked each other
+	RevisitedURLs int64
+	// ReclaimedBytes is the size of stale temporary files removed at the start of
+	// the run
+	ReclaimedBytes int64
+	// FutureModTimes counts files whose modification time lay beyond
+	// Mirror.FutureTimeTolerance in the future
+	FutureModTimes int64
+	// FilesDeleted and DirectoriesDeleted count what Target.Prune deleted because
+	// it disappeared upstream, or would have deleted with Target.PruneDryRun.
+	// FilesDeleted includes the files of deleted directories.
+	FilesDeleted       int64
+	DirectoriesDeleted int64
+	// Retries counts requests repeated after temporary failures, ListingRetries
+	// those of them that were listing requests, and UnavailableListings the
+	// listings that still failed with a server error. Any unavailable listing
+	// fails the run.
+	Retries             int64
+	ListingRetries      int64
+	UnavailableListings int64
+	// RedirectHosts counts the redirects followed per host redirected to, and
+	// BlockedRedirects those refused by the cross-host redirect policy
+	RedirectHosts    map[string]int64
+	BlockedRedirects map[string]int64
+	// TransfersQueued counts downloads that waited for a slot of the process-wide
+	// transfer limit, and PeakOpenTransfers is the most transfers of the process
+	// open at once that a download of the run saw
+	TransfersQueued   int64
+	PeakOpenTransfers int64
+	// BytesPerSecond is the throughput the run achieved, BytesDownloaded over its
+	// Duration, to compare the shares of the transfer slots targets running at
+	// once got by Target.TransferWeight
+	BytesPerSecond int64
+
+	names    *localNames
+	warnings *warnThrottle
+	// progress estimates the progress of the first run of a target; nil otherwise
+	progress *bootstrapProgress
+	// s3 is set while the target is mirrored from S3 bucket listings
+	s3 *s3Bucket
+	// root is the target directory and sources the origins of files downloaded
+	// during the run, keyed by path relative to root
+	root    string
+	sources map[string]FileSource
+	// skips are the files the run skipped, keyed like sources, with
+	// Mirror.ReportDetail "full"
+	skips map[string]SkippedFile
+	// runDir is the directory the run writes into: root, or a dated directory below
+	// it. previous is the dated directory unchanged files are linked from, if any.
+	runDir   string
+	previous string
+	// prune records what the run found upstream with Target.Prune, nil without it.
+	// pruned are the files deleted because they were gone, keyed like sources.
+	prune  *pruneTracker
+	pruned []string
+	// adopted holds the files adopted from a pre-existing tree, keyed like sources
+	adopted map[string]bool
+	// clamped holds the files of earlier runs whose future modification time was
+	// clamped, and clamps those clamped by the run, keyed like sources
+	clamped  map[string]FileSource
+	clamps   map[string]clampedTime
+	excluder *dirExcluder
+	// digests indexes files of earlier runs by content hash, and checksums holds
+	// the sums of upstream checksum lists by URL, for relinking moved files and
+	// Target.VerifyChecksums
+	digests   *digestIndex
+	checksums map[string]httpPkg.Digest
+	// index is the parsed Target.MetadataIndex, nil without one
+	index *metadataIndex
+	// visited holds the URLs the run processed
+	visited *visitedURLs
+	// failures lists the files the run failed to download with Mirror.ReportDetail
+	// "full", and attempts holds the start times of the failed requests by URL
+	failures map[string]FailedFile
+	attempts map[string][]time.Time
+	// budget enforces Target.MaxTotalBytes and Target.MaxTotalFiles; nil without them
+	budget *runBudget
+	// storage receives the downloaded files; the local filesystem if nil
+	storage storage.Storage
+	// pacer spaces the run's requests to hosts without coordination by
+	// WaitBetweenRequests
+	pacer *hostSlot
+	// priority orders the run by Target.Priority. scheduled counts the files
+	// scheduled so far, and orders holds the order of the files being fetched.
+	priority  *priorityRules
+	scheduled int64
+	orders    map[string]fileOrder
+	// fileEvents streams the files the run changes with Target.FileEvents; nil
+	// without it
+	fileEvents *fileEventStream
+	// dispositions maps the paths of files named by their Content-Disposition
+	// header to the URL they were downloaded from
+	dispositions map[string]string
+	// unscheduled are the directories the run did not get to, and overBudget the
+	// files it skipped for the byte budget, for the next run
+	unscheduled []string
+	overBudget  []string
+	// churn records the listings of the run and skips unchanged ones
+	churn *churnTracker
+	// validators requests listings conditionally with Target.ConditionalListings
+	validators *validatorTracker
+	// fetches downloads files concurrently with Target.Concurrency; nil downloads
+	// them one after another
+	fetches *fetchPool
+	// mu guards the maps, slices and times downloads update while fetches run
+	// concurrently; the counters they update are changed atomically. sinkMu
+	// serializes the events of the run.
+	mu     sync.Mutex
+	sinkMu sync.Mutex
 }
 
-// mirrorURL recursively mirrors a URL and its contents
-func (m *Manager) mirrorURL(ctx context.Context, client *httpPkg.Client, target *config.Target,
-	currentURL, localDir string, depth int, stats *MirrorStats,
+// warnFailure records a failure in the stats and logs it through the run's warning throttle
+func (m *Manager) warnFailure(stats *MirrorStats, msg, rawURL string, err error) {
+	if stats.ErrorsByClass != nil {
+		stats.mu.Lock()
+		stats.ErrorsByClass[classifyError(err)]++
+		stats.mu.Unlock()
+	}
+	m.emit(stats, Event{Type: EventError, URL: rawURL, Err: err})
+	if stats.warnings == nil {
+		m.logger.Warn(msg, "url", rawURL, "error", err)
+		return
+	}
+	stats.warnings.Warn(msg, rawURL, err)
+}
+
+// Limits reported in MirrorStats.LimitsReached
+const (
+	limitDirectories         = "directories"
+	limitEntriesPerDirectory = "entries_per_directory"
+	limitPathDepth           = "path_depth"
+)
+
+// limitReached records that a tree limit truncated the run and logs it
+func (m *Manager) limitReached(stats *MirrorStats, limit, rawURL string, args ...any) {
+	if stats.LimitsReached == nil {
+		stats.LimitsReached = make(map[string]int64)
+	}
+	stats.LimitsReached[limit]++
+	m.logger.Warn("Mirror limit reached, skipping the rest",
+		append([]any{"limit_name", limit, "url", rawURL}, args...)...)
+}
+
+// dirJob is a URL waiting to be mirrored into localDir
+type dirJob struct {
+	url      string
+	localDir string
+	// rel is the remote path of the directory relative to the target URL
+	rel   string
+	depth int
+	// reported is set below a directory matched by ExcludeDirs in report mode
+	reported bool
+	// rank orders the visit by Target.Priority, and subtreeRank is the best rank
+	// the entries below the directory get because of the pattern rule
+	rank        int
+	subtreeRank int
+	rule        string
+}
+
+// mirrorTree mirrors rootURL and everything below it into rootDir. Directories are
+// visited depth-first from explicit stacks instead of by recursion, so deep trees
+// cost neither call stack nor open responses per level; directories ranked higher
+// by Target.Priority go first. Failures below the root are counted and logged; an
+// error is only returned if the root fails, ctx ends or listings were unavailable
+// because of upstream server errors. Directories a run cut short did not visit are
+// recorded for the next run to visit first.
+func (m *Manager) mirrorTree(ctx context.Context, client *httpPkg.Client, target *config.Target,
+	rootURL, rootDir string, stats *MirrorStats,
 ) error {
+	maxDirectories := m.config.Mirror.MaxDirectories
+	if stats.priority == nil {
+		stats.priority = &priorityRules{}
+	}
+	lowest := stats.priority.lowest()
+	stack := newDirQueue(lowest)
+	stack.push(dirJob{url: rootURL, localDir: rootDir, subtreeRank: lowest})
+	var current *dirJob
+	defer func() { stats.unscheduled = stack.unscheduled(current) }()
+	visited := 0
+	// consecutive counts unavailable listings since the last successful one
+	consecutive := 0
+	var lastUnavailable error
+	done := func() error {
+		if lastUnavailable != nil {
+			return unavailableError(stats, lastUnavailable)
+		}
+		return nil
+	}
+
+	for stack.len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := m.usage.check(0); err != nil {
+			return err
+		}
+		if err := stats.budget.check(); err != nil {
+			return err
+		}
+
+		if maxDirectories > 0 && visited >= maxDirectories {
+			m.limitReached(stats, limitDirectories, rootURL, "limit", maxDirectories, "skipped_directories", stack.len())
+			return done()
+		}
+		visited++
+
+		job, _ := stack.pop()
+		current = &job
+
+		// Records of the directory, including those of the client, carry its depth
+		dm := m.withLogger(m.logger.With("depth", job.depth))
+		subdirs, err := dm.mirrorURL(httpPkg.ContextWithLogger(ctx, dm.logger), client, target, job, stats)
+		if isUnavailable(err) {
+			stats.UnavailableListings++
+			consecutive++
+			lastUnavailable = err
+		} else if err == nil {
+			consecutive = 0
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			var storageErr *StorageError
+			if job.depth == 0 || errors.Is(err, ErrMonthlyCapReached) || errors.Is(err, ErrBudgetExceeded) || errors.As(err, &storageErr) {
+				return err
+			}
+			if consecutive >= listingBreakerThreshold {
+				m.logger.Warn("Upstream keeps failing directory listings, stopping run",
+					"url", job.url, "consecutive", consecutive, "skipped_directories", stack.len())
+				return unavailableError(stats, err)
+			}
+			m.warnFailure(stats, "Failed to mirror subdirectory", job.url, err)
+			current = nil
+			continue
+		}
+		current = nil
+
+		// Push in reverse so that subdirectories are visited in listing order
+		for i := len(subdirs) - 1; i >= 0; i-- {
+			stack.push(subdirs[i])
+		}
+	}
+
+	return done()
+}
+
+// mirrorURL mirrors a single URL: files of a directory listing are downloaded and
+// its subdirectories are returned for the caller to visit
+func (m *Manager) mirrorURL(ctx context.Context, client *httpPkg.Client, target *config.Target,
+	job dirJob, stats *MirrorStats,
+) ([]dirJob, error) {
+	currentURL, localDir, depth := job.url, job.localDir, job.depth
+
 	// Check depth limit (-1 means unlimited)
 	if target.MaxDepth >= 0 && depth >= target.MaxDepth {
-		return nil
+		return nil, nil
 	}
 
 	// Check context cancellation
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	default:
 	}
 
-	// Wait between requests if configured
-	if depth > 0 && target.WaitBetweenRequests > 0 {
-		time.Sleep(target.GetWaitDuration())
-	}
-
 	m.logger.Debug("Processing URL", "url", currentURL, "depth", depth)
 
 	// Parse the URL
 	parsedURL, err := url.Parse(currentURL)
 	if err != nil {
-		stats.Errors++
-		return fmt.Errorf("failed to parse URL %s: %w", currentURL, err)
+		atomic.AddInt64(&stats.Errors, 1)
+		return nil, fmt.Errorf("failed to parse URL %s: %w", currentURL, err)
 	}
 
-	// Try to get directory listing
-	resp, err := m.fetchDirectoryListing(ctx, client, currentURL)
+	// Listings linking each other or back up the tree would make the run mirror
+	// the same directory again on every level
+	if !stats.visited.visit(parsedURL, true) {
+		atomic.AddInt64(&stats.RevisitedURLs, 1)
+		m.logger.Debug("Skipping directory visited before", "url", currentURL)
+		return nil, nil
+	}
+
+	// Directories described by the metadata index need no listing request
+	if links, ok := stats.index.links(job.rel); ok {
+		stats.ListingsAvoided++
+		return m.mirrorLinks(ctx, client, target, job, parsedURL, links, nil, stats)
+	}
+
+	// Directories whose listing rarely changes are mirrored from their last listing
+	if links, ok := stats.churn.skip(job.rel); ok {
+		stats.ListingsSkippedByChurn++
+		m.logger.Debug("Listing unchanged for a while, using the recorded links", "url", currentURL)
+		return m.mirrorLinks(ctx, client, target, job, parsedURL, links, nil, stats)
+	}
+
+	// Buckets are listed by prefix through their endpoint
+	if stats.s3 != nil {
+		return m.mirrorS3Dir(ctx, client, target, job, stats)
+	}
+
+	// Try to get directory listing; the host slot is held until the listing is consumed
+	release, err := m.acquire(ctx, stats, currentURL)
 	if err != nil {
-		stats.Errors++
-		return fmt.Errorf("failed to fetch directory listing from %s: %w", currentURL, err)
+		return nil, err
+	}
+	defer release()
+
+	stored := stats.validators.conditional(job.rel)
+	resp, err := m.fetchListingWithRetry(ctx, client, target, currentURL, stored, stats)
+	if err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		return nil, fmt.Errorf("failed to fetch directory listing from %s: %w", currentURL, err)
 	}
 	defer resp.Body.Close()
 
+	// So would a directory redirecting to one visited before, e.g. its parent
+	if final := resp.Request; final != nil && canonicalURL(final.URL, true) != canonicalURL(parsedURL, true) &&
+		!stats.visited.visit(final.URL, true) {
+		atomic.AddInt64(&stats.RevisitedURLs, 1)
+		m.logger.Debug("Skipping directory redirecting to one visited before", "url", currentURL, "location", final.URL.String())
+		return nil, nil
+	}
+
+	// An unchanged listing is mirrored from the links stored with its validators
+	if resp.StatusCode == http.StatusNotModified && stored != nil {
+		release()
+		stats.ListingsNotModified++
+		m.logger.Debug("Listing not modified, using the stored links", "url", currentURL)
+		stats.validators.notModified(job.rel)
+		stats.churn.observe(job.rel, stored.Links)
+		return m.mirrorLinks(ctx, client, target, job, listingBase(parsedURL, depth), stored.Links, nil, stats)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		atomic.AddInt64(&stats.Errors, 1)
+		return nil, &httpPkg.StatusError{Method: "GET", URL: currentURL, Code: resp.StatusCode}
+	}
+
 	// Check if this looks like a directory listing
 	contentType := resp.Header.Get("Content-Type")
 	m.logger.Debug("Fetched URL", "url", currentURL, "contentType", contentType)
 
-	if strings.Contains(contentType, "text/html") {
-		// Parse HTML to find links
-		links, err := m.parseDirectoryListing(resp, currentURL)
+	// The root of an S3 bucket answers with a listing of its keys, which is
+	// listed again by prefix
+	if depth == 0 && isS3Listing(target, contentType, resp.Body) {
+		release()
+		if stats.s3, err = parseS3Target(currentURL); err != nil {
+			return nil, err
+		}
+		m.logger.Info("Target URL is an S3 bucket, listing it by prefix", "url", currentURL)
+		return m.mirrorS3Dir(ctx, client, target, job, stats)
+	}
+
+	jsonListing := isJSONListing(target, currentURL, contentType)
+	if strings.Contains(contentType, "text/html") || jsonListing {
+		// Parse HTML or nginx JSON to find links
+		var listing *listingResult
+		if jsonListing {
+			listing, err = m.parseJSONListing(resp, currentURL)
+		} else {
+			listing, err = m.parseDirectoryListing(resp, currentURL, target.FollowsAbsoluteSameHost())
+		}
+		release()
 		if err != nil {
-			m.logger.Warn("Failed to parse directory listing", "url", currentURL, "error", err)
-			stats.Errors++
-			return nil
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			m.warnFailure(stats, "Failed to parse directory listing", currentURL, err)
+			atomic.AddInt64(&stats.Errors, 1)
+			return nil, nil
 		}
+		links := listing.Links
 
-		m.logger.Debug("Parsed directory listing", "url", currentURL, "linkCount", len(links))
+		m.recordListing(stats, currentURL, listing)
+		if len(links) > 0 {
+			stats.churn.observe(job.rel, links)
+			stats.validators.received(job.rel, resp.Header, links)
+		}
 
-		// If no links found, treat as a direct file
+		// If no links found, treat as a direct file; a JSON listing is never a file
+		if len(links) == 0 && jsonListing {
+			return m.mirrorLinks(ctx, client, target, job, parsedURL, nil, nil, stats)
+		}
 		if len(links) == 0 {
-			filename := filepath.Base(parsedURL.Path)
-			if filename == "" || filename == "." {
+			filename := path.Base(parsedURL.Path)
+			if filename == "" || filename == "." || filename == "/" {
 				filename = "index.html"
 			}
-			localPath := filepath.Join(localDir, filename)
+			localPath := filepath.Join(localDir, m.localName(localDir, filename, stats))
 			m.logger.Debug("No links found, treating as direct file", "url", currentURL, "filename", filename)
-			if err := m.downloadFile(ctx, client, currentURL, localPath, stats); err != nil {
-				m.logger.Warn("Failed to download file", "url", currentURL, "error", err)
-			}
-			return nil
+			return nil, m.fetchFile(ctx, client, currentURL, localPath, stats)
 		}
 
-		// Process each link
-		for _, link := range links {
-			linkURL, err := url.Parse(link)
-			if err != nil {
-				continue
-			}
+		if base := listingBase(parsedURL, depth); base != parsedURL {
+			m.logger.Info("Target URL is a directory listing, resolving its links as a directory", "url", currentURL, "base", base.String())
+			parsedURL = base
+		}
+
+		return m.mirrorLinks(ctx, client, target, job, parsedURL, links, listing.Entries, stats)
+	} else {
+		// This is a direct file - download it
+		release()
+		filename := path.Base(parsedURL.Path)
+		if filename == "" || filename == "." || filename == "/" {
+			filename = "index.html"
+		}
+		localPath := filepath.Join(localDir, m.localName(localDir, filename, stats))
+		m.logger.Debug("Downloading direct file", "url", currentURL, "filename", filename, "localPath", localPath)
+		return nil, m.fetchFile(ctx, client, currentURL, localPath, stats)
+	}
+}
 
-			// Resolve relative URLs
-			absoluteURL := parsedURL.ResolveReference(linkURL).String()
+// listingBase returns the URL the links of the listing at parsedURL are resolved
+// against. Links to subdirectories end in a slash, only the target URL may lack it.
+func listingBase(parsedURL *url.URL, depth int) *url.URL {
+	if depth == 0 && !strings.HasSuffix(parsedURL.Path, "/") {
+		return directoryBase(parsedURL)
+	}
+	return parsedURL
+}
 
-			// Skip parent directory links
-			if strings.Contains(link, "..") || strings.Contains(link, "Parent Directory") {
-				continue
-			}
+// mirrorLinks downloads the files among the links of the directory of job and
+// returns its subdirectories for the caller to visit. entries holds the metadata
+// the listing printed next to the links, if it was fetched.
+func (m *Manager) mirrorLinks(ctx context.Context, client *httpPkg.Client, target *config.Target,
+	job dirJob, parsedURL *url.URL, links []string, entries []listingEntry, stats *MirrorStats,
+) ([]dirJob, error) {
+	localDir, depth := job.localDir, job.depth
+	listed := listingEntries(links, entries)
+	if !target.AllowQueryStrings {
+		links = stripLinkQueries(links)
+	}
+	links = m.dedupeLinks(parsedURL, links, stats)
+	complete := true
+	if limit := m.config.Mirror.MaxEntriesPerDirectory; limit > 0 && len(links) > limit {
+		m.limitReached(stats, limitEntriesPerDirectory, job.url, "limit", limit, "entries", len(links))
+		links = links[:limit]
+		complete = false
+	}
 
-			// Determine if this is a directory or file
-			if strings.HasSuffix(link, "/") {
-				// It's a directory - recurse
-				dirName := strings.TrimSuffix(link, "/")
+	// Different links may still map to the same local file; the first one wins
+	claimed := make(map[string]string)
+	listingDir := parsedURL.Path[:strings.LastIndex(parsedURL.Path, "/")+1]
+	var subdirs []dirJob
+	for _, link := range stats.priority.orderLinks(job, links) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-				// Security: Validate directory name
-				if !isValidFilename(dirName) {
-					m.logger.Warn("Skipping invalid directory name", "name", dirName)
-					continue
-				}
+		// Resolve relative URLs; links leaving the listing's directory are not followed
+		resolved, ok := resolveListingLink(parsedURL, link)
+		if !ok {
+			m.logger.Debug("Skipping link outside the listed directory", "url", job.url, "link", link)
+			continue
+		}
+		absoluteURL := resolved.String()
+		linkPath := linkPath(link)
 
-				subDir := filepath.Join(localDir, dirName)
+		// Determine if this is a directory or file
+		if strings.HasSuffix(linkPath, "/") {
+			// It's a directory - queue it
+			dirName := linkName(strings.TrimSuffix(linkPath, "/"))
+			stats.prune.seeDir(filepath.Join(localDir, dirName))
 
-				// Security: Ensure the path stays within bounds
-				if !strings.HasPrefix(subDir, localDir) {
-					m.logger.Warn("Skipping directory outside bounds", "path", subDir)
-					stats.Errors++
-					continue
-				}
+			if limit := m.config.Mirror.MaxPathDepth; limit > 0 && depth+1 > limit {
+				m.limitReached(stats, limitPathDepth, absoluteURL, "limit", limit)
+				continue
+			}
 
-				if err := os.MkdirAll(subDir, 0755); err != nil {
-					stats.Errors++
-					continue
-				}
+			if config.IsHidden(target.Hidden, dirName) {
+				m.logger.Debug("Skipping hidden directory", "url", absoluteURL)
+				continue
+			}
 
-				if err := m.mirrorURL(ctx, client, target, absoluteURL, subDir, depth+1, stats); err != nil {
-					m.logger.Warn("Failed to mirror subdirectory", "url", absoluteURL, "error", err)
-				}
-			} else {
-				// It's a file - download it
-				filename := filepath.Base(link)
+			// Security: Validate directory name
+			if !isValidFilename(dirName) {
+				m.logger.Warn("Skipping invalid directory name", "error", &PathSecurityError{Name: dirName, Reason: "invalid directory name"})
+				continue
+			}
 
-				// Security: Validate filename
-				if !isValidFilename(filename) {
-					m.logger.Warn("Skipping invalid filename", "name", filename)
-					continue
-				}
+			subDir := filepath.Join(localDir, m.localName(localDir, dirName, stats))
+			stats.prune.seeDir(subDir)
 
-				localPath := filepath.Join(localDir, filename)
+			// Security: Ensure the path stays within bounds
+			if !isWithinDir(localDir, subDir) {
+				m.warnFailure(stats, "Skipping directory outside bounds", absoluteURL, &PathSecurityError{Name: subDir, Reason: "outside target directory"})
+				atomic.AddInt64(&stats.Errors, 1)
+				continue
+			}
 
-				// Security: Ensure the path stays within bounds
-				if !strings.HasPrefix(localPath, localDir) {
-					m.logger.Warn("Skipping file outside bounds", "path", localPath)
-					stats.Errors++
+			rel := path.Join(job.rel, dirName)
+			rank, subtreeRank, rule := stats.priority.dirRank(rel, job.subtreeRank, job.rule)
+			reported := job.reported
+			if pattern, ok := stats.excluder.match(rel); ok && !reported {
+				if m.excludeDir(stats, stats.excluder, rel, pattern, subDir) {
 					continue
 				}
+				reported = true
+			}
 
-				if err := m.downloadFile(ctx, client, absoluteURL, localPath, stats); err != nil {
-					m.logger.Warn("Failed to download file", "url", absoluteURL, "error", err)
+			if err := stats.fileStorage().MkdirAll(subDir); err != nil {
+				atomic.AddInt64(&stats.Errors, 1)
+				if storageErr := asStorageError(subDir, err); storageErr != nil {
+					return nil, storageErr
 				}
+				continue
 			}
-		}
-	} else {
-		// This is a direct file - download it
-		filename := filepath.Base(parsedURL.Path)
-		if filename == "" || filename == "." || filename == "/" {
-			filename = "index.html"
-		}
-		localPath := filepath.Join(localDir, filename)
-		m.logger.Debug("Downloading direct file", "url", currentURL, "filename", filename, "localPath", localPath)
-		if err := m.downloadFile(ctx, client, currentURL, localPath, stats); err != nil {
-			m.logger.Warn("Failed to download file", "url", currentURL, "error", err)
-		}
-	}
 
-	return nil
-}
+			subdirs = append(subdirs, dirJob{url: absoluteURL, localDir: subDir, rel: rel, depth: depth + 1,
+				reported: reported, rank: rank, subtreeRank: subtreeRank, rule: rule})
+		} else {
+			// It's a file - download it
+			filename := linkName(path.Base(linkPath))
 
-// fetchDirectoryListing fetches a directory listing
-func (m *Manager) fetchDirectoryListing(ctx context.Context, client *httpPkg.Client, url string) (*http.Response, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
+			// A file linked into a subdirectory, e.g. as "sub/file.iso", is stored
+			// where the listing of that directory would store it
+			fileDir, fileRel := localDir, job.rel
+			if dir := path.Dir(strings.TrimPrefix(path.Clean(resolved.Path), listingDir)); dir != "." {
+				var err error
+				if fileDir, fileRel, ok, err = m.linkedSubdir(target, stats, localDir, job.rel, dir); err != nil {
+					return nil, err
+				} else if !ok {
+					m.logger.Debug("Skipping link to a file in a skipped subdirectory", "url", job.url, "link", link)
+					continue
+				}
+			}
+			stats.prune.seeFile(filepath.Join(fileDir, filename))
 
-	req.Header.Set("User-Agent", client.GetUserAgent())
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+			if config.IsHidden(target.Hidden, filename) {
+				m.logger.Debug("Skipping hidden file", "url", absoluteURL)
+				m.skipped(stats, absoluteURL, filepath.Join(fileDir, filename), config.SkipExcluded)
+				continue
+			}
 
-	return client.DoRequest(req)
-}
+			// Security: Validate filename
+			if !isValidFilename(filename) {
+				m.logger.Warn("Skipping invalid filename", "error", &PathSecurityError{Name: filename, Reason: "invalid file name"})
+				continue
+			}
 
-// parseDirectoryListing parses HTML directory listing to extract links
-func (m *Manager) parseDirectoryListing(resp *http.Response, baseURL string) ([]string, error) {
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+			localPath := filepath.Join(fileDir, m.localName(fileDir, filename, stats))
+			stats.prune.seeFile(localPath)
 
-	content := string(body)
-	var links []string
+			// Security: Ensure the path stays within bounds
+			if !isWithinDir(localDir, localPath) {
+				m.warnFailure(stats, "Skipping file outside bounds", absoluteURL, &PathSecurityError{Name: localPath, Reason: "outside target directory"})
+				atomic.AddInt64(&stats.Errors, 1)
+				continue
+			}
 
-	// Pattern to match href links in directory listings
-	// This is a simple regex - could be improved with proper HTML parsing
-	linkPattern := regexp.MustCompile(`href=["']([^"']+)["']`)
-	matches := linkPattern.FindAllStringSubmatch(content, -1)
+			// Links to a download endpoint differ by their query string, and the
+			// upstream names their files
+			claim := localPath
+			if target.ContentDispositionNames && resolved.RawQuery != "" {
+				claim += "?" + resolved.RawQuery
+			}
+			if first, ok := claimed[claim]; ok {
+				stats.NameConflicts++
+				m.logger.Warn("Skipping link to a file already mirrored from another URL",
+					"url", absoluteURL, "path", localPath, "mirrored_from", first)
+				continue
+			}
+			claimed[claim] = absoluteURL
+			if !stats.visited.visit(resolved, false) {
+				atomic.AddInt64(&stats.RevisitedURLs, 1)
+				m.logger.Debug("Skipping file processed before", "url", absoluteURL)
+				continue
+			}
+			if job.reported {
+				stats.FilesReported++
+			}
+			order := stats.schedule(path.Join(fileRel, filename), job)
 
-	for _, match := range matches {
-		if len(match) > 1 {
-			link := match[1]
+			// The first run estimates its progress from the sizes printed for the files
+			size, slack := int64(-1), int64(0)
+			entry, inListing := listed[linkPath]
+			if inListing {
+				size, slack = entry.Size, entry.sizeSlack
+			}
+			indexed, inIndex := stats.index.file(fileRel, path.Base(linkPath))
+			if inIndex {
+				size, slack = indexed.Size, 0
+			}
+			stats.progress.discover(size)
 
-			// Skip certain links (security: prevent various types of malicious links)
-			if strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") ||
-				strings.HasPrefix(link, "mailto:") || strings.HasPrefix(link, "ftp://") ||
-				strings.HasPrefix(link, "javascript:") || strings.HasPrefix(link, "data:") || strings.HasPrefix(link, "vbscript:") ||
-				strings.HasPrefix(link, "#") || link == "/" || link == "./" {
+			// Files certainly outside the size range are skipped on what the listing
+			// printed, within the rounding of sizes like "1.2M"
+			if size >= 0 && client.CheckSize(absoluteURL, size-slack) != nil && client.CheckSize(absoluteURL, size+slack) != nil {
+				stats.progress.finish(size, false)
+				m.skippedSize(stats, absoluteURL, localPath, client.CheckSize(absoluteURL, size))
 				continue
 			}
 
-			// Security: Comprehensive path traversal prevention
-			if strings.Contains(link, "..") ||
-				strings.HasPrefix(link, "../") ||
-				strings.Contains(link, "/..") ||
-				strings.HasSuffix(link, "/..") ||
-				link == ".." {
+			// The index tells unchanged files apart without a request
+			if inIndex && indexed.upToDate(stats.fileStorage(), localPath) {
+				m.logger.Debug("File is up to date according to metadata index, skipping", "path", localPath)
+				stats.progress.finish(size, false)
+				atomic.AddInt64(&stats.FilesSkipped, 1)
+				m.skipped(stats, absoluteURL, localPath, config.SkipUnchanged)
+				m.emit(stats, Event{Type: EventFileSkipped, URL: absoluteURL, Path: localPath})
 				continue
 			}
 
-			// Skip common non-content links
-			if strings.Contains(strings.ToLower(link), "parent") ||
-				strings.Contains(strings.ToLower(link), "back") ||
-				strings.Contains(link, "?") || strings.Contains(link, "&") {
+			// So does the size and time the listing printed, sparing the file info request
+			if inListing && (target.CheckChanges || stats.isAdopted(localPath)) &&
+				entry.upToDate(stats.fileStorage(), localPath) {
+				m.logger.Debug("File is up to date according to the listing, skipping", "path", localPath)
+				stats.progress.finish(size, false)
+				atomic.AddInt64(&stats.FilesCheckedByListing, 1)
+				atomic.AddInt64(&stats.FilesSkipped, 1)
+				m.skipped(stats, absoluteURL, localPath, config.SkipUnchanged)
+				m.emit(stats, Event{Type: EventFileSkipped, URL: absoluteURL, Path: localPath})
 				continue
 			}
 
-			// Security: Skip empty or suspicious links
-			if link == "" || strings.TrimSpace(link) == "" {
+			fetch := func() error {
+				defer stats.fetching(localPath, order)()
+				defer stats.progress.finish(size, true)
+				return m.fetchFile(ctx, client, absoluteURL, localPath, stats)
+			}
+
+			// The files following a checksum list are verified against it, so it is
+			// fetched before them
+			if isChecksumFile(filename) {
+				if err := fetch(); err != nil {
+					return nil, err
+				}
+				m.loadChecksums(stats, parsedURL, localPath)
 				continue
 			}
+			if err := stats.fetches.submit(ctx, fetch); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if complete {
+		stats.prune.listedDir(localDir)
+	}
+	return subdirs, nil
+}
 
-			links = append(links, link)
+// linkedSubdir returns the local directory and relative path of dir, the
+// subdirectory of localDir a file link points into, and creates it. It reports
+// false if a directory on the way is hidden, invalid or excluded.
+func (m *Manager) linkedSubdir(target *config.Target, stats *MirrorStats, localDir, rel, dir string) (string, string, bool, error) {
+	for _, name := range strings.Split(dir, "/") {
+		if config.IsHidden(target.Hidden, name) || !isValidFilename(name) {
+			return "", "", false, nil
 		}
+		subDir := filepath.Join(localDir, m.localName(localDir, name, stats))
+		if !isWithinDir(localDir, subDir) {
+			return "", "", false, nil
+		}
+		localDir, rel = subDir, path.Join(rel, name)
+		stats.prune.seeDir(localDir)
+		if _, excluded := stats.excluder.match(rel); excluded {
+			return "", "", false, nil
+		}
+	}
+
+	if err := stats.fileStorage().MkdirAll(localDir); err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		if storageErr := asStorageError(localDir, err); storageErr != nil {
+			return "", "", false, storageErr
+		}
+		return "", "", false, nil
+	}
+	return localDir, rel, true, nil
+}
+
+// dedupeLinks drops links of a listing that resolve to the same URL as an earlier
+// one, such as the icon and name anchors of Apache listings. Fragments are ignored.
+func (m *Manager) dedupeLinks(base *url.URL, links []string, stats *MirrorStats) []string {
+	seen := make(map[string]bool, len(links))
+	unique := links[:0:0]
+	for _, link := range links {
+		key := link
+		if linkURL, err := url.Parse(link); err == nil {
+			resolved := base.ResolveReference(linkURL)
+			resolved.Fragment = ""
+			key = resolved.String()
+		}
+		if seen[key] {
+			stats.DuplicateLinks++
+			m.logger.Debug("Skipping duplicate link", "url", key)
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, link)
+	}
+	return unique
+}
+
+// fetchDirectoryListing fetches a directory listing, conditionally on stored if set
+func (m *Manager) fetchDirectoryListing(ctx context.Context, client *httpPkg.Client, url string, stored *ListingValidator) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return links, nil
+	req.Header.Set("User-Agent", client.GetUserAgent())
+	switch client.GetConfig().ListingFormat {
+	case listingFormatNginxJSON:
+		req.Header.Set("Accept", "application/json")
+	case listingFormatS3:
+		req.Header.Set("Accept", "application/xml")
+	default:
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	}
+	setConditional(req, stored)
+
+	return client.DoRequest(req)
 }
 
 // isValidFilename checks if a filename is safe for mirroring (minimal filtering for old file compatibility)
 func isValidFilename(filename string) bool {
-	// Reject empty names
-	if filename == "" || strings.TrimSpace(filename) == "" {
+	// Reject empty names and the directory itself
+	if filename == "" || strings.TrimSpace(filename) == "" || filename == "." {
+		return false
+	}
+
+	// Only reject clear path traversal attempts - keep it minimal for old files,
+	// which may well be named like "foo..bar.tar". Both separators are rejected
+	// regardless of the host OS.
+	if filename == ".." || strings.ContainsAny(filename, `/\`) {
+		return false
+	}
+
+	// NUL and other control characters are never part of a name worth mirroring
+	if hasControlChars(filename) {
 		return false
 	}
 
-	// Only reject clear path traversal attempts - keep it minimal for old files
-	if strings.Contains(filename, "..") ||
-		strings.Contains(filename, "/") ||
-		strings.Contains(filename, "\\") {
+	// Reject names the host OS would interpret as a volume or absolute path (e.g. "C:")
+	if filepath.VolumeName(filename) != "" || filepath.IsAbs(filename) {
 		return false
 	}
 
 	return true
 }
 
+// localName maps a remote name to the name used on disk inside localDir
+func (m *Manager) localName(localDir, remoteName string, stats *MirrorStats) string {
+	name, renamed := stats.names.resolve(localDir, remoteName)
+	if renamed {
+		stats.CaseCollisions++
+		m.logger.Warn("Renamed file to avoid filesystem name collision",
+			"dir", localDir, "remote_name", remoteName, "local_name", name)
+	}
+	return name
+}
+
+// acquire waits until a request to rawURL may start. Hosts shared with other targets
+// are paced by the host coordinator, all others by the run's WaitBetweenRequests.
+// The returned release function must be called once the request is finished.
+func (m *Manager) acquire(ctx context.Context, stats *MirrorStats, rawURL string) (func(), error) {
+	if m.hosts.coordinates(rawURL) {
+		return m.hosts.acquire(ctx, rawURL)
+	}
+	if err := stats.pacer.delay(ctx); err != nil {
+		return func() {}, err
+	}
+	return func() {}, nil
+}
+
+// fetchFile downloads a file found while mirroring. Failures are counted and logged;
+// only the end of ctx, an exhausted monthly budget or failing storage is returned,
+// to stop the run. An exhausted run budget lets the downloads in progress finish
+// and stops the run once its current directory is done.
+func (m *Manager) fetchFile(ctx context.Context, client *httpPkg.Client, url, localPath string, stats *MirrorStats) error {
+	err := m.downloadFile(ctx, client, url, localPath, stats)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	if errors.Is(err, ErrMonthlyCapReached) {
+		return err
+	}
+	if errors.Is(err, ErrBudgetExceeded) {
+		return nil
+	}
+	if storageErr := asStorageError(localPath, err); storageErr != nil {
+		return storageErr
+	}
+	if err != nil {
+		m.failed(stats, url, localPath, err)
+		m.warnFailure(stats, "Failed to download file", url, err)
+	}
+	return nil
+}
+
 // downloadFile downloads a single file
 func (m *Manager) downloadFile(ctx context.Context, client *httpPkg.Client, url, localPath string, stats *MirrorStats) error {
-	// Check if file needs updating
-	if client.GetConfig().CheckChanges {
-		remoteInfo, err := client.CheckFileInfo(ctx, url)
+	if err := m.usage.check(0); err != nil {
+		return m.skippedForBudget(stats, url, localPath, err)
+	}
+	if err := stats.budget.check(); err != nil {
+		return m.skippedForBudget(stats, url, localPath, err)
+	}
+	// Files an earlier run named by their Content-Disposition header are checked
+	// under that name
+	target, linkPath := client.GetConfig(), localPath
+	if target.ContentDispositionNames {
+		if named := m.recordedDisposition(stats, target, url, localPath); named != "" {
+			localPath = named
+		}
+	}
+
+	// Check if file needs updating; adopted files are always checked so that data
+	// taken over from an existing tree is not downloaded again when unchanged
+	var remoteInfo *httpPkg.FileInfo
+	if client.GetConfig().CheckChanges || stats.isAdopted(localPath) || stats.previousCopy(localPath) != "" {
+		var info *httpPkg.FileInfo
+		err := m.withRetries(ctx, stats, client.GetConfig().Retries, "file info request", url, func() error {
+			release, err := m.acquire(ctx, stats, url)
+			if err != nil {
+				return err
+			}
+			defer release()
+			info, err = client.CheckFileInfo(ctx, url)
+			return err
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			// If we can't check, try to download anyway
 			m.logger.Debug("Could not check file info, downloading anyway", "url", url, "error", err)
 		} else {
-			needsUpdate, err := client.NeedsUpdate(localPath, remoteInfo)
+			remoteInfo = info
+			if target.ContentDispositionNames && info.Filename != "" {
+				if named := m.dispositionPath(stats, target, url, localPath, info.Filename); named != "" {
+					localPath = named
+				}
+			}
+			stats.mu.Lock()
+			if remoteInfo.LastModified.After(stats.NewestRemoteModTime) {
+				stats.NewestRemoteModTime = remoteInfo.LastModified
+			}
+			stats.mu.Unlock()
+
+			// Links differing by their query string share the file of their path
+			// until the upstream names theirs, so that file tells nothing
+			var needsUpdate bool
+			if target.ContentDispositionNames && localPath == linkPath && strings.Contains(url, "?") {
+				needsUpdate = true
+			} else {
+				needsUpdate, err = m.needsUpdate(client, stats, localPath, remoteInfo)
+			}
 			if err != nil {
 				m.logger.Debug("Could not check if file needs update, downloading anyway", "path", localPath, "error", err)
 			} else if !needsUpdate {
 				m.logger.Debug("File is up to date, skipping", "path", localPath)
-				stats.FilesSkipped++
+				m.checkFutureTime(stats, localPath, remoteInfo.ETag)
+				atomic.AddInt64(&stats.FilesSkipped, 1)
+				m.skipped(stats, url, localPath, config.SkipUnchanged)
+				m.emit(stats, Event{Type: EventFileSkipped, URL: url, Path: localPath})
 				return nil
 			}
 		}
 	}
 
+	// A size the HEAD request announced outside the size range is skipped
+	if remoteInfo != nil && remoteInfo.Size > 0 {
+		if err := client.CheckSize(url, remoteInfo.Size); err != nil {
+			return m.skippedSize(stats, url, localPath, err)
+		}
+	}
+
+	// Unchanged data of a dated layout is taken from the previous run
+	if m.linkUnchanged(client, stats, url, localPath, remoteInfo) {
+		return nil
+	}
+
+	// Data the upstream merely moved is taken from the earlier copy
+	if m.relink(ctx, stats, url, localPath, remoteInfo) {
+		return nil
+	}
+	// A file the budget has no room for is left for later; smaller ones may fit
+	if remoteInfo != nil {
+		if err := m.usage.check(remoteInfo.Size); err != nil {
+			return m.skippedOverBudget(stats, url, localPath, remoteInfo.Size, err)
+		}
+	}
+	if err := stats.budget.claim(); err != nil {
+		return m.skippedForBudget(stats, url, localPath, err)
+	}
+
 	m.logger.Debug("Downloading file", "url", url, "path", localPath)
 
-	// Download the file
-	err := client.DownloadFile(ctx, url, localPath)
+	// Download the file; with VerifyChecksums, content not matching its checksum
+	// list may have been corrupted on the way and is downloaded again
+	var digest httpPkg.Digest
+	expected := stats.expectedDigest(url, remoteInfo)
+	retryable := httpPkg.IsTemporary
+	if target.VerifyChecksums {
+		retryable = func(err error) bool {
+			var mismatch *httpPkg.ChecksumMismatchError
+			return httpPkg.IsTemporary(err) || errors.As(err, &mismatch)
+		}
+	}
+	err := m.withRetriesIf(ctx, stats, target.Retries, "download", url, retryable, func() error {
+		release, err := m.acquire(ctx, stats, url)
+		if err != nil {
+			return err
+		}
+		defer release()
+		digest, err = client.FetchFileVerified(ctx, url, localPath, expected)
+		return err
+	})
+	if digest.Path != "" {
+		localPath = digest.Path
+	}
+	var sizeErr *httpPkg.FileSizeError
+	if errors.As(err, &sizeErr) {
+		stats.budget.release()
+		return m.skippedSize(stats, url, localPath, err)
+	}
 	if err != nil {
-		stats.Errors++
+		stats.budget.release()
+		// An interrupted run is not a failed download
+		if ctx.Err() == nil {
+			atomic.AddInt64(&stats.Errors, 1)
+		}
+		var mismatch *httpPkg.ChecksumMismatchError
+		if errors.As(err, &mismatch) {
+			atomic.AddInt64(&stats.ChecksumMismatches, 1)
+		}
 		return err
 	}
+	if target.VerifyChecksums && (expected.SHA256 != "" || expected.MD5 != "") {
+		atomic.AddInt64(&stats.FilesVerified, 1)
+	}
+
+	m.checkContent(stats, client.GetConfig().ContentTypeCheck, url, localPath, digest)
 
 	// Update stats
-	if stat, err := os.Stat(localPath); err == nil {
-		stats.BytesDownloaded += stat.Size()
+	written := localPath
+	if digest.Quarantined != "" {
+		written = digest.Quarantined
+	}
+	// Bytes kept from an interrupted download were transferred by an earlier run
+	var size int64
+	if stat, err := stats.fileStorage().Stat(written); err == nil {
+		size = stat.Size
+		atomic.AddInt64(&stats.BytesDownloaded, size-digest.Resumed)
+		atomic.AddInt64(&stats.BytesResumed, digest.Resumed)
+	}
+	stats.budget.add(size - digest.Resumed)
+	if err := m.usage.add(stats.Target, size-digest.Resumed); err != nil {
+		m.logger.Warn("Failed to account downloaded bytes", "error", err)
+	}
+	if digest.Quarantined != "" {
+		m.skipped(stats, url, localPath, config.SkipQuarantined)
+		return nil
+	}
+	atomic.AddInt64(&stats.FilesDownloaded, 1)
+	if digest.FinalURL != "" {
+		m.logger.Debug("Download was redirected", "url", url, "final_url", digest.FinalURL)
 	}
-	stats.FilesDownloaded++
+	m.checkFutureTime(stats, localPath, digest.ETag)
+	m.fileEvent(stats, stats.downloadAction(localPath), localPath, url, size, digest.SHA256)
+	stats.recordSource(localPath, url, digest)
+	m.emit(stats, Event{Type: EventFileDownloaded, URL: url, Path: localPath, Bytes: size})
 
 	return nil
 }
@@ -1,15 +1,23 @@
 package mirror
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -63,10 +71,11 @@ func TestParseDirectoryListing(t *testing.T) {
 		Body: io.NopCloser(strings.NewReader(htmlContent)),
 	}
 
-	links, err := manager.parseDirectoryListing(resp, "http://example.com/files/")
+	listing, err := manager.parseDirectoryListing(resp, "http://example.com/files/", false)
 	if err != nil {
 		t.Fatalf("parseDirectoryListing failed: %v", err)
 	}
+	links := listing.Links
 
 	expectedLinks := []string{"file1.txt", "file2.pdf", "subdir/"}
 
@@ -405,10 +414,136 @@ func TestMirrorTargetContextCancellation(t *testing.T) {
 	}
 }
 
+func TestRunStopsBetweenFilesWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var downloads []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="a.txt">a</a><a href="b.txt">b</a><a href="c.txt">c</a><a href="sub/">sub</a>`)
+			return
+		}
+		mu.Lock()
+		downloads = append(downloads, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("data"))
+		// The run is cancelled while the first file is in flight
+		cancel()
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "cancel", URL: server.URL + "/", MaxDepth: 3, Timeout: 5}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(ctx, target, targetDir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if len(downloads) != 1 {
+		t.Errorf("Expected the run to stop after the file in flight, got requests %v", downloads)
+	}
+	if stats.Errors != 0 {
+		t.Errorf("Expected cancellation not to count as an error, got %d errors", stats.Errors)
+	}
+	matches, _ := filepath.Glob(filepath.Join(targetDir, config.TempFilePrefix+"*"))
+	if len(matches) != 0 {
+		t.Errorf("Expected no partial downloads, found %v", matches)
+	}
+}
+
+func TestRunWithS3Storage(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	// A minimal bucket keeping objects and their metadata in memory
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	meta := make(map[string]http.Header)
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/mirror/")
+		switch r.Method {
+		case "PUT":
+			objects[key], _ = io.ReadAll(r.Body)
+			meta[key] = http.Header{"X-Amz-Meta-Mtime": r.Header.Values("X-Amz-Meta-Mtime")}
+		case "HEAD":
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("X-Amz-Meta-Mtime", meta[key].Get("X-Amz-Meta-Mtime"))
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		default:
+			t.Errorf("Unexpected S3 request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer bucket.Close()
+
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	var downloads int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="readme.txt">readme.txt</a><a href="pool/">pool/</a>`)
+		case "/pool/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="pkg.deb">pkg.deb</a>`)
+		default:
+			w.Header().Set("Last-Modified", modified)
+			if r.Method == "GET" {
+				downloads++
+			}
+			fmt.Fprint(w, "content of "+r.URL.Path)
+		}
+	}))
+	defer upstream.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{
+		Name: "debian", URL: upstream.URL + "/", MaxDepth: 3, Timeout: 5, CheckChanges: true,
+		Storage: config.StorageS3,
+		S3:      &config.S3Storage{Bucket: "mirror", Endpoint: bucket.URL, PathStyle: true},
+	}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesDownloaded != 2 || stats.BytesDownloaded != int64(len("content of /readme.txt")+len("content of /pool/pkg.deb")) {
+		t.Errorf("Expected 2 files to be uploaded, got %d files and %d bytes", stats.FilesDownloaded, stats.BytesDownloaded)
+	}
+	if string(objects["debian/pool/pkg.deb"]) != "content of /pool/pkg.deb" {
+		t.Errorf("Expected the file to be uploaded below the target prefix, got %v", objects)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "readme.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected no local copy of uploaded files, got %v", err)
+	}
+	if source, ok := manager.loadManifest(targetDir).Lookup("pool/pkg.deb"); !ok || source.Size == 0 {
+		t.Errorf("Expected the manifest to stay local and record the upload, got %+v", source)
+	}
+
+	// Unchanged files are recognized from the object metadata
+	stats, err = manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if stats.FilesSkipped != 2 || downloads != 2 {
+		t.Errorf("Expected unchanged files to be skipped, got %d skipped and %d downloads", stats.FilesSkipped, downloads)
+	}
+}
+
 func TestMirrorStatsTracking(t *testing.T) {
 	// Create test server
 	responses := map[string]string{
-		"/":          `<html><body><a href="file1.txt">file1.txt</a><a href="file2.txt">file2.txt</a></body></html>`,
+		"/":          `<html><body><a href="file1.txt">file1.txt</a><a href="file2.txt">file2.txt</a><a href="gone.txt">gone.txt</a></body></html>`,
 		"/file1.txt": "Content 1",
 		"/file2.txt": "Content 2",
 	}
@@ -431,29 +566,461 @@ func TestMirrorStatsTracking(t *testing.T) {
 		},
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 	manager := NewManager(cfg, logger)
 
 	target.URL = server.URL + "/"
 
 	ctx := context.Background()
-	err := manager.MirrorTarget(ctx, target)
+	stats, err := manager.MirrorTargetWithStats(ctx, target)
 	if err != nil {
-		t.Fatalf("MirrorTarget failed: %v", err)
+		t.Fatalf("MirrorTargetWithStats failed: %v", err)
 	}
 
-	// Note: In a real implementation, you might want to expose stats
-	// For now, we just verify that the operation completed successfully
-	// and files were created (which indirectly tests the stats tracking)
+	if stats.Target != "test-target" || stats.RunID == "" || stats.EndTime.Before(stats.StartTime) {
+		t.Errorf("Expected the run to be identified, got target %q, run %q", stats.Target, stats.RunID)
+	}
+	if stats.FilesDownloaded != 2 || stats.BytesDownloaded != 18 || stats.FilesSkipped != 0 {
+		t.Errorf("Expected 2 files of 18 bytes downloaded, got %d files of %d bytes, %d skipped",
+			stats.FilesDownloaded, stats.BytesDownloaded, stats.FilesSkipped)
+	}
+	if stats.BytesPerSecond <= 0 {
+		t.Errorf("Expected the throughput of the run, got %d", stats.BytesPerSecond)
+	}
+	if stats.Errors != 1 || stats.ErrorsByClass["http 404"] != 1 {
+		t.Errorf("Expected the missing file counted as an http 404 error, got %d errors: %v", stats.Errors, stats.ErrorsByClass)
+	}
 
-	file1Path := filepath.Join(tempDir, "test-target", "file1.txt")
-	file2Path := filepath.Join(tempDir, "test-target", "file2.txt")
+	for _, name := range []string{"file1.txt", "file2.txt"} {
+		if _, err := os.Stat(filepath.Join(tempDir, "test-target", name)); os.IsNotExist(err) {
+			t.Errorf("%s should have been downloaded", name)
+		}
+	}
 
-	if _, err := os.Stat(file1Path); os.IsNotExist(err) {
-		t.Error("file1.txt should have been downloaded")
+	// Without change detection the second run downloads both files again, and its
+	// counters start from zero
+	stats, err = manager.MirrorTargetWithStats(ctx, target)
+	if err != nil {
+		t.Fatalf("MirrorTargetWithStats failed: %v", err)
 	}
+	if stats.FilesDownloaded != 2 || stats.BytesDownloaded != 18 || stats.Errors != 1 {
+		t.Errorf("Expected the counters of the second run only, got %d files of %d bytes, %d errors",
+			stats.FilesDownloaded, stats.BytesDownloaded, stats.Errors)
+	}
+}
 
-	if _, err := os.Stat(file2Path); os.IsNotExist(err) {
-		t.Error("file2.txt should have been downloaded")
+func TestMirrorTreeLimits(t *testing.T) {
+	// Every directory holds five files and five subdirectories, forever
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("x"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		for i := range 5 {
+			fmt.Fprintf(w, `<a href="f%d.txt">f</a><a href="d%d/">d</a>`, i, i)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		mirror     config.Mirror
+		maxDepth   int
+		limit      string
+		downloaded int64
+	}{
+		{"directories", config.Mirror{MaxDirectories: 3}, 3, limitDirectories, 15},
+		{"entries per directory", config.Mirror{MaxEntriesPerDirectory: 2}, 1, limitEntriesPerDirectory, 1},
+		{"path depth", config.Mirror{MaxPathDepth: 2, MaxEntriesPerDirectory: 2}, -1, limitPathDepth, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewManager(&config.Config{Mirror: tt.mirror}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			target := &config.Target{Name: "limits", URL: server.URL + "/", MaxDepth: tt.maxDepth, Timeout: 5}
+
+			stats, err := manager.Run(context.Background(), target, t.TempDir())
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if stats.LimitsReached[tt.limit] == 0 {
+				t.Errorf("Expected limit %q to be reported, got %v", tt.limit, stats.LimitsReached)
+			}
+			if stats.FilesDownloaded != tt.downloaded {
+				t.Errorf("Expected %d files downloaded, got %d", tt.downloaded, stats.FilesDownloaded)
+			}
+		})
+	}
+}
+
+func TestMirrorTreeVisitsInListingOrder(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/") {
+			requests = append(requests, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="a/">a</a><a href="b/">b</a>`))
+		case "/a/":
+			w.Write([]byte(`<a href="c/">c</a>`))
+		default:
+			w.Write([]byte(`<a href="x.txt">x</a>`))
+		}
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "order", URL: server.URL + "/", MaxDepth: -1, Timeout: 5}
+	if _, err := manager.Run(context.Background(), target, t.TempDir()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"/", "/a/", "/a/c/", "/b/"}
+	if fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Errorf("Expected depth-first listing order %v, got %v", want, requests)
+	}
+}
+
+func TestMirrorSkipsHiddenFiles(t *testing.T) {
+	responses := map[string]string{
+		"/":                        `<a href="visible.txt">v</a><a href=".htaccess">h</a><a href=".git/">g</a><a href=".http-mirror-state.json">s</a>`,
+		"/visible.txt":             "visible",
+		"/.htaccess":               "deny from all",
+		"/.git/":                   `<a href="config">c</a>`,
+		"/.git/config":             "config",
+		"/.http-mirror-state.json": "{}",
+	}
+	server := createTestServer(t, responses)
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name       string
+		hidden     []string
+		downloaded []string
+		skipped    []string
+	}{
+		{"default policy", nil, []string{"visible.txt"}, []string{".htaccess", ".git"}},
+		{"dotfiles allowed", []string{}, []string{"visible.txt", ".htaccess", ".git/config"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetDir := t.TempDir()
+			target := &config.Target{Name: "hidden", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, Hidden: tt.hidden}
+			if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			for _, name := range tt.downloaded {
+				if _, err := os.Stat(filepath.Join(targetDir, name)); err != nil {
+					t.Errorf("Expected %s to be mirrored: %v", name, err)
+				}
+			}
+			for _, name := range tt.skipped {
+				if _, err := os.Stat(filepath.Join(targetDir, name)); !os.IsNotExist(err) {
+					t.Errorf("Expected %s not to be mirrored", name)
+				}
+			}
+			// Upstream files never overwrite mirror metadata
+			if data, _ := os.ReadFile(filepath.Join(targetDir, StateFileName)); string(data) == "{}" {
+				t.Error("Expected upstream metadata file to be skipped")
+			}
+		})
+	}
+}
+
+func TestMirrorDeduplicatesLinks(t *testing.T) {
+	// Apache fancy indexes link every entry from its icon and its name
+	listing := `<table>
+<tr><td valign="top"><a href="big.iso"><img src="/icons/binary.gif" alt="[   ]"></a></td><td><a href="big.iso">big.iso</a></td></tr>
+<tr><td valign="top"><a href="docs/"><img src="/icons/folder.gif" alt="[DIR]"></a></td><td><a href="docs/">docs/</a></td></tr>
+<tr><td valign="top"><a href="big.iso#sha256"><img src="/icons/text.gif" alt="[TXT]"></a></td><td><a href="./big.iso">again</a></td></tr>
+<tr><td><a href="big%2Eiso">alias with an encoded dot</a></td></tr>
+</table>`
+	responses := map[string]string{
+		"/":                listing,
+		"/big.iso":         "image",
+		"/docs/":           `<a href="readme.txt"><img src="/icons/text.gif"></a><a href="readme.txt">readme.txt</a>`,
+		"/docs/readme.txt": "readme",
+	}
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	inner := createTestServer(t, responses)
+	defer inner.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		inner.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "dedup", URL: server.URL + "/", MaxDepth: 3, Timeout: 5}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, path := range []string{"/", "/big.iso", "/docs/", "/docs/readme.txt"} {
+		if got := requests["GET "+path]; got != 1 {
+			t.Errorf("Expected one request for %s, got %d", path, got)
+		}
+	}
+	if stats.FilesDownloaded != 2 {
+		t.Errorf("Expected 2 downloads, got %d", stats.FilesDownloaded)
+	}
+	if stats.DuplicateLinks != 5 {
+		t.Errorf("Expected 5 duplicate links, got %d", stats.DuplicateLinks)
+	}
+
+	// The alias maps to the same local file; the first link wins and the alias
+	// is not requested, which the single request for /big.iso above shows
+	if stats.NameConflicts != 1 {
+		t.Errorf("Expected 1 name conflict, got %d", stats.NameConflicts)
+	}
+	if data, _ := os.ReadFile(filepath.Join(targetDir, "big.iso")); string(data) != "image" {
+		t.Errorf("Expected first link's content, got %q", data)
+	}
+}
+
+func TestMirrorDecodesLinkNames(t *testing.T) {
+	server := createTestServer(t, map[string]string{
+		"/": `<a href="caf%C3%A9%20menu/">café menu/</a><a href="r%C3%A9sum%C3%A9.txt">résumé.txt</a>` +
+			`<a href="c++%20notes+v2.txt">c++ notes+v2.txt</a><a href="x%2By.txt">x+y.txt</a>` +
+			`<a href="100%25.txt">100%.txt</a><a href="%20">blank</a>`,
+		"/café menu/":       `<a href="%E6%97%A5%E6%9C%AC.txt">日本.txt</a>`,
+		"/café menu/日本.txt": "nested",
+		"/résumé.txt":       "resume",
+		"/c++ notes+v2.txt": "plus",
+		"/x+y.txt":          "encoded plus",
+		"/100%.txt":         "percent",
+		"/ ":                "blank",
+	})
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "decode", URL: server.URL + "/", MaxDepth: 3, Timeout: 5}
+	targetDir := t.TempDir()
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// Files are stored under their upstream names, not the encoded link text; "+"
+	// is a plus sign in paths, not a space
+	for path, want := range map[string]string{
+		"résumé.txt": "resume", "café menu/日本.txt": "nested",
+		"c++ notes+v2.txt": "plus", "x+y.txt": "encoded plus", "100%.txt": "percent",
+	} {
+		if data, err := os.ReadFile(filepath.Join(targetDir, filepath.FromSlash(path))); err != nil || string(data) != want {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", path, want, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "r%C3%A9sum%C3%A9.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file named after the encoded link, got %v", err)
+	}
+	// Names are validated once decoded
+	if _, err := os.Stat(filepath.Join(targetDir, " ")); !os.IsNotExist(err) {
+		t.Errorf("Expected the blank name to be rejected, got %v", err)
+	}
+}
+
+// FuzzLocalPath checks that the local path built for a link, as in mirrorLinks,
+// is always a direct child of the listing's local directory
+func FuzzLocalPath(f *testing.F) {
+	for _, seed := range []string{
+		"file.txt", "sub/", ".", "./", "..", "../", "a/../../b", `..\..\win.ini`, "C:", "C:foo",
+		"/etc/passwd", "nul\x00byte", "con.txt", "trailing. ", "\xc0\xae\xc0\xae/", "%2e%2e/",
+	} {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	localDir := filepath.Join(string(filepath.Separator)+"srv", "mirror", "target")
+
+	f.Fuzz(func(t *testing.T, link string, portable bool) {
+		name := path.Base(link)
+		if strings.HasSuffix(link, "/") {
+			name = strings.TrimSuffix(link, "/")
+		}
+		if !isValidFilename(name) {
+			return
+		}
+		stats := &MirrorStats{names: newLocalNames(portable)}
+		localPath := filepath.Join(localDir, manager.localName(localDir, name, stats))
+		if filepath.Dir(localPath) != localDir || !isWithinDir(localDir, localPath) {
+			t.Fatalf("Name %q from link %q maps to %q outside %s", name, link, localPath, localDir)
+		}
+	})
+}
+
+func TestRunLogsCarryTargetAndRunID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pub/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="sub/">sub/</a><a href="top.txt">top.txt</a>`))
+		case "/pub/sub/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="moved.txt">moved.txt</a>`))
+		case "/pub/sub/moved.txt":
+			http.Redirect(w, r, "/files/moved.txt", http.StatusFound)
+		default:
+			w.Write([]byte("data"))
+		}
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	manager := NewManager(&config.Config{}, logger)
+	target := &config.Target{Name: "pub", URL: server.URL + "/pub/", MaxDepth: 5, Timeout: 5}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.RunID == "" {
+		t.Fatal("Expected the run to have an ID")
+	}
+
+	// Every record carries the target and run once, and those of the client the
+	// depth of the directory too
+	redirectDepth := -1.0
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("Failed to decode %s: %v", line, err)
+		}
+		if record["target"] != "pub" || record["run_id"] != stats.RunID {
+			t.Errorf("Expected target and run ID on %s", line)
+		}
+		if n := bytes.Count(line, []byte(`"target":`)); n != 1 {
+			t.Errorf("Expected the target once, got %d times on %s", n, line)
+		}
+		if record["msg"] == "Following redirect" {
+			redirectDepth, _ = record["depth"].(float64)
+		}
+	}
+	if redirectDepth != 1 {
+		t.Errorf("Expected the client's redirect record at depth 1, got %v", redirectDepth)
+	}
+
+	// The manifest ties the files to the run
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range []string{"top.txt", "sub/moved.txt"} {
+		if source, ok := manifest.Lookup(rel); !ok || source.RunID != stats.RunID {
+			t.Errorf("Expected %s recorded with run %s, got %+v", rel, stats.RunID, source)
+		}
+	}
+
+	// Every run gets an ID of its own
+	second, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if second.RunID == stats.RunID {
+		t.Errorf("Expected a new run ID, got %s again", second.RunID)
+	}
+}
+
+// readTree returns the content of every file below dir that is not mirror metadata
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), config.MetadataPrefix) {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRunDownloadsConcurrently(t *testing.T) {
+	// Three directories of 20 files each
+	responses := map[string]string{"/": `<a href="a/">a/</a><a href="b/">b/</a><a href="c/">c/</a>`}
+	for _, dir := range []string{"a", "b", "c"} {
+		var listing strings.Builder
+		for i := range 20 {
+			name := fmt.Sprintf("file%02d.txt", i)
+			fmt.Fprintf(&listing, `<a href="%s">%s</a>`, name, name)
+			responses["/"+dir+"/"+name] = "content of /" + dir + "/" + name
+		}
+		responses["/"+dir+"/"] = listing.String()
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	run := func(concurrency int) (*MirrorStats, map[string]string, int32) {
+		t.Helper()
+		// Every file takes a moment, and the most file requests in flight at once are recorded
+		var running, peak atomic.Int32
+		inner := createTestServer(t, responses)
+		defer inner.Close()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			inner.Config.Handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+
+		var mu sync.Mutex
+		downloaded := make(map[string]bool)
+		manager := NewManager(&config.Config{}, logger, WithEventSink(func(e Event) {
+			// Events arrive one at a time, so the sink needs no locking of its own
+			if !mu.TryLock() {
+				t.Error("Expected events to be delivered one at a time")
+				return
+			}
+			defer mu.Unlock()
+			downloaded[e.Path] = e.Type == EventFileDownloaded
+		}))
+		target := &config.Target{Name: "tree", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, Concurrency: concurrency}
+		targetDir := t.TempDir()
+		stats, err := manager.Run(context.Background(), target, targetDir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		if len(downloaded) != 60 {
+			t.Errorf("Expected an event for every file, got %d", len(downloaded))
+		}
+		return stats, readTree(t, targetDir), peak.Load()
+	}
+
+	sequentialStats, sequential, sequentialPeak := run(1)
+	concurrentStats, concurrent, concurrentPeak := run(8)
+	if len(sequential) != 60 || !maps.Equal(sequential, concurrent) {
+		t.Errorf("Expected the same tree of 60 files, got %d and %d files", len(sequential), len(concurrent))
+	}
+	if concurrentStats.FilesDownloaded != 60 || concurrentStats.BytesDownloaded != sequentialStats.BytesDownloaded || concurrentStats.Errors != 0 {
+		t.Errorf("Expected the same statistics, got %+v and %+v", sequentialStats, concurrentStats)
+	}
+	if sequentialPeak != 1 || concurrentPeak < 2 || concurrentPeak > 8 {
+		t.Errorf("Expected 1 and up to 8 downloads at once, got %d and %d", sequentialPeak, concurrentPeak)
 	}
 }
@@ -0,0 +1,255 @@
+package mirror
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// ManifestFileName is the file in each target directory recording where every
+// mirrored file came from
+const ManifestFileName = ".http-mirror-manifest.json"
+
+// FileSource records the upstream origin of a mirrored file
+type FileSource struct {
+	// URL is the upstream URL the file was downloaded from; empty for adopted files
+	URL string `json:"url,omitempty"`
+	// FinalURL is where URL redirected to when the file was downloaded; empty if
+	// the upstream served URL directly
+	FinalURL string `json:"finalUrl,omitempty"`
+	// FetchedAt is when the current local copy was downloaded, and RunID the
+	// MirrorStats.RunID of the run that downloaded it
+	FetchedAt time.Time `json:"fetchedAt,omitzero"`
+	RunID     string    `json:"runId,omitempty"`
+	// Size and ModTime describe the local copy when it was recorded
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"modTime,omitzero"`
+	// SHA256 and MD5 are the hex content hashes, if they were computed
+	SHA256 string `json:"sha256,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+	// Adopted marks files that existed on disk before the mirror took over the
+	// target; their origin is unknown until they are downloaded again
+	Adopted bool `json:"adopted,omitempty"`
+	// Order is the position of the file among the files scheduled by the run that
+	// downloaded it, and Priority the Target.Priority pattern that ranked it, if any
+	Order    int64  `json:"order,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	// UpstreamModTime is the modification time the upstream claimed for a file
+	// whose time lay in the future and was clamped to when it was checked. Such
+	// files are compared by ETag and size instead of their local modification time.
+	// ETag is the entity tag the file was served with; an unchanged ETag keeps any
+	// file from being downloaded again.
+	UpstreamModTime time.Time `json:"upstreamModTime,omitzero"`
+	ETag            string    `json:"etag,omitempty"`
+}
+
+// Manifest maps files of a target, by slash-separated path relative to the target
+// directory, to their upstream sources
+type Manifest struct {
+	Files map[string]FileSource `json:"files"`
+}
+
+// Lookup returns the source of the file at relPath. Files mirrored before the
+// manifest existed are not found.
+func (m *Manifest) Lookup(relPath string) (FileSource, bool) {
+	source, ok := m.Files[filepath.ToSlash(relPath)]
+	return source, ok
+}
+
+// LoadManifest reads the manifest stored in targetDir. A missing manifest yields an
+// empty one.
+func LoadManifest(targetDir string) (*Manifest, error) {
+	manifest := &Manifest{Files: make(map[string]FileSource)}
+
+	data, err := os.ReadFile(filepath.Join(targetDir, ManifestFileName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]FileSource)
+	}
+	return manifest, nil
+}
+
+// WalkManifest calls fn for every file in the manifest stored in targetDir, in
+// file order, decoding one entry at a time so that huge manifests are never held
+// in memory. A missing manifest has no files. An error returned by fn stops the
+// walk and is returned.
+func WalkManifest(targetDir string, fn func(rel string, source FileSource) error) error {
+	file, err := os.Open(filepath.Join(targetDir, ManifestFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to parse manifest: %w", err)
+		}
+		if key != "files" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fmt.Errorf("failed to parse manifest: %w", err)
+			}
+			continue
+		}
+
+		// "files": null is an empty manifest
+		if tok, err := dec.Token(); err != nil {
+			return fmt.Errorf("failed to parse manifest: %w", err)
+		} else if tok == nil {
+			continue
+		} else if tok != json.Delim('{') {
+			return fmt.Errorf("failed to parse manifest: unexpected %v", tok)
+		}
+		for dec.More() {
+			rel, err := dec.Token()
+			if err != nil {
+				return fmt.Errorf("failed to parse manifest: %w", err)
+			}
+			var source FileSource
+			if err := dec.Decode(&source); err != nil {
+				return fmt.Errorf("failed to parse manifest: %w", err)
+			}
+			if err := fn(rel.(string), source); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectDelim reads the next token of dec, which must be delim
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("failed to parse manifest: expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+// relPath returns the manifest key of a file below the target directory
+func (stats *MirrorStats) relPath(localPath string) (string, bool) {
+	if stats.root == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(stats.root, localPath)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// recordSource remembers the origin and content hashes of a file downloaded during the run
+func (stats *MirrorStats) recordSource(localPath, url string, digest httpPkg.Digest) {
+	rel, ok := stats.relPath(localPath)
+	if !ok {
+		return
+	}
+
+	source := FileSource{URL: url, FinalURL: digest.FinalURL, FetchedAt: time.Now().UTC(), RunID: stats.RunID, SHA256: digest.SHA256, MD5: digest.MD5, ETag: digest.ETag}
+	if stat, err := stats.fileStorage().Stat(localPath); err == nil {
+		source.Size = stat.Size
+		source.ModTime = stat.ModTime.UTC()
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.sources == nil {
+		stats.sources = make(map[string]FileSource)
+	}
+	order := stats.orders[localPath]
+	source.Order, source.Priority = order.order, order.rule
+	stats.sources[rel] = source
+}
+
+// recordedETag returns the entity tag the manifest recorded for the file at rel
+// when the run started, if any
+func (stats *MirrorStats) recordedETag(rel string) string {
+	if stats.digests == nil {
+		return ""
+	}
+	return stats.digests.files[rel].ETag
+}
+
+// isAdopted reports whether localPath was adopted from a pre-existing tree
+func (stats *MirrorStats) isAdopted(localPath string) bool {
+	rel, ok := stats.relPath(localPath)
+	return ok && stats.adopted[rel]
+}
+
+// saveSources merges the sources of files downloaded during the run into the
+// manifest of targetDir
+func (m *Manager) saveSources(targetDir string, stats *MirrorStats) {
+	if len(stats.sources) == 0 && len(stats.clamps) == 0 && len(stats.pruned) == 0 {
+		return
+	}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		m.logger.Warn("Discarding unreadable manifest", "error", err)
+		manifest = &Manifest{Files: make(map[string]FileSource)}
+	}
+	for rel, source := range stats.sources {
+		manifest.Files[rel] = source
+	}
+	for rel, clamp := range stats.clamps {
+		source := manifest.Files[rel]
+		source.ModTime, source.UpstreamModTime, source.ETag = clamp.modTime, clamp.upstream, clamp.etag
+		manifest.Files[rel] = source
+	}
+	for _, rel := range stats.pruned {
+		delete(manifest.Files, rel)
+	}
+
+	if err := saveManifest(targetDir, manifest); err != nil {
+		m.logger.Warn("Failed to save manifest", "error", err)
+	}
+}
+
+// RecordFile adds the source of the file at rel, relative to targetDir, to the
+// manifest of targetDir, e.g. for a file fetched outside of a run. A run saving its
+// sources at the same time may drop the entry.
+func RecordFile(targetDir, rel string, source FileSource) error {
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		return err
+	}
+	manifest.Files[filepath.ToSlash(rel)] = source
+	return saveManifest(targetDir, manifest)
+}
+
+// saveManifest atomically replaces the manifest in targetDir
+func saveManifest(targetDir string, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return writeFileAtomic(targetDir, ManifestFileName, data)
+}
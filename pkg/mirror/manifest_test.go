@@ -0,0 +1,183 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+func TestRunRecordsFileSources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a</a><a href="sub/">sub</a>`))
+		case "/sub/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="b.txt">b</a>`))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+
+	// Data from before the manifest existed keeps working
+	if err := os.WriteFile(filepath.Join(targetDir, "old.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "sources", URL: server.URL + "/", MaxDepth: 3, Timeout: 5}
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		url  string
+	}{
+		{"a.txt", server.URL + "/a.txt"},
+		{filepath.Join("sub", "b.txt"), server.URL + "/sub/b.txt"},
+	}
+	for _, tt := range tests {
+		source, ok := manifest.Lookup(tt.path)
+		if !ok || source.URL != tt.url || source.FetchedAt.IsZero() {
+			t.Errorf("Expected source %s for %s, got %+v (found %v)", tt.url, tt.path, source, ok)
+		}
+	}
+	// Pre-existing files are adopted without an origin
+	if source, ok := manifest.Lookup("old.txt"); !ok || !source.Adopted || source.URL != "" {
+		t.Errorf("Expected pre-existing file to be adopted without source, got %+v", source)
+	}
+}
+
+func TestSaveSourcesMergesRuns(t *testing.T) {
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	first := &MirrorStats{Target: "t", root: targetDir}
+	first.recordSource(filepath.Join(targetDir, "a.txt"), "http://up/a.txt", httpPkg.Digest{})
+	first.recordSource(filepath.Join(targetDir, "b.txt"), "http://up/b.txt", httpPkg.Digest{})
+	manager.saveSources(targetDir, first)
+
+	second := &MirrorStats{Target: "t", root: targetDir}
+	second.recordSource(filepath.Join(targetDir, "b.txt"), "http://mirror2/b.txt", httpPkg.Digest{})
+	manager.saveSources(targetDir, second)
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if source, _ := manifest.Lookup("a.txt"); source.URL != "http://up/a.txt" {
+		t.Errorf("Expected source of a file not downloaded again to be kept, got %+v", source)
+	}
+	if source, _ := manifest.Lookup("b.txt"); source.URL != "http://mirror2/b.txt" {
+		t.Errorf("Expected redownloaded file to get its new source, got %+v", source)
+	}
+}
+
+func TestRunRecordsRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a</a><a href="b.txt">b</a>`))
+		case "/a.txt":
+			http.Redirect(w, r, "/pool/a.txt", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("content"))
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "redirects", URL: server.URL + "/", MaxDepth: 1, Timeout: 5}
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.RedirectHosts["127.0.0.1"] != 1 || len(stats.BlockedRedirects) != 0 {
+		t.Errorf("Unexpected redirect summary %v, blocked %v", stats.RedirectHosts, stats.BlockedRedirects)
+	}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if source, _ := manifest.Lookup("a.txt"); source.URL != server.URL+"/a.txt" || source.FinalURL != server.URL+"/pool/a.txt" {
+		t.Errorf("Expected redirected source with final URL, got %+v", source)
+	}
+	if source, _ := manifest.Lookup("b.txt"); source.FinalURL != "" {
+		t.Errorf("Expected no final URL for direct download, got %+v", source)
+	}
+}
+
+func TestRecordFile(t *testing.T) {
+	targetDir := t.TempDir()
+	if err := saveManifest(targetDir, &Manifest{Files: map[string]FileSource{"a.txt": {URL: "http://upstream/a.txt"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordFile(targetDir, filepath.Join("pool", "b.txt"), FileSource{URL: "http://upstream/pool/b.txt"}); err != nil {
+		t.Fatalf("RecordFile failed: %v", err)
+	}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatalf("LoadManifest failed: %v", err)
+	}
+	if len(manifest.Files) != 2 || manifest.Files["pool/b.txt"].URL != "http://upstream/pool/b.txt" {
+		t.Errorf("Expected the file added to the existing sources, got %+v", manifest.Files)
+	}
+}
+
+func TestWalkManifest(t *testing.T) {
+	targetDir := t.TempDir()
+	if err := WalkManifest(targetDir, func(string, FileSource) error {
+		t.Error("Expected no files without a manifest")
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkManifest failed: %v", err)
+	}
+
+	data := `{"version": 2, "files": {"a.txt": {"url": "http://up/a.txt", "size": 3}, "sub/b.txt": {"adopted": true}}, "extra": [1]}`
+	if err := os.WriteFile(filepath.Join(targetDir, ManifestFileName), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	walked := make(map[string]FileSource)
+	if err := WalkManifest(targetDir, func(rel string, source FileSource) error {
+		walked[rel] = source
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkManifest failed: %v", err)
+	}
+	if len(walked) != 2 || walked["a.txt"].URL != "http://up/a.txt" || walked["a.txt"].Size != 3 || !walked["sub/b.txt"].Adopted {
+		t.Errorf("Unexpected files %+v", walked)
+	}
+
+	for _, bad := range []string{`[]`, `{"files": {"a": 1}}`, `{"files": {"a": {}`} {
+		if err := os.WriteFile(filepath.Join(targetDir, ManifestFileName), []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := WalkManifest(targetDir, func(string, FileSource) error { return nil }); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
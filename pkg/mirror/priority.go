@@ -0,0 +1,202 @@
+package mirror
+
+import (
+	"path"
+	"slices"
+	"strings"
+)
+
+// maxUnscheduledRecorded bounds the directories a cut-short run leaves for the next
+// one to visit first
+const maxUnscheduledRecorded = 1000
+
+// priorityRules ranks files and directories by Target.Priority. Lower ranks are
+// scheduled first: 0 is reserved for the directories a previous run did not get to,
+// the files it skipped for the byte budget and the directories leading to them,
+// pattern i ranks i+1 and everything else ranks last.
+type priorityRules struct {
+	patterns []dirPattern
+	// pending are the directories left unvisited by the previous run, and
+	// overBudget the files it skipped because they did not fit the byte budget
+	pending    map[string]bool
+	overBudget map[string]bool
+	// ancestors are the directories leading to pending directories and files
+	ancestors map[string]bool
+}
+
+// newPriorityRules compiles the priority patterns of a target, the directories its
+// previous run left unvisited and the files it skipped for the byte budget
+func newPriorityRules(patterns, pending, overBudget []string) (*priorityRules, error) {
+	compiled, err := compilePatterns("priority", patterns)
+	if err != nil {
+		return nil, err
+	}
+	p := &priorityRules{patterns: compiled, pending: make(map[string]bool), overBudget: make(map[string]bool), ancestors: make(map[string]bool)}
+	for _, rel := range pending {
+		p.pending[rel] = true
+		p.addAncestors(rel)
+	}
+	for _, rel := range overBudget {
+		p.overBudget[rel] = true
+		p.addAncestors(rel)
+	}
+	return p, nil
+}
+
+// addAncestors records the directories leading to rel
+func (p *priorityRules) addAncestors(rel string) {
+	for dir := path.Dir(rel); dir != "." && dir != "/" && !p.ancestors[dir]; dir = path.Dir(dir) {
+		p.ancestors[dir] = true
+	}
+}
+
+// lowest is the rank of entries matching no rule
+func (p *priorityRules) lowest() int {
+	return len(p.patterns) + 1
+}
+
+// rank returns the rank of the entry at rel and the pattern responsible, if any
+func (p *priorityRules) rank(rel string) (int, string) {
+	for i, pattern := range p.patterns {
+		if pattern.match(rel) {
+			return i + 1, pattern.raw
+		}
+	}
+	return p.lowest(), ""
+}
+
+// entryRank returns the rank of the entry at rel below a directory whose subtree
+// has the rank parent, because of the pattern parentRule, and the pattern
+// responsible for the result
+func (p *priorityRules) entryRank(rel string, parent int, parentRule string) (int, string) {
+	if p.overBudget[rel] {
+		return 0, ""
+	}
+	if own, pattern := p.rank(rel); own < parent {
+		return own, pattern
+	}
+	return parent, parentRule
+}
+
+// dirRank returns the rank a directory is visited at and the rank passed on to its
+// subtree with the pattern responsible, like entryRank. Directories left unvisited
+// by the previous run keep rank 0 for their whole subtree; those leading to them
+// are only visited first themselves.
+func (p *priorityRules) dirRank(rel string, parent int, parentRule string) (visit, subtree int, rule string) {
+	if p.pending[rel] {
+		return 0, 0, ""
+	}
+	subtree, rule = p.entryRank(rel, parent, parentRule)
+	if p.ancestors[rel] {
+		return 0, subtree, rule
+	}
+	return subtree, subtree, rule
+}
+
+// orderLinks stably sorts the links of a listing below the directory of job by the
+// rank of their files and directories. Checksum files stay first, as relinking the
+// files they list depends on them.
+func (p *priorityRules) orderLinks(job dirJob, links []string) []string {
+	if len(p.patterns) > 0 || len(p.pending) > 0 || len(p.overBudget) > 0 {
+		ranks := make(map[string]int, len(links))
+		for _, link := range links {
+			linkPath := linkPath(link)
+			rel := path.Join(job.rel, linkName(path.Base(strings.TrimSuffix(linkPath, "/"))))
+			if strings.HasSuffix(linkPath, "/") {
+				ranks[link], _, _ = p.dirRank(rel, job.subtreeRank, job.rule)
+			} else {
+				ranks[link], _ = p.entryRank(rel, job.subtreeRank, job.rule)
+			}
+		}
+		links = slices.Clone(links)
+		slices.SortStableFunc(links, func(a, b string) int { return ranks[a] - ranks[b] })
+	}
+	return checksumFilesFirst(links)
+}
+
+// dirQueue holds the directories still to visit, one stack per rank. Directories
+// of the same rank are visited depth-first.
+type dirQueue struct {
+	stacks [][]dirJob
+}
+
+// newDirQueue creates a queue for ranks 0 to lowest
+func newDirQueue(lowest int) *dirQueue {
+	return &dirQueue{stacks: make([][]dirJob, lowest+1)}
+}
+
+// push adds a directory to visit
+func (q *dirQueue) push(job dirJob) {
+	q.stacks[job.rank] = append(q.stacks[job.rank], job)
+}
+
+// pop removes the most recently added directory of the lowest rank
+func (q *dirQueue) pop() (dirJob, bool) {
+	for i, stack := range q.stacks {
+		if len(stack) > 0 {
+			job := stack[len(stack)-1]
+			q.stacks[i] = stack[:len(stack)-1]
+			return job, true
+		}
+	}
+	return dirJob{}, false
+}
+
+// len returns the number of directories left
+func (q *dirQueue) len() int {
+	n := 0
+	for _, stack := range q.stacks {
+		n += len(stack)
+	}
+	return n
+}
+
+// unscheduled returns the relative paths of the directories left, in the order
+// they would have been visited, plus current if its visit was cut short. The root
+// is left out, as it is always visited first. At most maxUnscheduledRecorded are
+// returned.
+func (q *dirQueue) unscheduled(current *dirJob) []string {
+	var rels []string
+	if current != nil && current.rel != "" {
+		rels = append(rels, current.rel)
+	}
+	for _, stack := range q.stacks {
+		for i := len(stack) - 1; i >= 0 && len(rels) < maxUnscheduledRecorded; i-- {
+			rels = append(rels, stack[i].rel)
+		}
+	}
+	return rels
+}
+
+// fileOrder is the number of a file in the order of the run and the priority
+// pattern responsible for it, as recorded in its FileSource
+type fileOrder struct {
+	order int64
+	rule  string
+	// rel is the path of the file relative to the target URL
+	rel string
+}
+
+// schedule numbers the file at rel, which is about to be fetched, in the order of
+// the run
+func (stats *MirrorStats) schedule(rel string, job dirJob) fileOrder {
+	stats.scheduled++
+	_, rule := stats.priority.entryRank(rel, job.subtreeRank, job.rule)
+	return fileOrder{order: stats.scheduled, rule: rule, rel: rel}
+}
+
+// fetching remembers the order of the file at localPath for recordSource while it
+// is fetched; the returned function forgets it again
+func (stats *MirrorStats) fetching(localPath string, order fileOrder) func() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.orders == nil {
+		stats.orders = make(map[string]fileOrder)
+	}
+	stats.orders[localPath] = order
+	return func() {
+		stats.mu.Lock()
+		delete(stats.orders, localPath)
+		stats.mu.Unlock()
+	}
+}
@@ -0,0 +1,217 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestPriorityRulesRank(t *testing.T) {
+	rules, err := newPriorityRules([]string{"Release", "dists", `re:^pool/main/`}, []string{"pub/old/2019"}, nil)
+	if err != nil {
+		t.Fatalf("newPriorityRules failed: %v", err)
+	}
+	lowest := rules.lowest()
+
+	tests := []struct {
+		rel        string
+		parent     int
+		parentRule string
+		visit      int
+		subtree    int
+		rule       string
+	}{
+		{"dists", lowest, "", 2, 2, "dists"},
+		{"dists/stable", 2, "dists", 2, 2, "dists"},
+		{"dists/stable/Release", 2, "dists", 1, 1, "Release"},
+		{"pool/main/a", lowest, "", 3, 3, `re:^pool/main/`},
+		{"archive", lowest, "", lowest, lowest, ""},
+		{"pub/old/2019", lowest, "", 0, 0, ""},
+		{"pub/old", lowest, "", 0, lowest, ""},
+		{"pub", lowest, "", 0, lowest, ""},
+		{"pub/new", lowest, "", lowest, lowest, ""},
+	}
+	for _, tt := range tests {
+		visit, subtree, rule := rules.dirRank(tt.rel, tt.parent, tt.parentRule)
+		if visit != tt.visit || subtree != tt.subtree || rule != tt.rule {
+			t.Errorf("dirRank(%q) = %d, %d, %q; want %d, %d, %q", tt.rel, visit, subtree, rule, tt.visit, tt.subtree, tt.rule)
+		}
+	}
+
+	if _, err := newPriorityRules([]string{"re:("}, nil, nil); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+}
+
+func TestOrderLinks(t *testing.T) {
+	rules, err := newPriorityRules([]string{"*.xml", "Release"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := dirJob{subtreeRank: rules.lowest()}
+	links := []string{"a.deb", "Release", "old/", "repomd.xml", "SHA256SUMS", "b.deb"}
+	want := []string{"SHA256SUMS", "repomd.xml", "Release", "a.deb", "old/", "b.deb"}
+	if got := rules.orderLinks(job, links); !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if links[0] != "a.deb" {
+		t.Error("Expected the listing to be left unchanged")
+	}
+}
+
+func TestDirQueue(t *testing.T) {
+	queue := newDirQueue(2)
+	for _, job := range []dirJob{{rel: "a", rank: 2}, {rel: "b", rank: 1}, {rel: "c", rank: 2}, {rel: "d", rank: 1}} {
+		queue.push(job)
+	}
+	if got := queue.unscheduled(&dirJob{rel: "current"}); !slices.Equal(got, []string{"current", "d", "b", "c", "a"}) {
+		t.Errorf("Unexpected unscheduled directories %v", got)
+	}
+
+	var order []string
+	for queue.len() > 0 {
+		job, _ := queue.pop()
+		order = append(order, job.rel)
+	}
+	if !slices.Equal(order, []string{"d", "b", "c", "a"}) {
+		t.Errorf("Expected higher ranks first and depth-first within a rank, got %v", order)
+	}
+}
+
+// priorityServer serves a small tree and records the order of requests
+type priorityServer struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *priorityServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.URL.Path)
+	s.mu.Unlock()
+
+	listings := map[string]string{
+		"/":              `<a href="archive/">archive/</a><a href="a.txt">a.txt</a><a href="dists/">dists/</a><a href="README">README</a><a href="pool/">pool/</a>`,
+		"/archive/":      `<a href="old.txt">old.txt</a>`,
+		"/dists/":        `<a href="stable/">stable/</a>`,
+		"/dists/stable/": `<a href="Packages">Packages</a><a href="Release">Release</a>`,
+		"/pool/":         `<a href="p.deb">p.deb</a>`,
+	}
+	if listing, ok := listings[r.URL.Path]; ok {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, listing)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "content of "+r.URL.Path)
+}
+
+func (s *priorityServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+func TestRunFetchesPriorityFirst(t *testing.T) {
+	upstream := &priorityServer{}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{
+		Name:     "priority",
+		URL:      server.URL + "/",
+		MaxDepth: 5,
+		Timeout:  5,
+		Priority: []string{"Release", "README", "dists"},
+	}
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	want := []string{"/", "/README", "/a.txt", "/dists/", "/dists/stable/", "/dists/stable/Release", "/dists/stable/Packages",
+		"/archive/", "/archive/old.txt", "/pool/", "/pool/p.deb"}
+	if got := upstream.requested(); !slices.Equal(got, want) {
+		t.Errorf("Expected requests\n%v\ngot\n%v", want, got)
+	}
+
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, want := range map[string]FileSource{
+		"README":                {Order: 1, Priority: "README"},
+		"a.txt":                 {Order: 2},
+		"dists/stable/Release":  {Order: 3, Priority: "Release"},
+		"dists/stable/Packages": {Order: 4, Priority: "dists"},
+		"pool/p.deb":            {Order: 6},
+	} {
+		got, ok := manifest.Lookup(rel)
+		if !ok || got.Order != want.Order || got.Priority != want.Priority {
+			t.Errorf("Expected %s scheduled as %d by %q, got %+v", rel, want.Order, want.Priority, got)
+		}
+	}
+}
+
+func TestRunVisitsUnscheduledFirst(t *testing.T) {
+	upstream := &priorityServer{}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	cfg := &config.Config{Mirror: config.Mirror{MaxDirectories: 2}}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "budget", URL: server.URL + "/", MaxDepth: 5, Timeout: 5}
+
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	state, err := LoadTargetState(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(state.Unscheduled, []string{"dists", "pool"}) {
+		t.Fatalf("Expected the directories left over to be recorded, got %v", state.Unscheduled)
+	}
+
+	// The next run goes to the leftovers before anything else
+	upstream.mu.Lock()
+	upstream.requests = nil
+	upstream.mu.Unlock()
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	var listings []string
+	for _, p := range upstream.requested() {
+		if strings.HasSuffix(p, "/") {
+			listings = append(listings, p)
+		}
+	}
+	if !slices.Equal(listings, []string{"/", "/dists/"}) {
+		t.Errorf("Expected the leftover directory to be listed first, got %v", listings)
+	}
+	state, err = LoadTargetState(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(state.Unscheduled, []string{"dists/stable", "pool", "archive"}) {
+		t.Errorf("Expected the remaining directories to be recorded, got %v", state.Unscheduled)
+	}
+
+	// A complete run leaves nothing over
+	cfg.Mirror.MaxDirectories = 0
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if state, err := LoadTargetState(targetDir); err != nil || len(state.Unscheduled) != 0 {
+		t.Errorf("Expected no leftovers after a complete run, got %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,110 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// Listing formats reported by Probe
+const (
+	// FormatHTMLListing is an HTML page with links the mirror would follow
+	FormatHTMLListing = "html-listing"
+	// FormatFile is a non-HTML response, mirrored as a single file
+	FormatFile = "file"
+	// FormatUnknown is an HTML page without any followable links
+	FormatUnknown = "unknown"
+)
+
+// ProbeResult describes the reachability of a target's root URL
+type ProbeResult struct {
+	Target       string        `json:"target"`
+	URL          string        `json:"url"`
+	Reachable    bool          `json:"reachable"`
+	StatusCode   int           `json:"statusCode,omitempty"`
+	ResponseTime time.Duration `json:"responseTime"`
+	Server       string        `json:"server,omitempty"`
+	ContentType  string        `json:"contentType,omitempty"`
+	// Format is how the mirror would treat the response; empty if unreachable
+	Format string `json:"format,omitempty"`
+	// Generator is the detected listing generator, e.g. "apache" or "nginx"
+	Generator string `json:"generator,omitempty"`
+	// Links is the number of links the listing parser would follow
+	Links int `json:"links"`
+	// ExcludedDirs are the directories of the root listing a run would skip
+	ExcludedDirs []ExcludedDir `json:"excludedDirs,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// Probe fetches the root listing of a target through the same client and parser as
+// a mirror run, without downloading anything. A target is reachable if it answers
+// with a non-error status.
+func (m *Manager) Probe(ctx context.Context, target *config.Target) *ProbeResult {
+	m = m.forTarget(target.Name)
+	target = m.normalizeTarget(target)
+	result := &ProbeResult{Target: target.Name, URL: target.URL}
+	excluder, err := newDirExcluder(target.ExcludeDirs, target.ExcludedDirPolicy, target.FilterMode)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	client := m.newClient(target)
+
+	release, err := m.hosts.acquire(ctx, target.URL)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer release()
+
+	start := time.Now()
+	resp, err := m.fetchDirectoryListing(ctx, client, target.URL, nil)
+	result.ResponseTime = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.Server = resp.Header.Get("Server")
+	result.ContentType = resp.Header.Get("Content-Type")
+	if resp.StatusCode >= http.StatusBadRequest {
+		result.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+		return result
+	}
+	result.Reachable = true
+
+	if !strings.Contains(result.ContentType, "text/html") {
+		result.Format = FormatFile
+		return result
+	}
+
+	listing, err := m.parseDirectoryListing(resp, target.URL, target.FollowsAbsoluteSameHost())
+	if err != nil {
+		result.Format = FormatUnknown
+		result.Error = err.Error()
+		return result
+	}
+	result.Links = len(listing.Links)
+	result.Format = FormatUnknown
+	if len(listing.Links) > 0 {
+		result.Format = FormatHTMLListing
+		result.Generator = listing.Format
+	}
+
+	for _, link := range listing.Links {
+		name, isDir := strings.CutSuffix(link, "/")
+		if !isDir || !isValidFilename(name) {
+			continue
+		}
+		if pattern, ok := excluder.match(name); ok {
+			result.ExcludedDirs = append(result.ExcludedDirs, ExcludedDir{Path: name, Pattern: pattern})
+		}
+	}
+	return result
+}
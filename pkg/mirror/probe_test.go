@@ -0,0 +1,87 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestProbe(t *testing.T) {
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "test/1.0")
+		switch r.URL.Path {
+		case "/listing/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a</a><a href="b/">b</a><a href="../">up</a>`))
+		case "/empty/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<p>nothing here</p>`))
+		case "/file.iso":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("data"))
+		case "/a.txt":
+			downloads++
+		default:
+			http.Error(w, "gone", http.StatusGone)
+		}
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		path      string
+		reachable bool
+		status    int
+		format    string
+		links     int
+	}{
+		{"/listing/", true, http.StatusOK, FormatHTMLListing, 2},
+		{"/empty/", true, http.StatusOK, FormatUnknown, 0},
+		{"/file.iso", true, http.StatusOK, FormatFile, 0},
+		{"/missing/", false, http.StatusGone, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			target := &config.Target{Name: "probe", URL: server.URL + tt.path, Timeout: 5}
+			result := manager.Probe(context.Background(), target)
+
+			if result.Reachable != tt.reachable || result.StatusCode != tt.status {
+				t.Errorf("Expected reachable=%v status=%d, got %+v", tt.reachable, tt.status, result)
+			}
+			if result.Format != tt.format || result.Links != tt.links {
+				t.Errorf("Expected format %q with %d links, got %q with %d", tt.format, tt.links, result.Format, result.Links)
+			}
+			if result.Server != "test/1.0" {
+				t.Errorf("Expected Server header to be reported, got %q", result.Server)
+			}
+			if !tt.reachable && result.Error == "" {
+				t.Error("Expected an error for an unreachable target")
+			}
+		})
+	}
+
+	if downloads != 0 {
+		t.Errorf("Expected probing not to download files, got %d downloads", downloads)
+	}
+}
+
+func TestProbeConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	result := manager.Probe(context.Background(), &config.Target{Name: "down", URL: url + "/", Timeout: 5})
+
+	if result.Reachable || result.StatusCode != 0 || result.Error == "" {
+		t.Errorf("Expected an unreachable result with an error, got %+v", result)
+	}
+}
@@ -0,0 +1,172 @@
+package mirror
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// pruneTracker records what a run found upstream, for Target.Prune to delete the
+// local files that are gone. A nil tracker records nothing.
+type pruneTracker struct {
+	// files and dirs are the local paths of the files and directories found in
+	// listings; listed are the directories whose listing was processed in full
+	files  map[string]bool
+	dirs   map[string]bool
+	listed map[string]bool
+}
+
+// newPruneTracker returns a tracker if target prunes, or nil. Dated runs start
+// from an empty directory and have nothing to prune.
+func newPruneTracker(target *config.Target) *pruneTracker {
+	if !target.Prune || target.Layout == LayoutImmutableDated {
+		return nil
+	}
+	return &pruneTracker{files: make(map[string]bool), dirs: make(map[string]bool), listed: make(map[string]bool)}
+}
+
+// seeFile records a file found upstream
+func (p *pruneTracker) seeFile(localPath string) {
+	if p != nil {
+		p.files[localPath] = true
+	}
+}
+
+// seeDir records a directory found upstream, whether or not it is listed
+func (p *pruneTracker) seeDir(localDir string) {
+	if p != nil {
+		p.dirs[localDir] = true
+	}
+}
+
+// listedDir records that every entry of the directory was seen
+func (p *pruneTracker) listedDir(localDir string) {
+	if p != nil {
+		p.dirs[localDir] = true
+		p.listed[localDir] = true
+	}
+}
+
+// victim returns what to delete for the local file at localPath below root: the
+// file itself if its directory was listed without it, or the topmost directory
+// above it that a listed directory no longer has. Files below directories the run
+// found but did not list in full are kept.
+func (p *pruneTracker) victim(root, localPath string) (string, bool) {
+	if p.files[localPath] {
+		return "", false
+	}
+	child := localPath
+	for dir := filepath.Dir(localPath); isWithinDir(root, dir); dir = filepath.Dir(dir) {
+		if p.listed[dir] {
+			return child, true
+		}
+		if p.dirs[dir] || dir == root {
+			return "", false
+		}
+		child = dir
+	}
+	return "", false
+}
+
+// isMetadataPath reports whether rel, relative to the target directory, is or lies
+// below mirror metadata or a temporary file
+func isMetadataPath(rel string) bool {
+	for _, name := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(name, config.MetadataPrefix) || config.IsTempFile(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// prune deletes the files and directories below the run directory that the run
+// did not find upstream, or only logs them with Target.PruneDryRun. Only what a
+// fully listed directory no longer has is deleted; files below directories the
+// run could not list, did not get to or excluded are kept, and so is metadata.
+func (m *Manager) prune(target *config.Target, stats *MirrorStats) {
+	tracker, root, store := stats.prune, stats.runDir, stats.fileStorage()
+	if tracker == nil || !tracker.listed[root] {
+		return
+	}
+
+	var files []string
+	dirs := make(map[string]bool)
+	// victims maps the files to delete to the file or directory deleted with them
+	victims := make(map[string]string)
+	err := store.Walk(root, func(path string, info storage.FileInfo) error {
+		rel, err := filepath.Rel(stats.root, path)
+		if err != nil || isMetadataPath(rel) || !isWithinDir(stats.root, path) {
+			return nil
+		}
+		victim, ok := tracker.victim(root, path)
+		if !ok {
+			return nil
+		}
+		if victim == path {
+			files = append(files, path)
+		} else {
+			dirs[victim] = true
+		}
+		victims[path] = victim
+		stats.FilesDeleted++
+		stats.pruned = append(stats.pruned, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		m.logger.Warn("Failed to find files to prune", "error", err)
+		stats.FilesDeleted, stats.pruned = 0, nil
+		return
+	}
+
+	// Directories left empty have no files to find them by
+	if _, local := store.(*storage.Local); local {
+		for dir := range tracker.listed {
+			entries, _ := os.ReadDir(dir)
+			for _, entry := range entries {
+				path := filepath.Join(dir, entry.Name())
+				if entry.IsDir() && !tracker.dirs[path] && !strings.HasPrefix(entry.Name(), config.MetadataPrefix) {
+					dirs[path] = true
+				}
+			}
+		}
+	}
+	stats.DirectoriesDeleted = int64(len(dirs))
+
+	removals := files
+	for dir := range dirs {
+		removals = append(removals, dir)
+	}
+	sort.Strings(removals)
+	failed := make(map[string]bool)
+	for _, path := range removals {
+		if target.PruneDryRun {
+			m.logger.Info("Would delete what disappeared upstream", "path", path)
+			continue
+		}
+		if err := store.RemoveAll(path); err != nil {
+			m.logger.Warn("Failed to delete what disappeared upstream", "path", path, "error", err)
+			failed[path] = true
+			continue
+		}
+		m.logger.Info("Deleted what disappeared upstream", "path", path)
+	}
+	if target.PruneDryRun {
+		stats.pruned = nil
+		return
+	}
+
+	deleted := make([]string, 0, len(victims))
+	for path, victim := range victims {
+		if !failed[victim] {
+			deleted = append(deleted, path)
+		}
+	}
+	sort.Strings(deleted)
+	for _, path := range deleted {
+		m.fileEvent(stats, FileDeleted, path, "", 0, "")
+	}
+}
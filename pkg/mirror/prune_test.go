@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunPrunes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `<a href="keep.txt">keep.txt</a><a href="sub/">sub/</a><a href="broken/">broken/</a>`)
+		case "/sub/":
+			io.WriteString(w, `<a href="b.txt">b.txt</a>`)
+		case "/broken/":
+			http.Error(w, "unavailable", http.StatusForbidden)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "content")
+		}
+	}))
+	defer server.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{"deletes", false},
+		{"dry run", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			local := map[string]string{
+				"gone.txt":                           "stale",
+				"sub/gone.txt":                       "stale",
+				"old/a.txt":                          "stale",
+				"old/deep/b.txt":                     "stale",
+				"broken/kept.txt":                    "unlisted",
+				config.MetadataPrefix + "state":      "{}",
+				"sub/" + config.MetadataPrefix + "x": "meta",
+			}
+			for name, data := range local {
+				path := filepath.Join(dir, name)
+				os.MkdirAll(filepath.Dir(path), 0755)
+				if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			os.MkdirAll(filepath.Join(dir, "empty"), 0755)
+			if err := RecordFile(dir, "gone.txt", FileSource{URL: server.URL + "/gone.txt"}); err != nil {
+				t.Fatal(err)
+			}
+
+			manager := NewManager(&config.Config{}, logger)
+			target := &config.Target{Name: "prune", URL: server.URL + "/", MaxDepth: 3, Timeout: 5, Prune: true, PruneDryRun: tt.dryRun}
+			stats, err := manager.Run(context.Background(), target, dir)
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+
+			// The directory whose listing failed is kept as it is
+			if stats.FilesDeleted != 4 || stats.DirectoriesDeleted != 2 {
+				t.Errorf("Expected 4 files and 2 directories counted, got %d and %d", stats.FilesDeleted, stats.DirectoriesDeleted)
+			}
+			for _, name := range []string{"gone.txt", "sub/gone.txt", "old", "empty"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) != !tt.dryRun {
+					t.Errorf("%s: expected deleted %t, got %v", name, !tt.dryRun, err)
+				}
+			}
+			for _, name := range []string{"keep.txt", "sub/b.txt", "broken/kept.txt", config.MetadataPrefix + "state", "sub/" + config.MetadataPrefix + "x"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Errorf("%s: expected kept, got %v", name, err)
+				}
+			}
+			manifest, _ := LoadManifest(dir)
+			if _, ok := manifest.Lookup("gone.txt"); ok != tt.dryRun {
+				t.Errorf("Expected the deleted file dropped from the manifest: %t", ok)
+			}
+		})
+	}
+}
+
+func TestPruneTrackerVictim(t *testing.T) {
+	root := filepath.FromSlash("/data/t")
+	join := func(rel string) string { return filepath.Join(root, filepath.FromSlash(rel)) }
+	tracker := &pruneTracker{
+		files:  map[string]bool{join("a.txt"): true},
+		dirs:   map[string]bool{join("sub"): true},
+		listed: map[string]bool{root: true},
+	}
+
+	tests := []struct {
+		path   string
+		victim string
+		ok     bool
+	}{
+		{"a.txt", "", false},
+		{"b.txt", "b.txt", true},
+		{"sub/c.txt", "", false},
+		{"old/x/c.txt", "old", true},
+	}
+	for _, tt := range tests {
+		victim, ok := tracker.victim(root, join(tt.path))
+		if ok != tt.ok || ok && victim != join(tt.victim) {
+			t.Errorf("%s: expected %q %t, got %q %t", tt.path, tt.victim, tt.ok, victim, ok)
+		}
+	}
+}
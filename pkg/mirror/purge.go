@@ -0,0 +1,193 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/storage"
+)
+
+// ErrSyncInProgress is wrapped by the error of Purge, Reset, Verify and Adopt while
+// a run is syncing the target, and by the error of Run with DuplicateRunsReject
+// while another run holds the target directory
+var ErrSyncInProgress = errors.New("a sync of the target is in progress")
+
+// PurgeStats summarizes the files removed by Purge or Reset
+type PurgeStats struct {
+	// Files and Bytes count the removed files
+	Files int64
+	Bytes int64
+}
+
+// Purge deletes the directory of a target with all its mirrored data and metadata,
+// e.g. before the target is removed from the configuration. Files the target
+// stores in a bucket are deleted from the bucket as well. targetDir must be exactly
+// the directory named after the target below dataPath; frozen targets and targets
+// being synced are refused. A missing directory is not an error.
+func (m *Manager) Purge(ctx context.Context, target *config.Target, dataPath, targetDir string) (*PurgeStats, error) {
+	m = m.forTarget(target.Name)
+	stats := &PurgeStats{}
+	exists, err := checkRemovable(target, dataPath, targetDir)
+	if err != nil || !exists {
+		return stats, err
+	}
+	release, err := m.runs.TryAcquire(target.Name, targetDir, OperationPurge)
+	if err != nil {
+		return stats, err
+	}
+	defer release()
+
+	if target.Storage == config.StorageS3 {
+		store, err := m.newStorage(target, targetDir)
+		if err != nil {
+			return stats, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		err = store.Walk(targetDir, func(path string, info storage.FileInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			stats.Files++
+			stats.Bytes += info.Size
+			return nil
+		})
+		if err == nil {
+			err = store.RemoveAll(targetDir)
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to delete stored files of target %s: %w", target.Name, err)
+		}
+	}
+
+	// The directory is moved out of the way first, so that it disappears from the
+	// server at once and a run starting meanwhile begins with an empty directory
+	trash, err := os.MkdirTemp(dataPath, config.TempFilePrefix+"purge-")
+	if err != nil {
+		return stats, fmt.Errorf("failed to purge target %s: %w", target.Name, err)
+	}
+	if err := os.Rename(targetDir, filepath.Join(trash, target.Name)); err != nil {
+		os.Remove(trash)
+		return stats, fmt.Errorf("failed to purge target %s: %w", target.Name, err)
+	}
+
+	err = filepath.WalkDir(trash, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				stats.Files++
+				stats.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = os.RemoveAll(trash)
+	}
+	if err != nil {
+		return stats, fmt.Errorf("failed to purge target %s, its remains are in %s: %w", target.Name, trash, err)
+	}
+
+	m.logger.Info("Purged target", "path", targetDir, "files", stats.Files, "bytes", stats.Bytes)
+	return stats, nil
+}
+
+// Reset deletes the metadata of a target, such as its sync state and manifest, but
+// keeps the mirrored files. The next run adopts them again and checks every one
+// against the upstream. The same checks as for Purge apply.
+func (m *Manager) Reset(ctx context.Context, target *config.Target, dataPath, targetDir string) (*PurgeStats, error) {
+	m = m.forTarget(target.Name)
+	stats := &PurgeStats{}
+	exists, err := checkRemovable(target, dataPath, targetDir)
+	if err != nil || !exists {
+		return stats, err
+	}
+	release, err := m.runs.TryAcquire(target.Name, targetDir, OperationReset)
+	if err != nil {
+		return stats, err
+	}
+	defer release()
+
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		return stats, fmt.Errorf("failed to reset target %s: %w", target.Name, err)
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), config.MetadataPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(filepath.Join(targetDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return stats, fmt.Errorf("failed to reset target %s: %w", target.Name, err)
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+	}
+
+	m.logger.Info("Reset target metadata", "path", targetDir, "files", stats.Files, "bytes", stats.Bytes)
+	return stats, nil
+}
+
+// checkRemovable makes sure that targetDir is exactly the directory of target below
+// dataPath and that nothing else works on it, so that a wrong name or path never
+// removes anything else. It reports whether the directory exists.
+func checkRemovable(target *config.Target, dataPath, targetDir string) (bool, error) {
+	name := target.Name
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) ||
+		filepath.Base(name) != name || strings.HasPrefix(name, config.MetadataPrefix) {
+		return false, fmt.Errorf("invalid target name %q", name)
+	}
+	if target.Frozen {
+		return false, fmt.Errorf("target %s: %w", name, ErrTargetFrozen)
+	}
+	if dataPath == "" {
+		return false, fmt.Errorf("target %s: data path is not set", name)
+	}
+	root, err := filepath.Abs(dataPath)
+	if err != nil {
+		return false, fmt.Errorf("target %s: %w", name, err)
+	}
+	dir, err := filepath.Abs(targetDir)
+	if err != nil {
+		return false, fmt.Errorf("target %s: %w", name, err)
+	}
+	if dir != filepath.Join(root, name) {
+		return false, fmt.Errorf("target %s: refusing to remove %s, which is not %s", name, targetDir, filepath.Join(root, name))
+	}
+
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("target %s: %w", name, err)
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("target %s: refusing to remove %s, which is not a directory", name, targetDir)
+	}
+
+	marker, err := LoadSyncMarker(dir)
+	if err != nil {
+		return false, fmt.Errorf("target %s: %w", name, err)
+	}
+	if marker != nil {
+		return false, fmt.Errorf("target %s: %w since %s (pid %d on %q); remove %s if that run crashed",
+			name, ErrSyncInProgress, marker.Started.Format("2006-01-02 15:04:05 MST"), marker.PID, marker.Host, SyncMarkerFileName)
+	}
+	return true, nil
+}
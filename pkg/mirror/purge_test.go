@@ -0,0 +1,155 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// writeTargetTree creates files below dir, by slash-separated path
+func writeTargetTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	dataPath := t.TempDir()
+	writeTargetTree(t, dataPath, map[string]string{
+		"debian/pool/a.deb":       "12345",
+		"debian/README":           "abc",
+		"debian/" + StateFileName: "{}",
+		"debian-security/b.deb":   "sibling",
+	})
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	stats, err := manager.Purge(context.Background(), &config.Target{Name: "debian"}, dataPath, filepath.Join(dataPath, "debian"))
+	if err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+	if stats.Files != 3 || stats.Bytes != 10 {
+		t.Errorf("Expected 3 files of 10 bytes, got %+v", stats)
+	}
+
+	// Only the sibling is left, without any remains of the purge
+	entries, _ := os.ReadDir(dataPath)
+	if len(entries) != 1 || entries[0].Name() != "debian-security" {
+		t.Errorf("Expected only the sibling target to remain, got %v", entries)
+	}
+
+	// Purging again finds nothing to do
+	stats, err = manager.Purge(context.Background(), &config.Target{Name: "debian"}, dataPath, filepath.Join(dataPath, "debian"))
+	if err != nil || stats.Files != 0 {
+		t.Errorf("Expected purging a missing directory to do nothing, got %+v, %v", stats, err)
+	}
+}
+
+func TestPurgeRefusesUnsafeTargets(t *testing.T) {
+	dataPath := t.TempDir()
+	writeTargetTree(t, dataPath, map[string]string{
+		"debian/README":  "keep",
+		"syncing/README": "keep",
+		"other/README":   "keep",
+	})
+	marker := `{"target":"syncing","started":"2024-05-01T12:00:00Z","pid":42}`
+	writeTargetTree(t, dataPath, map[string]string{"syncing/" + SyncMarkerFileName: marker})
+	if err := os.Symlink(filepath.Join(dataPath, "other"), filepath.Join(dataPath, "linked")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		target    config.Target
+		dataPath  string
+		targetDir string
+		wantErr   error
+	}{
+		{"sibling directory", config.Target{Name: "debian"}, dataPath, filepath.Join(dataPath, "other"), nil},
+		{"data path itself", config.Target{Name: "debian"}, dataPath, dataPath, nil},
+		{"nested directory", config.Target{Name: "debian"}, dataPath, filepath.Join(dataPath, "debian", "pool"), nil},
+		{"name with separator", config.Target{Name: "debian/.."}, dataPath, dataPath, nil},
+		{"parent name", config.Target{Name: ".."}, dataPath, filepath.Dir(dataPath), nil},
+		{"metadata name", config.Target{Name: config.MetadataPrefix + "usage.json"}, dataPath, filepath.Join(dataPath, config.MetadataPrefix+"usage.json"), nil},
+		{"missing data path", config.Target{Name: "debian"}, "", "debian", nil},
+		{"symbolic link", config.Target{Name: "linked"}, dataPath, filepath.Join(dataPath, "linked"), nil},
+		{"frozen target", config.Target{Name: "debian", Frozen: true}, dataPath, filepath.Join(dataPath, "debian"), ErrTargetFrozen},
+		{"sync in progress", config.Target{Name: "syncing"}, dataPath, filepath.Join(dataPath, "syncing"), ErrSyncInProgress},
+	}
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, remove := range []func(context.Context, *config.Target, string, string) (*PurgeStats, error){manager.Purge, manager.Reset} {
+				_, err := remove(context.Background(), &tt.target, tt.dataPath, tt.targetDir)
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
+				}
+			}
+		})
+	}
+
+	for _, name := range []string{"debian/README", "syncing/README", "syncing/" + SyncMarkerFileName, "other/README"} {
+		if _, err := os.Stat(filepath.Join(dataPath, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected %s to be kept: %v", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dataPath, "linked")); err != nil {
+		t.Errorf("Expected the symbolic link to be kept: %v", err)
+	}
+}
+
+func TestResetKeepsFiles(t *testing.T) {
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "debian")
+	writeTargetTree(t, dataPath, map[string]string{
+		"debian/pool/a.deb":            "12345",
+		"debian/" + StateFileName:      "{}",
+		"debian/" + ManifestFileName:   `{"files":{}}`,
+		"debian/pool/" + StateFileName: "not metadata of the target",
+	})
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	stats, err := manager.Reset(context.Background(), &config.Target{Name: "debian"}, dataPath, targetDir)
+	if err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if stats.Files != 2 {
+		t.Errorf("Expected 2 metadata files removed, got %+v", stats)
+	}
+
+	for _, name := range []string{StateFileName, ManifestFileName} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"pool/a.deb", "pool/" + StateFileName} {
+		if _, err := os.Stat(filepath.Join(targetDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected %s to be kept: %v", name, err)
+		}
+	}
+
+	// The next run takes the remaining files over again
+	if !needsAdoption(targetDir) {
+		t.Error("Expected the reset target to be adopted by the next run")
+	}
+	state, err := LoadTargetState(targetDir)
+	if err != nil || state.Synced() {
+		t.Errorf("Expected the reset target to have no sync state, got %+v, %v", state, err)
+	}
+}
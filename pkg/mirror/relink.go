@@ -0,0 +1,256 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// checksumFileNames are the upstream checksum lists parsed for relinking and
+// Target.VerifyChecksums, lowercase
+var checksumFileNames = map[string]bool{
+	"sha256sums":     true,
+	"sha256sums.txt": true,
+	"sha256sum.txt":  true,
+	"md5sums":        true,
+	"md5sums.txt":    true,
+	"md5sum.txt":     true,
+}
+
+// md5ETag matches a single-part S3 ETag, which is the MD5 of the content
+var md5ETag = regexp.MustCompile(`^"?([0-9a-fA-F]{32})"?$`)
+
+// isChecksumFile reports whether a file name is an upstream checksum list
+func isChecksumFile(name string) bool {
+	return checksumFileNames[strings.ToLower(name)]
+}
+
+// checksumFilesFirst moves checksum lists to the front of links, so their sums are
+// known before the files they describe are downloaded
+func checksumFilesFirst(links []string) []string {
+	ordered := make([]string, 0, len(links))
+	for _, link := range links {
+		if isChecksumFile(path.Base(linkPath(link))) {
+			ordered = append(ordered, link)
+		}
+	}
+	if len(ordered) == 0 {
+		return links
+	}
+	for _, link := range links {
+		if !isChecksumFile(path.Base(linkPath(link))) {
+			ordered = append(ordered, link)
+		}
+	}
+	return ordered
+}
+
+// digestIndex finds files from earlier runs by content hash
+type digestIndex struct {
+	sha256 map[string]string
+	md5    map[string]string
+	files  map[string]FileSource
+	// urls maps the URL files were downloaded from to their manifest key
+	urls map[string]string
+}
+
+// newDigestIndex indexes the hashed files of a manifest
+func newDigestIndex(manifest *Manifest) *digestIndex {
+	index := &digestIndex{
+		sha256: make(map[string]string),
+		md5:    make(map[string]string),
+		files:  manifest.Files,
+		urls:   make(map[string]string),
+	}
+	for rel, source := range manifest.Files {
+		if source.URL != "" {
+			index.urls[source.URL] = rel
+		}
+		if source.SHA256 != "" {
+			index.sha256[source.SHA256] = rel
+		}
+		if source.MD5 != "" {
+			index.md5[source.MD5] = rel
+		}
+	}
+	return index
+}
+
+// byURL returns the manifest key of the file downloaded from url
+func (i *digestIndex) byURL(url string) (string, bool) {
+	if i == nil {
+		return "", false
+	}
+	rel, ok := i.urls[url]
+	return rel, ok
+}
+
+// lookup returns the manifest key of a file with the expected content
+func (i *digestIndex) lookup(expected httpPkg.Digest) (string, bool) {
+	if i == nil {
+		return "", false
+	}
+	if rel, ok := i.sha256[expected.SHA256]; ok && expected.SHA256 != "" {
+		return rel, true
+	}
+	if rel, ok := i.md5[expected.MD5]; ok && expected.MD5 != "" {
+		return rel, true
+	}
+	return "", false
+}
+
+// loadChecksums records the SHA-256 and MD5 sums listed in a downloaded checksum
+// file for the URLs they describe, relative to the directory at dirURL
+func (m *Manager) loadChecksums(stats *MirrorStats, dirURL *url.URL, localPath string) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.checksums == nil {
+		stats.checksums = make(map[string]httpPkg.Digest)
+	}
+	parseChecksums(file, dirURL, stats.checksums)
+}
+
+// parseChecksums adds the sums of the checksum list r to digests, keyed by the URLs
+// they describe relative to the directory at dirURL
+func parseChecksums(r io.Reader, dirURL *url.URL, digests map[string]httpPkg.Digest) {
+	// Lines look like "<hex>  <name>", or "<hex> *<name>" in binary mode; the
+	// length of the hash tells SHA-256 from MD5
+	scanner := bufio.NewScanner(io.LimitReader(r, 64<<20))
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok || (len(sum) != 64 && len(sum) != 32) || !isHex(sum) {
+			continue
+		}
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		ref, err := url.Parse(path.Clean(name))
+		if err != nil || name == "" {
+			continue
+		}
+		key := dirURL.ResolveReference(ref).String()
+		digest := digests[key]
+		if len(sum) == 64 {
+			digest.SHA256 = strings.ToLower(sum)
+		} else {
+			digest.MD5 = strings.ToLower(sum)
+		}
+		digests[key] = digest
+	}
+}
+
+// isHex reports whether s consists of hexadecimal digits only
+func isHex(s string) bool {
+	return strings.Trim(s, "0123456789abcdefABCDEF") == ""
+}
+
+// expectedDigest returns the upstream content hashes known for rawURL before
+// downloading it: from checksum lists, or from an ETag that is an MD5
+func (stats *MirrorStats) expectedDigest(rawURL string, remoteInfo *httpPkg.FileInfo) httpPkg.Digest {
+	stats.mu.Lock()
+	digest := stats.checksums[rawURL]
+	stats.mu.Unlock()
+	if remoteInfo != nil && digest.MD5 == "" {
+		if match := md5ETag.FindStringSubmatch(remoteInfo.ETag); match != nil {
+			digest.MD5 = strings.ToLower(match[1])
+		}
+	}
+	return digest
+}
+
+// relink creates localPath from an identical file mirrored earlier under another
+// path, e.g. after the upstream moved it, instead of downloading it again. The data
+// is hard-linked, or copied where links are unsupported. It reports whether
+// localPath was created.
+func (m *Manager) relink(ctx context.Context, stats *MirrorStats, rawURL, localPath string, remoteInfo *httpPkg.FileInfo) bool {
+	if _, err := os.Lstat(localPath); !os.IsNotExist(err) {
+		return false
+	}
+
+	expected := stats.expectedDigest(rawURL, remoteInfo)
+	rel, ok := stats.digests.lookup(expected)
+	if !ok {
+		return false
+	}
+	source := stats.digests.files[rel]
+	existing := filepath.Join(stats.root, filepath.FromSlash(rel))
+
+	// The earlier copy must still be the file that was hashed
+	stat, err := os.Stat(existing)
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() != source.Size || !stat.ModTime().Equal(source.ModTime) {
+		return false
+	}
+
+	if err := linkOrCopy(existing, localPath); err != nil {
+		m.logger.Debug("Could not relink file, downloading", "path", localPath, "from", existing, "error", err)
+		return false
+	}
+
+	if m.config.Mirror.VerifyRelinks {
+		digest, err := fileDigest(ctx, localPath)
+		if err == nil {
+			err = digest.Verify(expected, localPath)
+		}
+		if err != nil {
+			m.logger.Warn("Relinked file failed verification, downloading", "path", localPath, "from", existing, "error", err)
+			os.Remove(localPath)
+			return false
+		}
+	}
+
+	m.logger.Debug("Relinked moved file", "url", rawURL, "path", localPath, "from", existing)
+	atomic.AddInt64(&stats.FilesRelinked, 1)
+	atomic.AddInt64(&stats.BytesSavedByRelink, stat.Size())
+	m.fileEvent(stats, FileAdded, localPath, rawURL, stat.Size(), source.SHA256)
+	stats.recordSource(localPath, rawURL, httpPkg.Digest{SHA256: source.SHA256, MD5: source.MD5})
+	m.emit(stats, Event{Type: EventFileRelinked, URL: rawURL, Path: localPath, Bytes: stat.Size()})
+	return true
+}
+
+// linkOrCopy creates dst with the content and modification time of src
+func linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, stat.ModTime(), stat.ModTime())
+}
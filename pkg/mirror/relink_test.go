@@ -0,0 +1,196 @@
+package mirror
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+func TestRunRelinksMovedFiles(t *testing.T) {
+	content := []byte("a large artifact")
+	sha := sha256.Sum256(content)
+
+	// The first run sees the artifact in pool/a/, the second in pool/all/a/
+	var moved atomic.Bool
+	var downloads atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			if moved.Load() {
+				w.Write([]byte(`<a href="all/">all</a>`))
+			} else {
+				w.Write([]byte(`<a href="a/">a</a>`))
+			}
+		case "/a/", "/all/a/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="pkg.deb">pkg.deb</a><a href="SHA256SUMS">SHA256SUMS</a>`))
+		case "/all/":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a/">a</a>`))
+		case "/a/SHA256SUMS", "/all/a/SHA256SUMS":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "%s *pkg.deb\n", hex.EncodeToString(sha[:]))
+		default:
+			downloads.Add(1)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(content)
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{Mirror: config.Mirror{VerifyRelinks: true}},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "relink", URL: server.URL + "/", MaxDepth: 5, Timeout: 5}
+
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("First run failed: %v", err)
+	}
+	if downloads.Load() != 1 {
+		t.Fatalf("Expected 1 download in the first run, got %d", downloads.Load())
+	}
+
+	moved.Store(true)
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if downloads.Load() != 1 {
+		t.Errorf("Expected the moved file not to be downloaded again, got %d downloads", downloads.Load())
+	}
+	if stats.FilesRelinked != 1 || stats.BytesSavedByRelink != int64(len(content)) {
+		t.Errorf("Expected 1 relinked file saving %d bytes, got %d and %d",
+			len(content), stats.FilesRelinked, stats.BytesSavedByRelink)
+	}
+
+	data, err := os.ReadFile(filepath.Join(targetDir, "all", "a", "pkg.deb"))
+	if err != nil || string(data) != string(content) {
+		t.Errorf("Expected relinked file with the original content, got %q (%v)", data, err)
+	}
+
+	manifest, _ := LoadManifest(targetDir)
+	if source, _ := manifest.Lookup("all/a/pkg.deb"); source.SHA256 != hex.EncodeToString(sha[:]) || source.URL != server.URL+"/all/a/pkg.deb" {
+		t.Errorf("Expected relinked file recorded with its new origin and hash, got %+v", source)
+	}
+}
+
+func TestRelinkByETag(t *testing.T) {
+	content := []byte("object")
+	sum := md5.Sum(content)
+
+	targetDir := t.TempDir()
+	old := filepath.Join(targetDir, "old.bin")
+	if err := os.WriteFile(old, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat(old)
+	manifest := &Manifest{Files: map[string]FileSource{
+		"old.bin": {Size: stat.Size(), ModTime: stat.ModTime(), MD5: hex.EncodeToString(sum[:])},
+	}}
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	stats := &MirrorStats{root: targetDir, digests: newDigestIndex(manifest)}
+	newPath := filepath.Join(targetDir, "new", "new.bin")
+
+	tests := []struct {
+		etag string
+		want bool
+	}{
+		{`"0123456789abcdef0123456789abcdef"`, false},
+		{`"` + hex.EncodeToString(sum[:]) + `-2"`, false}, // multipart ETags are not MD5s
+		{`"` + hex.EncodeToString(sum[:]) + `"`, true},
+	}
+	for _, tt := range tests {
+		got := manager.relink(context.Background(), stats, "http://up/new.bin", newPath, &httpPkg.FileInfo{ETag: tt.etag})
+		if got != tt.want {
+			t.Errorf("relink with ETag %s = %v, want %v", tt.etag, got, tt.want)
+		}
+	}
+
+	// Changed since it was hashed: never relinked
+	os.Remove(newPath)
+	os.WriteFile(old, []byte("modified"), 0644)
+	if manager.relink(context.Background(), stats, "http://up/new.bin", newPath, &httpPkg.FileInfo{ETag: `"` + hex.EncodeToString(sum[:]) + `"`}) {
+		t.Error("Expected a modified earlier copy not to be relinked")
+	}
+}
+
+func TestRunVerifyChecksums(t *testing.T) {
+	previous := listingRetryDelay
+	listingRetryDelay = time.Millisecond
+	t.Cleanup(func() { listingRetryDelay = previous })
+
+	files := map[string]string{"a.iso": "image a", "b.iso": "image b", "c.iso": "image c", "notes.txt": "notes"}
+	sha := sha256.Sum256([]byte(files["a.iso"]))
+	sum := md5.Sum([]byte(files["b.iso"]))
+	var requests sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		count, _ := requests.LoadOrStore(name, new(atomic.Int64))
+		n := count.(*atomic.Int64).Add(1)
+		switch name {
+		case "/", ".":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="a.iso">a.iso</a><a href="b.iso">b.iso</a><a href="c.iso">c.iso</a>`+
+				`<a href="notes.txt">notes.txt</a><a href="SHA256SUMS">SHA256SUMS</a><a href="MD5SUMS">MD5SUMS</a>`)
+		case "SHA256SUMS":
+			fmt.Fprintf(w, "%s *a.iso\n%s  c.iso\n", hex.EncodeToString(sha[:]), strings.Repeat("0", 64))
+		case "MD5SUMS":
+			fmt.Fprintf(w, "%s  b.iso\n", hex.EncodeToString(sum[:]))
+		case "b.iso":
+			// The first transfer is corrupted on the way
+			if n == 1 {
+				io.WriteString(w, "image B")
+				return
+			}
+			io.WriteString(w, files[name])
+		default:
+			io.WriteString(w, files[name])
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "iso", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, Retries: 2, VerifyChecksums: true}
+	stats, err := manager.Run(context.Background(), target, dir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesVerified != 2 || stats.ChecksumMismatches != 1 || stats.Errors != 1 || stats.Retries != 2 {
+		t.Errorf("Expected 2 verified files and 1 mismatch after 2 retries, got %+v", stats)
+	}
+	for name, content := range files {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if name == "c.iso" {
+			if !os.IsNotExist(err) {
+				t.Errorf("Expected the mismatching c.iso discarded, got %q (%v)", data, err)
+			}
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	if count, _ := requests.Load("c.iso"); count.(*atomic.Int64).Load() != 2 {
+		t.Errorf("Expected c.iso requested as often as Retries allows, got %d", count.(*atomic.Int64).Load())
+	}
+}
@@ -0,0 +1,68 @@
+package mirror
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// retryDelay is the pause before the given retry of a request: listingRetryDelay
+// doubling with every attempt, or the Retry-After the upstream asked for, capped
+// at maxListingRetryDelay. Computed pauses are jittered down to half their length,
+// so that workers failing together do not retry together.
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, maxListingRetryDelay)
+	}
+	delay := min(listingRetryDelay<<(attempt-1), maxListingRetryDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sleepRetry waits out delay, returning early with the error of ctx once it ends
+func sleepRetry(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// withRetries runs request up to attempts times in total, as long as it fails with
+// a temporary error: timeouts, network errors, 5xx, 408 and 429. Other failures,
+// such as 404, are returned at once. Every retry is counted in stats.Retries.
+func (m *Manager) withRetries(ctx context.Context, stats *MirrorStats, attempts int, op, url string, request func() error) error {
+	return m.withRetriesIf(ctx, stats, attempts, op, url, httpPkg.IsTemporary, request)
+}
+
+// withRetriesIf runs request like withRetries, retrying the failures retryable
+// reports instead of the temporary ones
+func (m *Manager) withRetriesIf(ctx context.Context, stats *MirrorStats, attempts int, op, url string,
+	retryable func(error) bool, request func() error,
+) error {
+	// Start times of failed requests are kept for the failures of the skip report
+	var started []time.Time
+	for attempt := 1; ; attempt++ {
+		started = append(started, time.Now())
+		err := request()
+		if err == nil || attempt >= attempts || !retryable(err) || ctx.Err() != nil {
+			if err != nil && m.config.Mirror.ReportDetail == config.ReportFull {
+				stats.attempted(url, started)
+			}
+			return err
+		}
+
+		delay := retryDelay(attempt, 0)
+		atomic.AddInt64(&stats.Retries, 1)
+		m.logger.Debug("Retrying "+op, "url", url, "attempt", attempt+1, "delay", delay, "error", err)
+		if err := sleepRetry(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRetryDelay(t *testing.T) {
+	fastListingRetries(t)
+
+	for attempt := 1; attempt <= 4; attempt++ {
+		full := time.Millisecond << (attempt - 1)
+		if delay := retryDelay(attempt, 0); delay < full/2 || delay > full {
+			t.Errorf("Attempt %d: expected between %v and %v, got %v", attempt, full/2, full, delay)
+		}
+	}
+	if delay := retryDelay(1, 5*time.Second); delay != 5*time.Second {
+		t.Errorf("Expected Retry-After to be honored, got %v", delay)
+	}
+	if delay := retryDelay(1, time.Hour); delay != maxListingRetryDelay {
+		t.Errorf("Expected Retry-After to be capped, got %v", delay)
+	}
+}
+
+// newFlakyServer serves a listing of a.txt, failing the first failures requests
+// for it with status, and counts the requests for the file
+func newFlakyServer(t *testing.T, failures int64, status int) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="a.txt">a.txt</a>`)
+			return
+		}
+		if requests.Add(1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		io.WriteString(w, "content")
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestRunRetriesDownloads(t *testing.T) {
+	fastListingRetries(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name       string
+		retries    int
+		status     int
+		requests   int64
+		retried    int64
+		downloaded int64
+	}{
+		{"recovers within the attempts", 3, http.StatusServiceUnavailable, 3, 2, 1},
+		{"gives up after the attempts", 1, http.StatusServiceUnavailable, 1, 0, 0},
+		{"client errors fail at once", 3, http.StatusForbidden, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newFlakyServer(t, 2, tt.status)
+			manager := NewManager(&config.Config{}, logger)
+			target := &config.Target{Name: "flaky", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, Retries: tt.retries}
+
+			stats, err := manager.Run(context.Background(), target, t.TempDir())
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if requests.Load() != tt.requests || stats.Retries != tt.retried || stats.FilesDownloaded != tt.downloaded {
+				t.Errorf("Expected %d requests, %d retries and %d downloads, got %d requests and %+v",
+					tt.requests, tt.retried, tt.downloaded, requests.Load(), stats)
+			}
+			if stats.Errors != 1-tt.downloaded {
+				t.Errorf("Expected %d errors, got %d", 1-tt.downloaded, stats.Errors)
+			}
+		})
+	}
+}
+
+func TestRunRetriesFileInfo(t *testing.T) {
+	fastListingRetries(t)
+
+	var heads atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="a.txt">a.txt</a>`)
+			return
+		}
+		if r.Method == http.MethodHead && heads.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(w, "content")
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "head", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, Retries: 3, CheckChanges: true}
+	stats, err := manager.Run(context.Background(), target, t.TempDir())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if heads.Load() != 2 || stats.Retries != 1 || stats.FilesDownloaded != 1 {
+		t.Errorf("Expected the HEAD request to be retried once, got %d requests and %+v", heads.Load(), stats)
+	}
+}
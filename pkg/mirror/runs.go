@@ -0,0 +1,209 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policies for a run of a target directory that another run holds, see
+// WithDuplicateRuns
+const (
+	// DuplicateRunsQueue makes the run wait until the runs before it are done
+	DuplicateRunsQueue = "queue"
+	// DuplicateRunsReject fails the run at once with ErrSyncInProgress
+	DuplicateRunsReject = "reject"
+)
+
+// States of the runs reported by RunCoordinator.Runs
+const (
+	RunRunning = "running"
+	RunQueued  = "queued"
+)
+
+// Operations of the runs reported by RunCoordinator.Runs
+const (
+	OperationRun    = "run"
+	OperationPurge  = "purge"
+	OperationReset  = "reset"
+	OperationAdopt  = "adopt"
+	OperationVerify = "verify"
+)
+
+// Runs coordinates the runs of all managers of the process that do not share
+// another coordinator through WithRunCoordinator
+var Runs = NewRunCoordinator()
+
+// RunStatus describes a run holding or waiting for a target directory
+type RunStatus struct {
+	Target string `json:"target"`
+	Dir    string `json:"dir"`
+	// Operation is one of the Operation constants
+	Operation string `json:"operation"`
+	// State is RunRunning or RunQueued
+	State string `json:"state"`
+	// Position is the place of a queued run in the queue of its directory, from 1
+	Position int `json:"position,omitempty"`
+	// Since is when the run started, or was queued while it waits
+	Since time.Time `json:"since"`
+}
+
+// RunCoordinator serializes the runs of a process that write the same target
+// directory, so that the manifest, state and other metadata of a target are never
+// written by two runs at once, e.g. by a scheduled run and one triggered through an
+// API. Directories are told apart by their absolute path; two targets configured
+// with the same directory share it. Runs of different directories do not wait for
+// each other. It is safe for concurrent use.
+type RunCoordinator struct {
+	mu   sync.Mutex
+	dirs map[string]*dirRuns
+}
+
+// dirRuns is the run holding a directory and the runs queued behind it
+type dirRuns struct {
+	active RunStatus
+	queue  []*queuedRun
+}
+
+// queuedRun is a run waiting for a directory; ready is closed once it holds it
+type queuedRun struct {
+	status RunStatus
+	ready  chan struct{}
+}
+
+// NewRunCoordinator creates a coordinator without runs
+func NewRunCoordinator() *RunCoordinator {
+	return &RunCoordinator{dirs: make(map[string]*dirRuns)}
+}
+
+// runKey returns the path dir is coordinated under
+func runKey(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return filepath.Clean(dir)
+}
+
+// TryAcquire makes the operation of target hold dir and returns the function
+// releasing it. If another run holds dir or waits for it, it fails with
+// ErrSyncInProgress instead.
+func (c *RunCoordinator) TryAcquire(target, dir, operation string) (func(), error) {
+	key := runKey(dir)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if runs := c.dirs[key]; runs != nil {
+		return nil, fmt.Errorf("target %s: %w: %s of target %s since %s", target, ErrSyncInProgress,
+			runs.active.Operation, runs.active.Target, runs.active.Since.Format("2006-01-02 15:04:05 MST"))
+	}
+	c.dirs[key] = &dirRuns{active: RunStatus{Target: target, Dir: key, Operation: operation, State: RunRunning, Since: time.Now()}}
+	return c.releaser(key), nil
+}
+
+// Acquire makes the operation of target hold dir like TryAcquire, but waits in
+// line behind the runs that hold or wait for dir. Runs get the directory in the
+// order they asked for it. It fails with the error of ctx if ctx ends first.
+func (c *RunCoordinator) Acquire(ctx context.Context, target, dir, operation string) (func(), error) {
+	key := runKey(dir)
+	status := RunStatus{Target: target, Dir: key, Operation: operation, State: RunRunning, Since: time.Now()}
+	c.mu.Lock()
+	runs := c.dirs[key]
+	if runs == nil {
+		c.dirs[key] = &dirRuns{active: status}
+		c.mu.Unlock()
+		return c.releaser(key), nil
+	}
+	status.State = RunQueued
+	queued := &queuedRun{status: status, ready: make(chan struct{})}
+	runs.queue = append(runs.queue, queued)
+	c.mu.Unlock()
+
+	select {
+	case <-queued.ready:
+		return c.releaser(key), nil
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-queued.ready:
+		// The directory was handed over meanwhile and is passed on at once
+		c.release(key)
+	default:
+		for i, q := range runs.queue {
+			if q == queued {
+				runs.queue = append(runs.queue[:i], runs.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// releaser returns the function releasing key once
+func (c *RunCoordinator) releaser(key string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.release(key)
+		})
+	}
+}
+
+// release hands key over to the first run in its queue; c.mu must be held
+func (c *RunCoordinator) release(key string) {
+	runs := c.dirs[key]
+	if len(runs.queue) == 0 {
+		delete(c.dirs, key)
+		return
+	}
+	next := runs.queue[0]
+	runs.queue = runs.queue[1:]
+	runs.active = next.status
+	runs.active.State, runs.active.Since = RunRunning, time.Now()
+	close(next.ready)
+}
+
+// Runs returns the runs holding or waiting for a directory, ordered by directory
+// with the running one first and the queued ones in queue order
+func (c *RunCoordinator) Runs() []RunStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.dirs))
+	for key := range c.dirs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var statuses []RunStatus
+	for _, key := range keys {
+		runs := c.dirs[key]
+		statuses = append(statuses, runs.active)
+		for i, queued := range runs.queue {
+			status := queued.status
+			status.Position = i + 1
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// acquireRun makes a run of target hold targetDir, waiting for or rejecting a run
+// in progress by the duplicate run policy of the manager
+func (m *Manager) acquireRun(ctx context.Context, target, targetDir string) (func(), error) {
+	release, err := m.runs.TryAcquire(target, targetDir, OperationRun)
+	if err == nil || m.duplicateRuns == DuplicateRunsReject {
+		return release, err
+	}
+	m.logger.Info("Waiting for a run in progress in the target directory", "reason", err)
+	release, err = m.runs.Acquire(ctx, target, targetDir, OperationRun)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", target, err)
+	}
+	return release, nil
+}
@@ -0,0 +1,202 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// waitForRuns polls c until it reports n runs
+func waitForRuns(t *testing.T, c *RunCoordinator, n int) []RunStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runs := c.Runs()
+		if len(runs) == n {
+			return runs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d runs, got %+v", n, runs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunCoordinatorQueuesInOrder(t *testing.T) {
+	c := NewRunCoordinator()
+	dir := t.TempDir()
+	release, err := c.TryAcquire("first", dir, OperationRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in use is refused without waiting, also by another spelling
+	if _, err := c.TryAcquire("other", filepath.Join(dir, "sub", ".."), OperationPurge); !errors.Is(err, ErrSyncInProgress) {
+		t.Errorf("Expected ErrSyncInProgress, got %v", err)
+	}
+	// Other directories are independent
+	releaseOther, err := c.TryAcquire("other", t.TempDir(), OperationRun)
+	if err != nil {
+		t.Fatalf("Expected another directory to be free, got %v", err)
+	}
+	releaseOther()
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, name := range []string{"second", "third"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := c.Acquire(context.Background(), name, dir, OperationRun)
+			if err != nil {
+				t.Errorf("Acquire failed: %v", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			release()
+		}()
+		// Queue the runs one after the other
+		waitForRuns(t, c, i+2)
+	}
+
+	runs := c.Runs()
+	if runs[0].Target != "first" || runs[0].State != RunRunning || runs[0].Position != 0 {
+		t.Errorf("Expected the first run to be running, got %+v", runs[0])
+	}
+	for i, name := range []string{"second", "third"} {
+		if run := runs[i+1]; run.Target != name || run.State != RunQueued || run.Position != i+1 || run.Dir != dir {
+			t.Errorf("Expected %s queued at %d, got %+v", name, i+1, run)
+		}
+	}
+
+	release()
+	release() // releasing twice does not hand the directory over twice
+	wg.Wait()
+	if len(order) != 2 || order[0] != "second" || order[1] != "third" {
+		t.Errorf("Expected the queued runs in order, got %v", order)
+	}
+	if runs := c.Runs(); len(runs) != 0 {
+		t.Errorf("Expected no runs left, got %+v", runs)
+	}
+}
+
+func TestRunCoordinatorCancelsQueuedRun(t *testing.T) {
+	c := NewRunCoordinator()
+	dir := t.TempDir()
+	release, err := c.TryAcquire("first", dir, OperationRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := c.Acquire(ctx, "second", dir, OperationRun)
+		done <- err
+	}()
+	waitForRuns(t, c, 2)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the queued run to be canceled, got %v", err)
+	}
+	if runs := c.Runs(); len(runs) != 1 || runs[0].Target != "first" {
+		t.Errorf("Expected the canceled run to leave the queue, got %+v", runs)
+	}
+
+	release()
+	if runs := c.Runs(); len(runs) != 0 {
+		t.Errorf("Expected the directory to be free, got %+v", runs)
+	}
+}
+
+func TestRunSerializesOverlappingRuns(t *testing.T) {
+	// Downloads block until the test lets them go
+	var listings, downloads, open, overlaps atomic.Int32
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			listings.Add(1)
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="file.txt">file.txt</a>`))
+			return
+		}
+		if open.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+		defer open.Add(-1)
+		downloads.Add(1)
+		<-unblock
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	coordinator := NewRunCoordinator()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := NewManager(&config.Config{}, logger, WithRunCoordinator(coordinator))
+	rejecting := NewManager(&config.Config{}, logger, WithRunCoordinator(coordinator), WithDuplicateRuns(DuplicateRunsReject))
+	targetDir := t.TempDir()
+	// Two targets misconfigured with the same directory
+	scheduled := &config.Target{Name: "scheduled", URL: server.URL + "/", MaxDepth: 1, Timeout: 5, CheckChanges: true}
+	triggered := &config.Target{Name: "triggered", URL: server.URL + "/", MaxDepth: 1, Timeout: 5, CheckChanges: true}
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := manager.Run(context.Background(), scheduled, targetDir)
+		errs <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for downloads.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		_, err := manager.Run(context.Background(), triggered, targetDir)
+		errs <- err
+	}()
+	runs := waitForRuns(t, coordinator, 2)
+	if runs[0].Target != "scheduled" || runs[0].State != RunRunning || runs[1].Target != "triggered" ||
+		runs[1].State != RunQueued || runs[1].Position != 1 {
+		t.Errorf("Expected the triggered run to be queued behind the scheduled one, got %+v", runs)
+	}
+	if listings.Load() != 1 {
+		t.Errorf("Expected the queued run not to start, got %d listings", listings.Load())
+	}
+
+	// With the reject policy the run fails at once and is not queued
+	if _, err := rejecting.Run(context.Background(), triggered, targetDir); !errors.Is(err, ErrSyncInProgress) {
+		t.Errorf("Expected ErrSyncInProgress, got %v", err)
+	}
+	if runs := coordinator.Runs(); len(runs) != 2 {
+		t.Errorf("Expected the rejected run not to be queued, got %+v", runs)
+	}
+	// Neither are operations rewriting the directory
+	if _, err := manager.Adopt(context.Background(), "scheduled", targetDir, false); !errors.Is(err, ErrSyncInProgress) {
+		t.Errorf("Expected Adopt to be refused, got %v", err)
+	}
+
+	close(unblock)
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	}
+	if listings.Load() != 2 || overlaps.Load() != 0 {
+		t.Errorf("Expected two runs one after the other, got %d listings and %d overlaps", listings.Load(), overlaps.Load())
+	}
+	if runs := coordinator.Runs(); len(runs) != 0 {
+		t.Errorf("Expected no runs left, got %+v", runs)
+	}
+}
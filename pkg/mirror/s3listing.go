@@ -0,0 +1,232 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// ListingS3 is the format of S3 ListObjectsV2 listings
+const ListingS3 = "s3"
+
+// listingFormatS3 is the Target.ListingFormat of S3-style bucket endpoints
+const listingFormatS3 = "s3"
+
+// s3Bucket is the S3-style endpoint a target is mirrored from. Directories are
+// the common prefixes of the keys up to a "/".
+type s3Bucket struct {
+	// endpoint is the bucket URL without query; its path ends with a slash
+	endpoint *url.URL
+	// prefix is the key prefix of the target, empty or ending with a slash
+	prefix string
+}
+
+// s3ListResult is a page of a ListObjectsV2 response
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// parseS3Target splits a target URL into the bucket endpoint, e.g.
+// "https://bucket.s3.amazonaws.com/" or "http://minio:9000/bucket/", and the key
+// prefix given by its "prefix" query parameter
+func parseS3Target(rawURL string) (*s3Bucket, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimPrefix(parsed.Query().Get("prefix"), "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	endpoint := *parsed
+	endpoint.RawQuery, endpoint.Fragment = "", ""
+	if !strings.HasSuffix(endpoint.Path, "/") {
+		endpoint.Path += "/"
+		endpoint.RawPath = ""
+	}
+	return &s3Bucket{endpoint: &endpoint, prefix: prefix}, nil
+}
+
+// dirPrefix returns the key prefix of the directory at rel
+func (b *s3Bucket) dirPrefix(rel string) string {
+	if rel == "" {
+		return b.prefix
+	}
+	return b.prefix + rel + "/"
+}
+
+// dirURL returns the URL the objects of the directory at rel are downloaded
+// below: the endpoint followed by the escaped key prefix
+func (b *s3Bucket) dirURL(rel string) *url.URL {
+	dir := *b.endpoint
+	for _, segment := range strings.SplitAfter(b.dirPrefix(rel), "/") {
+		if name := strings.TrimSuffix(segment, "/"); name != "" {
+			dir = *dir.ResolveReference(&url.URL{Path: "./" + name + "/"})
+		}
+	}
+	return &dir
+}
+
+// listURL returns the ListObjectsV2 request for a page of the keys below prefix
+func (b *s3Bucket) listURL(prefix, token string) string {
+	query := url.Values{"list-type": {"2"}, "delimiter": {"/"}, "prefix": {prefix}}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	list := *b.endpoint
+	list.RawQuery = query.Encode()
+	return list.String()
+}
+
+// isS3Listing reports whether a response in auto mode is an S3 bucket listing
+// by sniffing the start of its body
+func isS3Listing(target *config.Target, contentType string, body io.Reader) bool {
+	if target.ListingFormat != "" && target.ListingFormat != listingFormatAuto {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/xml" && mediaType != "text/xml" {
+		return false
+	}
+	head := make([]byte, listingSniffBytes)
+	n, _ := io.ReadFull(body, head)
+	return bytes.Contains(head[:n], []byte("<ListBucketResult"))
+}
+
+// mirrorS3Dir mirrors the directory of job from the S3 listing of its prefix
+func (m *Manager) mirrorS3Dir(ctx context.Context, client *httpPkg.Client, target *config.Target,
+	job dirJob, stats *MirrorStats,
+) ([]dirJob, error) {
+	dirURL := stats.s3.dirURL(job.rel)
+	listing, err := m.listS3(ctx, client, target, stats.s3.dirPrefix(job.rel), stats)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		atomic.AddInt64(&stats.Errors, 1)
+		var parseErr *ListingParseError
+		if errors.As(err, &parseErr) {
+			m.warnFailure(stats, "Failed to parse directory listing", dirURL.String(), err)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to fetch directory listing from %s: %w", dirURL, err)
+	}
+
+	m.recordListing(stats, dirURL.String(), listing)
+	if len(listing.Links) > 0 {
+		stats.churn.observe(job.rel, listing.Links)
+	}
+	return m.mirrorLinks(ctx, client, target, job, dirURL, listing.Links, listing.Entries, stats)
+}
+
+// listS3 lists the objects and common prefixes directly below prefix, paging
+// through continuation tokens. Keys become links relative to the directory, so
+// that they take the same path through filtering, recursion and change
+// detection as the links of HTML listings.
+func (m *Manager) listS3(ctx context.Context, client *httpPkg.Client, target *config.Target,
+	prefix string, stats *MirrorStats,
+) (*listingResult, error) {
+	result := &listingResult{Format: ListingS3}
+	seen := make(map[string]bool)
+	token := ""
+	for {
+		listURL := stats.s3.listURL(prefix, token)
+		page, err := m.fetchS3Page(ctx, client, target, listURL, stats)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, common := range page.CommonPrefixes {
+			result.Anchors++
+			if name := strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/"); s3Name(name) {
+				result.Links = append(result.Links, escapeLinkName(name)+"/")
+				result.Entries = append(result.Entries, listingEntry{Size: -1})
+			}
+		}
+		for _, object := range page.Contents {
+			result.Anchors++
+			name := strings.TrimPrefix(object.Key, prefix)
+			if !s3Name(name) {
+				continue
+			}
+			entry := listingEntry{Size: object.Size}
+			// Downloads are dated by Last-Modified, which has whole seconds
+			if modTime, err := time.Parse(time.RFC3339, object.LastModified); err == nil {
+				entry.modTime, entry.precision = modTime.Unix(), time.Second
+			}
+			result.Links = append(result.Links, escapeLinkName(name))
+			result.Entries = append(result.Entries, entry)
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return result, nil
+		}
+		if seen[page.NextContinuationToken] {
+			return nil, &ListingParseError{URL: listURL, Err: fmt.Errorf("continuation token repeated")}
+		}
+		seen[page.NextContinuationToken] = true
+		token = page.NextContinuationToken
+	}
+}
+
+// fetchS3Page requests and decodes one page of a ListObjectsV2 listing
+func (m *Manager) fetchS3Page(ctx context.Context, client *httpPkg.Client, target *config.Target,
+	listURL string, stats *MirrorStats,
+) (*s3ListResult, error) {
+	release, err := m.acquire(ctx, stats, listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := m.fetchListingWithRetry(ctx, client, target, listURL, nil, stats)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, &httpPkg.StatusError{Method: "GET", URL: listURL, Code: resp.StatusCode}
+	}
+
+	maxBytes := m.maxListingBytes()
+	counter := &countingReader{r: resp.Body}
+	if maxBytes > 0 {
+		counter.r = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	var page s3ListResult
+	if err := xml.NewDecoder(counter).Decode(&page); err != nil {
+		if maxBytes > 0 && counter.n > maxBytes {
+			err = fmt.Errorf("%w (%d bytes)", errListingTooLarge, maxBytes)
+		}
+		return nil, &ListingParseError{URL: listURL, Err: err}
+	}
+	return &page, nil
+}
+
+// s3Name reports whether a key below a prefix names an entry of the directory:
+// keys of "folder" placeholders end where the prefix does, and keys with empty
+// or dot segments have no place in a tree
+func s3Name(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
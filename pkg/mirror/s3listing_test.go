@@ -0,0 +1,227 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// fakeBucket answers ListObjectsV2 requests and object GETs like MinIO with
+// path-style addressing, for the bucket "data"
+type fakeBucket struct {
+	objects map[string]string
+	modTime time.Time
+	// pageSize is the max-keys of every listing page
+	pageSize int
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	key := r.Method + " " + r.URL.Path
+	if r.URL.Query().Get("list-type") == "2" {
+		key = "LIST " + r.URL.Query().Get("prefix")
+	}
+	b.requests[key]++
+	b.mu.Unlock()
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/data/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case key == "" && query.Get("list-type") == "2":
+		b.list(w, query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token"))
+	case key == "":
+		// The plain bucket URL answers with a version 1 listing of all keys
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+			`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>data</Name><Prefix></Prefix><Marker></Marker><IsTruncated>false</IsTruncated></ListBucketResult>`)
+	default:
+		content, ok := b.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			return
+		}
+		w.Header().Set("Last-Modified", b.modTime.Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.WriteString(w, content)
+	}
+}
+
+// list writes a page of the keys below prefix, grouped by delimiter
+func (b *fakeBucket) list(w http.ResponseWriter, prefix, delimiter, token string) {
+	var entries []string
+	seen := make(map[string]bool)
+	for key := range b.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			common := prefix + rest[:i+1]
+			if !seen[common] {
+				seen[common] = true
+				entries = append(entries, common)
+			}
+			continue
+		}
+		entries = append(entries, key)
+	}
+	sort.Strings(entries)
+
+	start, _ := strconv.Atoi(token)
+	end := min(start+b.pageSize, len(entries))
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>data</Name>`)
+	fmt.Fprintf(&body, "<Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>%d</MaxKeys><Delimiter>%s</Delimiter>",
+		prefix, end-start, b.pageSize, delimiter)
+	if end < len(entries) {
+		fmt.Fprintf(&body, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	} else {
+		body.WriteString("<IsTruncated>false</IsTruncated>")
+	}
+	for _, entry := range entries[start:end] {
+		if strings.HasSuffix(entry, delimiter) {
+			fmt.Fprintf(&body, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", entry)
+			continue
+		}
+		fmt.Fprintf(&body, `<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>"x"</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>`,
+			entry, b.modTime.Add(250*time.Millisecond).Format("2006-01-02T15:04:05.000Z"), len(b.objects[entry]))
+	}
+	body.WriteString("</ListBucketResult>")
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, body.String())
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{
+		objects: map[string]string{
+			"README.txt":                 "read me",
+			"datasets/":                  "", // folder placeholder
+			"datasets/a.csv":             "1,2,3",
+			"datasets/b.csv":             "4,5",
+			"datasets/c.csv":             "6",
+			"datasets/raw/2024/part.bin": "bytes",
+			"datasets/Übersicht 1:2.txt": "unicode",
+			"other/skipped.txt":          "no",
+		},
+		modTime:  time.Date(2024, time.June, 1, 10, 0, 0, 0, time.UTC),
+		pageSize: 2,
+		requests: make(map[string]int),
+	}
+}
+
+func TestParseS3Target(t *testing.T) {
+	tests := []struct {
+		url, endpoint, prefix, root string
+	}{
+		{"https://bucket.s3.amazonaws.com", "https://bucket.s3.amazonaws.com/", "", "https://bucket.s3.amazonaws.com/"},
+		{"http://minio:9000/data/?prefix=datasets", "http://minio:9000/data/", "datasets/", "http://minio:9000/data/datasets/"},
+		{"http://minio:9000/data?prefix=/a b/c/", "http://minio:9000/data/", "a b/c/", "http://minio:9000/data/a%20b/c/"},
+	}
+	for _, tt := range tests {
+		bucket, err := parseS3Target(tt.url)
+		if err != nil {
+			t.Fatalf("parseS3Target(%q) failed: %v", tt.url, err)
+		}
+		if bucket.endpoint.String() != tt.endpoint || bucket.prefix != tt.prefix || bucket.dirURL("").String() != tt.root {
+			t.Errorf("parseS3Target(%q) = %s, %q, %s", tt.url, bucket.endpoint, bucket.prefix, bucket.dirURL(""))
+		}
+	}
+}
+
+func TestRunS3Bucket(t *testing.T) {
+	bucket := newFakeBucket()
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "bucket", URL: server.URL + "/data/?prefix=datasets/", MaxDepth: 5, Timeout: 5,
+		CheckChanges: true, ListingFormat: "s3"}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for name, content := range map[string]string{
+		"a.csv": "1,2,3", "b.csv": "4,5", "c.csv": "6", "raw/2024/part.bin": "bytes", "Übersicht 1:2.txt": "unicode",
+	} {
+		if data, err := os.ReadFile(filepath.Join(targetDir, name)); err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q (%v)", name, content, data, err)
+		}
+	}
+	for _, name := range []string{"README.txt", "skipped.txt", "other"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); err == nil {
+			t.Errorf("Expected %s outside the prefix not to be mirrored", name)
+		}
+	}
+	// Five entries below datasets/ at two per page
+	if bucket.requests["LIST datasets/"] != 3 {
+		t.Errorf("Expected the prefix to be listed in 3 pages, got %v", bucket.requests)
+	}
+	if stats.ListingsByFormat[ListingS3] != 3 {
+		t.Errorf("Expected 3 S3 listings, got %v", stats.ListingsByFormat)
+	}
+
+	// Sizes and times of the listing spare the file info requests
+	bucket.mu.Lock()
+	clear(bucket.requests)
+	bucket.mu.Unlock()
+	stats, err = manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	for key := range bucket.requests {
+		if strings.HasPrefix(key, "HEAD ") || strings.HasPrefix(key, "GET ") {
+			t.Errorf("Expected only listing requests, got %v", bucket.requests)
+			break
+		}
+	}
+	if stats.FilesCheckedByListing != 5 {
+		t.Errorf("Expected 5 files checked by listing, got %d", stats.FilesCheckedByListing)
+	}
+}
+
+func TestRunDetectsS3Bucket(t *testing.T) {
+	bucket := newFakeBucket()
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "bucket", URL: server.URL + "/data/", MaxDepth: 5, Timeout: 5}
+	targetDir := t.TempDir()
+
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	for _, name := range []string{"README.txt", "datasets/a.csv", "datasets/raw/2024/part.bin", "other/skipped.txt"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); err != nil {
+			t.Errorf("Expected %s to be mirrored: %v", name, err)
+		}
+	}
+	if bucket.requests["LIST "] == 0 {
+		t.Errorf("Expected the bucket to be listed by prefix, got %v", bucket.requests)
+	}
+}
@@ -0,0 +1,157 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// SkipReportFileName is the file in each target directory listing the files the
+// last run skipped and why, written with Mirror.ReportDetail "full"
+const SkipReportFileName = config.MetadataPrefix + "skip-report.json"
+
+// SkipReportVersion is the format of the skip report. Version 2 added Failures;
+// reports without a version are version 1.
+const SkipReportVersion = 2
+
+// SkippedFile is a file a run did not download
+type SkippedFile struct {
+	URL string `json:"url"`
+	// Reason is one of the config.Skip* reason codes
+	Reason string `json:"reason"`
+}
+
+// SkipReport lists the files a run skipped and those it failed to download, by
+// slash-separated path relative to the target directory
+type SkipReport struct {
+	// Version is SkipReportVersion for reports written by this version
+	Version   int       `json:"version"`
+	StartTime time.Time `json:"startTime"`
+	// Reasons counts the skipped files per reason code
+	Reasons map[string]int64       `json:"reasons"`
+	Files   map[string]SkippedFile `json:"files"`
+	// Failures are the files that failed, at most 1000
+	Failures map[string]FailedFile `json:"failures"`
+}
+
+// LoadSkipReport reads the skip report stored in targetDir. A missing report
+// yields an empty one.
+func LoadSkipReport(targetDir string) (*SkipReport, error) {
+	report := &SkipReport{Version: SkipReportVersion, Reasons: make(map[string]int64), Files: make(map[string]SkippedFile),
+		Failures: make(map[string]FailedFile)}
+
+	data, err := os.ReadFile(filepath.Join(targetDir, SkipReportFileName))
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read skip report: %w", err)
+	}
+
+	report.Version = 0
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, fmt.Errorf("failed to parse skip report: %w", err)
+	}
+	report.Version = max(report.Version, 1)
+	return report, nil
+}
+
+// skipped counts a file the run did not download for reason, and lists it with
+// Mirror.ReportDetail "full"
+func (m *Manager) skipped(stats *MirrorStats, rawURL, localPath, reason string) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.SkipReasons == nil {
+		stats.SkipReasons = make(map[string]int64)
+	}
+	stats.SkipReasons[reason]++
+
+	if m.config.Mirror.ReportDetail != config.ReportFull {
+		return
+	}
+	rel, ok := stats.relPath(localPath)
+	if !ok {
+		return
+	}
+	if stats.skips == nil {
+		stats.skips = make(map[string]SkippedFile)
+	}
+	stats.skips[rel] = SkippedFile{URL: rawURL, Reason: reason}
+}
+
+// skippedForBudget lists the file at localPath as skipped if err is the monthly byte
+// cap or the run budget, and returns err
+func (m *Manager) skippedForBudget(stats *MirrorStats, rawURL, localPath string, err error) error {
+	switch {
+	case errors.Is(err, ErrMonthlyCapReached):
+		m.skipped(stats, rawURL, localPath, config.SkipBudgetExhausted)
+	case errors.Is(err, ErrBudgetExceeded):
+		m.skipped(stats, rawURL, localPath, config.SkipRunBudget)
+	}
+	return err
+}
+
+// skippedOverBudget lists the file at localPath, which is size bytes, as skipped
+// because it does not fit the rest of the monthly byte cap, and records it for the
+// next run to try first. The run goes on unless err is not about the budget.
+func (m *Manager) skippedOverBudget(stats *MirrorStats, rawURL, localPath string, size int64, err error) error {
+	if !errors.Is(err, ErrMonthlyCapReached) {
+		return err
+	}
+	m.logger.Info("File does not fit the remaining byte budget, trying it first next run",
+		"url", rawURL, "size", size, "reason", err)
+	m.skipped(stats, rawURL, localPath, config.SkipOverBudget)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if order, ok := stats.orders[localPath]; ok && order.rel != "" && len(stats.overBudget) < maxUnscheduledRecorded {
+		stats.overBudget = append(stats.overBudget, order.rel)
+	}
+	return nil
+}
+
+// skippedSize counts and lists the file at localPath as skipped because err, a
+// FileSizeError, put it outside Target.MinFileSize and Target.MaxFileSize
+func (m *Manager) skippedSize(stats *MirrorStats, rawURL, localPath string, err error) error {
+	m.logger.Debug("Skipping file outside the size range", "url", rawURL, "reason", err)
+	atomic.AddInt64(&stats.FilesSkippedSize, 1)
+	m.skipped(stats, rawURL, localPath, config.SkipSize)
+	return nil
+}
+
+// saveSkipReport replaces the skip report of targetDir with the files skipped by
+// the run. Without Mirror.ReportDetail "full" a stale report is removed, so that it
+// never describes an older run.
+func (m *Manager) saveSkipReport(targetDir string, stats *MirrorStats) {
+	if m.config.Mirror.ReportDetail != config.ReportFull {
+		if err := os.Remove(filepath.Join(targetDir, SkipReportFileName)); err != nil && !os.IsNotExist(err) {
+			m.logger.Warn("Failed to remove stale skip report", "error", err)
+		}
+		return
+	}
+
+	report := SkipReport{Version: SkipReportVersion, StartTime: stats.StartTime, Reasons: stats.SkipReasons,
+		Files: stats.skips, Failures: stats.failures}
+	if report.Reasons == nil {
+		report.Reasons = make(map[string]int64)
+	}
+	if report.Files == nil {
+		report.Files = make(map[string]SkippedFile)
+	}
+	if report.Failures == nil {
+		report.Failures = make(map[string]FailedFile)
+	}
+	data, err := json.Marshal(report)
+	if err == nil {
+		err = writeFileAtomic(targetDir, SkipReportFileName, data)
+	}
+	if err != nil {
+		m.logger.Warn("Failed to save skip report", "error", err)
+	}
+}
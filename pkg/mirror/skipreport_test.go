@@ -0,0 +1,170 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunReportsSkipReasons(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="a.txt">a.txt</a><a href=".secret">.secret</a><a href="image.bin">image.bin</a>`)
+		case "/image.bin":
+			// An error page served for a binary is quarantined
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<html><body>Not found</body></html>")
+		default:
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			io.WriteString(w, "content of "+r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	target := &config.Target{Name: "skips", URL: server.URL + "/", MaxDepth: 5, Timeout: 5, CheckChanges: true,
+		Hidden: config.DefaultHidden, QuarantineMismatches: true}
+	full := NewManager(&config.Config{Mirror: config.Mirror{ReportDetail: config.ReportFull}}, logger)
+
+	if _, err := full.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	stats, err := full.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	want := map[string]int64{config.SkipUnchanged: 1, config.SkipExcluded: 1, config.SkipQuarantined: 1}
+	if !maps.Equal(stats.SkipReasons, want) {
+		t.Errorf("Expected skip reasons %v, got %v", want, stats.SkipReasons)
+	}
+
+	report, err := LoadSkipReport(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFiles := map[string]SkippedFile{
+		"a.txt":     {URL: server.URL + "/a.txt", Reason: config.SkipUnchanged},
+		".secret":   {URL: server.URL + "/.secret", Reason: config.SkipExcluded},
+		"image.bin": {URL: server.URL + "/image.bin", Reason: config.SkipQuarantined},
+	}
+	if !maps.Equal(report.Files, wantFiles) || !maps.Equal(report.Reasons, want) || !report.StartTime.Equal(stats.StartTime) {
+		t.Errorf("Expected the skipped files of the last run, got %+v", report)
+	}
+	state, err := LoadTargetState(targetDir)
+	if err != nil || !maps.Equal(state.LastAttemptSkips, want) {
+		t.Errorf("Expected the skip reasons in the target state, got %v (%v)", state.LastAttemptSkips, err)
+	}
+
+	// The default summary only counts skipped files and drops the stale report
+	summary := NewManager(&config.Config{}, logger)
+	if stats, err := summary.Run(context.Background(), target, targetDir); err != nil || !maps.Equal(stats.SkipReasons, want) {
+		t.Fatalf("Expected the same skip reasons, got %v (%v)", stats.SkipReasons, err)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, SkipReportFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected no skip report without full detail, got %v", err)
+	}
+}
+
+func TestRunReportsFilesSkippedForBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="a.txt">a.txt</a><a href="b.txt">b.txt</a>`)
+			return
+		}
+		io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{Mirror: config.Mirror{ReportDetail: config.ReportFull}},
+		slog.New(slog.NewTextHandler(io.Discard, nil)), WithUsageMeter(NewUsageMeter(t.TempDir(), 10, 1)))
+	target := &config.Target{Name: "budget", URL: server.URL + "/", MaxDepth: 5, Timeout: 5}
+
+	// The first file uses up the budget, so the second one is skipped
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if !errors.Is(err, ErrMonthlyCapReached) {
+		t.Fatalf("Expected the monthly cap to stop the run, got %v", err)
+	}
+	if stats.SkipReasons[config.SkipBudgetExhausted] != 1 {
+		t.Errorf("Expected one file skipped for the budget, got %v", stats.SkipReasons)
+	}
+	report, err := LoadSkipReport(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped := report.Files["b.txt"]; skipped.Reason != config.SkipBudgetExhausted {
+		t.Errorf("Expected b.txt skipped for the budget, got %+v", report.Files)
+	}
+}
+
+func TestRunSkipsFilesBySize(t *testing.T) {
+	var requested sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(r.Method+" "+r.URL.Path, true)
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<pre><a href="huge.iso">huge.iso</a>  2024-01-15 10:30  3.4G
+<a href="small.txt">small.txt</a>  2024-01-15 10:30  -
+<a href="stream.bin">stream.bin</a>  2024-01-15 10:30  -
+<a href="fits.txt">fits.txt</a>  2024-01-15 10:30  200
+</pre>`)
+		case "/small.txt":
+			io.WriteString(w, "tiny")
+		case "/stream.bin":
+			// Of unknown size, it is aborted once it grew past the maximum
+			for range 64 {
+				w.Write(bytes.Repeat([]byte("x"), 1024))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Write(bytes.Repeat([]byte("x"), 200))
+		}
+	}))
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	manager := NewManager(&config.Config{Mirror: config.Mirror{ReportDetail: config.ReportFull}},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "sizes", URL: server.URL + "/", MaxDepth: 5, Timeout: 5, CheckChanges: true,
+		MinFileSize: "100", MaxFileSize: "16k"}
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesSkippedSize != 3 || stats.SkipReasons[config.SkipSize] != 3 || stats.FilesDownloaded != 1 {
+		t.Errorf("Expected three files skipped for their size and one downloaded, got %d skipped (%v) and %d downloaded",
+			stats.FilesSkippedSize, stats.SkipReasons, stats.FilesDownloaded)
+	}
+	if _, ok := requested.Load("HEAD /huge.iso"); ok {
+		t.Error("Expected the file the listing printed as too large not to be requested")
+	}
+	report, err := LoadSkipReport(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"huge.iso", "small.txt", "stream.bin"} {
+		if skipped := report.Files[name]; skipped.Reason != config.SkipSize {
+			t.Errorf("Expected %s skipped for its size, got %+v", name, skipped)
+		}
+		if _, err := os.Stat(filepath.Join(targetDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected no %s on disk, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// StateFileName is the file in each target directory holding its sync state
+const StateFileName = ".http-mirror-state.json"
+
+// TargetState is the sync state of a target, persisted by the updater after every
+// run and read by the server to report staleness
+type TargetState struct {
+	Target string `json:"target"`
+	// LastAttempt is when the most recent run started, successful or not
+	LastAttempt time.Time `json:"lastAttempt"`
+	// LastAttemptErrors is the number of errors in the most recent run
+	LastAttemptErrors int64 `json:"lastAttemptErrors"`
+	// LastAttemptSkips counts the files the most recent run skipped per
+	// config.Skip* reason
+	LastAttemptSkips map[string]int64 `json:"lastAttemptSkips,omitempty"`
+	// LastSuccess is when the most recent successful run started. The mirror holds
+	// every upstream change made before this time.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// NewestRemoteModTime is the newest upstream modification time seen by the most
+	// recent successful run
+	NewestRemoteModTime time.Time `json:"newestRemoteModTime"`
+	// Listings, EmptyListings and UnrecognizedListings are the listing parser
+	// outcomes of the most recent run, compared against by the next run
+	Listings             int64 `json:"listings"`
+	EmptyListings        int64 `json:"emptyListings"`
+	UnrecognizedListings int64 `json:"unrecognizedListings"`
+	// FrozenAt is when the updater first skipped the target because it is frozen;
+	// zero once a run mirrored it again
+	FrozenAt time.Time `json:"frozenAt,omitzero"`
+	// Unscheduled are the directories, relative to the target URL, the most recent
+	// run did not get to because it was cut short, e.g. by a limit or the monthly
+	// byte cap. The next run visits them first.
+	Unscheduled []string `json:"unscheduled,omitempty"`
+	// OverBudget are the files, relative to the target URL, the most recent run
+	// skipped because they were larger than what the monthly byte cap had left.
+	// The next run tries them first.
+	OverBudget []string `json:"overBudget,omitempty"`
+}
+
+// emptyListingPercent returns the share of listings without entries in percent
+func emptyListingPercent(listings, empty int64) float64 {
+	if listings == 0 {
+		return 0
+	}
+	return float64(empty) * 100 / float64(listings)
+}
+
+// Synced reports whether the target has completed at least one successful run
+func (s *TargetState) Synced() bool {
+	return !s.LastSuccess.IsZero()
+}
+
+// Staleness estimates how far the mirror may lag behind upstream at now: changes
+// made upstream since the start of the last successful run may be missing. Failed
+// or skipped runs do not reset it. The result is meaningless if !Synced().
+func (s *TargetState) Staleness(now time.Time) time.Duration {
+	if !s.Synced() || now.Before(s.LastSuccess) {
+		return 0
+	}
+	return now.Sub(s.LastSuccess)
+}
+
+// LoadTargetState reads the sync state of the target stored in targetDir. A missing
+// state file yields an empty state for a target that has never synced.
+func LoadTargetState(targetDir string) (*TargetState, error) {
+	data, err := os.ReadFile(filepath.Join(targetDir, StateFileName))
+	if os.IsNotExist(err) {
+		return &TargetState{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target state: %w", err)
+	}
+
+	var state TargetState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse target state: %w", err)
+	}
+	return &state, nil
+}
+
+// saveTargetState atomically replaces the state file in targetDir
+func saveTargetState(targetDir string, state *TargetState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(targetDir, StateFileName, data)
+}
+
+// writeFileAtomic replaces dir/name with data through a temporary file, so readers
+// never see a partially written file
+func writeFileAtomic(dir, name string, data []byte) error {
+	// Leftovers of a crash are recognized as temporary files and cleaned up later
+	tmp, err := os.CreateTemp(dir, config.TempFilePrefix+strings.TrimPrefix(name, config.MetadataPrefix)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// recordRun updates the persisted state of a target with the outcome of a run
+func (m *Manager) recordRun(targetDir string, stats *MirrorStats, runErr error) {
+	state, err := LoadTargetState(targetDir)
+	if err != nil {
+		m.logger.Warn("Discarding unreadable target state", "error", err)
+		state = &TargetState{}
+	}
+
+	m.checkListingOutcomes(state, stats)
+
+	state.Target = stats.Target
+	state.LastAttempt = stats.StartTime
+	state.LastAttemptErrors = stats.Errors
+	state.LastAttemptSkips = stats.SkipReasons
+	state.Listings = 0
+	for _, n := range stats.ListingsByFormat {
+		state.Listings += n
+	}
+	state.EmptyListings = stats.EmptyListings
+	state.UnrecognizedListings = stats.UnrecognizedListings
+	state.FrozenAt = time.Time{}
+	state.Unscheduled = stats.unscheduled
+	state.OverBudget = stats.overBudget
+	if runErr == nil {
+		state.LastSuccess = stats.StartTime
+		state.NewestRemoteModTime = stats.NewestRemoteModTime
+	}
+
+	if err := saveTargetState(targetDir, state); err != nil {
+		m.logger.Warn("Failed to save target state", "error", err)
+	}
+}
+
+// checkListingOutcomes alerts when the share of empty listings grew by more than
+// Mirror.EmptyListingAlertPercent points since the previous run, which usually means
+// the upstream changed its listing format and directories are no longer recognized
+func (m *Manager) checkListingOutcomes(previous *TargetState, stats *MirrorStats) {
+	threshold := m.config.Mirror.EmptyListingAlertPercent
+	if threshold <= 0 || previous.Listings == 0 {
+		return
+	}
+
+	var listings int64
+	for _, n := range stats.ListingsByFormat {
+		listings += n
+	}
+	if listings == 0 {
+		return
+	}
+
+	before := emptyListingPercent(previous.Listings, previous.EmptyListings)
+	now := emptyListingPercent(listings, stats.EmptyListings)
+	if now-before <= float64(threshold) {
+		return
+	}
+
+	err := fmt.Errorf("%w: %.0f%% of listings empty, up from %.0f%%", ErrListingFormatChanged, now, before)
+	m.logger.Error("Share of empty directory listings jumped since the previous run",
+		"empty_percent", now,
+		"previous_empty_percent", before,
+		"listings", listings,
+		"unrecognized_listings", stats.UnrecognizedListings,
+		"listings_by_format", stats.ListingsByFormat)
+	m.emit(stats, Event{Type: EventListingAnomaly, Err: err})
+}
@@ -0,0 +1,114 @@
+package mirror
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestLoadTargetStateMissing(t *testing.T) {
+	state, err := LoadTargetState(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadTargetState failed: %v", err)
+	}
+	if state.Synced() {
+		t.Error("Expected a target without state file to be unsynced")
+	}
+}
+
+func TestRecordRun(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	first := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	remote := time.Date(2024, 5, 30, 8, 0, 0, 0, time.UTC)
+	m.recordRun(dir, &MirrorStats{Target: "t", StartTime: first, NewestRemoteModTime: remote}, nil)
+
+	state, err := LoadTargetState(dir)
+	if err != nil {
+		t.Fatalf("LoadTargetState failed: %v", err)
+	}
+	if !state.LastSuccess.Equal(first) || !state.NewestRemoteModTime.Equal(remote) {
+		t.Errorf("Unexpected state after successful run: %+v", state)
+	}
+
+	// A failed run records the attempt but keeps the last success
+	second := first.Add(time.Hour)
+	m.recordRun(dir, &MirrorStats{Target: "t", StartTime: second, Errors: 3}, errors.New("boom"))
+
+	state, err = LoadTargetState(dir)
+	if err != nil {
+		t.Fatalf("LoadTargetState failed: %v", err)
+	}
+	if !state.LastAttempt.Equal(second) || state.LastAttemptErrors != 3 {
+		t.Errorf("Expected failed attempt to be recorded, got %+v", state)
+	}
+	if !state.LastSuccess.Equal(first) || !state.NewestRemoteModTime.Equal(remote) {
+		t.Errorf("Expected failed run to keep the last success, got %+v", state)
+	}
+	if got := state.Staleness(first.Add(2 * time.Hour)); got != 2*time.Hour {
+		t.Errorf("Expected staleness to keep growing across failures, got %v", got)
+	}
+
+	// No temp files are left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != StateFileName {
+		t.Errorf("Expected only the state file, got %v", entries)
+	}
+}
+
+func TestLoadTargetStateCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, StateFileName), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTargetState(dir); err == nil {
+		t.Error("Expected an error for a corrupt state file")
+	}
+}
+
+func TestCheckListingOutcomesAlertsOnJump(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		previous  TargetState
+		listings  int64
+		empty     int64
+		alert     bool
+	}{
+		{"jump above threshold", 20, TargetState{Listings: 100, EmptyListings: 5}, 100, 60, true},
+		{"small change", 20, TargetState{Listings: 100, EmptyListings: 5}, 100, 20, false},
+		{"improvement", 20, TargetState{Listings: 100, EmptyListings: 80}, 100, 5, false},
+		{"no previous run", 20, TargetState{}, 100, 100, false},
+		{"disabled", 0, TargetState{Listings: 100, EmptyListings: 0}, 100, 100, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []Event
+			cfg := &config.Config{Mirror: config.Mirror{EmptyListingAlertPercent: tt.threshold}}
+			m := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)),
+				WithEventSink(func(e Event) { events = append(events, e) }))
+
+			stats := &MirrorStats{
+				Target:           "t",
+				ListingsByFormat: map[string]int64{ListingGeneric: tt.listings},
+				EmptyListings:    tt.empty,
+			}
+			m.checkListingOutcomes(&tt.previous, stats)
+
+			if alerted := len(events) == 1; alerted != tt.alert {
+				t.Fatalf("Expected alert %v, got events %+v", tt.alert, events)
+			}
+			if tt.alert && (events[0].Type != EventListingAnomaly || !errors.Is(events[0].Err, ErrListingFormatChanged)) {
+				t.Errorf("Unexpected alert event: %+v", events[0])
+			}
+		})
+	}
+}
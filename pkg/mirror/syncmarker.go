@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SyncMarkerFileName is the file in a target directory that exists while the
+// updater is syncing the target
+const SyncMarkerFileName = ".http-mirror-syncing.json"
+
+// SyncMarker describes the run currently rewriting a target. A crashed run leaves
+// its marker behind until the next run of the target completes.
+type SyncMarker struct {
+	Target  string    `json:"target"`
+	Started time.Time `json:"started"`
+	Host    string    `json:"host,omitempty"`
+	PID     int       `json:"pid"`
+	// Progress is the latest progress estimate of the first run of a target
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+// LoadSyncMarker reads the sync marker of targetDir; it returns nil if no sync is
+// in progress
+func LoadSyncMarker(targetDir string) (*SyncMarker, error) {
+	data, err := os.ReadFile(filepath.Join(targetDir, SyncMarkerFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync marker: %w", err)
+	}
+
+	var marker SyncMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, fmt.Errorf("failed to parse sync marker: %w", err)
+	}
+	return &marker, nil
+}
+
+// markSyncing writes the sync marker of targetDir and returns it with a function
+// removing it
+func (m *Manager) markSyncing(targetDir, target string, started time.Time) (*SyncMarker, func()) {
+	host, _ := os.Hostname()
+	marker := &SyncMarker{Target: target, Started: started, Host: host, PID: os.Getpid()}
+	if !m.writeSyncMarker(targetDir, marker) {
+		return nil, func() {}
+	}
+
+	return marker, func() {
+		if err := os.Remove(filepath.Join(targetDir, SyncMarkerFileName)); err != nil && !os.IsNotExist(err) {
+			m.logger.Warn("Failed to remove sync marker", "error", err)
+		}
+	}
+}
+
+// writeSyncMarker writes marker to targetDir and reports whether it succeeded
+func (m *Manager) writeSyncMarker(targetDir string, marker *SyncMarker) bool {
+	data, err := json.MarshalIndent(marker, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(targetDir, SyncMarkerFileName, data)
+	}
+	if err != nil {
+		m.logger.Warn("Failed to write sync marker", "error", err)
+		return false
+	}
+	return true
+}
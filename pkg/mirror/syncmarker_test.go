@@ -0,0 +1,49 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestRunMarksSyncInProgress(t *testing.T) {
+	targetDir := t.TempDir()
+	var markerDuringRun *SyncMarker
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="file.txt">file</a>`))
+			return
+		}
+		markerDuringRun, _ = LoadSyncMarker(targetDir)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "marked", URL: server.URL + "/", MaxDepth: 2, Timeout: 5}
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if markerDuringRun == nil || markerDuringRun.Target != "marked" || markerDuringRun.PID != os.Getpid() {
+		t.Fatalf("Expected sync marker during the run, got %+v", markerDuringRun)
+	}
+	if !markerDuringRun.Started.Equal(stats.StartTime) {
+		t.Errorf("Expected marker to record the run start %v, got %v", stats.StartTime, markerDuringRun.Started)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, SyncMarkerFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected sync marker to be removed after the run, got %v", err)
+	}
+	if marker, err := LoadSyncMarker(targetDir); marker != nil || err != nil {
+		t.Errorf("Expected no marker after the run, got %+v, %v", marker, err)
+	}
+}
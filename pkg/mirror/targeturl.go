@@ -0,0 +1,56 @@
+package mirror
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// normalizeTargetURL returns rawURL with a trailing slash if it names a directory.
+// Without it, links of the listing would resolve against the parent directory.
+// Paths whose last segment has an extension are left alone; they are detected by
+// the first request instead.
+func normalizeTargetURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || strings.HasSuffix(u.Path, "/") {
+		return rawURL
+	}
+	if u.Path != "" && path.Ext(u.Path) != "" {
+		return rawURL
+	}
+	u.Path += "/"
+	if u.RawPath != "" {
+		u.RawPath += "/"
+	}
+	return u.String()
+}
+
+// normalizeTarget returns target with a normalized URL, logging the change. The
+// caller's target is not modified.
+func (m *Manager) normalizeTarget(target *config.Target) *config.Target {
+	normalized := normalizeTargetURL(target.URL)
+	if normalized == target.URL {
+		return target
+	}
+	m.logger.Info("Normalized target URL to a directory", "url", target.URL, "normalized", normalized)
+	copied := *target
+	copied.URL = normalized
+	return &copied
+}
+
+// directoryBase returns the URL the links of the root listing at u resolve against.
+// A listing served for a path without trailing slash, e.g. "/pub/v1.2", describes
+// the directory, so its links are relative to "/pub/v1.2/".
+func directoryBase(u *url.URL) *url.URL {
+	if strings.HasSuffix(u.Path, "/") {
+		return u
+	}
+	base := *u
+	base.Path += "/"
+	if base.RawPath != "" {
+		base.RawPath += "/"
+	}
+	return &base
+}
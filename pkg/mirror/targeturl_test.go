@@ -0,0 +1,124 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestNormalizeTargetURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://host", "https://host/"},
+		{"https://host/pub", "https://host/pub/"},
+		{"https://host/pub/", "https://host/pub/"},
+		{"https://host/pub?C=M", "https://host/pub/?C=M"},
+		{"https://host/a%2Fb", "https://host/a%2Fb/"},
+		{"https://host/pub/file.iso", "https://host/pub/file.iso"},
+		{"https://host/pub/v1.2", "https://host/pub/v1.2"},
+	}
+	for _, tt := range tests {
+		if got := normalizeTargetURL(tt.url); got != tt.want {
+			t.Errorf("normalizeTargetURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRunWithAndWithoutTrailingSlash(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	listings := map[string]string{
+		"/pub/":          `<a href="../">Parent Directory</a><a href="a.txt">a.txt</a><a href="sub/">sub/</a>`,
+		"/pub/sub/":      `<a href="b.txt">b.txt</a>`,
+		"/pub/v1.2/":     `<a href="c.txt">c.txt</a><a href="sub/">sub/</a>`,
+		"/pub/v1.2/sub/": `<a href="d.txt">d.txt</a>`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		// Like many servers, answer the slashless directory path without redirecting
+		listing, ok := listings[r.URL.Path]
+		if !ok {
+			listing, ok = listings[r.URL.Path+"/"]
+		}
+		if ok {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(listing))
+			return
+		}
+		if filepath.Ext(r.URL.Path) != ".txt" || filepath.Dir(r.URL.Path) == "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	run := func(rawURL string) ([]string, []string) {
+		t.Helper()
+		mu.Lock()
+		requested = nil
+		mu.Unlock()
+
+		targetDir := t.TempDir()
+		manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		target := &config.Target{Name: "slash", URL: rawURL, MaxDepth: 5, Timeout: 5}
+		stats, err := manager.Run(context.Background(), target, targetDir)
+		if err != nil {
+			t.Fatalf("Run(%s) failed: %v", rawURL, err)
+		}
+		if stats.Errors != 0 {
+			t.Errorf("Run(%s): expected no errors, got %d", rawURL, stats.Errors)
+		}
+		if target.URL != rawURL {
+			t.Errorf("Expected the caller's target to stay unchanged, got %s", target.URL)
+		}
+
+		var files []string
+		filepath.WalkDir(targetDir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() && filepath.Ext(path) == ".txt" {
+				data, _ := os.ReadFile(path)
+				rel, _ := filepath.Rel(targetDir, path)
+				files = append(files, filepath.ToSlash(rel)+"="+string(data))
+			}
+			return nil
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		return files, slices.Clone(requested)
+	}
+
+	withSlash, withSlashRequests := run(server.URL + "/pub/")
+	withoutSlash, withoutSlashRequests := run(server.URL + "/pub")
+	want := []string{"a.txt=content of /pub/a.txt", "sub/b.txt=content of /pub/sub/b.txt"}
+	if !slices.Equal(withSlash, want) {
+		t.Errorf("Expected %v with trailing slash, got %v", want, withSlash)
+	}
+	if !slices.Equal(withoutSlash, withSlash) {
+		t.Errorf("Expected identical trees, got %v and %v", withoutSlash, withSlash)
+	}
+	if !slices.Equal(withoutSlashRequests, withSlashRequests) {
+		t.Errorf("Expected identical requests, got %v and %v", withoutSlashRequests, withSlashRequests)
+	}
+
+	// Directory names with dots are recognized by the listing they return
+	dotted, _ := run(server.URL + "/pub/v1.2")
+	want = []string{"c.txt=content of /pub/v1.2/c.txt", "sub/d.txt=content of /pub/v1.2/sub/d.txt"}
+	if !slices.Equal(dotted, want) {
+		t.Errorf("Expected %v for a dotted directory, got %v", want, dotted)
+	}
+}
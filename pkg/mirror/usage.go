@@ -0,0 +1,261 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// UsageFileName is the file in the data directory holding the transfer accounting
+// of all targets
+const UsageFileName = ".http-mirror-usage.json"
+
+// usageSaveInterval is how often the accounting is persisted during a run
+var usageSaveInterval = 10 * time.Second
+
+// ErrMonthlyCapReached is returned by a run that stopped because the bytes
+// downloaded in the current billing period reached Mirror.MonthlyByteCap
+var ErrMonthlyCapReached = errors.New("monthly byte cap reached")
+
+// Usage is the persisted transfer accounting. Only downloaded file contents are
+// counted; listings and request overhead are not.
+type Usage struct {
+	// PeriodStart is the start of the current billing period
+	PeriodStart time.Time `json:"periodStart"`
+	// TrackingSince is when accounting began within the period. It is later than
+	// PeriodStart in the month the mirror was installed, when transfer from before
+	// is unknown.
+	TrackingSince time.Time        `json:"trackingSince"`
+	PeriodBytes   int64            `json:"periodBytes"`
+	PeriodTargets map[string]int64 `json:"periodTargets,omitempty"`
+	// TotalBytes and TotalTargets are never reset
+	TotalBytes   int64            `json:"totalBytes"`
+	TotalTargets map[string]int64 `json:"totalTargets,omitempty"`
+}
+
+// Partial reports whether accounting started after the beginning of the period
+func (u *Usage) Partial() bool {
+	return u.TrackingSince.After(u.PeriodStart)
+}
+
+// BillingPeriodStart returns the start of the billing period containing now, in the
+// location of now. Periods start at midnight on resetDay; months shorter than
+// resetDay reset on their last day.
+func BillingPeriodStart(now time.Time, resetDay int) time.Time {
+	resetDay = max(resetDay, 1)
+	year, month, _ := now.Date()
+	start := resetDate(year, month, resetDay, now.Location())
+	if now.Before(start) {
+		start = resetDate(year, month-1, resetDay, now.Location())
+	}
+	return start
+}
+
+// resetDate returns midnight of day in the given month, clamped to the month's length
+func resetDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	return time.Date(year, month, min(day, last), 0, 0, 0, 0, loc)
+}
+
+// advance moves the accounting to the billing period containing now. A clock set
+// back before the period start moves the period back without discarding bytes, so
+// correcting the clock never grants a fresh budget.
+func (u *Usage) advance(now time.Time, resetDay int) {
+	start := BillingPeriodStart(now, resetDay)
+	switch {
+	case u.PeriodStart.IsZero():
+		u.PeriodStart = start
+		u.TrackingSince = now
+	case start.After(u.PeriodStart):
+		u.PeriodStart = start
+		u.TrackingSince = start
+		u.PeriodBytes = 0
+		u.PeriodTargets = nil
+	case start.Before(u.PeriodStart):
+		u.PeriodStart = start
+	}
+}
+
+// At returns a copy of the accounting as of now, with an elapsed period reset
+func (u *Usage) At(now time.Time, resetDay int) *Usage {
+	current := *u
+	if !current.PeriodStart.IsZero() {
+		current.advance(now, resetDay)
+	}
+	return &current
+}
+
+// LoadUsage reads the transfer accounting stored in dir. A missing file yields
+// empty accounting.
+func LoadUsage(dir string) (*Usage, error) {
+	usage := &Usage{}
+	data, err := os.ReadFile(filepath.Join(dir, UsageFileName))
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+	if err := json.Unmarshal(data, usage); err != nil {
+		return nil, fmt.Errorf("failed to parse usage: %w", err)
+	}
+	return usage, nil
+}
+
+// UsageMeter accounts downloaded bytes in a data directory and enforces the monthly
+// cap. All managers writing to the same directory must share one meter. A nil
+// meter accounts nothing.
+type UsageMeter struct {
+	dir        string
+	monthlyCap int64
+	resetDay   int
+	now        func() time.Time
+
+	mu       sync.Mutex
+	usage    *Usage
+	loadErr  error
+	lastSave time.Time
+}
+
+// NewUsageMeter creates a meter persisting to dir. A monthlyCap of 0 or less only
+// accounts without limiting.
+func NewUsageMeter(dir string, monthlyCap int64, resetDay int) *UsageMeter {
+	return &UsageMeter{
+		dir:        dir,
+		monthlyCap: max(monthlyCap, 0),
+		resetDay:   resetDay,
+		now:        time.Now,
+	}
+}
+
+// load reads the persisted accounting on first use. The caller must hold u.mu.
+func (u *UsageMeter) load() error {
+	if u.usage != nil {
+		return nil
+	}
+	if u.loadErr != nil {
+		return u.loadErr
+	}
+
+	usage, err := LoadUsage(u.dir)
+	if err != nil {
+		// Without a cap, broken accounting must not stop mirroring
+		if u.monthlyCap > 0 {
+			u.loadErr = err
+			return err
+		}
+		usage = &Usage{}
+	}
+	u.usage = usage
+	return nil
+}
+
+// check returns ErrMonthlyCapReached if the period's budget is used up or too small
+// for a download of size bytes; size is 0 when unknown
+func (u *UsageMeter) check(size int64) error {
+	if u == nil || u.monthlyCap == 0 {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.load(); err != nil {
+		return err
+	}
+
+	u.usage.advance(u.now(), u.resetDay)
+	if used := u.usage.PeriodBytes; used >= u.monthlyCap || used+size > u.monthlyCap {
+		return fmt.Errorf("%w: %d of %d bytes used since %s", ErrMonthlyCapReached,
+			used, u.monthlyCap, u.usage.PeriodStart.Format(time.DateOnly))
+	}
+	return nil
+}
+
+// add accounts n downloaded bytes to target and persists them periodically
+func (u *UsageMeter) add(target string, n int64) error {
+	if u == nil || n <= 0 {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.load(); err != nil {
+		return err
+	}
+
+	u.usage.advance(u.now(), u.resetDay)
+	if u.usage.PeriodTargets == nil {
+		u.usage.PeriodTargets = make(map[string]int64)
+	}
+	if u.usage.TotalTargets == nil {
+		u.usage.TotalTargets = make(map[string]int64)
+	}
+	u.usage.PeriodBytes += n
+	u.usage.PeriodTargets[target] += n
+	u.usage.TotalBytes += n
+	u.usage.TotalTargets[target] += n
+
+	if time.Since(u.lastSave) < usageSaveInterval {
+		return nil
+	}
+	return u.save()
+}
+
+// Flush persists the accounting
+func (u *UsageMeter) Flush() error {
+	if u == nil {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.usage == nil {
+		return nil
+	}
+	return u.save()
+}
+
+// save writes the accounting atomically. The caller must hold u.mu.
+func (u *UsageMeter) save() error {
+	data, err := json.MarshalIndent(u.usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(u.dir, UsageFileName, data); err != nil {
+		return fmt.Errorf("failed to save usage: %w", err)
+	}
+	u.lastSave = time.Now()
+	return nil
+}
+
+// MonthlyCap returns the cap in bytes per billing period, 0 if unlimited
+func (u *UsageMeter) MonthlyCap() int64 {
+	if u == nil {
+		return 0
+	}
+	return u.monthlyCap
+}
+
+// Snapshot returns a copy of the current accounting
+func (u *UsageMeter) Snapshot() (Usage, error) {
+	if u == nil {
+		return Usage{}, nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.load(); err != nil {
+		return Usage{}, err
+	}
+
+	u.usage.advance(u.now(), u.resetDay)
+	snapshot := *u.usage
+	snapshot.PeriodTargets = maps.Clone(u.usage.PeriodTargets)
+	snapshot.TotalTargets = maps.Clone(u.usage.TotalTargets)
+	return snapshot, nil
+}
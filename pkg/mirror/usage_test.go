@@ -0,0 +1,198 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestBillingPeriodStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      time.Time
+		resetDay int
+		want     time.Time
+	}{
+		{"first of month", time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC), 1, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"before reset day", time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC), 15, time.Date(2024, 2, 15, 0, 0, 0, 0, time.UTC)},
+		{"on reset day", time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), 15, time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"short month clamps", time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC), 31, time.Date(2023, 2, 28, 0, 0, 0, 0, time.UTC)},
+		{"across year", time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC), 10, time.Date(2023, 12, 10, 0, 0, 0, 0, time.UTC)},
+		{"zero means first", time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), 0, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BillingPeriodStart(tt.now, tt.resetDay); !got.Equal(tt.want) {
+				t.Errorf("BillingPeriodStart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsageMeterPeriods(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 3, 20, 12, 0, 0, 0, time.UTC)
+
+	meter := NewUsageMeter(dir, 100, 1)
+	meter.now = func() time.Time { return now }
+
+	// Installed mid-month: the period is partial, but the full cap applies
+	if err := meter.add("a", 60); err != nil {
+		t.Fatal(err)
+	}
+	usage, _ := meter.Snapshot()
+	if !usage.Partial() || !usage.TrackingSince.Equal(now) {
+		t.Errorf("Expected a partial first period tracked since install, got %+v", usage)
+	}
+	if err := meter.check(50); !errors.Is(err, ErrMonthlyCapReached) {
+		t.Errorf("Expected a download exceeding the remaining budget to be refused, got %v", err)
+	}
+	if err := meter.check(40); err != nil {
+		t.Errorf("Expected a download within the budget to be allowed, got %v", err)
+	}
+	meter.add("b", 40)
+	if err := meter.check(0); !errors.Is(err, ErrMonthlyCapReached) {
+		t.Errorf("Expected exhausted budget, got %v", err)
+	}
+
+	// Setting the clock back across the reset does not grant a new budget
+	now = time.Date(2024, 2, 28, 12, 0, 0, 0, time.UTC)
+	if err := meter.check(0); !errors.Is(err, ErrMonthlyCapReached) {
+		t.Errorf("Expected budget to stay exhausted after the clock moved back, got %v", err)
+	}
+
+	// The next period starts over, lifetime totals are kept
+	now = time.Date(2024, 4, 1, 0, 0, 1, 0, time.UTC)
+	if err := meter.check(0); err != nil {
+		t.Errorf("Expected a fresh budget in the new period, got %v", err)
+	}
+	usage, _ = meter.Snapshot()
+	if usage.PeriodBytes != 0 || usage.TotalBytes != 100 || usage.TotalTargets["a"] != 60 || usage.Partial() {
+		t.Errorf("Unexpected usage after reset: %+v", usage)
+	}
+
+	// Accounting survives restarts
+	if err := meter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadUsage(dir)
+	if err != nil {
+		t.Fatalf("LoadUsage failed: %v", err)
+	}
+	if loaded.TotalBytes != 100 || !loaded.PeriodStart.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected persisted usage: %+v", loaded)
+	}
+}
+
+func TestRunStopsAtMonthlyCap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.bin">a</a><a href="b.bin">b</a><a href="c.bin">c</a>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(make([]byte, 1000))
+	}))
+	defer server.Close()
+
+	dataPath := t.TempDir()
+	cfg := &config.Config{Mirror: config.Mirror{DataPath: dataPath, MonthlyByteCap: "1500", CapResetDay: 1}}
+
+	var events []Event
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WithEventSink(func(e Event) { events = append(events, e) }))
+	target := &config.Target{Name: "capped", URL: server.URL + "/", MaxDepth: 2, Timeout: 5}
+
+	stats, err := manager.Run(context.Background(), target, filepath.Join(dataPath, "capped"))
+	if !errors.Is(err, ErrMonthlyCapReached) {
+		t.Fatalf("Expected ErrMonthlyCapReached, got %v", err)
+	}
+	// The file crossing the cap is finished, nothing after it is started
+	if stats.FilesDownloaded != 2 {
+		t.Errorf("Expected 2 files before the cap stopped the run, got %d", stats.FilesDownloaded)
+	}
+	if last := events[len(events)-1]; last.Type != EventMonthlyCapReached {
+		t.Errorf("Expected a monthly cap event, got %+v", last)
+	}
+
+	usage, err := LoadUsage(dataPath)
+	if err != nil {
+		t.Fatalf("LoadUsage failed: %v", err)
+	}
+	if usage.PeriodBytes != 2000 || usage.PeriodTargets["capped"] != 2000 {
+		t.Errorf("Expected 2000 accounted bytes, got %+v", usage)
+	}
+}
+
+func TestRunSkipsFilesOverBudget(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.bin">a</a><a href="big.bin">big</a><a href="b.bin">b</a>`))
+			return
+		}
+		size := 500
+		if r.URL.Path == "/big.bin" {
+			size = 2000
+		}
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			fetched = append(fetched, r.URL.Path)
+			mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(make([]byte, size))
+	}))
+	defer server.Close()
+
+	dataPath := t.TempDir()
+	targetDir := filepath.Join(dataPath, "capped")
+	cfg := &config.Config{Mirror: config.Mirror{DataPath: dataPath, MonthlyByteCap: "1500", CapResetDay: 1}}
+	manager := NewManager(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "capped", URL: server.URL + "/", MaxDepth: 2, Timeout: 5, CheckChanges: true, Concurrency: 1}
+
+	// The file that cannot fit is passed over for the ones that do
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stats.FilesDownloaded != 2 || stats.SkipReasons[config.SkipOverBudget] != 1 {
+		t.Errorf("Expected 2 files downloaded and 1 over budget, got %d and %v", stats.FilesDownloaded, stats.SkipReasons)
+	}
+	state, err := LoadTargetState(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(state.OverBudget, []string{"big.bin"}) {
+		t.Fatalf("Expected the skipped file recorded, got %v", state.OverBudget)
+	}
+
+	// Once the budget allows, the next run fetches it first
+	manager = NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	mu.Lock()
+	fetched = nil
+	mu.Unlock()
+	if _, err := manager.Run(context.Background(), target, targetDir); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(fetched) == 0 || fetched[0] != "/big.bin" {
+		t.Errorf("Expected the skipped file fetched first, got %v", fetched)
+	}
+	if state, err := LoadTargetState(targetDir); err != nil || len(state.OverBudget) != 0 {
+		t.Errorf("Expected nothing left over budget, got %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,190 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// ListingValidatorsFileName is the file in each target directory holding the HTTP
+// validators and links of the directory listings last fetched
+const ListingValidatorsFileName = config.MetadataPrefix + "listing-validators.json"
+
+// DefaultListingRefreshEvery is the default of Target.ListingRefreshEvery
+const DefaultListingRefreshEvery = 10
+
+// ListingValidator is what a conditional request for a directory listing needs: the
+// validators the upstream sent with the listing, and its links to mirror when the
+// upstream answers 304 Not Modified
+type ListingValidator struct {
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"lastModified,omitempty"`
+	Links        []string `json:"links"`
+	// FetchedRun is the number of the run that last received the listing in full
+	FetchedRun int64 `json:"fetchedRun"`
+}
+
+// ListingValidators are the listing validators of the directories of a target, keyed
+// by path relative to the target URL
+type ListingValidators struct {
+	// Runs counts the runs of the target with Target.ConditionalListings so far
+	Runs        int64                        `json:"runs"`
+	Directories map[string]*ListingValidator `json:"directories"`
+}
+
+// LoadListingValidators reads the listing validators stored in targetDir. A missing
+// file yields no validators.
+func LoadListingValidators(targetDir string) (*ListingValidators, error) {
+	validators := &ListingValidators{Directories: make(map[string]*ListingValidator)}
+
+	data, err := os.ReadFile(filepath.Join(targetDir, ListingValidatorsFileName))
+	if os.IsNotExist(err) {
+		return validators, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read listing validators: %w", err)
+	}
+
+	if err := json.Unmarshal(data, validators); err != nil {
+		return nil, fmt.Errorf("failed to parse listing validators: %w", err)
+	}
+	if validators.Directories == nil {
+		validators.Directories = make(map[string]*ListingValidator)
+	}
+	return validators, nil
+}
+
+// saveListingValidators atomically replaces the listing validators in targetDir
+func saveListingValidators(targetDir string, validators *ListingValidators) error {
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return fmt.Errorf("failed to encode listing validators: %w", err)
+	}
+	return writeFileAtomic(targetDir, ListingValidatorsFileName, data)
+}
+
+// validatorTracker decides which listings of a run are requested conditionally and
+// records the validators of the listings received
+type validatorTracker struct {
+	validators *ListingValidators
+	run        int64
+	// refreshEvery is Target.ListingRefreshEvery; force requests every listing in
+	// full, as for a full scan
+	refreshEvery int64
+	force        bool
+	// seen are the directories whose listing the run received or confirmed
+	seen map[string]bool
+}
+
+// newValidatorTracker starts tracking the run following those in validators
+func newValidatorTracker(validators *ListingValidators, target *config.Target, force bool) *validatorTracker {
+	refreshEvery := target.ListingRefreshEvery
+	if refreshEvery <= 0 {
+		refreshEvery = DefaultListingRefreshEvery
+	}
+	return &validatorTracker{
+		validators:   validators,
+		run:          validators.Runs + 1,
+		refreshEvery: int64(refreshEvery),
+		force:        force,
+		seen:         make(map[string]bool),
+	}
+}
+
+// conditional returns the stored validator of the directory at rel to request its
+// listing with, or nil to request it in full. Listings are received in full again
+// every refreshEvery runs, in case the upstream validators are broken.
+func (v *validatorTracker) conditional(rel string) *ListingValidator {
+	if v == nil || v.force {
+		return nil
+	}
+	stored, ok := v.validators.Directories[rel]
+	if !ok || v.run-stored.FetchedRun >= v.refreshEvery {
+		return nil
+	}
+	return stored
+}
+
+// notModified records that the upstream confirmed the stored listing of rel
+func (v *validatorTracker) notModified(rel string) {
+	if v != nil {
+		v.seen[rel] = true
+	}
+}
+
+// received records the validators of a listing of rel received in full; listings
+// without any are forgotten, as they cannot be requested conditionally
+func (v *validatorTracker) received(rel string, header http.Header, links []string) {
+	if v == nil {
+		return
+	}
+	etag, lastModified := header.Get("ETag"), header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		delete(v.validators.Directories, rel)
+		return
+	}
+	v.seen[rel] = true
+	v.validators.Directories[rel] = &ListingValidator{
+		ETag:         etag,
+		LastModified: lastModified,
+		Links:        slices.Clone(links),
+		FetchedRun:   v.run,
+	}
+}
+
+// finish ends the run; a complete run also forgets directories it did not see
+func (v *validatorTracker) finish(complete bool) {
+	v.validators.Runs = v.run
+	if !complete {
+		return
+	}
+	for rel := range v.validators.Directories {
+		if !v.seen[rel] {
+			delete(v.validators.Directories, rel)
+		}
+	}
+}
+
+// setConditional adds the headers making req conditional on validator
+func setConditional(req *http.Request, validator *ListingValidator) {
+	if validator == nil {
+		return
+	}
+	if validator.ETag != "" {
+		req.Header.Set("If-None-Match", validator.ETag)
+	}
+	if validator.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validator.LastModified)
+	}
+}
+
+// loadValidators starts tracking the listing validators of a run into targetDir, if
+// the target requests its listings conditionally
+func (m *Manager) loadValidators(target *config.Target, targetDir string) *validatorTracker {
+	if !target.ConditionalListings {
+		return nil
+	}
+	validators, err := LoadListingValidators(targetDir)
+	if err != nil {
+		m.logger.Warn("Discarding unreadable listing validators", "error", err)
+		validators = &ListingValidators{Directories: make(map[string]*ListingValidator)}
+	}
+	return newValidatorTracker(validators, target, m.fullScan)
+}
+
+// saveValidators persists the listing validators of a run. Like for the listing
+// churn, only a run that visited everything may forget directories.
+func (m *Manager) saveValidators(targetDir string, stats *MirrorStats, runErr error) {
+	if stats.validators == nil {
+		return
+	}
+	stats.validators.finish(runErr == nil && len(stats.LimitsReached) == 0 && len(stats.unscheduled) == 0)
+	if err := saveListingValidators(targetDir, stats.validators.validators); err != nil {
+		m.logger.Warn("Failed to save listing validators", "error", err)
+	}
+}
@@ -0,0 +1,173 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestValidatorTracker(t *testing.T) {
+	target := &config.Target{ConditionalListings: true, ListingRefreshEvery: 3}
+	validators := &ListingValidators{Directories: make(map[string]*ListingValidator)}
+
+	first := newValidatorTracker(validators, target, false)
+	header := http.Header{"Etag": {`"a1"`}}
+	first.received("a", header, []string{"x"})
+	first.received("plain", http.Header{}, []string{"y"})
+	first.received("gone", header, []string{"z"})
+	first.finish(true)
+	if _, ok := validators.Directories["plain"]; ok {
+		t.Error("Expected listings without validators not to be stored")
+	}
+
+	second := newValidatorTracker(validators, target, false)
+	if stored := second.conditional("a"); stored == nil || stored.ETag != `"a1"` || !slices.Equal(stored.Links, []string{"x"}) {
+		t.Fatalf("Expected the stored validator, got %+v", stored)
+	}
+	second.notModified("a")
+	second.finish(false)
+	if _, ok := validators.Directories["gone"]; !ok {
+		t.Error("Expected an incomplete run to keep directories it did not see")
+	}
+
+	third := newValidatorTracker(validators, target, false)
+	third.notModified("a")
+	third.finish(true)
+	if _, ok := validators.Directories["gone"]; ok {
+		t.Error("Expected a complete run to forget directories it did not see")
+	}
+
+	// The listing was last received in full three runs ago
+	if stored := newValidatorTracker(validators, target, false).conditional("a"); stored != nil {
+		t.Errorf("Expected a periodic refresh, got %+v", stored)
+	}
+	validators.Runs = 1
+	if stored := newValidatorTracker(validators, target, true).conditional("a"); stored != nil {
+		t.Errorf("Expected a forced refresh, got %+v", stored)
+	}
+
+	var disabled *validatorTracker
+	if disabled.conditional("a") != nil {
+		t.Error("Expected no validators without tracking")
+	}
+}
+
+// validatingServer serves listings with an ETag, answering matching conditional
+// requests with 304
+type validatingServer struct {
+	mu          sync.Mutex
+	full        []string
+	notModified []string
+	rootListing string
+}
+
+func (s *validatingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	listings := map[string]string{
+		"/":   s.rootListing,
+		"/a/": `<a href="one.txt">one.txt</a>`,
+	}
+	listing, ok := listings[r.URL.Path]
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "content of "+r.URL.Path)
+		return
+	}
+	etag := `"` + linkSetHash([]string{listing})[:8] + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		s.notModified = append(s.notModified, r.URL.Path)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.full = append(s.full, r.URL.Path)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "text/html")
+	io.WriteString(w, listing)
+}
+
+// requests returns the full and 304 listing responses since the last call
+func (s *validatingServer) requests() (full, notModified []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	full, notModified = s.full, s.notModified
+	s.full, s.notModified = nil, nil
+	return full, notModified
+}
+
+func TestRunReusesUnmodifiedListings(t *testing.T) {
+	upstream := &validatingServer{rootListing: `<a href="a/">a/</a><a href="top.txt">top.txt</a>`}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	targetDir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	target := &config.Target{Name: "validators", URL: server.URL + "/", MaxDepth: 5, Timeout: 5, CheckChanges: true,
+		ConditionalListings: true, ListingRefreshEvery: 3}
+	run := func(m *Manager) *MirrorStats {
+		t.Helper()
+		stats, err := m.Run(context.Background(), target, targetDir)
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+		return stats
+	}
+	manager := NewManager(&config.Config{}, logger)
+
+	if stats := run(manager); stats.ListingsNotModified != 0 || stats.FilesDownloaded != 2 {
+		t.Fatalf("Expected a first run listing everything, got %+v", stats)
+	}
+	if full, _ := upstream.requests(); !slices.Equal(full, []string{"/", "/a/"}) {
+		t.Fatalf("Expected full listings, got %v", full)
+	}
+
+	// Unchanged listings come back as 304 and their files are still checked
+	stats := run(manager)
+	full, notModified := upstream.requests()
+	if stats.ListingsNotModified != 2 || len(full) != 0 || !slices.Equal(notModified, []string{"/", "/a/"}) {
+		t.Errorf("Expected both listings to be reused, got %d, full %v, 304 %v", stats.ListingsNotModified, full, notModified)
+	}
+	if stats.FilesSkipped != 2 {
+		t.Errorf("Expected the files of reused listings to be checked, got %+v", stats)
+	}
+
+	// A changed listing is received and parsed in full
+	upstream.mu.Lock()
+	upstream.rootListing = `<a href="a/">a/</a><a href="top.txt">top.txt</a><a href="new.txt">new.txt</a>`
+	upstream.mu.Unlock()
+	if stats := run(manager); stats.ListingsNotModified != 1 || stats.FilesDownloaded != 1 {
+		t.Errorf("Expected the changed root to be listed and the new file fetched, got %+v", stats)
+	}
+	if full, _ := upstream.requests(); !slices.Equal(full, []string{"/"}) {
+		t.Errorf("Expected only the changed listing in full, got %v", full)
+	}
+
+	// A forced full scan and the periodic refresh request every listing in full
+	run(NewManager(&config.Config{}, logger, WithFullScan()))
+	if full, notModified := upstream.requests(); len(full) != 2 || len(notModified) != 0 {
+		t.Errorf("Expected a full scan, got full %v, 304 %v", full, notModified)
+	}
+	run(manager)
+	run(manager)
+	upstream.requests()
+	run(manager)
+	if full, _ := upstream.requests(); len(full) != 2 {
+		t.Errorf("Expected a periodic refresh, got %v", full)
+	}
+
+	validators, err := LoadListingValidators(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := validators.Directories[""]; root == nil || !strings.HasPrefix(root.ETag, `"`) || len(root.Links) != 3 {
+		t.Errorf("Expected the root validators and links to be stored, got %+v", root)
+	}
+}
@@ -0,0 +1,392 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+)
+
+// VerifyProgressFileName holds the progress of an interrupted Verify, so that the
+// next one resumes instead of hashing everything again
+const VerifyProgressFileName = config.MetadataPrefix + "verify-progress.json"
+
+// verifyCheckpointInterval is how often verification progress is logged and saved
+var verifyCheckpointInterval = 30 * time.Second
+
+// Kinds of problems found by Verify
+const (
+	// ProblemMissing is a file of the manifest that is not on disk
+	ProblemMissing = "missing"
+	// ProblemCorrupted is a file whose size or SHA-256 differs from the manifest
+	ProblemCorrupted = "corrupted"
+	// ProblemExtra is a file on disk the manifest does not know
+	ProblemExtra = "extra"
+	// ProblemUpstream is a sampled file whose upstream is gone or differs in size
+	ProblemUpstream = "upstream"
+)
+
+// VerifyOptions configures Verify
+type VerifyOptions struct {
+	// Sample is the number of files with a known URL whose upstream is checked with
+	// a HEAD request; 0 checks none
+	Sample int
+	// Repair downloads missing and corrupted files again. Frozen targets are
+	// never repaired.
+	Repair bool
+}
+
+// VerifyProblem is a file that does not match what was mirrored
+type VerifyProblem struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+	// Repaired is set once the file was downloaded again
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	Target string `json:"target"`
+	// Files and Bytes count the files of the manifest that were checked, Hashed
+	// those whose SHA-256 was compared, and UpstreamChecked the sampled upstreams
+	Files           int64           `json:"files"`
+	Bytes           int64           `json:"bytes"`
+	Hashed          int64           `json:"hashed"`
+	UpstreamChecked int64           `json:"upstreamChecked"`
+	Problems        []VerifyProblem `json:"problems,omitempty"`
+	// Resumed is set if the verification continued an interrupted one
+	Resumed  bool          `json:"resumed,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Count returns the number of problems of kind, not counting repaired ones
+func (r *VerifyReport) Count(kind string) int {
+	count := 0
+	for _, p := range r.Problems {
+		if p.Kind == kind && !p.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// verifyProgress is the saved state of an interrupted Verify: the manifest files
+// up to and including After were checked
+type verifyProgress struct {
+	After  string       `json:"after"`
+	Report VerifyReport `json:"report"`
+}
+
+// Verify checks the files below targetDir against the manifest: files recorded in
+// it must exist with the recorded size and, where one was recorded, SHA-256, and
+// files on disk must be recorded. With opts.Sample, the upstreams of that many
+// random files are checked with HEAD requests. With opts.Repair, missing and
+// corrupted files are downloaded again through the target's client. Progress is
+// logged and saved periodically; running Verify again after an interruption skips
+// the files checked before. Targets being synced and S3 storage are refused.
+func (m *Manager) Verify(ctx context.Context, target *config.Target, targetDir string, opts VerifyOptions) (*VerifyReport, error) {
+	m = m.forTarget(target.Name)
+	start := time.Now()
+	report := &VerifyReport{Target: target.Name}
+	if target.Storage == config.StorageS3 {
+		return report, fmt.Errorf("target %s: verify does not support s3 storage", target.Name)
+	}
+	release, err := m.runs.TryAcquire(target.Name, targetDir, OperationVerify)
+	if err != nil {
+		return report, err
+	}
+	defer release()
+	if marker, err := LoadSyncMarker(targetDir); err != nil {
+		return report, fmt.Errorf("target %s: %w", target.Name, err)
+	} else if marker != nil {
+		return report, fmt.Errorf("target %s: %w since %s", target.Name, ErrSyncInProgress, marker.Started.Format("2006-01-02 15:04:05 MST"))
+	}
+	manifest, err := LoadManifest(targetDir)
+	if err != nil {
+		return report, err
+	}
+
+	after := ""
+	if progress, err := loadVerifyProgress(targetDir); err != nil {
+		m.logger.Warn("Discarding unreadable verification progress", "error", err)
+	} else if progress != nil {
+		*report = progress.Report
+		report.Resumed, after = true, progress.After
+		// Extra files and upstreams are checked again after the manifest files
+		report.Problems = slices.DeleteFunc(report.Problems, func(p VerifyProblem) bool {
+			return p.Kind == ProblemExtra || p.Kind == ProblemUpstream
+		})
+		report.UpstreamChecked = 0
+		m.logger.Info("Resuming interrupted verification", "after", after, "files", report.Files)
+	}
+	m.logger.Info("Verifying target", "path", targetDir, "files", len(manifest.Files))
+
+	rels := make([]string, 0, len(manifest.Files))
+	for rel := range manifest.Files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	lastCheckpoint := time.Now()
+	for _, rel := range rels {
+		if rel <= after {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, m.saveVerifyProgress(targetDir, after, report, err)
+		}
+		if err := m.verifyFile(ctx, targetDir, rel, manifest.Files[rel], report); err != nil {
+			return report, m.saveVerifyProgress(targetDir, after, report, err)
+		}
+		after = rel
+
+		if time.Since(lastCheckpoint) >= verifyCheckpointInterval {
+			lastCheckpoint = time.Now()
+			m.logger.Info("Verification progress", "files", report.Files, "of", len(rels),
+				"bytes", report.Bytes, "problems", len(report.Problems), "elapsed", time.Since(start).Round(time.Second))
+			if err := m.saveVerifyProgress(targetDir, after, report, nil); err != nil {
+				m.logger.Warn("Failed to save verification progress", "error", err)
+			}
+		}
+	}
+
+	if err := m.findExtraFiles(ctx, targetDir, manifest, report); err != nil {
+		return report, m.saveVerifyProgress(targetDir, after, report, err)
+	}
+	if opts.Sample > 0 {
+		if err := m.sampleUpstream(ctx, target, manifest, rels, opts.Sample, report); err != nil {
+			return report, m.saveVerifyProgress(targetDir, after, report, err)
+		}
+	}
+	os.Remove(filepath.Join(targetDir, VerifyProgressFileName))
+
+	if opts.Repair && target.Frozen {
+		m.logger.Warn("Not repairing frozen target")
+	} else if opts.Repair {
+		if err := m.repair(ctx, target, targetDir, manifest, report); err != nil {
+			report.Duration = time.Since(start)
+			return report, fmt.Errorf("failed to repair %s: %w", targetDir, err)
+		}
+	}
+	report.Duration = time.Since(start)
+
+	m.logger.Info("Verification completed", "files", report.Files, "bytes", report.Bytes,
+		"hashed", report.Hashed, "missing", report.Count(ProblemMissing), "corrupted", report.Count(ProblemCorrupted),
+		"extra", report.Count(ProblemExtra), "upstream", report.Count(ProblemUpstream), "duration", report.Duration)
+	return report, nil
+}
+
+// verifyFile compares the file at rel with its manifest entry
+func (m *Manager) verifyFile(ctx context.Context, targetDir, rel string, source FileSource, report *VerifyReport) error {
+	path := filepath.Join(targetDir, filepath.FromSlash(rel))
+	if !isWithinDir(targetDir, path) {
+		return nil
+	}
+	report.Files++
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		report.Problems = append(report.Problems, VerifyProblem{Path: rel, Kind: ProblemMissing})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	report.Bytes += info.Size()
+	if info.Size() != source.Size {
+		report.Problems = append(report.Problems, VerifyProblem{Path: rel, Kind: ProblemCorrupted,
+			Detail: fmt.Sprintf("size %d, expected %d", info.Size(), source.Size)})
+		return nil
+	}
+	if source.SHA256 == "" {
+		return nil
+	}
+	digest, err := fileDigest(ctx, path)
+	if err != nil {
+		return err
+	}
+	report.Hashed++
+	if digest.SHA256 != source.SHA256 {
+		report.Problems = append(report.Problems, VerifyProblem{Path: rel, Kind: ProblemCorrupted,
+			Detail: fmt.Sprintf("sha256 %s, expected %s", digest.SHA256, source.SHA256)})
+	}
+	return nil
+}
+
+// findExtraFiles reports the files below targetDir the manifest does not know.
+// Mirror metadata, temporary files and other hidden entries are skipped.
+func (m *Manager) findExtraFiles(ctx context.Context, targetDir string, manifest *Manifest, report *VerifyReport) error {
+	err := filepath.WalkDir(targetDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if path != targetDir && (strings.HasPrefix(d.Name(), ".") || config.IsTempFile(d.Name())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(targetDir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := manifest.Lookup(rel); !ok {
+			report.Problems = append(report.Problems, VerifyProblem{Path: filepath.ToSlash(rel), Kind: ProblemExtra})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk %s: %w", targetDir, err)
+	}
+	return nil
+}
+
+// sampleUpstream checks the upstreams of up to sample random files of the manifest
+// with HEAD requests: they must still exist and, where the upstream tells, have
+// the recorded size
+func (m *Manager) sampleUpstream(ctx context.Context, target *config.Target, manifest *Manifest, rels []string, sample int, report *VerifyReport) error {
+	client := m.newClient(m.normalizeTarget(target))
+	for _, i := range rand.Perm(len(rels)) {
+		if report.UpstreamChecked >= int64(sample) {
+			break
+		}
+		rel := rels[i]
+		source := manifest.Files[rel]
+		if source.URL == "" {
+			continue
+		}
+
+		release, err := m.hosts.acquire(ctx, source.URL)
+		if err != nil {
+			return err
+		}
+		info, err := client.CheckFileInfo(ctx, source.URL)
+		release()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		report.UpstreamChecked++
+		if err != nil {
+			report.Problems = append(report.Problems, VerifyProblem{Path: rel, Kind: ProblemUpstream, Detail: err.Error()})
+			continue
+		}
+		if info.Size > 0 && info.Size != source.Size {
+			report.Problems = append(report.Problems, VerifyProblem{Path: rel, Kind: ProblemUpstream,
+				Detail: fmt.Sprintf("upstream size %d, recorded %d", info.Size, source.Size)})
+		}
+	}
+	return nil
+}
+
+// repair downloads the missing and corrupted files of report again from their
+// recorded URLs, like a run would, and records them in the manifest. Files without
+// a known URL, e.g. adopted ones, cannot be repaired.
+func (m *Manager) repair(ctx context.Context, target *config.Target, targetDir string, manifest *Manifest, report *VerifyReport) error {
+	target = m.normalizeTarget(target)
+	client := m.newClient(target)
+	stats := &MirrorStats{Target: target.Name, root: targetDir, runDir: targetDir, pacer: &hostSlot{gap: target.GetWaitDuration()}}
+	defer m.saveSources(targetDir, stats)
+
+	for i := range report.Problems {
+		problem := &report.Problems[i]
+		if problem.Kind != ProblemMissing && problem.Kind != ProblemCorrupted {
+			continue
+		}
+		url := manifest.Files[problem.Path].URL
+		if url == "" {
+			m.logger.Warn("Cannot repair file without a known upstream URL", "path", problem.Path)
+			continue
+		}
+		if err := m.usage.check(0); err != nil {
+			return err
+		}
+
+		localPath := filepath.Join(targetDir, filepath.FromSlash(problem.Path))
+		var digest httpPkg.Digest
+		err := m.withRetries(ctx, stats, target.Retries, "download", url, func() error {
+			release, err := m.acquire(ctx, stats, url)
+			if err != nil {
+				return err
+			}
+			defer release()
+			digest, err = client.FetchFileVerified(ctx, url, localPath, httpPkg.Digest{})
+			return err
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if storageErr := asStorageError(localPath, err); storageErr != nil {
+			return storageErr
+		}
+		if err != nil {
+			m.logger.Warn("Failed to repair file", "path", problem.Path, "url", url, "error", err)
+			continue
+		}
+		if stat, err := os.Stat(localPath); err == nil {
+			if err := m.usage.add(target.Name, stat.Size()-digest.Resumed); err != nil {
+				m.logger.Warn("Failed to account downloaded bytes", "error", err)
+			}
+		}
+		stats.recordSource(localPath, url, digest)
+		problem.Repaired = true
+		m.logger.Info("Repaired file", "path", problem.Path, "problem", problem.Kind)
+	}
+	if err := m.usage.Flush(); err != nil {
+		m.logger.Warn("Failed to save transfer accounting", "error", err)
+	}
+	return nil
+}
+
+// loadVerifyProgress reads the progress of an interrupted Verify; it returns nil if
+// there is none
+func loadVerifyProgress(targetDir string) (*verifyProgress, error) {
+	data, err := os.ReadFile(filepath.Join(targetDir, VerifyProgressFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var progress verifyProgress
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return nil, fmt.Errorf("failed to parse verification progress: %w", err)
+	}
+	return &progress, nil
+}
+
+// saveVerifyProgress saves the progress of Verify up to and including the manifest
+// file after, so that the next Verify resumes there. It returns cause, the error
+// that stopped Verify, or the error saving the progress if there is no cause.
+func (m *Manager) saveVerifyProgress(targetDir, after string, report *VerifyReport, cause error) error {
+	data, err := json.Marshal(verifyProgress{After: after, Report: *report})
+	if err == nil {
+		err = writeFileAtomic(targetDir, VerifyProgressFileName, data)
+	}
+	if cause != nil {
+		if err != nil {
+			m.logger.Warn("Failed to save verification progress", "error", err)
+		}
+		return fmt.Errorf("failed to verify %s: %w", targetDir, cause)
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// writeVerifyTree writes good.txt, missing.txt (recorded only), corrupt.txt
+// (altered after recording), short.txt (truncated) and extra.txt (unrecorded)
+// below dir with URLs on upstream
+func writeVerifyTree(t *testing.T, dir, upstream string) {
+	t.Helper()
+	sum := sha256.Sum256([]byte("content"))
+	source := func(name string) FileSource {
+		return FileSource{URL: upstream + "/" + name, Size: 7, SHA256: hex.EncodeToString(sum[:])}
+	}
+	manifest := &Manifest{Files: map[string]FileSource{}}
+	for name, data := range map[string]string{"good.txt": "content", "corrupt.txt": "CONTENT", "short.txt": "cont", "extra.txt": "x"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"good.txt", "missing.txt", "corrupt.txt", "short.txt"} {
+		manifest.Files[name] = source(name)
+	}
+	if err := saveManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "content")
+	}))
+	defer server.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name     string
+		opts     VerifyOptions
+		frozen   bool
+		repaired bool
+	}{
+		{"reports", VerifyOptions{Sample: 2}, false, false},
+		{"repairs", VerifyOptions{Repair: true}, false, true},
+		{"frozen targets are not repaired", VerifyOptions{Repair: true}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeVerifyTree(t, dir, server.URL)
+			manager := NewManager(&config.Config{}, logger)
+			target := &config.Target{Name: "verify", URL: server.URL + "/", Timeout: 5, Frozen: tt.frozen}
+
+			report, err := manager.Verify(context.Background(), target, dir, tt.opts)
+			if err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+			if report.Files != 4 || report.Hashed != 2 || report.UpstreamChecked != int64(tt.opts.Sample) {
+				t.Errorf("Unexpected counts: %+v", report)
+			}
+			kinds := make(map[string]string)
+			for _, p := range report.Problems {
+				kinds[p.Path] = p.Kind
+				if p.Repaired != (tt.repaired && p.Kind != ProblemExtra) {
+					t.Errorf("%s: expected repaired %t, got %+v", p.Path, tt.repaired, p)
+				}
+			}
+			expected := map[string]string{"missing.txt": ProblemMissing, "corrupt.txt": ProblemCorrupted, "short.txt": ProblemCorrupted, "extra.txt": ProblemExtra}
+			if len(kinds) != len(expected) {
+				t.Errorf("Expected %v, got %v", expected, kinds)
+			}
+			for path, kind := range expected {
+				if kinds[path] != kind {
+					t.Errorf("%s: expected %s, got %q", path, kind, kinds[path])
+				}
+			}
+
+			for _, name := range []string{"missing.txt", "corrupt.txt", "short.txt"} {
+				data, _ := os.ReadFile(filepath.Join(dir, name))
+				if (string(data) == "content") != tt.repaired {
+					t.Errorf("%s: expected repaired %t, got %q", name, tt.repaired, data)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, VerifyProgressFileName)); !os.IsNotExist(err) {
+				t.Errorf("Expected no progress left behind, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyResumes(t *testing.T) {
+	dir := t.TempDir()
+	writeVerifyTree(t, dir, "http://example.com")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	manager := NewManager(&config.Config{}, logger)
+	target := &config.Target{Name: "verify"}
+
+	// An interruption after the first files keeps what was checked
+	progress := verifyProgress{After: "good.txt", Report: VerifyReport{Target: "verify", Files: 2,
+		Problems: []VerifyProblem{{Path: "corrupt.txt", Kind: ProblemCorrupted}, {Path: "extra.txt", Kind: ProblemExtra}}}}
+	if err := manager.saveVerifyProgress(dir, progress.After, &progress.Report, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := manager.Verify(context.Background(), target, dir, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !report.Resumed || report.Files != 4 || report.Hashed != 0 {
+		t.Errorf("Expected missing.txt and short.txt checked on top, got %+v", report)
+	}
+	if report.Count(ProblemCorrupted) != 2 || report.Count(ProblemMissing) != 1 || report.Count(ProblemExtra) != 1 {
+		t.Errorf("Expected the earlier problems kept once, got %+v", report.Problems)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := manager.Verify(ctx, target, dir, VerifyOptions{}); err == nil {
+		t.Fatal("Expected a cancelled verification to fail")
+	}
+	if progress, err := loadVerifyProgress(dir); err != nil || progress == nil || progress.After != "" {
+		t.Errorf("Expected the progress saved before the first file, got %+v (%v)", progress, err)
+	}
+}
@@ -0,0 +1,67 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// visitedURLs is the set of directory and file URLs a run processed, so that
+// listings linking each other, or a directory redirecting to its ancestor, do not
+// make the run mirror the same URL again on every level down to Target.MaxDepth.
+// URLs are kept as hashes of their canonical form, which bounds the memory of
+// large trees. A nil set treats every URL as new; it is safe for concurrent use.
+type visitedURLs struct {
+	mu   sync.Mutex
+	seen map[[16]byte]struct{}
+}
+
+// newVisitedURLs creates an empty set
+func newVisitedURLs() *visitedURLs {
+	return &visitedURLs{seen: make(map[[16]byte]struct{})}
+}
+
+// visit records the URL u of a directory or file and reports whether it is new
+func (v *visitedURLs) visit(u *url.URL, dir bool) bool {
+	if v == nil {
+		return true
+	}
+	sum := sha256.Sum256([]byte(canonicalURL(u, dir)))
+	var key [16]byte
+	copy(key[:], sum[:])
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.seen[key]; ok {
+		return false
+	}
+	v.seen[key] = struct{}{}
+	return true
+}
+
+// canonicalURL returns the form visits of u are told apart by: without fragment
+// and user info, with a lowercase scheme and host without the default port, with
+// "." and ".." segments and repeated slashes resolved, the path escaped the same
+// way for every spelling, and a trailing slash if and only if u is a directory
+func canonicalURL(u *url.URL, dir bool) string {
+	scheme, host := canonicalOrigin(u)
+	cleaned := path.Clean("/" + u.Path)
+	if dir && cleaned != "/" {
+		cleaned += "/"
+	}
+	canonical := url.URL{Scheme: scheme, Host: host, Path: cleaned, RawQuery: u.RawQuery}
+	return canonical.String()
+}
+
+// canonicalOrigin returns the lowercase scheme and host of u, the host without
+// the default port of the scheme
+func canonicalOrigin(u *url.URL) (string, string) {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return scheme, host
+}
@@ -0,0 +1,157 @@
+package mirror
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		dir  bool
+		want string
+	}{
+		{"http://Example.COM:80/pub/a/#top", true, "http://example.com/pub/a/"},
+		{"http://example.com/pub/a", true, "http://example.com/pub/a/"},
+		{"http://example.com/pub/./a/../a//", true, "http://example.com/pub/a/"},
+		{"https://example.com:443/pub/f%69le.txt", false, "https://example.com/pub/file.txt"},
+		{"https://example.com:8443/pub/file.txt/", false, "https://example.com:8443/pub/file.txt"},
+		{"http://user@example.com/pub/a%20b.txt?v=1", false, "http://example.com/pub/a%20b.txt?v=1"},
+		{"http://example.com", true, "http://example.com/"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalURL(u, tt.dir); got != tt.want {
+			t.Errorf("canonicalURL(%q, %v) = %q, want %q", tt.url, tt.dir, got, tt.want)
+		}
+	}
+
+	visited := newVisitedURLs()
+	first, _ := url.Parse("http://example.com/pub/a/")
+	again, _ := url.Parse("http://EXAMPLE.com/pub/./a#x")
+	if !visited.visit(first, true) || visited.visit(again, true) {
+		t.Error("Expected the second spelling of the directory to be visited before")
+	}
+	var none *visitedURLs
+	if !none.visit(first, true) {
+		t.Error("Expected a nil set to treat every URL as new")
+	}
+}
+
+func TestRunVisitsEachURLOnce(t *testing.T) {
+	// The listings link their sibling and parent by absolute path, and two
+	// directories redirect back up the tree
+	listings := map[string]string{
+		"/pub/": `<a href="a/">a/</a><a href="b/">b/</a><a href="top.txt">top.txt</a>` +
+			`<a href="/pub/">self</a><a href="/pub/b/">b again</a><a href="/pub/a/a.txt">a.txt</a>`,
+		"/pub/a/": `<a href="a.txt">a.txt</a><a href="/pub/">parent</a><a href="/pub/b/">sibling</a>` +
+			`<a href="/pub/b/b.txt">sibling file</a><a href="loop/">loop/</a><a href="./a.txt#x">a.txt</a>`,
+		"/pub/b/": `<a href="b.txt">b.txt</a><a href="/pub/a/">sibling</a><a href="/pub/">parent</a><a href="up/">up/</a>`,
+	}
+	redirects := map[string]string{
+		"/pub/a/loop/": "/pub/",
+		"/pub/b/up/":   "/pub/b/",
+	}
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests following a redirect carry its URL as the referer; the target
+		// of a redirect loop is fetched again before the run can tell
+		mu.Lock()
+		if r.Referer() == "" {
+			requests[r.Method+" "+r.URL.Path]++
+		}
+		mu.Unlock()
+		if location, ok := redirects[r.URL.Path]; ok {
+			http.Redirect(w, r, location, http.StatusFound)
+			return
+		}
+		if listing, ok := listings[r.URL.Path]; ok {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, listing)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "loops", URL: server.URL + "/pub/", MaxDepth: 10, Timeout: 5}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, path := range []string{"/pub/", "/pub/a/", "/pub/b/", "/pub/top.txt", "/pub/a/a.txt", "/pub/b/b.txt"} {
+		if got := requests["GET "+path]; got != 1 {
+			t.Errorf("Expected %s to be fetched once, got %d requests: %v", path, got, requests)
+		}
+	}
+	for name, content := range map[string]string{"top.txt": "/pub/top.txt", "a/a.txt": "/pub/a/a.txt", "b/b.txt": "/pub/b/b.txt"} {
+		if data, err := os.ReadFile(filepath.Join(targetDir, name)); err != nil || string(data) != "content of "+content {
+			t.Errorf("Expected %s to hold %s, got %q (%v)", name, content, data, err)
+		}
+	}
+	for _, name := range []string{"a.txt", "a/b.txt", "a/loop/a", "b/up/b.txt"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); err == nil {
+			t.Errorf("Expected %s not to be mirrored", name)
+		}
+	}
+	if stats.FilesDownloaded != 3 || stats.RevisitedURLs != 3 {
+		t.Errorf("Expected 3 downloads and the 2 redirecting directories and a.txt linked twice skipped, got %d and %d",
+			stats.FilesDownloaded, stats.RevisitedURLs)
+	}
+}
+
+func TestRunMirrorsFilesLinkedFromParentListing(t *testing.T) {
+	// The subdirectory has no index of its own, so its files are only known from
+	// the links of the parent listing
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pub/":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<a href="sub/file.iso">file.iso</a><a href="sub/file.iso">again</a>`)
+		case "/pub/sub/":
+			http.NotFound(w, r)
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.WriteString(w, "content of "+r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	manager := NewManager(&config.Config{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	target := &config.Target{Name: "links", URL: server.URL + "/pub/", MaxDepth: 10, Timeout: 5}
+	targetDir := t.TempDir()
+
+	stats, err := manager.Run(context.Background(), target, targetDir)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(targetDir, "sub", "file.iso")); err != nil || string(data) != "content of /pub/sub/file.iso" {
+		t.Errorf("Expected the linked file to be mirrored into its directory, got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "file.iso")); err == nil {
+		t.Error("Expected the linked file not to be mirrored into the listing's directory")
+	}
+	if stats.FilesDownloaded != 1 {
+		t.Errorf("Expected the file linked twice to be downloaded once, got %d downloads", stats.FilesDownloaded)
+	}
+}
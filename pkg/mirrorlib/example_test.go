@@ -0,0 +1,63 @@
+package mirrorlib_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/mirrorlib"
+)
+
+func Example() {
+	// An upstream directory listing with a single file
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pub/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="release.tar.gz">release.tar.gz</a>`)
+		case "/pub/release.tar.gz":
+			fmt.Fprint(w, "archive")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	dir, err := os.MkdirTemp("", "mirror")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := mirrorlib.New(mirrorlib.Options{
+		Target: mirrorlib.Target{
+			Name:    "releases",
+			URL:     upstream.URL + "/pub/",
+			Timeout: 10 * time.Second,
+		},
+		Dir:    dir,
+		Logger: slog.New(slog.DiscardHandler),
+		Events: func(e mirrorlib.Event) {
+			if e.Type == mirrorlib.EventFileDownloaded {
+				fmt.Printf("downloaded %s (%d bytes)\n", e.URL[len(upstream.URL):], e.Bytes)
+			}
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	stats, err := m.Run(context.Background())
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("files:", stats.FilesDownloaded, "errors:", stats.Errors)
+	// Output:
+	// downloaded /pub/release.tar.gz (7 bytes)
+	// files: 1 errors: 0
+}
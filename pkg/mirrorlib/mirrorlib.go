@@ -0,0 +1,1366 @@
+// Package mirrorlib is the stable API for embedding the mirroring engine in other
+// programs. A Mirrorer mirrors one target into a destination directory using the
+// caller's logger, HTTP transport and event sink, without reading any environment
+// variables or configuration files.
+//
+// # Compatibility
+//
+// This package follows semantic versioning independently of the internal packages
+// it wraps. Within a major version, exported identifiers are not removed or renamed,
+// function signatures do not change, and the zero value of every field in Options,
+// Target and Settings keeps its documented meaning. New fields, event types and
+// functions may be added in minor versions, so callers should use keyed struct
+// literals and ignore event types they do not know. The packages below pkg/mirror,
+// pkg/http and pkg/config carry no such guarantee.
+package mirrorlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	httpPkg "github.com/jhofer-cloud/http-mirror/pkg/http"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+// Target describes the upstream site to mirror
+type Target struct {
+	// Name identifies the target in logs, stats and events
+	Name string
+	// URL is the directory listing or file to mirror
+	URL string
+	// UserAgent defaults to the engine's friendly mirror user agent
+	UserAgent string
+	// RateLimit caps download bandwidth (e.g. "500k"); empty uses the default of 500k/s
+	RateLimit string
+	// Retries is the number of attempts for failed requests; 0 uses the default
+	Retries int
+	// MaxDepth limits recursion into subdirectories; 0 uses the default of 5, -1 is unlimited
+	MaxDepth int
+	// Timeout bounds each request; 0 uses the default of 30s. Rounded up to whole seconds.
+	Timeout time.Duration
+	// WaitBetweenRequests is the pause between listing requests; 0 uses the default
+	// of 1s. Rounded up to whole seconds.
+	WaitBetweenRequests time.Duration
+	// AlwaysDownload disables the comparison with existing local files and downloads everything
+	AlwaysDownload bool
+	// DisableContinueDownload downloads interrupted files again from the start
+	// instead of resuming them from their partial file
+	DisableContinueDownload bool
+	// DisableTimestamping and DisableNoClobber turn off the wget-style settings of
+	// the same name; the engine always keeps upstream modification times and
+	// replaces files atomically
+	DisableTimestamping bool
+	DisableNoClobber    bool
+	// ExcludeDirs skips matching directories without fetching their listings: globs
+	// matched against the path relative to URL (e.g. "pub/old"), globs without a
+	// slash matched against each directory name, or regular expressions prefixed
+	// with "re:"
+	ExcludeDirs []string
+	// DeleteExcludedDirs removes local copies of excluded directories instead of
+	// keeping them
+	DeleteExcludedDirs bool
+	// ReportFilters mirrors and keeps directories matched by ExcludeDirs anyway and
+	// only reports what would have been skipped or deleted, so that new patterns
+	// can be reviewed before they are enforced
+	ReportFilters bool
+	// Priority are patterns in the syntax of ExcludeDirs for files and directories
+	// to fetch first, in the order of the patterns, so that a run cut short by a
+	// limit or budget has the important ones
+	Priority []string
+	// ContentTypeCheck selects which conflicts between the extension of a file and
+	// its Content-Type or first bytes are reported: "html" (the default) for HTML
+	// in place of binary data and the reverse, "all" or "off"
+	ContentTypeCheck string
+	// QuarantineMismatches writes downloads failing ContentTypeCheck below the
+	// hidden quarantine directory of Dir instead of replacing the local copy
+	QuarantineMismatches bool
+	// VerifyChecksums verifies downloads against the SHA256SUMS or MD5SUMS list of
+	// their directory, retrying and finally discarding those that do not match
+	VerifyChecksums bool
+	// ChurnSkipAfter mirrors directories whose listing has not changed for more
+	// than that many runs from their last listing instead of listing them again;
+	// 0 lists every directory on every run. ChurnRelistEvery lists them every that
+	// many runs anyway and FullScanEvery lists every directory every that many
+	// runs; 0 uses the defaults of 5 and 20.
+	ChurnSkipAfter   int
+	ChurnRelistEvery int
+	FullScanEvery    int
+	// ConditionalListings requests listings conditionally on the validators of
+	// the previous run and mirrors unchanged ones from their stored links;
+	// ListingRefreshEvery requests them in full every that many runs anyway, 0
+	// uses the default of 10
+	ConditionalListings bool
+	ListingRefreshEvery int
+	// AllowQueryStrings requests listing links with their query string, e.g. a
+	// download token; otherwise it is dropped. Local names never include it.
+	AllowQueryStrings bool
+	// ContentDispositionNames names downloads by the filename of their
+	// Content-Disposition header instead of the link path, if it is a safe name
+	ContentDispositionNames bool
+	// ListingFormat is "auto" (empty), "html", "nginx-json" or "s3"; auto reads
+	// nginx JSON listings of directory URLs served as application/json and S3
+	// bucket listings at URL. With "s3", a "prefix" query parameter of URL selects
+	// the keys to mirror.
+	ListingFormat string
+	// IgnoreSameHostURLs drops listing links that are absolute URLs even when
+	// they point below the listed directory on the target's own host; by default
+	// those are followed. Links to other hosts are always dropped.
+	IgnoreSameHostURLs bool
+	// MTimeTolerance is how far the upstream modification time of a file may lie
+	// past the local one before the file is downloaded again, for upstreams whose
+	// servers disagree on the time; 0 uses the default of 2s, a negative value
+	// re-downloads on any newer time. Rounded up to whole seconds. Files whose
+	// ETag did not change are never downloaded again.
+	MTimeTolerance time.Duration
+	// ParallelChunks downloads files of at least ParallelChunkMinSize (e.g. "1g";
+	// empty means 256 MiB) in that many byte ranges at once from upstreams that
+	// support ranges; 0 or 1 downloads every file in a single stream
+	ParallelChunks       int
+	ParallelChunkMinSize string
+	// Concurrency is how many files are downloaded at once while directories are
+	// still visited one after another; 0 uses the default of 1
+	Concurrency int
+	// TransferWeight is the share of Settings.MaxOpenTransfers the target gets
+	// while targets running at once wait for transfer slots, relative to the
+	// weights of the others; 0 means 1, an equal share
+	TransferWeight int
+	// MaxTotalBytes (e.g. "20g") and MaxTotalFiles cap what a single run
+	// downloads; a run reaching either lets the downloads in progress finish and
+	// stops with ErrBudgetExceeded. Empty or 0 is unlimited.
+	MaxTotalBytes string
+	MaxTotalFiles int
+	// MinFileSize and MaxFileSize (e.g. "100m") skip files whose size, as a HEAD
+	// request or the listing tells, lies outside the range; downloads of unknown
+	// size are aborted once they grow past MaxFileSize. Empty is unlimited.
+	MinFileSize string
+	MaxFileSize string
+	// Hidden are name patterns that are not downloaded; nil skips dotfiles and an
+	// empty list mirrors everything. Mirror metadata names are always skipped.
+	Hidden []string
+	// MetadataIndex is the URL of an "ls -lR" file, optionally gzipped, relative to
+	// URL. Directories it covers are mirrored from it without listing requests.
+	MetadataIndex string
+	// Dated writes every run into a new directory below Dir instead of updating Dir
+	// in place; nil keeps the in-place layout
+	Dated *DatedLayout
+	// DenyCrossHostRedirects refuses redirects to a host other than the one of the
+	// request, except to the hosts in RedirectAllowHosts
+	DenyCrossHostRedirects bool
+	RedirectAllowHosts     []string
+	// Frozen skips Run and Cleanup, returning ErrTargetFrozen, while leaving Dir as
+	// it is; the time the target was first skipped is kept in its sync state
+	Frozen bool
+	// Prune deletes files and directories below Dir that a run no longer finds
+	// upstream; PruneDryRun only logs them. Not supported with Dated.
+	Prune       bool
+	PruneDryRun bool
+	// S3 uploads downloaded files to a bucket instead of writing them below Dir,
+	// which then only keeps the target's metadata; nil stores files in Dir
+	S3 *S3Storage
+	// FileEvents reports every file a run adds, updates or deletes to a webhook
+	// or an events file below Dir as the run progresses; nil reports nothing
+	FileEvents *FileEvents
+}
+
+// FileEvents configures the outputs of the file events of a target
+type FileEvents struct {
+	// WebhookURL receives batches of events as JSON arrays in POST requests
+	WebhookURL string
+	// File appends the events of every run as NDJSON lines to a file of its own
+	// in the hidden events directory of Dir
+	File bool
+	// BatchSize is the most events per request and FlushInterval how long an
+	// incomplete batch waits for more; 0 uses the defaults of 100 and 5 seconds
+	BatchSize     int
+	FlushInterval time.Duration
+	// QueueSize is the most events kept while the webhook fails, 0 for 10000;
+	// further events are dropped and counted in Stats.FileEventsDropped
+	QueueSize int
+}
+
+// S3Storage configures the bucket a target is uploaded to. Credentials are read
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type S3Storage struct {
+	Bucket string
+	// Prefix is prepended to all keys; empty uses the target name
+	Prefix string
+	// Region defaults to "us-east-1"
+	Region string
+	// Endpoint overrides the AWS endpoint, e.g. for S3-compatible stores
+	Endpoint string
+	// PathStyle addresses the bucket in the URL path instead of the host name
+	PathStyle bool
+	// PartSize is the size of multipart upload parts (e.g. "16m", at least "5m");
+	// empty uses the default of 16 MiB
+	PartSize string
+}
+
+// DatedLayout configures the immutable-dated layout. Every run mirrors into a new
+// directory named by the run's start time, which is never modified afterwards. A
+// "current" symlink in Dir points at the directory of the last successful run.
+type DatedLayout struct {
+	// Format is the strftime-style directory name, formatted in UTC; empty uses
+	// "%Y-%m-%d". Supports %Y, %y, %m, %d, %j, %H, %M and %S.
+	Format string
+	// LinkUnchanged hard-links files that did not change upstream from the previous
+	// directory instead of downloading them again
+	LinkUnchanged bool
+	// Keep is how many dated directories are kept after a successful run; 0 keeps all
+	Keep int
+}
+
+// Settings tunes the engine. The zero value uses the same defaults as the CLI.
+type Settings struct {
+	// WriteBufferSize is the per-download buffer size (e.g. "256k")
+	WriteBufferSize string
+	// SyncWrites selects when files are fsynced: "always", "large-files" or "never"
+	SyncWrites string
+	// MaxListingBytes caps the size of a single directory listing (e.g. "1g")
+	MaxListingBytes string
+	// FilesystemCompat selects the naming policy: "auto", "native" or "portable"
+	FilesystemCompat string
+	// LogThrottle aggregates repeated warnings into sampled lines and summaries
+	LogThrottle LogThrottle
+	// Hosts overrides request pacing per upstream host. Within a group, the overrides
+	// of all Mirrorers apply to every Mirrorer.
+	Hosts []HostPolicy
+	// EmptyListingAlertPercent is the growth in percentage points of the share of
+	// empty listings since the previous run that raises an EventListingAnomaly;
+	// 0 uses the default, a negative value disables the check
+	EmptyListingAlertPercent int
+	// MaxDirectories, MaxEntriesPerDirectory and MaxPathDepth bound the size of the
+	// mirrored tree; 0 uses the default and a negative value means unlimited
+	MaxDirectories         int
+	MaxEntriesPerDirectory int
+	MaxPathDepth           int
+	// VerifyRelinks re-hashes files created from an identical copy after an upstream
+	// move before trusting them
+	VerifyRelinks bool
+	// UsageDir is the directory holding the transfer accounting shared by a group;
+	// empty disables accounting and MonthlyByteCap. Within a group, the first
+	// Options' UsageDir, MonthlyByteCap and CapResetDay apply to every Mirrorer.
+	UsageDir string
+	// MonthlyByteCap stops runs with ErrMonthlyCapReached once this many bytes
+	// (e.g. "2t") were downloaded in the current billing period; empty is unlimited
+	MonthlyByteCap string
+	// CapResetDay is the day of the month, in local time, the billing period starts;
+	// 0 uses the first
+	CapResetDay int
+	// TempMaxAge is the age after which Run removes temporary and partial download
+	// files left by crashed runs; 0 uses the default, a negative value disables the
+	// cleanup. Rounded up to whole seconds.
+	TempMaxAge time.Duration
+	// ReportDetail "full" lists every file a run skipped with its reason in the
+	// skip report of the target; empty or "summary" only counts them
+	ReportDetail string
+	// FutureTimeTolerance is how far past the current time a modification time may
+	// lie before the file is counted in Stats.FutureModTimes; 0 uses the default, a
+	// negative value disables the check. Rounded up to whole seconds.
+	FutureTimeTolerance time.Duration
+	// ClampFutureTimes sets such modification times to the time the file was
+	// checked, so that they are served and compared sensibly
+	ClampFutureTimes bool
+	// FullScan lists every directory in full, ignoring Target.ChurnSkipAfter and
+	// Target.ConditionalListings
+	FullScan bool
+	// MaxOpenTransfers caps the file downloads open at once in the whole process,
+	// see httpPkg.Transfers; 0 keeps the current cap, which is derived from the file
+	// descriptor limit unless changed, and a negative value means unlimited. The
+	// first Options' MaxOpenTransfers of a group applies.
+	MaxOpenTransfers int
+	// DuplicateRuns is DuplicateRunsQueue, the default, to make Run wait while
+	// another Run of the same directory in the process is in progress, or
+	// DuplicateRunsReject to fail with ErrSyncInProgress at once
+	DuplicateRuns string
+}
+
+// LogThrottle tunes warning aggregation; zero fields use the defaults
+type LogThrottle struct {
+	// Disabled logs every repeated warning
+	Disabled bool
+	// Burst is how many occurrences of each error class per host are logged in full
+	Burst int
+	// SampleRate logs every Nth occurrence once the burst is exhausted
+	SampleRate int
+	// SummaryInterval is the time between summary lines. Rounded up to whole seconds.
+	SummaryInterval time.Duration
+}
+
+// HostPolicy overrides pacing for a single upstream host
+type HostPolicy struct {
+	// Host is the URL host, including a non-default port
+	Host string
+	// WaitBetweenRequests is the minimum gap between requests to the host; 0 derives
+	// it from the targets, a negative value disables the gap. Rounded up to whole seconds.
+	WaitBetweenRequests time.Duration
+	// MaxConcurrency caps simultaneous requests to the host, 0 means unlimited
+	MaxConcurrency int
+}
+
+// EventType identifies what an Event reports
+type EventType string
+
+// Event types; more may be added in minor versions
+const (
+	EventFileDownloaded EventType = "file_downloaded"
+	EventFileSkipped    EventType = "file_skipped"
+	EventError          EventType = "error"
+	// EventFileRelinked reports a file created from an identical copy the upstream
+	// moved, instead of downloading it; Bytes is the download avoided
+	EventFileRelinked EventType = "file_relinked"
+	// EventListingAnomaly reports that the share of empty directory listings jumped
+	// compared to the previous run, e.g. because the upstream changed its listing format
+	EventListingAnomaly EventType = "listing_anomaly"
+	// EventMonthlyCapReached reports that a run stopped at the monthly byte cap
+	EventMonthlyCapReached EventType = "monthly_cap_reached"
+	// EventFilterReport reports that a run with Target.ReportFilters mirrored
+	// directories matched by ExcludeDirs; Stats.ExcludedDirs lists them
+	EventFilterReport EventType = "filter_report"
+	// EventContentMismatch reports a download whose content conflicts with its
+	// file extension, such as a login page saved as firmware.bin
+	EventContentMismatch EventType = "content_mismatch"
+	// EventProgress reports the estimated progress of the first run into a
+	// directory that was never synced every 30 seconds in Event.Progress
+	EventProgress EventType = "progress"
+)
+
+// Progress estimates how far the first run into a directory got; the totals grow
+// as the tree is discovered
+type Progress = mirror.Progress
+
+// Progress bases
+const (
+	ProgressByBytes = mirror.ProgressByBytes
+	ProgressByFiles = mirror.ProgressByFiles
+)
+
+// Policies of Settings.DuplicateRuns
+const (
+	DuplicateRunsQueue  = mirror.DuplicateRunsQueue
+	DuplicateRunsReject = mirror.DuplicateRunsReject
+)
+
+// RunStatus describes a run of the process holding or waiting for a directory
+type RunStatus = mirror.RunStatus
+
+// States of the runs reported by ActiveRuns
+const (
+	RunRunning = mirror.RunRunning
+	RunQueued  = mirror.RunQueued
+)
+
+// ActiveRuns returns the runs of all Mirrorers of the process that hold or wait
+// for their directory, with the running one of each directory first and the
+// queued ones in the order they will run. Runs, purges, resets, verifications and
+// adoptions of one directory never overlap.
+func ActiveRuns() []RunStatus {
+	return mirror.Runs.Runs()
+}
+
+// ErrListingFormatChanged is the error of an EventListingAnomaly
+var ErrListingFormatChanged = mirror.ErrListingFormatChanged
+
+// ErrFilterReport is the error of an EventFilterReport
+var ErrFilterReport = mirror.ErrFilterReport
+
+// ErrContentTypeMismatch is the error of an EventContentMismatch
+var ErrContentTypeMismatch = mirror.ErrContentTypeMismatch
+
+// ErrTargetFrozen is wrapped by the error of Run and Cleanup for a frozen target,
+// which did nothing
+var ErrTargetFrozen = mirror.ErrTargetFrozen
+
+// ErrSyncInProgress is wrapped by the error of Purge, Reset, Verify and Adopt while
+// the target is being synced, and by the error of Run with DuplicateRunsReject
+// while another Run of the directory is in progress
+var ErrSyncInProgress = mirror.ErrSyncInProgress
+
+// ErrMonthlyCapReached is wrapped by the error of a run stopped at the monthly byte cap
+var ErrMonthlyCapReached = mirror.ErrMonthlyCapReached
+
+// ErrBudgetExceeded is wrapped by the error of a run stopped at Target.MaxTotalBytes
+// or Target.MaxTotalFiles
+var ErrBudgetExceeded = mirror.ErrBudgetExceeded
+
+// ErrDatedDirExists is wrapped by the error of a dated run whose directory already
+// exists, e.g. after a second run on the same day
+var ErrDatedDirExists = mirror.ErrDatedDirExists
+
+// Errors returned by runs and reported in events, matched with errors.As
+type (
+	// StatusError is an unexpected HTTP status from the upstream
+	StatusError = httpPkg.StatusError
+	// TimeoutError is a request that did not complete in time
+	TimeoutError = httpPkg.TimeoutError
+	// ChecksumMismatchError is content that does not match its expected digest
+	ChecksumMismatchError = httpPkg.ChecksumMismatchError
+	// RedirectBlockedError is a redirect refused by Target.DenyCrossHostRedirects
+	RedirectBlockedError = httpPkg.RedirectBlockedError
+	// ListingParseError is a directory listing that could not be parsed
+	ListingParseError = mirror.ListingParseError
+	// PathSecurityError is a remote name that would escape the target directory
+	PathSecurityError = mirror.PathSecurityError
+	// StorageError is a read-only, full or failing destination volume; it stops the run
+	StorageError = mirror.StorageError
+)
+
+// IsTemporary reports whether err may go away on retry: timeouts, network errors,
+// server errors and rate limiting
+func IsTemporary(err error) bool {
+	return httpPkg.IsTemporary(err)
+}
+
+// Usage is the transfer accounting shared by a group of Mirrorers
+type Usage struct {
+	// PeriodStart is the start of the current billing period
+	PeriodStart time.Time
+	// TrackingSince is later than PeriodStart if accounting began during the period
+	TrackingSince time.Time
+	PeriodBytes   int64
+	// MonthlyByteCap is the budget of a billing period, 0 if unlimited
+	MonthlyByteCap int64
+	TotalBytes     int64
+	// PeriodBytesByTarget and TotalBytesByTarget break the totals down by target name
+	PeriodBytesByTarget map[string]int64
+	TotalBytesByTarget  map[string]int64
+}
+
+// Event describes a single file-level outcome or run-level alert of a run
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Target string
+	URL    string
+	// Path is the local file path, empty for errors not tied to a file
+	Path string
+	// Bytes is the size of a downloaded file
+	Bytes int64
+	Err   error
+	// Progress is set for EventProgress
+	Progress *Progress
+}
+
+// Options configures a Mirrorer
+type Options struct {
+	Target Target
+	// Dir is the destination directory; files are written directly below it
+	Dir string
+	// Logger receives the engine's logs; nil discards them
+	Logger *slog.Logger
+	// Events, if set, is called synchronously for every file-level outcome and must not block
+	Events func(Event)
+	// Transport is used for all upstream requests; nil uses http.DefaultTransport
+	Transport http.RoundTripper
+	Settings  Settings
+}
+
+// Stats summarizes a completed run. It encodes to JSON with camelCase keys;
+// Duration is left out as StartTime and EndTime give it.
+type Stats struct {
+	Target string `json:"target"`
+	// RunID identifies the run in its log records, as "run_id", and in the
+	// manifest entries of the files it downloaded
+	RunID           string        `json:"runId"`
+	StartTime       time.Time     `json:"startTime"`
+	EndTime         time.Time     `json:"endTime"`
+	Duration        time.Duration `json:"-"`
+	FilesDownloaded int64         `json:"filesDownloaded"`
+	FilesSkipped    int64         `json:"filesSkipped"`
+	BytesDownloaded int64         `json:"bytesDownloaded"`
+	// BytesResumed counts the bytes of interrupted downloads that were continued
+	// rather than downloaded again
+	BytesResumed int64 `json:"bytesResumed"`
+	// FilesSkippedSize counts the files outside Target.MinFileSize and
+	// Target.MaxFileSize, including downloads aborted for their size
+	FilesSkippedSize int64 `json:"filesSkippedSize"`
+	// SkipReasons counts the files the run did not download per reason code, e.g.
+	// "unchanged"; see the Skip* constants of the config package
+	SkipReasons map[string]int64 `json:"skipReasons"`
+	// NewestRemoteModTime is the newest upstream modification time seen during the run
+	NewestRemoteModTime time.Time `json:"newestRemoteModTime"`
+	CaseCollisions      int64     `json:"caseCollisions"`
+	Errors              int64     `json:"errors"`
+	// ErrorsByClass counts failures per error class (e.g. "timeout", "http 404")
+	ErrorsByClass map[string]int64 `json:"errorsByClass"`
+	// FailureSignatures counts the files that failed to download by error class,
+	// the host that answered and its server software, e.g. "http 503 from
+	// mirror.example.com (nginx)"
+	FailureSignatures map[string]int64 `json:"failureSignatures,omitempty"`
+	// ListingsByFormat counts parsed HTML listings per detected generator
+	ListingsByFormat map[string]int64 `json:"listingsByFormat"`
+	// EmptyListings counts HTML listings without a single followable link
+	EmptyListings int64 `json:"emptyListings"`
+	// UnrecognizedListings counts HTML responses without any anchors
+	UnrecognizedListings int64 `json:"unrecognizedListings"`
+	// LimitsReached counts how often each tree limit truncated the run, keyed by
+	// "directories", "entries_per_directory" or "path_depth"
+	LimitsReached map[string]int64 `json:"limitsReached"`
+	// FilesRelinked counts files created from identical copies the upstream moved,
+	// and BytesSavedByRelink the downloads this avoided
+	FilesRelinked      int64 `json:"filesRelinked"`
+	BytesSavedByRelink int64 `json:"bytesSavedByRelink"`
+	// DirectoriesSkipped counts directories excluded by Target.ExcludeDirs;
+	// ExcludedDirs lists the first 100 of them
+	DirectoriesSkipped int64         `json:"directoriesSkipped"`
+	ExcludedDirs       []ExcludedDir `json:"excludedDirs"`
+	// DirectoriesReported counts directories matched with Target.ReportFilters and
+	// mirrored anyway, and FilesReported the files in them; ExcludedDirs lists them
+	// as reported
+	DirectoriesReported int64 `json:"directoriesReported"`
+	FilesReported       int64 `json:"filesReported"`
+	// ContentTypeMismatches counts downloads failing Target.ContentTypeCheck;
+	// ContentMismatches lists the first 100 of them
+	ContentTypeMismatches int64             `json:"contentTypeMismatches"`
+	ContentMismatches     []ContentMismatch `json:"contentMismatches"`
+	// ListingsAvoided counts directories mirrored from Target.MetadataIndex
+	// without fetching their listing
+	ListingsAvoided int64 `json:"listingsAvoided"`
+	// FilesCheckedByListing counts files found unchanged by the size and
+	// modification time printed in their directory listing
+	FilesCheckedByListing int64 `json:"filesCheckedByListing"`
+	// ListingsSkippedByChurn counts directories mirrored from their last listing
+	// because of Target.ChurnSkipAfter
+	ListingsSkippedByChurn int64 `json:"listingsSkippedByChurn"`
+	// ListingsNotModified counts listings the upstream answered with 304 Not
+	// Modified because of Target.ConditionalListings
+	ListingsNotModified int64 `json:"listingsNotModified"`
+	// DuplicateLinks counts links a listing repeated; NameConflicts counts links
+	// skipped because an earlier link of the same listing maps to the same file
+	DuplicateLinks int64 `json:"duplicateLinks"`
+	NameConflicts  int64 `json:"nameConflicts"`
+	// FilesNamedByHeader counts files named by their Content-Disposition header
+	// with Target.ContentDispositionNames
+	FilesNamedByHeader int64 `json:"filesNamedByHeader"`
+	// FilesVerified counts downloads that matched their checksum list with
+	// Target.VerifyChecksums; ChecksumMismatches those that never did and were
+	// discarded
+	FilesVerified      int64 `json:"filesVerified"`
+	ChecksumMismatches int64 `json:"checksumMismatches"`
+	// FileEventsSent counts file events delivered to Target.FileEvents' webhook,
+	// and FileEventsDropped those given up on while it failed
+	FileEventsSent    int64 `json:"fileEventsSent"`
+	FileEventsDropped int64 `json:"fileEventsDropped"`
+	// RevisitedURLs counts directories and files skipped because the run processed
+	// their URL before, e.g. as listings linked each other
+	RevisitedURLs int64 `json:"revisitedUrls"`
+	// SkewTolerated counts files not downloaded again because their upstream
+	// modification time lay within Target.MTimeTolerance past the local one
+	SkewTolerated int64 `json:"skewTolerated"`
+	// ReclaimedBytes is the size of stale temporary files removed before the run
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+	// FutureModTimes counts files whose modification time lay beyond
+	// Settings.FutureTimeTolerance in the future
+	FutureModTimes int64 `json:"futureModTimes"`
+	// FilesDeleted and DirectoriesDeleted count what Target.Prune deleted, or
+	// would have deleted with Target.PruneDryRun; FilesDeleted includes the files
+	// of deleted directories
+	FilesDeleted       int64 `json:"filesDeleted"`
+	DirectoriesDeleted int64 `json:"directoriesDeleted"`
+	// Retries counts requests repeated after temporary failures and ListingRetries
+	// the listing requests among them; UnavailableListings counts listings that
+	// still failed with a server error, which fails the run
+	Retries             int64 `json:"retries"`
+	ListingRetries      int64 `json:"listingRetries"`
+	UnavailableListings int64 `json:"unavailableListings"`
+	// RedirectHosts counts followed redirects per host redirected to;
+	// BlockedRedirects counts those refused by Target.DenyCrossHostRedirects
+	RedirectHosts    map[string]int64 `json:"redirectHosts"`
+	BlockedRedirects map[string]int64 `json:"blockedRedirects"`
+	// TransfersQueued counts downloads that waited for a slot of
+	// Settings.MaxOpenTransfers; PeakOpenTransfers is the most transfers of the
+	// process open at once that a download of the run saw
+	TransfersQueued   int64 `json:"transfersQueued"`
+	PeakOpenTransfers int64 `json:"peakOpenTransfers"`
+	// BytesPerSecond is the throughput of the run, BytesDownloaded over its
+	// duration, which shows the share of transfer slots Target.TransferWeight gave
+	// it among targets running at once
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+	// BudgetExceeded is "bytes" or "files" if the run stopped at
+	// Target.MaxTotalBytes or Target.MaxTotalFiles, empty otherwise
+	BudgetExceeded string `json:"budgetExceeded,omitempty"`
+}
+
+// CleanupStats summarizes a removal of stale temporary files
+type CleanupStats struct {
+	// Files and Bytes count the removed files
+	Files int64
+	Bytes int64
+	// Resumable counts stale partial downloads kept for a later run to resume
+	Resumable int64
+}
+
+// TimeAuditStats summarizes a search for modification times in the future
+type TimeAuditStats struct {
+	// Files counts the files found beyond Settings.FutureTimeTolerance, and Clamped
+	// those whose time was set to the time of the audit with Settings.ClampFutureTimes
+	Files   int64
+	Clamped int64
+}
+
+// Kinds of problems reported by Verify
+const (
+	ProblemMissing   = mirror.ProblemMissing
+	ProblemCorrupted = mirror.ProblemCorrupted
+	ProblemExtra     = mirror.ProblemExtra
+	ProblemUpstream  = mirror.ProblemUpstream
+)
+
+// VerifyOptions configures Verify
+type VerifyOptions struct {
+	// Sample is the number of files whose upstream is checked with a HEAD request;
+	// 0 checks none
+	Sample int
+	// Repair downloads missing and corrupted files again, except for frozen targets
+	Repair bool
+}
+
+// VerifyProblem is a file that does not match what was mirrored
+type VerifyProblem struct {
+	Path string
+	// Kind is one of the Problem* constants
+	Kind     string
+	Detail   string
+	Repaired bool
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	Target string
+	// Files and Bytes count the recorded files that were checked, Hashed those
+	// whose SHA-256 was compared, and UpstreamChecked the sampled upstreams
+	Files           int64
+	Bytes           int64
+	Hashed          int64
+	UpstreamChecked int64
+	Problems        []VerifyProblem
+	// Resumed is set if the verification continued an interrupted one
+	Resumed  bool
+	Duration time.Duration
+}
+
+// Count returns the number of problems of kind, not counting repaired ones
+func (r VerifyReport) Count(kind string) int {
+	count := 0
+	for _, p := range r.Problems {
+		if p.Kind == kind && !p.Repaired {
+			count++
+		}
+	}
+	return count
+}
+
+// PurgeStats summarizes the files removed by Purge or Reset
+type PurgeStats struct {
+	Files int64
+	Bytes int64
+}
+
+// ExcludedDir is a subtree skipped by a Target.ExcludeDirs pattern
+type ExcludedDir struct {
+	// Path is relative to the target URL
+	Path    string `json:"path"`
+	Pattern string `json:"pattern"`
+	// Deleted is set if a local copy was removed
+	Deleted bool `json:"deleted"`
+	// Reported is set with Target.ReportFilters, where the directory was mirrored
+	// anyway; WouldDelete then tells that DeleteExcludedDirs would have removed a
+	// local copy
+	Reported    bool `json:"reported"`
+	WouldDelete bool `json:"wouldDelete"`
+}
+
+// ContentMismatch is a download whose content conflicts with its file extension
+type ContentMismatch struct {
+	// Path is relative to Target.Dir
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// Expected is the class of content the extension implies: "binary", "html" or "text"
+	Expected string `json:"expected"`
+	// ContentType is the Content-Type header and Sniffed the type detected from
+	// the first bytes
+	ContentType string `json:"contentType"`
+	Sniffed     string `json:"sniffed"`
+	// Quarantined is set if the download was kept out of the mirror
+	Quarantined bool `json:"quarantined"`
+}
+
+// Listing formats reported in ProbeResult.Format
+const (
+	FormatHTMLListing = mirror.FormatHTMLListing
+	FormatFile        = mirror.FormatFile
+	FormatUnknown     = mirror.FormatUnknown
+)
+
+// ProbeResult describes whether a target's root URL is reachable and parseable
+type ProbeResult struct {
+	Target       string
+	URL          string
+	Reachable    bool
+	StatusCode   int
+	ResponseTime time.Duration
+	Server       string
+	ContentType  string
+	// Format is how the root response would be mirrored; empty if unreachable
+	Format string
+	// Generator is the server software the root listing was attributed to
+	Generator string
+	// Links is the number of links found in the root listing
+	Links int
+	// ExcludedDirs are the directories of the root listing a run would skip
+	ExcludedDirs []ExcludedDir
+	// Err describes why the target is unreachable or its listing unparseable
+	Err string
+}
+
+// Mirrorer mirrors one target. It is safe to call Run repeatedly and concurrently;
+// concurrent runs of a directory are serialized by Settings.DuplicateRuns.
+type Mirrorer struct {
+	manager *mirror.Manager
+	usage   *mirror.UsageMeter
+	target  config.Target
+	dir     string
+	// tempMaxAge is the effective Settings.TempMaxAge; 0 if the cleanup is disabled
+	tempMaxAge time.Duration
+}
+
+// New validates opts and creates a Mirrorer
+func New(opts Options) (*Mirrorer, error) {
+	mirrorers, err := NewGroup(opts)
+	if err != nil {
+		return nil, err
+	}
+	return mirrorers[0], nil
+}
+
+// NewGroup creates one Mirrorer per Options. Mirrorers of a group coordinate their
+// request pacing for upstream hosts shared by several of their targets, even when
+// run concurrently.
+func NewGroup(opts ...Options) ([]*Mirrorer, error) {
+	if len(opts) == 0 {
+		return nil, errors.New("mirrorlib: no targets")
+	}
+
+	targets := make([]config.Target, len(opts))
+	var hosts []HostPolicy
+	for i := range opts {
+		if err := validate(opts[i]); err != nil {
+			return nil, err
+		}
+		targets[i] = configTarget(opts[i].Target)
+		hosts = append(hosts, opts[i].Settings.Hosts...)
+	}
+
+	// The shared coordinator only needs every target and host override of the group
+	shared := mirror.NewManager(&config.Config{
+		Targets: targets,
+		Mirror:  config.Mirror{Hosts: hostPolicies(hosts)},
+	}, discardLogger())
+
+	if n := opts[0].Settings.MaxOpenTransfers; n != 0 {
+		httpPkg.Transfers.SetLimit(n)
+	}
+
+	var usage *mirror.UsageMeter
+	if s := opts[0].Settings; s.UsageDir != "" {
+		usage = mirror.NewUsageMeter(s.UsageDir, httpPkg.ParseSize(s.MonthlyByteCap), s.CapResetDay)
+	}
+
+	mirrorers := make([]*Mirrorer, len(opts))
+	for i, o := range opts {
+		logger := o.Logger
+		if logger == nil {
+			logger = discardLogger()
+		}
+
+		managerOptions := []mirror.Option{mirror.ShareHostsWith(shared), mirror.WithUsageMeter(usage)}
+		if o.Events != nil {
+			managerOptions = append(managerOptions, mirror.WithEventSink(eventSink(o.Events)))
+		}
+		if o.Settings.DuplicateRuns != "" {
+			managerOptions = append(managerOptions, mirror.WithDuplicateRuns(o.Settings.DuplicateRuns))
+		}
+		if o.Settings.FullScan {
+			managerOptions = append(managerOptions, mirror.WithFullScan())
+		}
+		if o.Transport != nil {
+			managerOptions = append(managerOptions, mirror.WithClientOptions(httpPkg.WithTransport(o.Transport)))
+		}
+
+		cfg := &config.Config{
+			Targets: []config.Target{targets[i]},
+			Mirror:  mirrorSettings(o.Settings),
+		}
+
+		mirrorers[i] = &Mirrorer{
+			manager:    mirror.NewManager(cfg, logger, managerOptions...),
+			usage:      usage,
+			target:     targets[i],
+			dir:        o.Dir,
+			tempMaxAge: time.Duration(cfg.Mirror.TempMaxAge) * time.Second,
+		}
+	}
+
+	return mirrorers, nil
+}
+
+// Run mirrors the target once. Per-file failures are counted in Stats and reported
+// as events; the returned error is set when the run as a whole failed or ctx ended.
+func (m *Mirrorer) Run(ctx context.Context) (Stats, error) {
+	target := m.target
+	stats, err := m.manager.Run(ctx, &target, m.dir)
+	if stats == nil {
+		return Stats{Target: target.Name}, err
+	}
+
+	return runStats(stats), err
+}
+
+// Cleanup removes the temporary and partial download files of the target that are
+// older than Settings.TempMaxAge, or the default age if the automatic cleanup is
+// disabled. Partial downloads that may still be resumed are kept.
+func (m *Mirrorer) Cleanup(ctx context.Context) (CleanupStats, error) {
+	maxAge := m.tempMaxAge
+	if maxAge <= 0 {
+		maxAge = time.Duration(config.GetMirrorDefaults().TempMaxAge) * time.Second
+	}
+	target := m.target
+	stats, err := m.manager.CleanupTempFiles(ctx, &target, m.dir, maxAge)
+	return CleanupStats{Files: stats.Files, Bytes: stats.Bytes, Resumable: stats.Resumable}, err
+}
+
+// AuditTimes reports the files of the target whose modification time lies beyond
+// Settings.FutureTimeTolerance in the future, and clamps them with
+// Settings.ClampFutureTimes. Files of frozen targets are only reported.
+func (m *Mirrorer) AuditTimes(ctx context.Context) (TimeAuditStats, error) {
+	target := m.target
+	stats, err := m.manager.AuditTimes(ctx, &target, m.dir)
+	return TimeAuditStats{Files: stats.Files, Clamped: stats.Clamped}, err
+}
+
+// Verify checks the files below Dir against what the target recorded when it
+// mirrored them and reports missing, corrupted and unknown files, optionally
+// checking a sample of upstreams and downloading missing and corrupted files
+// again. An interrupted verification resumes where it stopped.
+func (m *Mirrorer) Verify(ctx context.Context, opts VerifyOptions) (VerifyReport, error) {
+	target := m.target
+	report, err := m.manager.Verify(ctx, &target, m.dir, mirror.VerifyOptions{Sample: opts.Sample, Repair: opts.Repair})
+	result := VerifyReport{
+		Target:          report.Target,
+		Files:           report.Files,
+		Bytes:           report.Bytes,
+		Hashed:          report.Hashed,
+		UpstreamChecked: report.UpstreamChecked,
+		Resumed:         report.Resumed,
+		Duration:        report.Duration,
+	}
+	for _, p := range report.Problems {
+		result.Problems = append(result.Problems, VerifyProblem{Path: p.Path, Kind: p.Kind, Detail: p.Detail, Repaired: p.Repaired})
+	}
+	return result, err
+}
+
+// Purge deletes Dir with all mirrored files and metadata of the target, and the
+// files it stored in a bucket. Dir must be the directory named after the target
+// directly below dataPath. Frozen targets and targets being synced are refused.
+func (m *Mirrorer) Purge(ctx context.Context, dataPath string) (PurgeStats, error) {
+	target := m.target
+	stats, err := m.manager.Purge(ctx, &target, dataPath, m.dir)
+	return PurgeStats{Files: stats.Files, Bytes: stats.Bytes}, err
+}
+
+// Reset deletes the metadata of the target but keeps its files, so that the next
+// run adopts them and checks every one against the upstream. The same checks as
+// for Purge apply.
+func (m *Mirrorer) Reset(ctx context.Context, dataPath string) (PurgeStats, error) {
+	target := m.target
+	stats, err := m.manager.Reset(ctx, &target, dataPath, m.dir)
+	return PurgeStats{Files: stats.Files, Bytes: stats.Bytes}, err
+}
+
+// Probe fetches and parses the root listing of the target without downloading
+// anything, using the same client and parser as Run
+func (m *Mirrorer) Probe(ctx context.Context) ProbeResult {
+	target := m.target
+	r := m.manager.Probe(ctx, &target)
+	return ProbeResult{
+		Target:       r.Target,
+		URL:          r.URL,
+		Reachable:    r.Reachable,
+		StatusCode:   r.StatusCode,
+		ResponseTime: r.ResponseTime,
+		Server:       r.Server,
+		ContentType:  r.ContentType,
+		Format:       r.Format,
+		Generator:    r.Generator,
+		Links:        r.Links,
+		ExcludedDirs: excludedDirs(r.ExcludedDirs),
+		Err:          r.Error,
+	}
+}
+
+// AdoptStats summarizes the adoption of files already present in the target directory
+type AdoptStats struct {
+	// Files and Bytes count the files recorded by this adoption
+	Files int64
+	Bytes int64
+	// Hashed counts files whose content hashes were computed
+	Hashed int64
+	// Known counts files recorded by an earlier, possibly interrupted, adoption
+	Known    int64
+	Duration time.Duration
+}
+
+// Adopt records files that are already in the target directory, e.g. from an
+// earlier rsync, so that Run checks them against upstream instead of downloading
+// them again. Run adopts automatically when it finds a non-empty directory that
+// was never mirrored; Adopt is needed only to compute hashes or to adopt ahead of
+// time. An interrupted adoption resumes when called again.
+func (m *Mirrorer) Adopt(ctx context.Context, hash bool) (AdoptStats, error) {
+	stats, err := m.manager.Adopt(ctx, m.target.Name, m.dir, hash)
+	if stats == nil {
+		return AdoptStats{}, err
+	}
+	return AdoptStats{
+		Files:    stats.Files,
+		Bytes:    stats.Bytes,
+		Hashed:   stats.Hashed,
+		Known:    stats.Known,
+		Duration: stats.Duration,
+	}, err
+}
+
+// Usage returns the transfer accounting of the group, or the zero Usage if
+// Settings.UsageDir is not set
+func (m *Mirrorer) Usage() (Usage, error) {
+	if m.usage == nil {
+		return Usage{}, nil
+	}
+	snapshot, err := m.usage.Snapshot()
+	if err != nil {
+		return Usage{}, err
+	}
+	return Usage{
+		PeriodStart:         snapshot.PeriodStart,
+		TrackingSince:       snapshot.TrackingSince,
+		PeriodBytes:         snapshot.PeriodBytes,
+		MonthlyByteCap:      m.usage.MonthlyCap(),
+		TotalBytes:          snapshot.TotalBytes,
+		PeriodBytesByTarget: snapshot.PeriodTargets,
+		TotalBytesByTarget:  snapshot.TotalTargets,
+	}, nil
+}
+
+// validate checks the required fields of opts
+func validate(opts Options) error {
+	if opts.Target.Name == "" {
+		return errors.New("mirrorlib: target name is required")
+	}
+	if err := config.ValidateURL(opts.Target.URL); err != nil {
+		return fmt.Errorf("mirrorlib: target %s: %w", opts.Target.Name, err)
+	}
+	if opts.Dir == "" {
+		return fmt.Errorf("mirrorlib: target %s: destination directory is required", opts.Target.Name)
+	}
+	switch opts.Settings.DuplicateRuns {
+	case "", DuplicateRunsQueue, DuplicateRunsReject:
+	default:
+		return fmt.Errorf("mirrorlib: target %s: unknown duplicate run policy %q", opts.Target.Name, opts.Settings.DuplicateRuns)
+	}
+	if err := config.ValidateFileSizes(config.Target{MinFileSize: opts.Target.MinFileSize, MaxFileSize: opts.Target.MaxFileSize}); err != nil {
+		return fmt.Errorf("mirrorlib: target %s: %w", opts.Target.Name, err)
+	}
+	if s3 := opts.Target.S3; s3 != nil {
+		if s3.Bucket == "" {
+			return fmt.Errorf("mirrorlib: target %s: s3 storage requires a bucket", opts.Target.Name)
+		}
+		if opts.Target.Dated != nil {
+			return fmt.Errorf("mirrorlib: target %s: s3 storage does not support the dated layout", opts.Target.Name)
+		}
+	}
+	return nil
+}
+
+// configTarget converts an API target into the engine's target with defaults applied
+func configTarget(t Target) config.Target {
+	defaults := config.GetDefaults()
+
+	target := config.Target{
+		Name:                    t.Name,
+		URL:                     t.URL,
+		UserAgent:               t.UserAgent,
+		RateLimit:               t.RateLimit,
+		Retries:                 t.Retries,
+		MaxDepth:                t.MaxDepth,
+		Timeout:                 ceilSeconds(t.Timeout),
+		WaitBetweenRequests:     ceilSeconds(t.WaitBetweenRequests),
+		Timestamping:            !t.DisableTimestamping,
+		NoClobber:               !t.DisableNoClobber,
+		ContinueDownload:        !t.DisableContinueDownload,
+		CheckChanges:            !t.AlwaysDownload,
+		ExcludeDirs:             t.ExcludeDirs,
+		Priority:                t.Priority,
+		ChurnSkipAfter:          t.ChurnSkipAfter,
+		ChurnRelistEvery:        t.ChurnRelistEvery,
+		FullScanEvery:           t.FullScanEvery,
+		ConditionalListings:     t.ConditionalListings,
+		ListingRefreshEvery:     t.ListingRefreshEvery,
+		AllowQueryStrings:       t.AllowQueryStrings,
+		ContentDispositionNames: t.ContentDispositionNames,
+		ListingFormat:           t.ListingFormat,
+		ParallelChunks:          t.ParallelChunks,
+		ParallelChunkMinSize:    t.ParallelChunkMinSize,
+		Concurrency:             t.Concurrency,
+		TransferWeight:          t.TransferWeight,
+		MaxTotalBytes:           t.MaxTotalBytes,
+		MaxTotalFiles:           t.MaxTotalFiles,
+		MinFileSize:             t.MinFileSize,
+		MaxFileSize:             t.MaxFileSize,
+		ContentTypeCheck:        t.ContentTypeCheck,
+		QuarantineMismatches:    t.QuarantineMismatches,
+		VerifyChecksums:         t.VerifyChecksums,
+		Hidden:                  t.Hidden,
+		MetadataIndex:           t.MetadataIndex,
+		RedirectAllowHosts:      t.RedirectAllowHosts,
+		Frozen:                  t.Frozen,
+		Prune:                   t.Prune,
+		PruneDryRun:             t.PruneDryRun,
+	}
+	if t.IgnoreSameHostURLs {
+		follow := false
+		target.FollowAbsoluteSameHost = &follow
+	}
+	if t.MTimeTolerance != 0 {
+		tolerance := max(ceilSeconds(t.MTimeTolerance), 0)
+		target.MTimeTolerance = &tolerance
+	}
+	if t.DenyCrossHostRedirects {
+		target.CrossHostRedirects = httpPkg.RedirectDeny
+	}
+	if t.DeleteExcludedDirs {
+		target.ExcludedDirPolicy = mirror.ExcludedDirDelete
+	}
+	if t.ReportFilters {
+		target.FilterMode = mirror.FilterReport
+	}
+	if t.S3 != nil {
+		target.Storage = config.StorageS3
+		target.S3 = &config.S3Storage{
+			Bucket:    t.S3.Bucket,
+			Prefix:    t.S3.Prefix,
+			Region:    t.S3.Region,
+			Endpoint:  t.S3.Endpoint,
+			PathStyle: t.S3.PathStyle,
+			PartSize:  t.S3.PartSize,
+		}
+	}
+	if t.FileEvents != nil {
+		target.FileEvents = &config.FileEvents{
+			WebhookURL:    t.FileEvents.WebhookURL,
+			File:          t.FileEvents.File,
+			BatchSize:     t.FileEvents.BatchSize,
+			FlushInterval: ceilSeconds(t.FileEvents.FlushInterval),
+			QueueSize:     t.FileEvents.QueueSize,
+		}
+	}
+	if t.Dated != nil {
+		target.Layout = mirror.LayoutImmutableDated
+		target.DatedFormat = t.Dated.Format
+		target.LinkUnchanged = t.Dated.LinkUnchanged
+		target.KeepDated = t.Dated.Keep
+	}
+
+	if target.UserAgent == "" {
+		target.UserAgent = defaults.UserAgent
+	}
+	if target.RateLimit == "" {
+		target.RateLimit = defaults.RateLimit
+	}
+	if target.Retries == 0 {
+		target.Retries = defaults.Retries
+	}
+	if target.MaxDepth == 0 {
+		target.MaxDepth = defaults.MaxDepth
+	}
+	if target.Timeout == 0 {
+		target.Timeout = defaults.Timeout
+	}
+	if target.WaitBetweenRequests == 0 {
+		target.WaitBetweenRequests = defaults.WaitBetweenRequests
+	}
+	if target.Concurrency == 0 {
+		target.Concurrency = defaults.Concurrency
+	}
+
+	return target
+}
+
+// TargetFromConfig converts a target of a configuration file, as loaded by
+// config.LoadConfig with its defaults applied, into an API target. It is the
+// inverse of the conversion Run applies, so that programs reading the CLI's
+// configuration mirror exactly like the updater. Server-only settings such as
+// Protected and PullThrough are dropped. Unlike the rest of this package, it
+// follows the fields of pkg/config without a compatibility guarantee.
+func TargetFromConfig(t config.Target) Target {
+	target := Target{
+		Name:                    t.Name,
+		URL:                     t.URL,
+		UserAgent:               t.UserAgent,
+		RateLimit:               t.RateLimit,
+		Retries:                 t.Retries,
+		MaxDepth:                t.MaxDepth,
+		Timeout:                 time.Duration(t.Timeout) * time.Second,
+		WaitBetweenRequests:     time.Duration(t.WaitBetweenRequests) * time.Second,
+		AlwaysDownload:          !t.CheckChanges,
+		DisableContinueDownload: !t.ContinueDownload,
+		DisableTimestamping:     !t.Timestamping,
+		DisableNoClobber:        !t.NoClobber,
+		ExcludeDirs:             t.ExcludeDirs,
+		DeleteExcludedDirs:      t.ExcludedDirPolicy == mirror.ExcludedDirDelete,
+		ReportFilters:           t.FilterMode == mirror.FilterReport,
+		Priority:                t.Priority,
+		ChurnSkipAfter:          t.ChurnSkipAfter,
+		ChurnRelistEvery:        t.ChurnRelistEvery,
+		FullScanEvery:           t.FullScanEvery,
+		ConditionalListings:     t.ConditionalListings,
+		ListingRefreshEvery:     t.ListingRefreshEvery,
+		AllowQueryStrings:       t.AllowQueryStrings,
+		ContentDispositionNames: t.ContentDispositionNames,
+		ListingFormat:           t.ListingFormat,
+		IgnoreSameHostURLs:      !t.FollowsAbsoluteSameHost(),
+		ParallelChunks:          t.ParallelChunks,
+		ParallelChunkMinSize:    t.ParallelChunkMinSize,
+		Concurrency:             t.Concurrency,
+		TransferWeight:          t.TransferWeight,
+		MaxTotalBytes:           t.MaxTotalBytes,
+		MaxTotalFiles:           t.MaxTotalFiles,
+		MinFileSize:             t.MinFileSize,
+		MaxFileSize:             t.MaxFileSize,
+		ContentTypeCheck:        t.ContentTypeCheck,
+		QuarantineMismatches:    t.QuarantineMismatches,
+		VerifyChecksums:         t.VerifyChecksums,
+		Hidden:                  t.Hidden,
+		MetadataIndex:           t.MetadataIndex,
+		DenyCrossHostRedirects:  t.CrossHostRedirects == httpPkg.RedirectDeny,
+		RedirectAllowHosts:      t.RedirectAllowHosts,
+		Frozen:                  t.Frozen,
+		Prune:                   t.Prune,
+		PruneDryRun:             t.PruneDryRun,
+	}
+	// A tolerance of 0 disables it in the configuration but selects the default here
+	if t.MTimeTolerance != nil {
+		target.MTimeTolerance = -1
+		if *t.MTimeTolerance != 0 {
+			target.MTimeTolerance = t.GetMTimeTolerance()
+		}
+	}
+	if t.Layout == mirror.LayoutImmutableDated {
+		target.Dated = &DatedLayout{Format: t.DatedFormat, LinkUnchanged: t.LinkUnchanged, Keep: t.KeepDated}
+	}
+	if t.Storage == config.StorageS3 && t.S3 != nil {
+		target.S3 = &S3Storage{
+			Bucket:    t.S3.Bucket,
+			Prefix:    t.S3.Prefix,
+			Region:    t.S3.Region,
+			Endpoint:  t.S3.Endpoint,
+			PathStyle: t.S3.PathStyle,
+			PartSize:  t.S3.PartSize,
+		}
+	}
+	if e := t.FileEvents; e != nil {
+		target.FileEvents = &FileEvents{
+			WebhookURL:    e.WebhookURL,
+			File:          e.File,
+			BatchSize:     e.BatchSize,
+			FlushInterval: time.Duration(e.FlushInterval) * time.Second,
+			QueueSize:     e.QueueSize,
+		}
+	}
+	return target
+}
+
+// mirrorSettings converts API settings into the engine's settings with defaults applied
+func mirrorSettings(s Settings) config.Mirror {
+	settings := config.GetMirrorDefaults()
+
+	if s.WriteBufferSize != "" {
+		settings.WriteBufferSize = s.WriteBufferSize
+	}
+	if s.SyncWrites != "" {
+		settings.SyncWrites = s.SyncWrites
+	}
+	if s.MaxListingBytes != "" {
+		settings.MaxResponseBytes = s.MaxListingBytes
+	}
+	if s.FilesystemCompat != "" {
+		settings.FilesystemCompat = s.FilesystemCompat
+	}
+	if s.LogThrottle.Disabled {
+		settings.LogThrottle.Enabled = false
+	}
+	if s.LogThrottle.Burst > 0 {
+		settings.LogThrottle.Burst = s.LogThrottle.Burst
+	}
+	if s.LogThrottle.SampleRate > 0 {
+		settings.LogThrottle.SampleRate = s.LogThrottle.SampleRate
+	}
+	if s.LogThrottle.SummaryInterval > 0 {
+		settings.LogThrottle.SummaryInterval = ceilSeconds(s.LogThrottle.SummaryInterval)
+	}
+	if s.EmptyListingAlertPercent != 0 {
+		settings.EmptyListingAlertPercent = s.EmptyListingAlertPercent
+	}
+	if s.MaxDirectories != 0 {
+		settings.MaxDirectories = max(s.MaxDirectories, 0)
+	}
+	if s.MaxEntriesPerDirectory != 0 {
+		settings.MaxEntriesPerDirectory = max(s.MaxEntriesPerDirectory, 0)
+	}
+	if s.MaxPathDepth != 0 {
+		settings.MaxPathDepth = max(s.MaxPathDepth, 0)
+	}
+	settings.VerifyRelinks = s.VerifyRelinks
+	if s.TempMaxAge != 0 {
+		settings.TempMaxAge = max(ceilSeconds(s.TempMaxAge), 0)
+	}
+	if s.ReportDetail != "" {
+		settings.ReportDetail = s.ReportDetail
+	}
+	if s.FutureTimeTolerance != 0 {
+		settings.FutureTimeTolerance = max(ceilSeconds(s.FutureTimeTolerance), 0)
+	}
+	settings.ClampFutureTimes = s.ClampFutureTimes
+	settings.Hosts = hostPolicies(s.Hosts)
+
+	return settings
+}
+
+// hostPolicies converts API host policies into the engine's host policies
+func hostPolicies(policies []HostPolicy) []config.HostPolicy {
+	var converted []config.HostPolicy
+	for _, p := range policies {
+		wait := ceilSeconds(p.WaitBetweenRequests)
+		if p.WaitBetweenRequests < 0 {
+			wait = -1
+		}
+		converted = append(converted, config.HostPolicy{
+			Host:                p.Host,
+			WaitBetweenRequests: wait,
+			MaxConcurrency:      p.MaxConcurrency,
+		})
+	}
+	return converted
+}
+
+// runStats converts the stats of a run of the engine into API stats
+func runStats(stats *mirror.MirrorStats) Stats {
+	return Stats{
+		Target:                 stats.Target,
+		RunID:                  stats.RunID,
+		StartTime:              stats.StartTime,
+		EndTime:                stats.EndTime,
+		Duration:               stats.Duration,
+		FilesDownloaded:        stats.FilesDownloaded,
+		FilesSkipped:           stats.FilesSkipped,
+		FilesSkippedSize:       stats.FilesSkippedSize,
+		SkipReasons:            stats.SkipReasons,
+		BytesDownloaded:        stats.BytesDownloaded,
+		BytesResumed:           stats.BytesResumed,
+		NewestRemoteModTime:    stats.NewestRemoteModTime,
+		CaseCollisions:         stats.CaseCollisions,
+		Errors:                 stats.Errors,
+		ErrorsByClass:          stats.ErrorsByClass,
+		FailureSignatures:      stats.FailureSignatures,
+		ListingsByFormat:       stats.ListingsByFormat,
+		EmptyListings:          stats.EmptyListings,
+		UnrecognizedListings:   stats.UnrecognizedListings,
+		LimitsReached:          stats.LimitsReached,
+		FilesRelinked:          stats.FilesRelinked,
+		BytesSavedByRelink:     stats.BytesSavedByRelink,
+		DirectoriesSkipped:     stats.DirectoriesSkipped,
+		ExcludedDirs:           excludedDirs(stats.ExcludedDirs),
+		DirectoriesReported:    stats.DirectoriesReported,
+		FilesReported:          stats.FilesReported,
+		ContentTypeMismatches:  stats.ContentTypeMismatches,
+		ContentMismatches:      contentMismatches(stats.ContentMismatches),
+		ListingsAvoided:        stats.ListingsAvoided,
+		FilesCheckedByListing:  stats.FilesCheckedByListing,
+		ListingsSkippedByChurn: stats.ListingsSkippedByChurn,
+		ListingsNotModified:    stats.ListingsNotModified,
+		DuplicateLinks:         stats.DuplicateLinks,
+		NameConflicts:          stats.NameConflicts,
+		FilesNamedByHeader:     stats.FilesNamedByHeader,
+		FilesVerified:          stats.FilesVerified,
+		ChecksumMismatches:     stats.ChecksumMismatches,
+		FileEventsSent:         stats.FileEventsSent,
+		FileEventsDropped:      stats.FileEventsDropped,
+		RevisitedURLs:          stats.RevisitedURLs,
+		SkewTolerated:          stats.SkewTolerated,
+		ReclaimedBytes:         stats.ReclaimedBytes,
+		FutureModTimes:         stats.FutureModTimes,
+		FilesDeleted:           stats.FilesDeleted,
+		DirectoriesDeleted:     stats.DirectoriesDeleted,
+		Retries:                stats.Retries,
+		ListingRetries:         stats.ListingRetries,
+		UnavailableListings:    stats.UnavailableListings,
+		RedirectHosts:          stats.RedirectHosts,
+		BlockedRedirects:       stats.BlockedRedirects,
+		TransfersQueued:        stats.TransfersQueued,
+		PeakOpenTransfers:      stats.PeakOpenTransfers,
+		BytesPerSecond:         stats.BytesPerSecond,
+		BudgetExceeded:         stats.BudgetExceeded,
+	}
+}
+
+// excludedDirs converts skipped subtrees into their API form
+func excludedDirs(dirs []mirror.ExcludedDir) []ExcludedDir {
+	var converted []ExcludedDir
+	for _, d := range dirs {
+		converted = append(converted, ExcludedDir{Path: d.Path, Pattern: d.Pattern, Deleted: d.Deleted, Reported: d.Reported, WouldDelete: d.WouldDelete})
+	}
+	return converted
+}
+
+// contentMismatches converts flagged downloads into their API form
+func contentMismatches(mismatches []mirror.ContentMismatch) []ContentMismatch {
+	var converted []ContentMismatch
+	for _, c := range mismatches {
+		converted = append(converted, ContentMismatch{Path: c.Path, URL: c.URL, Expected: c.Expected,
+			ContentType: c.ContentType, Sniffed: c.Sniffed, Quarantined: c.Quarantined})
+	}
+	return converted
+}
+
+// eventSink adapts an API event callback to the engine's event sink
+func eventSink(fn func(Event)) mirror.EventSink {
+	return func(e mirror.Event) {
+		fn(Event{
+			Type:     EventType(e.Type),
+			Time:     e.Time,
+			Target:   e.Target,
+			URL:      e.URL,
+			Path:     e.Path,
+			Bytes:    e.Bytes,
+			Err:      e.Err,
+			Progress: e.Progress,
+		})
+	}
+}
+
+// ceilSeconds converts a duration to whole seconds, rounding up
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// discardLogger returns a logger that drops all records
+func discardLogger() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
@@ -0,0 +1,331 @@
+package mirrorlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+	"github.com/jhofer-cloud/http-mirror/pkg/mirror"
+)
+
+func TestNewValidatesOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"missing name", Options{Target: Target{URL: "http://example.com/"}, Dir: "/tmp/x"}},
+		{"bad scheme", Options{Target: Target{Name: "a", URL: "ftp://example.com/"}, Dir: "/tmp/x"}},
+		{"missing host", Options{Target: Target{Name: "a", URL: "http:///pub/"}, Dir: "/tmp/x"}},
+		{"missing dir", Options{Target: Target{Name: "a", URL: "http://example.com/"}}},
+		{"s3 without bucket", Options{Target: Target{Name: "a", URL: "http://example.com/", S3: &S3Storage{}}, Dir: "/tmp/x"}},
+		{"invalid file size", Options{Target: Target{Name: "a", URL: "http://example.com/", MaxFileSize: "100mb"}, Dir: "/tmp/x"}},
+		{"empty file size range", Options{Target: Target{Name: "a", URL: "http://example.com/", MinFileSize: "2g", MaxFileSize: "1g"}, Dir: "/tmp/x"}},
+		{"s3 with dated layout", Options{Target: Target{Name: "a", URL: "http://example.com/", S3: &S3Storage{Bucket: "b"}, Dated: &DatedLayout{}}, Dir: "/tmp/x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.opts); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+
+	if _, err := NewGroup(); err == nil {
+		t.Error("Expected error for an empty group")
+	}
+}
+
+func TestConfigTargetDefaults(t *testing.T) {
+	target := configTarget(Target{
+		Name:                "a",
+		URL:                 "http://example.com/",
+		WaitBetweenRequests: 1500 * time.Millisecond,
+		AlwaysDownload:      true,
+	})
+
+	if target.WaitBetweenRequests != 2 {
+		t.Errorf("Expected wait rounded up to 2s, got %d", target.WaitBetweenRequests)
+	}
+	if target.Timeout != 30 || target.MaxDepth != 5 || target.RateLimit != "500k" || target.UserAgent == "" {
+		t.Errorf("Expected CLI defaults to be applied, got %+v", target)
+	}
+	if target.CheckChanges {
+		t.Error("AlwaysDownload should disable change checks")
+	}
+	if target.Layout != "" {
+		t.Errorf("Expected the in-place layout by default, got %q", target.Layout)
+	}
+
+	redirects := configTarget(Target{Name: "c", URL: "http://example.com/", DenyCrossHostRedirects: true, RedirectAllowHosts: []string{"cdn.example.net"}})
+	if redirects.CrossHostRedirects != "deny" || len(redirects.RedirectAllowHosts) != 1 {
+		t.Errorf("Expected cross-host redirects to be denied, got %+v", redirects)
+	}
+	dated := configTarget(Target{Name: "b", URL: "http://example.com/", Dated: &DatedLayout{Format: "%Y%m%d", Keep: 3}})
+	if dated.Layout != "immutable-dated" || dated.DatedFormat != "%Y%m%d" || dated.KeepDated != 3 || dated.LinkUnchanged {
+		t.Errorf("Expected the dated layout to be carried over, got %+v", dated)
+	}
+	if target.Storage != "" || target.S3 != nil {
+		t.Errorf("Expected local storage by default, got %q", target.Storage)
+	}
+	bucket := configTarget(Target{Name: "d", URL: "http://example.com/", S3: &S3Storage{Bucket: "mirror", Prefix: "d/", PathStyle: true}})
+	if bucket.Storage != "s3" || bucket.S3 == nil || bucket.S3.Bucket != "mirror" || bucket.S3.Prefix != "d/" || !bucket.S3.PathStyle {
+		t.Errorf("Expected the bucket to be carried over, got %q %+v", bucket.Storage, bucket.S3)
+	}
+	if target.FilterMode != "" {
+		t.Errorf("Expected filters to be enforced by default, got %q", target.FilterMode)
+	}
+	report := configTarget(Target{Name: "e", URL: "http://example.com/", ExcludeDirs: []string{"old"}, ReportFilters: true, Priority: []string{"Release"}})
+	if report.FilterMode != "report" {
+		t.Errorf("Expected filters in report mode, got %q", report.FilterMode)
+	}
+	if len(report.Priority) != 1 || report.Priority[0] != "Release" {
+		t.Errorf("Expected the priority patterns to be carried over, got %v", report.Priority)
+	}
+	churn := configTarget(Target{Name: "g", URL: "http://example.com/", ChurnSkipAfter: 3, ChurnRelistEvery: 4, FullScanEvery: 12})
+	if churn.ChurnSkipAfter != 3 || churn.ChurnRelistEvery != 4 || churn.FullScanEvery != 12 {
+		t.Errorf("Expected the churn settings to be carried over, got %+v", churn)
+	}
+	conditional := configTarget(Target{Name: "i", URL: "http://example.com/", ConditionalListings: true, ListingRefreshEvery: 7})
+	if !conditional.ConditionalListings || conditional.ListingRefreshEvery != 7 {
+		t.Errorf("Expected the listing validator settings to be carried over, got %+v", conditional)
+	}
+	chunked := configTarget(Target{Name: "h", URL: "http://example.com/", ParallelChunks: 4, ParallelChunkMinSize: "1g"})
+	if chunked.ParallelChunks != 4 || chunked.ParallelChunkMinSize != "1g" {
+		t.Errorf("Expected the chunk settings to be carried over, got %+v", chunked)
+	}
+	if concurrent := configTarget(Target{Name: "j", URL: "http://example.com/", Concurrency: 8, TransferWeight: 3}); concurrent.Concurrency != 8 || concurrent.TransferWeight != 3 {
+		t.Errorf("Expected the concurrency and transfer weight to be carried over, got %d and %d", concurrent.Concurrency, concurrent.TransferWeight)
+	}
+	if budget := configTarget(Target{Name: "k", URL: "http://example.com/", MaxTotalBytes: "20g", MaxTotalFiles: 100}); budget.MaxTotalBytes != "20g" || budget.MaxTotalFiles != 100 {
+		t.Errorf("Expected the run budget to be carried over, got %q and %d", budget.MaxTotalBytes, budget.MaxTotalFiles)
+	}
+	if sizes := configTarget(Target{Name: "k", URL: "http://example.com/", MinFileSize: "1k", MaxFileSize: "4g"}); sizes.MinFileSize != "1k" || sizes.MaxFileSize != "4g" {
+		t.Errorf("Expected the file size range to be carried over, got %q and %q", sizes.MinFileSize, sizes.MaxFileSize)
+	}
+	if resume := configTarget(Target{Name: "l", URL: "http://example.com/"}); !resume.ContinueDownload || !resume.Timestamping || !resume.NoClobber {
+		t.Errorf("Expected the wget-style settings on by default, got %+v", resume)
+	}
+	if noResume := configTarget(Target{Name: "l", URL: "http://example.com/", DisableContinueDownload: true}); noResume.ContinueDownload {
+		t.Error("Expected DisableContinueDownload to turn off resuming")
+	}
+	if chunked.Concurrency != 1 {
+		t.Errorf("Expected a default concurrency of 1, got %d", chunked.Concurrency)
+	}
+	if target.MTimeTolerance != nil {
+		t.Errorf("Expected the default modification time tolerance, got %d", *target.MTimeTolerance)
+	}
+	exact := configTarget(Target{Name: "k", URL: "http://example.com/", MTimeTolerance: -1})
+	skewed := configTarget(Target{Name: "l", URL: "http://example.com/", MTimeTolerance: 4500 * time.Millisecond})
+	if exact.GetMTimeTolerance() != 0 || skewed.GetMTimeTolerance() != 5*time.Second {
+		t.Errorf("Expected tolerances of 0 and 5s, got %v and %v", exact.GetMTimeTolerance(), skewed.GetMTimeTolerance())
+	}
+	checked := configTarget(Target{Name: "f", URL: "http://example.com/", ContentTypeCheck: "all", QuarantineMismatches: true})
+	if checked.ContentTypeCheck != "all" || !checked.QuarantineMismatches {
+		t.Errorf("Expected the content type check to be carried over, got %q %v", checked.ContentTypeCheck, checked.QuarantineMismatches)
+	}
+}
+
+func TestTargetFromConfigMapsEveryField(t *testing.T) {
+	// Settings of the server have no meaning for the engine
+	serverOnly := map[string]bool{"Protected": true, "PullThrough": true}
+
+	var target config.Target
+	fillFields(reflect.ValueOf(&target).Elem())
+	follow := false
+	target.FollowAbsoluteSameHost = &follow
+	target.ExcludedDirPolicy = mirror.ExcludedDirDelete
+	target.FilterMode = mirror.FilterReport
+	target.Layout = mirror.LayoutImmutableDated
+	target.CrossHostRedirects = "deny"
+	target.Storage = config.StorageS3
+
+	// A field added to config.Target fails here until both conversions carry it
+	got := configTarget(TargetFromConfig(target))
+	want, converted := reflect.ValueOf(target), reflect.ValueOf(got)
+	for i := range want.NumField() {
+		name := want.Type().Field(i).Name
+		if !serverOnly[name] && !reflect.DeepEqual(want.Field(i).Interface(), converted.Field(i).Interface()) {
+			t.Errorf("config.Target.%s is not carried through mirrorlib.Target: set %v, got %v",
+				name, want.Field(i).Interface(), converted.Field(i).Interface())
+		}
+	}
+
+	for _, tolerance := range []int{0, 5} {
+		target.MTimeTolerance = &tolerance
+		if got := configTarget(TargetFromConfig(target)); *got.MTimeTolerance != tolerance {
+			t.Errorf("Expected an mtime tolerance of %d to be kept, got %d", tolerance, *got.MTimeTolerance)
+		}
+	}
+}
+
+func TestRunStatsMapsEveryField(t *testing.T) {
+	var stats mirror.MirrorStats
+	fillFields(reflect.ValueOf(&stats).Elem())
+
+	// A counter added to mirror.MirrorStats fails here until Stats reports it
+	got := reflect.ValueOf(runStats(&stats))
+	engine := reflect.ValueOf(&stats).Elem()
+	for i := range engine.NumField() {
+		field := engine.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		reported := got.FieldByName(field.Name)
+		switch {
+		case !reported.IsValid():
+			t.Errorf("mirror.MirrorStats.%s is missing from Stats", field.Name)
+		case reported.Type() == field.Type && !reflect.DeepEqual(reported.Interface(), engine.Field(i).Interface()),
+			reported.Type() != field.Type && reported.Len() != engine.Field(i).Len():
+			t.Errorf("mirror.MirrorStats.%s is not carried into Stats: set %v, got %v",
+				field.Name, engine.Field(i).Interface(), reported.Interface())
+		}
+	}
+}
+
+// fillFields sets every exported field of the struct v, recursively, to a value
+// other than its zero value
+func fillFields(v reflect.Value) {
+	for i := range v.NumField() {
+		field, name := v.Field(i), v.Type().Field(i).Name
+		if v.Type().Field(i).IsExported() {
+			fillValue(field, name, i+1)
+		}
+	}
+}
+
+// fillValue sets v to a value other than its zero value derived from name and n
+func fillValue(v reflect.Value, name string, n int) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("value of " + name)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem(), name, n)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0), name, n)
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key, value := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fillValue(key, name, n)
+		fillValue(value, name, n)
+		v.SetMapIndex(key, value)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Unix(int64(n), 0).UTC()))
+			return
+		}
+		fillFields(v)
+	}
+}
+
+// recordingTransport records request paths before delegating to http.DefaultTransport
+type recordingTransport struct {
+	paths []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.paths = append(t.paths, req.URL.Path)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRunUsesTransportAndDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<a href="a.txt">a.txt</a><a href=".hidden">.hidden</a>`))
+			return
+		}
+		w.Write([]byte("a"))
+	}))
+	defer server.Close()
+
+	transport := &recordingTransport{}
+	dir := filepath.Join(t.TempDir(), "dest")
+
+	m, err := New(Options{
+		Target:    Target{Name: "t", URL: server.URL + "/", AlwaysDownload: true},
+		Dir:       dir,
+		Transport: transport,
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	stats, err := m.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if stats.Target != "t" || stats.FilesDownloaded != 1 || stats.SkipReasons["excluded"] != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Errorf("Expected file directly below Dir: %v", err)
+	}
+	if len(transport.paths) == 0 {
+		t.Error("Expected requests to go through the custom transport")
+	}
+}
+
+func TestRunHonorsCancellation(t *testing.T) {
+	m, err := New(Options{
+		Target: Target{Name: "t", URL: "http://127.0.0.1:1/"},
+		Dir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := m.Run(ctx); err == nil {
+		t.Error("Expected an error for a cancelled context")
+	}
+}
+
+func TestPurgeAndReset(t *testing.T) {
+	dataPath := t.TempDir()
+	dir := filepath.Join(dataPath, "t")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("data"), 0644)
+	os.WriteFile(filepath.Join(dir, mirror.StateFileName), []byte("{}"), 0644)
+
+	m, err := New(Options{Target: Target{Name: "t", URL: "http://example.com/"}, Dir: dir})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	stats, err := m.Reset(context.Background(), dataPath)
+	if err != nil || stats.Files != 1 {
+		t.Fatalf("Expected the state file to be reset, got %+v, %v", stats, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err != nil {
+		t.Errorf("Expected reset to keep files: %v", err)
+	}
+
+	if _, err := m.Purge(context.Background(), filepath.Join(dataPath, "other")); err == nil {
+		t.Error("Expected purge to refuse a Dir outside the data path")
+	}
+	stats, err = m.Purge(context.Background(), dataPath)
+	if err != nil || stats.Files != 1 || stats.Bytes != 4 {
+		t.Fatalf("Expected one file of 4 bytes purged, got %+v, %v", stats, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected Dir to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package stats
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NoExtension is the extension key of files without an extension
+const NoExtension = "(none)"
+
+// SizeBucketBounds are the upper bounds in bytes of the size buckets; a final
+// bucket holds everything larger
+var SizeBucketBounds = []int64{
+	4 << 10,   // 4 KiB
+	1 << 20,   // 1 MiB
+	16 << 20,  // 16 MiB
+	256 << 20, // 256 MiB
+	1 << 30,   // 1 GiB
+	4 << 30,   // 4 GiB
+}
+
+// SizeBucketLabels name the size buckets by their upper bound
+var SizeBucketLabels = []string{"4KiB", "1MiB", "16MiB", "256MiB", "1GiB", "4GiB", "+Inf"}
+
+// Usage counts files and their total size
+type Usage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Breakdown splits the files of a tree by extension and by size
+type Breakdown struct {
+	// Extensions is keyed by lower-cased extension including the dot, e.g. ".iso"
+	// or ".tar.gz", and NoExtension
+	Extensions map[string]Usage `json:"extensions"`
+	// Sizes holds one entry per SizeBucketBounds plus one for larger files
+	Sizes []Usage `json:"sizes"`
+}
+
+// ExtensionUsage is the usage of one extension
+type ExtensionUsage struct {
+	Extension string `json:"extension"`
+	Usage
+}
+
+// newBreakdown creates an empty breakdown
+func newBreakdown() *Breakdown {
+	return &Breakdown{
+		Extensions: make(map[string]Usage),
+		Sizes:      make([]Usage, len(SizeBucketBounds)+1),
+	}
+}
+
+// count adds a file to the breakdown
+func (b *Breakdown) count(name string, size int64) {
+	ext := Extension(name)
+	usage := b.Extensions[ext]
+	usage.Files++
+	usage.Bytes += size
+	b.Extensions[ext] = usage
+
+	bucket := sort.Search(len(SizeBucketBounds), func(i int) bool { return size <= SizeBucketBounds[i] })
+	b.Sizes[bucket].Files++
+	b.Sizes[bucket].Bytes += size
+}
+
+// add merges other into b
+func (b *Breakdown) add(other *Breakdown) {
+	for ext, usage := range other.Extensions {
+		total := b.Extensions[ext]
+		total.Files += usage.Files
+		total.Bytes += usage.Bytes
+		b.Extensions[ext] = total
+	}
+	for i, usage := range other.Sizes {
+		b.Sizes[i].Files += usage.Files
+		b.Sizes[i].Bytes += usage.Bytes
+	}
+}
+
+// TopExtensions returns the n extensions using the most bytes, largest first.
+// Ties are ordered by name.
+func (b *Breakdown) TopExtensions(n int) []ExtensionUsage {
+	top := make([]ExtensionUsage, 0, len(b.Extensions))
+	for ext, usage := range b.Extensions {
+		top = append(top, ExtensionUsage{Extension: ext, Usage: usage})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Bytes != top[j].Bytes {
+			return top[i].Bytes > top[j].Bytes
+		}
+		return top[i].Extension < top[j].Extension
+	})
+	if n >= 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// compressedTarSuffixes are the compression extensions reported together with a
+// preceding ".tar"
+var compressedTarSuffixes = map[string]bool{".gz": true, ".bz2": true, ".xz": true, ".zst": true}
+
+// Extension returns the lower-cased extension of a file name as used in
+// breakdowns, keeping compressed tarballs together (".tar.gz")
+func Extension(name string) string {
+	name = strings.ToLower(name)
+	ext := filepath.Ext(name)
+	if ext == "" || ext == name {
+		return NoExtension
+	}
+	if compressedTarSuffixes[ext] && strings.HasSuffix(strings.TrimSuffix(name, ext), ".tar") {
+		return ".tar" + ext
+	}
+	return ext
+}
@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtension(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"debian.ISO", ".iso"},
+		{"linux-6.1.tar.xz", ".tar.xz"},
+		{"archive.tar.gz", ".tar.gz"},
+		{"notes.gz", ".gz"},
+		{"tar.gz", ".gz"},
+		{"README", NoExtension},
+		{".hidden", NoExtension},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Extension(tt.name); got != tt.want {
+				t.Errorf("Extension(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDirStatsWithBreakdown(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]int{
+		"a.iso":           5 << 20,
+		"sub/b.iso":       100,
+		"sub/c.tar.gz":    4 << 10,
+		"sub/deep/README": 4<<10 + 1,
+	}
+	for name, size := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plain, err := GetDirStats(context.Background(), root)
+	if err != nil {
+		t.Fatalf("GetDirStats failed: %v", err)
+	}
+	if plain.Breakdown != nil {
+		t.Errorf("Expected no breakdown unless requested, got %+v", plain.Breakdown)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		stats, err := GetDirStats(context.Background(), root, WithConcurrency(concurrency), WithBreakdown())
+		if err != nil {
+			t.Fatalf("GetDirStats failed: %v", err)
+		}
+		b := stats.Breakdown
+		if b == nil {
+			t.Fatal("Expected a breakdown")
+		}
+		if iso := b.Extensions[".iso"]; iso.Files != 2 || iso.Bytes != 5<<20+100 {
+			t.Errorf("Expected 2 .iso files, got %+v", iso)
+		}
+		if tgz := b.Extensions[".tar.gz"]; tgz.Files != 1 {
+			t.Errorf("Expected 1 .tar.gz file, got %+v", tgz)
+		}
+		if none := b.Extensions[NoExtension]; none.Files != 1 {
+			t.Errorf("Expected 1 file without extension, got %+v", none)
+		}
+
+		// 100 B and exactly 4 KiB share the first bucket, 4 KiB + 1 and 5 MiB go up
+		wantSizes := []int64{2, 1, 1, 0, 0, 0, 0}
+		for i, want := range wantSizes {
+			if b.Sizes[i].Files != want {
+				t.Errorf("Bucket %s: expected %d files, got %d", SizeBucketLabels[i], want, b.Sizes[i].Files)
+			}
+		}
+	}
+}
+
+func TestTopExtensions(t *testing.T) {
+	b := newBreakdown()
+	b.count("a.iso", 300)
+	b.count("b.rpm", 100)
+	b.count("c.deb", 100)
+	b.count("d.zip", 50)
+
+	top := b.TopExtensions(3)
+	want := []string{".iso", ".deb", ".rpm"}
+	if len(top) != len(want) {
+		t.Fatalf("Expected %d extensions, got %+v", len(want), top)
+	}
+	for i, ext := range want {
+		if top[i].Extension != ext {
+			t.Errorf("Position %d: expected %s, got %s", i, ext, top[i].Extension)
+		}
+	}
+	if all := b.TopExtensions(-1); len(all) != 4 {
+		t.Errorf("Expected all 4 extensions for a negative n, got %d", len(all))
+	}
+}
@@ -0,0 +1,179 @@
+// Package stats computes size statistics of mirrored directory trees
+package stats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DirStats summarizes a directory tree
+type DirStats struct {
+	// Files counts everything that is not a directory, including symlinks
+	Files int64 `json:"files"`
+	// Dirs counts directories including the root
+	Dirs  int64 `json:"directories"`
+	Bytes int64 `json:"bytes"`
+	// NewestMTime is the latest modification time of any file or directory
+	NewestMTime time.Time `json:"newestMTime"`
+	// Breakdown splits the files by extension and size; only set WithBreakdown
+	Breakdown *Breakdown `json:"-"`
+}
+
+// add merges other into s
+func (s *DirStats) add(other DirStats) {
+	s.Files += other.Files
+	s.Dirs += other.Dirs
+	s.Bytes += other.Bytes
+	if other.NewestMTime.After(s.NewestMTime) {
+		s.NewestMTime = other.NewestMTime
+	}
+	if other.Breakdown != nil {
+		if s.Breakdown == nil {
+			s.Breakdown = newBreakdown()
+		}
+		s.Breakdown.add(other.Breakdown)
+	}
+}
+
+// Option configures GetDirStats
+type Option func(*walker)
+
+// WithConcurrency reads up to n directories in parallel. The default of 1 walks
+// sequentially.
+func WithConcurrency(n int) Option {
+	return func(w *walker) {
+		w.concurrency = max(n, 1)
+	}
+}
+
+// WithBreakdown additionally splits the files by extension and size in the same walk
+func WithBreakdown() Option {
+	return func(w *walker) {
+		w.breakdown = true
+	}
+}
+
+// GetDirStats walks the tree below dir without following symlinks. The walk stops
+// at the first error or when ctx is done.
+func GetDirStats(ctx context.Context, dir string, opts ...Option) (DirStats, error) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return DirStats{}, fmt.Errorf("directory does not exist: %s", dir)
+	}
+	if err != nil {
+		return DirStats{}, err
+	}
+	if !info.IsDir() {
+		return DirStats{}, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &walker{ctx: ctx, cancel: cancel, concurrency: 1}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.slots = make(chan struct{}, w.concurrency-1)
+
+	result := w.newStats()
+	result.Dirs = 1
+	result.NewestMTime = info.ModTime()
+	w.walk(dir, &result)
+	w.wg.Wait()
+
+	if w.err != nil {
+		return DirStats{}, w.err
+	}
+	w.mu.Lock()
+	result.add(w.total)
+	w.mu.Unlock()
+	return result, nil
+}
+
+// newStats returns empty statistics to collect a (partial) walk in
+func (w *walker) newStats() DirStats {
+	if w.breakdown {
+		return DirStats{Breakdown: newBreakdown()}
+	}
+	return DirStats{}
+}
+
+// walker walks a tree, handing subdirectories to extra goroutines while slots
+// are free and walking them inline otherwise
+type walker struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	concurrency int
+	breakdown   bool
+	slots       chan struct{}
+	wg          sync.WaitGroup
+
+	mu    sync.Mutex
+	total DirStats
+	err   error
+}
+
+// walk adds the entries of dir and its subdirectories to stats
+func (w *walker) walk(dir string, stats *DirStats) {
+	if err := w.ctx.Err(); err != nil {
+		w.fail(err)
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			w.fail(err)
+			return
+		}
+		if info.ModTime().After(stats.NewestMTime) {
+			stats.NewestMTime = info.ModTime()
+		}
+		if !entry.IsDir() {
+			stats.Files++
+			stats.Bytes += info.Size()
+			if stats.Breakdown != nil {
+				stats.Breakdown.count(entry.Name(), info.Size())
+			}
+			continue
+		}
+
+		stats.Dirs++
+		path := filepath.Join(dir, entry.Name())
+		select {
+		case w.slots <- struct{}{}:
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				defer func() { <-w.slots }()
+				sub := w.newStats()
+				w.walk(path, &sub)
+				w.mu.Lock()
+				w.total.add(sub)
+				w.mu.Unlock()
+			}()
+		default:
+			w.walk(path, stats)
+		}
+	}
+}
+
+// fail records the first error and stops the walk
+func (w *walker) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		w.cancel()
+	}
+}
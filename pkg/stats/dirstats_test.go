@@ -0,0 +1,101 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateTree creates width directories per level down to depth, each holding
+// files files of 10 bytes, and returns the expected statistics
+func generateTree(tb testing.TB, root string, depth, width, files int) DirStats {
+	tb.Helper()
+	expected := DirStats{Dirs: 1}
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		for i := range files {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), []byte("0123456789"), 0644); err != nil {
+				tb.Fatal(err)
+			}
+			expected.Files++
+			expected.Bytes += 10
+		}
+		if level == depth {
+			return
+		}
+		for i := range width {
+			sub := filepath.Join(dir, fmt.Sprintf("d%d", i))
+			if err := os.Mkdir(sub, 0755); err != nil {
+				tb.Fatal(err)
+			}
+			expected.Dirs++
+			fill(sub, level+1)
+		}
+	}
+	fill(root, 0)
+	return expected
+}
+
+func TestGetDirStats(t *testing.T) {
+	root := t.TempDir()
+	expected := generateTree(t, root, 3, 3, 2)
+
+	newest := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(root, "d1", "d2", "f0"), newest, newest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{0, 1, 4, 64} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			stats, err := GetDirStats(context.Background(), root, WithConcurrency(concurrency))
+			if err != nil {
+				t.Fatalf("GetDirStats failed: %v", err)
+			}
+			if stats.Files != expected.Files || stats.Dirs != expected.Dirs || stats.Bytes != expected.Bytes {
+				t.Errorf("Expected %+v, got %+v", expected, stats)
+			}
+			if !stats.NewestMTime.Equal(newest) {
+				t.Errorf("Expected newest mtime %v, got %v", newest, stats.NewestMTime)
+			}
+		})
+	}
+}
+
+func TestGetDirStatsErrors(t *testing.T) {
+	if _, err := GetDirStats(context.Background(), "/nonexistent/directory"); err == nil {
+		t.Error("Expected error for non-existent directory")
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if _, err := GetDirStats(context.Background(), file); err == nil {
+		t.Error("Expected error for a file")
+	}
+
+	root := t.TempDir()
+	generateTree(t, root, 2, 2, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := GetDirStats(ctx, root, WithConcurrency(4)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancellation error, got %v", err)
+	}
+}
+
+func BenchmarkGetDirStats(b *testing.B) {
+	root := b.TempDir()
+	generateTree(b, root, 4, 5, 10)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := GetDirStats(context.Background(), root, WithConcurrency(concurrency)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
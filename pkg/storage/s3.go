@@ -0,0 +1,547 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultS3PartSize is the size of multipart upload parts if none is configured
+	DefaultS3PartSize = 16 * 1024 * 1024
+	// MinS3PartSize is the smallest part S3 accepts for all but the last part
+	MinS3PartSize = 5 * 1024 * 1024
+	// defaultS3Region is used when no region is configured
+	defaultS3Region = "us-east-1"
+)
+
+// S3 metadata keys storing the upstream modification time and entity tag
+const (
+	s3MetaModTime = "X-Amz-Meta-Mtime"
+	s3MetaETag    = "X-Amz-Meta-Upstream-Etag"
+)
+
+// S3Options configures an S3 storage
+type S3Options struct {
+	Bucket string
+	// Prefix is prepended to the key of every file, e.g. the target name
+	Prefix string
+	Region string
+	// Endpoint overrides the AWS endpoint, e.g. for S3-compatible stores
+	Endpoint string
+	// PathStyle addresses the bucket in the path instead of the host name
+	PathStyle bool
+	// PartSize is the size of multipart upload parts; files smaller than a part
+	// are uploaded with a single request
+	PartSize        int64
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client sends the requests; http.DefaultClient if nil
+	Client *http.Client
+}
+
+// S3 stores files as objects of an S3 bucket. Directories are key prefixes, so
+// MkdirAll does nothing. Modification times and upstream ETags are kept as object
+// metadata.
+type S3 struct {
+	root     string
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+	// now returns the signing time
+	now func() time.Time
+}
+
+// NewS3 creates an S3 storage for the files below the local path root
+func NewS3(root string, opts S3Options) (*S3, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage: missing bucket")
+	}
+	if opts.Region == "" {
+		opts.Region = defaultS3Region
+	}
+	if opts.PartSize == 0 {
+		opts.PartSize = DefaultS3PartSize
+	}
+	if opts.PartSize < MinS3PartSize {
+		return nil, fmt.Errorf("s3 storage: part size %d is below the minimum of %d bytes", opts.PartSize, MinS3PartSize)
+	}
+	if opts.AccessKeyID == "" || opts.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 storage: missing credentials")
+	}
+
+	rawEndpoint := opts.Endpoint
+	if rawEndpoint == "" {
+		rawEndpoint = "https://s3." + opts.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 storage: invalid endpoint %q", rawEndpoint)
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	return &S3{root: root, opts: opts, endpoint: endpoint, client: client, now: time.Now}, nil
+}
+
+// S3Error is an error response of S3
+type S3Error struct {
+	Op         string
+	Key        string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3 %s %s: status %d", e.Op, e.Key, e.StatusCode)
+	}
+	return fmt.Sprintf("s3 %s %s: %s: %s", e.Op, e.Key, e.Code, e.Message)
+}
+
+// BucketFailure reports whether the error affects the whole bucket rather than a
+// single object, e.g. missing permissions or a deleted bucket
+func (e *S3Error) BucketFailure() bool {
+	switch e.Code {
+	case "AccessDenied", "NoSuchBucket", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "AllAccessDisabled":
+		return true
+	}
+	return false
+}
+
+// key returns the object key of the local path p
+func (s *S3) key(p string) (string, error) {
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("s3 storage: %s is outside %s", p, s.root)
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		rel = ""
+	}
+	switch {
+	case s.opts.Prefix == "":
+		return rel, nil
+	case rel == "":
+		return s.opts.Prefix, nil
+	default:
+		return s.opts.Prefix + "/" + rel, nil
+	}
+}
+
+// localPath returns the local path of the object key
+func (s *S3) localPath(key string) string {
+	rel := key
+	if s.opts.Prefix != "" {
+		rel = strings.TrimPrefix(strings.TrimPrefix(key, s.opts.Prefix), "/")
+	}
+	return filepath.Join(s.root, filepath.FromSlash(rel))
+}
+
+// Create implements Storage. Content is buffered up to the part size: smaller
+// files are uploaded with a single request on Commit, larger ones as a multipart
+// upload while they are written.
+func (s *S3) Create(path string, modTime time.Time, etag string) (File, error) {
+	key, err := s.key(path)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	if !modTime.IsZero() {
+		header.Set(s3MetaModTime, modTime.UTC().Format(time.RFC3339Nano))
+	}
+	if etag != "" {
+		header.Set(s3MetaETag, etag)
+	}
+	return &s3File{s: s, key: key, header: header}, nil
+}
+
+// Stat implements Storage
+func (s *S3) Stat(path string) (FileInfo, error) {
+	key, err := s.key(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+
+	info := FileInfo{Size: resp.ContentLength, ETag: resp.Header.Get(s3MetaETag)}
+	if info.ETag == "" {
+		info.ETag = resp.Header.Get("ETag")
+	}
+	if t, err := time.Parse(time.RFC3339Nano, resp.Header.Get(s3MetaModTime)); err == nil {
+		info.ModTime = t
+	} else if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+// MkdirAll implements Storage; S3 has no directories
+func (s *S3) MkdirAll(path string) error {
+	return nil
+}
+
+// RemoveAll implements Storage
+func (s *S3) RemoveAll(path string) error {
+	key, err := s.key(path)
+	if err != nil {
+		return err
+	}
+	err = s.Walk(path, func(p string, info FileInfo) error {
+		objectKey, err := s.key(p)
+		if err != nil {
+			return err
+		}
+		return s.delete(objectKey)
+	})
+	if err != nil {
+		return err
+	}
+	return s.delete(key)
+}
+
+// delete removes a single object; S3 reports success for missing objects too
+func (s *S3) delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listResult is the response of ListObjectsV2
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Walk implements Storage. Objects are listed page by page; their modification
+// time is the time of the upload, as listings carry no metadata.
+func (s *S3) Walk(root string, fn func(path string, info FileInfo) error) error {
+	prefix, err := s.key(root)
+	if err != nil {
+		return err
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var page listResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+
+		for _, object := range page.Contents {
+			info := FileInfo{Size: object.Size, ModTime: object.LastModified, ETag: object.ETag}
+			if err := fn(s.localPath(object.Key), info); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// s3File is an upload in progress
+type s3File struct {
+	s      *S3
+	key    string
+	header http.Header
+	buf    bytes.Buffer
+	// uploadID and parts track a multipart upload once the content outgrew a part
+	uploadID  string
+	parts     []completedPart
+	err       error
+	committed bool
+}
+
+// completedPart is a part of a multipart upload, as listed when completing it
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	f.buf.Write(p)
+	for int64(f.buf.Len()) >= f.s.opts.PartSize {
+		if f.err = f.uploadPart(f.buf.Next(int(f.s.opts.PartSize))); f.err != nil {
+			return 0, f.err
+		}
+	}
+	return len(p), nil
+}
+
+// uploadPart uploads the next part, starting the multipart upload if needed
+func (f *s3File) uploadPart(data []byte) error {
+	if f.uploadID == "" {
+		resp, err := f.s.do("POST", f.key, url.Values{"uploads": {""}}, f.header, nil)
+		if err != nil {
+			return err
+		}
+		var created struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&created)
+		resp.Body.Close()
+		if err != nil || created.UploadID == "" {
+			return fmt.Errorf("s3 create multipart upload %s: invalid response: %v", f.key, err)
+		}
+		f.uploadID = created.UploadID
+	}
+
+	number := len(f.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {f.uploadID}}
+	resp, err := f.s.do("PUT", f.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	f.parts = append(f.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// Commit implements File
+func (f *s3File) Commit() error {
+	if f.err != nil {
+		return f.err
+	}
+	if f.uploadID == "" {
+		resp, err := f.s.do("PUT", f.key, nil, f.header, f.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		f.committed = true
+		return nil
+	}
+
+	if f.buf.Len() > 0 {
+		if err := f.uploadPart(f.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: f.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := f.s.do("POST", f.key, url.Values{"uploadId": {f.uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Completion can fail after the 200 status line was sent
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("s3 complete multipart upload %s: %w", f.key, err)
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		return s3ErrorFromBody("complete multipart upload", f.key, resp.StatusCode, data)
+	}
+	f.committed = true
+	return nil
+}
+
+// Abort implements File
+func (f *s3File) Abort() error {
+	if f.committed || f.uploadID == "" {
+		return nil
+	}
+	resp, err := f.s.do("DELETE", f.key, url.Values{"uploadId": {f.uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for key, or for the bucket if key is empty. Error
+// responses are returned as S3Error; a missing object also matches fs.ErrNotExist.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	plain, escaped := "/"+key, "/"+s3Escape(key, true)
+	if s.opts.PathStyle {
+		plain, escaped = "/"+s.opts.Bucket+plain, "/"+s3Escape(s.opts.Bucket, false)+escaped
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + plain
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + escaped
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s: %w", strings.ToLower(method), key, err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		err := s3ErrorFromBody(strings.ToLower(method), key, resp.StatusCode, data)
+		if resp.StatusCode == http.StatusNotFound && method == "HEAD" {
+			return nil, fmt.Errorf("%w: %w", err, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// s3ErrorFromBody parses an S3 error document
+func s3ErrorFromBody(op, key string, status int, data []byte) *S3Error {
+	s3Err := &S3Error{Op: op, Key: key, StatusCode: status}
+	var doc struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &doc) == nil {
+		s3Err.Code, s3Err.Message = doc.Code, doc.Message
+	}
+	return s3Err
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, signing the
+// host, all headers set on req and the payload hash
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.opts.SecretAccessKey), date)
+	key = hmacSHA256(key, s.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.opts.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by name as Signature Version 4 requires
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and slashes if
+// keepSlash is set
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
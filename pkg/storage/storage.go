@@ -0,0 +1,276 @@
+// Package storage abstracts where mirrored files are written, so that the crawling
+// logic stays the same whether a target lands on a local volume or in a bucket.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jhofer-cloud/http-mirror/pkg/config"
+)
+
+// Storage writes the files of a target. Paths are the local paths the mirror
+// computes below the target directory; backends other than Local map them into
+// their own namespace.
+type Storage interface {
+	// Create starts writing the file at path. Its content only replaces the
+	// current file once committed; modTime and etag describe the upstream file.
+	Create(path string, modTime time.Time, etag string) (File, error)
+	// Stat describes the file at path, or returns an error matching
+	// fs.ErrNotExist if there is none
+	Stat(path string) (FileInfo, error)
+	// MkdirAll creates the directory at path and its parents
+	MkdirAll(path string) error
+	// RemoveAll deletes path and everything below it
+	RemoveAll(path string) error
+	// Walk calls fn for every file below root
+	Walk(root string, fn func(path string, info FileInfo) error) error
+}
+
+// File is a file being written to a Storage
+type File interface {
+	io.Writer
+	// Commit makes the written content visible at the file's path
+	Commit() error
+	// Abort discards the written content; it does nothing after Commit
+	Abort() error
+}
+
+// RandomAccessFile is a File that can also be written and read at any offset, as
+// parallel chunked downloads require. Backends that can only append do not
+// implement it.
+type RandomAccessFile interface {
+	File
+	io.WriterAt
+	io.ReaderAt
+	// Truncate sets the size of the file, preallocating it when growing
+	Truncate(size int64) error
+}
+
+// PartialStorage is a Storage that keeps interrupted downloads as partial files
+// next to their destination, for a later attempt to continue with a range request.
+// Backends that can only store complete files do not implement it.
+type PartialStorage interface {
+	Storage
+	// Partial returns the size of the partial download of the file at path and the
+	// validator its content belongs to, or 0 and "" if there is none to continue
+	Partial(path string) (int64, string)
+	// CreatePartial continues the partial download of the file at path after its
+	// first offset bytes, or starts it over for offset 0. validator is the ETag or
+	// Last-Modified of the upstream content being written.
+	CreatePartial(path string, modTime time.Time, validator string, offset int64) (PartialFile, error)
+}
+
+// PartialFile is a partial download being written. Unlike other files, its content
+// is kept on Abort for a later attempt.
+type PartialFile interface {
+	File
+	io.ReaderAt
+	// Discard removes the partial download, e.g. because its content is corrupt
+	Discard() error
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+	// ETag is the upstream entity tag the file was stored with, if known
+	ETag  string
+	IsDir bool
+}
+
+// Local stores files on the local filesystem. Files are written to temporary
+// files next to their destination and renamed into place when committed, so
+// readers never see a partial file.
+type Local struct{}
+
+// NewLocal creates the local filesystem storage
+func NewLocal() *Local {
+	return &Local{}
+}
+
+// Create implements Storage
+func (l *Local) Create(path string, modTime time.Time, etag string) (File, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), config.TempFilePrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local file: %w", err)
+	}
+	return &localFile{file: file, path: path, modTime: modTime}, nil
+}
+
+// Stat implements Storage
+func (l *Local) Stat(path string) (FileInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: stat.Size(), ModTime: stat.ModTime(), IsDir: stat.IsDir()}, nil
+}
+
+// MkdirAll implements Storage
+func (l *Local) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+// RemoveAll implements Storage
+func (l *Local) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Walk implements Storage; symlinks are not followed
+func (l *Local) Walk(root string, fn func(path string, info FileInfo) error) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, FileInfo{Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// partialValidatorPath returns the file keeping the validator of the partial
+// download of the file at path
+func partialValidatorPath(path string) string {
+	return filepath.Join(filepath.Dir(path), config.PartialValidatorPrefix+filepath.Base(path))
+}
+
+// Partial implements PartialStorage
+func (l *Local) Partial(path string) (int64, string) {
+	validator, err := os.ReadFile(partialValidatorPath(path))
+	if err != nil || len(validator) == 0 {
+		return 0, ""
+	}
+	stat, err := os.Lstat(path + config.PartialSuffix)
+	if err != nil || !stat.Mode().IsRegular() {
+		return 0, ""
+	}
+	return stat.Size(), string(validator)
+}
+
+// CreatePartial implements PartialStorage. The validator is only written once the
+// content of an earlier download is dropped, so it always describes the content.
+func (l *Local) CreatePartial(path string, modTime time.Time, validator string, offset int64) (PartialFile, error) {
+	file, err := os.OpenFile(path+config.PartialSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partial file: %w", err)
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate partial file: %w", err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek partial file: %w", err)
+	}
+	if err := os.WriteFile(partialValidatorPath(path), []byte(validator), 0644); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write partial validator: %w", err)
+	}
+	return &partialFile{localFile: localFile{file: file, path: path, modTime: modTime}}, nil
+}
+
+// partialFile is a download in progress to the partial file of its destination
+type partialFile struct {
+	localFile
+}
+
+// Commit implements File
+func (f *partialFile) Commit() error {
+	if err := f.localFile.Commit(); err != nil {
+		return err
+	}
+	os.Remove(partialValidatorPath(f.path))
+	return nil
+}
+
+// Abort implements File, keeping the partial download
+func (f *partialFile) Abort() error {
+	if f.committed {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// Discard implements PartialFile
+func (f *partialFile) Discard() error {
+	f.file.Close()
+	os.Remove(partialValidatorPath(f.path))
+	if err := os.Remove(f.file.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// localFile is a download in progress to a temporary file
+type localFile struct {
+	file      *os.File
+	path      string
+	modTime   time.Time
+	committed bool
+}
+
+func (f *localFile) Write(p []byte) (int, error) {
+	return f.file.Write(p)
+}
+
+// WriteAt implements RandomAccessFile
+func (f *localFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.file.WriteAt(p, off)
+}
+
+// ReadAt implements RandomAccessFile
+func (f *localFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.file.ReadAt(p, off)
+}
+
+// Truncate implements RandomAccessFile
+func (f *localFile) Truncate(size int64) error {
+	return f.file.Truncate(size)
+}
+
+// Sync flushes the written content to disk
+func (f *localFile) Sync() error {
+	return f.file.Sync()
+}
+
+// Commit implements File
+func (f *localFile) Commit() error {
+	tmpPath := f.file.Name()
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if !f.modTime.IsZero() {
+		os.Chtimes(tmpPath, f.modTime, f.modTime)
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	f.committed = true
+	return nil
+}
+
+// Abort implements File
+func (f *localFile) Abort() error {
+	if f.committed {
+		return nil
+	}
+	f.file.Close()
+	return os.Remove(f.file.Name())
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLocalCreateCommit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewLocal()
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	file, err := store.Create(path, modTime, `"etag"`)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := file.Write([]byte("new content")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Nothing is visible before the commit
+	if data, _ := os.ReadFile(path); string(data) != "previous" {
+		t.Errorf("Expected previous content before commit, got %q", data)
+	}
+	if err := file.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := file.Abort(); err != nil {
+		t.Errorf("Expected Abort after Commit to do nothing, got %v", err)
+	}
+
+	info, err := store.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size != int64(len("new content")) || !info.ModTime.Equal(modTime) || info.IsDir {
+		t.Errorf("Unexpected info %+v", info)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the committed file, found %d entries", len(entries))
+	}
+}
+
+func TestLocalAbortRemovesTemporaryFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+
+	store := NewLocal()
+	file, err := store.Create(path, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	file.Write([]byte("partial"))
+	if err := file.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected no files after abort, found %d entries", len(entries))
+	}
+	if _, err := store.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestLocalPartial(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.iso")
+	store := NewLocal()
+	if offset, validator := store.Partial(path); offset != 0 || validator != "" {
+		t.Errorf("Expected no partial download, got %d %q", offset, validator)
+	}
+
+	// An aborted download is kept with its validator
+	file, err := store.CreatePartial(path, time.Time{}, `"v1"`, 0)
+	if err != nil {
+		t.Fatalf("CreatePartial failed: %v", err)
+	}
+	file.Write([]byte("abc"))
+	if err := file.Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	if offset, validator := store.Partial(path); offset != 3 || validator != `"v1"` {
+		t.Fatalf("Expected 3 bytes for \"v1\", got %d %q", offset, validator)
+	}
+
+	// A continued download appends and is renamed into place
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	file, err = store.CreatePartial(path, modTime, `"v1"`, 3)
+	if err != nil {
+		t.Fatalf("CreatePartial failed: %v", err)
+	}
+	head := make([]byte, 3)
+	if _, err := file.ReadAt(head, 0); err != nil || string(head) != "abc" {
+		t.Errorf("Expected the kept content, got %q (%v)", head, err)
+	}
+	file.Write([]byte("def"))
+	if err := file.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "abcdef" {
+		t.Errorf("Expected the whole content, got %q", data)
+	}
+	if info, _ := store.Stat(path); !info.ModTime.Equal(modTime) {
+		t.Errorf("Expected the upstream modification time, got %v", info.ModTime)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the committed file, found %d entries", len(entries))
+	}
+
+	// Starting over drops the content, discarding removes everything
+	file, _ = store.CreatePartial(path, time.Time{}, `"v1"`, 0)
+	file.Write([]byte("xyz"))
+	file.Abort()
+	file, _ = store.CreatePartial(path, time.Time{}, `"v2"`, 0)
+	if offset, validator := store.Partial(path); offset != 0 || validator != `"v2"` {
+		t.Errorf("Expected an empty partial download for \"v2\", got %d %q", offset, validator)
+	}
+	if err := file.Discard(); err != nil {
+		t.Fatalf("Discard failed: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected no partial files after discarding, found %d entries", len(entries))
+	}
+}
+
+func TestLocalRandomAccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	file, err := NewLocal().Create(path, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	random, ok := file.(RandomAccessFile)
+	if !ok {
+		t.Fatal("Expected local files to support random access")
+	}
+	if err := random.Truncate(10); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	random.WriteAt([]byte("world"), 5)
+	random.WriteAt([]byte("hello"), 0)
+	buf := make([]byte, 10)
+	if _, err := random.ReadAt(buf, 0); err != nil || string(buf) != "helloworld" {
+		t.Errorf("Expected the chunks in order, got %q, %v", buf, err)
+	}
+	if err := file.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "helloworld" {
+		t.Errorf("Expected the committed content, got %q", data)
+	}
+}
+
+func TestLocalWalkAndRemoveAll(t *testing.T) {
+	dir := t.TempDir()
+	store := NewLocal()
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := store.MkdirAll(filepath.Dir(path)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var walked []string
+	err := store.Walk(dir, func(path string, info FileInfo) error {
+		rel, _ := filepath.Rel(dir, path)
+		walked = append(walked, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	sort.Strings(walked)
+	if len(walked) != 3 || walked[0] != "a.txt" || walked[2] != "sub/deeper/c.txt" {
+		t.Errorf("Unexpected walk %v", walked)
+	}
+
+	if err := store.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if _, err := store.Stat(filepath.Join(dir, "sub")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected sub to be removed, got %v", err)
+	}
+	if err := store.Walk(filepath.Join(dir, "missing"), func(string, FileInfo) error { return nil }); err != nil {
+		t.Errorf("Expected walking a missing directory to succeed, got %v", err)
+	}
+}
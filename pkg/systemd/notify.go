@@ -0,0 +1,128 @@
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notifier sends service state notifications to systemd via the sd_notify protocol.
+// When NOTIFY_SOCKET is not set every method is a no-op.
+type Notifier struct {
+	socket           string
+	watchdogInterval time.Duration
+}
+
+// NewNotifier creates a notifier from the NOTIFY_SOCKET and WATCHDOG_USEC environment
+func NewNotifier() *Notifier {
+	n := &Notifier{
+		socket: os.Getenv("NOTIFY_SOCKET"),
+	}
+
+	if n.socket == "" {
+		return n
+	}
+
+	// WATCHDOG_PID, when set, must match our own PID for the watchdog to apply to us
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return n
+	}
+
+	if usec := os.Getenv("WATCHDOG_USEC"); usec != "" {
+		if value, err := strconv.ParseInt(usec, 10, 64); err == nil && value > 0 {
+			n.watchdogInterval = time.Duration(value) * time.Microsecond
+		}
+	}
+
+	return n
+}
+
+// Enabled reports whether a systemd notify socket is available
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.socket != ""
+}
+
+// WatchdogInterval returns the watchdog timeout configured by systemd, or zero if disabled
+func (n *Notifier) WatchdogInterval() time.Duration {
+	if !n.Enabled() {
+		return 0
+	}
+	return n.watchdogInterval
+}
+
+// Notify sends a raw state string (e.g. "READY=1") to the notify socket
+func (n *Notifier) Notify(state string) error {
+	if !n.Enabled() {
+		return nil
+	}
+
+	socketAddr := &net.UnixAddr{
+		Name: n.socket,
+		Net:  "unixgram",
+	}
+
+	// Abstract namespace sockets are announced with a leading '@'
+	if socketAddr.Name[0] == '@' {
+		socketAddr.Name = "\x00" + socketAddr.Name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, socketAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to write to notify socket: %w", err)
+	}
+
+	return nil
+}
+
+// Ready tells systemd that service startup is finished
+func (n *Notifier) Ready() error {
+	return n.Notify("READY=1")
+}
+
+// Reloading tells systemd that the service is reloading its configuration
+func (n *Notifier) Reloading() error {
+	return n.Notify("RELOADING=1")
+}
+
+// Stopping tells systemd that the service is beginning its shutdown
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+// Status sends a free-form status line shown by systemctl status
+func (n *Notifier) Status(status string) error {
+	return n.Notify("STATUS=" + status)
+}
+
+// RunWatchdog pings the systemd watchdog at half the configured interval for as long
+// as healthy reports true. A failing health check withholds the ping so systemd can
+// restart a wedged process. It returns when ctx is cancelled or the watchdog is disabled.
+func (n *Notifier) RunWatchdog(ctx context.Context, healthy func() bool) {
+	interval := n.WatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if healthy != nil && !healthy() {
+				continue
+			}
+			n.Notify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket creates a fake systemd notify socket and points NOTIFY_SOCKET at it
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to create notify socket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	return conn
+}
+
+// readMessage reads a single datagram from the fake notify socket
+func readMessage(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifierDisabledWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	t.Setenv("WATCHDOG_USEC", "1000000")
+
+	notifier := NewNotifier()
+	if notifier.Enabled() {
+		t.Error("Notifier should be disabled without NOTIFY_SOCKET")
+	}
+
+	if err := notifier.Ready(); err != nil {
+		t.Errorf("Ready should be a no-op when disabled, got %v", err)
+	}
+
+	if notifier.WatchdogInterval() != 0 {
+		t.Errorf("Expected no watchdog interval, got %v", notifier.WatchdogInterval())
+	}
+}
+
+func TestNotifierStateMessages(t *testing.T) {
+	conn := listenNotifySocket(t)
+
+	notifier := NewNotifier()
+	if !notifier.Enabled() {
+		t.Fatal("Notifier should be enabled with NOTIFY_SOCKET set")
+	}
+
+	tests := []struct {
+		send     func() error
+		expected string
+	}{
+		{notifier.Ready, "READY=1"},
+		{notifier.Reloading, "RELOADING=1"},
+		{notifier.Stopping, "STOPPING=1"},
+		{func() error { return notifier.Status("serving") }, "STATUS=serving"},
+	}
+
+	for _, tt := range tests {
+		if err := tt.send(); err != nil {
+			t.Fatalf("Failed to send %s: %v", tt.expected, err)
+		}
+		if msg := readMessage(t, conn); msg != tt.expected {
+			t.Errorf("Expected message %q, got %q", tt.expected, msg)
+		}
+	}
+}
+
+func TestNotifierWatchdogInterval(t *testing.T) {
+	listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "2000000")
+
+	notifier := NewNotifier()
+	if notifier.WatchdogInterval() != 2*time.Second {
+		t.Errorf("Expected watchdog interval 2s, got %v", notifier.WatchdogInterval())
+	}
+
+	// A watchdog addressed to another process must be ignored
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	notifier = NewNotifier()
+	if notifier.WatchdogInterval() != 0 {
+		t.Errorf("Expected watchdog to be ignored for foreign PID, got %v", notifier.WatchdogInterval())
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	notifier := NewNotifier()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go notifier.RunWatchdog(ctx, func() bool { return true })
+
+	if msg := readMessage(t, conn); msg != "WATCHDOG=1" {
+		t.Errorf("Expected WATCHDOG=1, got %q", msg)
+	}
+}
+
+func TestRunWatchdogWithholdsPingWhenUnhealthy(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	notifier := NewNotifier()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go notifier.RunWatchdog(ctx, func() bool { return false })
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("Expected no watchdog ping while unhealthy, got %q", string(buf[:n]))
+	}
+}